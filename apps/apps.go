@@ -1,15 +1,17 @@
 package apps
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"io"
 	"net/url"
 	"path"
 	"regexp"
+	"time"
 
 	"github.com/dcasier/cozy-stack/couchdb"
 	"github.com/dcasier/cozy-stack/couchdb/mango"
+	"github.com/dcasier/cozy-stack/logger"
 	"github.com/dcasier/cozy-stack/vfs"
 	"github.com/dcasier/cozy-stack/web/jsonapi"
 )
@@ -17,6 +19,8 @@ import (
 const (
 	// ManifestDocType is manifest type
 	ManifestDocType = "io.cozy.manifests"
+	// KonnectorDocType is the type of the manifests of the konnectors
+	KonnectorDocType = "io.cozy.konnectors"
 	// ManifestMaxSize is the manifest maximum size
 	ManifestMaxSize = 2 << (2 * 10) // 2MB
 )
@@ -24,6 +28,52 @@ const (
 // AppsDirectory is the name of the directory in which apps are stored
 const AppsDirectory = "/_cozyapps"
 
+// KonnectorsDirectory is the name of the directory in which konnectors are
+// stored
+const KonnectorsDirectory = "/_cozykonnectors"
+
+// AppType is the type of an application: a webapp, served to the browser,
+// or a konnector, that fetches data from an external service
+type AppType string
+
+const (
+	// Webapp is the type of the applications with routes, served on the
+	// subdomains of the instance
+	Webapp AppType = "webapp"
+	// Konnector is the type of the data connectors, that declare an
+	// executable entrypoint instead of routes
+	Konnector AppType = "konnector"
+)
+
+// DocType returns the doctype of the manifests of this type of application
+func (t AppType) DocType() string {
+	if t == Konnector {
+		return KonnectorDocType
+	}
+	return ManifestDocType
+}
+
+// Directory returns the directory of the VFS in which the applications of
+// this type are stored
+func (t AppType) Directory() string {
+	if t == Konnector {
+		return KonnectorsDirectory
+	}
+	return AppsDirectory
+}
+
+// manifestFilename returns the name of the manifest file in the sources of
+// this type of application
+func (t AppType) manifestFilename() string {
+	if t == Konnector {
+		return konnectorManifestFilename
+	}
+	return manifestFilename
+}
+
+// listPageSize is the number of manifests fetched by each request of List
+const listPageSize = 100
+
 // State is the state of the application
 type State string
 
@@ -64,6 +114,15 @@ var (
 // either be read, write or readwrite.
 type Access string
 
+const (
+	// ReadAccess allows to read the documents or files
+	ReadAccess Access = "read"
+	// WriteAccess allows to create, modify and delete documents or files
+	WriteAccess Access = "write"
+	// ReadWriteAccess allows both reading and writing
+	ReadWriteAccess Access = "readwrite"
+)
+
 // Permissions is a map of key, a description and an access level.
 type Permissions map[string]*struct {
 	Description string `json:"description"`
@@ -94,9 +153,53 @@ type Manifest struct {
 		Description string `json:"description"`
 	} `json:"locales"`
 
-	Version     string       `json:"version"`
+	Version string `json:"version"`
+	// PreviousVersion is the version before the last update, that can be
+	// restored from the .<slug>.old directory
+	PreviousVersion string `json:"previous_version,omitempty"`
+	// Previous is the manifest of the previous version, restored with its
+	// files by a rollback
+	Previous *Manifest `json:"previous,omitempty"`
+	// Commit is the hash of the installed commit, for the git sources
+	Commit string `json:"commit,omitempty"`
+	// Checksum is the sha256 of the installed package, verified before its
+	// files were written, for the archive and registry sources
+	Checksum    string       `json:"checksum,omitempty"`
 	License     string       `json:"license"`
 	Permissions *Permissions `json:"permissions"`
+	Routes      Routes       `json:"routes,omitempty"`
+	// Intents are the actions that the application can handle for the
+	// other applications, and Services its scripts run by the stack
+	Intents  []*Intent           `json:"intents,omitempty"`
+	Services map[string]*Service `json:"services,omitempty"`
+	// CSP are the sources added to the Content-Security-Policy of the files
+	// of the application
+	CSP CSP `json:"csp,omitempty"`
+	// Scopes are the permissions of the manifest, parsed when the
+	// application is installed or updated
+	Scopes Scopes `json:"scopes,omitempty"`
+	// Token is the token issued to the application when it is installed or
+	// updated, with its scopes. It is injected in the index of its routes.
+	Token string `json:"token,omitempty"`
+
+	// ErroredAt is the date of the failure of the last installation or
+	// update, and ErroredOp this operation, for the errored applications.
+	// They are used to collect the files left by the failed installations.
+	ErroredAt *time.Time `json:"errored_at,omitempty"`
+	ErroredOp string     `json:"errored_op,omitempty"`
+
+	// Type is webapp or konnector, webapp if it is empty
+	Type AppType `json:"type,omitempty"`
+	// Entrypoint is the path of the executable file of a konnector
+	Entrypoint string `json:"entrypoint,omitempty"`
+}
+
+// AppType returns the type of the application of the manifest
+func (m *Manifest) AppType() AppType {
+	if m.Type == Konnector {
+		return Konnector
+	}
+	return Webapp
 }
 
 // ID returns the manifest identifier - see couchdb.Doc interface
@@ -106,7 +209,7 @@ func (m *Manifest) ID() string { return m.ManID }
 func (m *Manifest) Rev() string { return m.ManRev }
 
 // DocType returns the manifest doctype - see couchdb.Doc interfaces
-func (m *Manifest) DocType() string { return ManifestDocType }
+func (m *Manifest) DocType() string { return m.AppType().DocType() }
 
 // SetID is used to change the file identifier - see couchdb.Doc
 // interface
@@ -118,7 +221,12 @@ func (m *Manifest) SetRev(rev string) { m.ManRev = rev }
 
 // SelfLink is used to generate a JSON-API link for the file - see
 // jsonapi.Object interface
-func (m *Manifest) SelfLink() string { return "/apps/" + m.ManID }
+func (m *Manifest) SelfLink() string {
+	if m.AppType() == Konnector {
+		return "/konnectors/" + m.ManID
+	}
+	return "/apps/" + m.ManID
+}
 
 // Relationships is used to generate the parent relationship in JSON-API format
 // - see jsonapi.Object interface
@@ -142,18 +250,122 @@ type Client interface {
 	Fetch(vfsC *vfs.Context, appdir string) error
 }
 
-// List returns the list of installed applications.
-//
-// TODO: pagination
-func List(db string) ([]*Manifest, error) {
-	var docs []*Manifest
-	sel := mango.Empty()
-	req := &couchdb.FindRequest{Selector: sel, Limit: 10}
-	err := couchdb.FindDocs(db, ManifestDocType, req, &docs)
+// committer is implemented by the clients that can tell which commit has
+// been fetched, like the git one
+type committer interface {
+	Commit() string
+}
+
+// fetchedCommit returns the commit fetched by the client, or an empty
+// string if the client has no notion of commit
+func fetchedCommit(cli Client) string {
+	if c, ok := cli.(committer); ok {
+		return c.Commit()
+	}
+	return ""
+}
+
+// GetBySlug returns the manifest of the installed application with the
+// given type and slug
+func GetBySlug(ctx context.Context, db string, typ AppType, slug string) (*Manifest, error) {
+	man := &Manifest{}
+	if err := couchdb.GetDoc(ctx, db, typ.DocType(), slug, man); err != nil {
+		return nil, err
+	}
+	return man, nil
+}
+
+// newClient returns the client used to fetch an application from its
+// source. creds can be nil for the public sources. The manifest fetched by
+// the client is the one of the given type of application.
+func newClient(vfsC *vfs.Context, typ AppType, src string, creds *Credentials) (Client, error) {
+	parsedSrc, err := url.Parse(src)
 	if err != nil {
 		return nil, err
 	}
-	return docs, nil
+
+	switch parsedSrc.Scheme {
+	case "git", "file":
+		// the git repositories and local directories can't be signed
+		if requireSignature {
+			return nil, ErrMissingSignature
+		}
+	}
+
+	switch parsedSrc.Scheme {
+	case "git":
+		return newGitClient(vfsC, typ, src, creds), nil
+	case "registry":
+		return newRegistryClient(typ, parsedSrc)
+	case "http", "https":
+		return newArchiveClient(typ, parsedSrc)
+	case "file":
+		return newLocalClient(typ, parsedSrc)
+	}
+	return nil, ErrNotSupportedSource
+}
+
+// List returns the list of installed applications of the given type.
+func List(ctx context.Context, db string, typ AppType) ([]*Manifest, error) {
+	var all []*Manifest
+	req := &couchdb.FindRequest{Selector: mango.Empty(), Limit: listPageSize}
+	for {
+		var docs []*Manifest
+		res, err := couchdb.FindDocsRaw(ctx, db, typ.DocType(), req, &docs)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, docs...)
+		if len(docs) < listPageSize {
+			return all, nil
+		}
+		req.Bookmark = res.Bookmark
+	}
+}
+
+// ListOptions are the filter and the pagination of a ListPage request
+type ListOptions struct {
+	// State keeps only the applications in this state, if not empty
+	State State
+	// Limit is the maximal number of manifests returned by the request
+	Limit int
+	// Cursor is the bookmark returned by the previous page, if any
+	Cursor string
+}
+
+// ListPage returns a page of the installed applications of the given type,
+// with the cursor of the next page (empty for the last page), and the total
+// number of applications matching the filter.
+func ListPage(ctx context.Context, db string, typ AppType, opts *ListOptions) ([]*Manifest, string, int, error) {
+	var selector mango.Filter
+	if opts.State != "" {
+		selector = mango.Equal("state", opts.State)
+	}
+	limit := opts.Limit
+	if limit <= 0 || limit > listPageSize {
+		limit = listPageSize
+	}
+	total, err := couchdb.CountDocs(ctx, db, typ.DocType(), selector)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if selector == nil {
+		selector = mango.Empty()
+	}
+	req := &couchdb.FindRequest{Selector: selector, Limit: limit, Bookmark: opts.Cursor}
+	var docs []*Manifest
+	res, err := couchdb.FindDocsRaw(ctx, db, typ.DocType(), req, &docs)
+	if couchdb.IsNoDatabaseError(err) {
+		return []*Manifest{}, "", 0, nil
+	}
+	if err != nil {
+		return nil, "", 0, err
+	}
+	var next string
+	if len(docs) == limit {
+		next = res.Bookmark
+	}
+	return docs, next, total, nil
 }
 
 // Installer is used to install or update applications.
@@ -161,9 +373,11 @@ type Installer struct {
 	cli Client
 
 	// TODO: fix this mess with contexts
+	ctx  context.Context
 	db   string
 	vfsC *vfs.Context
 
+	typ  AppType
 	slug string
 	src  string
 	man  *Manifest
@@ -173,45 +387,48 @@ type Installer struct {
 	manc chan *Manifest
 }
 
-// NewInstaller creates a new Installer
+// NewInstaller creates a new Installer for an application of the given
+// type. The installation goes on after the response to the HTTP request,
+// so ctx should not be the context of this request.
 // @TODO: fix this mess with contexts
-func NewInstaller(vfsC *vfs.Context, db, slug, src string) (*Installer, error) {
+func NewInstaller(ctx context.Context, vfsC *vfs.Context, db string, typ AppType, slug, src string) (*Installer, error) {
 	if !slugReg.MatchString(slug) {
 		return nil, ErrInvalidSlugName
 	}
 
-	parsedSrc, err := url.Parse(src)
+	src, creds, err := sourceCredentials(ctx, db, src)
 	if err != nil {
 		return nil, err
 	}
 
-	var cli Client
-	switch parsedSrc.Scheme {
-	case "git":
-		cli = newGitClient(vfsC, src)
-	default:
-		err = ErrNotSupportedSource
-	}
-
+	cli, err := newClient(vfsC, typ, src, creds)
 	if err != nil {
 		return nil, err
 	}
 
 	inst := &Installer{
 		cli:  cli,
+		ctx:  ctx,
 		db:   db,
 		vfsC: vfsC,
 
+		typ:  typ,
 		slug: slug,
 		src:  src,
 
 		errc: make(chan error),
 		manc: make(chan *Manifest),
 	}
+	inst.watchProgress()
 
 	return inst, err
 }
 
+// Source returns the source of the application, without its credentials
+func (i *Installer) Source() string {
+	return i.src
+}
+
 // Install will install the application linked to the installer. It
 // will report its progress or error using the WaitManifest method.
 func (i *Installer) Install() (newman *Manifest, err error) {
@@ -219,8 +436,27 @@ func (i *Installer) Install() (newman *Manifest, err error) {
 		return nil, i.err
 	}
 
+	// the lock is released last, after the errored state is persisted
+	unlock, err := lock(i.ctx, i.db, i.slug)
+	if err != nil {
+		return nil, i.handleErr(err)
+	}
+	defer unlock()
+
 	defer func() {
 		if err != nil {
+			// the state is persisted, so that the installation can be
+			// retried, even after a restart of the stack, and the partial
+			// files (like the .git directory of a clone) are removed
+			if i.man != nil && i.man.State == Installing {
+				errored := *i.man
+				setErrored(&errored, installOperation)
+				couchdb.UpdateDoc(i.ctx, i.db, &errored)
+				appdir := path.Join(i.typ.Directory(), i.slug)
+				if errc := removeDir(i.vfsC, appdir); errc != nil {
+					logger.Errorf("apps", "cannot clean the files of %s: %v", i.slug, errc)
+				}
+			}
 			err = i.handleErr(err)
 		}
 	}()
@@ -243,18 +479,33 @@ func (i *Installer) Install() (newman *Manifest, err error) {
 		return
 	}
 
-	appdir := path.Join(AppsDirectory, newman.Slug)
+	appdir := path.Join(i.typ.Directory(), newman.Slug)
 	err = i.vfsC.MkdirAll(appdir)
 	if err != nil {
 		return
 	}
 
+	i.notify(StepFetching, nil)
 	err = i.cli.Fetch(i.vfsC, appdir)
 	if err != nil {
 		return
 	}
+	err = checkEntrypoint(i.vfsC, newman, appdir)
+	if err != nil {
+		return
+	}
 
+	newman.Commit = fetchedCommit(i.cli)
+	newman.Checksum = verifiedChecksum(i.cli)
+	if i.typ == Webapp {
+		err = issueAppToken(i.ctx, i.db, newman)
+		if err != nil {
+			return
+		}
+	}
 	newman.State = Ready
+	newman.ErroredAt = nil
+	newman.ErroredOp = ""
 	err = i.updateManifest(newman)
 	if err != nil {
 		return
@@ -266,11 +517,36 @@ func (i *Installer) Install() (newman *Manifest, err error) {
 func (i *Installer) handleErr(err error) error {
 	if i.err == nil {
 		i.err = err
+		i.notify(StepError, err)
 		i.errc <- err
 	}
 	return i.err
 }
 
+// notify sends an event with the current state of the application to the
+// clients that follow its progress
+func (i *Installer) notify(step string, err error) {
+	ev := &Event{Slug: i.slug, Step: step}
+	if i.man != nil {
+		ev.State = i.man.State
+	}
+	if step == StepError {
+		ev.State = Errored
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	publish(i.db, ev)
+}
+
+// watchProgress sends the steps of the fetch as events, if the client can
+// report them
+func (i *Installer) watchProgress() {
+	if p, ok := i.cli.(progressReporter); ok {
+		p.setProgress(func(step string) { i.notify(step, nil) })
+	}
+}
+
 func (i *Installer) getOrCreateManifest(src, slug string) (man *Manifest, err error) {
 	if i.err != nil {
 		return nil, err
@@ -289,8 +565,7 @@ func (i *Installer) getOrCreateManifest(src, slug string) (man *Manifest, err er
 		panic("Manifest is already defined")
 	}
 
-	man = &Manifest{}
-	err = couchdb.GetDoc(i.db, ManifestDocType, slug, man)
+	man, err = GetBySlug(i.ctx, i.db, i.typ, slug)
 	if err != nil && !couchdb.IsNotFoundError(err) {
 		return nil, err
 	}
@@ -298,25 +573,34 @@ func (i *Installer) getOrCreateManifest(src, slug string) (man *Manifest, err er
 		return man, nil
 	}
 
-	r, err := i.cli.FetchManifest()
+	man, err = i.fetchManifest()
 	if err != nil {
 		return nil, err
 	}
 
-	defer r.Close()
-	err = json.NewDecoder(io.LimitReader(r, ManifestMaxSize)).Decode(&man)
-	if err != nil {
-		return nil, ErrBadManifest
-	}
-
 	man.Slug = slug
 	man.Source = src
 	man.State = Available
 
-	err = couchdb.CreateDoc(i.db, man)
+	// the manifest is identified by the slug, to find it with GetBySlug
+	man.SetID(slug)
+	man.SetRev("")
+	err = couchdb.CreateNamedDocWithDB(i.ctx, i.db, man)
 	return
 }
 
+// fetchManifest fetches and parses the manifest from the source of the
+// application
+func (i *Installer) fetchManifest() (*Manifest, error) {
+	r, err := i.cli.FetchManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+	return parseManifest(r, i.typ)
+}
+
 func (i *Installer) updateManifest(newman *Manifest) (err error) {
 	if i.err != nil {
 		return err
@@ -327,6 +611,11 @@ func (i *Installer) updateManifest(newman *Manifest) (err error) {
 			err = i.handleErr(err)
 		} else {
 			i.man = newman
+			step := ""
+			if newman.State == Ready {
+				step = StepDone
+			}
+			i.notify(step, nil)
 			i.manc <- newman
 		}
 	}()
@@ -339,7 +628,7 @@ func (i *Installer) updateManifest(newman *Manifest) (err error) {
 	newman.SetID(oldman.ID())
 	newman.SetRev(oldman.Rev())
 
-	return couchdb.UpdateDoc(i.db, newman)
+	return couchdb.UpdateDoc(i.ctx, i.db, newman)
 }
 
 // WaitManifest should be used to monitor the progress of the
@@ -0,0 +1,329 @@
+package apps
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/dcasier/cozy-stack/vfs"
+)
+
+// Kinds of archives
+const (
+	tarGzArchive = "tar.gz"
+	zipArchive   = "zip"
+)
+
+// errNoManifestInArchive is used when an archive has no manifest
+var errNoManifestInArchive = errors.New("No manifest.webapp in the archive")
+
+// archiveClient is the client for the applications published as an
+// archive, like https://example.org/releases/app-1.2.3.tar.gz
+type archiveClient struct {
+	src      string
+	kind     string
+	manifest string
+
+	pinned   []byte
+	checksum string
+}
+
+func newArchiveClient(typ AppType, src *url.URL) (*archiveClient, error) {
+	kind := archiveKind(src.Path)
+	if kind == "" {
+		return nil, ErrNotSupportedSource
+	}
+	return &archiveClient{src: src.String(), kind: kind, manifest: typ.manifestFilename()}, nil
+}
+
+// archiveKind returns the kind of archive from its filename, or an empty
+// string if it is not supported
+func archiveKind(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return tarGzArchive
+	case strings.HasSuffix(name, ".zip"):
+		return zipArchive
+	}
+	return ""
+}
+
+// PinChecksum sets the sha256 checksum that the archive must match
+func (a *archiveClient) PinChecksum(checksum string) error {
+	sum, err := parseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	a.pinned = sum
+	return nil
+}
+
+// Checksum returns the checksum of the archive verified by the last call
+// to Fetch
+func (a *archiveClient) Checksum() string {
+	return a.checksum
+}
+
+// download downloads the archive and checks its integrity, with the pinned
+// checksum and the detached signature published as <archive>.sig
+func (a *archiveClient) download() (*os.File, []byte, error) {
+	h := sha256.New()
+	f, err := downloadFile(a.src, h)
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := h.Sum(nil)
+	sig, err := fetchSignature(a.src + ".sig")
+	if err == nil {
+		err = verifyPackage(digest, a.pinned, sig)
+	}
+	if err != nil {
+		removeTempFile(f)
+		return nil, nil, err
+	}
+	return f, digest, nil
+}
+
+func (a *archiveClient) FetchManifest() (io.ReadCloser, error) {
+	f, _, err := a.download()
+	if err != nil {
+		return nil, err
+	}
+	defer removeTempFile(f)
+
+	root, err := archiveRoot(f, a.kind, a.manifest)
+	if err == errNoManifestInArchive {
+		return nil, ErrBadManifest
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest []byte
+	manpath := path.Join(root, a.manifest)
+	err = walkArchive(f, a.kind, func(name string, isDir bool, r io.Reader) error {
+		if name != manpath {
+			return nil
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(r, ManifestMaxSize))
+		if err == nil {
+			manifest = b
+			err = errStopWalk
+		}
+		return err
+	})
+	if err != errStopWalk {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(manifest)), nil
+}
+
+func (a *archiveClient) Fetch(vfsC *vfs.Context, appdir string) error {
+	f, digest, err := a.download()
+	if err != nil {
+		return err
+	}
+	defer removeTempFile(f)
+	if err = extractArchive(vfsC, f, a.kind, a.manifest, appdir); err != nil {
+		return err
+	}
+	a.checksum = formatChecksum(digest)
+	return nil
+}
+
+// downloadFile downloads a file in a temporary file, while it is also
+// written to w (for example to compute its checksum). The caller must
+// remove the file, with removeTempFile.
+func downloadFile(rawurl string, w io.Writer) (*os.File, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, ErrSourceNotReachable
+	}
+	return downloadRequest(req, w)
+}
+
+// downloadRequest is like downloadFile, for a request that needs some
+// headers, like the credentials of a private repository
+func downloadRequest(req *http.Request, w io.Writer) (*os.File, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, ErrSourceNotReachable
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, ErrSourceNotReachable
+	}
+
+	tmp, err := ioutil.TempFile("", "cozy-app")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(io.MultiWriter(tmp, w), resp.Body)
+	if err == nil {
+		_, err = tmp.Seek(0, 0)
+	}
+	if err != nil {
+		removeTempFile(tmp)
+		return nil, err
+	}
+	return tmp, nil
+}
+
+func removeTempFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// walkArchive calls fn for each file and directory of the archive, with
+// its absolute name, like /assets/app.js
+func walkArchive(f *os.File, kind string, fn func(name string, isDir bool, r io.Reader) error) error {
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+
+	if kind == zipArchive {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return err
+		}
+		for _, zf := range zr.File {
+			if err = walkZipFile(zf, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = fn(path.Clean("/"+hdr.Name), true, nil)
+		case tar.TypeReg, tar.TypeRegA:
+			err = fn(path.Clean("/"+hdr.Name), false, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func walkZipFile(zf *zip.File, fn func(name string, isDir bool, r io.Reader) error) error {
+	name := path.Clean("/" + zf.Name)
+	if zf.FileInfo().IsDir() {
+		return fn(name, true, nil)
+	}
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return fn(name, false, r)
+}
+
+// errStopWalk is returned by the walk functions to stop walking an archive
+var errStopWalk = errors.New("Stop walking the archive")
+
+// archiveRoot returns the directory of the archive with the manifest (like
+// manifest.webapp): the root of the archive, or a top-level directory, like
+// app-1.2.3/
+func archiveRoot(f *os.File, kind, manifest string) (string, error) {
+	root := ""
+	err := walkArchive(f, kind, func(name string, isDir bool, r io.Reader) error {
+		if isDir || path.Base(name) != manifest {
+			return nil
+		}
+		switch strings.Count(name, "/") {
+		case 1:
+			root = "/"
+			return errStopWalk
+		case 2:
+			if root == "" {
+				root = path.Dir(name)
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errStopWalk {
+		return "", err
+	}
+	if root == "" {
+		return "", errNoManifestInArchive
+	}
+	return root, nil
+}
+
+// extractArchive writes the files of an archive in the given directory of
+// the VFS. If the manifest is in a top-level directory of the archive,
+// only the content of this directory is written.
+func extractArchive(vfsC *vfs.Context, f *os.File, kind, manifest, appdir string) error {
+	root, err := archiveRoot(f, kind, manifest)
+	if err == errNoManifestInArchive {
+		root = "/"
+	} else if err != nil {
+		return err
+	}
+
+	return walkArchive(f, kind, func(name string, isDir bool, r io.Reader) error {
+		if root != "/" {
+			if !strings.HasPrefix(name, root+"/") {
+				return nil
+			}
+			name = strings.TrimPrefix(name, root)
+		}
+		if name == "/" {
+			return nil
+		}
+		abs := path.Join(appdir, name)
+		if isDir {
+			return vfsC.MkdirAll(abs)
+		}
+		if err := vfsC.MkdirAll(path.Dir(abs)); err != nil {
+			return err
+		}
+		return writeFile(vfsC, abs, r)
+	})
+}
+
+func writeFile(vfsC *vfs.Context, name string, r io.Reader) (err error) {
+	file, err := vfsC.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	_, err = io.Copy(file, r)
+	return err
+}
+
+var _ Client = &archiveClient{}
+var _ verifier = &archiveClient{}
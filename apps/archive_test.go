@@ -0,0 +1,115 @@
+package apps
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var archiveFiles = map[string]string{
+	"mini-1.0.0/manifest.webapp": `{"name": "Mini", "version": "1.0.0"}`,
+	"mini-1.0.0/index.html":      "<!DOCTYPE html><html><body>mini</body></html>",
+	"mini-1.0.0/assets/app.js":   "console.log('mini')",
+}
+
+func makeTarGz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestArchiveKind(t *testing.T) {
+	assert.Equal(t, tarGzArchive, archiveKind("/releases/mini-1.0.0.tar.gz"))
+	assert.Equal(t, tarGzArchive, archiveKind("/releases/mini.tgz"))
+	assert.Equal(t, zipArchive, archiveKind("/releases/mini.zip"))
+	assert.Equal(t, "", archiveKind("/mini.git"))
+
+	src, _ := url.Parse("https://example.org/mini.git")
+	_, err := newArchiveClient(Webapp, src)
+	assert.Equal(t, ErrNotSupportedSource, err)
+}
+
+func TestArchiveFetchManifest(t *testing.T) {
+	noManifest := map[string]string{"index.html": "<html></html>"}
+	archives := map[string][]byte{
+		"/mini.tar.gz":    makeTarGz(t, archiveFiles),
+		"/mini.zip":       makeZip(t, archiveFiles),
+		"/root.tar.gz":    makeTarGz(t, map[string]string{"manifest.webapp": `{"name": "Root"}`}),
+		"/nomanifest.zip": makeZip(t, noManifest),
+		"/nomanifest.tgz": makeTarGz(t, noManifest),
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if content, ok := archives[r.URL.Path]; ok {
+			w.Write(content)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	fetch := func(name string) (*Manifest, error) {
+		src, _ := url.Parse(ts.URL + name)
+		cli, err := newArchiveClient(Webapp, src)
+		if err != nil {
+			return nil, err
+		}
+		r, err := cli.FetchManifest()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		man := &Manifest{}
+		err = json.NewDecoder(r).Decode(man)
+		return man, err
+	}
+
+	for _, name := range []string{"/mini.tar.gz", "/mini.zip"} {
+		man, err := fetch(name)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Mini", man.Name)
+			assert.Equal(t, "1.0.0", man.Version)
+		}
+	}
+
+	man, err := fetch("/root.tar.gz")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Root", man.Name)
+	}
+
+	_, err = fetch("/nomanifest.zip")
+	assert.Equal(t, ErrBadManifest, err)
+	_, err = fetch("/nomanifest.tgz")
+	assert.Equal(t, ErrBadManifest, err)
+	_, err = fetch("/missing.zip")
+	assert.Equal(t, ErrSourceNotReachable, err)
+}
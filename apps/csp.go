@@ -0,0 +1,124 @@
+package apps
+
+import (
+	"net/url"
+	"strings"
+)
+
+// CSP are the sources that an application adds to some directives of the
+// Content-Security-Policy of its files, declared in its manifest, like
+// {"img-src": "https://tile.openstreetmap.org"}. The values are lists of
+// sources separated by spaces.
+type CSP map[string]string
+
+// cspDirectives are the directives that an application can extend in its
+// manifest. The scripts can only come from the application itself.
+var cspDirectives = []string{
+	"connect-src", "font-src", "frame-src", "img-src", "media-src", "style-src",
+}
+
+// cspSchemes are the scheme sources accepted in the manifest, for the
+// directives of the contents that can't run code
+var cspSchemes = map[string]bool{"data:": true, "blob:": true}
+
+func isCSPDirective(directive string) bool {
+	for _, d := range cspDirectives {
+		if d == directive {
+			return true
+		}
+	}
+	return false
+}
+
+// validCSPSource returns true for the sources that an application can add
+// to the policy: https or wss hosts, with an optional path, and some
+// schemes for the medias. The wildcards, the keywords like 'unsafe-inline'
+// and the plain http sources are refused.
+func validCSPSource(directive, src string) bool {
+	if cspSchemes[src] {
+		return directive != "connect-src" && directive != "frame-src"
+	}
+	if strings.ContainsAny(src, ";,'\"*") {
+		return false
+	}
+	u, err := url.Parse(src)
+	if err != nil || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "wss":
+		return directive == "connect-src"
+	}
+	return false
+}
+
+// Sources returns the sources declared for a directive
+func (c CSP) Sources(directive string) []string {
+	return strings.Fields(c[directive])
+}
+
+// Policy returns the Content-Security-Policy of the files of an
+// application: the scripts and the other contents come from the application
+// itself, it can call the API of the stack on stackOrigin (and its realtime
+// on wsOrigin), embed and be embedded by the other applications of the
+// instance, on appsOrigin, and use the sources declared in its manifest.
+func (c CSP) Policy(stackOrigin, wsOrigin, appsOrigin string) string {
+	sources := map[string][]string{
+		"default-src":     {"'none'"},
+		"script-src":      {"'self'"},
+		"style-src":       {"'self'"},
+		"img-src":         {"'self'", "data:", "blob:"},
+		"font-src":        {"'self'"},
+		"media-src":       {"'self'", "blob:"},
+		"connect-src":     {"'self'", stackOrigin, wsOrigin},
+		"frame-src":       {appsOrigin},
+		"frame-ancestors": {"'self'", stackOrigin, appsOrigin},
+		"form-action":     {"'self'", stackOrigin},
+		"base-uri":        {"'self'"},
+		"object-src":      {"'none'"},
+	}
+	order := []string{
+		"default-src", "script-src", "style-src", "img-src", "font-src",
+		"media-src", "connect-src", "frame-src", "frame-ancestors",
+		"form-action", "base-uri", "object-src",
+	}
+	for _, directive := range cspDirectives {
+		for _, src := range c.Sources(directive) {
+			if validCSPSource(directive, src) {
+				sources[directive] = append(sources[directive], src)
+			}
+		}
+	}
+	parts := make([]string, len(order))
+	for i, directive := range order {
+		parts[i] = directive + " " + strings.Join(sources[directive], " ")
+	}
+	return strings.Join(parts, "; ")
+}
+
+// validateCSP checks the csp section of the manifest of a webapp
+func (v *manifestValidator) validateCSP(raw map[string]interface{}) {
+	csp, ok := v.object(raw, "csp", "csp", false)
+	if !ok {
+		return
+	}
+	for _, directive := range sortedKeys(csp) {
+		field := "csp." + directive
+		if !isCSPDirective(directive) {
+			v.fail(field, "must be one of "+strings.Join(cspDirectives, ", "))
+			continue
+		}
+		val, ok := v.str(csp, directive, field, true)
+		if !ok {
+			continue
+		}
+		for _, src := range strings.Fields(val) {
+			if !validCSPSource(directive, src) {
+				v.fail(field, "invalid source "+src+": must be an https host, without wildcard")
+				break
+			}
+		}
+	}
+}
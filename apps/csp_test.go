@@ -0,0 +1,75 @@
+package apps
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseManifestCSP(t *testing.T) {
+	man, err := parseManifestString(`{
+  "name": "Maps", "slug": "maps", "version": "1.0.0", "permissions": {},
+  "routes": {"/": {"index": "index.html"}},
+  "csp": {
+    "img-src": "https://tile.openstreetmap.org data:",
+    "connect-src": "https://api.example.com wss://push.example.com"
+  }
+}`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"https://tile.openstreetmap.org", "data:"}, man.CSP.Sources("img-src"))
+	}
+
+	_, err = parseManifestString(`{
+  "name": "Maps", "slug": "maps", "version": "1.0.0", "permissions": {},
+  "routes": {"/": {"index": "index.html"}},
+  "csp": {
+    "script-src": "https://cdn.example.com",
+    "img-src": "http://tile.openstreetmap.org",
+    "style-src": "'unsafe-inline'",
+    "connect-src": "https://*.example.com",
+    "frame-src": "data:",
+    "font-src": 42
+  }
+}`)
+	errs, ok := err.(ManifestErrors)
+	if !assert.True(t, ok) {
+		return
+	}
+	fields := make(map[string]string)
+	for _, e := range errs {
+		fields[e.Field] = e.Reason
+	}
+	assert.Contains(t, fields["csp.script-src"], "must be one of")
+	assert.Contains(t, fields["csp.img-src"], "invalid source")
+	assert.Contains(t, fields["csp.style-src"], "invalid source")
+	assert.Contains(t, fields["csp.connect-src"], "invalid source")
+	assert.Contains(t, fields["csp.frame-src"], "invalid source")
+	assert.Equal(t, "must be a string", fields["csp.font-src"])
+	assert.Len(t, errs, 6)
+
+	_, err = parseManifest(strings.NewReader(`{
+  "name": "Bank", "slug": "bank", "version": "1.0.0", "permissions": {},
+  "entrypoint": "index.js", "csp": {}
+}`), Konnector)
+	errs, ok = err.(ManifestErrors)
+	if assert.True(t, ok) && assert.Len(t, errs, 1) {
+		assert.Equal(t, "csp", errs[0].Field)
+	}
+}
+
+func TestCSPPolicy(t *testing.T) {
+	csp := CSP{"img-src": "https://tile.openstreetmap.org", "connect-src": "'unsafe-eval'"}
+	policy := csp.Policy("https://alice.example.com", "wss://alice.example.com", "https://*.alice.example.com")
+	directives := make(map[string]string)
+	for _, d := range strings.Split(policy, "; ") {
+		parts := strings.SplitN(d, " ", 2)
+		directives[parts[0]] = parts[1]
+	}
+	assert.Equal(t, "'none'", directives["default-src"])
+	assert.Equal(t, "'self'", directives["script-src"])
+	assert.Equal(t, "'self' data: blob: https://tile.openstreetmap.org", directives["img-src"])
+	assert.Equal(t, "'self' https://alice.example.com wss://alice.example.com", directives["connect-src"])
+	assert.Equal(t, "'self' https://alice.example.com https://*.alice.example.com", directives["frame-ancestors"])
+	assert.Equal(t, "'none'", directives["object-src"])
+}
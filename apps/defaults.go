@@ -0,0 +1,99 @@
+package apps
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/jobs"
+	"github.com/dcasier/cozy-stack/logger"
+)
+
+// InstallWorkerType is the worker type of the jobs that install the default
+// applications of the new instances
+const InstallWorkerType = "install-app"
+
+// installTimeout is the maximal duration of an installation by the worker,
+// longer than the default timeout of the jobs for the big repositories
+const installTimeout = 10 * time.Minute
+
+// InstallArguments are the arguments of the jobs of the install-app worker
+type InstallArguments struct {
+	Slug   string `json:"slug"`
+	Source string `json:"source"`
+}
+
+func init() {
+	jobs.AddWorkerConfig(&jobs.WorkerConfig{
+		WorkerType: InstallWorkerType,
+		WorkerFunc: installWorker,
+		Timeout:    installTimeout,
+	})
+}
+
+// InstallDefaults pushes a job for each application to install on a new
+// instance. If apps is empty, they are the default applications of the
+// context of the instance. An application without a source is installed
+// from the registry. The jobs are retried if they fail, and their final
+// state, with the error, is kept in the io.cozy.jobs documents.
+func InstallDefaults(ctx context.Context, i *instance.Instance, apps []*instance.DefaultApp) ([]*jobs.Job, error) {
+	if len(apps) == 0 {
+		apps = i.GetContext().DefaultApps
+	}
+	var pushed []*jobs.Job
+	for _, app := range apps {
+		if !slugReg.MatchString(app.Slug) {
+			return pushed, ErrInvalidSlugName
+		}
+		src := app.Source
+		if src == "" {
+			src = "registry://" + app.Slug
+		}
+		args, err := json.Marshal(&InstallArguments{Slug: app.Slug, Source: src})
+		if err != nil {
+			return pushed, err
+		}
+		job, err := jobs.Push(ctx, i.GetDatabasePrefix(), &jobs.Request{
+			WorkerType: InstallWorkerType,
+			Arguments:  args,
+		})
+		if err != nil {
+			return pushed, err
+		}
+		pushed = append(pushed, job)
+	}
+	return pushed, nil
+}
+
+// installWorker is the worker of the install-app jobs. An application that
+// is already installed is left as is.
+func installWorker(ctx context.Context, job *jobs.Job) error {
+	args := &InstallArguments{}
+	if err := job.UnmarshalArguments(args); err != nil {
+		return err
+	}
+	i, err := instance.Get(ctx, strings.TrimSuffix(job.DBPrefix, "/"))
+	if err != nil {
+		return err
+	}
+	vfsC, err := i.GetVFSContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	db := i.GetDatabasePrefix()
+	if man, errg := GetBySlug(ctx, db, Webapp, args.Slug); errg == nil && man.State == Ready {
+		return nil
+	}
+	inst, err := NewInstaller(ctx, vfsC, db, Webapp, args.Slug, args.Source)
+	if err == nil {
+		defer inst.discardProgress()()
+		_, err = inst.Install()
+	}
+	if err != nil && job.TryCount >= job.Options.MaxExecCount {
+		logger.Errorf("apps", "cannot install %s on %s: %v", args.Slug, i.Domain, err)
+	}
+	return err
+}
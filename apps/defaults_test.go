@@ -0,0 +1,22 @@
+package apps
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstallDefaults(t *testing.T) {
+	ctx := context.Background()
+	i := &instance.Instance{Domain: "defaults.cozycloud.cc"}
+
+	// no context, no default apps
+	pushed, err := InstallDefaults(ctx, i, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, pushed)
+
+	_, err = InstallDefaults(ctx, i, []*instance.DefaultApp{{Slug: "!!!"}})
+	assert.Equal(t, ErrInvalidSlugName, err)
+}
@@ -0,0 +1,104 @@
+package apps
+
+import "sync"
+
+// The steps of an installation or an update, sent in the events
+const (
+	// StepFetching is when the files of the application are downloaded
+	StepFetching = "fetching"
+	// StepCloning is when the git repository is cloned
+	StepCloning = "cloning"
+	// StepCopying is when the files are copied in the VFS
+	StepCopying = "copying"
+	// StepDone is the last step of an operation that has succeeded
+	StepDone = "done"
+	// StepError is the last step of an operation that has failed
+	StepError = "error"
+)
+
+// eventsBufferSize is the number of events kept for a slow subscriber,
+// before the next ones are dropped
+const eventsBufferSize = 16
+
+// Event is sent to the clients that follow the progress of an installation
+// or an update of an application
+type Event struct {
+	Slug  string `json:"slug"`
+	State State  `json:"state"`
+	Step  string `json:"step,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Final returns true if the event is the last one of an operation
+func (e *Event) Final() bool {
+	return e.Step == StepDone || e.Step == StepError
+}
+
+// CurrentEvent returns the event for the current state of an application,
+// for the clients that start to follow its progress
+func CurrentEvent(man *Manifest) *Event {
+	ev := &Event{Slug: man.Slug, State: man.State}
+	switch man.State {
+	case Ready:
+		ev.Step = StepDone
+	case Errored:
+		ev.Step = StepError
+	}
+	return ev
+}
+
+// subscribers are the channels of the clients that follow the progress of
+// the applications, by instance and slug
+var subscribers = struct {
+	sync.Mutex
+	chans map[string]map[chan *Event]struct{}
+}{chans: make(map[string]map[chan *Event]struct{})}
+
+// appKey identifies an application of an instance
+func appKey(db, slug string) string {
+	return db + "/" + slug
+}
+
+// Subscribe returns a channel where the events for the application with the
+// given slug are sent, and a function to call when the client no longer
+// follows its progress.
+func Subscribe(db, slug string) (<-chan *Event, func()) {
+	key := appKey(db, slug)
+	ch := make(chan *Event, eventsBufferSize)
+
+	subscribers.Lock()
+	if subscribers.chans[key] == nil {
+		subscribers.chans[key] = make(map[chan *Event]struct{})
+	}
+	subscribers.chans[key][ch] = struct{}{}
+	subscribers.Unlock()
+
+	unsubscribe := func() {
+		subscribers.Lock()
+		delete(subscribers.chans[key], ch)
+		if len(subscribers.chans[key]) == 0 {
+			delete(subscribers.chans, key)
+		}
+		subscribers.Unlock()
+	}
+	return ch, unsubscribe
+}
+
+// publish sends an event to the subscribers of an application. It never
+// blocks: the events are dropped for the subscribers that are too slow.
+func publish(db string, ev *Event) {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	for ch := range subscribers.chans[appKey(db, ev.Slug)] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// progressReporter is implemented by the clients that can tell the steps of
+// the fetch of an application, like the git one
+type progressReporter interface {
+	setProgress(fn func(step string))
+}
@@ -0,0 +1,52 @@
+package apps
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribe(t *testing.T) {
+	events, unsubscribe := Subscribe("test-events/", "mini")
+	other, unsubscribeOther := Subscribe("test-events/", "other")
+	defer unsubscribeOther()
+
+	inst := &Installer{db: "test-events/", slug: "mini", man: &Manifest{State: Installing}}
+	inst.notify(StepCloning, nil)
+	inst.notify(StepError, errors.New("Clone failed"))
+
+	ev := <-events
+	assert.Equal(t, &Event{Slug: "mini", State: Installing, Step: StepCloning}, ev)
+	assert.False(t, ev.Final())
+	ev = <-events
+	assert.Equal(t, &Event{Slug: "mini", State: Errored, Step: StepError, Error: "Clone failed"}, ev)
+	assert.True(t, ev.Final())
+	assert.Len(t, other, 0)
+
+	unsubscribe()
+	inst.notify(StepCopying, nil)
+	assert.Len(t, events, 0)
+	_, ok := subscribers.chans[appKey("test-events/", "mini")]
+	assert.False(t, ok)
+}
+
+func TestPublishDoesNotBlock(t *testing.T) {
+	events, unsubscribe := Subscribe("test-events/", "slow")
+	defer unsubscribe()
+	for i := 0; i < eventsBufferSize+5; i++ {
+		publish("test-events/", &Event{Slug: "slow", Step: StepCopying})
+	}
+	assert.Len(t, events, eventsBufferSize)
+}
+
+func TestCurrentEvent(t *testing.T) {
+	ev := CurrentEvent(&Manifest{Slug: "mini", State: Ready})
+	assert.Equal(t, StepDone, ev.Step)
+	assert.True(t, ev.Final())
+	ev = CurrentEvent(&Manifest{Slug: "mini", State: Errored})
+	assert.Equal(t, StepError, ev.Step)
+	ev = CurrentEvent(&Manifest{Slug: "mini", State: Upgrading})
+	assert.Equal(t, State(Upgrading), ev.State)
+	assert.False(t, ev.Final())
+}
@@ -0,0 +1,94 @@
+package apps
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/vfs"
+)
+
+// ErroredGracePeriod is the duration during which the files of a failed
+// installation or update are kept, for a retry or an investigation, before
+// being collected by SweepErrored
+const ErroredGracePeriod = 24 * time.Hour
+
+// The operations recorded in the ErroredOp field of the manifests
+const (
+	installOperation = "install"
+	updateOperation  = "update"
+)
+
+// setErrored marks the manifest as errored by the given operation
+func setErrored(man *Manifest, op string) {
+	now := time.Now()
+	man.State = Errored
+	man.ErroredAt = &now
+	man.ErroredOp = op
+}
+
+// SweepErrored removes the directories left by the installations and
+// updates that have failed for longer than the grace period: the partial
+// tree of an installation, and the .<slug>.new directory of an update. The
+// files of the current version of an application whose update has failed
+// are kept. The applications that are locked by another operation are
+// skipped, they will be collected by the next sweep.
+func SweepErrored(ctx context.Context, vfsC *vfs.Context, db string, grace time.Duration) error {
+	var errm error
+	for _, typ := range []AppType{Webapp, Konnector} {
+		mans, err := List(ctx, db, typ)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return err
+		}
+		for _, man := range mans {
+			if !isExpiredError(man, grace) {
+				continue
+			}
+			if err = sweepApp(ctx, vfsC, db, typ, man.Slug, grace); err != nil && err != ErrLocked {
+				errm = fmt.Errorf("cannot sweep %s: %v", man.Slug, err)
+			}
+		}
+	}
+	return errm
+}
+
+// isExpiredError returns true if the application has failed for longer
+// than the grace period
+func isExpiredError(man *Manifest, grace time.Duration) bool {
+	return man.State == Errored && man.ErroredAt != nil && time.Since(*man.ErroredAt) > grace
+}
+
+func sweepApp(ctx context.Context, vfsC *vfs.Context, db string, typ AppType, slug string, grace time.Duration) error {
+	unlock, err := lock(ctx, db, slug)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// the application may have been retried since it was listed
+	man, err := GetBySlug(ctx, db, typ, slug)
+	if err != nil {
+		return err
+	}
+	if !isExpiredError(man, grace) {
+		return nil
+	}
+
+	appdir := path.Join(typ.Directory(), slug)
+	newdir := path.Join(typ.Directory(), "."+slug+".new")
+	if man.ErroredOp == installOperation {
+		return removeDir(vfsC, appdir)
+	}
+	// an interrupted update may have moved the current version away, and
+	// only the new one is left
+	if _, err = vfs.GetDirDocFromPath(vfsC, appdir, false); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return removeDir(vfsC, newdir)
+}
@@ -0,0 +1,26 @@
+package apps
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsExpiredError(t *testing.T) {
+	man := &Manifest{State: Ready}
+	assert.False(t, isExpiredError(man, 0))
+
+	setErrored(man, installOperation)
+	assert.Equal(t, State(Errored), man.State)
+	assert.Equal(t, installOperation, man.ErroredOp)
+	assert.False(t, isExpiredError(man, time.Hour))
+
+	past := time.Now().Add(-2 * time.Hour)
+	man.ErroredAt = &past
+	assert.True(t, isExpiredError(man, time.Hour))
+
+	// the manifests of the previous versions of the stack have no date
+	man.ErroredAt = nil
+	assert.False(t, isExpiredError(man, 0))
+}
@@ -10,11 +10,13 @@ import (
 	"path"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dcasier/cozy-stack/vfs"
 	"github.com/spf13/afero"
 	git "gopkg.in/src-d/go-git.v4"
+	gitHTTP "gopkg.in/src-d/go-git.v4/clients/http"
 	gitSt "gopkg.in/src-d/go-git.v4/storage/filesystem"
 	gitFS "gopkg.in/src-d/go-git.v4/utils/fs"
 )
@@ -22,15 +24,62 @@ import (
 const manifestFilename = "manifest.webapp"
 const githubRawManifestURL = "https://raw.githubusercontent.com/%s/%s/%s/%s"
 
+// rawManifestURL is the URL of a raw file on GitLab, Gitea and Bitbucket:
+// https://<host>/<user>/<project>/raw/<ref>/<file>
+const rawManifestURL = "https://%s/%s/%s/raw/%s/%s"
+
 var githubURLRegex = regexp.MustCompile(`/([^/]+)/([^/]+).git`)
 
+// gitURLRegex matches the path of a repository on the other forges, where
+// the .git suffix is optional
+var gitURLRegex = regexp.MustCompile(`^/([^/]+)/([^/]+?)(?:\.git)?/?$`)
+
+// gitCommitRegex matches the full hash of a commit, that can be used in the
+// fragment of a git source instead of a branch or a tag
+var gitCommitRegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
 type gitClient struct {
-	vfsC *vfs.Context
-	src  string
+	vfsC     *vfs.Context
+	src      string
+	manifest string
+	auth     *Credentials
+	commit   string
+	progress func(step string)
+}
+
+func newGitClient(vfsC *vfs.Context, typ AppType, rawurl string, auth *Credentials) *gitClient {
+	return &gitClient{vfsC: vfsC, src: rawurl, manifest: typ.manifestFilename(), auth: auth}
+}
+
+// newRequest creates a GET request, with the credentials of the client for
+// the private repositories
+func (g *gitClient) newRequest(rawurl string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if g.auth != nil {
+		req.SetBasicAuth(g.auth.Username, g.auth.Token)
+	}
+	return req, nil
 }
 
-func newGitClient(vfsC *vfs.Context, rawurl string) *gitClient {
-	return &gitClient{vfsC: vfsC, src: rawurl}
+// get makes a GET request, with the credentials of the client for the
+// private repositories
+func (g *gitClient) get(rawurl string) (*http.Response, error) {
+	req, err := g.newRequest(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// setCloneAuth adds the authentication for cloning a private repository to
+// the clone options
+func (g *gitClient) setCloneAuth(opts *git.CloneOptions) {
+	if g.auth != nil {
+		opts.Auth = gitHTTP.NewBasicAuth(g.auth.Username, g.auth.Token)
+	}
 }
 
 func (g *gitClient) FetchManifest() (io.ReadCloser, error) {
@@ -43,8 +92,108 @@ func (g *gitClient) FetchManifest() (io.ReadCloser, error) {
 		return g.fetchManifestFromGithub(src)
 	}
 
-	// TODO
-	return nil, errors.New("Not implemented")
+	if isRawForge(src.Host) {
+		if r, err := g.fetchRawManifest(src); err == nil {
+			return r, nil
+		}
+	}
+
+	return g.fetchManifestFromClone(src)
+}
+
+// isRawForge returns true if the host is a GitLab, Gitea or Bitbucket
+// forge, where the raw files can be downloaded without a clone. For the
+// self-hosted forges, we rely on the usual hostnames, like gitlab.example.org.
+func isRawForge(host string) bool {
+	switch host {
+	case "gitlab.com", "bitbucket.org", "try.gitea.io":
+		return true
+	}
+	return strings.HasPrefix(host, "gitlab.") || strings.HasPrefix(host, "gitea.")
+}
+
+// fetchRawManifest downloads the manifest from the raw URL of a GitLab,
+// Gitea or Bitbucket repository
+func (g *gitClient) fetchRawManifest(src *url.URL) (io.ReadCloser, error) {
+	submatch := gitURLRegex.FindStringSubmatch(src.Path)
+	if len(submatch) != 3 {
+		return nil, ErrSourceNotReachable
+	}
+
+	user, project := submatch[1], submatch[2]
+	ref := src.Fragment
+	if ref == "" {
+		ref = "master"
+	}
+
+	manURL := fmt.Sprintf(rawManifestURL, src.Host, user, project, ref, g.manifest)
+	resp, err := g.get(manURL)
+	if err != nil {
+		return nil, ErrSourceNotReachable
+	}
+
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, ErrSourceNotReachable
+	}
+
+	return resp.Body, nil
+}
+
+// fetchManifestFromClone reads the manifest from a shallow clone in memory
+// of the repository. It works with every git host, but it is slower than
+// downloading the raw manifest.
+func (g *gitClient) fetchManifestFromClone(src *url.URL) (io.ReadCloser, error) {
+	u := *src
+	if u.Scheme == "git" {
+		u.Scheme = "https"
+	}
+	fragment := u.Fragment
+	u.Fragment = ""
+
+	opts := &git.CloneOptions{URL: u.String(), Depth: 1}
+	g.setCloneAuth(opts)
+	if gitCommitRegex.MatchString(fragment) {
+		opts.Depth = 0
+	} else if fragment != "" {
+		opts.ReferenceName = git.ReferenceName("refs/heads/" + fragment)
+		opts.SingleBranch = true
+	}
+
+	rep := git.NewMemoryRepository()
+	err := rep.Clone(opts)
+	if err != nil && opts.ReferenceName != "" {
+		// the fragment may be a tag instead of a branch
+		rep = git.NewMemoryRepository()
+		opts.ReferenceName = git.ReferenceName("refs/tags/" + fragment)
+		err = rep.Clone(opts)
+	}
+	if err != nil {
+		return nil, ErrSourceNotReachable
+	}
+
+	var hash git.Hash
+	if opts.Depth == 0 {
+		hash = git.NewHash(fragment)
+	} else {
+		ref, err := rep.Head()
+		if err != nil {
+			return nil, err
+		}
+		hash = ref.Hash()
+	}
+
+	commit, err := rep.Commit(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := commit.File(g.manifest)
+	if err != nil {
+		return nil, ErrSourceNotReachable
+	}
+
+	return f.Reader()
 }
 
 func (g *gitClient) fetchManifestFromGithub(src *url.URL) (io.ReadCloser, error) {
@@ -57,16 +206,18 @@ func (g *gitClient) fetchManifestFromGithub(src *url.URL) (io.ReadCloser, error)
 		}
 	}
 
+	// The fragment can be a branch, a tag or a commit: raw.githubusercontent
+	// accepts all of them.
 	user, project := submatch[1], submatch[2]
-	var branch string
+	var ref string
 	if src.Fragment != "" {
-		branch = src.Fragment
+		ref = src.Fragment
 	} else {
-		branch = "master"
+		ref = "master"
 	}
 
-	manURL := fmt.Sprintf(githubRawManifestURL, user, project, branch, manifestFilename)
-	resp, err := http.Get(manURL)
+	manURL := fmt.Sprintf(githubRawManifestURL, user, project, ref, g.manifest)
+	resp, err := g.get(manURL)
 	if err != nil {
 		return nil, ErrSourceNotReachable
 	}
@@ -78,26 +229,37 @@ func (g *gitClient) fetchManifestFromGithub(src *url.URL) (io.ReadCloser, error)
 	return resp.Body, nil
 }
 
-func (g *gitClient) Fetch(vfsC *vfs.Context, appdir string) error {
-	gitdir := path.Join(appdir, ".git")
-	err := vfsC.Mkdir(gitdir)
-	if err != nil {
-		return err
-	}
+func (g *gitClient) setProgress(fn func(step string)) {
+	g.progress = fn
+}
 
-	gfs := newGFS(vfsC, gitdir)
-	storage, err := gitSt.NewStorage(gfs)
-	if err != nil {
-		return err
+func (g *gitClient) report(step string) {
+	if g.progress != nil {
+		g.progress(step)
 	}
+}
 
-	rep, err := git.NewRepository(storage)
+// Commit returns the hash of the commit fetched by the last call to Fetch
+func (g *gitClient) Commit() string {
+	return g.commit
+}
+
+// Fetch clones the repository and copies the files of the selected commit
+// in appdir. The fragment of the source URL selects what is installed:
+//   - nothing for the default branch
+//   - the full hash of a commit
+//   - the name of a branch or of a tag (branches are tried first).
+//
+// For GitHub and GitLab, the tarball of the selected commit is downloaded
+// instead, and the repository is cloned only if it can't be downloaded.
+func (g *gitClient) Fetch(vfsC *vfs.Context, appdir string) error {
+	src, err := url.Parse(g.src)
 	if err != nil {
 		return err
 	}
 
-	src, err := url.Parse(g.src)
-	if err != nil {
+	err = g.fetchArchive(vfsC, src, appdir)
+	if err != errNoArchive && err != ErrSourceNotReachable {
 		return err
 	}
 
@@ -105,24 +267,63 @@ func (g *gitClient) Fetch(vfsC *vfs.Context, appdir string) error {
 	if src.Scheme == "git" {
 		src.Scheme = "https"
 	}
+	fragment := src.Fragment
+	src.Fragment = ""
+	cloneURL := src.String()
 
-	err = rep.Clone(&git.CloneOptions{
-		URL:   src.String(),
-		Depth: 1,
-	})
-	if err != nil {
-		return err
-	}
+	gitdir := path.Join(appdir, ".git")
+	var rep *git.Repository
+	var hash git.Hash
+	g.report(StepCloning)
+
+	switch {
+	case fragment == "":
+		if rep, err = g.cloneRepository(vfsC, gitdir, cloneURL, "", 1); err != nil {
+			return err
+		}
+		ref, err := rep.Head()
+		if err != nil {
+			return err
+		}
+		hash = ref.Hash()
 
-	ref, err := rep.Head()
-	if err != nil {
-		return err
+	case gitCommitRegex.MatchString(fragment):
+		// A commit can't be asked directly to the remote, so the whole
+		// history must be fetched.
+		if rep, err = g.cloneRepository(vfsC, gitdir, cloneURL, "", 0); err != nil {
+			return err
+		}
+		hash = git.NewHash(fragment)
+
+	default:
+		names := []git.ReferenceName{
+			git.ReferenceName("refs/heads/" + fragment),
+			git.ReferenceName("refs/tags/" + fragment),
+		}
+		for _, name := range names {
+			if err = removeDir(vfsC, gitdir); err != nil {
+				return err
+			}
+			if rep, err = g.cloneRepository(vfsC, gitdir, cloneURL, name, 1); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+		ref, err := rep.Head()
+		if err != nil {
+			return err
+		}
+		hash = ref.Hash()
 	}
 
-	commit, err := rep.Commit(ref.Hash())
+	commit, err := rep.Commit(hash)
 	if err != nil {
 		return err
 	}
+	g.commit = commit.Hash.String()
+	g.report(StepCopying)
 
 	files, err := commit.Files()
 	if err != nil {
@@ -161,6 +362,39 @@ func (g *gitClient) Fetch(vfsC *vfs.Context, appdir string) error {
 	})
 }
 
+// cloneRepository clones the repository at cloneURL, with its git data
+// stored in the gitdir directory of the VFS. If name is not empty, only this
+// reference is cloned. A depth of 0 means the whole history.
+func (g *gitClient) cloneRepository(vfsC *vfs.Context, gitdir, cloneURL string, name git.ReferenceName, depth int) (*git.Repository, error) {
+	if err := vfsC.Mkdir(gitdir); err != nil {
+		return nil, err
+	}
+
+	gfs := newGFS(vfsC, gitdir)
+	storage, err := gitSt.NewStorage(gfs)
+	if err != nil {
+		return nil, err
+	}
+
+	rep, err := git.NewRepository(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &git.CloneOptions{
+		URL:           cloneURL,
+		ReferenceName: name,
+		SingleBranch:  name != "",
+		Depth:         depth,
+	}
+	g.setCloneAuth(opts)
+	if err = rep.Clone(opts); err != nil {
+		return nil, err
+	}
+
+	return rep, nil
+}
+
 type gfs struct {
 	vfsC *vfs.Context
 	base string
@@ -345,6 +579,7 @@ func (fs *gfs) Base() string {
 
 var (
 	_ Client           = &gitClient{}
+	_ progressReporter = &gitClient{}
 	_ gitFS.Filesystem = &gfs{}
 	_ gitFS.File       = &gfileWrite{}
 	_ gitFS.File       = &gfileRead{}
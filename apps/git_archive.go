@@ -0,0 +1,114 @@
+package apps
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/dcasier/cozy-stack/vfs"
+)
+
+// githubArchiveURL is the URL of the tarball of a GitHub repository, for a
+// branch, a tag or a commit (the default branch if it is empty)
+const githubArchiveURL = "https://api.github.com/repos/%s/%s/tarball/%s"
+
+// gitlabArchiveURL is the URL of the tarball of a GitLab repository. The
+// project is identified by its path, like cozy%2Fcozy-emails.
+const gitlabArchiveURL = "https://%s/api/v4/projects/%s/repository/archive.tar.gz"
+
+// errNoArchive is used when the forge of a repository has no endpoint to
+// download its tarball
+var errNoArchive = errors.New("No archive endpoint for this repository")
+
+// isGitLab returns true for gitlab.com and the self-hosted GitLab forges,
+// with the usual gitlab. hostnames
+func isGitLab(host string) bool {
+	return host == "gitlab.com" || strings.HasPrefix(host, "gitlab.")
+}
+
+// archiveURL returns the URL of the tarball of the repository, for the ref
+// of the fragment of the source
+func archiveURL(src *url.URL) (string, error) {
+	ref := src.Fragment
+	switch {
+	case src.Host == "github.com":
+		submatch := githubURLRegex.FindStringSubmatch(src.Path)
+		if len(submatch) != 3 {
+			return "", errNoArchive
+		}
+		u := fmt.Sprintf(githubArchiveURL, submatch[1], submatch[2], url.QueryEscape(ref))
+		return strings.TrimSuffix(u, "/"), nil
+
+	case isGitLab(src.Host):
+		submatch := gitURLRegex.FindStringSubmatch(src.Path)
+		if len(submatch) != 3 {
+			return "", errNoArchive
+		}
+		project := url.QueryEscape(submatch[1] + "/" + submatch[2])
+		u := fmt.Sprintf(gitlabArchiveURL, src.Host, project)
+		if ref != "" {
+			u += "?sha=" + url.QueryEscape(ref)
+		}
+		return u, nil
+	}
+	return "", errNoArchive
+}
+
+// fetchArchive downloads the tarball of the repository from its forge, and
+// extracts it in appdir. Unlike a clone, no git object is stored in the VFS.
+// It returns errNoArchive or ErrSourceNotReachable if the tarball can't be
+// downloaded, and the repository must be cloned instead.
+func (g *gitClient) fetchArchive(vfsC *vfs.Context, src *url.URL, appdir string) error {
+	rawurl, err := archiveURL(src)
+	if err != nil {
+		return err
+	}
+	req, err := g.newRequest(rawurl)
+	if err != nil {
+		return err
+	}
+	if g.auth != nil && isGitLab(src.Host) {
+		// the API of GitLab expects a personal access token in this header
+		req.Header.Set("PRIVATE-TOKEN", g.auth.Token)
+	}
+
+	f, err := downloadRequest(req, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	defer removeTempFile(f)
+
+	g.report(StepCopying)
+	if err = extractArchive(vfsC, f, tarGzArchive, g.manifest, appdir); err != nil {
+		return err
+	}
+	g.commit = archiveCommit(f)
+	return nil
+}
+
+// archiveCommit returns the commit of a tarball made by git archive, which
+// is the comment of its pax global header, or an empty string if it has
+// none
+func archiveCommit(f *os.File) string {
+	if _, err := f.Seek(0, 0); err != nil {
+		return ""
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return ""
+	}
+	defer gz.Close()
+	hdr, err := tar.NewReader(gz).Next()
+	if err != nil || hdr.Typeflag != tar.TypeXGlobalHeader {
+		return ""
+	}
+	if commit := hdr.PAXRecords["comment"]; gitCommitRegex.MatchString(commit) {
+		return commit
+	}
+	return ""
+}
@@ -0,0 +1,127 @@
+package apps
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRawForge(t *testing.T) {
+	assert.True(t, isRawForge("gitlab.com"))
+	assert.True(t, isRawForge("bitbucket.org"))
+	assert.True(t, isRawForge("try.gitea.io"))
+	assert.True(t, isRawForge("gitlab.example.org"))
+	assert.True(t, isRawForge("gitea.example.org"))
+	assert.False(t, isRawForge("github.com"))
+	assert.False(t, isRawForge("git.example.org"))
+}
+
+func TestGitURLRegex(t *testing.T) {
+	for _, p := range []string{"/cozy/cozy-emails.git", "/cozy/cozy-emails", "/cozy/cozy-emails/"} {
+		submatch := gitURLRegex.FindStringSubmatch(p)
+		if assert.Len(t, submatch, 3, p) {
+			assert.Equal(t, "cozy", submatch[1])
+			assert.Equal(t, "cozy-emails", submatch[2])
+		}
+	}
+	assert.Nil(t, gitURLRegex.FindStringSubmatch("/cozy"))
+	assert.Nil(t, gitURLRegex.FindStringSubmatch("/group/sub/project.git"))
+}
+
+func TestGitClientGetWithCredentials(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, token, ok := r.BasicAuth()
+		if !ok || user != "deploy" || token != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"name": "Private"}`))
+	}))
+	defer ts.Close()
+
+	g := newGitClient(nil, Webapp, "git://gitlab.example.org/cozy/private.git", nil)
+	res, err := g.get(ts.URL)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	}
+
+	creds := &Credentials{Username: "deploy", Token: "s3cr3t"}
+	g = newGitClient(nil, Webapp, "git://gitlab.example.org/cozy/private.git", creds)
+	res, err = g.get(ts.URL)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+}
+
+func TestArchiveURL(t *testing.T) {
+	tests := map[string]string{
+		"git://github.com/cozy/cozy-emails.git":        "https://api.github.com/repos/cozy/cozy-emails/tarball",
+		"git://github.com/cozy/cozy-emails.git#v1.0.0": "https://api.github.com/repos/cozy/cozy-emails/tarball/v1.0.0",
+		"git://gitlab.com/cozy/cozy-emails.git":        "https://gitlab.com/api/v4/projects/cozy%2Fcozy-emails/repository/archive.tar.gz",
+		"git://gitlab.example.org/cozy/emails#dev":     "https://gitlab.example.org/api/v4/projects/cozy%2Femails/repository/archive.tar.gz?sha=dev",
+		"git://gitlab.example.org/cozy/emails#feat/ui": "https://gitlab.example.org/api/v4/projects/cozy%2Femails/repository/archive.tar.gz?sha=feat%2Fui",
+	}
+	for src, expected := range tests {
+		u, _ := url.Parse(src)
+		actual, err := archiveURL(u)
+		if assert.NoError(t, err, src) {
+			assert.Equal(t, expected, actual, src)
+		}
+	}
+
+	for _, src := range []string{"git://bitbucket.org/cozy/emails.git", "git://github.com/cozy"} {
+		u, _ := url.Parse(src)
+		_, err := archiveURL(u)
+		assert.Equal(t, errNoArchive, err, src)
+	}
+}
+
+func TestArchiveCommit(t *testing.T) {
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		PAXRecords: map[string]string{"comment": commit},
+	}))
+	content := `{"name": "Mini"}`
+	assert.NoError(t, tw.WriteHeader(&tar.Header{
+		Name: "cozy-mini-0123456/manifest.webapp",
+		Mode: 0644,
+		Size: int64(len(content)),
+	}))
+	tw.Write([]byte(content))
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gz.Close())
+
+	f, err := ioutil.TempFile("", "cozy-git-archive")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer removeTempFile(f)
+	f.Write(buf.Bytes())
+	assert.Equal(t, commit, archiveCommit(f))
+	root, err := archiveRoot(f, tarGzArchive, manifestFilename)
+	assert.NoError(t, err)
+	assert.Equal(t, "/cozy-mini-0123456", root)
+
+	other, err := ioutil.TempFile("", "cozy-git-archive")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(other.Name())
+	defer other.Close()
+	other.Write(makeTarGz(t, archiveFiles))
+	assert.Equal(t, "", archiveCommit(other))
+}
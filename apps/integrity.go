@@ -0,0 +1,196 @@
+package apps
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// checksumPrefix is the prefix of the checksums stored in the manifests,
+// like sha256:1b5c0cb5...
+const checksumPrefix = "sha256:"
+
+// signatureMaxSize is the maximal size of a detached signature
+const signatureMaxSize = 16 * 1024
+
+var (
+	// ErrBadSignature is used when the signature of a package is not
+	// valid for any of the trusted keys
+	ErrBadSignature = errors.New("Application package does not match its signature")
+	// ErrMissingSignature is used when the signatures are required, but
+	// a package is not signed
+	ErrMissingSignature = errors.New("Application package is not signed")
+	// ErrChecksumNotSupported is used when a checksum is pinned for a
+	// source that is not a package, like a git repository
+	ErrChecksumNotSupported = errors.New("A checksum can only be given for the archive and registry sources")
+)
+
+var (
+	trustedKeys      []crypto.PublicKey
+	requireSignature bool
+)
+
+// UseTrustedKeys configures the public keys (PEM files, RSA or ECDSA) used
+// to verify the signatures of the application packages. If require is
+// true, the packages without a valid signature are refused, and the
+// applications can only be installed from the archive and registry sources.
+func UseTrustedKeys(files []string, require bool) error {
+	keys := make([]crypto.PublicKey, 0, len(files))
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		key, err := parsePublicKey(b)
+		if err != nil {
+			return fmt.Errorf("Invalid trusted key %s: %s", file, err)
+		}
+		keys = append(keys, key)
+	}
+	if require && len(keys) == 0 {
+		return errors.New("Signatures are required, but no trusted key is configured")
+	}
+	trustedKeys = keys
+	requireSignature = require
+	return nil
+}
+
+func parsePublicKey(b []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, errors.New("only the RSA and ECDSA keys are supported")
+}
+
+// parseChecksum parses a sha256 checksum, with or without the sha256:
+// prefix
+func parseChecksum(checksum string) ([]byte, error) {
+	sum, err := hex.DecodeString(strings.TrimPrefix(checksum, checksumPrefix))
+	if err != nil || len(sum) != 32 {
+		return nil, ErrBadChecksum
+	}
+	return sum, nil
+}
+
+// formatChecksum returns the checksum of a package, as stored in the
+// manifest
+func formatChecksum(sum []byte) string {
+	return checksumPrefix + hex.EncodeToString(sum)
+}
+
+// verifyPackage checks the sha256 digest of a package against the pinned
+// checksum (if any) and its signature. A nil signature means that the
+// package is not signed.
+func verifyPackage(digest, pinned, signature []byte) error {
+	if pinned != nil && !bytes.Equal(digest, pinned) {
+		return ErrBadChecksum
+	}
+	if signature == nil {
+		if requireSignature {
+			return ErrMissingSignature
+		}
+		return nil
+	}
+	// without trusted keys, the signatures can't be checked and are ignored
+	if len(trustedKeys) == 0 {
+		return nil
+	}
+	for _, key := range trustedKeys {
+		if verifySignature(key, digest, signature) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// verifySignature checks a signature made with the SHA-256 digest, like
+// the ones made with openssl dgst -sha256 -sign
+func verifySignature(key crypto.PublicKey, digest, signature []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		var sig ecdsaSignature
+		rest, err := asn1.Unmarshal(signature, &sig)
+		if err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil {
+			return false
+		}
+		return ecdsa.Verify(k, digest, sig.R, sig.S)
+	}
+	return false
+}
+
+// fetchSignature downloads the detached signature of a package, published
+// next to it, like app-1.2.3.tar.gz.sig. It returns a nil signature if the
+// package is not signed.
+func fetchSignature(rawurl string) ([]byte, error) {
+	resp, err := http.Get(rawurl)
+	if err != nil {
+		return nil, ErrSourceNotReachable
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, ErrSourceNotReachable
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, signatureMaxSize))
+}
+
+// verifier is implemented by the clients that download a package, whose
+// integrity is checked before its files are written in the VFS
+type verifier interface {
+	// PinChecksum sets the sha256 checksum that the package must match
+	PinChecksum(checksum string) error
+	// Checksum returns the checksum of the last verified package
+	Checksum() string
+}
+
+// verifiedChecksum returns the checksum of the package fetched by the
+// client, or an empty string if the client does not fetch packages
+func verifiedChecksum(cli Client) string {
+	if v, ok := cli.(verifier); ok {
+		return v.Checksum()
+	}
+	return ""
+}
+
+// PinChecksum sets the sha256 checksum that the package of the application
+// must match to be installed. It is only supported for the archive and
+// registry sources.
+func (i *Installer) PinChecksum(checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	v, ok := i.cli.(verifier)
+	if !ok {
+		return ErrChecksumNotSupported
+	}
+	return v.PinChecksum(checksum)
+}
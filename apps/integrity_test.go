@@ -0,0 +1,174 @@
+package apps
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func resetTrustedKeys() {
+	trustedKeys = nil
+	requireSignature = false
+}
+
+func TestParseChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("package"))
+	checksum := formatChecksum(sum[:])
+	parsed, err := parseChecksum(checksum)
+	assert.NoError(t, err)
+	assert.Equal(t, sum[:], parsed)
+	parsed, err = parseChecksum(checksum[len(checksumPrefix):])
+	assert.NoError(t, err)
+	assert.Equal(t, sum[:], parsed)
+	_, err = parseChecksum("sha256:123")
+	assert.Equal(t, ErrBadChecksum, err)
+}
+
+func TestVerifyPackage(t *testing.T) {
+	defer resetTrustedKeys()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	sum := sha256.Sum256([]byte("package"))
+	digest := sum[:]
+	rsaSig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest)
+	assert.NoError(t, err)
+	ecSig, err := ecKey.Sign(rand.Reader, digest, crypto.SHA256)
+	assert.NoError(t, err)
+
+	other := sha256.Sum256([]byte("other package"))
+	assert.NoError(t, verifyPackage(digest, nil, nil))
+	assert.NoError(t, verifyPackage(digest, digest, nil))
+	assert.Equal(t, ErrBadChecksum, verifyPackage(digest, other[:], nil))
+	// the signatures are ignored when no key is trusted
+	assert.NoError(t, verifyPackage(digest, nil, []byte("garbage")))
+
+	trustedKeys = []crypto.PublicKey{&rsaKey.PublicKey, &ecKey.PublicKey}
+	assert.NoError(t, verifyPackage(digest, nil, rsaSig))
+	assert.NoError(t, verifyPackage(digest, nil, ecSig))
+	assert.NoError(t, verifyPackage(digest, nil, nil))
+	assert.Equal(t, ErrBadSignature, verifyPackage(other[:], nil, rsaSig))
+	assert.Equal(t, ErrBadSignature, verifyPackage(other[:], nil, ecSig))
+	assert.Equal(t, ErrBadSignature, verifyPackage(digest, nil, []byte("garbage")))
+
+	requireSignature = true
+	assert.Equal(t, ErrMissingSignature, verifyPackage(digest, nil, nil))
+	assert.NoError(t, verifyPackage(digest, nil, ecSig))
+}
+
+func TestUseTrustedKeys(t *testing.T) {
+	defer resetTrustedKeys()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := ioutil.TempFile("", "cozy-trusted-key")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	f.Close()
+
+	assert.NoError(t, UseTrustedKeys([]string{f.Name()}, true))
+	assert.Len(t, trustedKeys, 1)
+	assert.True(t, requireSignature)
+
+	assert.Error(t, UseTrustedKeys(nil, true))
+	assert.Error(t, UseTrustedKeys([]string{"/no/such/key.pem"}, false))
+
+	_, err = newClient(nil, Webapp, "git://github.com/cozy/cozy-emails", nil)
+	assert.Equal(t, ErrMissingSignature, err)
+}
+
+func TestArchiveSignature(t *testing.T) {
+	defer resetTrustedKeys()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	archive := makeTarGz(t, archiveFiles)
+	sum := sha256.Sum256(archive)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	files := map[string][]byte{
+		"/signed.tar.gz":       archive,
+		"/signed.tar.gz.sig":   sig,
+		"/unsigned.tar.gz":     archive,
+		"/tampered.tar.gz":     makeTarGz(t, map[string]string{"manifest.webapp": "{}"}),
+		"/tampered.tar.gz.sig": sig,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if content, ok := files[r.URL.Path]; ok {
+			w.Write(content)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	download := func(name, checksum string) (string, error) {
+		src, _ := url.Parse(ts.URL + name)
+		cli, err := newArchiveClient(Webapp, src)
+		if err != nil {
+			return "", err
+		}
+		if checksum != "" {
+			if err = cli.PinChecksum(checksum); err != nil {
+				return "", err
+			}
+		}
+		f, digest, err := cli.download()
+		if err != nil {
+			return "", err
+		}
+		removeTempFile(f)
+		return formatChecksum(digest), nil
+	}
+
+	trustedKeys = []crypto.PublicKey{&key.PublicKey}
+	checksum, err := download("/signed.tar.gz", "")
+	assert.NoError(t, err)
+	assert.Equal(t, formatChecksum(sum[:]), checksum)
+	_, err = download("/signed.tar.gz", checksum)
+	assert.NoError(t, err)
+	_, err = download("/tampered.tar.gz", "")
+	assert.Equal(t, ErrBadSignature, err)
+	_, err = download("/unsigned.tar.gz", "")
+	assert.NoError(t, err)
+	_, err = download("/unsigned.tar.gz", formatChecksum(make([]byte, 32)))
+	assert.Equal(t, ErrBadChecksum, err)
+
+	requireSignature = true
+	_, err = download("/unsigned.tar.gz", "")
+	assert.Equal(t, ErrMissingSignature, err)
+}
@@ -0,0 +1,121 @@
+package apps
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Intent is declared by an application in its manifest to handle an action
+// on some types of documents or files, like picking a contact. The href is
+// the path of the page of the application that handles it.
+type Intent struct {
+	Action string   `json:"action"`
+	Types  []string `json:"type"`
+	Href   string   `json:"href"`
+}
+
+// Match returns true if the intent handles the given action on the given
+// type. The action is case-insensitive, and a type of the intent can end
+// with a wildcard for the MIME types, like image/*.
+func (i *Intent) Match(action, typ string) bool {
+	if !strings.EqualFold(i.Action, action) {
+		return false
+	}
+	for _, t := range i.Types {
+		if t == typ || t == "*" {
+			return true
+		}
+		if strings.HasSuffix(t, "/*") && strings.HasPrefix(typ, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Service is a script of an application, declared in its manifest, that
+// can be run by the stack without opening the application, like when a
+// trigger fires.
+type Service struct {
+	Type    string `json:"type"`
+	File    string `json:"file"`
+	Trigger string `json:"trigger,omitempty"`
+}
+
+// FindIntent returns the first intent of the manifest that handles the
+// given action on the given type, or nil
+func (m *Manifest) FindIntent(action, typ string) *Intent {
+	for _, intent := range m.Intents {
+		if intent.Match(action, typ) {
+			return intent
+		}
+	}
+	return nil
+}
+
+// validateIntents checks the intents and services sections of the
+// manifest of a webapp
+func (v *manifestValidator) validateIntents(raw map[string]interface{}) {
+	if val, ok := raw["intents"]; ok && val != nil {
+		intents, ok := val.([]interface{})
+		if !ok {
+			v.fail("intents", "must be an array")
+		}
+		for idx, val := range intents {
+			field := "intents." + strconv.Itoa(idx)
+			intent, ok := val.(map[string]interface{})
+			if !ok {
+				v.fail(field, "must be an object")
+				continue
+			}
+			v.str(intent, "action", field+".action", true)
+			if href, ok := v.str(intent, "href", field+".href", true); ok && !strings.HasPrefix(href, "/") {
+				v.fail(field+".href", "must start with a /")
+			}
+			types, ok := intent["type"].([]interface{})
+			if !ok || len(types) == 0 {
+				v.fail(field+".type", "must be a non-empty array of types")
+				continue
+			}
+			for _, t := range types {
+				if s, ok := t.(string); !ok || strings.TrimSpace(s) == "" {
+					v.fail(field+".type", "must be a non-empty array of types")
+					break
+				}
+			}
+		}
+	}
+
+	if services, ok := v.object(raw, "services", "services", false); ok {
+		for _, name := range sortedKeys(services) {
+			field := "services." + name
+			s, ok := v.object(services, name, field, true)
+			if !ok {
+				continue
+			}
+			v.str(s, "type", field+".type", true)
+			v.str(s, "trigger", field+".trigger", false)
+			if file, ok := v.str(s, "file", field+".file", true); ok {
+				if path.Clean("/"+file) == "/" || strings.Contains(file, "..") {
+					v.fail(field+".file", "must be the path of a file of the application")
+				}
+			}
+		}
+	}
+}
+
+// normalizeIntents upper-cases the actions of the intents, and cleans the
+// paths of the intents and services
+func normalizeIntents(man *Manifest) {
+	for _, intent := range man.Intents {
+		intent.Action = strings.ToUpper(strings.TrimSpace(intent.Action))
+		intent.Href = path.Clean(intent.Href)
+		for i, t := range intent.Types {
+			intent.Types[i] = strings.TrimSpace(t)
+		}
+	}
+	for _, s := range man.Services {
+		s.Type = strings.TrimSpace(s.Type)
+		s.File = path.Clean("/" + s.File)
+	}
+}
@@ -0,0 +1,76 @@
+package apps
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const intentsManifest = `{
+  "name": "Photos",
+  "slug": "photos",
+  "version": "1.0.0",
+  "permissions": {},
+  "routes": {"/": {"folder": "/", "index": "index.html"}},
+  "intents": [
+    {"action": "pick", "type": ["image/*", "io.cozy.photos.albums"], "href": "/pick"},
+    {"action": "VIEW", "type": ["image/jpeg"], "href": "/view/"}
+  ],
+  "services": {
+    "thumbnails": {"type": "node", "file": "services/thumbnails.js", "trigger": "@event io.cozy.files"}
+  }
+}`
+
+func TestParseIntents(t *testing.T) {
+	man, err := parseManifest(strings.NewReader(intentsManifest), Webapp)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, man.Intents, 2) {
+		assert.Equal(t, "PICK", man.Intents[0].Action)
+		assert.Equal(t, "/view", man.Intents[1].Href)
+	}
+	if assert.Contains(t, man.Services, "thumbnails") {
+		assert.Equal(t, "node", man.Services["thumbnails"].Type)
+		assert.Equal(t, "/services/thumbnails.js", man.Services["thumbnails"].File)
+	}
+
+	assert.Equal(t, "/pick", man.FindIntent("pick", "image/png").Href)
+	assert.Equal(t, "/pick", man.FindIntent("PICK", "io.cozy.photos.albums").Href)
+	assert.Equal(t, "/view", man.FindIntent("view", "image/jpeg").Href)
+	assert.Nil(t, man.FindIntent("view", "image/png"))
+	assert.Nil(t, man.FindIntent("pick", "io.cozy.contacts"))
+	assert.Nil(t, man.FindIntent("edit", "image/png"))
+}
+
+func TestParseInvalidIntents(t *testing.T) {
+	manifest := `{"name": "Photos", "slug": "photos", "version": "1.0.0", "permissions": {},
+		"routes": {"/": {"folder": "/"}},
+		"intents": [{"action": "PICK", "type": [], "href": "pick"}, "VIEW"],
+		"services": {"thumbnails": {"type": "node", "file": "../thumbnails.js"}}}`
+	_, err := parseManifest(strings.NewReader(manifest), Webapp)
+	if assert.IsType(t, ManifestErrors{}, err) {
+		fields := []string{}
+		for _, e := range err.(ManifestErrors) {
+			fields = append(fields, e.Field)
+		}
+		assert.Equal(t, []string{
+			"intents.0.href",
+			"intents.0.type",
+			"intents.1",
+			"services.thumbnails.file",
+		}, fields)
+	}
+
+	// the konnectors cannot declare intents
+	manifest = `{"name": "Bank", "slug": "bank", "version": "1.0.0", "permissions": {},
+		"entrypoint": "index.js", "intents": []}`
+	_, err = parseManifest(strings.NewReader(manifest), Konnector)
+	if assert.IsType(t, ManifestErrors{}, err) {
+		errs := err.(ManifestErrors)
+		if assert.Len(t, errs, 1) {
+			assert.Equal(t, "intents", errs[0].Field)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package apps
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidJWT is used when a JSON Web Token is malformed, or its signature
+// is not valid
+var ErrInvalidJWT = errors.New("Invalid JSON Web Token")
+
+// jwtHeader is the header of the JSON Web Tokens (RFC 7519) of the
+// applications. Only the HS256 algorithm is used.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// isJWT returns true if the token looks like a JSON Web Token, and not like
+// an opaque token
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// jwtSignature returns the HMAC-SHA256 signature of the header and payload
+// of a token
+func jwtSignature(secret []byte, signed string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signJWT serializes the claims in a JSON Web Token signed with the secret
+func signJWT(secret []byte, claims interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + jwtSignature(secret, signed), nil
+}
+
+// parseJWT checks the signature of a JSON Web Token, and unmarshals its
+// claims
+func parseJWT(secret []byte, token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidJWT
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidJWT
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err = json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return ErrInvalidJWT
+	}
+	expected := jwtSignature(secret, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return ErrInvalidJWT
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidJWT
+	}
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return ErrInvalidJWT
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package apps
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignAndParseJWT(t *testing.T) {
+	secret := []byte("a-secret-of-the-instance")
+	claims := &appClaims{Subject: "tasky", IssuedAt: 1476869400, Scope: "files:read"}
+	token, err := signJWT(secret, claims)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, isJWT(token))
+	assert.False(t, isJWT("5a6f8e3c1d"))
+
+	parsed := &appClaims{}
+	assert.NoError(t, parseJWT(secret, token, parsed))
+	assert.Equal(t, claims, parsed)
+
+	assert.Equal(t, ErrInvalidJWT, parseJWT([]byte("another-secret"), token, parsed))
+	assert.Equal(t, ErrInvalidJWT, parseJWT(secret, "not.a.jwt", parsed))
+	assert.Equal(t, ErrInvalidJWT, parseJWT(secret, "", parsed))
+
+	// the scopes can't be changed without the secret
+	parts := strings.Split(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"tasky","iat":1476869400,"scope":"files:readwrite"}`))
+	assert.Equal(t, ErrInvalidJWT, parseJWT(secret, parts[0]+"."+forged+"."+parts[2], parsed))
+
+	// the tokens without signature are refused
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	assert.Equal(t, ErrInvalidJWT, parseJWT(secret, none+"."+parts[1]+".", parsed))
+}
@@ -0,0 +1,29 @@
+package apps
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	"github.com/dcasier/cozy-stack/vfs"
+)
+
+// konnectorManifestFilename is the name of the manifest of a konnector
+const konnectorManifestFilename = "manifest.konnector"
+
+// ErrMissingEntrypoint is used when the entrypoint declared by the manifest
+// of a konnector is not in its files
+var ErrMissingEntrypoint = errors.New("Konnector entrypoint is missing")
+
+// checkEntrypoint checks that the entrypoint of a konnector has been
+// fetched in its directory. It does nothing for the webapps.
+func checkEntrypoint(vfsC *vfs.Context, man *Manifest, appdir string) error {
+	if man.AppType() != Konnector {
+		return nil
+	}
+	_, err := vfs.GetFileDocFromPath(vfsC, path.Join(appdir, man.Entrypoint))
+	if os.IsNotExist(err) {
+		return ErrMissingEntrypoint
+	}
+	return err
+}
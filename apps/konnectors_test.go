@@ -0,0 +1,107 @@
+package apps
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const konnectorManifest = `{
+  "name": "Bank",
+  "slug": "bank",
+  "type": "konnector",
+  "version": "1.0.0",
+  "entrypoint": "./index.js",
+  "permissions": {
+    "data/io.cozy.bank.operations": {"description": "Save the operations", "access": "write"}
+  }
+}`
+
+func TestAppType(t *testing.T) {
+	assert.Equal(t, ManifestDocType, Webapp.DocType())
+	assert.Equal(t, KonnectorDocType, Konnector.DocType())
+	assert.Equal(t, AppsDirectory, Webapp.Directory())
+	assert.Equal(t, KonnectorsDirectory, Konnector.Directory())
+
+	man := &Manifest{ManID: "bank"}
+	assert.Equal(t, Webapp, man.AppType())
+	assert.Equal(t, "/apps/bank", man.SelfLink())
+	man.Type = Konnector
+	assert.Equal(t, KonnectorDocType, man.DocType())
+	assert.Equal(t, "/konnectors/bank", man.SelfLink())
+}
+
+func TestParseKonnectorManifest(t *testing.T) {
+	man, err := parseManifest(strings.NewReader(konnectorManifest), Konnector)
+	if assert.NoError(t, err) {
+		assert.Equal(t, Konnector, man.Type)
+		assert.Equal(t, "/index.js", man.Entrypoint)
+		assert.Empty(t, man.Routes)
+		assert.Len(t, man.Scopes, 1)
+	}
+
+	// a konnector is not a webapp
+	_, err = parseManifest(strings.NewReader(konnectorManifest), Webapp)
+	if assert.IsType(t, ManifestErrors{}, err) {
+		fields := []string{}
+		for _, e := range err.(ManifestErrors) {
+			fields = append(fields, e.Field)
+		}
+		assert.Equal(t, []string{"type", "routes"}, fields)
+	}
+
+	manifest := `{"name": "Bank", "slug": "bank", "version": "1.0.0", "permissions": {},
+		"routes": {"/": {"folder": "/"}}, "entrypoint": "../../etc/passwd"}`
+	_, err = parseManifest(strings.NewReader(manifest), Konnector)
+	if assert.IsType(t, ManifestErrors{}, err) {
+		errs := err.(ManifestErrors)
+		if assert.Len(t, errs, 2) {
+			assert.Equal(t, "routes", errs[0].Field)
+			assert.Equal(t, "entrypoint", errs[1].Field)
+		}
+	}
+
+	manifest = `{"name": "Bank", "slug": "bank", "version": "1.0.0", "permissions": {}}`
+	_, err = parseManifest(strings.NewReader(manifest), Konnector)
+	if assert.IsType(t, ManifestErrors{}, err) {
+		errs := err.(ManifestErrors)
+		if assert.Len(t, errs, 1) {
+			assert.Equal(t, "entrypoint", errs[0].Field)
+		}
+	}
+}
+
+func TestArchiveKonnectorManifest(t *testing.T) {
+	archive := makeTarGz(t, map[string]string{
+		"bank-1.0.0/manifest.konnector": konnectorManifest,
+		"bank-1.0.0/index.js":           "console.log('bank')",
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive)
+	}))
+	defer ts.Close()
+
+	src, _ := url.Parse(ts.URL + "/bank-1.0.0.tar.gz")
+	cli, err := newArchiveClient(Konnector, src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	r, err := cli.FetchManifest()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	var man Manifest
+	assert.NoError(t, json.NewDecoder(r).Decode(&man))
+	assert.Equal(t, "Bank", man.Name)
+
+	// the same archive has no manifest for a webapp
+	cli, _ = newArchiveClient(Webapp, src)
+	_, err = cli.FetchManifest()
+	assert.Equal(t, ErrBadManifest, err)
+}
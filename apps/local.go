@@ -0,0 +1,89 @@
+package apps
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/dcasier/cozy-stack/vfs"
+)
+
+// localClient is the client for the applications in a local directory,
+// like file:///home/dev/my-app, for the developers of applications
+type localClient struct {
+	dir      string
+	manifest string
+}
+
+// ErrLocalSource is used when an application is installed from a local
+// directory by a client that is not the command line of the stack
+var ErrLocalSource = errors.New("The local sources are only for the command line or the development mode")
+
+// IsLocalSource returns true if the source of an application is a local
+// directory, like file:///home/dev/my-app. Such a source can read any
+// directory of the server, so the HTTP frontend only accepts it from the
+// command line or in development mode.
+func IsLocalSource(src string) bool {
+	u, err := url.Parse(src)
+	return err == nil && u.Scheme == "file"
+}
+
+func newLocalClient(typ AppType, src *url.URL) (*localClient, error) {
+	if src.Host != "" && src.Host != "localhost" {
+		return nil, ErrNotSupportedSource
+	}
+	dir := filepath.FromSlash(src.Path)
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return nil, ErrSourceNotReachable
+	}
+	return &localClient{dir: dir, manifest: typ.manifestFilename()}, nil
+}
+
+func (l *localClient) FetchManifest() (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(l.dir, l.manifest))
+	if err != nil {
+		return nil, ErrSourceNotReachable
+	}
+	return f, nil
+}
+
+// Fetch copies the files of the local directory in the application
+// directory of the VFS. The hidden files and directories, like .git, are
+// skipped.
+func (l *localClient) Fetch(vfsC *vfs.Context, appdir string) error {
+	return filepath.Walk(l.dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(l.dir, name)
+		if err != nil || rel == "." {
+			return err
+		}
+		if info.Name()[0] == '.' {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		abs := path.Join(appdir, filepath.ToSlash(rel))
+		if info.IsDir() {
+			return vfsC.MkdirAll(abs)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return writeFile(vfsC, abs, f)
+	})
+}
+
+var _ Client = &localClient{}
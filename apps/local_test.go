@@ -0,0 +1,46 @@
+package apps
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-local-app")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	manifest := `{"name": "Mini", "version": "1.0.0"}`
+	err = ioutil.WriteFile(filepath.Join(dir, manifestFilename), []byte(manifest), 0644)
+	assert.NoError(t, err)
+
+	src, _ := url.Parse("file://" + filepath.ToSlash(dir))
+	c, err := newLocalClient(Webapp, src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	r, err := c.FetchManifest()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	var man Manifest
+	assert.NoError(t, json.NewDecoder(r).Decode(&man))
+	assert.Equal(t, "Mini", man.Name)
+	assert.Equal(t, "1.0.0", man.Version)
+
+	src, _ = url.Parse("file://" + filepath.ToSlash(filepath.Join(dir, "missing")))
+	_, err = newLocalClient(Webapp, src)
+	assert.Equal(t, ErrSourceNotReachable, err)
+
+	src, _ = url.Parse("file://example.org/app")
+	_, err = newLocalClient(Webapp, src)
+	assert.Equal(t, ErrNotSupportedSource, err)
+}
@@ -0,0 +1,165 @@
+package apps
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+)
+
+// LeaseDocType is the doctype of the leases that lock an application
+// between the processes of the stack
+const LeaseDocType = "io.cozy.apps.leases"
+
+// leaseDuration is the time a lease is valid if it is not renewed, in
+// case its process has been stopped
+const leaseDuration = 5 * time.Minute
+
+// ErrLocked is used when an installation, update or uninstallation of the
+// application is already running
+var ErrLocked = errors.New("Another operation is already running on this application")
+
+// lockOwner identifies this process in the leases
+var lockOwner = newLockOwner()
+
+func newLockOwner() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// lease is a lock on an application, shared by the processes of the stack
+// via CouchDB. Its identifier is the slug of the application.
+type lease struct {
+	LeaseID   string    `json:"_id,omitempty"`
+	LeaseRev  string    `json:"_rev,omitempty"`
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ID returns the lease identifier - see couchdb.Doc interface
+func (l *lease) ID() string { return l.LeaseID }
+
+// Rev returns the lease revision - see couchdb.Doc interface
+func (l *lease) Rev() string { return l.LeaseRev }
+
+// DocType returns the lease doctype - see couchdb.Doc interface
+func (l *lease) DocType() string { return LeaseDocType }
+
+// SetID changes the lease identifier - see couchdb.Doc interface
+func (l *lease) SetID(id string) { l.LeaseID = id }
+
+// SetRev changes the lease revision - see couchdb.Doc interface
+func (l *lease) SetRev(rev string) { l.LeaseRev = rev }
+
+// localLocks are the applications locked by this process
+var localLocks = struct {
+	sync.Mutex
+	held map[string]bool
+}{held: make(map[string]bool)}
+
+func lockLocal(db, slug string) bool {
+	key := appKey(db, slug)
+	localLocks.Lock()
+	defer localLocks.Unlock()
+	if localLocks.held[key] {
+		return false
+	}
+	localLocks.held[key] = true
+	return true
+}
+
+func unlockLocal(db, slug string) {
+	localLocks.Lock()
+	delete(localLocks.held, appKey(db, slug))
+	localLocks.Unlock()
+}
+
+// lock serializes the operations on an application: it returns ErrLocked
+// if another operation is running on it, in this process or in another one.
+// Else, the returned function must be called to release the lock.
+func lock(ctx context.Context, db, slug string) (func(), error) {
+	if !lockLocal(db, slug) {
+		return nil, ErrLocked
+	}
+
+	l, err := acquireLease(ctx, db, slug)
+	if err != nil {
+		unlockLocal(db, slug)
+		return nil, err
+	}
+
+	// the lease is renewed while the operation is running, and deleted
+	// when it is done
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(leaseDuration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.ExpiresAt = time.Now().Add(leaseDuration)
+				couchdb.UpdateDoc(ctx, db, l)
+			case <-stop:
+				couchdb.DeleteDoc(ctx, db, l)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		unlockLocal(db, slug)
+	}, nil
+}
+
+// acquireLease creates the lease for the application, or takes it over if
+// it has expired
+func acquireLease(ctx context.Context, db, slug string) (*lease, error) {
+	l := &lease{
+		LeaseID:   slug,
+		Owner:     lockOwner,
+		ExpiresAt: time.Now().Add(leaseDuration),
+	}
+	err := couchdb.CreateNamedDocWithDB(ctx, db, l)
+	if couchdb.IsFileExistsError(err) {
+		// the database has been created by another process
+		err = couchdb.CreateNamedDoc(ctx, db, l)
+	}
+	if err == nil {
+		return l, nil
+	}
+	if !couchdb.IsConflictError(err) {
+		return nil, err
+	}
+
+	old := &lease{}
+	if err = couchdb.GetDoc(ctx, db, LeaseDocType, slug, old); err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	if old.ExpiresAt.After(time.Now()) {
+		return nil, ErrLocked
+	}
+
+	l.SetRev(old.Rev())
+	err = couchdb.UpdateDoc(ctx, db, l)
+	if couchdb.IsConflictError(err) {
+		return nil, ErrLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
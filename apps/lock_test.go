@@ -0,0 +1,21 @@
+package apps
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockLocal(t *testing.T) {
+	assert.True(t, lockLocal("test-lock/", "mini"))
+	assert.False(t, lockLocal("test-lock/", "mini"))
+	assert.True(t, lockLocal("test-lock/", "other"))
+	assert.True(t, lockLocal("other-instance/", "mini"))
+
+	unlockLocal("test-lock/", "mini")
+	assert.True(t, lockLocal("test-lock/", "mini"))
+
+	unlockLocal("test-lock/", "mini")
+	unlockLocal("test-lock/", "other")
+	unlockLocal("other-instance/", "mini")
+}
@@ -0,0 +1,293 @@
+package apps
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// manifestSlugReg is the format of the slug in a manifest
+var manifestSlugReg = regexp.MustCompile(`^[a-z0-9][a-z0-9\-]*$`)
+
+// ValidSlug returns true if the slug has the format of the slugs of the
+// manifests, that can be used as a subdomain
+func ValidSlug(slug string) bool {
+	return manifestSlugReg.MatchString(slug)
+}
+
+// Route is a path of the application that serves a folder, with an
+// optional index, for the owner of the instance or for everybody if the
+// route is public.
+type Route struct {
+	Folder string `json:"folder"`
+	Index  string `json:"index,omitempty"`
+	Public bool   `json:"public"`
+}
+
+// Routes is a map of the paths of the application to their route
+type Routes map[string]*Route
+
+// FindRoute returns the route with the longest path matching the given
+// URL path, and the rest of the URL path after the route path. It returns
+// a nil route if none matches.
+func (r Routes) FindRoute(urlpath string) (*Route, string) {
+	urlpath = path.Clean("/" + urlpath)
+	var found *Route
+	var foundPath, rest string
+	for p, route := range r {
+		var tail string
+		switch {
+		case p == "/":
+			tail = urlpath
+		case urlpath == strings.TrimSuffix(p, "/"):
+			tail = "/"
+		case strings.HasPrefix(urlpath, strings.TrimSuffix(p, "/")+"/"):
+			tail = strings.TrimPrefix(urlpath, strings.TrimSuffix(p, "/"))
+		default:
+			continue
+		}
+		if found == nil || len(p) > len(foundPath) {
+			found, foundPath, rest = route, p, tail
+		}
+	}
+	return found, rest
+}
+
+// ManifestError is an error on a field of an invalid manifest. The field is
+// the path of the field in the manifest, like permissions.files/images.
+type ManifestError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ManifestError) Error() string {
+	return "Invalid manifest field " + e.Field + ": " + e.Reason
+}
+
+// ManifestErrors is the list of the errors of an invalid manifest
+type ManifestErrors []*ManifestError
+
+func (errs ManifestErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// parseManifest reads, validates and normalizes the manifest of an
+// application of the given type. If the JSON is malformed, ErrBadManifest is
+// returned, and if the manifest is not valid, the errors are returned as
+// ManifestErrors.
+func parseManifest(r io.Reader, typ AppType) (*Manifest, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, ManifestMaxSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err = json.Unmarshal(body, &raw); err != nil {
+		return nil, ErrBadManifest
+	}
+	if errs := validateManifest(raw, typ); len(errs) > 0 {
+		return nil, errs
+	}
+
+	man := &Manifest{}
+	if err = json.Unmarshal(body, man); err != nil {
+		return nil, ErrBadManifest
+	}
+	normalizeManifest(man, typ)
+	return man, nil
+}
+
+// manifestValidator accumulates the errors found in a manifest
+type manifestValidator struct {
+	errs ManifestErrors
+}
+
+func (v *manifestValidator) fail(field, reason string) {
+	v.errs = append(v.errs, &ManifestError{Field: field, Reason: reason})
+}
+
+// str checks that the field is a string, not empty if it is required
+func (v *manifestValidator) str(obj map[string]interface{}, key, field string, required bool) (string, bool) {
+	val, ok := obj[key]
+	if !ok || val == nil {
+		if required {
+			v.fail(field, "is required")
+		}
+		return "", false
+	}
+	s, ok := val.(string)
+	if !ok {
+		v.fail(field, "must be a string")
+		return "", false
+	}
+	if required && strings.TrimSpace(s) == "" {
+		v.fail(field, "must not be empty")
+		return "", false
+	}
+	return s, true
+}
+
+// object checks that the field is a JSON object
+func (v *manifestValidator) object(obj map[string]interface{}, key, field string, required bool) (map[string]interface{}, bool) {
+	val, ok := obj[key]
+	if !ok || val == nil {
+		if required {
+			v.fail(field, "is required")
+		}
+		return nil, false
+	}
+	o, ok := val.(map[string]interface{})
+	if !ok {
+		v.fail(field, "must be an object")
+		return nil, false
+	}
+	return o, true
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateManifest checks the fields of a manifest, before it is decoded in
+// a Manifest struct. The webapps must declare their routes, and the
+// konnectors their entrypoint.
+func validateManifest(raw map[string]interface{}, typ AppType) ManifestErrors {
+	v := &manifestValidator{}
+
+	if t, ok := v.str(raw, "type", "type", false); ok && AppType(t) != typ {
+		v.fail("type", "must be "+string(typ))
+	}
+
+	v.str(raw, "name", "name", true)
+	v.str(raw, "version", "version", true)
+	if slug, ok := v.str(raw, "slug", "slug", true); ok {
+		if !manifestSlugReg.MatchString(strings.TrimSpace(slug)) {
+			v.fail("slug", "must contain only lowercase letters, digits and dashes")
+		}
+	}
+	for _, key := range []string{"icon", "description", "default_locale", "license"} {
+		v.str(raw, key, key, false)
+	}
+
+	if dev, ok := v.object(raw, "developer", "developer", false); ok {
+		v.str(dev, "name", "developer.name", true)
+		v.str(dev, "url", "developer.url", false)
+	}
+
+	if locales, ok := v.object(raw, "locales", "locales", false); ok {
+		for _, locale := range sortedKeys(locales) {
+			if l, ok := v.object(locales, locale, "locales."+locale, true); ok {
+				v.str(l, "description", "locales."+locale+".description", false)
+			}
+		}
+	}
+
+	if perms, ok := v.object(raw, "permissions", "permissions", true); ok {
+		for _, key := range sortedKeys(perms) {
+			field := "permissions." + key
+			p, ok := v.object(perms, key, field, true)
+			if !ok {
+				continue
+			}
+			v.str(p, "description", field+".description", true)
+			if strings.HasPrefix(key, "data/") && IsInternalDoctype(strings.TrimPrefix(key, "data/")) {
+				v.fail(field, "is an internal doctype of the stack")
+			}
+			access, ok := v.str(p, "access", field+".access", false)
+			if !ok || strings.HasPrefix(key, "jobs/") {
+				// the workers can use the access for their own needs
+				continue
+			}
+			switch Access(strings.ToLower(strings.TrimSpace(access))) {
+			case ReadAccess, WriteAccess, ReadWriteAccess:
+			default:
+				v.fail(field+".access", "must be read, write or readwrite")
+			}
+		}
+	}
+
+	if typ == Konnector {
+		for _, key := range []string{"routes", "intents", "services", "csp"} {
+			if _, ok := raw[key]; ok {
+				v.fail(key, "is not allowed for a konnector")
+			}
+		}
+		if entrypoint, ok := v.str(raw, "entrypoint", "entrypoint", true); ok {
+			clean := path.Clean("/" + entrypoint)
+			if clean == "/" || strings.Contains(entrypoint, "..") {
+				v.fail("entrypoint", "must be the path of a file of the konnector")
+			}
+		}
+		return v.errs
+	}
+
+	if routes, ok := v.object(raw, "routes", "routes", true); ok {
+		if len(routes) == 0 {
+			v.fail("routes", "must declare at least one route")
+		}
+		for _, key := range sortedKeys(routes) {
+			field := "routes." + key
+			if !strings.HasPrefix(key, "/") {
+				v.fail(field, "must start with a /")
+			}
+			r, ok := v.object(routes, key, field, true)
+			if !ok {
+				continue
+			}
+			v.str(r, "folder", field+".folder", false)
+			v.str(r, "index", field+".index", false)
+			if public, ok := r["public"]; ok {
+				if _, ok := public.(bool); !ok {
+					v.fail(field+".public", "must be a boolean")
+				}
+			}
+		}
+	}
+
+	v.validateIntents(raw)
+	v.validateCSP(raw)
+	return v.errs
+}
+
+// normalizeManifest trims the fields of a valid manifest, and cleans the
+// paths of its routes and entrypoint
+func normalizeManifest(man *Manifest, typ AppType) {
+	man.Type = typ
+	man.Name = strings.TrimSpace(man.Name)
+	man.Slug = strings.TrimSpace(man.Slug)
+	man.Version = strings.TrimSpace(man.Version)
+
+	if man.Permissions != nil {
+		for _, p := range *man.Permissions {
+			p.Access = Access(strings.ToLower(strings.TrimSpace(string(p.Access))))
+		}
+	}
+
+	routes := make(Routes, len(man.Routes))
+	for key, r := range man.Routes {
+		if r.Folder == "" {
+			r.Folder = "/"
+		}
+		r.Folder = path.Clean("/" + r.Folder)
+		routes[path.Clean(key)] = r
+	}
+	man.Routes = routes
+	if man.Entrypoint != "" {
+		man.Entrypoint = path.Clean("/" + man.Entrypoint)
+	}
+	normalizeIntents(man)
+	man.Scopes = ParseScopes(man.Permissions)
+}
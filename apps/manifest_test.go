@@ -0,0 +1,126 @@
+package apps
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const validManifest = `{
+  "name": " Mini ",
+  "slug": "mini",
+  "version": "1.0.0",
+  "permissions": {
+    "data/io.cozy.contacts": {"description": "Autocompletion", "access": "Read"},
+    "jobs/sendmail": {"description": "Send emails", "access": "mailer"}
+  },
+  "routes": {
+    "/admin/": {"folder": "", "index": "admin.html"},
+    "/assets": {"folder": "assets", "public": true}
+  }
+}`
+
+func TestParseValidManifest(t *testing.T) {
+	man, err := parseManifest(strings.NewReader(validManifest), Webapp)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "Mini", man.Name)
+	assert.Equal(t, "mini", man.Slug)
+	perms := *man.Permissions
+	assert.Equal(t, Access("read"), perms["data/io.cozy.contacts"].Access)
+	assert.Equal(t, Access("mailer"), perms["jobs/sendmail"].Access)
+	if assert.Contains(t, man.Routes, "/admin") {
+		assert.Equal(t, "/", man.Routes["/admin"].Folder)
+		assert.Equal(t, "admin.html", man.Routes["/admin"].Index)
+		assert.False(t, man.Routes["/admin"].Public)
+	}
+	if assert.Contains(t, man.Routes, "/assets") {
+		assert.Equal(t, "/assets", man.Routes["/assets"].Folder)
+		assert.True(t, man.Routes["/assets"].Public)
+	}
+}
+
+func TestParseMalformedManifest(t *testing.T) {
+	_, err := parseManifest(strings.NewReader(`{"name": "Mini",`), Webapp)
+	assert.Equal(t, ErrBadManifest, err)
+	_, err = parseManifest(strings.NewReader(`["name"]`), Webapp)
+	assert.Equal(t, ErrBadManifest, err)
+}
+
+func TestParseInvalidManifest(t *testing.T) {
+	manifest := `{
+  "name": "",
+  "slug": "Not a slug",
+  "version": 2,
+  "permissions": {
+    "data/io.cozy.contacts": {"access": "all"},
+    "data/io.cozy.apps.tokens": {"description": "More rights", "access": "write"},
+    "files/images": "read"
+  },
+  "routes": {
+    "admin": {"folder": "/", "public": "yes"}
+  }
+}`
+	_, err := parseManifest(strings.NewReader(manifest), Webapp)
+	errs, ok := err.(ManifestErrors)
+	if !assert.True(t, ok) {
+		return
+	}
+	fields := make(map[string]string)
+	for _, e := range errs {
+		fields[e.Field] = e.Reason
+	}
+	assert.Equal(t, "must not be empty", fields["name"])
+	assert.Equal(t, "must be a string", fields["version"])
+	assert.Contains(t, fields, "slug")
+	assert.Equal(t, "is required", fields["permissions.data/io.cozy.contacts.description"])
+	assert.Contains(t, fields, "permissions.data/io.cozy.contacts.access")
+	assert.Equal(t, "is an internal doctype of the stack", fields["permissions.data/io.cozy.apps.tokens"])
+	assert.Equal(t, "must be an object", fields["permissions.files/images"])
+	assert.Equal(t, "must start with a /", fields["routes.admin"])
+	assert.Equal(t, "must be a boolean", fields["routes.admin.public"])
+	assert.Len(t, errs, 9)
+
+	_, err = parseManifest(strings.NewReader(`{"name": "Mini", "slug": "mini", "version": "1.0.0"}`), Webapp)
+	errs, ok = err.(ManifestErrors)
+	if assert.True(t, ok) && assert.Len(t, errs, 2) {
+		assert.Equal(t, "permissions", errs[0].Field)
+		assert.Equal(t, "routes", errs[1].Field)
+	}
+}
+
+func parseManifestString(s string) (*Manifest, error) {
+	return parseManifest(strings.NewReader(s), Webapp)
+}
+
+func TestFindRoute(t *testing.T) {
+	routes := Routes{
+		"/":       &Route{Folder: "/", Index: "index.html"},
+		"/admin":  &Route{Folder: "/", Index: "admin.html"},
+		"/assets": &Route{Folder: "/assets", Public: true},
+	}
+
+	route, rest := routes.FindRoute("/")
+	assert.Equal(t, routes["/"], route)
+	assert.Equal(t, "/", rest)
+	route, rest = routes.FindRoute("/foo/bar.js")
+	assert.Equal(t, routes["/"], route)
+	assert.Equal(t, "/foo/bar.js", rest)
+	route, rest = routes.FindRoute("/admin")
+	assert.Equal(t, routes["/admin"], route)
+	assert.Equal(t, "/", rest)
+	route, rest = routes.FindRoute("/admin/app.js")
+	assert.Equal(t, routes["/admin"], route)
+	assert.Equal(t, "/app.js", rest)
+	route, rest = routes.FindRoute("/administration")
+	assert.Equal(t, routes["/"], route)
+	assert.Equal(t, "/administration", rest)
+	route, rest = routes.FindRoute("/assets/../admin/")
+	assert.Equal(t, routes["/admin"], route)
+	assert.Equal(t, "/", rest)
+
+	route, _ = Routes{"/public": &Route{}}.FindRoute("/private")
+	assert.Nil(t, route)
+}
@@ -0,0 +1,156 @@
+package apps
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/logger"
+	"github.com/dcasier/cozy-stack/vfs"
+)
+
+// Recover resumes the installations, updates and uninstallations of the
+// applications and konnectors that have been interrupted by the last stop of the stack.
+// Their state is persisted in their manifest:
+//   - an installation is restarted from scratch, after its partial files
+//     (including the .git directory of a clone) have been removed
+//   - an update is restarted, after the current version has been restored
+//   - an uninstallation is finished.
+//
+// The applications that are locked are skipped: their operation is still
+// running in another process of the stack. The installations and updates
+// go on in the background.
+func Recover(ctx context.Context, vfsC *vfs.Context, db string) error {
+	var mans []*Manifest
+	for _, typ := range []AppType{Webapp, Konnector} {
+		list, err := List(ctx, db, typ)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return err
+		}
+		mans = append(mans, list...)
+	}
+
+	var errm error
+	for _, man := range mans {
+		var err error
+		switch man.State {
+		case Installing:
+			err = recoverInstall(ctx, vfsC, db, man)
+		case Upgrading:
+			err = recoverUpdate(ctx, vfsC, db, man)
+		case Uninstalling:
+			err = Uninstall(ctx, vfsC, db, man.AppType(), man.Slug)
+		default:
+			continue
+		}
+		if err != nil && err != ErrLocked {
+			errm = fmt.Errorf("cannot recover %s: %v", man.Slug, err)
+		}
+	}
+	return errm
+}
+
+func recoverInstall(ctx context.Context, vfsC *vfs.Context, db string, man *Manifest) error {
+	ok, err := resetInstall(ctx, vfsC, db, man)
+	if err != nil || !ok {
+		return err
+	}
+	inst, err := NewInstaller(ctx, vfsC, db, man.AppType(), man.Slug, man.Source)
+	if err != nil {
+		return err
+	}
+	go inst.Install()
+	go inst.waitReady()
+	return nil
+}
+
+// resetInstall removes the partial files of an interrupted installation,
+// and makes the application available for a new one. It returns false if
+// the installation has been recovered since the application was listed.
+func resetInstall(ctx context.Context, vfsC *vfs.Context, db string, man *Manifest) (bool, error) {
+	unlock, err := lock(ctx, db, man.Slug)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	man, err = GetBySlug(ctx, db, man.AppType(), man.Slug)
+	if err != nil || man.State != Installing {
+		return false, err
+	}
+	if err = removeDir(vfsC, path.Join(man.AppType().Directory(), man.Slug)); err != nil {
+		return false, err
+	}
+	man.State = Available
+	return true, couchdb.UpdateDoc(ctx, db, man)
+}
+
+func recoverUpdate(ctx context.Context, vfsC *vfs.Context, db string, man *Manifest) error {
+	ok, err := resetUpdate(ctx, vfsC, db, man)
+	if err != nil || !ok {
+		return err
+	}
+	updater, err := NewUpdater(ctx, vfsC, db, man.AppType(), man.Slug)
+	if err != nil {
+		return err
+	}
+	go updater.Update()
+	go updater.waitReady()
+	return nil
+}
+
+// resetUpdate restores the current version of an application whose update
+// has been interrupted, and removes the new one. It returns false if the
+// update has been recovered since the application was listed.
+func resetUpdate(ctx context.Context, vfsC *vfs.Context, db string, man *Manifest) (bool, error) {
+	unlock, err := lock(ctx, db, man.Slug)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	man, err = GetBySlug(ctx, db, man.AppType(), man.Slug)
+	if err != nil || man.State != Upgrading {
+		return false, err
+	}
+
+	dir := man.AppType().Directory()
+	appdir := path.Join(dir, man.Slug)
+	newdir := path.Join(dir, "."+man.Slug+".new")
+	olddir := path.Join(dir, "."+man.Slug+".old")
+
+	// the update may have been interrupted between the two renames, when
+	// the current version was already moved to the .old directory
+	_, err = vfs.GetDirDocFromPath(vfsC, appdir, false)
+	if os.IsNotExist(err) {
+		if _, err = vfs.GetDirDocFromPath(vfsC, olddir, false); err == nil {
+			err = vfsC.Rename(olddir, appdir)
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err = removeDir(vfsC, newdir); err != nil {
+		return false, err
+	}
+
+	setErrored(man, updateOperation)
+	return true, couchdb.UpdateDoc(ctx, db, man)
+}
+
+// waitReady reads the progress of the installer, when nobody else does it,
+// until the application is ready or an error occurs
+func (i *Installer) waitReady() {
+	for {
+		man, err := i.WaitManifest()
+		if err != nil {
+			logger.Errorf("apps", "cannot install %s: %v", i.slug, err)
+			return
+		}
+		if man.State == Ready {
+			return
+		}
+	}
+}
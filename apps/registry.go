@@ -0,0 +1,221 @@
+package apps
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/dcasier/cozy-stack/vfs"
+)
+
+// defaultChannel is the channel of the registry used when the source does
+// not give one, like registry://drive
+const defaultChannel = "stable"
+
+var (
+	// ErrNoRegistry is used when an application is installed from the
+	// registry, but no registry has been configured
+	ErrNoRegistry = errors.New("No registry is configured for the applications")
+	// ErrBadChecksum is used when the tarball of an application does not
+	// match the checksum given by the registry
+	ErrBadChecksum = errors.New("Application tarball does not match its checksum")
+)
+
+var (
+	registryMu  sync.RWMutex
+	registryURL *url.URL
+)
+
+// UseRegistry configures the URL of the registry used to install the
+// applications with a registry:// source. An empty URL disables it. It can
+// be called again when the configuration is reloaded: the installations in
+// progress keep the previous registry.
+func UseRegistry(rawurl string) error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if rawurl == "" {
+		registryURL = nil
+		return nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	registryURL = u
+	return nil
+}
+
+// registryVersion is a version of an application, as returned by the
+// registry for GET /:app/:channel/latest. The signature of the tarball is
+// optional, and encoded in base64.
+type registryVersion struct {
+	Version   string          `json:"version"`
+	URL       string          `json:"url"`
+	Sha256    string          `json:"sha256"`
+	Signature string          `json:"signature,omitempty"`
+	Manifest  json.RawMessage `json:"manifest"`
+}
+
+type registryClient struct {
+	registry *url.URL
+	src      string
+	app      string
+	channel  string
+	manifest string
+	version  *registryVersion
+
+	pinned   []byte
+	checksum string
+}
+
+// newRegistryClient returns a client for a source like
+// registry://drive/stable, where drive is the name of the application in
+// the registry and stable is the channel
+func newRegistryClient(typ AppType, src *url.URL) (*registryClient, error) {
+	registryMu.RLock()
+	registry := registryURL
+	registryMu.RUnlock()
+	if registry == nil {
+		return nil, ErrNoRegistry
+	}
+	channel := strings.Trim(src.Path, "/")
+	if channel == "" {
+		channel = defaultChannel
+	}
+	if src.Host == "" || strings.Contains(channel, "/") {
+		return nil, &url.Error{
+			Op:  "parsepath",
+			URL: src.String(),
+			Err: errors.New("Could not parse the registry source"),
+		}
+	}
+	return &registryClient{
+		registry: registry,
+		src:      src.String(),
+		app:      src.Host,
+		channel:  channel,
+		manifest: typ.manifestFilename(),
+	}, nil
+}
+
+// resolve asks the registry for the latest version of the application on
+// its channel. The version is kept for Fetch, so that the files match the
+// manifest.
+func (r *registryClient) resolve() (*registryVersion, error) {
+	if r.version != nil {
+		return r.version, nil
+	}
+
+	ref := &url.URL{Path: url.QueryEscape(r.app) + "/" + url.QueryEscape(r.channel) + "/latest"}
+	resp, err := http.Get(r.registry.ResolveReference(ref).String())
+	if err != nil {
+		return nil, ErrSourceNotReachable
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, ErrSourceNotReachable
+	}
+
+	var v registryVersion
+	err = json.NewDecoder(io.LimitReader(resp.Body, ManifestMaxSize)).Decode(&v)
+	if err != nil || v.Version == "" || v.URL == "" || v.Sha256 == "" || len(v.Manifest) == 0 {
+		return nil, ErrBadManifest
+	}
+	r.version = &v
+	return r.version, nil
+}
+
+// PinChecksum sets the sha256 checksum that the tarball must match, in
+// addition to the checksum given by the registry
+func (r *registryClient) PinChecksum(checksum string) error {
+	sum, err := parseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	r.pinned = sum
+	return nil
+}
+
+// Checksum returns the checksum of the tarball verified by the last call
+// to Fetch
+func (r *registryClient) Checksum() string {
+	return r.checksum
+}
+
+func (r *registryClient) FetchManifest() (io.ReadCloser, error) {
+	v, err := r.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(v.Manifest)), nil
+}
+
+func (r *registryClient) Fetch(vfsC *vfs.Context, appdir string) error {
+	v, err := r.resolve()
+	if err != nil {
+		return err
+	}
+
+	tarballURL, err := r.registry.Parse(v.URL)
+	if err != nil {
+		return err
+	}
+	var sig []byte
+	if v.Signature != "" {
+		sig, err = base64.StdEncoding.DecodeString(v.Signature)
+		if err != nil {
+			return ErrBadSignature
+		}
+	}
+	tarball, digest, err := downloadTarball(tarballURL.String(), v.Sha256)
+	if err != nil {
+		return err
+	}
+	defer removeTempFile(tarball)
+	if err = verifyPackage(digest, r.pinned, sig); err != nil {
+		return err
+	}
+
+	if err = extractArchive(vfsC, tarball, tarGzArchive, r.manifest, appdir); err != nil {
+		return err
+	}
+	r.checksum = formatChecksum(digest)
+	return nil
+}
+
+// downloadTarball downloads a tarball in a temporary file and checks its
+// sha256 checksum, before its files are extracted. It returns the file and
+// its sha256 digest. The caller must remove the file.
+func downloadTarball(rawurl, checksum string) (*os.File, []byte, error) {
+	expected, err := parseChecksum(checksum)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h := sha256.New()
+	tmp, err := downloadFile(rawurl, h)
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := h.Sum(nil)
+	if !bytes.Equal(digest, expected) {
+		removeTempFile(tmp)
+		return nil, nil, ErrBadChecksum
+	}
+	return tmp, digest, nil
+}
+
+var _ Client = &registryClient{}
+var _ verifier = &registryClient{}
@@ -0,0 +1,95 @@
+package apps
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var tarballContent = []byte("not really a tarball")
+
+func newTestRegistry(t *testing.T) *httptest.Server {
+	sum := sha256.Sum256(tarballContent)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/registry/drive/stable/latest", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"version":  "1.2.3",
+			"url":      "/tarballs/drive-1.2.3.tar.gz",
+			"sha256":   hex.EncodeToString(sum[:]),
+			"manifest": map[string]string{"name": "Drive", "version": "1.2.3"},
+		})
+	})
+	mux.HandleFunc("/tarballs/drive-1.2.3.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarballContent)
+	})
+	ts := httptest.NewServer(mux)
+	assert.NoError(t, UseRegistry(ts.URL+"/registry"))
+	return ts
+}
+
+func TestRegistryClient(t *testing.T) {
+	ts := newTestRegistry(t)
+	defer ts.Close()
+	defer UseRegistry("")
+
+	src, _ := url.Parse("registry://drive/stable")
+	cli, err := newRegistryClient(Webapp, src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	r, err := cli.FetchManifest()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	var man Manifest
+	assert.NoError(t, json.NewDecoder(r).Decode(&man))
+	assert.Equal(t, "Drive", man.Name)
+	assert.Equal(t, "1.2.3", man.Version)
+
+	src, _ = url.Parse("registry://drive")
+	cli, err = newRegistryClient(Webapp, src)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "stable", cli.channel)
+	}
+
+	src, _ = url.Parse("registry://unknown/beta")
+	cli, _ = newRegistryClient(Webapp, src)
+	_, err = cli.FetchManifest()
+	assert.Equal(t, ErrSourceNotReachable, err)
+}
+
+func TestRegistryNotConfigured(t *testing.T) {
+	src, _ := url.Parse("registry://drive/stable")
+	_, err := newRegistryClient(Webapp, src)
+	assert.Equal(t, ErrNoRegistry, err)
+}
+
+func TestDownloadTarball(t *testing.T) {
+	ts := newTestRegistry(t)
+	defer ts.Close()
+	defer UseRegistry("")
+
+	sum := sha256.Sum256(tarballContent)
+	tarballURL := fmt.Sprintf("%s/tarballs/drive-1.2.3.tar.gz", ts.URL)
+	f, _, err := downloadTarball(tarballURL, hex.EncodeToString(sum[:]))
+	if assert.NoError(t, err) {
+		content, _ := ioutil.ReadAll(f)
+		assert.Equal(t, tarballContent, content)
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	sum = sha256.Sum256([]byte("something else"))
+	_, _, err = downloadTarball(tarballURL, hex.EncodeToString(sum[:]))
+	assert.Equal(t, ErrBadChecksum, err)
+}
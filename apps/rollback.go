@@ -0,0 +1,81 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/vfs"
+)
+
+// ErrNoPreviousVersion is used when an application is rolled back, but its
+// previous version has not been kept
+var ErrNoPreviousVersion = errors.New("Application has no previous version to restore")
+
+// Rollback restores the previous version of an application of the given
+// type, kept by its last
+// update: the files of the .<slug>.old directory and the manifest of this
+// version. The two versions are swapped, so that a second rollback cancels
+// the first one.
+func Rollback(ctx context.Context, vfsC *vfs.Context, db string, typ AppType, slug string) (*Manifest, error) {
+	unlock, err := lock(ctx, db, slug)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	man, err := GetBySlug(ctx, db, typ, slug)
+	if err != nil {
+		return nil, err
+	}
+	if s := man.State; s != Ready && s != Errored {
+		return nil, ErrBadState
+	}
+	if man.Previous == nil {
+		return nil, ErrNoPreviousVersion
+	}
+
+	appdir := path.Join(typ.Directory(), slug)
+	olddir := path.Join(typ.Directory(), "."+slug+".old")
+	tmpdir := path.Join(typ.Directory(), "."+slug+".rollback")
+
+	if _, err = vfs.GetDirDocFromPath(vfsC, olddir, false); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoPreviousVersion
+		}
+		return nil, err
+	}
+	if err = removeDir(vfsC, tmpdir); err != nil {
+		return nil, err
+	}
+	if err = vfsC.Rename(appdir, tmpdir); err != nil {
+		return nil, err
+	}
+	if err = vfsC.Rename(olddir, appdir); err != nil {
+		return nil, err
+	}
+	if err = vfsC.Rename(tmpdir, olddir); err != nil {
+		return nil, err
+	}
+
+	current := *man
+	current.SetID("")
+	current.SetRev("")
+	current.State = Ready
+	current.Previous = nil
+	current.ErroredAt = nil
+	current.ErroredOp = ""
+	restored := *man.Previous
+	restored.SetID(man.ID())
+	restored.SetRev(man.Rev())
+	restored.Slug = slug
+	restored.State = Ready
+	restored.PreviousVersion = current.Version
+	restored.Previous = &current
+	if err = couchdb.UpdateDoc(ctx, db, &restored); err != nil {
+		return nil, err
+	}
+	return &restored, nil
+}
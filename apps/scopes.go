@@ -0,0 +1,210 @@
+package apps
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/dcasier/cozy-stack/doctypes"
+)
+
+// ErrInvalidScope is used when a scope of a scope string is malformed
+var ErrInvalidScope = errors.New("Invalid scope")
+
+// Scope is a permission of an application, parsed from the key and access
+// of a permission of its manifest. For example, the data/io.cozy.contacts
+// permission gives a scope with the data type and io.cozy.contacts target.
+type Scope struct {
+	Type   string `json:"type"`
+	Target string `json:"target"`
+	Access Access `json:"access,omitempty"`
+}
+
+// Scopes is a list of scopes, of an application or of a token
+type Scopes []*Scope
+
+// IsInternalDoctype returns true if the doctype is one of the internal
+// doctypes of the stack, or one of their sub-doctypes. They can't be
+// accessed with a data scope, only with the routes of the stack that manage
+// them.
+func IsInternalDoctype(doctype string) bool {
+	return doctypes.IsInternal(doctype)
+}
+
+// ParseScopes returns the scopes for the permissions of a manifest. The
+// data, files, settings and notifications permissions without an access are
+// read-only. The data permissions on the internal doctypes are ignored.
+func ParseScopes(perms *Permissions) Scopes {
+	if perms == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(*perms))
+	for key := range *perms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	scopes := make(Scopes, 0, len(keys))
+	for _, key := range keys {
+		parts := strings.SplitN(key, "/", 2)
+		scope := &Scope{Type: parts[0]}
+		if len(parts) == 2 {
+			scope.Target = parts[1]
+		}
+		if p := (*perms)[key]; p != nil {
+			scope.Access = p.Access
+		}
+		if scope.Access == "" && scope.Type != "jobs" {
+			scope.Access = ReadAccess
+		}
+		if scope.Type == "data" && IsInternalDoctype(scope.Target) {
+			continue
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes
+}
+
+// Allows returns true if the access level of the scope permits the given
+// access
+func (s *Scope) Allows(access Access) bool {
+	return s.Access == ReadWriteAccess || s.Access == access
+}
+
+// ParseScopeString parses a list of scopes separated by spaces, like the
+// scope parameter of OAuth2. A scope is written like a permission key of a
+// manifest, with its access after a colon, like data/io.cozy.contacts:read.
+// The scopes without an access are read-only. The internal doctypes can't
+// be asked.
+func ParseScopeString(str string) (Scopes, error) {
+	fields := strings.Fields(str)
+	if len(fields) == 0 {
+		return nil, ErrInvalidScope
+	}
+	scopes := make(Scopes, 0, len(fields))
+	for _, field := range fields {
+		key, access := field, ReadAccess
+		if idx := strings.LastIndex(field, ":"); idx >= 0 {
+			key, access = field[:idx], Access(field[idx+1:])
+		}
+		switch access {
+		case ReadAccess, WriteAccess, ReadWriteAccess:
+		default:
+			return nil, ErrInvalidScope
+		}
+		parts := strings.SplitN(key, "/", 2)
+		scope := &Scope{Type: parts[0], Access: access}
+		if len(parts) == 2 {
+			scope.Target = parts[1]
+		}
+		switch scope.Type {
+		case "data", "files", "settings", "notifications":
+		default:
+			return nil, ErrInvalidScope
+		}
+		if scope.Type == "data" && (scope.Target == "" || IsInternalDoctype(scope.Target)) {
+			return nil, ErrInvalidScope
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// String returns the scope in the format of ParseScopeString
+func (s *Scope) String() string {
+	key := s.Type
+	if s.Target != "" {
+		key += "/" + s.Target
+	}
+	if s.Access == "" {
+		return key
+	}
+	return key + ":" + string(s.Access)
+}
+
+// String returns the scopes in the format of ParseScopeString
+func (scopes Scopes) String() string {
+	strs := make([]string, len(scopes))
+	for i, s := range scopes {
+		strs[i] = s.String()
+	}
+	return strings.Join(strs, " ")
+}
+
+// CanAccessDoctype returns true if there is a data scope for the doctype
+// that permits the given access. It is always false for the internal
+// doctypes.
+func (scopes Scopes) CanAccessDoctype(doctype string, access Access) bool {
+	if IsInternalDoctype(doctype) {
+		return false
+	}
+	for _, s := range scopes {
+		if s.Type == "data" && s.Target == doctype && s.Allows(access) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessFiles returns true if there is a files scope that permits the
+// given access.
+//
+// TODO: restrict the access to the folder of the type of files (like
+// Documents/pictures for files/pictures)
+func (scopes Scopes) CanAccessFiles(access Access) bool {
+	for _, s := range scopes {
+		if s.Type == "files" && s.Allows(access) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessSettings returns true if there is a settings scope for the type
+// of settings (like locale or owner) that permits the given access. A
+// settings scope for all, or without type, is for all the types.
+func (scopes Scopes) CanAccessSettings(typ string, access Access) bool {
+	for _, s := range scopes {
+		if s.Type != "settings" || !s.Allows(access) {
+			continue
+		}
+		if s.Target == typ || s.Target == "all" || s.Target == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessNotifications returns true if there is a notifications scope
+// that permits the given access
+func (scopes Scopes) CanAccessNotifications(access Access) bool {
+	for _, s := range scopes {
+		if s.Type == "notifications" && s.Allows(access) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanPushJob returns true if there is a jobs scope for the worker type.
+// The access of a jobs scope is for the worker, not for the stack.
+func (scopes Scopes) CanPushJob(workerType string) bool {
+	for _, s := range scopes {
+		if s.Type == "jobs" && s.Target == workerType {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessDoctype returns true if the application has a data scope for
+// the doctype that permits the given access
+func (m *Manifest) CanAccessDoctype(doctype string, access Access) bool {
+	return m.Scopes.CanAccessDoctype(doctype, access)
+}
+
+// CanAccessFiles returns true if the application has a files scope that
+// permits the given access
+func (m *Manifest) CanAccessFiles(access Access) bool {
+	return m.Scopes.CanAccessFiles(access)
+}
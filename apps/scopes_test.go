@@ -0,0 +1,109 @@
+package apps
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScopes(t *testing.T) {
+	assert.Nil(t, ParseScopes(nil))
+
+	man, err := parseManifestString(`{
+  "name": "Mini", "slug": "mini", "version": "1.0.0",
+  "permissions": {
+    "data/io.cozy.contacts": {"description": "Autocompletion", "access": "read"},
+    "data/io.cozy.events": {"description": "Calendar", "access": "readwrite"},
+    "files/pictures": {"description": "Background"},
+    "jobs/sendmail": {"description": "Send emails"}
+  },
+  "routes": {"/": {"folder": "/", "index": "index.html"}}
+}`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, man.Scopes, 4) {
+		assert.Equal(t, &Scope{Type: "data", Target: "io.cozy.contacts", Access: ReadAccess}, man.Scopes[0])
+		assert.Equal(t, &Scope{Type: "data", Target: "io.cozy.events", Access: ReadWriteAccess}, man.Scopes[1])
+		assert.Equal(t, &Scope{Type: "files", Target: "pictures", Access: ReadAccess}, man.Scopes[2])
+		assert.Equal(t, &Scope{Type: "jobs", Target: "sendmail"}, man.Scopes[3])
+	}
+
+	assert.True(t, man.CanAccessDoctype("io.cozy.contacts", ReadAccess))
+	assert.False(t, man.CanAccessDoctype("io.cozy.contacts", WriteAccess))
+	assert.True(t, man.CanAccessDoctype("io.cozy.events", WriteAccess))
+	assert.False(t, man.CanAccessDoctype("io.cozy.files", ReadAccess))
+	assert.True(t, man.CanAccessFiles(ReadAccess))
+	assert.False(t, man.CanAccessFiles(WriteAccess))
+	assert.True(t, man.Scopes.CanPushJob("sendmail"))
+	assert.False(t, man.Scopes.CanPushJob("log"))
+
+	// the data permissions on the internal doctypes are ignored
+	scopes := ParseScopes(&Permissions{
+		"data/io.cozy.files":         {Description: "Files", Access: ReadWriteAccess},
+		"data/io.cozy.notifications": {Description: "Notifications"},
+		"notifications":              {Description: "Notifications", Access: WriteAccess},
+	})
+	if assert.Len(t, scopes, 1) {
+		assert.Equal(t, &Scope{Type: "notifications", Access: WriteAccess}, scopes[0])
+	}
+	assert.True(t, scopes.CanAccessNotifications(WriteAccess))
+	assert.False(t, scopes.CanAccessNotifications(ReadAccess))
+	assert.False(t, scopes.CanAccessDoctype("io.cozy.files", ReadAccess))
+}
+
+func TestCanAccessSettings(t *testing.T) {
+	scopes, err := ParseScopeString("settings/locale:readwrite settings/owner")
+	if assert.NoError(t, err) {
+		assert.True(t, scopes.CanAccessSettings("locale", WriteAccess))
+		assert.True(t, scopes.CanAccessSettings("owner", ReadAccess))
+		assert.False(t, scopes.CanAccessSettings("owner", WriteAccess))
+		assert.False(t, scopes.CanAccessSettings("background", ReadAccess))
+	}
+	scopes, err = ParseScopeString("settings/all:read")
+	if assert.NoError(t, err) {
+		assert.True(t, scopes.CanAccessSettings("background", ReadAccess))
+		assert.False(t, scopes.CanAccessSettings("background", WriteAccess))
+	}
+}
+
+func TestParseScopeString(t *testing.T) {
+	scopes, err := ParseScopeString("data/io.cozy.contacts files:readwrite  data/io.cozy.events:write")
+	if assert.NoError(t, err) && assert.Len(t, scopes, 3) {
+		assert.Equal(t, &Scope{Type: "data", Target: "io.cozy.contacts", Access: ReadAccess}, scopes[0])
+		assert.Equal(t, &Scope{Type: "files", Access: ReadWriteAccess}, scopes[1])
+		assert.Equal(t, &Scope{Type: "data", Target: "io.cozy.events", Access: WriteAccess}, scopes[2])
+		assert.Equal(t, "data/io.cozy.contacts:read files:readwrite data/io.cozy.events:write", scopes.String())
+		assert.True(t, scopes.CanAccessDoctype("io.cozy.contacts", ReadAccess))
+		assert.False(t, scopes.CanAccessDoctype("io.cozy.events", ReadAccess))
+		assert.True(t, scopes.CanAccessFiles(WriteAccess))
+	}
+
+	scopes, err = ParseScopeString("notifications:write")
+	if assert.NoError(t, err) {
+		assert.True(t, scopes.CanAccessNotifications(WriteAccess))
+		assert.False(t, scopes.CanAccessNotifications(ReadAccess))
+	}
+
+	for _, str := range []string{"", "  ", "data", "data/io.cozy.contacts:all", "jobs/sendmail", "apps", "data/io.cozy.sessions", "data/io.cozy.apps.tokens:write", "data/io.cozy.files", "data/io.cozy.files:readwrite", "data/io.cozy.notifications:write", "data/io.cozy.intents"} {
+		_, err = ParseScopeString(str)
+		assert.Equal(t, ErrInvalidScope, err, str)
+	}
+}
+
+func TestInternalDoctypes(t *testing.T) {
+	for _, doctype := range []string{"io.cozy.apps", "io.cozy.apps.tokens", "io.cozy.settings", "io.cozy.sessions", "io.cozy.sharings.links", "io.cozy.manifests", "io.cozy.files", "io.cozy.files.moves", "io.cozy.intents", "io.cozy.notifications"} {
+		assert.True(t, IsInternalDoctype(doctype), doctype)
+	}
+	for _, doctype := range []string{"io.cozy.contacts", "io.cozy.filesfoo", "io.cozy.appsfoo"} {
+		assert.False(t, IsInternalDoctype(doctype), doctype)
+	}
+
+	// the scopes of the manifests installed before the check are ignored
+	scopes := Scopes{
+		{Type: "data", Target: "io.cozy.settings", Access: ReadWriteAccess},
+		{Type: "data", Target: "io.cozy.contacts", Access: ReadWriteAccess},
+	}
+	assert.False(t, scopes.CanAccessDoctype("io.cozy.settings", ReadAccess))
+	assert.True(t, scopes.CanAccessDoctype("io.cozy.contacts", ReadAccess))
+}
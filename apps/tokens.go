@@ -0,0 +1,271 @@
+package apps
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+)
+
+// TokenDocType is the doctype of the tokens of the applications
+const TokenDocType = "io.cozy.apps.tokens"
+
+// tokenLength is the number of random bytes used for a token
+const tokenLength = 24
+
+// ErrInvalidToken is used when the token of an application is not signed by
+// the instance, or has been issued for an uninstalled application or for
+// other scopes
+var ErrInvalidToken = errors.New("Invalid application token")
+
+// appClaims are the claims of the token issued to an application when it is
+// installed or updated. The token carries the scopes of the manifest.
+type appClaims struct {
+	Subject  string `json:"sub"`
+	IssuedAt int64  `json:"iat"`
+	Scope    string `json:"scope"`
+}
+
+// AdminTokenTTL is the duration of validity of the tokens of the hosters
+const AdminTokenTTL = 15 * time.Minute
+
+// adminSubject is the subject of the tokens of the hosters
+const adminSubject = "admin"
+
+// adminClaims are the claims of the short-lived token that gives to a hoster
+// the rights of the owner of an instance on its API
+type adminClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Token is used by an application to act on the data and files of the
+// instance, in the limits of its scopes. The token is the identifier of
+// the document.
+type Token struct {
+	TokenID   string    `json:"_id,omitempty"`
+	TokenRev  string    `json:"_rev,omitempty"`
+	Slug      string    `json:"slug"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ID returns the token - see couchdb.Doc interface
+func (t *Token) ID() string { return t.TokenID }
+
+// Rev returns the token revision - see couchdb.Doc interface
+func (t *Token) Rev() string { return t.TokenRev }
+
+// DocType returns the token doctype - see couchdb.Doc interface
+func (t *Token) DocType() string { return TokenDocType }
+
+// SetID changes the token - see couchdb.Doc interface
+func (t *Token) SetID(id string) { t.TokenID = id }
+
+// SetRev changes the token revision - see couchdb.Doc interface
+func (t *Token) SetRev(rev string) { t.TokenRev = rev }
+
+// SelfLink is part of the jsonapi.Object interface
+func (t *Token) SelfLink() string { return "/apps/" + t.Slug + "/token" }
+
+// Relationships is used to generate the application relationship in
+// JSON-API format - see jsonapi.Object interface
+func (t *Token) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"application": jsonapi.Relationship{
+			Links: &jsonapi.LinksList{
+				Related: "/apps/" + t.Slug,
+			},
+			Data: jsonapi.ResourceIdentifier{
+				ID:   t.Slug,
+				Type: ManifestDocType,
+			},
+		},
+	}
+}
+
+// Included is part of the jsonapi.Object interface
+func (t *Token) Included() []jsonapi.Object {
+	return []jsonapi.Object{}
+}
+
+// CreateToken creates a new token for the installed application with the
+// given slug
+func CreateToken(ctx context.Context, db, slug string) (*Token, error) {
+	man, err := GetBySlug(ctx, db, Webapp, slug)
+	if err != nil {
+		return nil, err
+	}
+	if man.State != Ready {
+		return nil, ErrBadState
+	}
+
+	b := make([]byte, tokenLength)
+	if _, err = rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	token := &Token{
+		TokenID:   hex.EncodeToString(b),
+		Slug:      slug,
+		CreatedAt: time.Now(),
+	}
+	if err = couchdb.CreateNamedDocWithDB(ctx, db, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// issueAppToken signs a new token for the application, with the scopes of
+// its manifest, and puts it in the manifest
+func issueAppToken(ctx context.Context, db string, man *Manifest) error {
+	keys, err := instance.GetKeys(ctx, db, instance.KeyApps)
+	if err != nil {
+		return err
+	}
+	claims := &appClaims{
+		Subject:  man.Slug,
+		IssuedAt: time.Now().Unix(),
+		Scope:    man.Scopes.String(),
+	}
+	man.Token, err = signJWT(keys[0].Secret, claims)
+	return err
+}
+
+// getByAppToken returns the manifest of the application for a token issued
+// at its installation. The token is rejected if the scopes of the
+// application have changed since, or if the application is not installed.
+func getByAppToken(ctx context.Context, db, token string) (*Manifest, error) {
+	keys, err := instance.GetKeys(ctx, db, instance.KeyApps)
+	if err != nil {
+		return nil, err
+	}
+	claims := &appClaims{}
+	err = ErrInvalidJWT
+	for _, key := range keys {
+		if err = parseJWT(key.Secret, token, claims); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	man, err := getTokenApp(ctx, db, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Scope != man.Scopes.String() {
+		return nil, ErrInvalidToken
+	}
+	return man, nil
+}
+
+// getTokenApp returns the manifest of the application of a token, or
+// ErrInvalidToken if the application is not installed, or not in a state
+// where it can use its tokens
+func getTokenApp(ctx context.Context, db, slug string) (*Manifest, error) {
+	man, err := GetBySlug(ctx, db, Webapp, slug)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s := man.State; s != Ready && s != Upgrading {
+		return nil, ErrInvalidToken
+	}
+	return man, nil
+}
+
+// GetByToken returns the manifest of the application for the given token,
+// either a token issued at its installation, or a token created by
+// CreateToken. For the latter, the error of CouchDB is returned if there is
+// no such token.
+func GetByToken(ctx context.Context, db, token string) (*Manifest, error) {
+	if isJWT(token) {
+		return getByAppToken(ctx, db, token)
+	}
+	t := &Token{}
+	if err := couchdb.GetDoc(ctx, db, TokenDocType, token, t); err != nil {
+		return nil, err
+	}
+	return getTokenApp(ctx, db, t.Slug)
+}
+
+// CreateAdminToken signs a new token for a hoster, valid for AdminTokenTTL
+// on the instance with the given database prefix
+func CreateAdminToken(ctx context.Context, db string) (string, error) {
+	keys, err := instance.GetKeys(ctx, db, instance.KeyAdmin)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := &adminClaims{
+		Subject:   adminSubject,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(AdminTokenTTL).Unix(),
+	}
+	return signJWT(keys[0].Secret, claims)
+}
+
+// CheckAdminToken returns ErrInvalidToken if the token has not been created
+// by CreateAdminToken for the instance, or if it has expired
+func CheckAdminToken(ctx context.Context, db, token string) error {
+	if !isJWT(token) {
+		return ErrInvalidToken
+	}
+	keys, err := instance.GetKeys(ctx, db, instance.KeyAdmin)
+	if err != nil {
+		return err
+	}
+	claims := &adminClaims{}
+	err = ErrInvalidJWT
+	for _, key := range keys {
+		if err = parseJWT(key.Secret, token, claims); err == nil {
+			break
+		}
+	}
+	if err != nil || claims.Subject != adminSubject {
+		return ErrInvalidToken
+	}
+	if time.Now().Unix() > claims.ExpiresAt {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// deleteTokens deletes all the tokens of the application with the given
+// slug
+func deleteTokens(ctx context.Context, db, slug string) error {
+	var tokens []*Token
+	err := couchdb.ForeachDocs(ctx, db, TokenDocType, func(doc json.RawMessage) error {
+		t := &Token{}
+		if err := json.Unmarshal(doc, t); err != nil {
+			return err
+		}
+		if t.Slug == slug {
+			tokens = append(tokens, t)
+		}
+		return nil
+	})
+	if couchdb.IsNoDatabaseError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if err = couchdb.DeleteDoc(ctx, db, t); err != nil && !couchdb.IsNotFoundError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ jsonapi.Object = &Token{}
@@ -0,0 +1,59 @@
+package apps
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/couchdb/couchdbtest"
+	"github.com/stretchr/testify/assert"
+)
+
+const testDB = "apps-test/"
+
+func TestGetByToken(t *testing.T) {
+	ctx := context.Background()
+	man := &Manifest{ManID: "tokens", Slug: "tokens", Type: Webapp, State: Ready}
+	if !assert.NoError(t, couchdb.CreateNamedDocWithDB(ctx, testDB, man)) {
+		return
+	}
+	token, err := CreateToken(ctx, testDB, "tokens")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	fetched, err := GetByToken(ctx, testDB, token.ID())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "tokens", fetched.Slug)
+	}
+	_, err = GetByToken(ctx, testDB, "unknown")
+	assert.True(t, couchdb.IsNotFoundError(err))
+
+	// the token can't be used by an application in error
+	man.State = Errored
+	if !assert.NoError(t, couchdb.UpdateDoc(ctx, testDB, man)) {
+		return
+	}
+	_, err = GetByToken(ctx, testDB, token.ID())
+	assert.Equal(t, ErrInvalidToken, err)
+
+	// nor after the uninstallation
+	if !assert.NoError(t, couchdb.DeleteDoc(ctx, testDB, man)) {
+		return
+	}
+	_, err = GetByToken(ctx, testDB, token.ID())
+	assert.Equal(t, ErrInvalidToken, err)
+}
+
+func TestMain(m *testing.M) {
+	couchURL, stop := couchdbtest.Start()
+	if err := couchdb.UseServer(couchdb.ServerOptions{URL: couchURL}); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res := m.Run()
+	stop()
+	os.Exit(res)
+}
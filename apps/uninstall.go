@@ -0,0 +1,52 @@
+package apps
+
+import (
+	"context"
+	"path"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/vfs"
+)
+
+// Uninstall removes an installed application of the given type: its files,
+// with the ones of an update, and its manifest. The manifest is first put in the
+// uninstalling state, and it is deleted last, so that an uninstall that
+// has been interrupted can be resumed by calling Uninstall again.
+func Uninstall(ctx context.Context, vfsC *vfs.Context, db string, typ AppType, slug string) error {
+	unlock, err := lock(ctx, db, slug)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	man, err := GetBySlug(ctx, db, typ, slug)
+	if err != nil {
+		return err
+	}
+
+	switch man.State {
+	case Installing, Upgrading:
+		return ErrBadState
+	case Uninstalling:
+	default:
+		man.State = Uninstalling
+		if err = couchdb.UpdateDoc(ctx, db, man); err != nil {
+			return err
+		}
+	}
+
+	dirs := []string{slug, "." + slug + ".new", "." + slug + ".old", "." + slug + ".rollback"}
+	for _, dir := range dirs {
+		if err = removeDir(vfsC, path.Join(typ.Directory(), dir)); err != nil {
+			return err
+		}
+	}
+
+	// the scopes are in the manifest, only the tokens must be removed
+	if typ == Webapp {
+		if err = deleteTokens(ctx, db, slug); err != nil {
+			return err
+		}
+	}
+	return couchdb.DeleteDoc(ctx, db, man)
+}
@@ -0,0 +1,173 @@
+package apps
+
+import (
+	"context"
+	"os"
+	"path"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/vfs"
+)
+
+// Updater is used to update an installed application to the last version
+// of its source. It reports its progress like the Installer, with the
+// WaitManifest method.
+type Updater struct {
+	*Installer
+}
+
+// NewUpdater creates a new Updater for the installed application with the
+// given type and slug. Like for the Installer, ctx should not be the context
+// of an HTTP request.
+func NewUpdater(ctx context.Context, vfsC *vfs.Context, db string, typ AppType, slug string) (*Updater, error) {
+	man, err := GetBySlug(ctx, db, typ, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	src, creds, err := sourceCredentials(ctx, db, man.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := newClient(vfsC, typ, src, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	inst := &Installer{
+		cli:  cli,
+		ctx:  ctx,
+		db:   db,
+		vfsC: vfsC,
+
+		typ:  typ,
+		slug: slug,
+		src:  src,
+		man:  man,
+
+		errc: make(chan error),
+		manc: make(chan *Manifest),
+	}
+
+	inst.watchProgress()
+	return &Updater{inst}, nil
+}
+
+// Update fetches the manifest of the application from its source, and if
+// its version has changed, fetches the new files of the application in a
+// temporary directory. The application directory is then swapped with it,
+// and the old one is kept as .<slug>.old until the next update, with the
+// previous version and its manifest recorded in the manifest, for Rollback.
+func (u *Updater) Update() (newman *Manifest, err error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+
+	// the lock is released last, after the errored state is persisted
+	unlock, err := lock(u.ctx, u.db, u.slug)
+	if err != nil {
+		return nil, u.handleErr(err)
+	}
+	defer unlock()
+
+	defer func() {
+		if err != nil {
+			// the update can be retried from the errored state
+			if u.man.State == Upgrading {
+				errored := *u.man
+				setErrored(&errored, updateOperation)
+				couchdb.UpdateDoc(u.ctx, u.db, &errored)
+			}
+			err = u.handleErr(err)
+		}
+	}()
+
+	oldman := u.man
+	if s := oldman.State; s != Ready && s != Errored {
+		return nil, ErrBadState
+	}
+
+	newman, err = u.fetchManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	if newman.Version == oldman.Version && oldman.State == Ready {
+		u.notify(StepDone, nil)
+		u.manc <- oldman
+		return oldman, nil
+	}
+
+	upgrading := *oldman
+	upgrading.State = Upgrading
+	if err = u.updateManifest(&upgrading); err != nil {
+		return nil, err
+	}
+
+	appdir := path.Join(u.typ.Directory(), u.slug)
+	newdir := path.Join(u.typ.Directory(), "."+u.slug+".new")
+	olddir := path.Join(u.typ.Directory(), "."+u.slug+".old")
+
+	if err = removeDir(u.vfsC, newdir); err != nil {
+		return nil, err
+	}
+	if err = u.vfsC.MkdirAll(newdir); err != nil {
+		return nil, err
+	}
+	u.notify(StepFetching, nil)
+	if err = u.cli.Fetch(u.vfsC, newdir); err != nil {
+		return nil, err
+	}
+	if err = checkEntrypoint(u.vfsC, newman, newdir); err != nil {
+		return nil, err
+	}
+	if u.typ == Webapp {
+		if err = issueAppToken(u.ctx, u.db, newman); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = removeDir(u.vfsC, olddir); err != nil {
+		return nil, err
+	}
+	if _, err = vfs.GetDirDocFromPath(u.vfsC, appdir, false); err == nil {
+		if err = u.vfsC.Rename(appdir, olddir); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err = u.vfsC.Rename(newdir, appdir); err != nil {
+		return nil, err
+	}
+
+	newman.Slug = u.slug
+	newman.Source = u.src
+	newman.Commit = fetchedCommit(u.cli)
+	newman.Checksum = verifiedChecksum(u.cli)
+	newman.State = Ready
+	newman.PreviousVersion = oldman.Version
+	previous := *oldman
+	previous.SetID("")
+	previous.SetRev("")
+	previous.State = Ready
+	previous.Previous = nil
+	previous.ErroredAt = nil
+	previous.ErroredOp = ""
+	newman.Previous = &previous
+	err = u.updateManifest(newman)
+	return newman, err
+}
+
+// removeDir destroys a directory and its content, if it exists
+func removeDir(vfsC *vfs.Context, name string) error {
+	dir, err := vfs.GetDirDocFromPath(vfsC, name, false)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return vfs.DestroyDirAndContent(vfsC, dir)
+}
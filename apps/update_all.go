@@ -0,0 +1,134 @@
+package apps
+
+import (
+	"context"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/vfs"
+)
+
+// The status of an application after an UpdateAll
+const (
+	// UpdateUpdated is the status of an application updated to a new version
+	UpdateUpdated = "updated"
+	// UpdateUpToDate is the status of an application already at the last
+	// version of its source
+	UpdateUpToDate = "up-to-date"
+	// UpdateSkipped is the status of an application that was not updated
+	// because another operation is running on it
+	UpdateSkipped = "skipped"
+	// UpdateFailed is the status of an application whose update has failed
+	UpdateFailed = "failed"
+)
+
+// UpdateResult is the result of the update of an application by UpdateAll
+type UpdateResult struct {
+	Slug       string
+	Type       AppType
+	Status     string
+	OldVersion string
+	NewVersion string
+	Error      error
+}
+
+// UpdateReport is the aggregated report of UpdateAll for an instance
+type UpdateReport struct {
+	Domain  string
+	Results []*UpdateResult
+}
+
+// Count returns the number of applications of the report with the given
+// status
+func (r *UpdateReport) Count(status string) int {
+	n := 0
+	for _, res := range r.Results {
+		if res.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// UpdateAll checks the sources of all the applications and konnectors
+// installed on the instance, and updates those that have a newer version.
+// The updates are made one after the other, and an error on one of them
+// does not stop the others: it is recorded in the report. The error
+// returned is only for the applications that cannot be listed.
+func UpdateAll(ctx context.Context, i *instance.Instance) (*UpdateReport, error) {
+	vfsC, err := i.GetVFSContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	db := i.GetDatabasePrefix()
+
+	report := &UpdateReport{Domain: i.Domain}
+	for _, typ := range []AppType{Webapp, Konnector} {
+		mans, err := List(ctx, db, typ)
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return nil, err
+		}
+		for _, man := range mans {
+			report.Results = append(report.Results, updateOne(ctx, vfsC, db, typ, man))
+		}
+	}
+	return report, nil
+}
+
+// updateOne updates an application and waits for the end of its update
+func updateOne(ctx context.Context, vfsC *vfs.Context, db string, typ AppType, man *Manifest) *UpdateResult {
+	res := &UpdateResult{
+		Slug:       man.Slug,
+		Type:       typ,
+		OldVersion: man.Version,
+		NewVersion: man.Version,
+	}
+	if s := man.State; s != Ready && s != Errored {
+		res.Status = UpdateSkipped
+		return res
+	}
+
+	updater, err := NewUpdater(ctx, vfsC, db, typ, man.Slug)
+	if err == nil {
+		var newman *Manifest
+		newman, err = updater.run()
+		if err == nil {
+			res.NewVersion = newman.Version
+		}
+	}
+	switch {
+	case err == ErrLocked || err == ErrBadState:
+		res.Status = UpdateSkipped
+	case err != nil:
+		res.Status = UpdateFailed
+		res.Error = err
+	case res.NewVersion != res.OldVersion || man.State == Errored:
+		res.Status = UpdateUpdated
+	default:
+		res.Status = UpdateUpToDate
+	}
+	return res
+}
+
+// run makes the update synchronously, discarding its progress
+func (u *Updater) run() (*Manifest, error) {
+	defer u.discardProgress()()
+	return u.Update()
+}
+
+// discardProgress reads the progress of the installer, for the operations
+// made synchronously, until the returned function is called
+func (i *Installer) discardProgress() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-i.manc:
+			case <-i.errc:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,319 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/spf13/cobra"
+)
+
+var flagAllDomains bool
+var flagDomain string
+var flagStackURL string
+var flagKonnector bool
+var flagChecksum string
+var flagNoWait bool
+
+// appsPollInterval is the delay between two checks of the state of an
+// application, when the command line waits for an operation to finish
+const appsPollInterval = 500 * time.Millisecond
+
+// appAttributes are the attributes of an application printed by the command
+// line, from the JSON-API responses of the stack
+type appAttributes struct {
+	Slug    string     `json:"slug"`
+	State   apps.State `json:"state"`
+	Version string     `json:"version"`
+	Source  string     `json:"source"`
+}
+
+type appObject struct {
+	Attributes appAttributes `json:"attributes"`
+}
+
+type appDocument struct {
+	Data appObject `json:"data"`
+}
+
+type appsDocument struct {
+	Data  []appObject `json:"data"`
+	Links struct {
+		Next string `json:"next"`
+	} `json:"links"`
+}
+
+var appsCmdGroup = &cobra.Command{
+	Use:   "apps [command]",
+	Short: "Manage the applications of the instances",
+	Long: `
+cozy-stack apps allows to manage the applications and konnectors installed on
+the instances of this stack.
+
+With --domain, the commands use the API of a running stack for this instance,
+with an admin token, like the owner of the instance would do. The token is
+asked to the admin server given by --admin-url, or signed with the keys of the
+instance in CouchDB. --konnector is for the konnectors instead of the
+applications.
+	`,
+	Run: func(cmd *cobra.Command, args []string) { cmd.Help() },
+}
+
+var lsAppsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the applications installed on an instance",
+	Long: `
+cozy-stack apps ls --domain <domain> lists the applications installed on the
+instance, with their version, state and source.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := configureAppsAPI(); err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "SLUG\tVERSION\tSTATE\tSOURCE")
+		path := appsPath("")
+		for path != "" {
+			var doc appsDocument
+			if err := instanceRequest(flagDomain, "GET", path, nil, &doc); err != nil {
+				return err
+			}
+			for _, app := range doc.Data {
+				attrs := app.Attributes
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", attrs.Slug, attrs.Version, attrs.State, attrs.Source)
+			}
+			path = doc.Links.Next
+		}
+		return w.Flush()
+	},
+}
+
+var installAppsCmd = &cobra.Command{
+	Use:   "install [slug] [source]",
+	Short: "Install an application on an instance",
+	Long: `
+cozy-stack apps install --domain <domain> <slug> [source] installs an
+application on the instance, from its source URL, or from the registry if no
+source is given. The command waits for the end of the installation, unless
+--no-wait is given.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := configureAppsAPI(); err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			return cmd.Help()
+		}
+
+		slug := args[0]
+		q := url.Values{}
+		if len(args) > 1 {
+			q.Set("Source", args[1])
+		} else {
+			q.Set("Source", "registry://"+slug)
+		}
+		if flagChecksum != "" {
+			q.Set("Checksum", flagChecksum)
+		}
+		var doc appDocument
+		if err := instanceRequest(flagDomain, "POST", appsPath(slug)+"?"+q.Encode(), nil, &doc); err != nil {
+			return err
+		}
+		return waitForApp(slug, doc.Data.Attributes, "installed")
+	},
+}
+
+var uninstallAppsCmd = &cobra.Command{
+	Use:     "uninstall [slug]",
+	Aliases: []string{"rm"},
+	Short:   "Uninstall an application from an instance",
+	Long: `
+cozy-stack apps uninstall --domain <domain> <slug> removes the application
+from the instance, with its files.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := configureAppsAPI(); err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			return cmd.Help()
+		}
+
+		slug := args[0]
+		if err := instanceRequest(flagDomain, "DELETE", appsPath(slug), nil, nil); err != nil {
+			return err
+		}
+		fmt.Printf("%s uninstalled\n", slug)
+		return nil
+	},
+}
+
+var updateAppsCmd = &cobra.Command{
+	Use:   "update [domain]",
+	Short: "Update the applications to their last version",
+	Long: `
+cozy-stack apps update checks the sources of all the applications and
+konnectors installed on the instance for the given domain, and updates those
+that have a newer version. With --all-domains, it does it for all the
+instances of the stack. A report is printed at the end.
+
+With --domain, the arguments are the slugs of the applications to update, and
+the updates are made by the API of a running stack:
+
+    cozy-stack apps update --domain <domain> <slug>...
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if flagDomain != "" {
+			return updateAppsWithAPI(cmd, args)
+		}
+
+		if err := Configure(); err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		var instances []*instance.Instance
+		if flagAllDomains {
+			list, err := instance.List(ctx)
+			if err != nil {
+				return err
+			}
+			instances = list
+		} else {
+			if len(args) == 0 {
+				return cmd.Help()
+			}
+			i, err := instance.Get(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			instances = []*instance.Instance{i}
+		}
+
+		var updated, upToDate, skipped, failed int
+		for _, i := range instances {
+			report, err := apps.UpdateAll(ctx, i)
+			if err != nil {
+				fmt.Printf("%s: cannot list the applications: %v\n", i.Domain, err)
+				failed++
+				continue
+			}
+			for _, res := range report.Results {
+				switch res.Status {
+				case apps.UpdateUpdated:
+					fmt.Printf("%s: %s updated from %s to %s\n", i.Domain, res.Slug, res.OldVersion, res.NewVersion)
+				case apps.UpdateSkipped:
+					fmt.Printf("%s: %s skipped, another operation is running\n", i.Domain, res.Slug)
+				case apps.UpdateFailed:
+					fmt.Printf("%s: %s cannot be updated: %v\n", i.Domain, res.Slug, res.Error)
+				}
+			}
+			updated += report.Count(apps.UpdateUpdated)
+			upToDate += report.Count(apps.UpdateUpToDate)
+			skipped += report.Count(apps.UpdateSkipped)
+			failed += report.Count(apps.UpdateFailed)
+		}
+
+		fmt.Printf("%d instance(s): %d updated, %d up-to-date, %d skipped, %d failed\n",
+			len(instances), updated, upToDate, skipped, failed)
+		if failed > 0 {
+			return errors.New("Some applications cannot be updated")
+		}
+		return nil
+	},
+}
+
+// updateAppsWithAPI updates the applications with the given slugs on the
+// instance of --domain, by the API of the stack
+func updateAppsWithAPI(cmd *cobra.Command, slugs []string) error {
+	if err := configureAppsAPI(); err != nil {
+		return err
+	}
+	if len(slugs) == 0 {
+		return cmd.Help()
+	}
+
+	var failed int
+	for _, slug := range slugs {
+		var doc appDocument
+		err := instanceRequest(flagDomain, "PUT", appsPath(slug), nil, &doc)
+		if err == nil {
+			err = waitForApp(slug, doc.Data.Attributes, "updated")
+		}
+		if err != nil {
+			fmt.Printf("%s cannot be updated: %v\n", slug, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.New("Some applications cannot be updated")
+	}
+	return nil
+}
+
+// configureAppsAPI loads the configuration for the commands that use the
+// API of the stack, and checks that an instance has been given
+func configureAppsAPI() error {
+	if err := Configure(); err != nil {
+		return err
+	}
+	if flagDomain == "" {
+		return errors.New("The domain of the instance is missing: use --domain")
+	}
+	return nil
+}
+
+// appsPath returns the path of the API for an application, or for the list
+// of the applications if slug is empty
+func appsPath(slug string) string {
+	path := "/apps/"
+	if flagKonnector {
+		path = "/konnectors/"
+	}
+	return path + slug
+}
+
+// waitForApp waits for the end of the installation or update of an
+// application, by checking its state, unless --no-wait is given
+func waitForApp(slug string, attrs appAttributes, done string) error {
+	for !flagNoWait {
+		switch attrs.State {
+		case apps.Ready:
+			fmt.Printf("%s %s (version %s)\n", slug, done, attrs.Version)
+			return nil
+		case apps.Errored:
+			return fmt.Errorf("%s is errored, see its events on the stack", slug)
+		}
+		time.Sleep(appsPollInterval)
+		var doc appDocument
+		if err := instanceRequest(flagDomain, "GET", appsPath(slug), nil, &doc); err != nil {
+			return err
+		}
+		attrs = doc.Data.Attributes
+	}
+	fmt.Printf("%s is %s\n", slug, attrs.State)
+	return nil
+}
+
+func init() {
+	appsCmdGroup.AddCommand(lsAppsCmd)
+	appsCmdGroup.AddCommand(installAppsCmd)
+	appsCmdGroup.AddCommand(updateAppsCmd)
+	appsCmdGroup.AddCommand(uninstallAppsCmd)
+	appsCmdGroup.PersistentFlags().StringVar(&flagDomain, "domain", "", "Domain of the instance, for the commands that use the API of the stack")
+	appsCmdGroup.PersistentFlags().StringVar(&flagStackURL, "stack-url", "", "URL of the API of the stack, like http://localhost:8080 (from the host and port of the config by default)")
+	appsCmdGroup.PersistentFlags().StringVar(&flagAdminURL, "admin-url", "", "URL of the admin server of the stack, like http://localhost:6060, to ask the admin tokens")
+	appsCmdGroup.PersistentFlags().BoolVar(&flagKonnector, "konnector", false, "Manage the konnectors instead of the applications")
+	installAppsCmd.Flags().StringVar(&flagChecksum, "checksum", "", "sha256 that the package must match")
+	installAppsCmd.Flags().BoolVar(&flagNoWait, "no-wait", false, "Don't wait for the end of the installation")
+	updateAppsCmd.Flags().BoolVar(&flagNoWait, "no-wait", false, "Don't wait for the end of the updates")
+	updateAppsCmd.Flags().BoolVar(&flagAllDomains, "all-domains", false, "Update the applications of all the instances")
+	RootCmd.AddCommand(appsCmdGroup)
+}
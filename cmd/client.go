@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/config"
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/web/instances"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+)
+
+// clientTimeout is the maximal duration of a request of the command line
+// to a stack
+const clientTimeout = 5 * time.Minute
+
+var httpClient = &http.Client{Timeout: clientTimeout}
+
+// doRequest sends a request to a stack, with in as the JSON body if it is
+// not nil, and decodes the JSON response in out if it is not nil. The
+// JSON-API errors of the stack are returned as errors. A Host header selects
+// the instance of the request.
+func doRequest(method, rawurl string, header http.Header, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, rawurl, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	if in != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := sendRequest(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// sendRequest sends a request to a stack, and returns its response if it is
+// a success. The caller must close the body of the response.
+func sendRequest(req *http.Request) (*http.Response, error) {
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 400 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	e := &responseError{Status: res.StatusCode}
+	var doc jsonapi.Document
+	if json.NewDecoder(res.Body).Decode(&doc) == nil && len(doc.Errors) > 0 {
+		e.Detail = doc.Errors[0].Detail
+	} else {
+		e.Detail = fmt.Sprintf("Unexpected response from the stack: %s", res.Status)
+	}
+	return nil, e
+}
+
+// responseError is the error of a request whose response is not a success
+type responseError struct {
+	Status int
+	Detail string
+}
+
+func (e *responseError) Error() string { return e.Detail }
+
+// isNotFound returns true if the error is a 404 Not Found of the stack
+func isNotFound(err error) bool {
+	e, ok := err.(*responseError)
+	return ok && e.Status == http.StatusNotFound
+}
+
+// adminRequest sends a request to the admin API of the stack at the URL
+// given with --admin-url
+func adminRequest(method, path string, in, out interface{}) error {
+	rawurl := strings.TrimSuffix(flagAdminURL, "/") + path
+	return doRequest(method, rawurl, nil, in, out)
+}
+
+// adminTokens are the admin tokens already given to the command, by domain
+var adminTokens = make(map[string]string)
+
+// instanceRequest sends a request to the API of the stack at the URL given
+// with --stack-url, on the instance of the given domain, with an admin token
+// that gives the rights of its owner. The token is asked to the admin server
+// if --admin-url is given, and else it is signed with the keyring of the
+// instance in CouchDB.
+func instanceRequest(domain, method, path string, in, out interface{}) error {
+	header, err := instanceHeader(domain)
+	if err != nil {
+		return err
+	}
+	return doRequest(method, stackURL()+path, header, in, out)
+}
+
+// newInstanceRequest returns a request for the API of the stack on the
+// instance of the given domain, like instanceRequest, with a body that is
+// not JSON
+func newInstanceRequest(domain, method, path string, body io.Reader) (*http.Request, error) {
+	header, err := instanceHeader(domain)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, stackURL()+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	req.Host = domain
+	return req, nil
+}
+
+// instanceHeader returns the headers of the requests for the instance of the
+// given domain
+func instanceHeader(domain string) (http.Header, error) {
+	token, err := adminToken(domain)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set("Host", domain)
+	header.Set("Authorization", "Bearer "+token)
+	header.Set("Accept", jsonapi.ContentType)
+	return header, nil
+}
+
+// adminToken returns an admin token for the instance of the given domain
+func adminToken(domain string) (string, error) {
+	if token, ok := adminTokens[domain]; ok {
+		return token, nil
+	}
+	var token string
+	if flagAdminURL != "" {
+		var res instances.AdminToken
+		if err := adminRequest("POST", "/instances/"+domain+"/token", nil, &res); err != nil {
+			return "", err
+		}
+		token = res.Token
+	} else {
+		ctx := context.Background()
+		i, err := instance.Get(ctx, domain)
+		if err != nil {
+			return "", err
+		}
+		if token, err = apps.CreateAdminToken(ctx, i.GetDatabasePrefix()); err != nil {
+			return "", err
+		}
+	}
+	adminTokens[domain] = token
+	return token, nil
+}
+
+// stackURL returns the URL of the API of the stack: --stack-url, or the host
+// and port of the configuration
+func stackURL() string {
+	if flagStackURL != "" {
+		return strings.TrimSuffix(flagStackURL, "/")
+	}
+	cfg := config.GetConfig()
+	host := cfg.Host
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(cfg.Port))
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// domainCompletionBash is the bash function that completes the domains of
+// the instances, for the --domain flag and the arguments of the instances
+// commands. The domains are listed by the admin API of the stack at
+// $COZY_ADMIN_URL, or by CouchDB if it is not set.
+const domainCompletionBash = `
+__cozy-stack_get_domains()
+{
+    local admin=()
+    if [[ -n "${COZY_ADMIN_URL}" ]]; then
+        admin=(--admin-url "${COZY_ADMIN_URL}")
+    fi
+    local domains
+    domains=$(cozy-stack instances ls --quiet "${admin[@]}" 2>/dev/null)
+    COMPREPLY=( $(compgen -W "${domains}" -- "${cur}") )
+}
+
+__cozy-stack_custom_func()
+{
+    case ${last_command} in
+        cozy-stack_instances_add)
+            return
+            ;;
+        cozy-stack_instances_*|cozy-stack_apps_update)
+            __cozy-stack_get_domains
+            return
+            ;;
+    esac
+}
+
+__custom_func()
+{
+    __cozy-stack_custom_func
+}
+`
+
+// domainCompletionFish is the fish function that completes the domains of
+// the instances, like __cozy-stack_get_domains for bash
+const domainCompletionFish = `function __cozy_stack_domains
+    if test -n "$COZY_ADMIN_URL"
+        cozy-stack instances ls --quiet --admin-url "$COZY_ADMIN_URL" 2>/dev/null
+    else
+        cozy-stack instances ls --quiet 2>/dev/null
+    end
+end
+
+`
+
+var completionCmd = &cobra.Command{
+	Use:   "completion [bash|zsh|fish]",
+	Short: "Generate the shell completion script",
+	Long: `
+cozy-stack completion prints the script of the completion of the commands and
+flags of cozy-stack for a shell. For example, with bash:
+
+    $ cozy-stack completion bash > /etc/bash_completion.d/cozy-stack
+
+with zsh, in a directory of $fpath:
+
+    $ cozy-stack completion zsh > "${fpath[1]}/_cozy-stack"
+
+and with fish:
+
+    $ cozy-stack completion fish > ~/.config/fish/completions/cozy-stack.fish
+
+With bash and fish, the values of --domain are completed with the domains of
+the instances, listed by the admin API of the stack at $COZY_ADMIN_URL, or by
+CouchDB if it is not set. Bash also completes the domain arguments of the
+instances commands.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Help()
+		}
+
+		annotateDomainFlags(RootCmd)
+		switch args[0] {
+		case "bash":
+			return RootCmd.GenBashCompletion(os.Stdout)
+		case "zsh":
+			return RootCmd.GenZshCompletion(os.Stdout)
+		case "fish":
+			return genFishCompletion(os.Stdout, RootCmd)
+		}
+		return fmt.Errorf("Unknown shell: %s", args[0])
+	},
+}
+
+// annotateDomainFlags marks the --domain flags of the commands to be
+// completed with the domains of the instances by bash
+func annotateDomainFlags(cmd *cobra.Command) {
+	for _, flags := range []*pflag.FlagSet{cmd.PersistentFlags(), cmd.Flags()} {
+		if flags.Lookup("domain") != nil {
+			flags.SetAnnotation("domain", cobra.BashCompCustom, []string{"__cozy-stack_get_domains"})
+		}
+	}
+	for _, sub := range cmd.Commands() {
+		annotateDomainFlags(sub)
+	}
+}
+
+// genFishCompletion writes the fish completion of the commands and of their
+// flags
+func genFishCompletion(w io.Writer, root *cobra.Command) error {
+	if _, err := io.WriteString(w, domainCompletionFish); err != nil {
+		return err
+	}
+	return writeFishCommand(w, root, root)
+}
+
+func writeFishCommand(w io.Writer, root, cmd *cobra.Command) error {
+	prog := root.Name()
+	condition := ""
+	if cmd != root {
+		condition = fmt.Sprintf(" -n '__fish_seen_subcommand_from %s'", cmd.Name())
+	}
+
+	var err error
+	writeFlag := func(f *pflag.Flag) {
+		if err != nil || f.Hidden {
+			return
+		}
+		line := fmt.Sprintf("complete -c %s%s -l %s", prog, condition, f.Name)
+		if f.Shorthand != "" {
+			line += " -s " + f.Shorthand
+		}
+		if f.Name == "domain" {
+			line += " -x -a '(__cozy_stack_domains)'"
+		} else if f.Value.Type() != "bool" {
+			line += " -r"
+		}
+		line += " -d " + fishQuote(f.Usage)
+		_, err = fmt.Fprintln(w, line)
+	}
+	if cmd == root {
+		root.PersistentFlags().VisitAll(writeFlag)
+	} else {
+		cmd.LocalFlags().VisitAll(writeFlag)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range cmd.Commands() {
+		if !sub.IsAvailableCommand() {
+			continue
+		}
+		subCondition := " -n '__fish_use_subcommand'"
+		if cmd != root {
+			subCondition = condition
+		}
+		_, err = fmt.Fprintf(w, "complete -c %s -f%s -a %s -d %s\n",
+			prog, subCondition, sub.Name(), fishQuote(sub.Short))
+		if err != nil {
+			return err
+		}
+		if err = writeFishCommand(w, root, sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fishQuote puts a string in single quotes for fish
+func fishQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
+
+func init() {
+	RootCmd.BashCompletionFunction = domainCompletionBash
+	RootCmd.AddCommand(completionCmd)
+}
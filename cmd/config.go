@@ -6,19 +6,35 @@ import (
 
 	"github.com/dcasier/cozy-stack/config"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
-var configCmd = &cobra.Command{
-	Use:   "config",
+var configCmdGroup = &cobra.Command{
+	Use:   "config [command]",
+	Short: "Display and check the configuration",
+	Long: `
+cozy-stack config allows to display the configuration, and to check it. Without
+a command, it displays the configuration, like cozy-stack config print.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return printConfigCmd.RunE(cmd, args)
+	},
+}
+
+var printConfigCmd = &cobra.Command{
+	Use:   "print",
 	Short: "Display the configuration",
-	Long: `Read the environment variables, the config file and
-the given parameters to display the configuration.`,
+	Long: `
+cozy-stack config print reads the environment variables, the config file and
+the given parameters, and displays the configuration that the stack uses, in
+JSON. The passwords, and the credentials in the URLs, are redacted.
+	`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if err := Configure(); err != nil {
 			return err
 		}
 
-		cfg, err := json.MarshalIndent(config.GetConfig(), "", "  ")
+		cfg, err := json.MarshalIndent(config.GetConfig().Redacted(), "", "  ")
 		if err != nil {
 			return err
 		}
@@ -28,6 +44,34 @@ the given parameters to display the configuration.`,
 	},
 }
 
+var checkConfigCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check the configuration",
+	Long: `
+cozy-stack config check reads the config file and the given parameters, and
+reports the unknown keys, that are often typos and would be ignored, the values
+that don't have the expected type, and the invalid values. It exits with an
+error if the configuration has a problem.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := Configure(); err != nil {
+			return err
+		}
+
+		errs := config.Check(viper.GetViper())
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%d problem(s) in the configuration", len(errs))
+		}
+		fmt.Println("The configuration is valid")
+		return nil
+	},
+}
+
 func init() {
-	RootCmd.AddCommand(configCmd)
+	configCmdGroup.AddCommand(printConfigCmd)
+	configCmdGroup.AddCommand(checkConfigCmd)
+	RootCmd.AddCommand(configCmdGroup)
 }
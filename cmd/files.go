@@ -0,0 +1,450 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+
+	"github.com/dcasier/cozy-stack/vfs"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/spf13/cobra"
+)
+
+// ErrUnclosedQuote is used when a command of files exec has a quote without
+// its closing quote
+var ErrUnclosedQuote = errors.New("Unclosed quote in the command")
+
+// The values of the Type parameter of POST /files/:folder-id
+const (
+	fileCreationType   = "io.cozy.files"
+	folderCreationType = "io.cozy.folders"
+)
+
+// fileAttributes are the attributes of a file or a directory printed by the
+// command line, from the JSON-API responses of the stack
+type fileAttributes struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Size int64  `json:"size,string"`
+	Mime string `json:"mime"`
+}
+
+type fileObject struct {
+	ID         string         `json:"id"`
+	Attributes fileAttributes `json:"attributes"`
+}
+
+type fileDocument struct {
+	Data     fileObject   `json:"data"`
+	Included []fileObject `json:"included"`
+	Links    struct {
+		Next string `json:"next"`
+	} `json:"links"`
+}
+
+// A fileOperation is a command of the files group, that can also be given
+// to files exec
+type fileOperation struct {
+	usage string
+	short string
+	min   int
+	max   int
+	run   func(args []string) error
+}
+
+var fileOperations = map[string]*fileOperation{
+	"ls": {
+		usage: "ls [dir]",
+		short: "List the content of a directory",
+		max:   1,
+		run:   filesLs,
+	},
+	"tree": {
+		usage: "tree [dir]",
+		short: "Print the tree of the files under a directory",
+		max:   1,
+		run:   filesTree,
+	},
+	"mkdir": {
+		usage: "mkdir [dir]",
+		short: "Create a directory",
+		min:   1,
+		max:   1,
+		run:   filesMkdir,
+	},
+	"cat": {
+		usage: "cat [file]",
+		short: "Print the content of a file",
+		min:   1,
+		max:   1,
+		run:   filesCat,
+	},
+	"put": {
+		usage: "put [local-file] [path]",
+		short: "Upload a local file",
+		min:   2,
+		max:   2,
+		run:   filesPut,
+	},
+	"mv": {
+		usage: "mv [path] [new-path]",
+		short: "Move or rename a file or a directory",
+		min:   2,
+		max:   2,
+		run:   filesMv,
+	},
+	"rm": {
+		usage: "rm [path]",
+		short: "Move a file or a directory to the trash",
+		min:   1,
+		max:   1,
+		run:   filesRm,
+	},
+}
+
+// fileOperationsOrder is the order of the commands in the help
+var fileOperationsOrder = []string{"ls", "tree", "mkdir", "cat", "put", "mv", "rm"}
+
+var filesCmdGroup = &cobra.Command{
+	Use:   "files [command]",
+	Short: "Manage the files of an instance",
+	Long: `
+cozy-stack files allows to manage the files of the instance given by --domain,
+with the files API of a running stack, like the owner of the instance would
+do. The requests are made with an admin token, asked to the admin server given
+by --admin-url, or signed with the keys of the instance in CouchDB.
+
+The paths are the paths of the virtual file system of the instance, like
+/Photos/2016. A file or directory that is removed goes to the trash.
+	`,
+	Run: func(cmd *cobra.Command, args []string) { cmd.Help() },
+}
+
+var execFilesCmd = &cobra.Command{
+	Use:   "exec [command]",
+	Short: "Execute a command on the files of an instance",
+	Long: `
+cozy-stack files exec executes a command given as a single argument, like
+"mkdir /Photos", for the scripts. The commands are ls, tree, mkdir, cat, put,
+mv and rm. The arguments with spaces can be put in quotes.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := configureFilesAPI(); err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			return cmd.Help()
+		}
+
+		words, err := splitCommand(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		if len(words) == 0 {
+			return cmd.Help()
+		}
+		op, ok := fileOperations[words[0]]
+		if !ok {
+			return fmt.Errorf("Unknown command: %s", words[0])
+		}
+		if n := len(words) - 1; n < op.min || n > op.max {
+			return fmt.Errorf("Usage: %s", op.usage)
+		}
+		return op.run(words[1:])
+	},
+}
+
+// newFileOperationCmd returns the subcommand of the files group for an
+// operation
+func newFileOperationCmd(op *fileOperation) *cobra.Command {
+	return &cobra.Command{
+		Use:   op.usage,
+		Short: op.short,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := configureFilesAPI(); err != nil {
+				return err
+			}
+			if len(args) < op.min || len(args) > op.max {
+				return cmd.Help()
+			}
+			return op.run(args)
+		},
+	}
+}
+
+// configureFilesAPI loads the configuration for the files commands, and
+// checks that an instance has been given
+func configureFilesAPI() error {
+	if err := Configure(); err != nil {
+		return err
+	}
+	if flagDomain == "" {
+		return errors.New("The domain of the instance is missing: use --domain")
+	}
+	return nil
+}
+
+// splitCommand splits a command line in words, on the spaces that are not
+// in single or double quotes, or escaped with a backslash
+func splitCommand(line string) ([]string, error) {
+	var words []string
+	var word []rune
+	var quote rune
+	inWord, escaped := false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word = append(word, r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word = append(word, r)
+			}
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, string(word))
+				word, inWord = nil, false
+			}
+		default:
+			word = append(word, r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, ErrUnclosedQuote
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
+
+// cleanPath returns the absolute path of the VFS for a path of the command
+// line
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// fileMetadata returns the metadata of the file or directory at the given
+// path, with the first page of the content of a directory
+func fileMetadata(name string) (*fileDocument, error) {
+	doc := &fileDocument{}
+	q := url.Values{"Path": {cleanPath(name)}}
+	err := instanceRequest(flagDomain, "GET", "/files/metadata?"+q.Encode(), nil, doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// dirContent returns the files and directories in the directory at the
+// given path, with all the pages of its content
+func dirContent(name string) ([]fileObject, error) {
+	doc, err := fileMetadata(name)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Data.Attributes.Type != vfs.DirType {
+		return nil, fmt.Errorf("%s is not a directory", cleanPath(name))
+	}
+	content := doc.Included
+	for next := doc.Links.Next; next != ""; next = doc.Links.Next {
+		doc = &fileDocument{}
+		if err = instanceRequest(flagDomain, "GET", next, nil, doc); err != nil {
+			return nil, err
+		}
+		content = append(content, doc.Included...)
+	}
+	return content, nil
+}
+
+// targetOf returns the identifier of the parent directory and the name of a
+// file that is uploaded or moved to the given path: the path is the parent
+// if it is an existing directory, and else its directory is the parent.
+func targetOf(name, defaultName string) (string, string, error) {
+	doc, err := fileMetadata(name)
+	if err == nil && doc.Data.Attributes.Type == vfs.DirType {
+		return doc.Data.ID, defaultName, nil
+	}
+	if err != nil && !isNotFound(err) {
+		return "", "", err
+	}
+	parent, err := fileMetadata(path.Dir(cleanPath(name)))
+	if err != nil {
+		return "", "", err
+	}
+	return parent.Data.ID, path.Base(cleanPath(name)), nil
+}
+
+func filesLs(args []string) error {
+	dir := "/"
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	content, err := dirContent(dir)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, f := range content {
+		attrs := f.Attributes
+		if attrs.Type == vfs.DirType {
+			fmt.Fprintf(w, "d\t-\t%s/\n", attrs.Name)
+		} else {
+			fmt.Fprintf(w, "-\t%d\t%s\n", attrs.Size, attrs.Name)
+		}
+	}
+	return w.Flush()
+}
+
+func filesTree(args []string) error {
+	dir := "/"
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	fmt.Println(cleanPath(dir))
+	return printTree(cleanPath(dir), "")
+}
+
+// printTree prints the content of a directory, and of its subdirectories,
+// with the given indentation
+func printTree(dir, indent string) error {
+	content, err := dirContent(dir)
+	if err != nil {
+		return err
+	}
+	for i, f := range content {
+		branch, next := "├── ", "│   "
+		if i == len(content)-1 {
+			branch, next = "└── ", "    "
+		}
+		fmt.Println(indent + branch + f.Attributes.Name)
+		if f.Attributes.Type == vfs.DirType {
+			if err = printTree(path.Join(dir, f.Attributes.Name), indent+next); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func filesMkdir(args []string) error {
+	name := cleanPath(args[0])
+	parent, err := fileMetadata(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	q := url.Values{"Type": {folderCreationType}, "Name": {path.Base(name)}}
+	return instanceRequest(flagDomain, "POST", "/files/"+parent.Data.ID+"?"+q.Encode(), nil, nil)
+}
+
+func filesCat(args []string) error {
+	q := url.Values{"Path": {cleanPath(args[0])}}
+	req, err := newInstanceRequest(flagDomain, "GET", "/files/download?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := sendRequest(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(os.Stdout, res.Body)
+	return err
+}
+
+func filesPut(args []string) error {
+	local, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+	infos, err := local.Stat()
+	if err != nil {
+		return err
+	}
+	if infos.IsDir() {
+		return fmt.Errorf("%s is a directory", args[0])
+	}
+
+	parentID, name, err := targetOf(args[1], filepath.Base(args[0]))
+	if err != nil {
+		return err
+	}
+	q := url.Values{"Type": {fileCreationType}, "Name": {name}}
+	if infos.Mode()&0100 != 0 {
+		q.Set("Executable", "true")
+	}
+	req, err := newInstanceRequest(flagDomain, "POST", "/files/"+parentID+"?"+q.Encode(), local)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = infos.Size()
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", contentType)
+	res, err := sendRequest(req)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func filesMv(args []string) error {
+	from, err := fileMetadata(args[0])
+	if err != nil {
+		return err
+	}
+	parentID, name, err := targetOf(args[1], from.Data.Attributes.Name)
+	if err != nil {
+		return err
+	}
+	patch := map[string]interface{}{
+		"data": map[string]interface{}{
+			"type":       vfs.FsDocType,
+			"id":         from.Data.ID,
+			"attributes": map[string]interface{}{"name": name},
+			"relationships": map[string]interface{}{
+				"parent": map[string]interface{}{
+					"data": jsonapi.ResourceIdentifier{ID: parentID, Type: vfs.FsDocType},
+				},
+			},
+		},
+	}
+	return instanceRequest(flagDomain, "PATCH", "/files/"+from.Data.ID, patch, nil)
+}
+
+func filesRm(args []string) error {
+	doc, err := fileMetadata(args[0])
+	if err != nil {
+		return err
+	}
+	return instanceRequest(flagDomain, "DELETE", "/files/"+doc.Data.ID, nil, nil)
+}
+
+func init() {
+	filesCmdGroup.AddCommand(execFilesCmd)
+	for _, name := range fileOperationsOrder {
+		filesCmdGroup.AddCommand(newFileOperationCmd(fileOperations[name]))
+	}
+	filesCmdGroup.PersistentFlags().StringVar(&flagDomain, "domain", "", "Domain of the instance")
+	filesCmdGroup.PersistentFlags().StringVar(&flagStackURL, "stack-url", "", "URL of the API of the stack, like http://localhost:8080 (from the host and port of the config by default)")
+	filesCmdGroup.PersistentFlags().StringVar(&flagAdminURL, "admin-url", "", "URL of the admin server of the stack, like http://localhost:6060, to ask the admin tokens")
+	RootCmd.AddCommand(filesCmdGroup)
+}
@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dcasier/cozy-stack/config"
+	"github.com/dcasier/cozy-stack/jobs"
+	"github.com/dcasier/cozy-stack/logger"
+	"github.com/dcasier/cozy-stack/realtime"
+)
+
+// defaultShutdownTimeout is the maximal duration to wait for the requests
+// and the jobs in progress when the stack is stopped, if it is not
+// configured
+const defaultShutdownTimeout = 30 * time.Second
+
+// listenersEnv is the environment variable with the names of the listeners
+// inherited from the previous process on a restart, separated by commas, in
+// the order of their file descriptors, starting at 3
+const listenersEnv = "COZY_LISTENERS"
+
+// readyEnv is the environment variable with the file descriptor of the pipe
+// where the new process of a restart writes a byte once it serves the
+// inherited listeners
+const readyEnv = "COZY_READY_FD"
+
+// server is an HTTP server of the stack, with its listener
+type server struct {
+	name     string
+	listener net.Listener
+	srv      *http.Server
+}
+
+var (
+	// inheritedListeners are the listeners inherited from the previous
+	// process, by name
+	inheritedListeners     map[string]net.Listener
+	inheritedListenersOnce sync.Once
+)
+
+// loadInheritedListeners returns the listeners inherited from the previous
+// process, if the stack has been restarted
+func loadInheritedListeners() map[string]net.Listener {
+	listeners := make(map[string]net.Listener)
+	names := os.Getenv(listenersEnv)
+	if names == "" {
+		return listeners
+	}
+	os.Unsetenv(listenersEnv)
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(3+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			logger.Warnf("serve", "cannot inherit the %s listener: %v", name, err)
+			continue
+		}
+		listeners[name] = l
+	}
+	return listeners
+}
+
+// notifyReady tells the previous process, if the stack has been restarted,
+// that the listeners are served, so that it can stop
+func notifyReady() {
+	fd := os.Getenv(readyEnv)
+	if fd == "" {
+		return
+	}
+	os.Unsetenv(readyEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		logger.Warnf("serve", "invalid %s: %s", readyEnv, fd)
+		return
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	defer f.Close()
+	if _, err = f.Write([]byte{1}); err != nil {
+		logger.Warnf("serve", "cannot notify the previous process: %v", err)
+	}
+}
+
+// newServer returns a server for the handler on the given address, with
+// the listener inherited from the previous process if any
+func newServer(name, addr string, handler http.Handler) (*server, error) {
+	inheritedListenersOnce.Do(func() {
+		inheritedListeners = loadInheritedListeners()
+	})
+	l, ok := inheritedListeners[name]
+	if !ok {
+		var err error
+		if l, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	srv := &http.Server{Addr: addr, Handler: handler}
+	// the realtime clients keep their connections open: they are closed
+	// when the server is stopped, so that they reconnect to another stack
+	srv.RegisterOnShutdown(realtime.GetHub().CloseAll)
+	return &server{name: name, listener: l, srv: srv}, nil
+}
+
+// serveAndWait serves the requests of the servers until the stack receives
+// a signal to stop (SIGINT or SIGTERM) or to restart (see restartSignals).
+// The stack is then stopped gracefully: the servers no longer accept new
+// connections, and the requests and the jobs in progress are finished
+// within the shutdown timeout. On SIGHUP, the configuration is reloaded.
+func serveAndWait(servers []*server, scheduler *jobs.Scheduler) error {
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *server) {
+			var err error
+			if s.srv.TLSConfig != nil {
+				err = s.srv.ServeTLS(s.listener, "", "")
+			} else {
+				err = s.srv.Serve(s.listener)
+			}
+			if err != http.ErrServerClosed {
+				errs <- err
+			}
+		}(s)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, append(restartSignals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)...)
+	defer signal.Stop(sigs)
+	notifyReady()
+
+	for {
+		select {
+		case err := <-errs:
+			shutdown(servers, scheduler)
+			return err
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				if err := reloadConfig(); err != nil {
+					logger.Errorf("config", "cannot reload the configuration: %v", err)
+				}
+				continue
+			}
+			if isRestartSignal(sig) {
+				if err := restart(servers); err != nil {
+					logger.Errorf("serve", "cannot restart: %v", err)
+					continue
+				}
+			}
+			logger.Infof("serve", "%s received, stopping the stack", sig)
+			return shutdown(servers, scheduler)
+		}
+	}
+}
+
+// isRestartSignal returns true for the signals that restart the stack
+func isRestartSignal(sig os.Signal) bool {
+	for _, s := range restartSignals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// shutdown stops the servers, the scheduler and the workers of the jobs,
+// and waits for the requests and the jobs in progress until the shutdown
+// timeout
+func shutdown(servers []*server, scheduler *jobs.Scheduler) error {
+	timeout := config.GetConfig().ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *server) {
+			defer wg.Done()
+			if err := s.srv.Shutdown(ctx); err != nil {
+				logger.Errorf("serve", "the %s server has been stopped before the end of the requests: %v", s.name, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	if scheduler != nil {
+		scheduler.Stop()
+	}
+	if err := jobs.Shutdown(ctx); err != nil {
+		logger.Errorf("serve", "some jobs have been interrupted: %v", err)
+	}
+	return nil
+}
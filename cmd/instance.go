@@ -1,14 +1,34 @@
 package cmd
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"os"
+	"text/tabwriter"
 
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/config"
 	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/jobs"
+	"github.com/dcasier/cozy-stack/web/instances"
 	"github.com/spf13/cobra"
 )
 
 var flagLocale string
 var flagApps []string
+var flagTrashRetention int
+var flagContinuous bool
+var flagRepository string
+var flagJSON bool
+var flagQuiet bool
+var flagStorageURL string
+var flagContext string
+var flagRevoke bool
+var flagQuota int64
+var flagYes bool
+var flagAdminURL string
 
 // serveCmd represents the serve command
 var instanceCmdGroup = &cobra.Command{
@@ -32,7 +52,8 @@ var addInstanceCmd = &cobra.Command{
 	Short: "Manage instances of a stack",
 	Long: `
 cozy-stack instances add allows to create an instance on the cozy for a
-given domain.
+given domain. It prints the registration token, that the owner of the
+instance needs to register the passphrase on the onboarding page.
 	`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if err := Configure(); err != nil {
@@ -45,19 +66,435 @@ given domain.
 
 		domain := args[0]
 
-		instance, err := instance.Create(domain, flagLocale, flagApps)
+		if flagAdminURL != "" {
+			return addInstanceWithAdmin(domain)
+		}
+
+		ctx := context.Background()
+		i, err := instance.Create(ctx, domain, flagLocale, flagStorageURL, flagContext)
+		if err != nil {
+			return err
+		}
+
+		if flagTrashRetention > 0 {
+			if err = i.SetTrashRetention(ctx, flagTrashRetention); err != nil {
+				return err
+			}
+		}
+
+		if flagQuota > 0 {
+			if err = i.SetQuota(ctx, flagQuota); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("Instance created for domain %s\n", domain)
+		fmt.Printf("Registration token: %s\n", hex.EncodeToString(i.RegisterToken))
+		return installDefaultApps(ctx, i)
+	},
+}
+
+// addInstanceWithAdmin creates the instance with the admin API of a stack,
+// that installs its applications with its jobs
+func addInstanceWithAdmin(domain string) error {
+	params := &instances.CreateParams{
+		Domain:         domain,
+		Locale:         flagLocale,
+		StorageURL:     flagStorageURL,
+		Context:        flagContext,
+		Quota:          flagQuota,
+		TrashRetention: flagTrashRetention,
+		Apps:           flagApps,
+	}
+	var created instances.Created
+	if err := adminRequest("POST", "/instances/", params, &created); err != nil {
+		return err
+	}
+	fmt.Printf("Instance created for domain %s\n", domain)
+	fmt.Printf("Registration token: %s\n", created.RegisterToken)
+	for _, id := range created.Jobs {
+		fmt.Printf("Installation queued: job %s\n", id)
+	}
+	return nil
+}
+
+// installDefaultApps pushes the jobs that install the applications of the
+// --apps flag, or the default applications of the context of the instance.
+// With the queues in Redis, the jobs are executed by the stacks. Else, they
+// are executed here, and their result is printed.
+func installDefaultApps(ctx context.Context, i *instance.Instance) error {
+	if _, err := configureJobsBroker(); err != nil {
+		return err
+	}
+	var defaults []*instance.DefaultApp
+	for _, slug := range flagApps {
+		defaults = append(defaults, &instance.DefaultApp{Slug: slug})
+	}
+	pushed, err := apps.InstallDefaults(ctx, i, defaults)
+	if err != nil {
+		return err
+	}
+	if len(pushed) == 0 {
+		return nil
+	}
+
+	if config.GetConfig().Jobs.Redis != "" {
+		for _, job := range pushed {
+			fmt.Printf("Installation queued: job %s\n", job.ID())
+		}
+		return nil
+	}
+
+	jobs.Start()
+	defer jobs.Stop()
+	failed := 0
+	for _, job := range pushed {
+		var args apps.InstallArguments
+		job.UnmarshalArguments(&args)
+		job, err = jobs.Wait(ctx, job.DBPrefix, job.ID())
+		if err != nil {
+			return err
+		}
+		if job.State == jobs.Errored {
+			failed++
+			fmt.Printf("Installation of %s failed: %s\n", args.Slug, job.Error)
+		} else {
+			fmt.Printf("Application %s installed\n", args.Slug)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d application(s) not installed", failed)
+	}
+	return nil
+}
+
+var lsInstanceCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the instances of the stack",
+	Long: `
+cozy-stack instances ls lists all the instances hosted by the stack, with
+their domain, storage URL, disk usage, creation date and state. With --json,
+the list is printed in JSON, like the GET /instances route of the admin
+server, and with --quiet, only the domains are printed.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := Configure(); err != nil {
+			return err
+		}
+
+		var infos []*instance.Info
+		var err error
+		if flagAdminURL != "" {
+			err = adminRequest("GET", "/instances/", nil, &infos)
+		} else {
+			infos, err = instance.ListInfos(context.Background())
+		}
+		if err != nil {
+			return err
+		}
+
+		if flagQuiet {
+			for _, info := range infos {
+				fmt.Println(info.Domain)
+			}
+			return nil
+		}
+
+		if flagJSON {
+			out, err := json.MarshalIndent(infos, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "DOMAIN\tSTORAGE\tDISK USAGE\tCREATED AT\tSTATE")
+		for _, info := range infos {
+			createdAt := "-"
+			if info.CreatedAt != nil {
+				createdAt = info.CreatedAt.Format("2006-01-02 15:04")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n",
+				info.Domain, info.StorageURL, info.DiskUsage, createdAt, info.State)
+		}
+		return w.Flush()
+	},
+}
+
+var rmInstanceCmd = &cobra.Command{
+	Use:     "rm [domain]",
+	Aliases: []string{"destroy"},
+	Short:   "Destroy an instance and all its data",
+	Long: `
+cozy-stack instances rm destroys the instance for the given domain, with its
+databases, its files and its keys. A confirmation is asked, unless --yes is
+given. It can't be undone.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := Configure(); err != nil {
+			return err
+		}
+
+		if len(args) == 0 {
+			return cmd.Help()
+		}
+
+		domain := args[0]
+
+		if !flagYes {
+			fmt.Printf("All the data of %s will be destroyed. Type the domain to confirm: ", domain)
+			var answer string
+			fmt.Scanln(&answer)
+			if answer != domain {
+				return fmt.Errorf("Aborted")
+			}
+		}
+
+		var err error
+		if flagAdminURL != "" {
+			err = adminRequest("DELETE", "/instances/"+domain, nil, nil)
+		} else {
+			err = instance.Destroy(context.Background(), domain)
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Instance for domain %s destroyed\n", domain)
+		return nil
+	},
+}
+
+var fsckInstanceCmd = &cobra.Command{
+	Use:   "fsck [domain]",
+	Short: "Check and repair the files of an instance",
+	Long: `
+cozy-stack instances fsck checks and repairs the virtual file system of the
+instance for the given domain. The moves of directories that have been
+interrupted are finished or reverted, and the sizes of the directories are
+recomputed.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := Configure(); err != nil {
+			return err
+		}
+
+		if len(args) == 0 {
+			return cmd.Help()
+		}
+
+		domain := args[0]
+
+		ctx := context.Background()
+		instance, err := instance.Get(ctx, domain)
+		if err != nil {
+			return err
+		}
+
+		if err = instance.Fsck(ctx); err != nil {
+			return err
+		}
+
+		fmt.Printf("Files of the instance %s checked\n", domain)
+		return nil
+	},
+}
+
+var replicateInstanceCmd = &cobra.Command{
+	Use:   "replicate [domain] [target]",
+	Short: "Replicate the databases of an instance",
+	Long: `
+cozy-stack instances replicate copies all the CouchDB databases of the
+instance for the given domain to another CouchDB server, given by its URL.
+It can be used to export or migrate an instance. With --continuous, the
+future changes are replicated too, until the replication is canceled.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := Configure(); err != nil {
+			return err
+		}
+
+		if len(args) < 2 {
+			return cmd.Help()
+		}
+
+		domain, target := args[0], args[1]
+
+		ctx := context.Background()
+		instance, err := instance.Get(ctx, domain)
 		if err != nil {
 			return err
 		}
 
-		fmt.Printf("Instance created for domain %s:\n%v\n", instance, domain)
+		repls, err := instance.Replicate(ctx, target, flagContinuous)
+		for _, repl := range repls {
+			fmt.Printf("Replication %s to %s\n", repl.ID(), repl.Target)
+		}
+		return err
+	},
+}
+
+var credentialsInstanceCmd = &cobra.Command{
+	Use:   "credentials [domain] [host] [username] [token]",
+	Short: "Save the credentials of a private repository of applications",
+	Long: `
+cozy-stack instances credentials saves the username and token (like a deploy
+token) used to install and update the applications of the instance for the
+given domain from the private git repositories of a host. With --repository,
+they are used only for the repository with this path.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := Configure(); err != nil {
+			return err
+		}
+
+		if len(args) < 4 {
+			return cmd.Help()
+		}
+
+		domain := args[0]
+
+		ctx := context.Background()
+		instance, err := instance.Get(ctx, domain)
+		if err != nil {
+			return err
+		}
+
+		creds := &apps.Credentials{
+			Host:     args[1],
+			Path:     flagRepository,
+			Username: args[2],
+			Token:    args[3],
+		}
+		db := instance.GetDatabasePrefix()
+		if err = apps.SaveCredentials(ctx, db, creds); err != nil {
+			return err
+		}
+
+		fmt.Printf("Credentials saved for %s%s\n", creds.Host, creds.Path)
+		return nil
+	},
+}
+
+var rotateKeyInstanceCmd = &cobra.Command{
+	Use:   "rotate-key [domain] [purpose]",
+	Short: "Rotate a key of the keyring of an instance",
+	Long: `
+cozy-stack instances rotate-key generates a new key for the instance of the
+given domain, for a purpose: sessions, apps, oauth or admin. What has been signed
+with the previous keys is still accepted, unless --revoke is given.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := Configure(); err != nil {
+			return err
+		}
+
+		if len(args) < 2 {
+			return cmd.Help()
+		}
+
+		domain, purpose := args[0], args[1]
+		switch purpose {
+		case instance.KeySessions, instance.KeyApps, instance.KeyOAuth, instance.KeyAdmin:
+		default:
+			return fmt.Errorf("Unknown purpose: %s", purpose)
+		}
+
+		ctx := context.Background()
+		i, err := instance.Get(ctx, domain)
+		if err != nil {
+			return err
+		}
+
+		var key *instance.Key
+		if flagRevoke {
+			key, err = i.RevokeKeys(ctx, purpose)
+		} else {
+			key, err = i.RotateKey(ctx, purpose)
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("New %s key for %s: %s\n", purpose, domain, key.ID)
+		return nil
+	},
+}
+
+var exportInstanceCmd = &cobra.Command{
+	Use:   "export [domain] [file]",
+	Short: "Export an instance to a portable archive",
+	Long: `
+cozy-stack instances export writes a tar.gz archive with all the data of the
+instance for the given domain: its CouchDB documents, as a JSON file per
+doctype, and its files. The archive is written in <domain>.tar.gz by default,
+or on the standard output if the file is -. It can be used by the owner to
+take the data out, or to migrate the instance to another hoster.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if err = Configure(); err != nil {
+			return err
+		}
+
+		if len(args) < 1 {
+			return cmd.Help()
+		}
+
+		domain := args[0]
+		filename := domain + ".tar.gz"
+		if len(args) > 1 {
+			filename = args[1]
+		}
+
+		if filename == "-" {
+			return instance.Export(context.Background(), domain, os.Stdout)
+		}
+
+		file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if errc := file.Close(); err == nil {
+				err = errc
+			}
+			if err != nil {
+				os.Remove(filename)
+			}
+		}()
+
+		if err = instance.Export(context.Background(), domain, file); err != nil {
+			return err
+		}
+
+		fmt.Printf("Instance %s exported to %s\n", domain, filename)
 		return nil
 	},
 }
 
 func init() {
 	instanceCmdGroup.AddCommand(addInstanceCmd)
+	instanceCmdGroup.AddCommand(lsInstanceCmd)
+	instanceCmdGroup.AddCommand(rmInstanceCmd)
+	instanceCmdGroup.AddCommand(fsckInstanceCmd)
+	instanceCmdGroup.AddCommand(replicateInstanceCmd)
+	instanceCmdGroup.AddCommand(credentialsInstanceCmd)
+	instanceCmdGroup.AddCommand(exportInstanceCmd)
+	instanceCmdGroup.AddCommand(rotateKeyInstanceCmd)
 	addInstanceCmd.Flags().StringVar(&flagLocale, "locale", "en", "Locale of the new cozy instance")
-	addInstanceCmd.Flags().StringSliceVar(&flagApps, "apps", nil, "Apps to be preinstalled")
+	addInstanceCmd.Flags().StringVar(&flagStorageURL, "storage-url", "", "URL or local path of the storage of the files, like mem://example.org/")
+	addInstanceCmd.Flags().StringVar(&flagContext, "context", "", "Name of the context of the new cozy instance, from the config file")
+	addInstanceCmd.Flags().StringSliceVar(&flagApps, "apps", nil, "Apps to be preinstalled from the registry, instead of the default apps of the context")
+	addInstanceCmd.Flags().Int64Var(&flagQuota, "quota", 0, "Maximal size in bytes of the files (the quota of the context by default)")
+	addInstanceCmd.Flags().IntVar(&flagTrashRetention, "trash-retention", 0, "Number of days the files are kept in the trash (30 by default)")
+	rotateKeyInstanceCmd.Flags().BoolVar(&flagRevoke, "revoke", false, "Revoke the previous keys")
+	instanceCmdGroup.PersistentFlags().StringVar(&flagAdminURL, "admin-url", "", "URL of the admin server of a stack, like http://localhost:6060, to use its API instead of CouchDB")
+	rmInstanceCmd.Flags().BoolVar(&flagYes, "yes", false, "Don't ask for a confirmation")
+	lsInstanceCmd.Flags().BoolVar(&flagJSON, "json", false, "Print the instances in JSON")
+	lsInstanceCmd.Flags().BoolVarP(&flagQuiet, "quiet", "q", false, "Print only the domains of the instances")
+	replicateInstanceCmd.Flags().BoolVar(&flagContinuous, "continuous", false, "Keep replicating the future changes")
+	credentialsInstanceCmd.Flags().StringVar(&flagRepository, "repository", "", "Path of the repository, like /cozy/emails.git")
 	RootCmd.AddCommand(instanceCmdGroup)
 }
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/config"
+	"github.com/dcasier/cozy-stack/logger"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+)
+
+// reloadConfig reads the configuration file again, when the stack receives
+// a SIGHUP, and applies the changes of the logs, the limits and trusted
+// proxies of the rate limiter, the limits of the request bodies, the
+// registry, the SMTP server and the contexts. The changes of
+// the keys listed in config.RestartKeys are ignored until the next restart.
+// The output of the logs is always reopened, for logrotate.
+func reloadConfig() error {
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+	for _, err := range config.Check(viper.GetViper()) {
+		logger.Warnf("config", "%v", err)
+	}
+
+	applied, restart := config.Reload(viper.GetViper())
+	if err := configureLogger(); err != nil {
+		return err
+	}
+	if !config.GetConfig().RateLimit.Disabled {
+		middlewares.UseRateLimits(rateLimits())
+		if err := middlewares.UseTrustedProxies(config.GetConfig().RateLimit.TrustedProxies); err != nil {
+			return err
+		}
+	}
+	middlewares.UseBodyLimits(bodyLimits())
+	if err := apps.UseRegistry(config.GetConfig().Registry.URL); err != nil {
+		return err
+	}
+	configureSMTP()
+	configureContexts()
+
+	if len(applied) == 0 && len(restart) == 0 {
+		logger.Infof("config", "%s reloaded, nothing has changed", viper.ConfigFileUsed())
+		return nil
+	}
+	msg := viper.ConfigFileUsed() + " reloaded"
+	if len(applied) > 0 {
+		msg += ", applied: " + strings.Join(applied, ", ")
+	}
+	if len(restart) > 0 {
+		msg += ", needs a restart: " + strings.Join(restart, ", ")
+	}
+	logger.Infof("config", "%s", msg)
+	return nil
+}
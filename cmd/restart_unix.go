@@ -0,0 +1,104 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// readyTimeout is the maximal duration to wait for the new process to be
+// ready on a restart
+const readyTimeout = 2 * time.Minute
+
+var (
+	// ErrListenerNotTCP is used when a listener can't be given to the new
+	// process on a restart
+	ErrListenerNotTCP = errors.New("Only the TCP listeners can be given to the new process")
+	// ErrNotReady is used when the new process of a restart has stopped, or
+	// has not served its listeners before readyTimeout
+	ErrNotReady = errors.New("The new process has not become ready")
+)
+
+// restartSignals are the signals that restart the stack without downtime
+var restartSignals = []os.Signal{syscall.SIGUSR2}
+
+// restart starts a new process of the stack, with the same arguments, that
+// inherits the listeners of the servers: the new connections are accepted
+// by the new process while the current one finishes its requests. It
+// returns once the new process has signaled that it serves the listeners,
+// on the pipe given in readyEnv. If the new process stops before, or is
+// too slow, it returns an error and the current process keeps serving.
+func restart(servers []*server) error {
+	files := make([]*os.File, len(servers))
+	names := make([]string, len(servers))
+	for i, s := range servers {
+		l, ok := s.listener.(*net.TCPListener)
+		if !ok {
+			return ErrListenerNotTCP
+		}
+		f, err := l.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		files[i] = f
+		names[i] = s.name
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		listenersEnv+"="+strings.Join(names, ","),
+		readyEnv+"="+strconv.Itoa(3+len(files)))
+	cmd.ExtraFiles = append(files, w)
+	err = cmd.Start()
+	// the pipe is closed for the current process, so that its read ends if
+	// the new process stops
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			ready <- ErrNotReady
+			return
+		}
+		ready <- nil
+	}()
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(readyTimeout):
+		err = ErrNotReady
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		<-exited
+	}
+	return err
+}
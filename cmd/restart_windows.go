@@ -0,0 +1,18 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrRestartUnsupported is used when the stack is asked to restart without
+// downtime on a platform that can't give its listeners to a new process
+var ErrRestartUnsupported = errors.New("The restart without downtime is not supported on this platform")
+
+// restartSignals are the signals that restart the stack without downtime
+var restartSignals = []os.Signal{}
+
+// restart is not supported on Windows
+func restart(servers []*server) error {
+	return ErrRestartUnsupported
+}
@@ -2,8 +2,12 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/dcasier/cozy-stack/config"
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/logger"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -44,6 +48,36 @@ func init() {
 
 	RootCmd.PersistentFlags().StringP("databaseUrl", "d", "http://localhost:5984", "couchdb database address")
 	viper.BindPFlag("databaseUrl", RootCmd.PersistentFlags().Lookup("databaseUrl"))
+
+	RootCmd.PersistentFlags().StringP("databaseCAFile", "", "", "PEM file with the certificate authorities trusted for couchdb over https")
+	viper.BindPFlag("databaseCAFile", RootCmd.PersistentFlags().Lookup("databaseCAFile"))
+
+	RootCmd.PersistentFlags().BoolP("databaseInsecureSkipVerify", "", false, "do not verify the certificate of couchdb (for development only)")
+	viper.BindPFlag("databaseInsecureSkipVerify", RootCmd.PersistentFlags().Lookup("databaseInsecureSkipVerify"))
+
+	RootCmd.PersistentFlags().IntP("databaseRetries", "", couchdb.DefaultRetryPolicy.MaxRetries, "number of retries of the couchdb requests on transient failures")
+	viper.BindPFlag("databaseRetries", RootCmd.PersistentFlags().Lookup("databaseRetries"))
+
+	RootCmd.PersistentFlags().IntP("databaseBreakerThreshold", "", couchdb.DefaultRetryPolicy.BreakerThreshold, "number of consecutive couchdb failures before the requests are suspended (0 to disable)")
+	viper.BindPFlag("databaseBreakerThreshold", RootCmd.PersistentFlags().Lookup("databaseBreakerThreshold"))
+
+	RootCmd.PersistentFlags().IntP("databaseMaxIdleConns", "", couchdb.DefaultTransportOptions.MaxIdleConnsPerHost, "number of idle connections to couchdb kept open")
+	viper.BindPFlag("databaseMaxIdleConns", RootCmd.PersistentFlags().Lookup("databaseMaxIdleConns"))
+
+	RootCmd.PersistentFlags().DurationP("databaseTimeout", "", 0, "maximum duration of a couchdb request (0 for no limit)")
+	viper.BindPFlag("databaseTimeout", RootCmd.PersistentFlags().Lookup("databaseTimeout"))
+
+	RootCmd.PersistentFlags().String("fs-url", "", "root of the storages of the new instances, like file://localhost/var/lib/cozy/")
+	viper.BindPFlag("fs.url", RootCmd.PersistentFlags().Lookup("fs-url"))
+
+	RootCmd.PersistentFlags().String("log-level", "info", "minimal level of the logs: debug, info, warn or error")
+	viper.BindPFlag("log.level", RootCmd.PersistentFlags().Lookup("log-level"))
+
+	RootCmd.PersistentFlags().String("log-format", "text", "format of the logs: text or json")
+	viper.BindPFlag("log.format", RootCmd.PersistentFlags().Lookup("log-format"))
+
+	RootCmd.PersistentFlags().String("log-output", "stderr", "output of the logs: stderr, stdout, syslog or the path of a file")
+	viper.BindPFlag("log.output", RootCmd.PersistentFlags().Lookup("log-output"))
 }
 
 // Configure Viper to read the environment and the optional config file
@@ -74,10 +108,85 @@ func Configure() error {
 	}
 
 	if viper.ConfigFileUsed() != "" {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		// on stderr, to not mix it with the output of the commands read by
+		// the scripts and the shell completions
+		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
 
 	config.UseViper(viper.GetViper())
 
+	if err = configureLogger(); err != nil {
+		return err
+	}
+
+	db := config.GetConfig().Database
+	err = couchdb.UseServer(couchdb.ServerOptions{
+		URL:                db.URL,
+		User:               db.User,
+		Password:           db.Password,
+		CAFile:             db.CAFile,
+		InsecureSkipVerify: db.InsecureSkipVerify,
+		Transport: couchdb.TransportOptions{
+			MaxIdleConnsPerHost: db.MaxIdleConns,
+			IdleConnTimeout:     db.IdleConnTimeout,
+			DialTimeout:         db.DialTimeout,
+			KeepAlive:           db.KeepAlive,
+			Timeout:             db.Timeout,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	policy := couchdb.DefaultRetryPolicy
+	policy.MaxRetries = db.Retries
+	policy.BreakerThreshold = db.BreakerThreshold
+	couchdb.UseRetryPolicy(policy)
+
+	if fsURL := config.GetConfig().Fs.URL; fsURL != "" {
+		if err = instance.UseFSURL(fsURL); err != nil {
+			return err
+		}
+	}
+
+	configureContexts()
+
 	return nil
 }
+
+// configureLogger applies the level, format and output of the logs of the
+// configuration
+func configureLogger() error {
+	cfg := config.GetConfig().Log
+	level, err := logger.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	return logger.Configure(&logger.Options{
+		Level:      level,
+		Format:     cfg.Format,
+		Output:     cfg.Output,
+		MaxSize:    int64(cfg.MaxSize) * 1024 * 1024,
+		MaxBackups: cfg.MaxBackups,
+	})
+}
+
+// configureContexts gives the contexts of the configuration file to the
+// instance package
+func configureContexts() {
+	var contexts []*instance.Context
+	for name, c := range config.GetConfig().Contexts {
+		var defaultApps []*instance.DefaultApp
+		for _, app := range c.DefaultApps {
+			defaultApps = append(defaultApps, &instance.DefaultApp{Slug: app.Slug, Source: app.Source})
+		}
+		contexts = append(contexts, &instance.Context{
+			Name:        name,
+			DefaultApps: defaultApps,
+			Quota:       c.Quota,
+			Features:    c.Features,
+			Branding:    c.Branding,
+		})
+	}
+	instance.UseContexts(contexts)
+}
@@ -1,36 +1,165 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 
+	"github.com/dcasier/cozy-stack/apps"
 	"github.com/dcasier/cozy-stack/config"
+	"github.com/dcasier/cozy-stack/i18n"
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/jobs"
+	"github.com/dcasier/cozy-stack/logger"
+	"github.com/dcasier/cozy-stack/mails"
+	"github.com/dcasier/cozy-stack/ratelimit"
+	"github.com/dcasier/cozy-stack/redis"
+	"github.com/dcasier/cozy-stack/vfs"
 	"github.com/dcasier/cozy-stack/web"
+	"github.com/dcasier/cozy-stack/web/metrics"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/dcasier/cozy-stack/web/status"
 )
 
+// appsSweepInterval is the delay between two collections of the files of
+// the failed installations
+const appsSweepInterval = time.Hour
+
+// devAppDir is the local directory of an application in development
+var devAppDir string
+
+// ErrDevInProduction is used when an application in development is served
+// in production mode
+var ErrDevInProduction = errors.New("The --dev flag can not be used in production mode")
+
 // serveCmd represents the serve command
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Starts the stack and listens for HTTP calls",
 	Long: `Starts the stack and listens for HTTP calls
 It will accept HTTP requests on localhost:8080 by default.
-Use the --port and --host flags to change the listening option.`,
+Use the --port and --host flags to change the listening option.
+
+It serves HTTPS with the --cert and --key flags, or with the certificates
+obtained automatically from Let's Encrypt for the domains of the instances
+with the --acme flag.
+
+On SIGINT or SIGTERM, the stack stops accepting new connections, and waits
+for the requests and the jobs in progress before exiting. On SIGUSR2, it
+starts a new process that takes over its listeners, and then stops the same
+way, for a restart without downtime. On SIGHUP, it reads its configuration
+file again and applies the changes of the logs, the rate limits, the limits of
+the request bodies, the registry, the SMTP server and the contexts; the other
+keys need a restart.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if err := Configure(); err != nil {
 			return err
 		}
 
+		for _, err := range config.Check(viper.GetViper()) {
+			logger.Warnf("config", "%v", err)
+		}
+
+		if err := configureAntivirus(); err != nil {
+			return err
+		}
+
+		if err := configureRateLimiter(); err != nil {
+			return err
+		}
+
+		middlewares.UseBodyLimits(bodyLimits())
+
+		configureSMTP()
+
+		scheduler, err := configureJobs()
+		if err != nil {
+			return err
+		}
+
+		configureStatus()
+
+		gzipConfig := config.GetConfig().Gzip
+		if err := middlewares.UseGzip(!gzipConfig.Disabled, gzipConfig.Level); err != nil {
+			return err
+		}
+
+		if dir := config.GetConfig().I18n.Dir; dir != "" {
+			if err := i18n.LoadDir(dir); err != nil {
+				return err
+			}
+		}
+
+		if err := apps.UseRegistry(config.GetConfig().Registry.URL); err != nil {
+			return err
+		}
+
+		appsConfig := config.GetConfig().Apps
+		if err := apps.UseTrustedKeys(appsConfig.TrustedKeys, appsConfig.RequireSignature); err != nil {
+			return err
+		}
+
+		recoverMoves()
+		time.AfterFunc(vfs.MoveGracePeriod, recoverMoves)
+		recoverApps()
+		go ensureTrashTriggers()
+		go sweepApps()
+
 		router := getGin()
 		web.SetupRoutes(router)
+		if devAppDir != "" {
+			if config.GetConfig().Mode == config.Production {
+				return ErrDevInProduction
+			}
+			web.SetupDevRoutes(router, devAppDir)
+		}
 
+		tlsConfig, manager, err := configureTLS()
+		if err != nil {
+			return err
+		}
 		addr := config.GetConfig().Host + ":" + strconv.Itoa(config.GetConfig().Port)
-		return router.Run(addr)
+		public, err := newServer("http", addr, router)
+		if err != nil {
+			return err
+		}
+		public.srv.TLSConfig = tlsConfig
+		servers := []*server{public}
+		redirect, err := newRedirectServer(manager)
+		if err != nil {
+			return err
+		}
+		if redirect != nil {
+			servers = append(servers, redirect)
+		}
+		admin, err := newAdminServer()
+		if err != nil {
+			return err
+		}
+		if admin != nil {
+			servers = append(servers, admin)
+		}
+		return serveAndWait(servers, scheduler)
 	},
 }
 
 func init() {
+	serveCmd.Flags().StringVar(&devAppDir, "dev", "", "serve the application in development in this local directory on /dev")
+
+	serveCmd.Flags().String("cert", "", "PEM file with the certificate to serve HTTPS")
+	viper.BindPFlag("tls.cert", serveCmd.Flags().Lookup("cert"))
+
+	serveCmd.Flags().String("key", "", "PEM file with the private key of the certificate")
+	viper.BindPFlag("tls.key", serveCmd.Flags().Lookup("key"))
+
+	serveCmd.Flags().Bool("acme", false, "obtain and renew the certificates with Let's Encrypt")
+	viper.BindPFlag("tls.acme", serveCmd.Flags().Lookup("acme"))
+
 	RootCmd.AddCommand(serveCmd)
 }
 
@@ -39,5 +168,266 @@ func getGin() *gin.Engine {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	return gin.Default()
+	router := gin.New()
+	router.Use(gin.LoggerWithWriter(logger.Writer(logger.InfoLevel, "http")))
+	router.Use(gin.RecoveryWithWriter(logger.Writer(logger.ErrorLevel, "http")))
+	return router
+}
+
+// newAdminServer returns the admin server, if an admin port is configured
+func newAdminServer() (*server, error) {
+	cfg := config.GetConfig()
+	metrics.UsePublic(cfg.Metrics.Public)
+	if cfg.Admin.Port == 0 {
+		return nil, nil
+	}
+
+	host := cfg.Admin.Host
+	if host == "" {
+		host = "localhost"
+	}
+	router := getGin()
+	web.SetupAdminRoutes(router)
+	return newServer("admin", host+":"+strconv.Itoa(cfg.Admin.Port), router)
+}
+
+// configureAntivirus plugs the clamd scanner in the VFS if a clamd socket
+// is configured
+func configureAntivirus() error {
+	av := config.GetConfig().Antivirus
+	if av.Clamd == "" {
+		return nil
+	}
+
+	scanner, err := vfs.NewClamdScanner(av.Clamd)
+	if err != nil {
+		return err
+	}
+
+	vfs.UseScanner(scanner, av.Action, av.FailOpen)
+	return nil
+}
+
+// configureRateLimiter enables the rate limiter of the requests, with the
+// budgets of the configuration or the default ones
+func configureRateLimiter() error {
+	cfg := config.GetConfig().RateLimit
+	if cfg.Disabled {
+		return nil
+	}
+
+	var store ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.Redis != "" {
+		redis, err := ratelimit.NewRedisStore(cfg.Redis)
+		if err != nil {
+			return err
+		}
+		store = redis
+	}
+
+	middlewares.UseRateLimiter(store, rateLimits())
+	return middlewares.UseTrustedProxies(cfg.TrustedProxies)
+}
+
+// configureSMTP gives the SMTP server of the configuration to the mails
+// package
+func configureSMTP() {
+	mailConfig := config.GetConfig().Mail
+	mails.UseSMTP(&mails.SMTPConfig{
+		Host:                      mailConfig.Host,
+		Port:                      mailConfig.Port,
+		Username:                  mailConfig.Username,
+		Password:                  mailConfig.Password,
+		DisableTLS:                mailConfig.DisableTLS,
+		SkipCertificateValidation: mailConfig.SkipCertificateValidation,
+	})
+}
+
+// rateLimits returns the limits of the groups of routes, with the defaults
+// of the ratelimit package for the values that are not configured
+func rateLimits() map[string]ratelimit.Limit {
+	cfg := config.GetConfig().RateLimit
+	limit := ratelimit.DefaultLimit
+	if cfg.Rate > 0 {
+		limit.Rate = cfg.Rate
+	}
+	if cfg.Burst > 0 {
+		limit.Burst = cfg.Burst
+	}
+	authLimit := ratelimit.DefaultAuthLimit
+	if cfg.AuthRate > 0 {
+		authLimit.Rate = cfg.AuthRate
+	}
+	if cfg.AuthBurst > 0 {
+		authLimit.Burst = cfg.AuthBurst
+	}
+	return map[string]ratelimit.Limit{
+		middlewares.RateLimitDefault: limit,
+		middlewares.RateLimitAuth:    authLimit,
+	}
+}
+
+// bodyLimits returns the maximal sizes of the request bodies of the groups
+// of routes that are configured. The others keep the defaults of the
+// middlewares package.
+func bodyLimits() map[string]int64 {
+	cfg := config.GetConfig().BodyLimit
+	limits := make(map[string]int64)
+	if cfg.JSON > 0 {
+		limits[middlewares.BodyLimitJSON] = cfg.JSON
+	}
+	if cfg.Files > 0 {
+		limits[middlewares.BodyLimitFiles] = cfg.Files
+	}
+	return limits
+}
+
+// configureJobs starts the workers of the jobs and the scheduler of the
+// triggers, with the queues in Redis if a Redis server is configured
+func configureJobs() (*jobs.Scheduler, error) {
+	locker, err := configureJobsBroker()
+	if err != nil {
+		return nil, err
+	}
+	jobs.Start()
+	scheduler := jobs.NewScheduler(locker, instancePrefixes)
+	scheduler.Start()
+	return scheduler, nil
+}
+
+// configureJobsBroker uses the queues in Redis if a Redis server is
+// configured, to share them with the other stacks. It returns the locker of
+// the scheduler, nil for the queues in memory.
+func configureJobsBroker() (jobs.Locker, error) {
+	url := config.GetConfig().Jobs.Redis
+	if url == "" {
+		return nil, nil
+	}
+	broker, err := jobs.NewRedisBroker(url)
+	if err != nil {
+		return nil, err
+	}
+	jobs.UseBroker(broker)
+	return jobs.NewRedisLocker(url)
+}
+
+// configureStatus adds the Redis servers of the configuration to the
+// dependencies checked by /status
+func configureStatus() {
+	urls := make(map[string]bool)
+	for _, url := range []string{config.GetConfig().RateLimit.Redis, config.GetConfig().Jobs.Redis} {
+		if url != "" {
+			urls[url] = true
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	var clients []*redis.Client
+	for url := range urls {
+		client, err := redis.NewClient(url)
+		if err != nil {
+			logger.Errorf("status", "cannot check the redis server: %v", err)
+			continue
+		}
+		clients = append(clients, client)
+	}
+	status.AddCheck("redis", func(ctx context.Context) error {
+		for _, client := range clients {
+			if err := client.Ping(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// instancePrefixes returns the database prefixes of all the instances
+func instancePrefixes(ctx context.Context) ([]string, error) {
+	instances, err := instance.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make([]string, len(instances))
+	for k, i := range instances {
+		prefixes[k] = i.GetDatabasePrefix()
+	}
+	return prefixes, nil
+}
+
+// ensureTrashTriggers adds the trigger that purges the trash to the
+// instances created before it existed
+func ensureTrashTriggers() {
+	ctx := context.Background()
+	instances, err := instance.List(ctx)
+	if err != nil {
+		logger.Errorf("trash", "cannot list the instances: %v", err)
+		return
+	}
+	for _, i := range instances {
+		if err = i.EnsureTrashTrigger(ctx); err != nil {
+			logger.Errorf("trash", "cannot add the trash trigger of %s: %v", i.Domain, err)
+		}
+	}
+}
+
+// recoverMoves finishes or reverts the moves of directories that have
+// been interrupted by the last stop of the stack. It is done before
+// serving the requests, and once more after the grace period of the
+// journal, for the moves that were too recent to be recovered at start.
+func recoverMoves() {
+	ctx := context.Background()
+	instances, err := instance.List(ctx)
+	if err != nil {
+		logger.Errorf("vfs", "cannot list the instances: %v", err)
+		return
+	}
+	for _, i := range instances {
+		if err = i.RecoverMoves(ctx); err != nil {
+			logger.Errorf("vfs", "cannot recover the moves of %s: %v", i.Domain, err)
+		}
+	}
+}
+
+// recoverApps resumes the installations, updates and uninstallations of
+// applications that have been interrupted by the last stop of the stack
+func recoverApps() {
+	ctx := context.Background()
+	instances, err := instance.List(ctx)
+	if err != nil {
+		logger.Errorf("apps", "cannot list the instances: %v", err)
+		return
+	}
+	for _, i := range instances {
+		vfsC, err := i.GetVFSContext(ctx)
+		if err == nil {
+			err = apps.Recover(ctx, vfsC, i.GetDatabasePrefix())
+		}
+		if err != nil {
+			logger.Errorf("apps", "cannot recover the applications of %s: %v", i.Domain, err)
+		}
+	}
+}
+
+// sweepApps periodically removes the files left by the installations and
+// updates of applications that have failed
+func sweepApps() {
+	ctx := context.Background()
+	for range time.Tick(appsSweepInterval) {
+		instances, err := instance.List(ctx)
+		if err != nil {
+			logger.Errorf("apps", "cannot list the instances: %v", err)
+			continue
+		}
+		for _, i := range instances {
+			vfsC, err := i.GetVFSContext(ctx)
+			if err == nil {
+				err = apps.SweepErrored(ctx, vfsC, i.GetDatabasePrefix(), apps.ErroredGracePeriod)
+			}
+			if err != nil {
+				logger.Errorf("apps", "cannot sweep the applications of %s: %v", i.Domain, err)
+			}
+		}
+	}
 }
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/config"
+	"github.com/dcasier/cozy-stack/instance"
+)
+
+// defaultACMECacheDir is the directory of the certificates obtained with
+// ACME, if it is not configured
+const defaultACMECacheDir = "/var/lib/cozy/acme"
+
+// ErrTLSIncomplete is used when only one of the certificate and the key is
+// configured
+var ErrTLSIncomplete = errors.New("The certificate and the key must be configured together")
+
+// ErrTLSWithACME is used when a certificate is configured with ACME
+var ErrTLSWithACME = errors.New("A certificate can not be configured with ACME, as the certificates are obtained from Let's Encrypt")
+
+// ErrACMELocalDomain is used when a certificate is asked with ACME for a
+// local domain
+var ErrACMELocalDomain = errors.New("No certificate can be obtained for a local domain")
+
+// configureTLS returns the TLS configuration of the public server, and the
+// ACME manager if the certificates are obtained from Let's Encrypt. The TLS
+// configuration is nil when the stack serves plain HTTP.
+func configureTLS() (*tls.Config, *autocert.Manager, error) {
+	cfg := config.GetConfig().TLS
+	if (cfg.Cert == "") != (cfg.Key == "") {
+		return nil, nil, ErrTLSIncomplete
+	}
+
+	if cfg.ACME {
+		if cfg.Cert != "" {
+			return nil, nil, ErrTLSWithACME
+		}
+		cacheDir := cfg.CacheDir
+		if cacheDir == "" {
+			cacheDir = defaultACMECacheDir
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cacheDir),
+			HostPolicy: instanceHostPolicy,
+			Email:      cfg.Email,
+		}
+		return &tls.Config{GetCertificate: manager.GetCertificate}, manager, nil
+	}
+
+	if cfg.Cert == "" {
+		return nil, nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil, nil
+}
+
+// instanceHostPolicy accepts to obtain a certificate only for the domains
+// of the instances and the subdomains of their applications, so that a
+// client can't make the stack ask Let's Encrypt for any domain that points
+// to it
+func instanceHostPolicy(ctx context.Context, host string) error {
+	if host == "localhost" || net.ParseIP(host) != nil {
+		return ErrACMELocalDomain
+	}
+	_, err := instance.Get(ctx, host)
+	if instance.IsNotFound(err) {
+		if parts := strings.SplitN(host, ".", 2); len(parts) == 2 && apps.ValidSlug(parts[0]) {
+			_, err = instance.Get(ctx, parts[1])
+		}
+	}
+	return err
+}
+
+// newRedirectServer returns the plain HTTP server that redirects to HTTPS,
+// if an HTTP port is configured. With ACME, it also answers the http-01
+// challenges of Let's Encrypt.
+func newRedirectServer(manager *autocert.Manager) (*server, error) {
+	cfg := config.GetConfig()
+	if cfg.TLS.HTTPPort == 0 {
+		return nil, nil
+	}
+	var handler http.Handler = redirectToHTTPS(cfg.Port)
+	if manager != nil {
+		handler = manager.HTTPHandler(handler)
+	}
+	return newServer("redirect", cfg.Host+":"+strconv.Itoa(cfg.TLS.HTTPPort), handler)
+}
+
+// redirectToHTTPS returns a handler that redirects the requests to the same
+// URL on the HTTPS server, listening on the given port
+func redirectToHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if port != 443 {
+			host += ":" + strconv.Itoa(port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
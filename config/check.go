@@ -0,0 +1,413 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/dcasier/cozy-stack/logger"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// redacted replaces the secrets in the configuration printed by Redacted
+const redacted = "********"
+
+// keyKind is the type of the value of a configuration key
+type keyKind int
+
+const (
+	stringKey keyKind = iota
+	intKey
+	boolKey
+	floatKey
+	durationKey
+	stringSliceKey
+	stringMapKey
+	listKey
+)
+
+// knownKeys are the keys read by UseViper, with the type of their value
+var knownKeys = map[string]keyKind{
+	"mode":                           stringKey,
+	"host":                           stringKey,
+	"port":                           intKey,
+	"databaseUrl":                    stringKey,
+	"databaseUser":                   stringKey,
+	"databasePassword":               stringKey,
+	"databaseCAFile":                 stringKey,
+	"databaseInsecureSkipVerify":     boolKey,
+	"databaseRetries":                intKey,
+	"databaseBreakerThreshold":       intKey,
+	"databaseMaxIdleConns":           intKey,
+	"databaseIdleConnTimeout":        durationKey,
+	"databaseDialTimeout":            durationKey,
+	"databaseKeepAlive":              durationKey,
+	"databaseTimeout":                durationKey,
+	"fs.url":                         stringKey,
+	"antivirus.clamd":                stringKey,
+	"antivirus.action":               stringKey,
+	"antivirus.failOpen":             boolKey,
+	"registry.url":                   stringKey,
+	"apps.trustedKeys":               stringSliceKey,
+	"apps.requireSignature":          boolKey,
+	"rateLimit.disabled":             boolKey,
+	"rateLimit.rate":                 floatKey,
+	"rateLimit.burst":                intKey,
+	"rateLimit.authRate":             floatKey,
+	"rateLimit.authBurst":            intKey,
+	"rateLimit.redis":                stringKey,
+	"rateLimit.trustedProxies":       stringSliceKey,
+	"bodyLimit.json":                 intKey,
+	"bodyLimit.files":                intKey,
+	"gzip.disabled":                  boolKey,
+	"gzip.level":                     intKey,
+	"jobs.redis":                     stringKey,
+	"mail.host":                      stringKey,
+	"mail.port":                      intKey,
+	"mail.username":                  stringKey,
+	"mail.password":                  stringKey,
+	"mail.disableTLS":                boolKey,
+	"mail.skipCertificateValidation": boolKey,
+	"admin.host":                     stringKey,
+	"admin.port":                     intKey,
+	"metrics.public":                 boolKey,
+	"tls.cert":                       stringKey,
+	"tls.key":                        stringKey,
+	"tls.acme":                       boolKey,
+	"tls.email":                      stringKey,
+	"tls.cacheDir":                   stringKey,
+	"tls.httpPort":                   intKey,
+	"i18n.dir":                       stringKey,
+	"log.level":                      stringKey,
+	"log.format":                     stringKey,
+	"log.output":                     stringKey,
+	"log.maxSize":                    intKey,
+	"log.maxBackups":                 intKey,
+	"shutdownTimeout":                durationKey,
+}
+
+// contextKeys are the keys of a context, under contexts.<name>
+var contextKeys = map[string]keyKind{
+	"defaultApps": listKey,
+	"quota":       intKey,
+	"features":    stringSliceKey,
+	"branding":    stringMapKey,
+}
+
+// Check returns the problems of the configuration of viper: the unknown
+// keys, that are often typos and would be silently ignored, the values that
+// don't have the expected type, and the invalid values. The configuration is
+// valid if the list is empty.
+func Check(v *viper.Viper) []error {
+	var errs []error
+	settings := v.AllSettings()
+	for _, key := range sortedSettings(settings) {
+		value := settings[key]
+		if strings.EqualFold(key, "contexts") {
+			errs = append(errs, checkContexts(value)...)
+			continue
+		}
+		errs = append(errs, checkKey(knownKeys, "", key, value)...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	switch v.GetString("mode") {
+	case string(Production), string(Development):
+	default:
+		errs = append(errs, fmt.Errorf("mode: must be production or development"))
+	}
+	return append(errs, checkValues(fromViper(v))...)
+}
+
+// checkKey checks the value of a key, and of its sub-keys if it is a map.
+// The prefix is only used for the messages.
+func checkKey(known map[string]keyKind, prefix, key string, value interface{}) []error {
+	if name, kind, ok := findKey(known, key); ok {
+		if err := checkKind(kind, value); err != nil {
+			return []error{fmt.Errorf("%s%s: %s", prefix, name, err)}
+		}
+		return nil
+	}
+	if m, err := cast.ToStringMapE(value); err == nil && isPrefix(known, key+".") {
+		var errs []error
+		for _, sub := range sortedSettings(m) {
+			errs = append(errs, checkKey(known, prefix, key+"."+sub, m[sub])...)
+		}
+		return errs
+	}
+	if suggestion := suggestKey(known, key); suggestion != "" {
+		return []error{fmt.Errorf("%s%s: unknown key, did you mean %s%s?", prefix, key, prefix, suggestion)}
+	}
+	return []error{fmt.Errorf("%s%s: unknown key", prefix, key)}
+}
+
+func checkContexts(value interface{}) []error {
+	contexts, err := cast.ToStringMapE(value)
+	if err != nil {
+		return []error{fmt.Errorf("contexts: must be a map of contexts")}
+	}
+	var errs []error
+	for _, name := range sortedSettings(contexts) {
+		c, err := cast.ToStringMapE(contexts[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("contexts.%s: must be a map", name))
+			continue
+		}
+		for _, key := range sortedSettings(c) {
+			errs = append(errs, checkKey(contextKeys, "contexts."+name+".", key, c[key])...)
+		}
+	}
+	return errs
+}
+
+// findKey returns the known key for a key of viper, that are case
+// insensitive, with its canonical name
+func findKey(known map[string]keyKind, key string) (string, keyKind, bool) {
+	for name, kind := range known {
+		if strings.EqualFold(name, key) {
+			return name, kind, true
+		}
+	}
+	return "", 0, false
+}
+
+// isPrefix returns true if a known key starts with the given prefix
+func isPrefix(known map[string]keyKind, prefix string) bool {
+	prefix = strings.ToLower(prefix)
+	for name := range known {
+		if strings.HasPrefix(strings.ToLower(name), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// suggestKey returns the known key closest to an unknown key, if it is
+// close enough to be a typo
+func suggestKey(known map[string]keyKind, key string) string {
+	key = strings.ToLower(key)
+	best, bestDistance := "", 3
+	for name := range known {
+		d := distance(key, strings.ToLower(name))
+		if d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+// distance is the Levenshtein distance between two strings
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// checkKind returns an error if the value can't be read with the type of
+// the key
+func checkKind(kind keyKind, value interface{}) error {
+	var err error
+	switch kind {
+	case stringKey:
+		switch value.(type) {
+		case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+			return fmt.Errorf("must be a string")
+		}
+	case intKey:
+		if _, err = cast.ToIntE(value); err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+	case boolKey:
+		if _, err = cast.ToBoolE(value); err != nil {
+			return fmt.Errorf("must be true or false")
+		}
+	case floatKey:
+		if _, err = cast.ToFloat64E(value); err != nil {
+			return fmt.Errorf("must be a number")
+		}
+	case durationKey:
+		if _, err = cast.ToDurationE(value); err != nil {
+			return fmt.Errorf("must be a duration, like 30s")
+		}
+	case stringSliceKey:
+		if _, err = cast.ToStringSliceE(value); err != nil {
+			return fmt.Errorf("must be a list of strings")
+		}
+	case stringMapKey:
+		if _, err = cast.ToStringMapStringE(value); err != nil {
+			return fmt.Errorf("must be a map of strings")
+		}
+	case listKey:
+		switch value.(type) {
+		case []interface{}, []string:
+		default:
+			return fmt.Errorf("must be a list")
+		}
+	}
+	return nil
+}
+
+// checkValues returns the values of the configuration that are not valid,
+// or that don't work together
+func checkValues(cfg *Config) []error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	ports := []struct {
+		key  string
+		port int
+	}{
+		{"port", cfg.Port},
+		{"admin.port", cfg.Admin.Port},
+		{"mail.port", cfg.Mail.Port},
+		{"tls.httpPort", cfg.TLS.HTTPPort},
+	}
+	for _, p := range ports {
+		if p.port < 0 || p.port > 65535 {
+			fail("%s: must be between 0 and 65535", p.key)
+		}
+	}
+	switch cfg.Antivirus.Action {
+	case "", "reject", "quarantine":
+	default:
+		fail("antivirus.action: must be reject or quarantine")
+	}
+	if cfg.BodyLimit.JSON < 0 || cfg.BodyLimit.Files < 0 {
+		fail("bodyLimit.json and bodyLimit.files: must not be negative")
+	}
+	if cfg.Gzip.Level < 0 || cfg.Gzip.Level > 9 {
+		fail("gzip.level: must be between 1 and 9, or 0 for the default level")
+	}
+	if _, err := logger.ParseLevel(cfg.Log.Level); err != nil {
+		fail("log.level: must be debug, info, warn or error")
+	}
+	switch cfg.Log.Format {
+	case "", logger.TextFormat, logger.JSONFormat:
+	default:
+		fail("log.format: must be text or json")
+	}
+	if cfg.Log.MaxSize < 0 || cfg.Log.MaxBackups < 0 {
+		fail("log.maxSize and log.maxBackups: must not be negative")
+	}
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		fail("tls.cert and tls.key: must be given together")
+	}
+	for _, u := range []struct{ key, url string }{
+		{"databaseUrl", cfg.Database.URL},
+		{"registry.url", cfg.Registry.URL},
+		{"rateLimit.redis", cfg.RateLimit.Redis},
+		{"jobs.redis", cfg.Jobs.Redis},
+	} {
+		if u.url == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u.url); err != nil || parsed.Scheme == "" {
+			fail("%s: must be a URL", u.key)
+		}
+	}
+	for _, proxy := range cfg.RateLimit.TrustedProxies {
+		if net.ParseIP(proxy) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil {
+			fail("rateLimit.trustedProxies: %s must be an IP address or a network, like 10.0.0.0/8", proxy)
+		}
+	}
+	if cfg.Fs.URL != "" && !strings.HasPrefix(cfg.Fs.URL, "/") {
+		if parsed, err := url.Parse(cfg.Fs.URL); err != nil || parsed.Scheme == "" {
+			fail("fs.url: must be a URL or an absolute path")
+		}
+	}
+	for _, name := range sortedContexts(cfg.Contexts) {
+		for _, app := range cfg.Contexts[name].DefaultApps {
+			if app.Slug == "" {
+				fail("contexts.%s.defaultApps: an application has no slug", name)
+			}
+		}
+	}
+	return errs
+}
+
+// Redacted returns a copy of the configuration without its secrets: the
+// passwords, and the credentials in the URLs. It can be printed.
+func (c *Config) Redacted() *Config {
+	cfg := *c
+	if cfg.Database.Password != "" {
+		cfg.Database.Password = redacted
+	}
+	if cfg.Mail.Password != "" {
+		cfg.Mail.Password = redacted
+	}
+	cfg.Database.URL = redactURL(cfg.Database.URL)
+	cfg.Fs.URL = redactURL(cfg.Fs.URL)
+	cfg.Registry.URL = redactURL(cfg.Registry.URL)
+	cfg.RateLimit.Redis = redactURL(cfg.RateLimit.Redis)
+	cfg.Jobs.Redis = redactURL(cfg.Jobs.Redis)
+	return &cfg
+}
+
+// redactURL replaces the password of a URL
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil {
+		return rawurl
+	}
+	if _, ok := u.User.Password(); !ok {
+		return rawurl
+	}
+	// url.URL.String would escape the stars of the redacted password, so
+	// it is added after the serialization of the URL without its user
+	user := url.User(u.User.Username()).String()
+	u.User = nil
+	prefix := u.Scheme + "://"
+	return prefix + user + ":" + redacted + "@" + strings.TrimPrefix(u.String(), prefix)
+}
+
+func sortedSettings(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedContexts(m map[string]Context) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,17 +1,44 @@
 package config
 
 import (
+	"sync/atomic"
+	"time"
+
 	"github.com/spf13/viper"
 )
 
-var config *Config
+// config holds the *Config in use. It is replaced as a whole by Reload,
+// while the requests are reading it, and never modified in place.
+var config atomic.Value
 
 // Config contains the configuration values of the application
 type Config struct {
-	Mode     Mode
-	Host     string
-	Port     int
-	Database Database
+	Mode      Mode
+	Host      string
+	Port      int
+	Database  Database
+	Fs        Fs
+	Antivirus Antivirus
+	Registry  Registry
+	Apps      Apps
+	RateLimit RateLimit
+	BodyLimit BodyLimit
+	Gzip      Gzip
+	Jobs      Jobs
+	Mail      Mail
+	Admin     Admin
+	Metrics   Metrics
+	TLS       TLS
+	I18n      I18n
+	Log       Log
+
+	// Contexts are the named profiles, like beta or premium, that the
+	// instances can reference
+	Contexts map[string]Context
+
+	// ShutdownTimeout is the maximal duration to wait for the requests and
+	// the jobs in progress when the stack is stopped
+	ShutdownTimeout time.Duration
 }
 
 // Mode is how is started the server, eg. production or development
@@ -26,26 +53,383 @@ const (
 
 // Database contains the configuration values of the database
 type Database struct {
+	// URL is the address of CouchDB. It can contain the credentials.
+	URL string
+	// User and Password are the credentials of CouchDB, if they are not
+	// in the URL
+	User     string
+	Password string
+	// CAFile is a PEM file with the authorities trusted for https
+	CAFile string
+	// InsecureSkipVerify disables the verification of the certificate
+	InsecureSkipVerify bool
+	// Retries is the number of times an idempotent request is retried
+	// after a transient failure of CouchDB
+	Retries int
+	// BreakerThreshold is the number of consecutive failures after which
+	// the requests to CouchDB are no longer sent for a while
+	BreakerThreshold int
+	// MaxIdleConns is the number of connections to CouchDB kept open
+	MaxIdleConns int
+	// IdleConnTimeout is how long an unused connection is kept open
+	IdleConnTimeout time.Duration
+	// DialTimeout is the maximum time to open a connection to CouchDB
+	DialTimeout time.Duration
+	// KeepAlive is the period of the TCP keep-alive probes
+	KeepAlive time.Duration
+	// Timeout is the maximum duration of a request to CouchDB, 0 for no
+	// limit
+	Timeout time.Duration
+}
+
+// Fs contains the configuration values of the storage of the files
+type Fs struct {
+	// URL is the root of the storages of the instances created without a
+	// storage URL, like file://localhost/var/lib/cozy/ or mem:// for the
+	// tests. Empty keeps the default, file://localhost/tmp/cozy2/.
+	URL string
+}
+
+// Antivirus contains the configuration values of the antivirus used to
+// scan the uploaded files
+type Antivirus struct {
+	// Clamd is the URL of the clamd socket, like
+	// unix:///var/run/clamav/clamd.ctl. Empty disables the scanning.
+	Clamd string
+	// Action is what to do with infected files: reject or quarantine
+	Action string
+	// FailOpen accepts the uploads, with an unscanned status, when clamd
+	// can't scan them. By default, they are rejected.
+	FailOpen bool
+}
+
+// Registry contains the configuration values of the registry of
+// applications
+type Registry struct {
+	// URL is the address of the registry HTTP API, used for the
+	// applications installed with a registry:// source
 	URL string
 }
 
-// GetConfig returns the configured instance of Config
+// Apps contains the configuration values used to verify the integrity of
+// the installed applications
+type Apps struct {
+	// TrustedKeys are the paths of the PEM files with the public keys
+	// accepted for the signatures of the application packages
+	TrustedKeys []string
+	// RequireSignature refuses the applications without a valid signature
+	RequireSignature bool
+}
+
+// RateLimit contains the configuration values of the rate limiter of the
+// requests. A zero value keeps the default of the ratelimit package.
+type RateLimit struct {
+	// Disabled turns off the rate limiter
+	Disabled bool
+	// Rate is the number of requests per second that a client can make to
+	// an instance in the long run, and Burst the number of requests that it
+	// can make at once
+	Rate  float64
+	Burst int
+	// AuthRate and AuthBurst are the stricter budget of the authentication
+	// routes
+	AuthRate  float64
+	AuthBurst int
+	// Redis is the URL of a Redis server, like redis://localhost:6379/0, to
+	// share the budgets between several stacks. Empty keeps them in memory.
+	Redis string
+	// TrustedProxies are the IP addresses or networks, like 10.0.0.0/8, of
+	// the reverse proxies in front of the stack. The client IP is only taken
+	// from the forwarded headers of the requests that they send.
+	TrustedProxies []string
+}
+
+// BodyLimit contains the maximal sizes in bytes of the bodies of the
+// requests. A zero value keeps the default of the middlewares package.
+type BodyLimit struct {
+	// JSON is the limit of the routes that read a JSON or form body, that
+	// is decoded in memory
+	JSON int64
+	// Files is the limit of the uploads of files and attachments, that are
+	// streamed. There is none by default, as the quota of the instance
+	// already applies.
+	Files int64
+}
+
+// Gzip contains the configuration values of the compression of the
+// responses
+type Gzip struct {
+	// Disabled turns off the compression, for example when it is done by
+	// the reverse proxy
+	Disabled bool
+	// Level is the level of compression, from 1 (fastest) to 9 (best), 0
+	// for the default level
+	Level int
+}
+
+// Jobs contains the configuration values of the jobs system
+type Jobs struct {
+	// Redis is the URL of a Redis server, like redis://localhost:6379/0, to
+	// share the queues between several stacks. Empty keeps them in memory.
+	Redis string
+}
+
+// Mail contains the configuration values of the SMTP server used to send
+// the emails. A zero value keeps the default, localhost:25.
+type Mail struct {
+	Host string
+	Port int
+	// Username and Password are the credentials for the SMTP server, if
+	// it requires an authentication
+	Username string
+	Password string
+	// DisableTLS sends the emails without STARTTLS
+	DisableTLS bool
+	// SkipCertificateValidation accepts any certificate from the server
+	SkipCertificateValidation bool
+}
+
+// Admin contains the configuration values of the admin server, that
+// listens on another port than the instances, for the operators
+type Admin struct {
+	// Host is the interface of the admin server, localhost by default
+	Host string
+	// Port is the port of the admin server. 0 disables it.
+	Port int
+}
+
+// Metrics contains the configuration values of the /metrics endpoint
+type Metrics struct {
+	// Public serves the metrics on the domains of the instances too. By
+	// default, they are only served on the admin server.
+	Public bool
+}
+
+// TLS contains the configuration values of HTTPS, when the stack serves it
+// directly without a reverse proxy
+type TLS struct {
+	// Cert and Key are the paths of the PEM files with the certificate and
+	// its private key
+	Cert string
+	Key  string
+	// ACME obtains and renews the certificates of the domains of the
+	// instances automatically with Let's Encrypt, instead of Cert and Key
+	ACME bool
+	// Email is the contact address of the Let's Encrypt account, for the
+	// notices about the expiration of the certificates
+	Email string
+	// CacheDir is the directory where the certificates obtained with ACME
+	// are kept between two starts of the stack
+	CacheDir string
+	// HTTPPort is the port of a plain HTTP server that redirects to HTTPS
+	// and answers the ACME challenges. 0 disables it.
+	HTTPPort int
+}
+
+// I18n contains the configuration values of the translations of the
+// strings shown by the stack
+type I18n struct {
+	// Dir is a directory of JSON catalogs, like fr.json, that add or
+	// replace translations of the stack
+	Dir string
+}
+
+// Log contains the configuration values of the logs of the stack
+type Log struct {
+	// Level is the minimal level of the logs: debug, info (the default),
+	// warn or error
+	Level string
+	// Format is text (the default) or json, for a JSON object by line
+	Format string
+	// Output is stderr (the default), stdout, syslog, or the path of a
+	// file
+	Output string
+	// MaxSize is the size in megabytes after which the file of the logs
+	// is rotated, 0 to never rotate it, and MaxBackups the number of
+	// rotated files kept
+	MaxSize    int
+	MaxBackups int
+}
+
+// Context contains the configuration values of a profile of instances
+type Context struct {
+	// DefaultApps are the applications installed automatically on the new
+	// instances of this context
+	DefaultApps []DefaultApp
+	// Quota is the maximal size in bytes of the files of an instance, 0
+	// for no limit
+	Quota int64
+	// Features are the names of the features allowed for the instances
+	// of this context
+	Features []string
+	// Branding are the values, like a logo URL or a color, used by the
+	// applications to customize their look
+	Branding map[string]string
+}
+
+// DefaultApp is an application installed automatically on the new
+// instances of a context
+type DefaultApp struct {
+	Slug string
+	// Source is the source of the application, like
+	// git://github.com/cozy/cozy-drive.git. Empty is for the registry.
+	Source string
+}
+
+// GetConfig returns the configured instance of Config. It must not be
+// modified.
 func GetConfig() *Config {
-	return config
+	cfg, _ := config.Load().(*Config)
+	return cfg
 }
 
 // UseViper sets the configured instance of Config
 func UseViper(viper *viper.Viper) {
-	config = &Config{
+	config.Store(fromViper(viper))
+}
+
+// fromViper reads the configuration values from viper
+func fromViper(viper *viper.Viper) *Config {
+	return &Config{
 		Mode: parseMode(viper.GetString("mode")),
 		Host: viper.GetString("host"),
 		Port: viper.GetInt("port"),
 		Database: Database{
-			URL: viper.GetString("databaseUrl"),
+			URL:                viper.GetString("databaseUrl"),
+			User:               viper.GetString("databaseUser"),
+			Password:           viper.GetString("databasePassword"),
+			CAFile:             viper.GetString("databaseCAFile"),
+			InsecureSkipVerify: viper.GetBool("databaseInsecureSkipVerify"),
+			Retries:            viper.GetInt("databaseRetries"),
+			BreakerThreshold:   viper.GetInt("databaseBreakerThreshold"),
+			MaxIdleConns:       viper.GetInt("databaseMaxIdleConns"),
+			IdleConnTimeout:    viper.GetDuration("databaseIdleConnTimeout"),
+			DialTimeout:        viper.GetDuration("databaseDialTimeout"),
+			KeepAlive:          viper.GetDuration("databaseKeepAlive"),
+			Timeout:            viper.GetDuration("databaseTimeout"),
+		},
+		Fs: Fs{
+			URL: viper.GetString("fs.url"),
+		},
+		Antivirus: Antivirus{
+			Clamd:    viper.GetString("antivirus.clamd"),
+			Action:   viper.GetString("antivirus.action"),
+			FailOpen: viper.GetBool("antivirus.failOpen"),
+		},
+		Registry: Registry{
+			URL: viper.GetString("registry.url"),
+		},
+		Apps: Apps{
+			TrustedKeys:      viper.GetStringSlice("apps.trustedKeys"),
+			RequireSignature: viper.GetBool("apps.requireSignature"),
+		},
+		RateLimit: RateLimit{
+			Disabled:       viper.GetBool("rateLimit.disabled"),
+			Rate:           viper.GetFloat64("rateLimit.rate"),
+			Burst:          viper.GetInt("rateLimit.burst"),
+			AuthRate:       viper.GetFloat64("rateLimit.authRate"),
+			AuthBurst:      viper.GetInt("rateLimit.authBurst"),
+			Redis:          viper.GetString("rateLimit.redis"),
+			TrustedProxies: viper.GetStringSlice("rateLimit.trustedProxies"),
+		},
+		BodyLimit: BodyLimit{
+			JSON:  int64(viper.GetInt("bodyLimit.json")),
+			Files: int64(viper.GetInt("bodyLimit.files")),
+		},
+		Gzip: Gzip{
+			Disabled: viper.GetBool("gzip.disabled"),
+			Level:    viper.GetInt("gzip.level"),
+		},
+		Jobs: Jobs{
+			Redis: viper.GetString("jobs.redis"),
 		},
+		Mail: Mail{
+			Host:                      viper.GetString("mail.host"),
+			Port:                      viper.GetInt("mail.port"),
+			Username:                  viper.GetString("mail.username"),
+			Password:                  viper.GetString("mail.password"),
+			DisableTLS:                viper.GetBool("mail.disableTLS"),
+			SkipCertificateValidation: viper.GetBool("mail.skipCertificateValidation"),
+		},
+		Admin: Admin{
+			Host: viper.GetString("admin.host"),
+			Port: viper.GetInt("admin.port"),
+		},
+		Metrics: Metrics{
+			Public: viper.GetBool("metrics.public"),
+		},
+		TLS: TLS{
+			Cert:     viper.GetString("tls.cert"),
+			Key:      viper.GetString("tls.key"),
+			ACME:     viper.GetBool("tls.acme"),
+			Email:    viper.GetString("tls.email"),
+			CacheDir: viper.GetString("tls.cacheDir"),
+			HTTPPort: viper.GetInt("tls.httpPort"),
+		},
+		I18n: I18n{
+			Dir: viper.GetString("i18n.dir"),
+		},
+		Log: Log{
+			Level:      viper.GetString("log.level"),
+			Format:     viper.GetString("log.format"),
+			Output:     viper.GetString("log.output"),
+			MaxSize:    viper.GetInt("log.maxSize"),
+			MaxBackups: viper.GetInt("log.maxBackups"),
+		},
+		Contexts:        parseContexts(viper),
+		ShutdownTimeout: viper.GetDuration("shutdownTimeout"),
 	}
 }
 
+func parseContexts(viper *viper.Viper) map[string]Context {
+	contexts := make(map[string]Context)
+	for name := range viper.GetStringMap("contexts") {
+		key := "contexts." + name
+		contexts[name] = Context{
+			DefaultApps: parseDefaultApps(viper.Get(key + ".defaultApps")),
+			Quota:       int64(viper.GetInt(key + ".quota")),
+			Features:    viper.GetStringSlice(key + ".features"),
+			Branding:    viper.GetStringMapString(key + ".branding"),
+		}
+	}
+	return contexts
+}
+
+// parseDefaultApps reads the default applications of a context. They can
+// be given by their slug only, or by a slug and a source:
+//
+//	defaultApps:
+//	  - drive
+//	  - slug: photos
+//	    source: git://github.com/cozy/cozy-photos.git
+func parseDefaultApps(value interface{}) []DefaultApp {
+	list, _ := value.([]interface{})
+	var apps []DefaultApp
+	for _, item := range list {
+		switch v := item.(type) {
+		case string:
+			apps = append(apps, DefaultApp{Slug: v})
+		case map[string]interface{}:
+			apps = append(apps, newDefaultApp(v["slug"], v["source"]))
+		case map[interface{}]interface{}:
+			apps = append(apps, newDefaultApp(v["slug"], v["source"]))
+		}
+	}
+	if slugs, ok := value.([]string); ok {
+		for _, slug := range slugs {
+			apps = append(apps, DefaultApp{Slug: slug})
+		}
+	}
+	return apps
+}
+
+func newDefaultApp(slug, source interface{}) DefaultApp {
+	app := DefaultApp{}
+	app.Slug, _ = slug.(string)
+	app.Source, _ = source.(string)
+	return app
+}
+
 func parseMode(mode string) Mode {
 	if mode == "production" {
 		return Production
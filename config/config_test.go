@@ -16,3 +16,148 @@ func TestUseViper(t *testing.T) {
 	assert.Equal(t, Production, GetConfig().Mode)
 	assert.Equal(t, "http://db:42", GetConfig().Database.URL)
 }
+
+func TestUseViperContexts(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("contexts", map[string]interface{}{
+		"beta": map[string]interface{}{
+			"defaultApps": []interface{}{
+				"files",
+				map[string]interface{}{"slug": "photos", "source": "git://github.com/cozy/cozy-photos.git"},
+			},
+			"quota":    1000000,
+			"features": []string{"sharings"},
+			"branding": map[string]interface{}{"color": "#297ef2"},
+		},
+	})
+
+	UseViper(cfg)
+
+	beta, ok := GetConfig().Contexts["beta"]
+	if assert.True(t, ok) {
+		assert.Equal(t, []DefaultApp{
+			{Slug: "files"},
+			{Slug: "photos", Source: "git://github.com/cozy/cozy-photos.git"},
+		}, beta.DefaultApps)
+		assert.Equal(t, int64(1000000), beta.Quota)
+		assert.Equal(t, []string{"sharings"}, beta.Features)
+		assert.Equal(t, "#297ef2", beta.Branding["color"])
+	}
+}
+
+func TestCheck(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("mode", "production")
+	cfg.Set("port", 8080)
+	cfg.Set("databaseUrl", "http://localhost:5984")
+	cfg.Set("gzip", map[string]interface{}{"level": 6})
+	cfg.Set("contexts", map[string]interface{}{
+		"beta": map[string]interface{}{"quota": 1000000},
+	})
+	assert.Empty(t, Check(cfg))
+
+	cfg.Set("databseUrl", "http://localhost:5984")
+	cfg.Set("port", "http")
+	cfg.Set("gzip", map[string]interface{}{"level": 6, "levle": 3})
+	cfg.Set("contexts", map[string]interface{}{
+		"beta": map[string]interface{}{"quota": 1000000, "feature": []string{"sharings"}},
+	})
+	var msgs []string
+	for _, err := range Check(cfg) {
+		msgs = append(msgs, err.Error())
+	}
+	assert.Equal(t, []string{
+		"contexts.beta.feature: unknown key, did you mean contexts.beta.features?",
+		"databseurl: unknown key, did you mean databaseUrl?",
+		"gzip.levle: unknown key, did you mean gzip.level?",
+		"port: must be an integer",
+	}, msgs)
+}
+
+func TestCheckValues(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("mode", "prod")
+	cfg.Set("tls.cert", "/etc/cozy/cert.pem")
+	cfg.Set("gzip.level", 12)
+	cfg.Set("bodyLimit.json", -1)
+	cfg.Set("rateLimit.trustedProxies", []string{"127.0.0.1", "10.0.0.0/8", "proxy"})
+	var msgs []string
+	for _, err := range Check(cfg) {
+		msgs = append(msgs, err.Error())
+	}
+	assert.Equal(t, []string{
+		"mode: must be production or development",
+		"bodyLimit.json and bodyLimit.files: must not be negative",
+		"gzip.level: must be between 1 and 9, or 0 for the default level",
+		"tls.cert and tls.key: must be given together",
+		"rateLimit.trustedProxies: proxy must be an IP address or a network, like 10.0.0.0/8",
+	}, msgs)
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := &Config{
+		Database: Database{URL: "http://admin:secret@db:5984/", Password: "secret"},
+		Mail:     Mail{Host: "smtp.example.org", Password: "secret"},
+		Jobs:     Jobs{Redis: "redis://localhost:6379/0"},
+	}
+	redactedCfg := cfg.Redacted()
+	assert.Equal(t, "http://admin:********@db:5984/", redactedCfg.Database.URL)
+	assert.Equal(t, "********", redactedCfg.Database.Password)
+	assert.Equal(t, "********", redactedCfg.Mail.Password)
+	assert.Equal(t, "smtp.example.org", redactedCfg.Mail.Host)
+	assert.Equal(t, "redis://localhost:6379/0", redactedCfg.Jobs.Redis)
+	assert.Equal(t, "secret", cfg.Database.Password)
+}
+
+func TestReload(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("port", 8080)
+	cfg.Set("databaseUrl", "http://localhost:5984")
+	cfg.Set("log", map[string]interface{}{"level": "info"})
+	cfg.Set("mail", map[string]interface{}{"host": "smtp.example.net"})
+	UseViper(cfg)
+
+	applied, restart := Reload(cfg)
+	assert.Empty(t, applied)
+	assert.Empty(t, restart)
+
+	cfg.Set("port", 8081)
+	cfg.Set("databaseUrl", "http://couchdb:5984")
+	cfg.Set("log", map[string]interface{}{"level": "debug"})
+	cfg.Set("mail", map[string]interface{}{"host": "smtp.example.net", "port": 587})
+	cfg.Set("bodyLimit.json", 1<<20)
+	applied, restart = Reload(cfg)
+	assert.Equal(t, []string{"bodyLimit.json", "mail.port", "log.level"}, applied)
+	assert.Equal(t, []string{"port", "databaseUrl"}, restart)
+
+	// the keys that need a restart keep their previous value
+	assert.Equal(t, 8080, GetConfig().Port)
+	assert.Equal(t, "http://localhost:5984", GetConfig().Database.URL)
+	assert.Equal(t, "debug", GetConfig().Log.Level)
+	assert.Equal(t, 587, GetConfig().Mail.Port)
+	assert.Equal(t, int64(1<<20), GetConfig().BodyLimit.JSON)
+}
+
+func TestReloadConcurrently(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("port", 8080)
+	cfg.Set("log", map[string]interface{}{"level": "info"})
+	UseViper(cfg)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			next := viper.New()
+			next.Set("port", 8080)
+			next.Set("log", map[string]interface{}{"level": "debug"})
+			Reload(next)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, 8080, GetConfig().Port)
+		assert.Contains(t, []string{"info", "debug"}, GetConfig().Log.Level)
+	}
+	<-done
+	assert.Equal(t, "debug", GetConfig().Log.Level)
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// RestartKeys are the configuration keys that are only read when the stack
+// starts. A change of their value in the configuration file is ignored by
+// Reload, and needs a restart of the stack to be applied. The other keys,
+// like the logs, the limits of the rate limiter and of the size of the
+// request bodies, the registry, the SMTP server and the contexts, are applied
+// on a reload.
+var RestartKeys = []string{
+	"mode",
+	"host",
+	"port",
+	"databaseUrl",
+	"databaseUser",
+	"databasePassword",
+	"databaseCAFile",
+	"databaseInsecureSkipVerify",
+	"databaseRetries",
+	"databaseBreakerThreshold",
+	"databaseMaxIdleConns",
+	"databaseIdleConnTimeout",
+	"databaseDialTimeout",
+	"databaseKeepAlive",
+	"databaseTimeout",
+	"fs.url",
+	"antivirus.clamd",
+	"antivirus.action",
+	"antivirus.failOpen",
+	"apps.trustedKeys",
+	"apps.requireSignature",
+	"rateLimit.disabled",
+	"rateLimit.redis",
+	"gzip.disabled",
+	"gzip.level",
+	"jobs.redis",
+	"admin.host",
+	"admin.port",
+	"metrics.public",
+	"tls.cert",
+	"tls.key",
+	"tls.acme",
+	"tls.email",
+	"tls.cacheDir",
+	"tls.httpPort",
+	"i18n.dir",
+}
+
+// reloadMu serializes the reloads, so that a reload compares the new values
+// to the ones of the previous reload
+var reloadMu sync.Mutex
+
+// Reload reads the configuration values from viper again, after the
+// configuration file has been read another time. It returns the keys whose
+// value has changed, split between the ones that can be applied at once and
+// the ones listed in RestartKeys. The latter keep their previous value until
+// the stack is restarted. The new configuration replaces the previous one
+// atomically: GetConfig returns either of them, never a mix.
+func Reload(viper *viper.Viper) (applied, restart []string) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	next := fromViper(viper)
+	current := GetConfig()
+	if current == nil {
+		config.Store(next)
+		return nil, nil
+	}
+
+	previous := configFields(reflect.ValueOf(current).Elem(), "")
+	for i, field := range configFields(reflect.ValueOf(next).Elem(), "") {
+		old := previous[i].value
+		if reflect.DeepEqual(old.Interface(), field.value.Interface()) {
+			continue
+		}
+		if isRestartKey(field.key) {
+			field.value.Set(old)
+			restart = append(restart, field.key)
+		} else {
+			applied = append(applied, field.key)
+		}
+	}
+	config.Store(next)
+	return applied, restart
+}
+
+// configField is a configuration value, with the name of its key
+type configField struct {
+	key   string
+	value reflect.Value
+}
+
+// configFields returns the values of a configuration, with one level of
+// sections: the fields of Database are the databaseXxx keys, the fields of
+// Mail are the mail.xxx keys, etc.
+func configFields(v reflect.Value, prefix string) []configField {
+	var fields []configField
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		value := v.Field(i)
+		if prefix == "" && value.Kind() == reflect.Struct {
+			section := lowerFirst(name) + "."
+			if !isPrefix(knownKeys, section) {
+				// the keys of the database are not in a section, like
+				// databaseUrl
+				section = lowerFirst(name)
+			}
+			fields = append(fields, configFields(value, section)...)
+			continue
+		}
+		fields = append(fields, configField{key: keyName(prefix, name), value: value})
+	}
+	return fields
+}
+
+// keyName returns the key of a field in the configuration file, like
+// mail.disableTLS for the DisableTLS field of the mail section
+func keyName(prefix, name string) string {
+	key := lowerFirst(name)
+	if prefix != "" {
+		key = prefix + name
+	}
+	if known, _, ok := findKey(knownKeys, key); ok {
+		return known
+	}
+	return key
+}
+
+func isRestartKey(key string) bool {
+	for _, k := range RestartKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
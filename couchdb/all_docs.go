@@ -0,0 +1,218 @@
+package couchdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ForeachDocsPageSize is the number of documents fetched by each request
+// of ForeachDocs
+const ForeachDocsPageSize = 1000
+
+// errUnexpectedJSON is returned when the response of _all_docs can't be
+// decoded as a stream
+var errUnexpectedJSON = errors.New("Unexpected JSON in the response of CouchDB")
+
+type allDocsRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type allDocsResponse struct {
+	TotalRows int          `json:"total_rows"`
+	Rows      []allDocsRow `json:"rows"`
+}
+
+type allDocsRow struct {
+	ID    string          `json:"id"`
+	Key   string          `json:"key"`
+	Error string          `json:"error"`
+	Doc   json.RawMessage `json:"doc"`
+}
+
+// GetDocs fetches several documents of the same doctype by their IDs, in
+// a single request. The results slice is filled with the documents in the
+// order of the IDs, by json.Unmarshal-ing. The documents that do not exist
+// or have been deleted are skipped.
+func GetDocs(ctx context.Context, dbprefix, doctype string, ids []string, results interface{}) error {
+	var docs []json.RawMessage
+	if len(ids) > 0 {
+		url := makeDBName(dbprefix, doctype) + "/_all_docs?include_docs=true"
+		var res allDocsResponse
+		err := makeRequest(ctx, "POST", url, &allDocsRequest{Keys: ids}, &res)
+		fixErrorNoDatabaseIsWrongDoctype(err)
+		if err != nil {
+			return err
+		}
+		for _, row := range res.Rows {
+			// a deleted document has a row with a null doc
+			if row.Error != "" || len(row.Doc) == 0 || bytes.Equal(row.Doc, []byte("null")) {
+				continue
+			}
+			docs = append(docs, row.Doc)
+		}
+	}
+	if docs == nil {
+		docs = []json.RawMessage{}
+	}
+	raw, err := json.Marshal(docs)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, results)
+}
+
+// AllDocsRequest are the parameters of a request for the documents of a
+// database, in the order of their IDs
+type AllDocsRequest struct {
+	// Limit is the maximal number of documents, 0 for no limit
+	Limit int
+	// StartKey is the ID of the first document, empty to start with the
+	// first document of the database
+	StartKey string
+	// IncludeDocs adds the documents to the rows, else only their IDs and
+	// revisions are returned
+	IncludeDocs bool
+}
+
+// AllDocsRow is a row of the response to an AllDocsRequest, for a document
+type AllDocsRow struct {
+	ID    string `json:"id"`
+	Key   string `json:"key"`
+	Value struct {
+		Rev string `json:"rev"`
+	} `json:"value"`
+	Doc json.RawMessage `json:"doc,omitempty"`
+}
+
+// AllDocsResponse is the response to an AllDocsRequest
+type AllDocsResponse struct {
+	TotalRows int          `json:"total_rows"`
+	Offset    int          `json:"offset"`
+	Rows      []AllDocsRow `json:"rows"`
+}
+
+// GetAllDocs returns the documents of the database of a doctype, in the
+// order of their IDs, from the StartKey of the request
+func GetAllDocs(ctx context.Context, dbprefix, doctype string, req *AllDocsRequest) (*AllDocsResponse, error) {
+	qs := url.Values{}
+	if req.Limit > 0 {
+		qs.Set("limit", strconv.Itoa(req.Limit))
+	}
+	if req.StartKey != "" {
+		startkey, err := json.Marshal(req.StartKey)
+		if err != nil {
+			return nil, err
+		}
+		qs.Set("startkey", string(startkey))
+	}
+	if req.IncludeDocs {
+		qs.Set("include_docs", "true")
+	}
+	var res AllDocsResponse
+	path := makeDBName(dbprefix, doctype) + "/_all_docs?" + qs.Encode()
+	err := makeRequest(ctx, "GET", path, nil, &res)
+	fixErrorNoDatabaseIsWrongDoctype(err)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ForeachDocs calls fn for each document of the doctype database, with the
+// raw JSON of the document, in the order of their IDs. The documents are
+// fetched by pages, and each page is decoded while it is read, so that
+// databases with millions of documents can be traversed without keeping
+// them in memory. The design documents are skipped. If fn returns an
+// error, the iteration stops and this error is returned.
+func ForeachDocs(ctx context.Context, dbprefix, doctype string, fn func(doc json.RawMessage) error) error {
+	stream := &allDocsStream{fn: fn}
+	for {
+		qs := url.Values{
+			"include_docs": {"true"},
+			"limit":        {strconv.Itoa(ForeachDocsPageSize)},
+		}
+		if stream.lastID != "" {
+			startkey, err := json.Marshal(stream.lastID)
+			if err != nil {
+				return err
+			}
+			qs.Set("startkey", string(startkey))
+			qs.Set("skip", "1")
+		}
+		url := makeDBName(dbprefix, doctype) + "/_all_docs?" + qs.Encode()
+		stream.rows = 0
+		if err := makeRequest(ctx, "GET", url, nil, stream); err != nil {
+			return err
+		}
+		if stream.rows < ForeachDocsPageSize {
+			return nil
+		}
+	}
+}
+
+// allDocsStream decodes the rows of a response of _all_docs one by one,
+// and gives their documents to a callback
+type allDocsStream struct {
+	fn     func(doc json.RawMessage) error
+	lastID string
+	rows   int
+}
+
+// decodeStream implements the streamDecoder interface of sendRequest
+func (s *allDocsStream) decodeStream(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if key, _ := tok.(string); key != "rows" {
+			var skipped json.RawMessage
+			if err = dec.Decode(&skipped); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = expectDelim(dec, '['); err != nil {
+			return err
+		}
+		for dec.More() {
+			var row allDocsRow
+			if err = dec.Decode(&row); err != nil {
+				return err
+			}
+			s.rows++
+			s.lastID = row.ID
+			if strings.HasPrefix(row.ID, "_design/") || len(row.Doc) == 0 {
+				continue
+			}
+			if err = s.fn(row.Doc); err != nil {
+				return err
+			}
+		}
+		if err = expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return errUnexpectedJSON
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllDocsStream(t *testing.T) {
+	body := `{"total_rows":3,"offset":0,"rows":[
+		{"id":"_design/foo","key":"_design/foo","value":{},"doc":{"_id":"_design/foo"}},
+		{"id":"a","key":"a","value":{},"doc":{"_id":"a","test":"A"}},
+		{"id":"b","key":"b","value":{},"doc":{"_id":"b","test":"B"}}
+	]}`
+	var tests []string
+	stream := &allDocsStream{fn: func(doc json.RawMessage) error {
+		var d testDoc
+		if err := json.Unmarshal(doc, &d); err != nil {
+			return err
+		}
+		tests = append(tests, d.Test)
+		return nil
+	}}
+	err := stream.decodeStream(strings.NewReader(body))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"A", "B"}, tests)
+	assert.Equal(t, 3, stream.rows)
+	assert.Equal(t, "b", stream.lastID)
+
+	err = (&allDocsStream{}).decodeStream(strings.NewReader(`["foo"]`))
+	assert.Equal(t, errUnexpectedJSON, err)
+}
+
+func TestForeachDocs(t *testing.T) {
+	doctype := "io.cozy.foreach"
+	ResetDB(context.Background(), TestPrefix, doctype)
+	defer DeleteDB(context.Background(), TestPrefix, doctype)
+
+	n := ForeachDocsPageSize + 10
+	docs := make([]Doc, n)
+	for i := range docs {
+		docs[i] = &JSONDoc{Type: doctype, M: map[string]interface{}{"n": i}}
+	}
+	err := BulkDocs(context.Background(), TestPrefix, doctype, docs)
+	assert.NoError(t, err)
+
+	seen := make(map[string]bool)
+	err = ForeachDocs(context.Background(), TestPrefix, doctype, func(doc json.RawMessage) error {
+		var d JSONDoc
+		if err := json.Unmarshal(doc, &d); err != nil {
+			return err
+		}
+		seen[d.ID()] = true
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, seen, n)
+
+	stop := errors.New("stop")
+	calls := 0
+	err = ForeachDocs(context.Background(), TestPrefix, doctype, func(doc json.RawMessage) error {
+		calls++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestGetAllDocs(t *testing.T) {
+	doctype := "io.cozy.alldocs"
+	ResetDB(context.Background(), TestPrefix, doctype)
+	defer DeleteDB(context.Background(), TestPrefix, doctype)
+
+	for _, id := range []string{"a", "b", "c"} {
+		doc := &JSONDoc{Type: doctype, M: map[string]interface{}{"_id": id}}
+		assert.NoError(t, CreateNamedDoc(context.Background(), TestPrefix, doc))
+	}
+
+	res, err := GetAllDocs(context.Background(), TestPrefix, doctype, &AllDocsRequest{
+		Limit:       2,
+		StartKey:    "b",
+		IncludeDocs: true,
+	})
+	if assert.NoError(t, err) && assert.Len(t, res.Rows, 2) {
+		assert.Equal(t, 3, res.TotalRows)
+		assert.Equal(t, "b", res.Rows[0].ID)
+		assert.NotEmpty(t, res.Rows[0].Value.Rev)
+		assert.NotEmpty(t, res.Rows[0].Doc)
+		assert.Equal(t, "c", res.Rows[1].ID)
+	}
+
+	res, err = GetAllDocs(context.Background(), TestPrefix, doctype, &AllDocsRequest{})
+	if assert.NoError(t, err) && assert.Len(t, res.Rows, 3) {
+		assert.Empty(t, res.Rows[0].Doc)
+	}
+}
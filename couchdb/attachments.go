@@ -0,0 +1,142 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dcasier/cozy-stack/logger"
+)
+
+// Attachment is the content of an attachment of a document, read from
+// CouchDB while it is sent to the client. Its Body must be closed.
+type Attachment struct {
+	ContentType string
+	Length      int64
+	// Digest is the ETag given by CouchDB for the content, like
+	// "md5-yDbs1scfYdqqLpxyFb1gFw=="
+	Digest string
+	Body   io.ReadCloser
+}
+
+func attachmentURL(dbprefix, doctype, id, name string) string {
+	// the spaces are escaped as + by QueryEscape, which is a plus sign
+	// in the path of the URL
+	escaped := strings.Replace(url.QueryEscape(name), "+", "%20", -1)
+	return docURL(dbprefix, doctype, id) + "/" + escaped
+}
+
+// sendRawRequest sends a request whose body is a stream, or whose response
+// is read as a stream, like the content of the attachments. It is not
+// retried, as the body can't be read twice, but it goes through the
+// circuit breaker. The body of the response must be closed.
+func sendRawRequest(ctx context.Context, method, path string, header http.Header, body io.Reader) (*http.Response, error) {
+	policy := retryPolicy
+	if !breaker.allow(policy) {
+		return nil, newUnavailableError(ErrCircuitOpen)
+	}
+	logger.Debugf("couchdb", "%v %v", method, path)
+
+	start := time.Now()
+	resp, err := doRawRequest(ctx, method, path, header, body)
+	observeRequest(requestLabels(method, path), start, err)
+	if isTransient(err) {
+		breaker.failure(policy)
+	} else {
+		breaker.success()
+	}
+	return resp, err
+}
+
+func doRawRequest(ctx context.Context, method, path string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, CouchURL()+path, body)
+	if err != nil {
+		return nil, newRequestError(err)
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	setCredentials(req)
+	resp, err := couchdbClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, newConnectionError(err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			err = newIOReadError(err)
+		} else {
+			err = newCouchdbError(resp.StatusCode, b)
+		}
+		logError(err)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// PutAttachment adds an attachment to a document, or replaces it, with the
+// content read from body. The revision is the current one of the document,
+// or empty to create a new document with only this attachment. The
+// database of the doctype must exist. It returns the new revision of the
+// document.
+func PutAttachment(ctx context.Context, dbprefix, doctype, id, rev, name, contentType string, body io.Reader) (string, error) {
+	path := attachmentURL(dbprefix, doctype, id, name)
+	if rev != "" {
+		path += "?rev=" + url.QueryEscape(rev)
+	}
+	header := http.Header{
+		"Content-Type": {contentType},
+		"Accept":       {"application/json"},
+	}
+	resp, err := sendRawRequest(ctx, "PUT", path, header, body)
+	fixErrorNoDatabaseIsWrongDoctype(err)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var res updateResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	return res.Rev, nil
+}
+
+// GetAttachment returns an attachment of a document. Its content is read
+// from the Body of the attachment, that must be closed.
+func GetAttachment(ctx context.Context, dbprefix, doctype, id, name string) (*Attachment, error) {
+	path := attachmentURL(dbprefix, doctype, id, name)
+	resp, err := sendRawRequest(ctx, "GET", path, nil, nil)
+	fixErrorNoDatabaseIsWrongDoctype(err)
+	if err != nil {
+		return nil, err
+	}
+	return &Attachment{
+		ContentType: resp.Header.Get("Content-Type"),
+		Length:      resp.ContentLength,
+		Digest:      resp.Header.Get("Etag"),
+		Body:        resp.Body,
+	}, nil
+}
+
+// DeleteAttachment removes an attachment from a document, with the current
+// revision of the document. It returns the new revision of the document.
+func DeleteAttachment(ctx context.Context, dbprefix, doctype, id, rev, name string) (string, error) {
+	path := attachmentURL(dbprefix, doctype, id, name) + "?rev=" + url.QueryEscape(rev)
+	var res updateResponse
+	err := makeRequest(ctx, "DELETE", path, nil, &res)
+	fixErrorNoDatabaseIsWrongDoctype(err)
+	if err != nil {
+		return "", err
+	}
+	return res.Rev, nil
+}
@@ -0,0 +1,51 @@
+package couchdb
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttachmentURL(t *testing.T) {
+	assert.Equal(t, "dev%2Fio-cozy-events/foo/my%20avatar.png",
+		attachmentURL("dev/", "io.cozy.events", "foo", "my avatar.png"))
+}
+
+func TestAttachments(t *testing.T) {
+	ctx := context.Background()
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"test": "attachments"}}
+	if !assert.NoError(t, CreateDoc(ctx, TestPrefix, doc)) {
+		return
+	}
+
+	rev, err := PutAttachment(ctx, TestPrefix, TestDoctype, doc.ID(), doc.Rev(),
+		"icon.svg", "image/svg+xml", strings.NewReader("<svg></svg>"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, doc.Rev(), rev)
+
+	// the previous revision of the document is no longer the current one
+	_, err = PutAttachment(ctx, TestPrefix, TestDoctype, doc.ID(), doc.Rev(),
+		"icon.svg", "image/svg+xml", strings.NewReader("<svg/>"))
+	assert.True(t, IsConflictError(err))
+
+	att, err := GetAttachment(ctx, TestPrefix, TestDoctype, doc.ID(), "icon.svg")
+	if assert.NoError(t, err) {
+		defer att.Body.Close()
+		assert.Equal(t, "image/svg+xml", att.ContentType)
+		assert.NotEmpty(t, att.Digest)
+		content, err := ioutil.ReadAll(att.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "<svg></svg>", string(content))
+	}
+
+	rev, err = DeleteAttachment(ctx, TestPrefix, TestDoctype, doc.ID(), rev, "icon.svg")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, rev)
+	_, err = GetAttachment(ctx, TestPrefix, TestDoctype, doc.ID(), "icon.svg")
+	assert.True(t, IsNotFoundError(err))
+}
@@ -0,0 +1,130 @@
+package couchdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// BulkResult is the result of the creation, update or deletion of one
+// document by BulkDocs
+type BulkResult struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Ok returns true if the document has been successfully written
+func (r BulkResult) Ok() bool {
+	return r.Error == ""
+}
+
+// BulkError is returned by BulkDocs when some of the documents have not
+// been written. The other documents of the request have been written.
+type BulkError struct {
+	Failures []BulkResult
+}
+
+func (e *BulkError) Error() string {
+	msgs := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		msgs[i] = fmt.Sprintf("%s: %s (%s)", f.ID, f.Error, f.Reason)
+	}
+	return "CouchDB bulk error: " + strings.Join(msgs, ", ")
+}
+
+// Tombstone is a document that can be given to BulkDocs to delete the
+// document with the same identifier and revision
+type Tombstone struct {
+	TID     string `json:"_id"`
+	TRev    string `json:"_rev"`
+	Deleted bool   `json:"_deleted"`
+	Type    string `json:"-"`
+}
+
+// NewTombstone returns the tombstone that deletes the given document
+func NewTombstone(doc Doc) *Tombstone {
+	return &Tombstone{
+		TID:     doc.ID(),
+		TRev:    doc.Rev(),
+		Deleted: true,
+		Type:    doc.DocType(),
+	}
+}
+
+// ID returns the identifier of the deleted document
+func (t *Tombstone) ID() string { return t.TID }
+
+// Rev returns the revision of the deleted document
+func (t *Tombstone) Rev() string { return t.TRev }
+
+// DocType returns the document type of the deleted document
+func (t *Tombstone) DocType() string { return t.Type }
+
+// SetID changes the identifier of the deleted document
+func (t *Tombstone) SetID(id string) { t.TID = id }
+
+// SetRev changes the revision of the deleted document
+func (t *Tombstone) SetRev(rev string) { t.TRev = rev }
+
+type bulkDocsRequest struct {
+	Docs []Doc `json:"docs"`
+}
+
+// BulkDocs creates, updates or deletes (with a Tombstone) several
+// documents of the same doctype in a single request. The documents
+// without an ID will be created. The SetID and SetRev functions of the
+// documents that have been written are called with their new ID and Rev.
+// If some documents can not be written, a *BulkError listing them is
+// returned.
+// This function creates the database if it does not exist.
+func BulkDocs(ctx context.Context, dbprefix, doctype string, docs []Doc) error {
+	res, err := BulkDocsResults(ctx, dbprefix, doctype, docs)
+	if err != nil {
+		return err
+	}
+	var failures []BulkResult
+	for _, r := range res {
+		if !r.Ok() {
+			failures = append(failures, r)
+		}
+	}
+	if len(failures) > 0 {
+		return &BulkError{Failures: failures}
+	}
+	return nil
+}
+
+// BulkDocsResults is like BulkDocs, but it returns the result of each
+// document, in the same order as the documents, instead of an error for the
+// documents that have not been written.
+func BulkDocsResults(ctx context.Context, dbprefix, doctype string, docs []Doc) ([]BulkResult, error) {
+	if len(docs) == 0 {
+		return nil, nil
+	}
+
+	db := makeDBName(dbprefix, doctype)
+	req := &bulkDocsRequest{Docs: docs}
+	var res []BulkResult
+	err := makeRequest(ctx, "POST", db+"/_bulk_docs", req, &res)
+	if IsNoDatabaseError(err) {
+		if err = CreateDB(ctx, dbprefix, doctype); err == nil {
+			err = makeRequest(ctx, "POST", db+"/_bulk_docs", req, &res)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res) != len(docs) {
+		return nil, fmt.Errorf("CouchDB replied with %d results for %d docs", len(res), len(docs))
+	}
+
+	for i, r := range res {
+		if r.Ok() {
+			docs[i].SetID(r.ID)
+			docs[i].SetRev(r.Rev)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,109 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The kinds of feeds of the changes of a database
+const (
+	// NormalFeed returns the changes since the given sequence
+	NormalFeed = "normal"
+	// LongPollFeed waits for a change if there are none since the given
+	// sequence
+	LongPollFeed = "longpoll"
+)
+
+// Seq is a sequence of the changes of a database. It is an opaque string
+// for CouchDB 2, and a number for CouchDB 1.
+type Seq string
+
+// UnmarshalJSON reads a sequence from a string or a number
+func (s *Seq) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*s = Seq(str)
+		return nil
+	}
+	var num json.Number
+	if err := json.Unmarshal(data, &num); err != nil {
+		return err
+	}
+	*s = Seq(num.String())
+	return nil
+}
+
+// ChangesRequest are the parameters of a request for the changes of a
+// database
+type ChangesRequest struct {
+	// Feed is NormalFeed (the default) or LongPollFeed
+	Feed string
+	// Since is the sequence after which the changes are returned, "now"
+	// for the changes after the request, or empty for all the changes
+	Since Seq
+	// Limit is the maximal number of changes, 0 for no limit
+	Limit int
+	// IncludeDocs adds the documents to the changes
+	IncludeDocs bool
+	// Timeout is the maximal duration of a longpoll request without change
+	Timeout time.Duration
+}
+
+// Change is the last change of a document
+type Change struct {
+	Seq     Seq    `json:"seq"`
+	DocID   string `json:"id"`
+	Deleted bool   `json:"deleted,omitempty"`
+	Changes []struct {
+		Rev string `json:"rev"`
+	} `json:"changes"`
+	Doc json.RawMessage `json:"doc,omitempty"`
+}
+
+// Rev returns the revision of the document after the change
+func (c *Change) Rev() string {
+	if len(c.Changes) == 0 {
+		return ""
+	}
+	return c.Changes[0].Rev
+}
+
+// ChangesResponse is the response of a request for the changes of a
+// database
+type ChangesResponse struct {
+	LastSeq Seq      `json:"last_seq"`
+	Pending int      `json:"pending"`
+	Results []Change `json:"results"`
+}
+
+// GetChanges returns the changes of the database of a doctype. With a
+// longpoll feed, the request waits until there is a change, or until its
+// timeout.
+func GetChanges(ctx context.Context, dbprefix, doctype string, req *ChangesRequest) (*ChangesResponse, error) {
+	qs := url.Values{}
+	if req.Feed != "" {
+		qs.Set("feed", req.Feed)
+	}
+	if req.Since != "" {
+		qs.Set("since", string(req.Since))
+	}
+	if req.Limit > 0 {
+		qs.Set("limit", strconv.Itoa(req.Limit))
+	}
+	if req.IncludeDocs {
+		qs.Set("include_docs", "true")
+	}
+	if req.Timeout > 0 {
+		qs.Set("timeout", strconv.FormatInt(int64(req.Timeout/time.Millisecond), 10))
+	}
+
+	var res ChangesResponse
+	path := makeDBName(dbprefix, doctype) + "/_changes?" + qs.Encode()
+	if err := makeRequest(ctx, "GET", path, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
@@ -0,0 +1,50 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeqUnmarshal(t *testing.T) {
+	var res ChangesResponse
+	err := json.Unmarshal([]byte(`{"last_seq": 42, "results": [{"seq": "12-abc", "id": "foo"}]}`), &res)
+	assert.NoError(t, err)
+	assert.Equal(t, Seq("42"), res.LastSeq)
+	assert.Equal(t, Seq("12-abc"), res.Results[0].Seq)
+}
+
+func TestGetChanges(t *testing.T) {
+	ctx := context.Background()
+	res, err := GetChanges(ctx, TestPrefix, TestDoctype, &ChangesRequest{})
+	assert.NoError(t, err)
+	since := res.LastSeq
+
+	doc := &testDoc{Test: "changes"}
+	assert.NoError(t, CreateDoc(ctx, TestPrefix, doc))
+	res, err = GetChanges(ctx, TestPrefix, TestDoctype, &ChangesRequest{
+		Since:       since,
+		IncludeDocs: true,
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, res.Results, 1) {
+		change := res.Results[0]
+		assert.Equal(t, doc.ID(), change.DocID)
+		assert.Equal(t, doc.Rev(), change.Rev())
+		assert.False(t, change.Deleted)
+		assert.Contains(t, string(change.Doc), `"changes"`)
+	}
+
+	assert.NoError(t, DeleteDoc(ctx, TestPrefix, doc))
+	res, err = GetChanges(ctx, TestPrefix, TestDoctype, &ChangesRequest{
+		Feed:  LongPollFeed,
+		Since: res.LastSeq,
+		Limit: 1,
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, res.Results, 1) {
+		assert.True(t, res.Results[0].Deleted)
+	}
+}
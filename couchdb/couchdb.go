@@ -2,14 +2,18 @@ package couchdb
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/dcasier/cozy-stack/couchdb/mango"
+	"github.com/dcasier/cozy-stack/logger"
 )
 
 // Doc is the interface that encapsulate a couchdb document, of any
@@ -98,13 +102,6 @@ func (j JSONDoc) Get(key string) interface{} {
 	return j.M[key]
 }
 
-// CouchURL is the URL where to check if CouchDB is up
-func CouchURL() string {
-	return "http://localhost:5984/"
-}
-
-var couchdbClient = &http.Client{}
-
 func makeDBName(dbprefix, doctype string) string {
 	// @TODO This should be better analysed
 	dbname := dbprefix + doctype
@@ -117,10 +114,21 @@ func docURL(dbprefix, doctype, id string) string {
 	return makeDBName(dbprefix, doctype) + "/" + url.QueryEscape(id)
 }
 
-func makeRequest(method, path string, reqbody interface{}, resbody interface{}) error {
+// streamDecoder can be given as the resbody of makeRequest to read the
+// body of the response while it is received, instead of decoding it all
+// at once
+type streamDecoder interface {
+	decodeStream(r io.Reader) error
+}
+
+func makeRequest(ctx context.Context, method, path string, reqbody interface{}, resbody interface{}) error {
 	var reqjson []byte
 	var err error
 
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
 	if reqbody != nil {
 		reqjson, err = json.Marshal(reqbody)
 		if err != nil {
@@ -128,20 +136,46 @@ func makeRequest(method, path string, reqbody interface{}, resbody interface{})
 		}
 	}
 
-	fmt.Printf("[couchdb request] %v %v %v\n", method, path, string(reqjson))
+	logger.Debugf("couchdb", "%v %v %v", method, path, string(reqjson))
 
+	start := time.Now()
+	err = doWithRetry(ctx, method, path, func() error {
+		return sendRequest(ctx, method, path, reqjson, reqbody != nil, resbody)
+	})
+	observeRequest(requestLabels(method, path), start, err)
+	return err
+}
+
+// logError writes the errors of CouchDB in the logs. The client errors, like
+// a missing document or a conflict, are often expected and are only written
+// at the debug level.
+func logError(err error) {
+	if couchErr, ok := err.(*Error); ok && couchErr.StatusCode < 500 {
+		logger.Debugf("couchdb", "%v", err)
+		return
+	}
+	logger.Errorf("couchdb", "%v", err)
+}
+
+func sendRequest(ctx context.Context, method, path string, reqjson []byte, hasBody bool, resbody interface{}) error {
 	req, err := http.NewRequest(method, CouchURL()+path, bytes.NewReader(reqjson))
 	// Possible err = wrong method, unparsable url
 	if err != nil {
 		return newRequestError(err)
 	}
-	if reqbody != nil {
+	req = req.WithContext(ctx)
+	setCredentials(req)
+	if hasBody {
 		req.Header.Add("Content-Type", "application/json")
 	}
 	req.Header.Add("Accept", "application/json")
 	resp, err := couchdbClient.Do(req)
-	// Possible err = mostly connection failure
+	// Possible err = mostly connection failure, or the context has been
+	// canceled
 	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return newConnectionError(err)
 	}
 	defer resp.Body.Close()
@@ -154,10 +188,13 @@ func makeRequest(method, path string, reqbody interface{}, resbody interface{})
 		} else {
 			err = newCouchdbError(resp.StatusCode, body)
 		}
-		fmt.Printf("[couchdb error] %v\n", err.Error())
+		logError(err)
 		return err
 	}
 
+	if stream, ok := resbody.(streamDecoder); ok {
+		return stream.decodeStream(resp.Body)
+	}
 	if resbody != nil {
 		err = json.NewDecoder(resp.Body).Decode(&resbody)
 	}
@@ -165,48 +202,52 @@ func makeRequest(method, path string, reqbody interface{}, resbody interface{})
 	return err
 }
 
+// wrongDoctypeReason replaces the reason of the no_db_file errors on the
+// requests for a single document
+const wrongDoctypeReason = "wrong_doctype"
+
 func fixErrorNoDatabaseIsWrongDoctype(err error) {
 	if IsNoDatabaseError(err) {
-		err.(*Error).Reason = "wrong_doctype"
+		err.(*Error).Reason = wrongDoctypeReason
 	}
 }
 
 // GetDoc fetch a document by its docType and ID, out is filled with
 // the document by json.Unmarshal-ing
-func GetDoc(dbprefix, doctype, id string, out Doc) error {
-	err := makeRequest("GET", docURL(dbprefix, doctype, id), nil, out)
+func GetDoc(ctx context.Context, dbprefix, doctype, id string, out Doc) error {
+	err := makeRequest(ctx, "GET", docURL(dbprefix, doctype, id), nil, out)
 	fixErrorNoDatabaseIsWrongDoctype(err)
 	return err
 }
 
 // CreateDB creates the necessary database for a doctype
-func CreateDB(dbprefix, doctype string) error {
-	return makeRequest("PUT", makeDBName(dbprefix, doctype), nil, nil)
+func CreateDB(ctx context.Context, dbprefix, doctype string) error {
+	return makeRequest(ctx, "PUT", makeDBName(dbprefix, doctype), nil, nil)
 }
 
 // DeleteDB destroy the database for a doctype
-func DeleteDB(dbprefix, doctype string) error {
-	return makeRequest("DELETE", makeDBName(dbprefix, doctype), nil, nil)
+func DeleteDB(ctx context.Context, dbprefix, doctype string) error {
+	return makeRequest(ctx, "DELETE", makeDBName(dbprefix, doctype), nil, nil)
 }
 
 // ResetDB destroy and recreate the database for a doctype
-func ResetDB(dbprefix, doctype string) (err error) {
-	err = DeleteDB(dbprefix, doctype)
+func ResetDB(ctx context.Context, dbprefix, doctype string) (err error) {
+	err = DeleteDB(ctx, dbprefix, doctype)
 	if err != nil && !IsNoDatabaseError(err) {
 		return err
 	}
-	return CreateDB(dbprefix, doctype)
+	return CreateDB(ctx, dbprefix, doctype)
 }
 
 // Delete destroy a document by its doctype and ID .
 // If the document's current rev does not match the one passed,
 // a CouchdbError(409 conflict) will be returned.
 // This functions returns the tombstone revision as string
-func Delete(dbprefix, doctype, id, rev string) (tombrev string, err error) {
+func Delete(ctx context.Context, dbprefix, doctype, id, rev string) (tombrev string, err error) {
 	var res updateResponse
 	qs := url.Values{"rev": []string{rev}}
 	url := docURL(dbprefix, doctype, id) + "?" + qs.Encode()
-	err = makeRequest("DELETE", url, nil, &res)
+	err = makeRequest(ctx, "DELETE", url, nil, &res)
 	fixErrorNoDatabaseIsWrongDoctype(err)
 	if err == nil {
 		tombrev = res.Rev
@@ -216,11 +257,11 @@ func Delete(dbprefix, doctype, id, rev string) (tombrev string, err error) {
 
 // DeleteDoc deletes a struct implementing the couchb.Doc interface
 // The document's SetRev will be called with tombstone revision
-func DeleteDoc(dbprefix string, doc Doc) (err error) {
+func DeleteDoc(ctx context.Context, dbprefix string, doc Doc) (err error) {
 	doctype := doc.DocType()
 	id := doc.ID()
 	rev := doc.Rev()
-	tombrev, err := Delete(dbprefix, doctype, id, rev)
+	tombrev, err := Delete(ctx, dbprefix, doctype, id, rev)
 	if err == nil {
 		doc.SetRev(tombrev)
 	}
@@ -229,7 +270,7 @@ func DeleteDoc(dbprefix string, doc Doc) (err error) {
 
 // UpdateDoc update a document. The document ID and Rev should be fillled.
 // The doc SetRev function will be called with the new rev.
-func UpdateDoc(dbprefix string, doc Doc) (err error) {
+func UpdateDoc(ctx context.Context, dbprefix string, doc Doc) (err error) {
 	doctype := doc.DocType()
 	id := doc.ID()
 	rev := doc.Rev()
@@ -239,7 +280,7 @@ func UpdateDoc(dbprefix string, doc Doc) (err error) {
 
 	url := docURL(dbprefix, doctype, id)
 	var res updateResponse
-	err = makeRequest("PUT", url, doc, &res)
+	err = makeRequest(ctx, "PUT", url, doc, &res)
 	fixErrorNoDatabaseIsWrongDoctype(err)
 	if err == nil {
 		doc.SetRev(res.Rev)
@@ -251,7 +292,7 @@ func UpdateDoc(dbprefix string, doc Doc) (err error) {
 // if the document already exist, it will return a 409 error.
 // The document ID should be fillled.
 // The doc SetRev function will be called with the new rev.
-func CreateNamedDoc(dbprefix string, doc Doc) (err error) {
+func CreateNamedDoc(ctx context.Context, dbprefix string, doc Doc) (err error) {
 	doctype := doc.DocType()
 	id := doc.ID()
 
@@ -261,7 +302,7 @@ func CreateNamedDoc(dbprefix string, doc Doc) (err error) {
 
 	url := docURL(dbprefix, doctype, id)
 	var res updateResponse
-	err = makeRequest("PUT", url, doc, &res)
+	err = makeRequest(ctx, "PUT", url, doc, &res)
 	fixErrorNoDatabaseIsWrongDoctype(err)
 	if err == nil {
 		doc.SetRev(res.Rev)
@@ -271,29 +312,29 @@ func CreateNamedDoc(dbprefix string, doc Doc) (err error) {
 
 // CreateNamedDocWithDB is equivalent to CreateNamedDoc but creates the database
 // if it does not exist
-func CreateNamedDocWithDB(dbprefix string, doc Doc) (err error) {
-	err = CreateNamedDoc(dbprefix, doc)
-	if coucherr, ok := err.(*Error); ok && coucherr.Reason == "wrong_doctype" {
-		err = CreateDB(dbprefix, doc.DocType())
+func CreateNamedDocWithDB(ctx context.Context, dbprefix string, doc Doc) (err error) {
+	err = CreateNamedDoc(ctx, dbprefix, doc)
+	if IsWrongDoctypeError(err) {
+		err = CreateDB(ctx, dbprefix, doc.DocType())
 		if err != nil {
 			return err
 		}
-		return CreateNamedDoc(dbprefix, doc)
+		return CreateNamedDoc(ctx, dbprefix, doc)
 	}
 	return err
 }
 
-func createDocOrDb(dbprefix string, doc Doc, response interface{}) (err error) {
+func createDocOrDb(ctx context.Context, dbprefix string, doc Doc, response interface{}) (err error) {
 	doctype := doc.DocType()
 	db := makeDBName(dbprefix, doctype)
-	err = makeRequest("POST", db, doc, response)
+	err = makeRequest(ctx, "POST", db, doc, response)
 	if err == nil || !IsNoDatabaseError(err) {
 		return
 	}
 
-	err = CreateDB(dbprefix, doctype)
+	err = CreateDB(ctx, dbprefix, doctype)
 	if err == nil {
-		err = makeRequest("POST", db, doc, response)
+		err = makeRequest(ctx, "POST", db, doc, response)
 	}
 	return
 }
@@ -302,7 +343,7 @@ func createDocOrDb(dbprefix string, doc Doc, response interface{}) (err error) {
 // database. The document's SetRev and SetID function will be called
 // with the document's new ID and Rev.
 // This function creates a database if this is the first document of its type
-func CreateDoc(dbprefix string, doc Doc) (err error) {
+func CreateDoc(ctx context.Context, dbprefix string, doc Doc) (err error) {
 	var res *updateResponse
 
 	if doc.ID() != "" {
@@ -310,7 +351,7 @@ func CreateDoc(dbprefix string, doc Doc) (err error) {
 		return
 	}
 
-	err = createDocOrDb(dbprefix, doc, &res)
+	err = createDocOrDb(ctx, dbprefix, doc, &res)
 	if err != nil {
 		return err
 	} else if !res.Ok {
@@ -324,23 +365,59 @@ func CreateDoc(dbprefix string, doc Doc) (err error) {
 
 // DefineIndex define the index on the doctype database
 // see query package on how to define an index
-func DefineIndex(dbprefix, doctype string, index mango.IndexDefinitionRequest) error {
+// This function creates the database if it does not exist.
+func DefineIndex(ctx context.Context, dbprefix, doctype string, index mango.IndexDefinitionRequest) error {
 	url := makeDBName(dbprefix, doctype) + "/_index"
 	var response indexCreationResponse
-	return makeRequest("POST", url, &index, &response)
+	err := makeRequest(ctx, "POST", url, &index, &response)
+	if IsNoDatabaseError(err) {
+		if err = CreateDB(ctx, dbprefix, doctype); err == nil {
+			err = makeRequest(ctx, "POST", url, &index, &response)
+		}
+	}
+	return err
+}
+
+// DefineIndexes defines all the given indexes on the doctype database.
+// An index that already exists is left untouched, so it is safe to call
+// it several times.
+func DefineIndexes(ctx context.Context, dbprefix, doctype string, indexes []mango.IndexDefinitionRequest) error {
+	for _, index := range indexes {
+		if err := DefineIndex(ctx, dbprefix, doctype, index); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // FindDocs returns all documents matching the passed FindRequest
 // documents will be unmarshalled in the provided results slice.
-func FindDocs(dbprefix, doctype string, req *FindRequest, results interface{}) error {
+func FindDocs(ctx context.Context, dbprefix, doctype string, req *FindRequest, results interface{}) error {
+	_, err := FindDocsRaw(ctx, dbprefix, doctype, req, results)
+	return err
+}
+
+// FindDocsRaw is like FindDocs, but it also returns the bookmark and the
+// execution stats sent by CouchDB. The bookmark can be put in the next
+// FindRequest to fetch the following page of results.
+func FindDocsRaw(ctx context.Context, dbprefix, doctype string, req *FindRequest, results interface{}) (*FindResponse, error) {
 	url := makeDBName(dbprefix, doctype) + "/_find"
 	// prepare a structure to receive the results
-	var response findResponse
-	err := makeRequest("POST", url, &req, &response)
+	var response FindResponse
+	err := makeRequest(ctx, "POST", url, &req, &response)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return json.Unmarshal(response.Docs, results)
+	// CouchDB adds a warning when no index matches the selector and all
+	// the documents of the database have been scanned
+	if response.Warning != "" {
+		sel, _ := json.Marshal(req.Selector)
+		logger.Warnf("couchdb", "%s on %s for %s", response.Warning, doctype, sel)
+	}
+	if err = json.Unmarshal(response.Docs, results); err != nil {
+		return nil, err
+	}
+	return &response, nil
 }
 
 type indexCreationResponse struct {
@@ -356,15 +433,35 @@ type updateResponse struct {
 	Ok  bool   `json:"ok"`
 }
 
-type findResponse struct {
-	Docs json.RawMessage `json:"docs"`
+// FindResponse is the response of CouchDB to a FindRequest, with the raw
+// JSON of the documents
+type FindResponse struct {
+	Docs           json.RawMessage `json:"docs"`
+	Bookmark       string          `json:"bookmark"`
+	Warning        string          `json:"warning"`
+	ExecutionStats *ExecutionStats `json:"execution_stats"`
+}
+
+// ExecutionStats are the statistics of the execution of a FindRequest,
+// returned by CouchDB when they have been asked
+type ExecutionStats struct {
+	TotalKeysExamined       int     `json:"total_keys_examined"`
+	TotalDocsExamined       int     `json:"total_docs_examined"`
+	TotalQuorumDocsExamined int     `json:"total_quorum_docs_examined"`
+	ResultsReturned         int     `json:"results_returned"`
+	ExecutionTimeMs         float64 `json:"execution_time_ms"`
 }
 
 // A FindRequest is a structure containin
 type FindRequest struct {
-	Selector mango.Filter  `json:"selector"`
-	Limit    int           `json:"limit,omitempty"`
-	Skip     int           `json:"skip,omitempty"`
-	Sort     *mango.SortBy `json:"sort,omitempty"`
-	Fields   []string      `json:"fields,omitempty"`
+	Selector       mango.Filter     `json:"selector"`
+	Limit          int              `json:"limit,omitempty"`
+	Skip           int              `json:"skip,omitempty"`
+	Bookmark       string           `json:"bookmark,omitempty"`
+	Sort           mango.SortFields `json:"sort,omitempty"`
+	Fields         []string         `json:"fields,omitempty"`
+	ExecutionStats bool             `json:"execution_stats,omitempty"`
+	// UseIndex is the design document of the index to use, as a hint
+	// for CouchDB
+	UseIndex string `json:"use_index,omitempty"`
 }
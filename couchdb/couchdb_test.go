@@ -1,16 +1,19 @@
 package couchdb
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"testing"
 
+	"github.com/dcasier/cozy-stack/couchdb/couchdbtest"
 	"github.com/dcasier/cozy-stack/couchdb/mango"
-	"github.com/sourcegraph/checkup"
 	"github.com/stretchr/testify/assert"
 )
 
-var CouchDBURL = "http://localhost:5984/"
+// CouchDBURL is the URL of the CouchDB used by the tests, see TestMain
+var CouchDBURL string
 
 func TestErrors(t *testing.T) {
 	err := Error{StatusCode: 404, Name: "not_found", Reason: "missing"}
@@ -62,7 +65,7 @@ func TestCreateDoc(t *testing.T) {
 	assert.Empty(t, doc.Rev(), doc.ID())
 
 	// Create the document
-	err = CreateDoc(TestPrefix, doc)
+	err = CreateDoc(context.Background(), TestPrefix, doc)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, doc.Rev(), doc.ID())
 
@@ -70,7 +73,7 @@ func TestCreateDoc(t *testing.T) {
 
 	// Fetch it and see if its match
 	fetched := &testDoc{}
-	err = GetDoc(TestPrefix, docType, id, fetched)
+	err = GetDoc(context.Background(), TestPrefix, docType, id, fetched)
 	assert.NoError(t, err)
 	assert.Equal(t, doc.ID(), fetched.ID())
 	assert.Equal(t, doc.Rev(), fetched.Rev())
@@ -81,25 +84,25 @@ func TestCreateDoc(t *testing.T) {
 	// Update it
 	updated := fetched
 	updated.Test = "changedvalue"
-	err = UpdateDoc(TestPrefix, updated)
+	err = UpdateDoc(context.Background(), TestPrefix, updated)
 	assert.NoError(t, err)
 	assert.NotEqual(t, revBackup, updated.Rev())
 	assert.Equal(t, "changedvalue", updated.Test)
 
 	// Refetch it and see if its match
 	fetched2 := &testDoc{}
-	err = GetDoc(TestPrefix, docType, id, fetched2)
+	err = GetDoc(context.Background(), TestPrefix, docType, id, fetched2)
 	assert.NoError(t, err)
 	assert.Equal(t, doc.ID(), fetched2.ID())
 	assert.Equal(t, updated.Rev(), fetched2.Rev())
 	assert.Equal(t, "changedvalue", fetched2.Test)
 
 	// Delete it
-	err = DeleteDoc(TestPrefix, updated)
+	err = DeleteDoc(context.Background(), TestPrefix, updated)
 	assert.NoError(t, err)
 
 	fetched3 := &testDoc{}
-	err = GetDoc(TestPrefix, docType, id, fetched3)
+	err = GetDoc(context.Background(), TestPrefix, docType, id, fetched3)
 	assert.Error(t, err)
 	coucherr, iscoucherr := err.(*Error)
 	if assert.True(t, iscoucherr) {
@@ -109,14 +112,29 @@ func TestCreateDoc(t *testing.T) {
 }
 
 func TestDefineIndex(t *testing.T) {
-	err := DefineIndex(TestPrefix, TestDoctype, mango.IndexOnFields("fieldA", "fieldB"))
+	err := DefineIndex(context.Background(), TestPrefix, TestDoctype, mango.IndexOnFields("fieldA", "fieldB"))
 	assert.NoError(t, err)
 
 	// if I try to define the same index several time
-	err2 := DefineIndex(TestPrefix, TestDoctype, mango.IndexOnFields("fieldA", "fieldB"))
+	err2 := DefineIndex(context.Background(), TestPrefix, TestDoctype, mango.IndexOnFields("fieldA", "fieldB"))
 	assert.NoError(t, err2)
 }
 
+func TestDefineIndexesCreatesDB(t *testing.T) {
+	doctype := "io.cozy.testindexes"
+	err := DeleteDB(context.Background(), TestPrefix, doctype)
+	if err != nil && !IsNoDatabaseError(err) {
+		t.Fatal(err)
+	}
+	defer DeleteDB(context.Background(), TestPrefix, doctype)
+
+	err = DefineIndexes(context.Background(), TestPrefix, doctype, []mango.IndexDefinitionRequest{
+		mango.IndexOnFields("fieldA"),
+		mango.IndexOnFields("fieldB"),
+	})
+	assert.NoError(t, err)
+}
+
 func TestQuery(t *testing.T) {
 
 	// create a few docs for testing
@@ -126,21 +144,21 @@ func TestQuery(t *testing.T) {
 	doc4 := testDoc{FieldA: "value13", FieldB: 1500}
 	docs := []*testDoc{&doc1, &doc2, &doc3, &doc4}
 	for _, doc := range docs {
-		err := CreateDoc(TestPrefix, doc)
+		err := CreateDoc(context.Background(), TestPrefix, doc)
 		if !assert.NoError(t, err) || doc.ID() == "" {
 			t.FailNow()
 			return
 		}
 	}
 
-	err := DefineIndex(TestPrefix, TestDoctype, mango.IndexOnFields("fieldA", "fieldB"))
+	err := DefineIndex(context.Background(), TestPrefix, TestDoctype, mango.IndexOnFields("fieldA", "fieldB"))
 	if !assert.NoError(t, err) {
 		t.FailNow()
 		return
 	}
 	var out []testDoc
 	req := &FindRequest{Selector: mango.Equal("fieldA", "value2")}
-	err = FindDocs(TestPrefix, TestDoctype, req, &out)
+	err = FindDocs(context.Background(), TestPrefix, TestDoctype, req, &out)
 	if assert.NoError(t, err) {
 		assert.Len(t, out, 2, "should get 2 results")
 		// if fieldA are equaly, docs will be ordered by fieldB
@@ -152,7 +170,7 @@ func TestQuery(t *testing.T) {
 
 	var out2 []testDoc
 	req2 := &FindRequest{Selector: mango.StartWith("fieldA", "value1")}
-	err = FindDocs(TestPrefix, TestDoctype, req2, &out2)
+	err = FindDocs(context.Background(), TestPrefix, TestDoctype, req2, &out2)
 	if assert.NoError(t, err) {
 		assert.Len(t, out, 2, "should get 2 results")
 		// if we do as startWith, docs will be ordered by the rest of fieldA
@@ -163,18 +181,192 @@ func TestQuery(t *testing.T) {
 	fmt.Println("results", out)
 }
 
+func TestFindDocsRawBookmark(t *testing.T) {
+	for i := 1; i <= 3; i++ {
+		doc := &testDoc{FieldA: "bookmark", FieldB: i}
+		if err := CreateDoc(context.Background(), TestPrefix, doc); !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+
+	err := DefineIndex(context.Background(), TestPrefix, TestDoctype, mango.IndexOnFields("fieldA", "fieldB"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var page1 []testDoc
+	req := &FindRequest{
+		Selector:       mango.Equal("fieldA", "bookmark"),
+		Limit:          2,
+		ExecutionStats: true,
+	}
+	res, err := FindDocsRaw(context.Background(), TestPrefix, TestDoctype, req, &page1)
+	if !assert.NoError(t, err) || !assert.Len(t, page1, 2) {
+		t.FailNow()
+	}
+	assert.NotEmpty(t, res.Bookmark)
+	if assert.NotNil(t, res.ExecutionStats) {
+		assert.Equal(t, 2, res.ExecutionStats.ResultsReturned)
+	}
+
+	var page2 []testDoc
+	req.Bookmark = res.Bookmark
+	_, err = FindDocsRaw(context.Background(), TestPrefix, TestDoctype, req, &page2)
+	if assert.NoError(t, err) && assert.Len(t, page2, 1) {
+		assert.Equal(t, 3, page2[0].FieldB)
+	}
+}
+
+func TestBulkDocs(t *testing.T) {
+	doc1 := &testDoc{Test: "bulk1"}
+	doc2 := &testDoc{Test: "bulk2"}
+	err := BulkDocs(context.Background(), TestPrefix, TestDoctype, []Doc{doc1, doc2})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NotEmpty(t, doc1.ID())
+	assert.NotEmpty(t, doc1.Rev())
+	assert.NotEmpty(t, doc2.ID())
+	assert.NotEmpty(t, doc2.Rev())
+
+	stale := &testDoc{TestID: doc2.ID(), TestRev: doc2.Rev(), Test: "stale"}
+	doc1.Test = "updated"
+	err = BulkDocs(context.Background(), TestPrefix, TestDoctype, []Doc{doc1, NewTombstone(doc2)})
+	assert.NoError(t, err)
+
+	fetched := &testDoc{}
+	err = GetDoc(context.Background(), TestPrefix, TestDoctype, doc1.ID(), fetched)
+	assert.NoError(t, err)
+	assert.Equal(t, "updated", fetched.Test)
+	err = GetDoc(context.Background(), TestPrefix, TestDoctype, doc2.ID(), fetched)
+	assert.True(t, IsNotFoundError(err))
+
+	err = BulkDocs(context.Background(), TestPrefix, TestDoctype, []Doc{stale})
+	if assert.Error(t, err) {
+		bulkerr, ok := err.(*BulkError)
+		if assert.True(t, ok) && assert.Len(t, bulkerr.Failures, 1) {
+			assert.Equal(t, doc2.ID(), bulkerr.Failures[0].ID)
+			assert.Equal(t, "conflict", bulkerr.Failures[0].Error)
+		}
+	}
+}
+
+func TestViews(t *testing.T) {
+	view := &View{
+		Name:    "by-fielda",
+		Doctype: TestDoctype,
+		Map:     "function(doc) { if (doc.fieldA) { emit(doc.fieldA, doc.fieldB); } }",
+		Reduce:  "_sum",
+	}
+	err := DefineView(context.Background(), TestPrefix, view)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// defining the same view again does nothing
+	assert.NoError(t, DefineView(context.Background(), TestPrefix, view))
+
+	doc1 := &testDoc{FieldA: "viewA", FieldB: 1}
+	doc2 := &testDoc{FieldA: "viewA", FieldB: 2}
+	doc3 := &testDoc{FieldA: "viewB", FieldB: 4}
+	err = BulkDocs(context.Background(), TestPrefix, TestDoctype, []Doc{doc1, doc2, doc3})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	res, err := QueryView(context.Background(), TestPrefix, view, &ViewRequest{Key: "viewA", Group: true})
+	if assert.NoError(t, err) && assert.Len(t, res.Rows, 1) {
+		assert.Equal(t, "viewA", res.Rows[0].Key)
+		assert.Equal(t, float64(3), res.Rows[0].Value)
+	}
+
+	noReduce := false
+	res, err = QueryView(context.Background(), TestPrefix, view, &ViewRequest{
+		StartKey:    "viewA",
+		EndKey:      "viewB",
+		Reduce:      &noReduce,
+		IncludeDocs: true,
+	})
+	if assert.NoError(t, err) && assert.Len(t, res.Rows, 3) {
+		assert.Equal(t, doc3.ID(), res.Rows[2].ID)
+		var fetched testDoc
+		assert.NoError(t, json.Unmarshal(res.Rows[2].Doc, &fetched))
+		assert.Equal(t, 4, fetched.FieldB)
+	}
+}
+
+func TestListDatabases(t *testing.T) {
+	dbs, err := ListDatabases(context.Background(), TestPrefix)
+	if assert.NoError(t, err) {
+		assert.Contains(t, dbs, "dev/io-cozy-testobject")
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	ctx := context.Background()
+	source := DBURL(TestPrefix, TestDoctype)
+	target := DBURL(TestPrefix, "io.cozy.testreplica")
+	defer DeleteDB(ctx, TestPrefix, "io.cozy.testreplica")
+
+	opts := &ReplicationOptions{Continuous: true, CreateTarget: true}
+	repl, err := Replicate(ctx, source, target, opts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NotEmpty(t, repl.ID())
+
+	fetched, err := GetReplication(ctx, repl.ID())
+	if assert.NoError(t, err) {
+		assert.Equal(t, source, fetched.Source)
+		assert.Equal(t, target, fetched.Target)
+		assert.True(t, fetched.Continuous)
+		assert.NoError(t, CancelReplication(ctx, fetched))
+	}
+}
+
 func TestMain(m *testing.M) {
-	// First we make sure couchdb is started
-	couchdb, err := checkup.HTTPChecker{URL: CouchDBURL}.Check()
-	if err != nil || couchdb.Status() != checkup.Healthy {
-		fmt.Println("This test need couchdb to run.")
+	// The tests use an in-memory CouchDB, or the one given by the
+	// COZY_COUCHDB_URL env variable
+	var stop func()
+	CouchDBURL, stop = couchdbtest.Start()
+	if err := UseServer(ServerOptions{URL: CouchDBURL}); err != nil {
+		fmt.Println("Cant use couchdb", err)
 		os.Exit(1)
 	}
-	err = ResetDB(TestPrefix, TestDoctype)
+	err := ResetDB(context.Background(), TestPrefix, TestDoctype)
 	if err != nil {
 		fmt.Printf("Cant reset db (%s, %s) %s\n", TestPrefix, TestDoctype, err.Error())
 		os.Exit(1)
 	}
 
-	os.Exit(m.Run())
+	res := m.Run()
+	stop()
+	os.Exit(res)
+}
+
+func TestGetDocs(t *testing.T) {
+	doc1 := &testDoc{Test: "first"}
+	doc2 := &testDoc{Test: "second"}
+	doc3 := &testDoc{Test: "deleted"}
+	err := BulkDocs(context.Background(), TestPrefix, TestDoctype, []Doc{doc1, doc2, doc3})
+	assert.NoError(t, err)
+	err = DeleteDoc(context.Background(), TestPrefix, doc3)
+	assert.NoError(t, err)
+
+	var out []*testDoc
+	ids := []string{doc2.ID(), "missing", doc3.ID(), doc1.ID()}
+	err = GetDocs(context.Background(), TestPrefix, TestDoctype, ids, &out)
+	assert.NoError(t, err)
+	if assert.Len(t, out, 2) {
+		assert.Equal(t, "second", out[0].Test)
+		assert.Equal(t, doc2.Rev(), out[0].Rev())
+		assert.Equal(t, "first", out[1].Test)
+	}
+
+	var none []*testDoc
+	err = GetDocs(context.Background(), TestPrefix, TestDoctype, nil, &none)
+	assert.NoError(t, err)
+	assert.Len(t, none, 0)
+
+	err = GetDocs(context.Background(), TestPrefix, "io.cozy.nodb", ids, &none)
+	assert.True(t, IsWrongDoctypeError(err))
 }
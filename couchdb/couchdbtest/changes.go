@@ -0,0 +1,217 @@
+package couchdbtest
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultLongPollTimeout is the duration of a longpoll request for the
+// changes without a timeout parameter
+const defaultLongPollTimeout = 60 * time.Second
+
+type docsBySeq []*document
+
+func (d docsBySeq) Len() int           { return len(d) }
+func (d docsBySeq) Less(i, j int) bool { return d[i].seq < d[j].seq }
+func (d docsBySeq) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// changes returns the last change of each document written after the given
+// sequence
+func (db *database) changes(since, limit int, includeDocs bool) map[string]interface{} {
+	var docs docsBySeq
+	for _, doc := range db.docs {
+		if doc.seq > since {
+			docs = append(docs, doc)
+		}
+	}
+	sort.Sort(docs)
+
+	pending := 0
+	if limit >= 0 && len(docs) > limit {
+		pending = len(docs) - limit
+		docs = docs[:limit]
+	}
+	lastSeq := db.seq
+	if pending > 0 {
+		lastSeq = docs[len(docs)-1].seq
+	}
+	results := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		change := map[string]interface{}{
+			"seq":     strconv.Itoa(doc.seq),
+			"id":      doc.id,
+			"changes": []map[string]string{{"rev": doc.rev}},
+		}
+		if doc.deleted {
+			change["deleted"] = true
+		}
+		if includeDocs {
+			change["doc"] = doc.JSON()
+		}
+		results[i] = change
+	}
+	return map[string]interface{}{
+		"last_seq": strconv.Itoa(lastSeq),
+		"pending":  pending,
+		"results":  results,
+	}
+}
+
+// serveChanges handles the requests for the changes of a database. With a
+// longpoll feed, it waits for a change, without holding the lock.
+func (s *Server) serveChanges(w http.ResponseWriter, r *request, dbName string) {
+	if r.Method != "GET" {
+		writeError(w, r.Request, errMethod)
+		return
+	}
+	q := r.URL.Query()
+	longpoll := q.Get("feed") == "longpoll"
+	includeDocs := r.queryBool("include_docs")
+	_, limit, err := skipAndLimit(r)
+	if err != nil {
+		writeError(w, r.Request, err)
+		return
+	}
+	timeout := defaultLongPollTimeout
+	if v := q.Get("timeout"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, r.Request, badRequest("timeout must be an integer"))
+			return
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	since := -1
+	for {
+		s.mu.Lock()
+		db := s.dbs[dbName]
+		if db == nil {
+			s.mu.Unlock()
+			writeError(w, r.Request, errNoDB)
+			return
+		}
+		if since < 0 {
+			if since, err = parseSince(q.Get("since"), db); err != nil {
+				s.mu.Unlock()
+				writeError(w, r.Request, err)
+				return
+			}
+		}
+		res := db.changes(since, limit, includeDocs)
+		changed := s.changed
+		s.mu.Unlock()
+
+		if !longpoll || len(res["results"].([]map[string]interface{})) > 0 {
+			writeJSON(w, r.Request, http.StatusOK, res)
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			writeJSON(w, r.Request, http.StatusOK, res)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// parseSince reads the since parameter of a request for the changes. The
+// sequences are numbers, but they are sent as strings, like the opaque
+// sequences of CouchDB 2.
+func parseSince(since string, db *database) (int, error) {
+	switch since {
+	case "", "0":
+		return 0, nil
+	case "now":
+		return db.seq, nil
+	}
+	seq, err := strconv.Atoi(strings.SplitN(since, "-", 2)[0])
+	if err != nil || seq < 0 {
+		return 0, badRequest("Malformed sequence supplied in 'since' parameter.")
+	}
+	return seq, nil
+}
+
+// replicate runs the replication of a document of the _replicator database
+// at once, if its source and target are databases of this server. The
+// documents of the source are copied with their revision, and the state of
+// the replication is set in its document, without a new revision. The
+// continuous replications are also run only once, but they stay in the
+// triggered state. The lock must be held.
+func (s *Server) replicate(req *http.Request, repl *document) {
+	state, reason := "completed", ""
+	if continuous, _ := repl.body["continuous"].(bool); continuous {
+		state = "triggered"
+	}
+	source := s.replicationDB(req, repl.body["source"])
+	targetName := s.replicationDBName(req, repl.body["target"])
+	target := s.dbs[targetName]
+	if create, _ := repl.body["create_target"].(bool); target == nil && create && validDBName.MatchString(targetName) {
+		target = newDatabase(targetName)
+		s.dbs[targetName] = target
+	}
+
+	switch {
+	case source == nil:
+		state, reason = "error", "db_not_found: could not open source"
+	case target == nil:
+		state, reason = "error", "db_not_found: could not open target"
+	default:
+		var docs docsBySeq
+		for _, doc := range source.docs {
+			docs = append(docs, doc)
+		}
+		sort.Sort(docs)
+		for _, doc := range docs {
+			if prev, ok := target.docs[doc.id]; ok && prev.rev == doc.rev {
+				continue
+			}
+			target.seq++
+			copied := *doc
+			copied.seq = target.seq
+			target.docs[doc.id] = &copied
+		}
+	}
+
+	repl.body["_replication_state"] = state
+	repl.body["_replication_state_time"] = time.Now().UTC().Format(time.RFC3339)
+	if reason != "" {
+		repl.body["_replication_state_reason"] = reason
+	}
+}
+
+// replicationDB returns the database of this server for the source or
+// target of a replication, or nil
+func (s *Server) replicationDB(req *http.Request, endpoint interface{}) *database {
+	return s.dbs[s.replicationDBName(req, endpoint)]
+}
+
+// replicationDBName returns the name of the database for the source or
+// target of a replication, that can be the URL of a database of this
+// server, or just the name of the database
+func (s *Server) replicationDBName(req *http.Request, endpoint interface{}) string {
+	raw, _ := endpoint.(string)
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	if u.Host == "" {
+		return raw
+	}
+	if req == nil || u.Host != req.Host {
+		return ""
+	}
+	name, err := url.QueryUnescape(strings.Trim(u.EscapedPath(), "/"))
+	if err != nil {
+		return ""
+	}
+	return name
+}
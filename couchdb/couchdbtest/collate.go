@@ -0,0 +1,154 @@
+package couchdbtest
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// collate compares two JSON values like the views of CouchDB sort their
+// keys: null < false < true < numbers < strings < arrays < objects. The
+// strings are compared case-insensitively first, with the lowercase letters
+// before the uppercase ones, which is close enough to the unicode collation
+// used by CouchDB for the tests.
+func collate(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return compareInts(ra, rb)
+	}
+	switch va := a.(type) {
+	case bool:
+		vb := b.(bool)
+		if va == vb {
+			return 0
+		}
+		if !va {
+			return -1
+		}
+		return 1
+	case string:
+		return compareStrings(va, b.(string))
+	case []interface{}:
+		vb := b.([]interface{})
+		for i := 0; i < len(va) && i < len(vb); i++ {
+			if c := collate(va[i], vb[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(va), len(vb))
+	case map[string]interface{}:
+		return compareObjects(va, b.(map[string]interface{}))
+	}
+	if ra == rankNumber {
+		fa, fb := toFloat(a), toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+	}
+	return 0
+}
+
+const (
+	rankNull = iota
+	rankFalse
+	rankTrue
+	rankNumber
+	rankString
+	rankArray
+	rankObject
+)
+
+func typeRank(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return rankNull
+	case bool:
+		if v {
+			return rankTrue
+		}
+		return rankFalse
+	case json.Number, float64, int:
+		return rankNumber
+	case string:
+		return rankString
+	case []interface{}:
+		return rankArray
+	}
+	return rankObject
+}
+
+// typeName returns the name of the type of a JSON value, for the $type
+// operator of the mango selectors
+func typeName(v interface{}) string {
+	switch typeRank(v) {
+	case rankNull:
+		return "null"
+	case rankFalse, rankTrue:
+		return "boolean"
+	case rankNumber:
+		return "number"
+	case rankString:
+		return "string"
+	case rankArray:
+		return "array"
+	}
+	return "object"
+}
+
+func toFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareStrings(a, b string) int {
+	if c := strings.Compare(strings.ToLower(a), strings.ToLower(b)); c != 0 {
+		return c
+	}
+	// "a" < "A" for CouchDB
+	return -strings.Compare(a, b)
+}
+
+// compareObjects compares the objects field by field, in the order of their
+// keys
+func compareObjects(a, b map[string]interface{}) int {
+	ka, kb := sortedKeys(a), sortedKeys(b)
+	for i := 0; i < len(ka) && i < len(kb); i++ {
+		if c := compareStrings(ka[i], kb[i]); c != 0 {
+			return c
+		}
+		if c := collate(a[ka[i]], b[kb[i]]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(ka), len(kb))
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
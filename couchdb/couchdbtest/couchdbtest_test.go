@@ -0,0 +1,108 @@
+package couchdbtest
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decode(t *testing.T, raw string) interface{} {
+	var v interface{}
+	if !assert.NoError(t, decodeJSON([]byte(raw), &v)) {
+		t.FailNow()
+	}
+	return v
+}
+
+func TestCollate(t *testing.T) {
+	ordered := []string{
+		`null`, `false`, `true`, `1`, `2.5`, `10`,
+		`"a"`, `"A"`, `"aa"`, `"b"`,
+		`[]`, `["a"]`, `["a", 1]`, `["b"]`,
+		`{}`, `{"a": 1}`, `{"a": 2}`, `{"b": 1}`,
+	}
+	for i := range ordered {
+		a := decode(t, ordered[i])
+		assert.Equal(t, 0, collate(a, a), ordered[i])
+		for j := i + 1; j < len(ordered); j++ {
+			b := decode(t, ordered[j])
+			assert.Equal(t, -1, collate(a, b), ordered[i]+" < "+ordered[j])
+			assert.Equal(t, 1, collate(b, a), ordered[j]+" > "+ordered[i])
+		}
+	}
+	assert.Equal(t, 0, collate(json.Number("1"), 1.0))
+}
+
+func TestCompileMap(t *testing.T) {
+	fn, err := compileMap(`function(doc) {
+		if (doc.type === "event" && !doc.archived) {
+			emit([doc.calendar, doc["start"]], {title: doc.title});
+		} else if (doc.tags) emit(doc.tags, null);
+	}`)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var keys, values []interface{}
+	emit := func(k, v interface{}) {
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+	fn(decode(t, `{"type": "event", "calendar": "work", "start": 3, "title": "foo"}`), emit)
+	fn(decode(t, `{"type": "event", "archived": true, "tags": ["bar"]}`), emit)
+	fn(decode(t, `{"type": "contact"}`), emit)
+	if assert.Len(t, keys, 2) {
+		assert.Equal(t, decode(t, `["work", 3]`), keys[0])
+		assert.Equal(t, decode(t, `{"title": "foo"}`), values[0])
+		assert.Equal(t, decode(t, `["bar"]`), keys[1])
+		assert.Nil(t, values[1])
+	}
+
+	_, err = compileMap(`function(doc) { doc.foo.map(emit); }`)
+	assert.Error(t, err)
+	_, err = compileMap(`function(doc) { emit(doc._id, 1) `)
+	assert.Error(t, err)
+}
+
+func TestMatch(t *testing.T) {
+	doc := decode(t, `{
+		"name": "foo",
+		"size": 42,
+		"tags": ["a", "b"],
+		"meta": {"dotted.key": true, "owner": "bob"}
+	}`)
+	matching := []string{
+		`{}`,
+		`{"name": "foo"}`,
+		`{"size": {"$gt": 40, "$lte": 42}}`,
+		`{"name": {"$in": ["bar", "foo"]}, "size": {"$nin": [1, 2]}}`,
+		`{"meta.owner": "bob", "meta.dotted\\.key": true}`,
+		`{"meta": {"owner": {"$regex": "^b"}}}`,
+		`{"missing": {"$exists": false}, "tags": {"$exists": true}}`,
+		`{"tags": {"$all": ["b", "a"], "$size": 2, "$elemMatch": {"$eq": "a"}}}`,
+		`{"$or": [{"name": "bar"}, {"size": {"$mod": [5, 2]}}]}`,
+		`{"$not": {"name": "bar"}, "$nor": [{"size": 1}]}`,
+		`{"size": {"$type": "number"}, "name": {"$ne": "bar"}}`,
+	}
+	for _, raw := range matching {
+		sel := decode(t, raw).(map[string]interface{})
+		if assert.NoError(t, checkSelector(sel), raw) {
+			assert.True(t, match(doc, true, sel), raw)
+		}
+	}
+	notMatching := []string{
+		`{"name": "bar"}`,
+		`{"size": {"$lt": 42}}`,
+		`{"missing": {"$exists": true}}`,
+		`{"tags": {"$allMatch": {"$eq": "a"}}}`,
+		`{"$and": [{"name": "foo"}, {"size": 1}]}`,
+	}
+	for _, raw := range notMatching {
+		sel := decode(t, raw).(map[string]interface{})
+		if assert.NoError(t, checkSelector(sel), raw) {
+			assert.False(t, match(doc, true, sel), raw)
+		}
+	}
+	assert.Error(t, checkSelector(map[string]interface{}{"size": map[string]interface{}{"$unknown": 1}}))
+}
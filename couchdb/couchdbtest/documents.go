@@ -0,0 +1,602 @@
+package couchdbtest
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// database is an in-memory CouchDB database
+type database struct {
+	name     string
+	seq      int
+	docs     map[string]*document
+	local    map[string]map[string]interface{}
+	security map[string]interface{}
+}
+
+// document is the last revision of a document, or its tombstone
+type document struct {
+	id          string
+	rev         string
+	deleted     bool
+	seq         int
+	body        map[string]interface{}
+	attachments map[string]*attachment
+}
+
+type attachment struct {
+	contentType string
+	data        []byte
+	digest      string
+	revpos      int
+}
+
+func newDatabase(name string) *database {
+	return &database{
+		name:     name,
+		docs:     make(map[string]*document),
+		local:    make(map[string]map[string]interface{}),
+		security: map[string]interface{}{},
+	}
+}
+
+func (db *database) info() map[string]interface{} {
+	count, deleted := 0, 0
+	for _, doc := range db.docs {
+		if doc.deleted {
+			deleted++
+		} else {
+			count++
+		}
+	}
+	return map[string]interface{}{
+		"db_name":       db.name,
+		"doc_count":     count,
+		"doc_del_count": deleted,
+		"update_seq":    strconv.Itoa(db.seq),
+	}
+}
+
+// get returns a document that has not been deleted
+func (db *database) get(id string) (*document, error) {
+	doc, ok := db.docs[id]
+	if !ok {
+		return nil, errMissing
+	}
+	if doc.deleted {
+		return nil, errDeleted
+	}
+	return doc, nil
+}
+
+// specialMembers are the fields starting with an underscore that CouchDB
+// accepts in the documents
+var specialMembers = map[string]bool{
+	"_id": true, "_rev": true, "_deleted": true, "_attachments": true,
+	"_revisions": true, "_revs_info": true, "_conflicts": true,
+	"_deleted_conflicts": true, "_local_seq": true,
+	// the fields written by the replicator
+	"_replication_id": true, "_replication_state": true,
+	"_replication_state_time": true, "_replication_state_reason": true,
+}
+
+// write saves a new revision of a document. rev is the revision given by
+// the client, that must be the current one of the document, except for a
+// new document or a deleted one.
+func (db *database) write(id, rev string, body map[string]interface{}, atts map[string]*attachment, deleted bool) (*document, error) {
+	prev, exists := db.docs[id]
+	switch {
+	case !exists && rev != "":
+		return nil, errConflict
+	case exists && !prev.deleted && rev != prev.rev:
+		return nil, errConflict
+	case exists && prev.deleted && rev != "" && rev != prev.rev:
+		return nil, errConflict
+	}
+
+	generation, prevRev := 0, ""
+	if exists {
+		generation, prevRev = revGeneration(prev.rev), prev.rev
+	}
+	for _, att := range atts {
+		if att.revpos == 0 {
+			att.revpos = generation + 1
+		}
+	}
+	content, _ := json.Marshal(body)
+	sum := md5.Sum([]byte(fmt.Sprintf("%s%s%v%d", prevRev, content, deleted, len(atts))))
+
+	db.seq++
+	doc := &document{
+		id:          id,
+		rev:         strconv.Itoa(generation+1) + "-" + hex.EncodeToString(sum[:]),
+		deleted:     deleted,
+		seq:         db.seq,
+		body:        body,
+		attachments: atts,
+	}
+	db.docs[id] = doc
+	return doc, nil
+}
+
+// putDoc writes a document sent as JSON by a client, with its special
+// members. The lock of the server must be held.
+func (s *Server) putDoc(req *http.Request, db *database, id string, fields map[string]interface{}) (*document, error) {
+	if id == "" {
+		return nil, badRequest("Document id must not be empty")
+	}
+	if strings.HasPrefix(id, "_") && !strings.HasPrefix(id, "_design/") {
+		return nil, errReservedID
+	}
+	rev, _ := fields["_rev"].(string)
+	if rev == "" && req != nil {
+		rev = req.URL.Query().Get("rev")
+	}
+	deleted, _ := fields["_deleted"].(bool)
+
+	body := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		if !strings.HasPrefix(k, "_") {
+			body[k] = v
+			continue
+		}
+		if !specialMembers[k] {
+			return nil, &couchError{http.StatusBadRequest, "doc_validation", "Bad special document member: " + k}
+		}
+	}
+	if strings.HasPrefix(id, "_design/") {
+		if err := checkDesignDoc(body); err != nil {
+			return nil, err
+		}
+	}
+
+	var prev map[string]*attachment
+	if doc, ok := db.docs[id]; ok && !doc.deleted {
+		prev = doc.attachments
+	}
+	atts, err := readAttachments(fields["_attachments"], prev)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := db.write(id, rev, body, atts, deleted)
+	if err != nil {
+		return nil, err
+	}
+	if db.name == replicatorDB && !deleted {
+		s.replicate(req, doc)
+	}
+	s.notify()
+	return doc, nil
+}
+
+// readAttachments returns the attachments of a document from its
+// _attachments field: the stubs keep the previous attachments, and the
+// others have their content in base64.
+func readAttachments(field interface{}, prev map[string]*attachment) (map[string]*attachment, error) {
+	stubs, _ := field.(map[string]interface{})
+	if len(stubs) == 0 {
+		return nil, nil
+	}
+	atts := make(map[string]*attachment, len(stubs))
+	for name, v := range stubs {
+		stub, _ := v.(map[string]interface{})
+		if isStub, _ := stub["stub"].(bool); isStub {
+			att, ok := prev[name]
+			if !ok {
+				return nil, &couchError{http.StatusPreconditionFailed, "missing_stub", "Invalid attachment stub for " + name}
+			}
+			atts[name] = att
+			continue
+		}
+		encoded, _ := stub["data"].(string)
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, badRequest("Invalid attachment data for " + name)
+		}
+		contentType, _ := stub["content_type"].(string)
+		atts[name] = newAttachment(contentType, data)
+	}
+	return atts, nil
+}
+
+func newAttachment(contentType string, data []byte) *attachment {
+	sum := md5.Sum(data)
+	return &attachment{
+		contentType: contentType,
+		data:        data,
+		digest:      "md5-" + base64.StdEncoding.EncodeToString(sum[:]),
+	}
+}
+
+func revGeneration(rev string) int {
+	n, _ := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	return n
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// JSON returns the document as it is sent to the clients, with its
+// special members
+func (doc *document) JSON() map[string]interface{} {
+	m := make(map[string]interface{}, len(doc.body)+3)
+	for k, v := range doc.body {
+		m[k] = v
+	}
+	m["_id"] = doc.id
+	m["_rev"] = doc.rev
+	if doc.deleted {
+		m["_deleted"] = true
+	}
+	if len(doc.attachments) > 0 {
+		stubs := make(map[string]interface{}, len(doc.attachments))
+		for name, att := range doc.attachments {
+			stubs[name] = map[string]interface{}{
+				"content_type": att.contentType,
+				"digest":       att.digest,
+				"length":       len(att.data),
+				"revpos":       att.revpos,
+				"stub":         true,
+			}
+		}
+		m["_attachments"] = stubs
+	}
+	return m
+}
+
+func (doc *document) updateResponse() map[string]interface{} {
+	return map[string]interface{}{"ok": true, "id": doc.id, "rev": doc.rev}
+}
+
+// handleDoc handles the requests on a document: GET, HEAD, PUT and DELETE
+func handleDoc(s *Server, r *request) (int, interface{}, error) {
+	db, id := r.db, r.path[0]
+	switch r.Method {
+	case "GET", "HEAD":
+		doc, err := db.get(id)
+		if err != nil {
+			return 0, nil, err
+		}
+		if rev := r.URL.Query().Get("rev"); rev != "" && rev != doc.rev {
+			return 0, nil, errMissing
+		}
+		return http.StatusOK, doc.JSON(), nil
+	case "PUT":
+		var fields map[string]interface{}
+		if err := decodeJSON(r.body, &fields); err != nil || fields == nil {
+			return 0, nil, errInvalidJSON
+		}
+		doc, err := s.putDoc(r.Request, db, id, fields)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusCreated, doc.updateResponse(), nil
+	case "DELETE":
+		if _, err := db.get(id); err != nil {
+			return 0, nil, err
+		}
+		doc, err := db.write(id, r.URL.Query().Get("rev"), map[string]interface{}{}, nil, true)
+		if err != nil {
+			return 0, nil, err
+		}
+		s.notify()
+		return http.StatusOK, doc.updateResponse(), nil
+	}
+	return 0, nil, errMethod
+}
+
+// handleBulkDocs writes several documents, and returns the result of each one
+func handleBulkDocs(s *Server, r *request) (int, interface{}, error) {
+	var req struct {
+		Docs []map[string]interface{} `json:"docs"`
+	}
+	if err := decodeJSON(r.body, &req); err != nil {
+		return 0, nil, err
+	}
+	results := make([]map[string]interface{}, len(req.Docs))
+	for i, fields := range req.Docs {
+		id, _ := fields["_id"].(string)
+		if id == "" {
+			id = newUUID()
+		}
+		doc, err := s.putDoc(r.Request, r.db, id, fields)
+		if err != nil {
+			couchErr, _ := err.(*couchError)
+			results[i] = map[string]interface{}{"id": id, "error": couchErr.Name, "reason": couchErr.Reason}
+			continue
+		}
+		results[i] = map[string]interface{}{"ok": true, "id": doc.id, "rev": doc.rev}
+	}
+	return http.StatusCreated, results, nil
+}
+
+// handleAllDocs returns the documents in the order of their identifiers, or the
+// documents with the given keys
+func handleAllDocs(s *Server, r *request) (int, interface{}, error) {
+	db := r.db
+	includeDocs := r.queryBool("include_docs")
+	row := func(doc *document) map[string]interface{} {
+		value := map[string]interface{}{"rev": doc.rev}
+		res := map[string]interface{}{"id": doc.id, "key": doc.id, "value": value}
+		if doc.deleted {
+			value["deleted"] = true
+			res["doc"] = nil
+		} else if includeDocs {
+			res["doc"] = doc.JSON()
+		}
+		return res
+	}
+
+	var keys []string
+	if r.Method == "POST" {
+		var req struct {
+			Keys []string `json:"keys"`
+		}
+		if err := decodeJSON(r.body, &req); err != nil {
+			return 0, nil, err
+		}
+		keys = req.Keys
+	} else if raw := r.URL.Query().Get("keys"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &keys); err != nil {
+			return 0, nil, badRequest("invalid JSON for the keys parameter")
+		}
+	}
+
+	var ids []string
+	for id, doc := range db.docs {
+		if !doc.deleted {
+			ids = append(ids, id)
+		}
+	}
+	rows := []map[string]interface{}{}
+	if keys != nil {
+		for _, key := range keys {
+			if doc, ok := db.docs[key]; ok {
+				rows = append(rows, row(doc))
+			} else {
+				rows = append(rows, map[string]interface{}{"key": key, "error": "not_found"})
+			}
+		}
+		return http.StatusOK, map[string]interface{}{"total_rows": len(ids), "rows": rows}, nil
+	}
+
+	// the identifiers of the documents are sorted with the raw collation
+	sort.Strings(ids)
+	descending := r.queryBool("descending")
+	if descending {
+		sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	}
+	startkey, endkey, err := allDocsRange(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	inclusiveEnd := r.URL.Query().Get("inclusive_end") != "false"
+	skip, limit, err := skipAndLimit(r)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	offset := 0
+	for _, id := range ids {
+		before := startkey != nil && id < *startkey
+		after := endkey != nil && (id > *endkey || (!inclusiveEnd && id == *endkey))
+		if descending {
+			before = startkey != nil && id > *startkey
+			after = endkey != nil && (id < *endkey || (!inclusiveEnd && id == *endkey))
+		}
+		if before {
+			offset++
+			continue
+		}
+		if after {
+			break
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if limit >= 0 && len(rows) >= limit {
+			break
+		}
+		rows = append(rows, row(db.docs[id]))
+	}
+	return http.StatusOK, map[string]interface{}{
+		"total_rows": len(ids),
+		"offset":     offset,
+		"rows":       rows,
+	}, nil
+}
+
+// allDocsRange returns the bounds of the identifiers of a request for
+// _all_docs, from the key, startkey and endkey parameters
+func allDocsRange(r *request) (startkey, endkey *string, err error) {
+	if startkey, err = stringParam(r, "startkey", "start_key"); err != nil {
+		return nil, nil, err
+	}
+	if endkey, err = stringParam(r, "endkey", "end_key"); err != nil {
+		return nil, nil, err
+	}
+	key, err := stringParam(r, "key")
+	if key != nil {
+		startkey, endkey = key, key
+	}
+	return startkey, endkey, err
+}
+
+// stringParam returns the value of a JSON string parameter of the query
+// string, that can have several names, or nil if it is absent
+func stringParam(r *request, names ...string) (*string, error) {
+	for _, name := range names {
+		v, ok, err := r.queryJSON(name)
+		if err != nil || !ok {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, badRequest("the " + name + " parameter must be a string")
+		}
+		return &s, nil
+	}
+	return nil, nil
+}
+
+// skipAndLimit returns the skip and limit parameters of a request, with -1
+// for no limit
+func skipAndLimit(r *request) (skip, limit int, err error) {
+	limit = -1
+	q := r.URL.Query()
+	if v := q.Get("skip"); v != "" {
+		if skip, err = strconv.Atoi(v); err != nil || skip < 0 {
+			return 0, 0, badRequest("skip must be a positive integer")
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			return 0, 0, badRequest("limit must be a positive integer")
+		}
+	}
+	return skip, limit, nil
+}
+
+// handleLocalDoc handles the requests on a local document, that has no history
+// and is not in the changes nor in _all_docs
+func handleLocalDoc(s *Server, r *request) (int, interface{}, error) {
+	id := "_local/" + r.path[1]
+	prev, exists := r.db.local[id]
+	var prevRev string
+	if exists {
+		prevRev, _ = prev["_rev"].(string)
+	}
+
+	switch r.Method {
+	case "GET":
+		if !exists {
+			return 0, nil, errMissing
+		}
+		return http.StatusOK, prev, nil
+	case "PUT":
+		var doc map[string]interface{}
+		if err := decodeJSON(r.body, &doc); err != nil || doc == nil {
+			return 0, nil, errInvalidJSON
+		}
+		if rev, _ := doc["_rev"].(string); rev != prevRev {
+			return 0, nil, errConflict
+		}
+		doc["_id"] = id
+		doc["_rev"] = "0-" + strconv.Itoa(revGeneration(strings.TrimPrefix(prevRev, "0-"))+1)
+		r.db.local[id] = doc
+		return http.StatusCreated, map[string]interface{}{"ok": true, "id": id, "rev": doc["_rev"]}, nil
+	case "DELETE":
+		if !exists {
+			return 0, nil, errMissing
+		}
+		if r.URL.Query().Get("rev") != prevRev {
+			return 0, nil, errConflict
+		}
+		delete(r.db.local, id)
+		return http.StatusOK, map[string]interface{}{"ok": true, "id": id, "rev": "0-0"}, nil
+	}
+	return 0, nil, errMethod
+}
+
+// handleSecurity reads or replaces the _security object of the database
+func handleSecurity(s *Server, r *request) (int, interface{}, error) {
+	if r.Method == "GET" {
+		return http.StatusOK, r.db.security, nil
+	}
+	var sec map[string]interface{}
+	if err := decodeJSON(r.body, &sec); err != nil || sec == nil {
+		return 0, nil, errInvalidJSON
+	}
+	r.db.security = sec
+	return http.StatusOK, okResponse, nil
+}
+
+// serveAttachment handles the requests on an attachment. Their body is the
+// raw content of the attachment, not JSON.
+func (s *Server) serveAttachment(w http.ResponseWriter, r *request, dbName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := s.dbs[dbName]
+	if db == nil {
+		writeError(w, r.Request, errNoDB)
+		return
+	}
+	id, name := r.path[0], strings.Join(r.path[1:], "/")
+	rev := r.URL.Query().Get("rev")
+
+	switch r.Method {
+	case "GET", "HEAD":
+		doc, err := db.get(id)
+		if err != nil {
+			writeError(w, r.Request, err)
+			return
+		}
+		att, ok := doc.attachments[name]
+		if !ok {
+			writeError(w, r.Request, errMissingAtt)
+			return
+		}
+		w.Header().Set("Content-Type", att.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(att.data)))
+		w.Header().Set("Etag", att.digest)
+		w.WriteHeader(http.StatusOK)
+		if r.Method == "GET" {
+			w.Write(att.data)
+		}
+		return
+	case "PUT", "DELETE":
+	default:
+		writeError(w, r.Request, errMethod)
+		return
+	}
+
+	body := map[string]interface{}{}
+	atts := map[string]*attachment{}
+	if doc, ok := db.docs[id]; ok && !doc.deleted {
+		body = doc.body
+		for k, att := range doc.attachments {
+			atts[k] = att
+		}
+	} else if r.Method == "DELETE" {
+		writeError(w, r.Request, errMissing)
+		return
+	}
+	if r.Method == "PUT" {
+		atts[name] = newAttachment(r.Header.Get("Content-Type"), r.body)
+	} else if _, ok := atts[name]; !ok {
+		writeError(w, r.Request, errMissingAtt)
+		return
+	} else {
+		delete(atts, name)
+	}
+
+	doc, err := db.write(id, rev, body, atts, false)
+	if err != nil {
+		writeError(w, r.Request, err)
+		return
+	}
+	s.notify()
+	status := http.StatusCreated
+	if r.Method == "DELETE" {
+		status = http.StatusOK
+	}
+	writeJSON(w, r.Request, status, doc.updateResponse())
+}
@@ -0,0 +1,655 @@
+package couchdbtest
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultFindLimit is the number of documents returned by _find without a
+// limit, like CouchDB 2
+const defaultFindLimit = 25
+
+// noIndexWarning is the warning of CouchDB when no index matches the
+// selector of a query
+const noIndexWarning = "no matching index found, create an index to optimize query time"
+
+// index is a mango index on some fields
+type index struct {
+	ddoc   string
+	name   string
+	fields []string
+}
+
+// handleIndex creates a mango index. Like CouchDB, the index is kept in a
+// design document with the "query" language.
+func handleIndex(s *Server, r *request) (int, interface{}, error) {
+	var req struct {
+		Index struct {
+			Fields []interface{} `json:"fields"`
+		} `json:"index"`
+		Name string `json:"name"`
+		DDoc string `json:"ddoc"`
+		Type string `json:"type"`
+	}
+	if err := decodeJSON(r.body, &req); err != nil {
+		return 0, nil, err
+	}
+	if req.Type != "" && req.Type != "json" {
+		return 0, nil, badRequest("only the json indexes are supported")
+	}
+	fields, err := sortFields(req.Index.Fields)
+	if err != nil || len(fields) == 0 {
+		return 0, nil, badRequest("Index fields must be a non-empty array of field names")
+	}
+
+	names := make([]interface{}, len(fields))
+	mapFields := make(map[string]interface{}, len(fields))
+	for i, f := range fields {
+		names[i] = f.field
+		mapFields[f.field] = "asc"
+	}
+	def, _ := json.Marshal(names)
+	sum := sha1.Sum(def)
+	hash := hex.EncodeToString(sum[:])
+	if req.DDoc == "" {
+		req.DDoc = hash
+	}
+	if req.Name == "" {
+		req.Name = hash
+	}
+	id := "_design/" + strings.TrimPrefix(req.DDoc, "_design/")
+
+	view := map[string]interface{}{
+		"map":     map[string]interface{}{"fields": mapFields},
+		"reduce":  "_count",
+		"options": map[string]interface{}{"def": map[string]interface{}{"fields": names}},
+	}
+	views := map[string]interface{}{}
+	rev := ""
+	if ddoc, err := r.db.get(id); err == nil {
+		rev = ddoc.rev
+		if prev, ok := ddoc.body["views"].(map[string]interface{}); ok {
+			views = prev
+		}
+		if prev, ok := views[req.Name].(map[string]interface{}); ok {
+			prevDef, _ := json.Marshal(prev["options"])
+			newDef, _ := json.Marshal(view["options"])
+			if string(prevDef) == string(newDef) {
+				return http.StatusOK, map[string]interface{}{"result": "exists", "id": id, "name": req.Name}, nil
+			}
+		}
+	}
+	copied := make(map[string]interface{}, len(views)+1)
+	for k, v := range views {
+		copied[k] = v
+	}
+	copied[req.Name] = view
+	ddoc := map[string]interface{}{"language": "query", "views": copied}
+	if rev != "" {
+		ddoc["_rev"] = rev
+	}
+	if _, err := s.putDoc(nil, r.db, id, ddoc); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, map[string]interface{}{"result": "created", "id": id, "name": req.Name}, nil
+}
+
+// indexes returns the mango indexes of the database, in the order of their
+// design documents
+func (db *database) indexes() []*index {
+	var ids []string
+	for id, doc := range db.docs {
+		if !doc.deleted && strings.HasPrefix(id, "_design/") && doc.body["language"] == "query" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var indexes []*index
+	for _, id := range ids {
+		views, _ := db.docs[id].body["views"].(map[string]interface{})
+		for _, name := range sortedKeys(views) {
+			view, _ := views[name].(map[string]interface{})
+			options, _ := view["options"].(map[string]interface{})
+			def, _ := options["def"].(map[string]interface{})
+			raw, _ := def["fields"].([]interface{})
+			fields, err := sortFields(raw)
+			if err != nil || len(fields) == 0 {
+				continue
+			}
+			idx := &index{ddoc: id, name: name}
+			for _, f := range fields {
+				idx.fields = append(idx.fields, f.field)
+			}
+			indexes = append(indexes, idx)
+		}
+	}
+	return indexes
+}
+
+// sortField is a field of a sort or of an index, with its direction
+type sortField struct {
+	field string
+	desc  bool
+}
+
+// sortFields reads the fields of a sort, or of the definition of an index:
+// a list of names, or of {"name": "asc" or "desc"} objects
+func sortFields(raw []interface{}) ([]sortField, error) {
+	fields := make([]sortField, 0, len(raw))
+	for _, item := range raw {
+		switch item := item.(type) {
+		case string:
+			fields = append(fields, sortField{field: item})
+		case map[string]interface{}:
+			if len(item) != 1 {
+				return nil, badRequest("invalid sort field")
+			}
+			for name, dir := range item {
+				if dir != "asc" && dir != "desc" {
+					return nil, badRequest("invalid sort direction")
+				}
+				fields = append(fields, sortField{field: name, desc: dir == "desc"})
+			}
+		default:
+			return nil, badRequest("invalid sort field")
+		}
+	}
+	return fields, nil
+}
+
+// chooseIndex returns the index used for a query: the index given in
+// use_index, or the index whose fields are the most used by the selector,
+// if its first field is. It returns nil if no index can be used.
+func chooseIndex(indexes []*index, selector map[string]interface{}, useIndex string) *index {
+	if useIndex != "" {
+		parts := strings.SplitN(strings.TrimPrefix(useIndex, "_design/"), "/", 2)
+		for _, idx := range indexes {
+			if idx.ddoc == "_design/"+parts[0] && (len(parts) == 1 || idx.name == parts[1]) {
+				return idx
+			}
+		}
+	}
+
+	required := map[string]bool{}
+	requiredFields(selector, "", required)
+	var best *index
+	bestScore := 0
+	for _, idx := range indexes {
+		score := 0
+		for _, f := range idx.fields {
+			if !required[f] {
+				break
+			}
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = idx, score
+		}
+	}
+	return best
+}
+
+// requiredFields fills the names of the fields that must exist in the
+// documents matching the selector
+func requiredFields(selector map[string]interface{}, prefix string, required map[string]bool) {
+	for key, arg := range selector {
+		if key == "$and" {
+			subs, _ := arg.([]interface{})
+			for _, sub := range subs {
+				if sub, ok := sub.(map[string]interface{}); ok {
+					requiredFields(sub, prefix, required)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "$") {
+			if exists, ok := arg.(bool); key == "$exists" && ok && !exists {
+				delete(required, strings.TrimSuffix(prefix, "."))
+			}
+			continue
+		}
+		name := prefix + key
+		required[name] = true
+		if sub, ok := arg.(map[string]interface{}); ok {
+			requiredFields(sub, name+".", required)
+			if !isOperatorObject(sub) {
+				delete(required, name)
+			}
+		}
+	}
+}
+
+func isOperatorObject(m map[string]interface{}) bool {
+	for key := range m {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return len(m) > 0
+}
+
+// findRow is a document that matches the selector of a query, with the
+// values of the fields used to sort the results
+type findRow struct {
+	doc  *document
+	json map[string]interface{}
+	key  []interface{}
+}
+
+type findRows struct {
+	rows  []*findRow
+	order []sortField
+}
+
+func (f findRows) Len() int      { return len(f.rows) }
+func (f findRows) Swap(i, j int) { f.rows[i], f.rows[j] = f.rows[j], f.rows[i] }
+func (f findRows) Less(i, j int) bool {
+	return f.compare(f.rows[i].key, f.rows[i].doc.id, f.rows[j].key, f.rows[j].doc.id) < 0
+}
+
+// compare compares the positions of two documents in the results, from
+// the values of their sort fields and their identifiers
+func (f findRows) compare(keyA []interface{}, idA string, keyB []interface{}, idB string) int {
+	for i, field := range f.order {
+		if i >= len(keyA) || i >= len(keyB) {
+			break
+		}
+		c := collate(keyA[i], keyB[i])
+		if field.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(idA, idB)
+}
+
+// bookmark is the position of the last document of a page of results
+type bookmark struct {
+	Key []interface{} `json:"k"`
+	ID  string        `json:"id"`
+}
+
+func encodeBookmark(row *findRow) string {
+	b, _ := json.Marshal(bookmark{Key: row.key, ID: row.doc.id})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeBookmark(raw string) (*bookmark, error) {
+	b, err := base64.RawURLEncoding.DecodeString(raw)
+	var bm bookmark
+	if err == nil {
+		err = decodeJSON(b, &bm)
+	}
+	if err != nil {
+		return nil, &couchError{http.StatusBadRequest, "invalid_bookmark", "Invalid bookmark value: " + raw}
+	}
+	return &bm, nil
+}
+
+// handleFind runs a mango query
+func handleFind(s *Server, r *request) (int, interface{}, error) {
+	start := time.Now()
+	var req struct {
+		Selector       map[string]interface{} `json:"selector"`
+		Limit          *int                   `json:"limit"`
+		Skip           int                    `json:"skip"`
+		Sort           []interface{}          `json:"sort"`
+		Fields         []string               `json:"fields"`
+		Bookmark       string                 `json:"bookmark"`
+		UseIndex       interface{}            `json:"use_index"`
+		ExecutionStats bool                   `json:"execution_stats"`
+	}
+	if err := decodeJSON(r.body, &req); err != nil {
+		return 0, nil, err
+	}
+	if req.Selector == nil {
+		return 0, nil, badRequest("The selector must be an object")
+	}
+	if err := checkSelector(req.Selector); err != nil {
+		return 0, nil, err
+	}
+	limit := defaultFindLimit
+	if req.Limit != nil {
+		limit = *req.Limit
+	}
+	order, err := sortFields(req.Sort)
+	if err != nil {
+		return 0, nil, err
+	}
+	useIndex, _ := req.UseIndex.(string)
+	if parts, ok := req.UseIndex.([]interface{}); ok {
+		var names []string
+		for _, p := range parts {
+			name, _ := p.(string)
+			names = append(names, name)
+		}
+		useIndex = strings.Join(names, "/")
+	}
+
+	idx := chooseIndex(r.db.indexes(), req.Selector, useIndex)
+	if len(order) == 0 && idx != nil {
+		for _, f := range idx.fields {
+			order = append(order, sortField{field: f})
+		}
+	}
+
+	rows := findRows{order: order}
+	examined := 0
+	for id, doc := range r.db.docs {
+		if doc.deleted || strings.HasPrefix(id, "_design/") {
+			continue
+		}
+		examined++
+		m := doc.JSON()
+		if !match(m, true, req.Selector) {
+			continue
+		}
+		// the documents without the fields of the index are not in it
+		if idx != nil && !hasFields(m, idx.fields) {
+			continue
+		}
+		row := &findRow{doc: doc, json: m, key: make([]interface{}, len(order))}
+		for i, f := range order {
+			row.key[i], _ = lookup(m, f.field)
+		}
+		rows.rows = append(rows.rows, row)
+	}
+	sort.Sort(rows)
+
+	results := rows.rows
+	if req.Bookmark != "" && req.Bookmark != "nil" {
+		bm, err := decodeBookmark(req.Bookmark)
+		if err != nil {
+			return 0, nil, err
+		}
+		i := sort.Search(len(results), func(i int) bool {
+			return rows.compare(results[i].key, results[i].doc.id, bm.Key, bm.ID) > 0
+		})
+		results = results[i:]
+	}
+	if req.Skip > len(results) {
+		req.Skip = len(results)
+	}
+	results = results[req.Skip:]
+	if limit >= 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	docs := make([]map[string]interface{}, len(results))
+	for i, row := range results {
+		docs[i] = project(row.json, req.Fields)
+	}
+	res := map[string]interface{}{"docs": docs, "bookmark": "nil"}
+	if len(results) > 0 {
+		res["bookmark"] = encodeBookmark(results[len(results)-1])
+	} else if req.Bookmark != "" {
+		res["bookmark"] = req.Bookmark
+	}
+	if idx == nil {
+		res["warning"] = noIndexWarning
+	}
+	if req.ExecutionStats {
+		res["execution_stats"] = map[string]interface{}{
+			"total_keys_examined":        0,
+			"total_docs_examined":        examined,
+			"total_quorum_docs_examined": 0,
+			"results_returned":           len(docs),
+			"execution_time_ms":          float64(time.Since(start)) / float64(time.Millisecond),
+		}
+	}
+	return http.StatusOK, res, nil
+}
+
+// project keeps only the given fields of a document, or all its fields if
+// there are none
+func project(doc map[string]interface{}, fields []string) map[string]interface{} {
+	if len(fields) == 0 {
+		return doc
+	}
+	out := map[string]interface{}{}
+	for _, field := range fields {
+		v, ok := lookup(doc, field)
+		if !ok {
+			continue
+		}
+		path := splitField(field)
+		m := out
+		for _, name := range path[:len(path)-1] {
+			sub, ok := m[name].(map[string]interface{})
+			if !ok {
+				sub = map[string]interface{}{}
+				m[name] = sub
+			}
+			m = sub
+		}
+		m[path[len(path)-1]] = v
+	}
+	return out
+}
+
+// splitField returns the names of a nested field, like metadata.exif\.date
+// -> [metadata, exif.date]
+func splitField(field string) []string {
+	var names []string
+	var name []rune
+	escaped := false
+	for _, c := range field {
+		switch {
+		case escaped:
+			name = append(name, c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '.':
+			names = append(names, string(name))
+			name = name[:0]
+		default:
+			name = append(name, c)
+		}
+	}
+	return append(names, string(name))
+}
+
+// lookup returns the value of a nested field of a JSON value
+func lookup(v interface{}, field string) (interface{}, bool) {
+	for _, name := range splitField(field) {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func hasFields(doc map[string]interface{}, fields []string) bool {
+	for _, field := range fields {
+		if _, ok := lookup(doc, field); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// combinationOperators are the operators of the mango selectors that
+// combine selectors
+var combinationOperators = map[string]bool{
+	"$and": true, "$or": true, "$nor": true, "$not": true,
+}
+
+// conditionOperators are the operators of the mango selectors that check
+// a value
+var conditionOperators = map[string]bool{
+	"$eq": true, "$ne": true, "$lt": true, "$lte": true, "$gt": true,
+	"$gte": true, "$exists": true, "$type": true, "$in": true, "$nin": true,
+	"$size": true, "$mod": true, "$regex": true, "$all": true,
+	"$elemMatch": true, "$allMatch": true,
+}
+
+// checkSelector returns an error if the selector uses an unknown operator
+func checkSelector(selector map[string]interface{}) error {
+	for key, arg := range selector {
+		if strings.HasPrefix(key, "$") && !combinationOperators[key] && !conditionOperators[key] {
+			return &couchError{http.StatusBadRequest, "invalid_operator", "Invalid operator: " + key}
+		}
+		var subs []interface{}
+		switch arg := arg.(type) {
+		case map[string]interface{}:
+			subs = []interface{}{arg}
+		case []interface{}:
+			if combinationOperators[key] {
+				subs = arg
+			}
+		}
+		for _, sub := range subs {
+			if sub, ok := sub.(map[string]interface{}); ok {
+				if err := checkSelector(sub); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// match checks that a value matches a selector. exists is false when the
+// value is a field that is missing in the document, which matches only
+// {"$exists": false}.
+func match(v interface{}, exists bool, selector map[string]interface{}) bool {
+	for key, arg := range selector {
+		if !matchKey(v, exists, key, arg) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchKey(v interface{}, exists bool, key string, arg interface{}) bool {
+	if combinationOperators[key] {
+		if key == "$not" {
+			sub, _ := arg.(map[string]interface{})
+			return !match(v, exists, sub)
+		}
+		subs, _ := arg.([]interface{})
+		matched := 0
+		for _, sub := range subs {
+			sub, _ := sub.(map[string]interface{})
+			if match(v, exists, sub) {
+				matched++
+			}
+		}
+		switch key {
+		case "$and":
+			return matched == len(subs)
+		case "$or":
+			return matched > 0
+		}
+		return matched == 0 // $nor
+	}
+	if strings.HasPrefix(key, "$") {
+		return matchOperator(v, exists, key, arg)
+	}
+
+	fv, fexists := lookup(v, key)
+	if sub, ok := arg.(map[string]interface{}); ok && len(sub) > 0 {
+		return match(fv, fexists, sub)
+	}
+	return fexists && collate(fv, arg) == 0
+}
+
+func matchOperator(v interface{}, exists bool, op string, arg interface{}) bool {
+	if op == "$exists" {
+		want, _ := arg.(bool)
+		return exists == want
+	}
+	if !exists {
+		return false
+	}
+
+	switch op {
+	case "$eq":
+		return collate(v, arg) == 0
+	case "$ne":
+		return collate(v, arg) != 0
+	case "$lt":
+		return collate(v, arg) < 0
+	case "$lte":
+		return collate(v, arg) <= 0
+	case "$gt":
+		return collate(v, arg) > 0
+	case "$gte":
+		return collate(v, arg) >= 0
+	case "$type":
+		return typeName(v) == arg
+	case "$in", "$nin":
+		values, _ := arg.([]interface{})
+		in := false
+		for _, value := range values {
+			in = in || collate(v, value) == 0 || arrayContains(v, value)
+		}
+		return in == (op == "$in")
+	case "$regex":
+		str, ok := v.(string)
+		pattern, _ := arg.(string)
+		re, err := regexp.Compile(pattern)
+		return ok && err == nil && re.MatchString(str)
+	case "$mod":
+		args, _ := arg.([]interface{})
+		if typeRank(v) != rankNumber || len(args) != 2 || toFloat(args[0]) == 0 {
+			return false
+		}
+		return int64(toFloat(v))%int64(toFloat(args[0])) == int64(toFloat(args[1]))
+	}
+
+	array, ok := v.([]interface{})
+	if !ok {
+		return false
+	}
+	switch op {
+	case "$size":
+		return typeRank(arg) == rankNumber && float64(len(array)) == toFloat(arg)
+	case "$all":
+		values, _ := arg.([]interface{})
+		for _, value := range values {
+			if !arrayContains(array, value) {
+				return false
+			}
+		}
+		return true
+	case "$elemMatch", "$allMatch":
+		sub, _ := arg.(map[string]interface{})
+		matched := 0
+		for _, elem := range array {
+			if match(elem, true, sub) {
+				matched++
+			}
+		}
+		if op == "$elemMatch" {
+			return matched > 0
+		}
+		return len(array) > 0 && matched == len(array)
+	}
+	return false
+}
+
+func arrayContains(v interface{}, value interface{}) bool {
+	array, _ := v.([]interface{})
+	for _, elem := range array {
+		if collate(elem, value) == 0 {
+			return true
+		}
+	}
+	return false
+}
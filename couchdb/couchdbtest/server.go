@@ -0,0 +1,364 @@
+// Package couchdbtest is an in-memory CouchDB, for the tests that need a
+// CouchDB server without running a real one. It implements the parts of the
+// HTTP API of CouchDB 2 used by the couchdb package: the databases, the
+// documents with their attachments, _all_docs, _bulk_docs, _changes, the
+// mango indexes and queries, the views, the local documents, the _security
+// objects and the one-shot replications between its own databases.
+//
+// It is a test double, not a database: everything is kept in memory, the
+// views are recomputed on each query, and only a small subset of javascript
+// is understood in the map functions (see compileMap).
+package couchdbtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// EnvURL is the environment variable that can be set to the URL of a real
+// CouchDB, like http://localhost:5984/, to run the tests against it instead
+// of an in-memory server
+const EnvURL = "COZY_COUCHDB_URL"
+
+// Start returns the URL of the CouchDB to use for the tests of a package,
+// and a function to call when the tests are done. It is the CouchDB given
+// by the COZY_COUCHDB_URL environment variable, or else a new in-memory
+// server listening on a local port.
+func Start() (string, func()) {
+	if u := os.Getenv(EnvURL); u != "" {
+		if !strings.HasSuffix(u, "/") {
+			u += "/"
+		}
+		return u, func() {}
+	}
+	ts := httptest.NewServer(NewServer())
+	return ts.URL + "/", ts.Close
+}
+
+// Server is an in-memory CouchDB server. It implements http.Handler.
+type Server struct {
+	mu  sync.Mutex
+	dbs map[string]*database
+	// changed is closed and replaced each time a document is written, to
+	// wake up the longpoll requests of _changes
+	changed chan struct{}
+}
+
+// NewServer returns an in-memory CouchDB server with only the _replicator
+// database
+func NewServer() *Server {
+	s := &Server{
+		dbs:     make(map[string]*database),
+		changed: make(chan struct{}),
+	}
+	s.dbs[replicatorDB] = newDatabase(replicatorDB)
+	return s
+}
+
+const replicatorDB = "_replicator"
+
+// validDBName are the names of databases accepted by CouchDB
+var validDBName = regexp.MustCompile(`^[a-z][a-z0-9_$()+/-]*$`)
+
+// couchError is an error of CouchDB, sent with its status code and the
+// usual {"error": "...", "reason": "..."} JSON body
+type couchError struct {
+	status int
+	Name   string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+func (e *couchError) Error() string {
+	return e.Name + ": " + e.Reason
+}
+
+var (
+	errNoDB          = &couchError{http.StatusNotFound, "not_found", "Database does not exist."}
+	errMissing       = &couchError{http.StatusNotFound, "not_found", "missing"}
+	errDeleted       = &couchError{http.StatusNotFound, "not_found", "deleted"}
+	errConflict      = &couchError{http.StatusConflict, "conflict", "Document update conflict."}
+	errDBExists      = &couchError{http.StatusPreconditionFailed, "file_exists", "The database could not be created, the file already exists."}
+	errIllegalDBName = &couchError{http.StatusBadRequest, "illegal_database_name", "Name: Only lowercase characters (a-z), digits (0-9), and any of the characters _, $, (, ), +, -, and / are allowed. Must begin with a letter."}
+	errInvalidJSON   = &couchError{http.StatusBadRequest, "bad_request", "invalid UTF-8 JSON"}
+	errMethod        = &couchError{http.StatusMethodNotAllowed, "method_not_allowed", "Only the methods of the API of CouchDB used by the stack are supported."}
+	errMissingAtt    = &couchError{http.StatusNotFound, "not_found", "Document is missing attachment"}
+	errReservedID    = &couchError{http.StatusBadRequest, "illegal_docid", "Only reserved document ids may start with underscore."}
+	errMissingView   = &couchError{http.StatusNotFound, "not_found", "missing_named_view"}
+)
+
+func badRequest(reason string) *couchError {
+	return &couchError{http.StatusBadRequest, "bad_request", reason}
+}
+
+// decodeJSON reads a JSON value, keeping the numbers as json.Number to
+// send them back as they were written
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return errInvalidJSON
+	}
+	return nil
+}
+
+// request is a request for a database, with the segments of its path
+// after the name of the database
+type request struct {
+	*http.Request
+	db   *database
+	path []string
+	body []byte
+}
+
+// queryJSON returns the JSON value of a parameter of the query string, like
+// startkey, and false if the parameter is absent
+func (r *request) queryJSON(name string) (interface{}, bool, error) {
+	raw, ok := r.URL.Query()[name]
+	if !ok || len(raw) == 0 {
+		return nil, false, nil
+	}
+	var v interface{}
+	if err := decodeJSON([]byte(raw[0]), &v); err != nil {
+		return nil, false, badRequest("invalid JSON for the " + name + " parameter")
+	}
+	return v, true, nil
+}
+
+func (r *request) queryBool(name string) bool {
+	return r.URL.Query().Get(name) == "true"
+}
+
+type handler func(s *Server, r *request) (int, interface{}, error)
+
+// ServeHTTP implements the http.Handler interface
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	segments, err := splitPath(req.URL.EscapedPath())
+	if err != nil {
+		writeError(w, req, badRequest("invalid path"))
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, req, badRequest(err.Error()))
+		return
+	}
+
+	if len(segments) == 0 {
+		writeJSON(w, req, http.StatusOK, map[string]interface{}{
+			"couchdb": "Welcome",
+			"version": "2.0.0",
+			"vendor":  map[string]string{"name": "cozy-stack couchdbtest"},
+		})
+		return
+	}
+	if segments[0] == "_all_dbs" {
+		s.mu.Lock()
+		names := make([]string, 0, len(s.dbs))
+		for name := range s.dbs {
+			names = append(names, name)
+		}
+		s.mu.Unlock()
+		sort.Strings(names)
+		writeJSON(w, req, http.StatusOK, names)
+		return
+	}
+
+	r := &request{Request: req, path: segments[1:], body: body}
+	if len(r.path) == 0 {
+		s.serveDatabase(w, r, segments[0])
+		return
+	}
+	if r.path[0] == "_changes" {
+		s.serveChanges(w, r, segments[0])
+		return
+	}
+
+	h, err := s.route(r)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	if h == nil {
+		// the attachments are not sent as JSON
+		s.serveAttachment(w, r, segments[0])
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.db = s.dbs[segments[0]]; r.db == nil {
+		writeError(w, req, errNoDB)
+		return
+	}
+	status, res, err := h(s, r)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	writeJSON(w, req, status, res)
+}
+
+// route returns the handler of a request for a database, or nil for the
+// requests of attachments
+func (s *Server) route(r *request) (handler, error) {
+	method := r.Method
+	switch r.path[0] {
+	case "_all_docs":
+		if method == "GET" || method == "POST" {
+			return handleAllDocs, nil
+		}
+	case "_bulk_docs":
+		if method == "POST" {
+			return handleBulkDocs, nil
+		}
+	case "_find":
+		if method == "POST" {
+			return handleFind, nil
+		}
+	case "_index":
+		if method == "POST" {
+			return handleIndex, nil
+		}
+	case "_security":
+		if method == "GET" || method == "PUT" {
+			return handleSecurity, nil
+		}
+	case "_local":
+		if len(r.path) != 2 {
+			return nil, errMissing
+		}
+		return handleLocalDoc, nil
+	default:
+		if r.path[0] == "_design" {
+			// the design docs can be requested as _design/name
+			if len(r.path) < 2 {
+				return nil, errMissing
+			}
+			r.path = append([]string{"_design/" + r.path[1]}, r.path[2:]...)
+		}
+		if len(r.path) == 3 && r.path[1] == "_view" && strings.HasPrefix(r.path[0], "_design/") {
+			if method == "GET" {
+				return handleView, nil
+			}
+			return nil, errMethod
+		}
+		if len(r.path) > 1 {
+			return nil, nil
+		}
+		if strings.HasPrefix(r.path[0], "_") && !strings.HasPrefix(r.path[0], "_design/") {
+			return nil, errReservedID
+		}
+		return handleDoc, nil
+	}
+	return nil, errMethod
+}
+
+// serveDatabase handles the requests on a database itself
+func (s *Server) serveDatabase(w http.ResponseWriter, r *request, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := s.dbs[name]
+
+	switch r.Method {
+	case "PUT":
+		if db != nil {
+			writeError(w, r.Request, errDBExists)
+			return
+		}
+		if !validDBName.MatchString(name) {
+			writeError(w, r.Request, errIllegalDBName)
+			return
+		}
+		s.dbs[name] = newDatabase(name)
+		writeJSON(w, r.Request, http.StatusCreated, okResponse)
+		return
+	}
+
+	if db == nil {
+		writeError(w, r.Request, errNoDB)
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		writeJSON(w, r.Request, http.StatusOK, db.info())
+	case "DELETE":
+		delete(s.dbs, name)
+		s.notify()
+		writeJSON(w, r.Request, http.StatusOK, okResponse)
+	case "POST":
+		var doc map[string]interface{}
+		if err := decodeJSON(r.body, &doc); err != nil || doc == nil {
+			writeError(w, r.Request, errInvalidJSON)
+			return
+		}
+		id, _ := doc["_id"].(string)
+		if id == "" {
+			id = newUUID()
+		}
+		updated, err := s.putDoc(r.Request, db, id, doc)
+		if err != nil {
+			writeError(w, r.Request, err)
+			return
+		}
+		writeJSON(w, r.Request, http.StatusCreated, updated.updateResponse())
+	default:
+		writeError(w, r.Request, errMethod)
+	}
+}
+
+var okResponse = map[string]bool{"ok": true}
+
+// notify wakes up the longpoll requests. The lock must be held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// splitPath returns the unescaped segments of the path of a request. The
+// names of the databases and the identifiers of the documents are escaped
+// with url.QueryEscape by the couchdb package.
+func splitPath(escaped string) ([]string, error) {
+	var segments []string
+	for _, part := range strings.Split(strings.Trim(escaped, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		segment, err := url.QueryUnescape(part)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, res interface{}) {
+	b, err := json.Marshal(res)
+	if err != nil {
+		status = http.StatusInternalServerError
+		b, _ = json.Marshal(&couchError{Name: "unknown_error", Reason: err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(b)
+		w.Write([]byte("\n"))
+	}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	couchErr, ok := err.(*couchError)
+	if !ok {
+		couchErr = &couchError{http.StatusInternalServerError, "unknown_error", err.Error()}
+	}
+	writeJSON(w, r, couchErr.status, couchErr)
+}
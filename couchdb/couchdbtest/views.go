@@ -0,0 +1,754 @@
+package couchdbtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// checkDesignDoc checks that the map functions of a javascript design
+// document can be compiled, and that its reduce functions are built-in
+func checkDesignDoc(body map[string]interface{}) error {
+	if lang, ok := body["language"].(string); ok && lang != "javascript" {
+		return nil
+	}
+	views, _ := body["views"].(map[string]interface{})
+	for name, v := range views {
+		view, _ := v.(map[string]interface{})
+		src, _ := view["map"].(string)
+		if _, err := compileMap(src); err != nil {
+			return &couchError{http.StatusBadRequest, "compilation_error", fmt.Sprintf("Compilation of the map function in the %s view failed: %s", name, err)}
+		}
+		if reduce, ok := view["reduce"].(string); ok && !builtinReduces[reduce] {
+			return &couchError{http.StatusBadRequest, "compilation_error", "Only the built-in reduce functions are supported: " + reduce}
+		}
+	}
+	return nil
+}
+
+var builtinReduces = map[string]bool{"_count": true, "_sum": true, "_stats": true}
+
+// viewRow is a row emitted by the map function of a view
+type viewRow struct {
+	id    string
+	key   interface{}
+	value interface{}
+}
+
+type viewRows []*viewRow
+
+func (v viewRows) Len() int      { return len(v) }
+func (v viewRows) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v viewRows) Less(i, j int) bool {
+	if c := collate(v[i].key, v[j].key); c != 0 {
+		return c < 0
+	}
+	return v[i].id < v[j].id
+}
+
+// handleView queries a view. The map function is run on all the documents
+// of the database for each request.
+func handleView(s *Server, r *request) (int, interface{}, error) {
+	ddoc, err := r.db.get(r.path[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	views, _ := ddoc.body["views"].(map[string]interface{})
+	view, ok := views[r.path[2]].(map[string]interface{})
+	if !ok {
+		return 0, nil, errMissingView
+	}
+	src, _ := view["map"].(string)
+	mapFn, err := compileMap(src)
+	if err != nil {
+		return 0, nil, &couchError{http.StatusInternalServerError, "compilation_error", err.Error()}
+	}
+
+	var rows viewRows
+	for id, doc := range r.db.docs {
+		if doc.deleted || strings.HasPrefix(id, "_design/") {
+			continue
+		}
+		mapFn(doc.JSON(), func(key, value interface{}) {
+			rows = append(rows, &viewRow{id: id, key: key, value: value})
+		})
+	}
+	sort.Sort(rows)
+	total := len(rows)
+
+	q := r.URL.Query()
+	descending := r.queryBool("descending")
+	if descending {
+		sort.Sort(sort.Reverse(rows))
+	}
+	rows, offset, err := viewRange(r, rows, descending)
+	if err != nil {
+		return 0, nil, err
+	}
+	skip, limit, err := skipAndLimit(r)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	reduce, hasReduce := view["reduce"].(string)
+	if hasReduce && q.Get("reduce") != "false" {
+		if r.queryBool("include_docs") {
+			return 0, nil, &couchError{http.StatusBadRequest, "query_parse_error", "`include_docs` is invalid for reduce"}
+		}
+		groupLevel := 0
+		if r.queryBool("group") {
+			groupLevel = -1
+		}
+		if v := q.Get("group_level"); v != "" {
+			if groupLevel, err = strconv.Atoi(v); err != nil || groupLevel < 0 {
+				return 0, nil, badRequest("group_level must be a positive integer")
+			}
+		}
+		reduced, err := reduceRows(rows, reduce, groupLevel)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, map[string]interface{}{"rows": paginate(reduced, skip, limit)}, nil
+	}
+
+	includeDocs := r.queryBool("include_docs")
+	var out []interface{}
+	for _, row := range rows {
+		res := map[string]interface{}{"id": row.id, "key": row.key, "value": row.value}
+		if includeDocs {
+			res["doc"] = r.db.docs[row.id].JSON()
+		}
+		out = append(out, res)
+	}
+	return http.StatusOK, map[string]interface{}{
+		"total_rows": total,
+		"offset":     offset + skip,
+		"rows":       paginate(out, skip, limit),
+	}, nil
+}
+
+// viewRange returns the rows between the startkey and the endkey of a
+// request, or the rows of its key, and the number of rows before them
+func viewRange(r *request, rows viewRows, descending bool) (viewRows, int, error) {
+	start, hasStart, err := r.queryJSON("startkey")
+	if err == nil && !hasStart {
+		start, hasStart, err = r.queryJSON("start_key")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	end, hasEnd, err := r.queryJSON("endkey")
+	if err == nil && !hasEnd {
+		end, hasEnd, err = r.queryJSON("end_key")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	key, hasKey, err := r.queryJSON("key")
+	if err != nil {
+		return nil, 0, err
+	}
+	if hasKey {
+		start, hasStart, end, hasEnd = key, true, key, true
+	}
+	inclusiveEnd := r.URL.Query().Get("inclusive_end") != "false"
+
+	// with the descending order, the startkey is the highest key
+	sign := 1
+	if descending {
+		sign = -1
+	}
+	var selected viewRows
+	offset := 0
+	for _, row := range rows {
+		if hasStart && sign*collate(row.key, start) < 0 {
+			offset++
+			continue
+		}
+		if hasEnd {
+			c := sign * collate(row.key, end)
+			if c > 0 || (c == 0 && !inclusiveEnd) {
+				break
+			}
+		}
+		selected = append(selected, row)
+	}
+	return selected, offset, nil
+}
+
+func paginate(rows []interface{}, skip, limit int) []interface{} {
+	if skip > len(rows) {
+		skip = len(rows)
+	}
+	rows = rows[skip:]
+	if limit >= 0 && len(rows) > limit {
+		rows = rows[:limit]
+	}
+	if rows == nil {
+		rows = []interface{}{}
+	}
+	return rows
+}
+
+// reduceRows groups the rows by their keys, truncated to groupLevel items
+// for the array keys (-1 for the whole keys), and runs a built-in reduce
+// function on each group. Without grouping, all the rows are reduced to a
+// single row with a null key.
+func reduceRows(rows viewRows, reduce string, groupLevel int) ([]interface{}, error) {
+	var groups [][]*viewRow
+	var keys []interface{}
+	for _, row := range rows {
+		var key interface{}
+		if groupLevel != 0 {
+			key = row.key
+			if array, ok := key.([]interface{}); ok && groupLevel > 0 && len(array) > groupLevel {
+				key = array[:groupLevel]
+			}
+		}
+		n := len(groups)
+		if n > 0 && (groupLevel == 0 || collate(keys[n-1], key) == 0) {
+			groups[n-1] = append(groups[n-1], row)
+			continue
+		}
+		groups = append(groups, []*viewRow{row})
+		keys = append(keys, key)
+	}
+
+	var out []interface{}
+	for i, group := range groups {
+		value, err := reduceGroup(group, reduce)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, map[string]interface{}{"key": keys[i], "value": value})
+	}
+	return out, nil
+}
+
+func reduceGroup(rows []*viewRow, reduce string) (interface{}, error) {
+	if reduce == "_count" {
+		return len(rows), nil
+	}
+	sum, sumsqr := 0.0, 0.0
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, row := range rows {
+		if typeRank(row.value) != rankNumber {
+			return nil, &couchError{http.StatusInternalServerError, "builtin_reduce_error", reduce + " function requires that map values be numbers"}
+		}
+		v := toFloat(row.value)
+		sum += v
+		sumsqr += v * v
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	if reduce == "_sum" {
+		return sum, nil
+	}
+	return map[string]interface{}{
+		"sum": sum, "count": len(rows), "min": min, "max": max, "sumsqr": sumsqr,
+	}, nil
+}
+
+// mapFunc is a compiled map function, that calls emit for each row of the
+// document
+type mapFunc func(doc interface{}, emit func(key, value interface{}))
+
+// compileMap compiles a map function written in the small subset of
+// javascript used by the views of the stack:
+//
+//	function(doc) {
+//	  if (doc.type === "file" && !doc.trashed) {
+//	    emit([doc.folder_id, doc.name], null);
+//	  }
+//	}
+//
+// The statements are emit(key, value) and if/else, and the expressions are
+// the literals (strings, numbers, true, false, null, arrays and objects),
+// the fields of the document, and the ===, !==, ==, !=, &&, || and !
+// operators.
+func compileMap(src string) (mapFunc, error) {
+	p := &parser{src: src}
+	p.next()
+	if !p.accept("function") {
+		return nil, p.errorf("function")
+	}
+	if p.tok == tokIdent && p.text != "(" {
+		p.next() // the name of the function
+	}
+	if !p.accept("(") || p.tok != tokIdent {
+		return nil, p.errorf("(doc)")
+	}
+	p.param = p.text
+	p.next()
+	if !p.accept(")") {
+		return nil, p.errorf(")")
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != tokEOF {
+		return nil, p.errorf("the end of the function")
+	}
+	return mapFunc(body), nil
+}
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokPunct
+)
+
+// value is the result of a javascript expression, with undefined for a
+// missing field
+type value struct {
+	v       interface{}
+	defined bool
+}
+
+type (
+	expr func(doc interface{}) value
+	stmt func(doc interface{}, emit func(key, value interface{}))
+)
+
+// parser is a recursive descent parser of the map functions
+type parser struct {
+	src   string
+	pos   int
+	tok   int
+	text  string
+	param string
+}
+
+func (p *parser) errorf(expected string) error {
+	return fmt.Errorf("expected %s at offset %d, found %q", expected, p.pos, p.text)
+}
+
+var punctuations = []string{"===", "!==", "==", "!=", "&&", "||", "(", ")", "{", "}", "[", "]", ",", ";", ".", ":", "!"}
+
+// next reads the next token
+func (p *parser) next() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		p.tok, p.text = tokEOF, ""
+		return
+	}
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case c == '"' || c == '\'':
+		p.pos++
+		for p.pos < len(p.src) && p.src[p.pos] != c {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		p.pos++
+		p.tok = tokString
+	case c >= '0' && c <= '9' || c == '-':
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		p.tok = tokNumber
+	case c == '_' || c == '$' || unicode.IsLetter(rune(c)):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || p.src[p.pos] == '$' ||
+			unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+			p.pos++
+		}
+		p.tok = tokIdent
+	default:
+		p.tok = tokPunct
+		p.pos++
+		for _, punct := range punctuations {
+			if strings.HasPrefix(p.src[start:], punct) {
+				p.pos = start + len(punct)
+				break
+			}
+		}
+	}
+	if p.pos > len(p.src) {
+		p.pos = len(p.src)
+	}
+	p.text = p.src[start:p.pos]
+}
+
+// accept reads the next token if the current one is text
+func (p *parser) accept(text string) bool {
+	if p.text != text || p.tok == tokString {
+		return false
+	}
+	p.next()
+	return true
+}
+
+// block parses { statements }
+func (p *parser) block() (stmt, error) {
+	if !p.accept("{") {
+		return nil, p.errorf("{")
+	}
+	var stmts []stmt
+	for !p.accept("}") {
+		if p.tok == tokEOF {
+			return nil, p.errorf("}")
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, s)
+	}
+	return func(doc interface{}, emit func(key, value interface{})) {
+		for _, s := range stmts {
+			s(doc, emit)
+		}
+	}, nil
+}
+
+// statement parses emit(key, value); or if (cond) ... else ...
+func (p *parser) statement() (stmt, error) {
+	switch {
+	case p.text == "{":
+		return p.block()
+	case p.accept(";"):
+		return func(interface{}, func(key, value interface{})) {}, nil
+	case p.accept("emit"):
+		if !p.accept("(") {
+			return nil, p.errorf("(")
+		}
+		key, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(",") {
+			return nil, p.errorf(",")
+		}
+		val, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.errorf(")")
+		}
+		p.accept(";")
+		return func(doc interface{}, emit func(key, value interface{})) {
+			emit(key(doc).v, val(doc).v)
+		}, nil
+	case p.accept("if"):
+		if !p.accept("(") {
+			return nil, p.errorf("(")
+		}
+		cond, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.errorf(")")
+		}
+		then, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		otherwise := func(interface{}, func(key, value interface{})) {}
+		if p.accept("else") {
+			if otherwise, err = p.statement(); err != nil {
+				return nil, err
+			}
+		}
+		return func(doc interface{}, emit func(key, value interface{})) {
+			if truthy(cond(doc)) {
+				then(doc, emit)
+			} else {
+				otherwise(doc, emit)
+			}
+		}, nil
+	}
+	return nil, p.errorf("emit or if")
+}
+
+// expression parses a || b
+func (p *parser) expression() (expr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = logical(left, right, true)
+	}
+	return left, nil
+}
+
+// and parses a && b
+func (p *parser) and() (expr, error) {
+	left, err := p.comparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.comparison()
+		if err != nil {
+			return nil, err
+		}
+		left = logical(left, right, false)
+	}
+	return left, nil
+}
+
+// comparison parses a === b, a !== b, a == b and a != b
+func (p *parser) comparison() (expr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	op := p.text
+	if p.tok != tokPunct || (op != "===" && op != "!==" && op != "==" && op != "!=") {
+		return left, nil
+	}
+	p.next()
+	right, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	negate := op[0] == '!'
+	return func(doc interface{}) value {
+		return value{v: equals(left(doc), right(doc)) != negate, defined: true}
+	}, nil
+}
+
+// unary parses !a
+func (p *parser) unary() (expr, error) {
+	if !p.accept("!") {
+		return p.primary()
+	}
+	operand, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return func(doc interface{}) value {
+		return value{v: !truthy(operand(doc)), defined: true}
+	}, nil
+}
+
+// primary parses the literals, the fields of the document and (a)
+func (p *parser) primary() (expr, error) {
+	text := p.text
+	switch p.tok {
+	case tokString:
+		var s string
+		quoted := text
+		if strings.HasPrefix(quoted, "'") {
+			quoted = `"` + strings.Replace(strings.Trim(quoted, "'"), `"`, `\"`, -1) + `"`
+		}
+		if err := json.Unmarshal([]byte(quoted), &s); err != nil {
+			return nil, p.errorf("a string")
+		}
+		p.next()
+		return constant(s), nil
+	case tokNumber:
+		if _, err := strconv.ParseFloat(text, 64); err != nil {
+			return nil, p.errorf("a number")
+		}
+		p.next()
+		return constant(json.Number(text)), nil
+	case tokIdent:
+		p.next()
+		switch text {
+		case "null":
+			return constant(nil), nil
+		case "true", "false":
+			return constant(text == "true"), nil
+		case "undefined":
+			return func(interface{}) value { return value{} }, nil
+		case p.param:
+			return p.fields()
+		}
+		return nil, fmt.Errorf("unknown identifier %q", text)
+	}
+
+	switch {
+	case p.accept("("):
+		e, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.errorf(")")
+		}
+		return e, nil
+	case p.accept("["):
+		return p.array()
+	case p.accept("{"):
+		return p.object()
+	}
+	return nil, p.errorf("an expression")
+}
+
+// fields parses the path of a field of the document, like doc.a.b or
+// doc["a"]
+func (p *parser) fields() (expr, error) {
+	var path []string
+	for {
+		if p.accept(".") {
+			if p.tok != tokIdent {
+				return nil, p.errorf("a field name")
+			}
+			path = append(path, p.text)
+			p.next()
+			continue
+		}
+		if p.text == "[" && p.tok == tokPunct {
+			p.next()
+			if p.tok != tokString {
+				return nil, p.errorf("a field name")
+			}
+			name, err := p.primary()
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, name(nil).v.(string))
+			if !p.accept("]") {
+				return nil, p.errorf("]")
+			}
+			continue
+		}
+		break
+	}
+	return func(doc interface{}) value {
+		v := doc
+		for _, name := range path {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return value{}
+			}
+			if v, ok = m[name]; !ok {
+				return value{}
+			}
+		}
+		return value{v: v, defined: true}
+	}, nil
+}
+
+// array parses [a, b, ...] after the [
+func (p *parser) array() (expr, error) {
+	var items []expr
+	for !p.accept("]") {
+		if len(items) > 0 && !p.accept(",") {
+			return nil, p.errorf(",")
+		}
+		item, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return func(doc interface{}) value {
+		array := make([]interface{}, len(items))
+		for i, item := range items {
+			array[i] = item(doc).v
+		}
+		return value{v: array, defined: true}
+	}, nil
+}
+
+// object parses {key: a, ...} after the {
+func (p *parser) object() (expr, error) {
+	var keys []string
+	var values []expr
+	for !p.accept("}") {
+		if len(keys) > 0 && !p.accept(",") {
+			return nil, p.errorf(",")
+		}
+		key := p.text
+		switch p.tok {
+		case tokString:
+			k, err := p.primary()
+			if err != nil {
+				return nil, err
+			}
+			key = k(nil).v.(string)
+		case tokIdent:
+			p.next()
+		default:
+			return nil, p.errorf("a key")
+		}
+		if !p.accept(":") {
+			return nil, p.errorf(":")
+		}
+		v, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		values = append(values, v)
+	}
+	return func(doc interface{}) value {
+		obj := make(map[string]interface{}, len(keys))
+		for i, key := range keys {
+			if v := values[i](doc); v.defined {
+				obj[key] = v.v
+			}
+		}
+		return value{v: obj, defined: true}
+	}, nil
+}
+
+// logical returns the expression left || right, or left && right, that
+// returns one of its operands like in javascript
+func logical(left, right expr, or bool) expr {
+	return func(doc interface{}) value {
+		if v := left(doc); truthy(v) == or {
+			return v
+		}
+		return right(doc)
+	}
+}
+
+func constant(v interface{}) expr {
+	return func(interface{}) value { return value{v: v, defined: true} }
+}
+
+// truthy returns the boolean value of a javascript value
+func truthy(v value) bool {
+	if !v.defined {
+		return false
+	}
+	switch x := v.v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case string:
+		return x != ""
+	case json.Number, float64, int:
+		f := toFloat(x)
+		return f != 0 && !math.IsNaN(f)
+	}
+	return true
+}
+
+// equals compares two javascript values: the arrays and objects are never
+// equal, as they are compared by reference
+func equals(a, b value) bool {
+	if !a.defined || !b.defined {
+		return a.defined == b.defined
+	}
+	rank := typeRank(a.v)
+	if rank == rankArray || rank == rankObject {
+		return false
+	}
+	return typeRank(b.v) == rank && collate(a.v, b.v) == 0
+}
@@ -0,0 +1,89 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/dcasier/cozy-stack/couchdb/mango"
+)
+
+// countPageSize is the number of identifiers fetched by each request of
+// CountDocs with a selector
+const countPageSize = 1000
+
+type dbInfo struct {
+	DocCount int `json:"doc_count"`
+}
+
+// DocExists checks if a document exists, with a HEAD request that does not
+// fetch its content
+func DocExists(ctx context.Context, dbprefix, doctype, id string) (bool, error) {
+	err := makeRequest(ctx, "HEAD", docURL(dbprefix, doctype, id), nil, nil)
+	if hasStatusCode(err, http.StatusNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CountDocs returns the number of documents of the doctype database that
+// match the selector, or of all the documents (without the design docs)
+// if the selector is nil. A database that does not exist has no documents.
+func CountDocs(ctx context.Context, dbprefix, doctype string, selector mango.Filter) (int, error) {
+	var count int
+	var err error
+	if selector == nil {
+		count, err = countAllDocs(ctx, dbprefix, doctype)
+	} else {
+		count, err = countMatchingDocs(ctx, dbprefix, doctype, selector)
+	}
+	if IsNoDatabaseError(err) {
+		return 0, nil
+	}
+	return count, err
+}
+
+// countAllDocs uses the doc_count of the database, that includes the
+// design documents
+func countAllDocs(ctx context.Context, dbprefix, doctype string) (int, error) {
+	var info dbInfo
+	if err := makeRequest(ctx, "GET", makeDBName(dbprefix, doctype), nil, &info); err != nil {
+		return 0, err
+	}
+	qs := url.Values{
+		"startkey": {`"_design/"`},
+		"endkey":   {`"_design0"`},
+	}
+	var designs allDocsResponse
+	path := makeDBName(dbprefix, doctype) + "/_all_docs?" + qs.Encode()
+	if err := makeRequest(ctx, "GET", path, nil, &designs); err != nil {
+		return 0, err
+	}
+	return info.DocCount - len(designs.Rows), nil
+}
+
+// countMatchingDocs fetches only the identifiers of the documents that
+// match the selector, page by page
+func countMatchingDocs(ctx context.Context, dbprefix, doctype string, selector mango.Filter) (int, error) {
+	count := 0
+	req := &FindRequest{
+		Selector: selector,
+		Fields:   []string{"_id"},
+		Limit:    countPageSize,
+	}
+	for {
+		var ids []struct{}
+		res, err := FindDocsRaw(ctx, dbprefix, doctype, req, &ids)
+		if err != nil {
+			return 0, err
+		}
+		count += len(ids)
+		if len(ids) < countPageSize || res.Bookmark == "" {
+			return count, nil
+		}
+		req.Bookmark = res.Bookmark
+	}
+}
@@ -0,0 +1,50 @@
+package couchdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dcasier/cozy-stack/couchdb/mango"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountDocs(t *testing.T) {
+	doctype := "io.cozy.counted"
+	ResetDB(context.Background(), TestPrefix, doctype)
+	defer DeleteDB(context.Background(), TestPrefix, doctype)
+
+	docs := make([]Doc, 5)
+	for i := range docs {
+		docs[i] = &JSONDoc{Type: doctype, M: map[string]interface{}{"n": i}}
+	}
+	err := BulkDocs(context.Background(), TestPrefix, doctype, docs)
+	assert.NoError(t, err)
+	err = DefineIndex(context.Background(), TestPrefix, doctype, mango.IndexOnFields("n"))
+	assert.NoError(t, err)
+
+	count, err := CountDocs(context.Background(), TestPrefix, doctype, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count)
+
+	count, err = CountDocs(context.Background(), TestPrefix, doctype, mango.Gte("n", 3))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = CountDocs(context.Background(), TestPrefix, "io.cozy.nodb", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestDocExists(t *testing.T) {
+	doc := makeTestDoc()
+	err := CreateDoc(context.Background(), TestPrefix, doc)
+	assert.NoError(t, err)
+
+	exists, err := DocExists(context.Background(), TestPrefix, TestDoctype, doc.ID())
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = DocExists(context.Background(), TestPrefix, TestDoctype, "missing")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
@@ -0,0 +1,71 @@
+package couchdb
+
+import (
+	"context"
+
+	"github.com/dcasier/cozy-stack/couchdb/mango"
+)
+
+// SecurityMembers is a list of users and roles of CouchDB
+type SecurityMembers struct {
+	Names []string `json:"names"`
+	Roles []string `json:"roles"`
+}
+
+// Security is the _security object of a database. The admins can change
+// the design documents and the members can read and write the documents.
+// A database without members is public.
+type Security struct {
+	Admins  SecurityMembers `json:"admins"`
+	Members SecurityMembers `json:"members"`
+}
+
+// AdminOnlySecurity restricts a database to the admins of CouchDB
+var AdminOnlySecurity = &Security{
+	Admins:  SecurityMembers{Names: []string{}, Roles: []string{"_admin"}},
+	Members: SecurityMembers{Names: []string{}, Roles: []string{"_admin"}},
+}
+
+// DBOptions are the options of EnsureDBExists
+type DBOptions struct {
+	// Security is the _security object of the database, nil to keep the
+	// current one
+	Security *Security
+	// Indexes are the mango indexes of the database
+	Indexes []mango.IndexDefinitionRequest
+}
+
+// GetSecurity returns the _security object of the database for a doctype
+func GetSecurity(ctx context.Context, dbprefix, doctype string) (*Security, error) {
+	var sec Security
+	url := makeDBName(dbprefix, doctype) + "/_security"
+	if err := makeRequest(ctx, "GET", url, nil, &sec); err != nil {
+		return nil, err
+	}
+	return &sec, nil
+}
+
+// SetSecurity changes the _security object of the database for a doctype
+func SetSecurity(ctx context.Context, dbprefix, doctype string, sec *Security) error {
+	url := makeDBName(dbprefix, doctype) + "/_security"
+	return makeRequest(ctx, "PUT", url, sec, nil)
+}
+
+// EnsureDBExists creates the database for a doctype if it does not exist,
+// and then sets its _security object and defines its indexes. It can be
+// called several times on the same database.
+func EnsureDBExists(ctx context.Context, dbprefix, doctype string, opts *DBOptions) error {
+	err := CreateDB(ctx, dbprefix, doctype)
+	if err != nil && !IsFileExistsError(err) {
+		return err
+	}
+	if opts == nil {
+		return nil
+	}
+	if opts.Security != nil {
+		if err = SetSecurity(ctx, dbprefix, doctype, opts.Security); err != nil {
+			return err
+		}
+	}
+	return DefineIndexes(ctx, dbprefix, doctype, opts.Indexes)
+}
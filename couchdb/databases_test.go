@@ -0,0 +1,33 @@
+package couchdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dcasier/cozy-stack/couchdb/mango"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnsureDBExists(t *testing.T) {
+	doctype := "io.cozy.ensured"
+	DeleteDB(context.Background(), TestPrefix, doctype)
+	defer DeleteDB(context.Background(), TestPrefix, doctype)
+
+	opts := &DBOptions{
+		Security: AdminOnlySecurity,
+		Indexes:  []mango.IndexDefinitionRequest{mango.IndexOnFields("fieldA")},
+	}
+	err := EnsureDBExists(context.Background(), TestPrefix, doctype, opts)
+	assert.NoError(t, err)
+	// a second call does not fail on the existing database
+	err = EnsureDBExists(context.Background(), TestPrefix, doctype, opts)
+	assert.NoError(t, err)
+
+	sec, err := GetSecurity(context.Background(), TestPrefix, doctype)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"_admin"}, sec.Members.Roles)
+	assert.Equal(t, []string{"_admin"}, sec.Admins.Roles)
+
+	err = CreateDB(context.Background(), TestPrefix, doctype)
+	assert.True(t, IsFileExistsError(err))
+}
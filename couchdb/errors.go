@@ -108,6 +108,49 @@ func IsNotFoundError(err error) bool {
 	return couchErr.Name == "not_found"
 }
 
+// IsWrongDoctypeError checks if the given error is returned for a
+// document of a doctype that has no database yet
+func IsWrongDoctypeError(err error) bool {
+	couchErr, isCouchErr := err.(*Error)
+	return isCouchErr && couchErr.Reason == wrongDoctypeReason
+}
+
+// IsConflictError checks if the given error is a couch conflict error,
+// ie the revision of the document is not the last one
+func IsConflictError(err error) bool {
+	return hasStatusCode(err, http.StatusConflict)
+}
+
+// IsFileExistsError checks if the given error is returned when creating a
+// database that already exists
+func IsFileExistsError(err error) bool {
+	couchErr, isCouchErr := err.(*Error)
+	return isCouchErr && couchErr.Name == "file_exists"
+}
+
+// IsUnauthorizedError checks if the given error is a couch unauthorized
+// error, ie the credentials are missing or wrong
+func IsUnauthorizedError(err error) bool {
+	return hasStatusCode(err, http.StatusUnauthorized)
+}
+
+// IsForbiddenError checks if the given error is a couch forbidden error
+func IsForbiddenError(err error) bool {
+	return hasStatusCode(err, http.StatusForbidden)
+}
+
+// IsUnavailableError checks if the given error is returned when CouchDB
+// can not be reached
+func IsUnavailableError(err error) bool {
+	couchErr, isCouchErr := err.(*Error)
+	return isCouchErr && couchErr.Name == "no_couch"
+}
+
+func hasStatusCode(err error, code int) bool {
+	couchErr, isCouchErr := err.(*Error)
+	return isCouchErr && couchErr.StatusCode == code
+}
+
 func newRequestError(originalError error) error {
 	return &Error{
 		StatusCode: http.StatusServiceUnavailable,
@@ -126,6 +169,15 @@ func newConnectionError(originalError error) error {
 	}
 }
 
+func newUnavailableError(originalError error) error {
+	return &Error{
+		StatusCode: http.StatusServiceUnavailable,
+		Name:       "no_couch",
+		Reason:     "circuit_open",
+		Original:   originalError,
+	}
+}
+
 func newIOReadError(originalError error) error {
 	return &Error{
 		StatusCode: http.StatusServiceUnavailable,
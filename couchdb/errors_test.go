@@ -30,3 +30,19 @@ func TestError_JSON(t *testing.T) {
 
 	assert.EqualValues(t, expectedMap, asJSON)
 }
+
+func TestErrorHelpers(t *testing.T) {
+	conflict := &Error{StatusCode: 409, Name: "conflict", Reason: "Document update conflict."}
+	assert.True(t, IsConflictError(conflict))
+	assert.False(t, IsNotFoundError(conflict))
+	assert.False(t, IsConflictError(fmt.Errorf("conflict")))
+	assert.False(t, IsConflictError(nil))
+
+	unauthorized := &Error{StatusCode: 401, Name: "unauthorized", Reason: "Name or password is incorrect."}
+	assert.True(t, IsUnauthorizedError(unauthorized))
+	assert.False(t, IsForbiddenError(unauthorized))
+
+	assert.True(t, IsForbiddenError(&Error{StatusCode: 403, Name: "forbidden"}))
+	assert.True(t, IsUnavailableError(newConnectionError(fmt.Errorf("refused"))))
+	assert.True(t, IsWrongDoctypeError(&Error{StatusCode: 404, Name: "not_found", Reason: wrongDoctypeReason}))
+}
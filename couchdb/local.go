@@ -0,0 +1,47 @@
+package couchdb
+
+import (
+	"context"
+	"net/url"
+)
+
+// localDocURL returns the path of a _local document. The local documents
+// are not replicated and do not appear in the views and in _all_docs.
+func localDocURL(dbprefix, doctype, id string) string {
+	return makeDBName(dbprefix, doctype) + "/_local/" + url.QueryEscape(id)
+}
+
+// GetLocal fetches a local document of the doctype database by its ID
+// (without the _local/ prefix)
+func GetLocal(ctx context.Context, dbprefix, doctype, id string) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	err := makeRequest(ctx, "GET", localDocURL(dbprefix, doctype, id), nil, &doc)
+	fixErrorNoDatabaseIsWrongDoctype(err)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// PutLocal creates or updates a local document of the doctype database.
+// To update a document, its _rev must be the one given by GetLocal. The
+// _rev of the doc is updated with the new revision.
+func PutLocal(ctx context.Context, dbprefix, doctype, id string, doc map[string]interface{}) error {
+	var res updateResponse
+	err := makeRequest(ctx, "PUT", localDocURL(dbprefix, doctype, id), doc, &res)
+	fixErrorNoDatabaseIsWrongDoctype(err)
+	if err == nil {
+		doc["_rev"] = res.Rev
+	}
+	return err
+}
+
+// DeleteLocal destroys a local document of the doctype database, at the
+// given revision
+func DeleteLocal(ctx context.Context, dbprefix, doctype, id, rev string) error {
+	qs := url.Values{"rev": []string{rev}}
+	path := localDocURL(dbprefix, doctype, id) + "?" + qs.Encode()
+	err := makeRequest(ctx, "DELETE", path, nil, nil)
+	fixErrorNoDatabaseIsWrongDoctype(err)
+	return err
+}
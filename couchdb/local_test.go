@@ -0,0 +1,41 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalDocs(t *testing.T) {
+	_, err := GetLocal(context.Background(), TestPrefix, TestDoctype, "checkpoint")
+	assert.True(t, IsNotFoundError(err))
+
+	doc := map[string]interface{}{"seq": "12-abc"}
+	err = PutLocal(context.Background(), TestPrefix, TestDoctype, "checkpoint", doc)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, doc["_rev"])
+
+	fetched, err := GetLocal(context.Background(), TestPrefix, TestDoctype, "checkpoint")
+	assert.NoError(t, err)
+	assert.Equal(t, "12-abc", fetched["seq"])
+
+	fetched["seq"] = "42-def"
+	err = PutLocal(context.Background(), TestPrefix, TestDoctype, "checkpoint", fetched)
+	assert.NoError(t, err)
+
+	// the local documents are not listed with the other documents
+	err = ForeachDocs(context.Background(), TestPrefix, TestDoctype, func(doc json.RawMessage) error {
+		var d JSONDoc
+		assert.NoError(t, json.Unmarshal(doc, &d))
+		assert.NotContains(t, d.ID(), "_local/")
+		return nil
+	})
+	assert.NoError(t, err)
+
+	err = DeleteLocal(context.Background(), TestPrefix, TestDoctype, "checkpoint", fetched["_rev"].(string))
+	assert.NoError(t, err)
+	_, err = GetLocal(context.Background(), TestPrefix, TestDoctype, "checkpoint")
+	assert.True(t, IsNotFoundError(err))
+}
@@ -0,0 +1,120 @@
+package mango
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrInvalidSelector is used when a selector given by a client is not
+	// an object, or uses an unknown operator
+	ErrInvalidSelector = errors.New("The selector is not a valid mango selector")
+	// ErrInvalidSort is used when a sort given by a client is not a list of
+	// fields or of {"field": "asc" or "desc"} objects
+	ErrInvalidSort = errors.New("The sort is not a valid mango sort")
+)
+
+// selectorOperators are the operators accepted in the selectors given by
+// the clients, with true for the ones that combine selectors
+var selectorOperators = map[string]bool{
+	"$and": true, "$or": true, "$nor": true, "$not": true,
+	"$elemMatch": true, "$allMatch": true,
+	"$eq": false, "$ne": false, "$lt": false, "$lte": false, "$gt": false,
+	"$gte": false, "$exists": false, "$type": false, "$in": false,
+	"$nin": false, "$size": false, "$mod": false, "$regex": false,
+	"$all": false,
+}
+
+// rawFilter is a selector given as is by a client, like the applications
+// that query their doctypes with the data API
+type rawFilter map[string]interface{}
+
+func (rf rawFilter) ToMango() map[string]interface{} {
+	return rf
+}
+
+func (rf rawFilter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}(rf))
+}
+
+var _ Filter = rawFilter(nil)
+
+// ParseSelector returns the filter of a selector given in JSON by a client.
+// The selector must be an object, and only the operators of CouchDB are
+// accepted.
+func ParseSelector(raw json.RawMessage) (Filter, error) {
+	var sel map[string]interface{}
+	if err := json.Unmarshal(raw, &sel); err != nil || sel == nil {
+		return nil, ErrInvalidSelector
+	}
+	if !validSelector(sel) {
+		return nil, ErrInvalidSelector
+	}
+	return rawFilter(sel), nil
+}
+
+func validSelector(sel map[string]interface{}) bool {
+	for key, val := range sel {
+		if strings.HasPrefix(key, "$") {
+			combine, ok := selectorOperators[key]
+			if !ok {
+				return false
+			}
+			if combine && !validSubSelectors(val) {
+				return false
+			}
+			continue
+		}
+		if sub, ok := val.(map[string]interface{}); ok && !validSelector(sub) {
+			return false
+		}
+	}
+	return true
+}
+
+// validSubSelectors checks the argument of a combination operator: a
+// selector, or a list of selectors for $and, $or and $nor
+func validSubSelectors(val interface{}) bool {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		return validSelector(v)
+	case []interface{}:
+		for _, item := range v {
+			sub, ok := item.(map[string]interface{})
+			if !ok || !validSelector(sub) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// ParseSort returns the sort given in JSON by a client, as a list of fields
+// (sorted in the ascending order) or of {"field": "asc" or "desc"} objects
+func ParseSort(raw json.RawMessage) (SortFields, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, ErrInvalidSort
+	}
+	sort := make(SortFields, 0, len(items))
+	for _, item := range items {
+		var field string
+		if err := json.Unmarshal(item, &field); err == nil && field != "" {
+			sort = append(sort, SortBy{field, Asc})
+			continue
+		}
+		var obj map[string]SortDirection
+		if err := json.Unmarshal(item, &obj); err != nil || len(obj) != 1 {
+			return nil, ErrInvalidSort
+		}
+		for field, dir := range obj {
+			if field == "" || (dir != Asc && dir != Desc) {
+				return nil, ErrInvalidSort
+			}
+			sort = append(sort, SortBy{field, dir})
+		}
+	}
+	return sort, nil
+}
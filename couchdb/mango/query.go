@@ -2,6 +2,7 @@ package mango
 
 import (
 	"encoding/json"
+	"strings"
 	"unicode"
 )
 
@@ -29,6 +30,25 @@ const lt ValueOperator = "$lt"
 // Lte ($lte) checks that field <= value
 const lte ValueOperator = "$lte"
 
+// Ne ($ne) checks that field != value
+const ne ValueOperator = "$ne"
+
+// In ($in) checks that field is one of the values
+const in ValueOperator = "$in"
+
+// Nin ($nin) checks that field is none of the values
+const nin ValueOperator = "$nin"
+
+// Exists ($exists) checks that field exists (or not)
+const exists ValueOperator = "$exists"
+
+// Regex ($regex) checks that field matches a regular expression
+const regex ValueOperator = "$regex"
+
+// ElemMatch ($elemMatch) checks that an element of the field array matches
+// a filter
+const elemMatch ValueOperator = "$elemMatch"
+
 // LogicOperator is an operator between two filters
 type LogicOperator string
 
@@ -61,8 +81,12 @@ type valueFilter struct {
 }
 
 // ToMango implements the Filter interface on valueFilter
-// it returns a map, either `{field: value}` or `{field: {$op: value}}`
+// it returns a map, either `{field: value}` or `{field: {$op: value}}`, or
+// `{$op: value}` without field (for ElemMatch on an array of scalars)
 func (vf *valueFilter) ToMango() map[string]interface{} {
+	if vf.field == "" {
+		return makeMap(string(vf.op), vf.value)
+	}
 	var value interface{}
 	if vf.op == eq {
 		value = vf.value
@@ -153,6 +177,51 @@ func Lt(field string, value interface{}) Filter { return &valueFilter{field, lt,
 // Lte returns a filter that check if a field <= value
 func Lte(field string, value interface{}) Filter { return &valueFilter{field, lte, value} }
 
+// NotEqual returns a filter that check if a field != value
+func NotEqual(field string, value interface{}) Filter { return &valueFilter{field, ne, value} }
+
+// In returns a filter that check if a field is one of the values
+func In(field string, values ...interface{}) Filter {
+	if values == nil {
+		values = []interface{}{}
+	}
+	return &valueFilter{field, in, values}
+}
+
+// NotIn returns a filter that check if a field is none of the values
+func NotIn(field string, values ...interface{}) Filter {
+	if values == nil {
+		values = []interface{}{}
+	}
+	return &valueFilter{field, nin, values}
+}
+
+// Exists returns a filter that check if a field exists (or not, if
+// exist is false)
+func Exists(field string, exist bool) Filter { return &valueFilter{field, exists, exist} }
+
+// Regex returns a filter that check if a field's string value matches the
+// regular expression (with the Erlang syntax)
+func Regex(field string, pattern string) Filter { return &valueFilter{field, regex, pattern} }
+
+// ElemMatch returns a filter that check if at least one element of the
+// array field matches the filter. The fields of the filter are relative to
+// the elements, or empty for an array of scalars, like
+// ElemMatch("tags", Equal("", "foo")).
+func ElemMatch(field string, filter Filter) Filter {
+	return &valueFilter{field, elemMatch, filter.ToMango()}
+}
+
+// Field returns the name of a nested field, from the names of the fields on
+// its path, like Field("metadata", "exif.date") -> metadata.exif\.date
+func Field(names ...string) string {
+	escaped := make([]string, len(names))
+	for i, name := range names {
+		escaped[i] = strings.Replace(name, ".", "\\.", -1)
+	}
+	return strings.Join(escaped, ".")
+}
+
 // Between returns a filter that check if v1 <= field < v2
 func Between(field string, v1 interface{}, v2 interface{}) Filter {
 	return &logicFilter{op: and, filters: []Filter{
@@ -195,6 +264,19 @@ func (s SortBy) MarshalJSON() ([]byte, error) {
 	return json.Marshal(asSlice)
 }
 
+// SortFields is the sort of a couchdb.FindRequest, a list of sorting rules.
+// It is serialized as CouchDB expects it: [{"field": "asc"}, ...].
+type SortFields []SortBy
+
+// MarshalJSON implements json.Marshaller on SortFields
+func (s SortFields) MarshalJSON() ([]byte, error) {
+	rules := make([]map[string]SortDirection, len(s))
+	for i, rule := range s {
+		rules[i] = map[string]SortDirection{rule.Field: rule.Direction}
+	}
+	return json.Marshal(rules)
+}
+
 // utility function to create a map with a single key
 func makeMap(key string, value interface{}) map[string]interface{} {
 	out := make(map[string]interface{})
@@ -35,6 +35,44 @@ func TestQueryMarshaling(t *testing.T) {
 	DeepEqual(t, q4.ToMango(), M{"$not": M{"FolderID": "ab123"}})
 }
 
+func TestOperatorsMarshaling(t *testing.T) {
+	DeepEqual(t, NotEqual("type", "file").ToMango(),
+		M{"type": M{"$ne": "file"}})
+	DeepEqual(t, In("class", "image", "audio").ToMango(),
+		M{"class": M{"$in": S{"image", "audio"}}})
+	DeepEqual(t, In("class").ToMango(), M{"class": M{"$in": S{}}})
+	DeepEqual(t, NotIn("class", "pdf").ToMango(),
+		M{"class": M{"$nin": S{"pdf"}}})
+	DeepEqual(t, Exists("trashed", false).ToMango(),
+		M{"trashed": M{"$exists": false}})
+	DeepEqual(t, Regex("name", "^IMG_[0-9]+").ToMango(),
+		M{"name": M{"$regex": "^IMG_[0-9]+"}})
+	DeepEqual(t, Nor(Equal("a", 1), Equal("b", 2)).ToMango(),
+		M{"$nor": S{M{"a": 1}, M{"b": 2}}})
+}
+
+func TestElemMatchMarshaling(t *testing.T) {
+	q1 := ElemMatch("tags", Equal("", "foo"))
+	DeepEqual(t, q1.ToMango(), M{"tags": M{"$elemMatch": M{"$eq": "foo"}}})
+	q2 := ElemMatch("referenced_by", And(Equal("type", "album"), Gt("added", 3)))
+	DeepEqual(t, q2.ToMango(),
+		M{"referenced_by": M{"$elemMatch": M{"$and": S{
+			M{"type": "album"},
+			M{"added": M{"$gt": 3}},
+		}}}})
+	j, err := json.Marshal(q1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `{"tags":{"$elemMatch":{"$eq":"foo"}}}`, string(j))
+	}
+}
+
+func TestNestedField(t *testing.T) {
+	assert.Equal(t, "metadata.exif.date", Field("metadata", "exif", "date"))
+	assert.Equal(t, `metadata.exif\.date`, Field("metadata", "exif.date"))
+	DeepEqual(t, Exists(Field("metadata", "gps"), true).ToMango(),
+		M{"metadata.gps": M{"$exists": true}})
+}
+
 func TestSortMarshaling(t *testing.T) {
 	s1 := &SortBy{"folder_id", Asc}
 	j1, err := json.Marshal(s1)
@@ -42,3 +80,42 @@ func TestSortMarshaling(t *testing.T) {
 		assert.Equal(t, j1, []byte(`["folder_id","asc"]`))
 	}
 }
+
+func TestSortFieldsMarshaling(t *testing.T) {
+	s := SortFields{{"folder_id", Asc}, {"name", Desc}}
+	j, err := json.Marshal(s)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `[{"folder_id":"asc"},{"name":"desc"}]`, string(j))
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	f, err := ParseSelector(json.RawMessage(`{"year": {"$gt": 2010}, "$or": [{"tags": {"$in": ["a"]}}, {"draft": true}]}`))
+	if assert.NoError(t, err) {
+		DeepEqual(t, f, M{
+			"$or":  S{M{"tags": M{"$in": S{"a"}}}, M{"draft": true}},
+			"year": M{"$gt": 2010},
+		})
+	}
+
+	_, err = ParseSelector(json.RawMessage(`["year"]`))
+	assert.Equal(t, ErrInvalidSelector, err)
+	_, err = ParseSelector(json.RawMessage(`{"year": {"$where": "1"}}`))
+	assert.Equal(t, ErrInvalidSelector, err)
+	_, err = ParseSelector(json.RawMessage(`{"$or": [{"year": 2010}, 2011]}`))
+	assert.Equal(t, ErrInvalidSelector, err)
+}
+
+func TestParseSort(t *testing.T) {
+	s, err := ParseSort(json.RawMessage(`["year", {"name": "desc"}]`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, SortFields{{"year", Asc}, {"name", Desc}}, s)
+	}
+
+	_, err = ParseSort(json.RawMessage(`{"name": "desc"}`))
+	assert.Equal(t, ErrInvalidSort, err)
+	_, err = ParseSort(json.RawMessage(`[{"name": "up"}]`))
+	assert.Equal(t, ErrInvalidSort, err)
+	_, err = ParseSort(json.RawMessage(`[{"name": "asc", "year": "asc"}]`))
+	assert.Equal(t, ErrInvalidSort, err)
+}
@@ -0,0 +1,78 @@
+package couchdb
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cozy",
+		Subsystem: "couchdb",
+		Name:      "requests_total",
+		Help:      "Number of requests sent to CouchDB, without the retries",
+	}, []string{"method", "database"})
+
+	errorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cozy",
+		Subsystem: "couchdb",
+		Name:      "errors_total",
+		Help:      "Number of requests to CouchDB that have failed, after the retries",
+	}, []string{"method", "database"})
+
+	retriesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cozy",
+		Subsystem: "couchdb",
+		Name:      "retries_total",
+		Help:      "Number of requests to CouchDB that have been retried",
+	}, []string{"method", "database"})
+
+	durationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cozy",
+		Subsystem: "couchdb",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the requests to CouchDB, with the retries",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "database"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsCounter, errorsCounter, retriesCounter, durationHistogram)
+}
+
+// globalPrefix is the prefix of the databases shared by all the instances
+const globalPrefix = "global"
+
+// instanceDatabase is the label of the databases of the instances
+const instanceDatabase = "instance"
+
+// requestLabels returns the labels of the metrics for a request: its
+// method, and its database. The databases of the instances share the
+// "instance" label, as their prefixes and doctypes are not bounded. The
+// global databases keep their name, and the requests that are not for a
+// database, like _all_dbs, have their path as database.
+func requestLabels(method, path string) []string {
+	dbname := path
+	if i := strings.IndexAny(dbname, "/?"); i >= 0 {
+		dbname = dbname[:i]
+	}
+	if unescaped, err := url.QueryUnescape(dbname); err == nil {
+		dbname = unescaped
+	}
+	if i := strings.LastIndex(dbname, "/"); i >= 0 && dbname[:i] != globalPrefix {
+		dbname = instanceDatabase
+	}
+	return []string{method, dbname}
+}
+
+// observeRequest records the metrics of a request sent to CouchDB
+func observeRequest(labels []string, start time.Time, err error) {
+	requestsCounter.WithLabelValues(labels...).Inc()
+	durationHistogram.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+	if err != nil {
+		errorsCounter.WithLabelValues(labels...).Inc()
+	}
+}
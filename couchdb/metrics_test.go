@@ -0,0 +1,21 @@
+package couchdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLabels(t *testing.T) {
+	labels := requestLabels("POST", "bob-cozy-example%2Fio-cozy-files/_find")
+	assert.Equal(t, []string{"POST", "instance"}, labels)
+
+	labels = requestLabels("GET", "dev%2Fio-cozy-files/io.cozy.files.rootdir")
+	assert.Equal(t, []string{"GET", "instance"}, labels)
+
+	labels = requestLabels("GET", "_all_dbs")
+	assert.Equal(t, []string{"GET", "_all_dbs"}, labels)
+
+	labels = requestLabels("PUT", "global%2Finstances")
+	assert.Equal(t, []string{"PUT", "global/instances"}, labels)
+}
@@ -0,0 +1,114 @@
+package couchdb
+
+import (
+	"context"
+	"net/url"
+	"strings"
+)
+
+// ReplicatorDB is the database where CouchDB keeps the replications
+const ReplicatorDB = "_replicator"
+
+// ReplicationOptions are the options of a replication
+type ReplicationOptions struct {
+	// Continuous keeps the replication running, to replicate the future
+	// changes, instead of stopping once the target is up-to-date
+	Continuous bool
+	// CreateTarget creates the target database if it does not exist
+	CreateTarget bool
+	// DocIDs limits the replication to the documents with these IDs
+	DocIDs []string
+}
+
+// Replication is a document of the _replicator database
+type Replication struct {
+	ReplID       string   `json:"_id,omitempty"`
+	ReplRev      string   `json:"_rev,omitempty"`
+	Source       string   `json:"source"`
+	Target       string   `json:"target"`
+	Continuous   bool     `json:"continuous,omitempty"`
+	CreateTarget bool     `json:"create_target,omitempty"`
+	DocIDs       []string `json:"doc_ids,omitempty"`
+	// State is filled by CouchDB: triggered, completed or error
+	State       string `json:"_replication_state,omitempty"`
+	StateReason string `json:"_replication_state_reason,omitempty"`
+}
+
+// ID returns the replication identifier
+func (r *Replication) ID() string { return r.ReplID }
+
+// Rev returns the replication revision
+func (r *Replication) Rev() string { return r.ReplRev }
+
+// DocType returns the replication document type
+func (r *Replication) DocType() string { return ReplicatorDB }
+
+// SetID changes the replication identifier
+func (r *Replication) SetID(id string) { r.ReplID = id }
+
+// SetRev changes the replication revision
+func (r *Replication) SetRev(rev string) { r.ReplRev = rev }
+
+// DBURL returns the URL of the database of the given doctype, as seen by
+// CouchDB. It can be used as the source or target of a replication. It
+// contains the credentials of CouchDB, if any, and should not be shown.
+func DBURL(dbprefix, doctype string) string {
+	return couchURLWithCredentials() + makeDBName(dbprefix, doctype)
+}
+
+// Replicate asks CouchDB to replicate the source database to the target
+// database, by creating a document in the _replicator database. The
+// source and target are URLs of databases, see DBURL. The replication
+// runs in the background, its progress can be followed with
+// GetReplication.
+func Replicate(ctx context.Context, source, target string, opts *ReplicationOptions) (*Replication, error) {
+	repl := &Replication{Source: source, Target: target}
+	if opts != nil {
+		repl.Continuous = opts.Continuous
+		repl.CreateTarget = opts.CreateTarget
+		repl.DocIDs = opts.DocIDs
+	}
+	var res updateResponse
+	if err := makeRequest(ctx, "POST", ReplicatorDB, repl, &res); err != nil {
+		return nil, err
+	}
+	repl.SetID(res.ID)
+	repl.SetRev(res.Rev)
+	return repl, nil
+}
+
+// GetReplication fetches a replication with its current state
+func GetReplication(ctx context.Context, id string) (*Replication, error) {
+	var repl Replication
+	path := ReplicatorDB + "/" + url.QueryEscape(id)
+	if err := makeRequest(ctx, "GET", path, nil, &repl); err != nil {
+		return nil, err
+	}
+	return &repl, nil
+}
+
+// CancelReplication stops a replication by deleting its document
+func CancelReplication(ctx context.Context, repl *Replication) error {
+	_, err := Delete(ctx, "", ReplicatorDB, repl.ID(), repl.Rev())
+	return err
+}
+
+// ListDatabases returns the names of the databases with the given prefix,
+// as they can be used in DBURL with an empty prefix
+func ListDatabases(ctx context.Context, dbprefix string) ([]string, error) {
+	var all []string
+	if err := makeRequest(ctx, "GET", "_all_dbs", nil, &all); err != nil {
+		return nil, err
+	}
+	prefix, err := url.QueryUnescape(makeDBName(dbprefix, ""))
+	if err != nil {
+		return nil, err
+	}
+	var dbs []string
+	for _, db := range all {
+		if strings.HasPrefix(db, prefix) {
+			dbs = append(dbs, db)
+		}
+	}
+	return dbs, nil
+}
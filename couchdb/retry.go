@@ -0,0 +1,186 @@
+package couchdb
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling CouchDB when too many
+// requests have failed in a row, until the breaker cooldown is over
+var ErrCircuitOpen = errors.New("CouchDB is unavailable, requests are not sent")
+
+// RetryPolicy describes how the requests to CouchDB are retried on
+// transient failures, and when the circuit breaker opens
+type RetryPolicy struct {
+	// MaxRetries is the number of times an idempotent request is retried
+	// after a transient failure
+	MaxRetries int
+	// MinBackoff is the delay before the first retry. It doubles for each
+	// retry, with some jitter, up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// BreakerThreshold is the number of consecutive failed requests after
+	// which the circuit opens. Zero disables the circuit breaker.
+	BreakerThreshold int
+	// BreakerCooldown is how long the circuit stays open before a request
+	// is allowed to test if CouchDB is back
+	BreakerCooldown time.Duration
+}
+
+// DefaultRetryPolicy is the policy used if none has been configured
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:       3,
+	MinBackoff:       100 * time.Millisecond,
+	MaxBackoff:       2 * time.Second,
+	BreakerThreshold: 5,
+	BreakerCooldown:  30 * time.Second,
+}
+
+var retryPolicy = DefaultRetryPolicy
+var breaker = &circuitBreaker{}
+
+// UseRetryPolicy changes the retry policy for the next requests and
+// closes the circuit breaker
+func UseRetryPolicy(policy RetryPolicy) {
+	breaker.reset()
+	retryPolicy = policy
+}
+
+// Available returns false when the circuit breaker is open, ie CouchDB
+// has been failing and the requests are not sent
+func Available() bool {
+	return !breaker.isOpen(retryPolicy)
+}
+
+// backoff returns the delay to wait before the given retry (starting at 1)
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	// full jitter on the second half, to avoid synchronized retries
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// isIdempotent returns true for the requests that can safely be sent
+// several times. _find and _all_docs can be POST but only read documents.
+func isIdempotent(method, path string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	}
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	return strings.HasSuffix(path, "/_find") || strings.HasSuffix(path, "/_all_docs")
+}
+
+// isTransient returns true for the errors that may not happen again if
+// the same request is retried a bit later
+func isTransient(err error) bool {
+	couchErr, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+	switch couchErr.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return couchErr.Reason != "wrong_config"
+	}
+	return false
+}
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+}
+
+func (b *circuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openedAt = time.Time{}
+}
+
+func (b *circuitBreaker) isOpen(p RetryPolicy) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return p.BreakerThreshold > 0 && b.failures >= p.BreakerThreshold &&
+		time.Since(b.openedAt) < p.BreakerCooldown
+}
+
+// allow returns false if the circuit is open. When the cooldown is over,
+// the circuit is half-open: requests are sent, and the first failure opens
+// it again for another cooldown.
+func (b *circuitBreaker) allow(p RetryPolicy) bool {
+	return !b.isOpen(p)
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+func (b *circuitBreaker) failure(p RetryPolicy) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if p.BreakerThreshold > 0 && b.failures >= p.BreakerThreshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// doWithRetry sends a request with the retry policy and the circuit
+// breaker. The request is built again for each try, by the send function.
+// It stops waiting for the next try when the context is canceled.
+func doWithRetry(ctx context.Context, method, path string, send func() error) error {
+	policy := retryPolicy
+	if !breaker.allow(policy) {
+		return newUnavailableError(ErrCircuitOpen)
+	}
+
+	retries := 0
+	if isIdempotent(method, path) {
+		retries = policy.MaxRetries
+	}
+
+	var err error
+	for try := 0; ; try++ {
+		err = send()
+		if ctx.Err() != nil {
+			return err
+		}
+		if !isTransient(err) {
+			break
+		}
+		breaker.failure(policy)
+		if try >= retries || !breaker.allow(policy) {
+			return err
+		}
+		retriesCounter.WithLabelValues(requestLabels(method, path)...).Inc()
+		select {
+		case <-time.After(policy.backoff(try + 1)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	breaker.success()
+	return err
+}
@@ -0,0 +1,113 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testRetryPolicy = RetryPolicy{
+	MaxRetries:       2,
+	MinBackoff:       time.Millisecond,
+	MaxBackoff:       4 * time.Millisecond,
+	BreakerThreshold: 4,
+	BreakerCooldown:  50 * time.Millisecond,
+}
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for i := 0; i < 10; i++ {
+		d := p.backoff(1)
+		assert.True(t, d >= 50*time.Millisecond && d <= 100*time.Millisecond)
+		d = p.backoff(3)
+		assert.True(t, d >= 200*time.Millisecond && d <= 400*time.Millisecond)
+		d = p.backoff(10)
+		assert.True(t, d >= 500*time.Millisecond && d <= time.Second)
+	}
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	UseRetryPolicy(testRetryPolicy)
+	defer UseRetryPolicy(DefaultRetryPolicy)
+
+	tries := 0
+	err := doWithRetry(context.Background(), "GET", "db/doc", func() error {
+		tries++
+		if tries < 3 {
+			return &Error{StatusCode: http.StatusServiceUnavailable, Reason: "cant_connect"}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, tries)
+
+	// a POST is not idempotent and is not retried
+	tries = 0
+	err = doWithRetry(context.Background(), "POST", "db", func() error {
+		tries++
+		return &Error{StatusCode: http.StatusTooManyRequests}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, tries)
+
+	// the other errors are not retried
+	tries = 0
+	err = doWithRetry(context.Background(), "GET", "db/doc", func() error {
+		tries++
+		return &Error{StatusCode: http.StatusNotFound, Name: "not_found"}
+	})
+	assert.True(t, IsNotFoundError(err))
+	assert.Equal(t, 1, tries)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	UseRetryPolicy(testRetryPolicy)
+	defer UseRetryPolicy(DefaultRetryPolicy)
+
+	failing := func() error {
+		return &Error{StatusCode: http.StatusServiceUnavailable, Reason: "cant_connect"}
+	}
+	for i := 0; i < 2; i++ {
+		assert.Error(t, doWithRetry(context.Background(), "GET", "db/doc", failing))
+	}
+	assert.False(t, Available())
+
+	called := false
+	err := doWithRetry(context.Background(), "GET", "db/doc", func() error {
+		called = true
+		return nil
+	})
+	assert.False(t, called)
+	if couchErr, ok := err.(*Error); assert.True(t, ok) {
+		assert.Equal(t, ErrCircuitOpen, couchErr.Original)
+	}
+
+	// after the cooldown, a successful request closes the circuit
+	time.Sleep(testRetryPolicy.BreakerCooldown)
+	assert.True(t, Available())
+	assert.NoError(t, doWithRetry(context.Background(), "GET", "db/doc", func() error { return nil }))
+	assert.True(t, Available())
+}
+
+func TestCanceledContext(t *testing.T) {
+	UseRetryPolicy(testRetryPolicy)
+	defer UseRetryPolicy(DefaultRetryPolicy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	doc := &testDoc{}
+	err := GetDoc(ctx, TestPrefix, TestDoctype, "foo", doc)
+	assert.Equal(t, context.Canceled, err)
+
+	tries := 0
+	err = doWithRetry(ctx, "GET", "db/doc", func() error {
+		tries++
+		return &Error{StatusCode: http.StatusServiceUnavailable, Reason: "cant_connect"}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, tries)
+	assert.True(t, Available())
+}
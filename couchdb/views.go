@@ -0,0 +1,170 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+)
+
+// View is the definition of a map/reduce view. Each view is stored in its
+// own design document, named after the view, in the database of its
+// doctype.
+type View struct {
+	Name    string `json:"-"`
+	Doctype string `json:"-"`
+	Map     string `json:"map"`
+	Reduce  string `json:"reduce,omitempty"`
+}
+
+type designDoc struct {
+	ID       string           `json:"_id"`
+	Rev      string           `json:"_rev,omitempty"`
+	Language string           `json:"language"`
+	Views    map[string]*View `json:"views"`
+}
+
+// ViewRequest contains the parameters to query a view. Keys are
+// serialized as JSON.
+type ViewRequest struct {
+	Key         interface{}
+	StartKey    interface{}
+	EndKey      interface{}
+	Limit       int
+	Skip        int
+	Descending  bool
+	IncludeDocs bool
+	// Reduce can be set to false to query only the map part of a view
+	// that has a reduce function
+	Reduce     *bool
+	Group      bool
+	GroupLevel int
+}
+
+// ViewRow is a row of the results of a view. Doc is only filled when
+// IncludeDocs has been requested.
+type ViewRow struct {
+	ID    string          `json:"id"`
+	Key   interface{}     `json:"key"`
+	Value interface{}     `json:"value"`
+	Doc   json.RawMessage `json:"doc,omitempty"`
+}
+
+// ViewResponse is the result of a view query
+type ViewResponse struct {
+	TotalRows int        `json:"total_rows"`
+	Offset    int        `json:"offset"`
+	Rows      []*ViewRow `json:"rows"`
+}
+
+func designDocID(name string) string {
+	return "_design/" + name
+}
+
+func (v *View) sameAs(other *View) bool {
+	return other != nil && v.Map == other.Map && v.Reduce == other.Reduce
+}
+
+// DefineView creates or updates the design document of the given view.
+// It does nothing if the view is already defined with the same functions,
+// so it is safe to call it several times.
+// This function creates the database if it does not exist.
+func DefineView(ctx context.Context, dbprefix string, v *View) error {
+	id := designDocID(v.Name)
+	ddocURL := makeDBName(dbprefix, v.Doctype) + "/" + id
+
+	var ddoc designDoc
+	err := makeRequest(ctx, "GET", ddocURL, nil, &ddoc)
+	switch {
+	case IsNoDatabaseError(err):
+		if err = CreateDB(ctx, dbprefix, v.Doctype); err != nil {
+			return err
+		}
+	case IsNotFoundError(err):
+	case err != nil:
+		return err
+	case v.sameAs(ddoc.Views[v.Name]):
+		return nil
+	}
+
+	ddoc.ID = id
+	ddoc.Language = "javascript"
+	ddoc.Views = map[string]*View{v.Name: v}
+	return makeRequest(ctx, "PUT", ddocURL, &ddoc, nil)
+}
+
+// DefineViews defines all the given views, see DefineView
+func DefineViews(ctx context.Context, dbprefix string, views []*View) error {
+	for _, v := range views {
+		if err := DefineView(ctx, dbprefix, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryView queries the given view and returns its rows
+func QueryView(ctx context.Context, dbprefix string, v *View, req *ViewRequest) (*ViewResponse, error) {
+	params, err := req.values()
+	if err != nil {
+		return nil, err
+	}
+
+	id := designDocID(v.Name)
+	path := makeDBName(dbprefix, v.Doctype) + "/" + id + "/_view/" + v.Name
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+
+	var res ViewResponse
+	if err = makeRequest(ctx, "GET", path, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (req *ViewRequest) values() (url.Values, error) {
+	params := url.Values{}
+	if req == nil {
+		return params, nil
+	}
+
+	keys := map[string]interface{}{
+		"key":      req.Key,
+		"startkey": req.StartKey,
+		"endkey":   req.EndKey,
+	}
+	for name, key := range keys {
+		if key == nil {
+			continue
+		}
+		b, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		params.Set(name, string(b))
+	}
+
+	if req.Limit > 0 {
+		params.Set("limit", strconv.Itoa(req.Limit))
+	}
+	if req.Skip > 0 {
+		params.Set("skip", strconv.Itoa(req.Skip))
+	}
+	if req.Descending {
+		params.Set("descending", "true")
+	}
+	if req.IncludeDocs {
+		params.Set("include_docs", "true")
+	}
+	if req.Reduce != nil {
+		params.Set("reduce", strconv.FormatBool(*req.Reduce))
+	}
+	if req.Group {
+		params.Set("group", "true")
+	}
+	if req.GroupLevel > 0 {
+		params.Set("group_level", strconv.Itoa(req.GroupLevel))
+	}
+	return params, nil
+}
@@ -0,0 +1,135 @@
+// Package doctypes is the registry of the known doctypes. A doctype can be
+// registered with a JSON schema and a validation hook, that are applied to
+// the documents created and updated through the data API.
+package doctypes
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrAlreadyRegistered is used when a doctype is registered twice
+var ErrAlreadyRegistered = errors.New("The doctype is already registered")
+
+// ErrInvalidName is used when a doctype is registered without a name, or
+// with a name that can't be a doctype, like io.cozy..files
+var ErrInvalidName = errors.New("The name of the doctype is invalid")
+
+// ValidateFunc is a validation hook of a doctype, called with the document
+// after the JSON schema has been checked
+type ValidateFunc func(doc map[string]interface{}) ValidationErrors
+
+// Doctype is a known doctype. The Schema and the Validate hook are
+// optional.
+type Doctype struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Schema      *Schema      `json:"schema,omitempty"`
+	Validate    ValidateFunc `json:"-"`
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]*Doctype)
+)
+
+// Register adds a doctype to the registry. It is usually called from the
+// init function of the package that owns the doctype.
+func Register(dt *Doctype) error {
+	if !validName(dt.Name) {
+		return ErrInvalidName
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[dt.Name]; ok {
+		return ErrAlreadyRegistered
+	}
+	registry[dt.Name] = dt
+	return nil
+}
+
+// MustRegister is like Register, but panics if the doctype can't be
+// registered
+func MustRegister(dt *Doctype) {
+	if err := Register(dt); err != nil {
+		panic(dt.Name + ": " + err.Error())
+	}
+}
+
+// Unregister removes a doctype from the registry
+func Unregister(name string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(registry, name)
+}
+
+// Get returns the registered doctype with this name, or nil
+func Get(name string) *Doctype {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return registry[name]
+}
+
+// List returns the registered doctypes, sorted by name
+func List() []*Doctype {
+	registryMu.RLock()
+	list := make([]*Doctype, 0, len(registry))
+	for _, dt := range registry {
+		list = append(list, dt)
+	}
+	registryMu.RUnlock()
+	sort.Sort(byName(list))
+	return list
+}
+
+// Validate checks a document of a doctype against its schema and its
+// validation hook. The documents of the doctypes that are not registered
+// are always valid.
+func Validate(name string, doc map[string]interface{}) ValidationErrors {
+	dt := Get(name)
+	if dt == nil {
+		return nil
+	}
+	var errs ValidationErrors
+	if dt.Schema != nil {
+		errs = dt.Schema.validate("", withoutSpecialFields(doc), errs)
+	}
+	if len(errs) == 0 && dt.Validate != nil {
+		errs = dt.Validate(doc)
+	}
+	return errs
+}
+
+// withoutSpecialFields returns the document without the fields of CouchDB,
+// like _id and _rev, that are not part of the schema of the doctype
+func withoutSpecialFields(doc map[string]interface{}) map[string]interface{} {
+	fields := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		if !strings.HasPrefix(k, "_") {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// validName returns true if the name can be the one of a doctype, like
+// io.cozy.files
+func validName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "_") {
+		return false
+	}
+	for _, part := range strings.Split(name, ".") {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
+
+type byName []*Doctype
+
+func (l byName) Len() int           { return len(l) }
+func (l byName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byName) Less(i, j int) bool { return l[i].Name < l[j].Name }
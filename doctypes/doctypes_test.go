@@ -0,0 +1,120 @@
+package doctypes
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["name"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 1, "maxLength": 10},
+		"age": {"type": "integer", "minimum": 0},
+		"kind": {"enum": ["cat", "dog"]},
+		"tags": {"type": "array", "items": {"type": "string"}},
+		"owner": {"type": ["object", "null"], "required": ["id"]}
+	}
+}`
+
+func parseDoc(t *testing.T, data string) map[string]interface{} {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestRegister(t *testing.T) {
+	dt := &Doctype{Name: "io.cozy.tests.register"}
+	assert.NoError(t, Register(dt))
+	defer Unregister(dt.Name)
+	assert.Equal(t, ErrAlreadyRegistered, Register(&Doctype{Name: dt.Name}))
+	assert.Equal(t, ErrInvalidName, Register(&Doctype{Name: ""}))
+	assert.Equal(t, ErrInvalidName, Register(&Doctype{Name: "io.cozy..tests"}))
+	assert.Equal(t, ErrInvalidName, Register(&Doctype{Name: "_users"}))
+
+	assert.Equal(t, dt, Get(dt.Name))
+	assert.Nil(t, Get("io.cozy.tests.unknown"))
+	assert.Contains(t, List(), dt)
+}
+
+func TestList(t *testing.T) {
+	MustRegister(&Doctype{Name: "io.cozy.tests.b"})
+	MustRegister(&Doctype{Name: "io.cozy.tests.a"})
+	defer Unregister("io.cozy.tests.a")
+	defer Unregister("io.cozy.tests.b")
+	var names []string
+	for _, dt := range List() {
+		names = append(names, dt.Name)
+	}
+	assert.Equal(t, []string{"io.cozy.tests.a", "io.cozy.tests.b"}, names)
+}
+
+func TestValidateSchema(t *testing.T) {
+	name := "io.cozy.tests.pets"
+	MustRegister(&Doctype{Name: name, Schema: MustParseSchema(testSchema)})
+	defer Unregister(name)
+
+	valid := parseDoc(t, `{"_id": "42", "_rev": "1-abc", "name": "Rex", "age": 3,
+		"kind": "dog", "tags": ["good"], "owner": null}`)
+	assert.Empty(t, Validate(name, valid))
+
+	errs := Validate(name, parseDoc(t, `{"age": 2.5, "kind": "fish", "color": "red"}`))
+	assert.Equal(t, ValidationErrors{
+		{Field: "/name", Message: "is required"},
+		{Field: "/age", Message: "must be of type integer"},
+		{Field: "/color", Message: "is not allowed"},
+		{Field: "/kind", Message: "must be one of the allowed values"},
+	}, errs)
+
+	errs = Validate(name, parseDoc(t, `{"name": "", "age": -1, "tags": ["a", 1], "owner": {}}`))
+	assert.Equal(t, ValidationErrors{
+		{Field: "/age", Message: "must be greater than or equal to 0"},
+		{Field: "/name", Message: "must be at least 1 characters long"},
+		{Field: "/owner/id", Message: "is required"},
+		{Field: "/tags/1", Message: "must be of type string"},
+	}, errs)
+
+	// the documents of unknown doctypes are not validated
+	assert.Empty(t, Validate("io.cozy.tests.unknown", parseDoc(t, `{"foo": 1}`)))
+}
+
+func TestValidateHook(t *testing.T) {
+	name := "io.cozy.tests.hook"
+	MustRegister(&Doctype{
+		Name:   name,
+		Schema: MustParseSchema(`{"type": "object", "required": ["a"]}`),
+		Validate: func(doc map[string]interface{}) ValidationErrors {
+			if doc["a"] == doc["b"] {
+				return ValidationErrors{{Field: "/b", Message: "must be different of a"}}
+			}
+			return nil
+		},
+	})
+	defer Unregister(name)
+
+	assert.Empty(t, Validate(name, parseDoc(t, `{"a": 1, "b": 2}`)))
+	errs := Validate(name, parseDoc(t, `{"a": 1, "b": 1}`))
+	assert.Equal(t, ValidationErrors{{Field: "/b", Message: "must be different of a"}}, errs)
+	assert.Equal(t, "Invalid document: /b: must be different of a", errs.Error())
+
+	// the hook is not called if the schema is not matched
+	errs = Validate(name, parseDoc(t, `{"b": 1}`))
+	assert.Equal(t, ValidationErrors{{Field: "/a", Message: "is required"}}, errs)
+}
+
+func TestSchemaJSON(t *testing.T) {
+	s := MustParseSchema(`{"type": "string", "properties": {"a": {"type": ["string", "null"]}}}`)
+	assert.Equal(t, SchemaType{"string"}, s.Type)
+	assert.Equal(t, SchemaType{"string", "null"}, s.Properties["a"].Type)
+	out, err := json.Marshal(s)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"type":"string","properties":{"a":{"type":["string","null"]}}}`, string(out))
+
+	_, err = ParseSchema([]byte(`{"type": 42}`))
+	assert.Error(t, err)
+}
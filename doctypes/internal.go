@@ -0,0 +1,43 @@
+package doctypes
+
+import "strings"
+
+// internal are the doctypes where the stack keeps the secrets and the
+// rights of the instance, like the passphrase, the sessions or the tokens of
+// the applications, and the doctypes managed by the stack, like the files or
+// the notifications. Their documents, and the ones of their sub-doctypes
+// like io.cozy.apps.tokens, can only be accessed with the routes of the
+// stack that manage them.
+var internal = []string{
+	"io.cozy.apps",
+	"io.cozy.manifests",
+	"io.cozy.konnectors",
+	"io.cozy.settings",
+	"io.cozy.sessions",
+	"io.cozy.sharings",
+	"io.cozy.oauth",
+	"io.cozy.jobs",
+	"io.cozy.triggers",
+	"io.cozy.files",
+	"io.cozy.intents",
+	"io.cozy.notifications",
+}
+
+// IsInternal returns true if the doctype is one of the internal doctypes of
+// the stack, or one of their sub-doctypes
+func IsInternal(doctype string) bool {
+	for _, name := range internal {
+		if doctype == name || strings.HasPrefix(doctype, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Internal returns the internal doctypes of the stack, without their
+// sub-doctypes
+func Internal() []string {
+	list := make([]string, len(internal))
+	copy(list, internal)
+	return list
+}
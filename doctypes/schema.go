@@ -0,0 +1,228 @@
+package doctypes
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is the subset of JSON schema supported for the documents: the
+// type of a value, the properties and required fields of an object, the
+// items of an array, the enumerated values, and the bounds of a string or
+// a number.
+type Schema struct {
+	Type                 SchemaType         `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+}
+
+// SchemaType is the list of the allowed types of a value, like "string" or
+// ["string", "null"]. It is empty to allow all the types.
+type SchemaType []string
+
+// MarshalJSON writes a single type as a string, like in most schemas
+func (t SchemaType) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+// UnmarshalJSON reads a type as a string or a list of strings
+func (t *SchemaType) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = SchemaType{one}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*t = SchemaType(list)
+	return nil
+}
+
+// ValidationError is a field of a document that doesn't match the schema
+// of its doctype. The Field is a JSON pointer, like /address/city.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is the list of the validation errors of a document
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Field + ": " + e.Message
+	}
+	return "Invalid document: " + strings.Join(msgs, ", ")
+}
+
+// ParseSchema reads a JSON schema
+func ParseSchema(data []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// MustParseSchema is like ParseSchema, but panics if the schema is invalid.
+// It is meant for the schemas declared in the code.
+func MustParseSchema(data string) *Schema {
+	s, err := ParseSchema([]byte(data))
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// validate checks the value at the given JSON pointer, and returns errs
+// with the errors of this value appended
+func (s *Schema) validate(pointer string, value interface{}, errs ValidationErrors) ValidationErrors {
+	field := pointer
+	if field == "" {
+		field = "/"
+	}
+	fail := func(format string, args ...interface{}) ValidationErrors {
+		return append(errs, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	kind := jsonType(value)
+	if len(s.Type) > 0 && !s.allowsType(kind, value) {
+		return fail("must be of type %s", strings.Join(s.Type, " or "))
+	}
+	if len(s.Enum) > 0 && !s.inEnum(value) {
+		return fail("must be one of the allowed values")
+	}
+
+	switch v := value.(type) {
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fail("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fail("must be at most %d characters long", *s.MaxLength)
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				errs = append(errs, ValidationError{
+					Field:   pointer + "/" + name,
+					Message: "is required",
+				})
+			}
+		}
+		// the fields are checked in a stable order, for the order of the
+		// errors
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := v[name]
+			if prop, ok := s.Properties[name]; ok {
+				errs = prop.validate(pointer+"/"+name, child, errs)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				errs = append(errs, ValidationError{
+					Field:   pointer + "/" + name,
+					Message: "is not allowed",
+				})
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				errs = s.Items.validate(fmt.Sprintf("%s/%d", pointer, i), item, errs)
+			}
+		}
+	default:
+		if n, ok := toFloat(value); ok {
+			if s.Minimum != nil && n < *s.Minimum {
+				return fail("must be greater than or equal to %v", *s.Minimum)
+			}
+			if s.Maximum != nil && n > *s.Maximum {
+				return fail("must be less than or equal to %v", *s.Maximum)
+			}
+		}
+	}
+	return errs
+}
+
+func (s *Schema) allowsType(kind string, value interface{}) bool {
+	for _, t := range s.Type {
+		if t == kind {
+			return true
+		}
+		if t == "integer" && kind == "number" {
+			if n, _ := toFloat(value); n == math.Trunc(n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Schema) inEnum(value interface{}) bool {
+	for _, allowed := range s.Enum {
+		if a, ok := toFloat(allowed); ok {
+			if n, ok := toFloat(value); ok && a == n {
+				return true
+			}
+			continue
+		}
+		if reflect.DeepEqual(allowed, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType returns the JSON schema type of a decoded JSON value
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	if _, ok := toFloat(value); ok {
+		return "number"
+	}
+	return "unknown"
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
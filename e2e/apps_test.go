@@ -0,0 +1,768 @@
+// +build e2e
+
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/stretchr/testify/assert"
+)
+
+// createFixtureApp creates a git repository in a temporary directory
+// with a minimal application inside it.
+func createFixtureApp(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cozy-e2e-app")
+	if !assert.NoError(t, err) {
+		return "", func() {}
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	manifest := `{"name": "Mini", "slug": "mini", "description": "A fixture app", "version": "1.0.0", "license": "AGPL-3.0", "permissions": {"data/io.cozy.contacts": {"description": "Fixture", "access": "read"}, "jobs/log": {"description": "Fixture"}}, "routes": {"/": {"folder": "/", "index": "index.html"}}}`
+	files := map[string]string{
+		"manifest.webapp": manifest,
+		"index.html":      "<!DOCTYPE html><html><body>mini</body></html>",
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if !assert.NoError(t, err) {
+			return "", cleanup
+		}
+	}
+
+	cmds := [][]string{
+		{"git", "init", "-q"},
+		{"git", "add", "."},
+		{"git", "-c", "user.name=e2e", "-c", "user.email=e2e@cozy.local", "commit", "-q", "-m", "Fixture"},
+	}
+	for _, args := range cmds {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+	}
+	return dir, cleanup
+}
+
+func TestInstallApp(t *testing.T) {
+	dir, cleanup := createFixtureApp(t)
+	defer cleanup()
+
+	// a local source is only accepted from the command line
+	src := "file://" + dir
+	res, err := doRequest("POST", "/apps/mini?Source="+src, "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 403, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	res, err = doAdminRequest("POST", "/apps/mini?Source="+src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 202, res.StatusCode)
+	man := readResource(t, res)
+	if !assert.NotNil(t, man) {
+		return
+	}
+	assert.Equal(t, apps.ManifestDocType, man.Type)
+	assert.Equal(t, "mini", man.Attributes["slug"])
+
+	var state interface{}
+	for i := 0; i < 50; i++ {
+		res, err = doRequest("GET", "/apps/", "", nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		doc := readDocument(t, res)
+		var list []*resource
+		if doc != nil && json.Unmarshal(doc.Data, &list) == nil && len(list) > 0 {
+			state = list[0].Attributes["state"]
+			if state == apps.Ready || state == apps.Errored {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, apps.Ready, state)
+
+	res, err = doRequest("GET", "/files/metadata?Path="+apps.AppsDirectory+"/mini/index.html", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		readResource(t, res)
+	}
+}
+
+func TestUpdateApp(t *testing.T) {
+	dir, cleanup := createFixtureApp(t)
+	defer cleanup()
+
+	src := "file://" + dir
+	res, err := doAdminRequest("POST", "/apps/mini-update?Source="+src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 202, res.StatusCode)
+	readResource(t, res)
+	assert.Equal(t, apps.Ready, waitAppState(t, "mini-update"))
+
+	manifest := `{"name": "Mini", "slug": "mini", "description": "A fixture app", "version": "1.1.0", "license": "AGPL-3.0", "permissions": {"data/io.cozy.contacts": {"description": "Fixture", "access": "read"}}, "routes": {"/": {"folder": "/", "index": "index.html"}}}`
+	err = ioutil.WriteFile(filepath.Join(dir, "manifest.webapp"), []byte(manifest), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cmd := exec.Command("git", "-c", "user.name=e2e", "-c", "user.email=e2e@cozy.local", "commit", "-q", "-a", "-m", "Bump")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	res, err = doAdminRequest("PUT", "/apps/mini-update")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 202, res.StatusCode)
+	man := readResource(t, res)
+	if assert.NotNil(t, man) {
+		assert.Equal(t, "1.1.0", man.Attributes["version"])
+	}
+	assert.Equal(t, apps.Ready, waitAppState(t, "mini-update"))
+
+	res, err = doRequest("GET", "/files/metadata?Path="+apps.AppsDirectory+"/.mini-update.old/index.html", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		readResource(t, res)
+	}
+
+	res, err = doRequest("POST", "/apps/mini-update/rollback", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		man = readResource(t, res)
+		if assert.NotNil(t, man) {
+			assert.Equal(t, "1.0.0", man.Attributes["version"])
+			assert.Equal(t, "1.1.0", man.Attributes["previous_version"])
+			assert.Equal(t, apps.Ready, man.Attributes["state"])
+		}
+	}
+
+	// a second rollback cancels the first one
+	res, err = doRequest("POST", "/apps/mini-update/rollback", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		man = readResource(t, res)
+		if assert.NotNil(t, man) {
+			assert.Equal(t, "1.1.0", man.Attributes["version"])
+			assert.Equal(t, "1.0.0", man.Attributes["previous_version"])
+		}
+	}
+
+	res, err = doRequest("POST", "/apps/unknown/rollback", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		readDocument(t, res)
+	}
+}
+
+func TestUpdateAllApps(t *testing.T) {
+	dir, cleanup := createFixtureApp(t)
+	defer cleanup()
+
+	src := "file://" + dir
+	res, err := doAdminRequest("POST", "/apps/mini-all?Source="+src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 202, res.StatusCode)
+	readResource(t, res)
+	assert.Equal(t, apps.Ready, waitAppState(t, "mini-all"))
+
+	findResult := func(report *apps.UpdateReport) *apps.UpdateResult {
+		for _, r := range report.Results {
+			if r.Slug == "mini-all" {
+				return r
+			}
+		}
+		return nil
+	}
+
+	ctx := context.Background()
+	report, err := apps.UpdateAll(ctx, testInstance)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testInstance.Domain, report.Domain)
+		if r := findResult(report); assert.NotNil(t, r) {
+			assert.Equal(t, apps.UpdateUpToDate, r.Status)
+			assert.Equal(t, "1.0.0", r.NewVersion)
+		}
+	}
+
+	manifest := `{"name": "Mini", "slug": "mini", "description": "A fixture app", "version": "1.1.0", "license": "AGPL-3.0", "permissions": {"data/io.cozy.contacts": {"description": "Fixture", "access": "read"}}, "routes": {"/": {"folder": "/", "index": "index.html"}}}`
+	err = ioutil.WriteFile(filepath.Join(dir, "manifest.webapp"), []byte(manifest), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cmd := exec.Command("git", "-c", "user.name=e2e", "-c", "user.email=e2e@cozy.local", "commit", "-q", "-a", "-m", "Bump")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	report, err = apps.UpdateAll(ctx, testInstance)
+	if assert.NoError(t, err) {
+		if r := findResult(report); assert.NotNil(t, r) {
+			assert.Equal(t, apps.UpdateUpdated, r.Status)
+			assert.Equal(t, "1.0.0", r.OldVersion)
+			assert.Equal(t, "1.1.0", r.NewVersion)
+			assert.NoError(t, r.Error)
+		}
+		assert.True(t, report.Count(apps.UpdateUpdated) >= 1)
+	}
+	assert.Equal(t, apps.Ready, waitAppState(t, "mini-all"))
+}
+
+func TestUninstallApp(t *testing.T) {
+	res, err := doRequest("DELETE", "/apps/unknown", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	dir, cleanup := createFixtureApp(t)
+	defer cleanup()
+
+	src := "file://" + dir
+	res, err = doAdminRequest("POST", "/apps/mini-uninstall?Source="+src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 202, res.StatusCode)
+	readResource(t, res)
+	assert.Equal(t, apps.Ready, waitAppState(t, "mini-uninstall"))
+
+	res, err = doRequest("DELETE", "/apps/mini-uninstall", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 204, res.StatusCode)
+		res.Body.Close()
+	}
+	assert.Nil(t, waitAppState(t, "mini-uninstall"))
+
+	res, err = doRequest("GET", "/files/metadata?Path="+apps.AppsDirectory+"/mini-uninstall", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		readDocument(t, res)
+	}
+}
+
+func TestAppScopes(t *testing.T) {
+	res, err := doAppRequest("GET", "/data/io.cozy.contacts/unknown", "not-a-token")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 401, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	dir, cleanup := createFixtureApp(t)
+	defer cleanup()
+
+	src := "file://" + dir
+	res, err = doAdminRequest("POST", "/apps/mini-scopes?Source="+src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 202, res.StatusCode)
+	readResource(t, res)
+	assert.Equal(t, apps.Ready, waitAppState(t, "mini-scopes"))
+
+	res, err = doRequest("POST", "/apps/mini-scopes/token", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 201, res.StatusCode)
+	token := readResource(t, res)
+	if !assert.NotNil(t, token) {
+		return
+	}
+
+	// the manifest has a read-only scope on io.cozy.contacts
+	res, err = doAppRequest("GET", "/data/io.cozy.contacts/unknown", token.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		res.Body.Close()
+	}
+	res, err = doAppRequest("DELETE", "/data/io.cozy.contacts/unknown", token.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 403, res.StatusCode)
+		readDocument(t, res)
+	}
+	res, err = doAppRequest("GET", "/data/io.cozy.events/unknown", token.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 403, res.StatusCode)
+		readDocument(t, res)
+	}
+	res, err = doAppRequest("GET", "/files/download/unknown-id", token.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 403, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	// the jobs of an event trigger have the documents of its doctype
+	addTrigger := func(doctype string) *http.Response {
+		body := `{"data": {"type": "io.cozy.triggers", "attributes": {"type": "@event", "arguments": "` + doctype + `", "worker": "log"}}}`
+		req, err := http.NewRequest("POST", ts.URL+"/jobs/triggers", strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		req.Host = domain
+		req.Header.Add("Authorization", "Bearer "+token.ID)
+		req.Header.Add("Content-Type", jsonapi.ContentType)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return res
+	}
+	res = addTrigger("io.cozy.events")
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 403, res.StatusCode)
+		readDocument(t, res)
+	}
+	res = addTrigger("io.cozy.contacts")
+	if assert.NotNil(t, res) && assert.Equal(t, 201, res.StatusCode) {
+		if trigger := readResource(t, res); assert.NotNil(t, trigger) {
+			res, err = doRequest("DELETE", "/jobs/triggers/"+trigger.ID, "", nil)
+			if assert.NoError(t, err) {
+				assert.Equal(t, 204, res.StatusCode)
+				res.Body.Close()
+			}
+		}
+	}
+
+	// the token issued at the installation has the same scopes
+	res, err = doRequest("GET", "/apps/mini-scopes", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	man := readResource(t, res)
+	if !assert.NotNil(t, man) {
+		return
+	}
+	appToken, _ := man.Attributes["token"].(string)
+	if assert.NotEmpty(t, appToken) {
+		res, err = doAppRequest("GET", "/data/io.cozy.contacts/unknown", appToken)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 404, res.StatusCode)
+			res.Body.Close()
+		}
+		res, err = doAppRequest("GET", "/data/io.cozy.events/unknown", appToken)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 403, res.StatusCode)
+			readDocument(t, res)
+		}
+		forged := appToken[:strings.LastIndex(appToken, ".")+1] + "forged"
+		res, err = doAppRequest("GET", "/data/io.cozy.contacts/unknown", forged)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 401, res.StatusCode)
+			readDocument(t, res)
+		}
+	}
+
+	// the tokens are removed with the application
+	res, err = doRequest("DELETE", "/apps/mini-scopes", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 204, res.StatusCode)
+		res.Body.Close()
+	}
+	res, err = doAppRequest("GET", "/data/io.cozy.contacts/unknown", token.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 401, res.StatusCode)
+		readDocument(t, res)
+	}
+	res, err = doAppRequest("GET", "/data/io.cozy.contacts/unknown", appToken)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 401, res.StatusCode)
+		readDocument(t, res)
+	}
+}
+
+func TestAppEvents(t *testing.T) {
+	res, err := doRequest("GET", "/apps/unknown/events", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	dir, cleanup := createFixtureApp(t)
+	defer cleanup()
+
+	src := "file://" + dir
+	res, err = doAdminRequest("POST", "/apps/mini-events?Source="+src)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 202, res.StatusCode)
+	readResource(t, res)
+
+	// the stream ends with the done event, whether it starts before or
+	// after the end of the installation
+	res, err = doRequest("GET", "/apps/mini-events/events", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Content-Type"), "text/event-stream")
+	body, err := ioutil.ReadAll(res.Body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var last map[string]interface{}
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "data:") {
+			last = nil
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &last)
+		}
+	}
+	if assert.NotNil(t, last) {
+		assert.Equal(t, "mini-events", last["slug"])
+		assert.Equal(t, apps.StepDone, last["step"])
+		assert.Equal(t, apps.Ready, last["state"])
+	}
+}
+
+func TestAppLock(t *testing.T) {
+	dir, cleanup := createFixtureApp(t)
+	defer cleanup()
+
+	// another process of the stack is installing the application
+	ctx := context.Background()
+	db := testInstance.GetDatabasePrefix()
+	lease := couchdb.JSONDoc{
+		Type: apps.LeaseDocType,
+		M: map[string]interface{}{
+			"_id":        "mini-locked",
+			"owner":      "another-process",
+			"expires_at": time.Now().Add(time.Minute),
+		},
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDocWithDB(ctx, db, lease)) {
+		return
+	}
+
+	src := "file://" + dir
+	res, err := doAdminRequest("POST", "/apps/mini-locked?Source="+src)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 409, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	// the lease of a process that has been stopped expires
+	lease.M["expires_at"] = time.Now().Add(-time.Minute)
+	if !assert.NoError(t, couchdb.UpdateDoc(ctx, db, lease)) {
+		return
+	}
+	res, err = doAdminRequest("POST", "/apps/mini-locked?Source="+src)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 202, res.StatusCode)
+		readResource(t, res)
+	}
+	assert.Equal(t, apps.Ready, waitAppState(t, "mini-locked"))
+}
+
+func TestRecoverApps(t *testing.T) {
+	dir, cleanup := createFixtureApp(t)
+	defer cleanup()
+
+	// an installation interrupted by a stop of the stack, in the middle
+	// of a git clone
+	ctx := context.Background()
+	db := testInstance.GetDatabasePrefix()
+	vfsC, err := testInstance.GetVFSContext(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	man := &apps.Manifest{
+		Name:    "Mini",
+		Slug:    "mini-recover",
+		Source:  "file://" + dir,
+		State:   apps.Installing,
+		Version: "1.0.0",
+	}
+	man.SetID(man.Slug)
+	if !assert.NoError(t, couchdb.CreateNamedDocWithDB(ctx, db, man)) {
+		return
+	}
+	if !assert.NoError(t, vfsC.MkdirAll(apps.AppsDirectory+"/mini-recover/.git/objects")) {
+		return
+	}
+
+	// the installation is still running in another process of the stack
+	lease := couchdb.JSONDoc{
+		Type: apps.LeaseDocType,
+		M: map[string]interface{}{
+			"_id":        "mini-recover",
+			"owner":      "another-process",
+			"expires_at": time.Now().Add(time.Minute),
+		},
+	}
+	if !assert.NoError(t, couchdb.CreateNamedDocWithDB(ctx, db, lease)) {
+		return
+	}
+	assert.NoError(t, apps.Recover(ctx, vfsC, db))
+	recovering, err := apps.GetBySlug(ctx, db, apps.Webapp, "mini-recover")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, apps.Installing, recovering.State)
+	}
+	_, err = vfsC.Stat(apps.AppsDirectory + "/mini-recover/.git/objects")
+	assert.NoError(t, err)
+
+	// the process has been stopped, and its lease has expired
+	lease.M["expires_at"] = time.Now().Add(-time.Minute)
+	if !assert.NoError(t, couchdb.UpdateDoc(ctx, db, lease)) {
+		return
+	}
+	assert.NoError(t, apps.Recover(ctx, vfsC, db))
+	assert.Equal(t, apps.Ready, waitAppState(t, "mini-recover"))
+
+	res, err := doRequest("GET", "/files/metadata?Path="+apps.AppsDirectory+"/mini-recover/index.html", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		readResource(t, res)
+	}
+	res, err = doRequest("GET", "/files/metadata?Path="+apps.AppsDirectory+"/mini-recover/.git", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		readDocument(t, res)
+	}
+}
+
+func TestServeApp(t *testing.T) {
+	dir, cleanup := createFixtureApp(t)
+	defer cleanup()
+
+	res, err := doAdminRequest("POST", "/apps/serve-mini?Source=file://"+dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, apps.Ready, waitAppState(t, "serve-mini")) {
+		return
+	}
+
+	get := func(path string) (*http.Response, error) {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Host = "serve-mini." + domain
+		return http.DefaultClient.Do(req)
+	}
+
+	res, err = get("/")
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+		assert.Equal(t, "private, no-cache", res.Header.Get("Cache-Control"))
+		assert.NotEmpty(t, res.Header.Get("Etag"))
+		assert.Contains(t, string(body), "mini")
+	}
+
+	res, err = get("/manifest.webapp")
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "private, max-age=3600", res.Header.Get("Cache-Control"))
+	}
+
+	res, err = get("/missing.js")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/", nil)
+	req.Host = "unknown." + domain
+	res, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		readDocument(t, res)
+	}
+}
+
+func TestFailedInstallCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-e2e-konnector")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	manifest := `{"name": "Broken", "slug": "broken", "type": "konnector", "version": "1.0.0", "entrypoint": "missing.js", "permissions": {}}`
+	files := map[string]string{
+		"manifest.konnector": manifest,
+		"index.js":           "console.log('broken')",
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	res, err := doAdminRequest("POST", "/konnectors/broken?Source=file://"+dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 202, res.StatusCode)
+	res.Body.Close()
+
+	var man *resource
+	for i := 0; i < 50; i++ {
+		res, err = doRequest("GET", "/konnectors/broken", "", nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		man = readResource(t, res)
+		if man != nil && man.Attributes["state"] == apps.Errored {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if assert.NotNil(t, man) {
+		assert.Equal(t, apps.Errored, man.Attributes["state"])
+		assert.Equal(t, "install", man.Attributes["errored_op"])
+		assert.NotEmpty(t, man.Attributes["errored_at"])
+	}
+
+	// the partial files of the failed installation have been removed
+	res, err = doRequest("GET", "/files/metadata?Path="+apps.KonnectorsDirectory+"/broken", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		res.Body.Close()
+	}
+
+	ctx := context.Background()
+	vfsC, err := testInstance.GetVFSContext(ctx)
+	if assert.NoError(t, err) {
+		err = apps.SweepErrored(ctx, vfsC, testInstance.GetDatabasePrefix(), 0)
+		assert.NoError(t, err)
+	}
+}
+
+// waitAppState waits for the installed application with the given slug to
+// be ready or errored, and returns its state
+func waitAppState(t *testing.T, slug string) interface{} {
+	var state interface{}
+	for i := 0; i < 50; i++ {
+		res, err := doRequest("GET", "/apps/"+slug, "", nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		if res.StatusCode == 200 {
+			if man := readResource(t, res); man != nil {
+				state = man.Attributes["state"]
+			}
+			if state == apps.Ready || state == apps.Errored {
+				break
+			}
+		} else {
+			res.Body.Close()
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return state
+}
+
+func TestShowAndListApps(t *testing.T) {
+	dir, cleanup := createFixtureApp(t)
+	defer cleanup()
+
+	src := "file://" + dir
+	for _, slug := range []string{"list-a", "list-b"} {
+		res, err := doAdminRequest("POST", "/apps/"+slug+"?Source="+src)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 202, res.StatusCode)
+		res.Body.Close()
+		assert.Equal(t, apps.Ready, waitAppState(t, slug))
+	}
+
+	res, err := doRequest("GET", "/apps/list-a", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		man := readResource(t, res)
+		if assert.NotNil(t, man) {
+			assert.Equal(t, apps.ManifestDocType, man.Type)
+			assert.Equal(t, "list-a", man.Attributes["slug"])
+			assert.Equal(t, apps.Ready, man.Attributes["state"])
+			assert.Equal(t, src, man.Attributes["source"])
+			assert.NotEmpty(t, man.Attributes["version"])
+		}
+	}
+
+	res, err = doRequest("GET", "/apps/no-such-app", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	res, err = doRequest("GET", "/apps/?state=sleeping", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 422, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	res, err = doRequest("GET", "/apps/?page[limit]=zero", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 422, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	seen := map[string]bool{}
+	next := "/apps/?state=ready&page[limit]=1"
+	for i := 0; next != "" && i < 20; i++ {
+		res, err = doRequest("GET", next, "", nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 200, res.StatusCode)
+		doc := readDocument(t, res)
+		if doc == nil {
+			return
+		}
+		var list []*resource
+		assert.NoError(t, json.Unmarshal(doc.Data, &list))
+		assert.True(t, len(list) <= 1)
+		for _, app := range list {
+			assert.Equal(t, apps.Ready, app.Attributes["state"])
+			seen[app.Attributes["slug"].(string)] = true
+		}
+		assert.True(t, doc.Meta["count"].(float64) >= 2)
+		next, _ = doc.Links["next"].(string)
+	}
+	assert.True(t, seen["list-a"])
+	assert.True(t, seen["list-b"])
+
+	res, err = doRequest("GET", "/apps/?state=errored", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		doc := readDocument(t, res)
+		var list []*resource
+		if doc != nil && assert.NoError(t, json.Unmarshal(doc.Data, &list)) {
+			for _, app := range list {
+				assert.NotEqual(t, "list-a", app.Attributes["slug"])
+				assert.NotEqual(t, "list-b", app.Attributes["slug"])
+			}
+		}
+	}
+}
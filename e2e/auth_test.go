@@ -0,0 +1,339 @@
+// +build e2e
+
+package e2e
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dcasier/cozy-stack/oauth"
+	"github.com/dcasier/cozy-stack/ratelimit"
+	"github.com/dcasier/cozy-stack/sessions"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuth(t *testing.T) {
+	// the owner is already logged in by TestMain
+	res, _, err := postPassphrase("/auth/passphrase", "another-passphrase")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 409, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	res, _, err = postPassphrase("/auth/login", "not-the-passphrase")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 401, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	res, cookie, err := postPassphrase("/auth/login", testPassphrase)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 204, res.StatusCode)
+	res.Body.Close()
+	if !assert.NotNil(t, cookie) {
+		return
+	}
+	assert.True(t, cookie.HttpOnly)
+	csrf := readCSRFToken(res)
+	assert.NotEmpty(t, csrf)
+	assert.NotEqual(t, csrfToken, csrf)
+
+	request := func(method, path string, cookie *http.Cookie, headers ...string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		req.Host = domain
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Add(headers[i], headers[i+1])
+		}
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return res
+	}
+
+	for _, path := range []string{"/apps/", "/konnectors/", "/data/io.cozy.events/unknown", "/files/unknown"} {
+		if res = request("GET", path, nil); res != nil {
+			assert.Equal(t, 401, res.StatusCode, path)
+			readDocument(t, res)
+		}
+	}
+	forged := &http.Cookie{Name: sessions.CookieName, Value: "forged.signature"}
+	if res = request("GET", "/apps/", forged); res != nil {
+		assert.Equal(t, 401, res.StatusCode)
+		readDocument(t, res)
+	}
+	if res = request("GET", "/apps/", cookie); res != nil {
+		assert.Equal(t, 200, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	// the requests that change something need the CSRF token of the session
+	if res = request("DELETE", "/auth/login", cookie); res != nil {
+		assert.Equal(t, 403, res.StatusCode)
+		readDocument(t, res)
+	}
+	if res = request("DELETE", "/auth/login", cookie, middlewares.CSRFHeader, csrfToken); res != nil {
+		assert.Equal(t, 403, res.StatusCode)
+		readDocument(t, res)
+	}
+	if res = request("DELETE", "/auth/login", cookie, middlewares.CSRFHeader, csrf); res != nil {
+		assert.Equal(t, 204, res.StatusCode)
+		res.Body.Close()
+	}
+	// the session is destroyed, the cookie can't be used anymore
+	if res = request("GET", "/apps/", cookie); res != nil {
+		assert.Equal(t, 401, res.StatusCode)
+		readDocument(t, res)
+	}
+}
+
+func TestOAuth(t *testing.T) {
+	redirectURI := "http://localhost:4242/oauth/callback"
+	registration := `{"redirect_uris": ["` + redirectURI + `"], "client_name": "e2e-client", "software_id": "e2e"}`
+	res, err := doRequest("POST", "/auth/register", "application/json", strings.NewReader(registration))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 201, res.StatusCode)
+	client := make(map[string]interface{})
+	err = json.NewDecoder(res.Body).Decode(&client)
+	res.Body.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+	clientID, _ := client["client_id"].(string)
+	clientSecret, _ := client["client_secret"].(string)
+	assert.NotEmpty(t, clientID)
+	assert.NotEmpty(t, clientSecret)
+	assert.NotContains(t, client, "_id")
+
+	res, err = doRequest("POST", "/auth/register", "application/json", strings.NewReader(`{"client_name": "e2e"}`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 400, res.StatusCode)
+		res.Body.Close()
+	}
+
+	params := url.Values{
+		"client_id":     {clientID},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"scope":         {"data/io.cozy.contacts:read"},
+		"state":         {"e2e-state"},
+	}
+	res, err = doRequest("GET", "/auth/authorize?"+params.Encode(), "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Contains(t, res.Header.Get("Content-Type"), "text/html")
+		assert.Equal(t, "DENY", res.Header.Get("X-Frame-Options"))
+		assert.Equal(t, "frame-ancestors 'none'", res.Header.Get("Content-Security-Policy"))
+		page, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Contains(t, string(page), csrfToken)
+	}
+
+	// the browser must not follow the redirection to the client
+	noRedirect := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	authorize := func(params url.Values) *url.URL {
+		req, err := http.NewRequest("POST", ts.URL+"/auth/authorize", strings.NewReader(params.Encode()))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		req.Host = domain
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(sessionCookie)
+		res, err := noRedirect.Do(req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		res.Body.Close()
+		if !assert.Equal(t, 302, res.StatusCode) {
+			return nil
+		}
+		location, err := url.Parse(res.Header.Get("Location"))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return location
+	}
+
+	params.Set(middlewares.CSRFFormField, csrfToken)
+	invalid := url.Values{}
+	for k, v := range params {
+		invalid[k] = v
+	}
+	invalid.Set("scope", "apps")
+	if location := authorize(invalid); location != nil {
+		assert.Equal(t, "invalid_scope", location.Query().Get("error"))
+		assert.Equal(t, "e2e-state", location.Query().Get("state"))
+	}
+
+	// the form of the consent page has the CSRF token, and it is checked
+	noCSRF := url.Values{}
+	for k, v := range params {
+		noCSRF[k] = v
+	}
+	noCSRF.Del(middlewares.CSRFFormField)
+	req, err := http.NewRequest("POST", ts.URL+"/auth/authorize", strings.NewReader(noCSRF.Encode()))
+	if assert.NoError(t, err) {
+		req.Host = domain
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(sessionCookie)
+		res, err = noRedirect.Do(req)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 403, res.StatusCode)
+			readDocument(t, res)
+		}
+	}
+
+	location := authorize(params)
+	if location == nil {
+		return
+	}
+	assert.Equal(t, "localhost:4242", location.Host)
+	assert.Equal(t, "e2e-state", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	if !assert.NotEmpty(t, code) {
+		return
+	}
+
+	token := func(form url.Values) (int, map[string]interface{}) {
+		res, err := doRequest("POST", "/auth/access_token", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+		if !assert.NoError(t, err) {
+			return 0, nil
+		}
+		defer res.Body.Close()
+		assert.Equal(t, "no-store", res.Header.Get("Cache-Control"))
+		body := make(map[string]interface{})
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+		return res.StatusCode, body
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientID},
+		"client_secret": {"not-the-secret"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+	}
+	status, body := token(form)
+	assert.Equal(t, 401, status)
+	assert.Equal(t, "invalid_client", body["error"])
+
+	form.Set("client_secret", clientSecret)
+	status, body = token(form)
+	if !assert.Equal(t, 200, status) {
+		return
+	}
+	assert.Equal(t, "bearer", body["token_type"])
+	assert.Equal(t, "data/io.cozy.contacts:read", body["scope"])
+	accessToken, _ := body["access_token"].(string)
+	refreshToken, _ := body["refresh_token"].(string)
+	assert.NotEmpty(t, accessToken)
+	assert.NotEmpty(t, refreshToken)
+
+	// the code can be used only once
+	status, body = token(form)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, "invalid_grant", body["error"])
+
+	res, err = doAppRequest("GET", "/data/io.cozy.contacts/unknown", accessToken)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		res.Body.Close()
+	}
+	res, err = doAppRequest("DELETE", "/data/io.cozy.contacts/unknown", accessToken)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 403, res.StatusCode)
+		readDocument(t, res)
+	}
+	res, err = doAppRequest("GET", "/apps/", accessToken)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 401, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	status, body = token(url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"refresh_token": {refreshToken},
+	})
+	if assert.Equal(t, 200, status) {
+		assert.NotEmpty(t, body["access_token"])
+		assert.NotEqual(t, accessToken, body["access_token"])
+		assert.Nil(t, body["refresh_token"])
+	}
+
+	// with PKCE, the code can only be exchanged with the verifier
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	params.Set("code_challenge", "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM")
+	params.Set("code_challenge_method", "plain")
+	if location = authorize(params); location != nil {
+		assert.Equal(t, "invalid_request", location.Query().Get("error"))
+	}
+	params.Set("code_challenge_method", oauth.CodeChallengeS256)
+	exchange := func(verifier string) (int, map[string]interface{}) {
+		location := authorize(params)
+		if location == nil {
+			return 0, nil
+		}
+		form.Set("code", location.Query().Get("code"))
+		form.Set("code_verifier", verifier)
+		return token(form)
+	}
+	status, body = exchange("")
+	assert.Equal(t, 400, status)
+	assert.Equal(t, "invalid_grant", body["error"])
+	status, body = exchange(strings.Repeat("a", 43))
+	assert.Equal(t, 400, status)
+	assert.Equal(t, "invalid_grant", body["error"])
+	status, body = exchange(verifier)
+	if assert.Equal(t, 200, status) {
+		assert.NotEmpty(t, body["access_token"])
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	middlewares.UseRateLimiter(ratelimit.NewMemoryStore(), map[string]ratelimit.Limit{
+		middlewares.RateLimitAuth: {Rate: 0.001, Burst: 2},
+	})
+	defer middlewares.UseRateLimiter(nil, nil)
+
+	for i := 0; i < 2; i++ {
+		res, _, err := postPassphrase("/auth/login", "not-the-passphrase")
+		if assert.NoError(t, err) {
+			assert.Equal(t, 401, res.StatusCode)
+			res.Body.Close()
+		}
+	}
+	res, _, err := postPassphrase("/auth/login", testPassphrase)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 429, res.StatusCode)
+		assert.NotEmpty(t, res.Header.Get("Retry-After"))
+		readDocument(t, res)
+	}
+
+	// the other routes have their own budget
+	res, err = doRequest("GET", "/apps/", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		res.Body.Close()
+	}
+}
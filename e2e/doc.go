@@ -0,0 +1,6 @@
+// Package e2e contains the end-to-end tests of the stack. They boot the
+// full router against a real CouchDB and exercise the HTTP API like a
+// client would do. They are behind the e2e build tag:
+//
+//     go test -tags e2e ./e2e/
+package e2e
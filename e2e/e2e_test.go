@@ -0,0 +1,102 @@
+// +build e2e
+
+package e2e
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/jobs"
+	"github.com/dcasier/cozy-stack/web"
+	"github.com/gin-gonic/gin"
+	"github.com/sourcegraph/checkup"
+)
+
+const CouchURL = "http://localhost:5984/"
+
+var ts *httptest.Server
+var domain string
+var testInstance *instance.Instance
+var sessionCookie *http.Cookie
+var csrfToken string
+
+// testPassphrase is the passphrase of the owner of the test instance
+const testPassphrase = "e2e-passphrase"
+
+func TestMain(m *testing.M) {
+	// First we make sure couchdb is started
+	db, err := checkup.HTTPChecker{URL: CouchURL}.Check()
+	if err != nil || db.Status() != checkup.Healthy {
+		fmt.Println("This test need couchdb to run.")
+		os.Exit(1)
+	}
+
+	tempdir, err := ioutil.TempDir("", "cozy-stack-e2e")
+	if err != nil {
+		fmt.Println("Could not create temporary directory.")
+		os.Exit(1)
+	}
+
+	// Each run uses its own instance, so that it can't collide with the
+	// data of a previous run or of the development instance.
+	domain = fmt.Sprintf("e2e-%d.cozy.local", time.Now().UnixNano())
+	testInstance = &instance.Instance{
+		Domain:     domain,
+		StorageURL: "file://localhost" + tempdir,
+	}
+	if err = testInstance.Create(context.Background()); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	web.SetupRoutes(router)
+	ts = httptest.NewServer(router)
+	jobs.Start()
+
+	res, cookie, err := postForm("/auth/passphrase", url.Values{
+		"passphrase":     {testPassphrase},
+		"register_token": {hex.EncodeToString(testInstance.RegisterToken)},
+	})
+	if err != nil {
+		fmt.Println("Could not register the passphrase.", err)
+		os.Exit(1)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent || cookie == nil {
+		fmt.Println("Could not register the passphrase:", res.Status)
+		os.Exit(1)
+	}
+	sessionCookie = cookie
+	csrfToken = readCSRFToken(res)
+
+	code := m.Run()
+
+	ts.Close()
+	jobs.Stop()
+	// all the databases of the instance are removed, like the ones of the
+	// doctypes used by the tests
+	ctx := context.Background()
+	dbs, err := couchdb.ListDatabases(ctx, testInstance.GetDatabasePrefix())
+	if err != nil {
+		fmt.Println("Could not list the databases.", err)
+	}
+	for _, db := range dbs {
+		couchdb.DeleteDB(ctx, "", db)
+	}
+	couchdb.DeleteDoc(context.Background(), "global/", testInstance)
+	os.RemoveAll(tempdir)
+
+	os.Exit(code)
+}
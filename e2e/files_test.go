@@ -0,0 +1,112 @@
+// +build e2e
+
+package e2e
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFiles(t *testing.T) {
+	res, err := doRequest("POST", "/files/?Type=io.cozy.folders&Name=photos", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 201, res.StatusCode)
+	dir := readResource(t, res)
+	if !assert.NotNil(t, dir) {
+		return
+	}
+	assert.Equal(t, "io.cozy.files", dir.Type)
+	assert.Equal(t, "directory", dir.Attributes["type"])
+	assert.Equal(t, "/photos", dir.Attributes["path"])
+
+	body := "hello e2e"
+	res, err = doRequest("POST", "/files/?Type=io.cozy.files&Name=hello.txt", "text/plain", strings.NewReader(body))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 201, res.StatusCode)
+	file := readResource(t, res)
+	if !assert.NotNil(t, file) {
+		return
+	}
+	assert.Equal(t, "file", file.Attributes["type"])
+	assert.Equal(t, "hello.txt", file.Attributes["name"])
+	assert.NotEmpty(t, file.Links["self"])
+
+	res, err = doRequest("GET", "/files/download/"+file.ID, "", nil)
+	if assert.NoError(t, err) {
+		defer res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		content, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, body, string(content))
+	}
+
+	move := `{"data": {"type": "io.cozy.files", "id": "` + file.ID + `", "attributes": {"name": "moved.txt"}, "relationships": {"parent": {"data": {"type": "io.cozy.files", "id": "` + dir.ID + `"}}}}}`
+	res, err = doRequest("PATCH", "/files/"+file.ID, jsonapi.ContentType, strings.NewReader(move))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res.StatusCode)
+	moved := readResource(t, res)
+	if assert.NotNil(t, moved) {
+		assert.Equal(t, "moved.txt", moved.Attributes["name"])
+		assert.Equal(t, dir.ID, moved.Attributes["folder_id"])
+	}
+
+	res, err = doRequest("GET", "/files/metadata?Path=/photos/moved.txt", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		meta := readResource(t, res)
+		if assert.NotNil(t, meta) {
+			assert.Equal(t, file.ID, meta.ID)
+		}
+	}
+
+	res, err = doRequest("GET", "/files/download?Path=/photos/moved.txt", "", nil)
+	if assert.NoError(t, err) {
+		defer res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		content, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, body, string(content))
+	}
+
+	res, err = doRequest("GET", "/files/"+dir.ID, "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		doc := readDocument(t, res)
+		if assert.NotNil(t, doc) && assert.Len(t, doc.Included, 1) {
+			child := &resource{}
+			assert.NoError(t, json.Unmarshal(doc.Included[0], child))
+			assert.Equal(t, file.ID, child.ID)
+		}
+	}
+}
+
+func TestFilesErrors(t *testing.T) {
+	res, err := doRequest("POST", "/files/?Type=io.cozy.files", "text/plain", strings.NewReader("foo"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 422, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	res, err = doRequest("GET", "/files/metadata?Path=/no/such/file", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	res, err = doRequest("GET", "/files/download/unknown-id", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		readDocument(t, res)
+	}
+}
@@ -0,0 +1,38 @@
+// +build e2e
+
+package e2e
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGzip(t *testing.T) {
+	req, err := http.NewRequest("GET", ts.URL+"/apps/", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Host = domain
+	req.AddCookie(sessionCookie)
+	req.Header.Set("Accept-Encoding", "gzip")
+	// the transport must not decompress the response by itself
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	res, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, jsonapi.ContentType, res.Header.Get("Content-Type"))
+	gz, err := gzip.NewReader(res.Body)
+	if assert.NoError(t, err) {
+		doc := &document{}
+		assert.NoError(t, json.NewDecoder(gz).Decode(doc))
+	}
+}
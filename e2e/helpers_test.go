@@ -0,0 +1,156 @@
+// +build e2e
+
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/sessions"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/stretchr/testify/assert"
+)
+
+// document is the generic form of a JSON-API document, used to check
+// the conformance of the responses
+type document struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Status string `json:"status"`
+		Title  string `json:"title"`
+		Detail string `json:"detail"`
+	} `json:"errors"`
+	Links    map[string]interface{} `json:"links"`
+	Included []json.RawMessage      `json:"included"`
+	Meta     map[string]interface{} `json:"meta"`
+}
+
+type resource struct {
+	Type          string                 `json:"type"`
+	ID            string                 `json:"id"`
+	Attributes    map[string]interface{} `json:"attributes"`
+	Relationships map[string]interface{} `json:"relationships"`
+	Links         map[string]interface{} `json:"links"`
+	Meta          map[string]interface{} `json:"meta"`
+}
+
+func doRequest(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, ts.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = domain
+	if contentType != "" {
+		req.Header.Add("Content-Type", contentType)
+	}
+	if sessionCookie != nil {
+		req.AddCookie(sessionCookie)
+		req.Header.Add(middlewares.CSRFHeader, csrfToken)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// readCSRFToken returns the CSRF token sent in a cookie with the session
+// cookie
+func readCSRFToken(res *http.Response) string {
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == middlewares.CSRFCookieName {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// postPassphrase posts the passphrase on an authentication route, and
+// returns the session cookie, if any
+func postPassphrase(path, passphrase string) (*http.Response, *http.Cookie, error) {
+	return postForm(path, url.Values{"passphrase": {passphrase}})
+}
+
+// postForm posts a form on an authentication route, and returns the session
+// cookie, if any
+func postForm(path string, form url.Values) (*http.Response, *http.Cookie, error) {
+	body := form.Encode()
+	req, err := http.NewRequest("POST", ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Host = domain
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == sessions.CookieName {
+			return res, cookie, nil
+		}
+	}
+	return res, nil, nil
+}
+
+// doAppRequest is like doRequest, with the token of an application
+func doAppRequest(method, path, token string) (*http.Response, error) {
+	req, err := http.NewRequest(method, ts.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = domain
+	req.Header.Add("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(req)
+}
+
+// doAdminRequest is like doRequest, with an admin token, as the command
+// line does
+func doAdminRequest(method, path string) (*http.Response, error) {
+	token, err := apps.CreateAdminToken(context.Background(), testInstance.GetDatabasePrefix())
+	if err != nil {
+		return nil, err
+	}
+	return doAppRequest(method, path, token)
+}
+
+// readDocument reads a JSON-API response and checks that it has the
+// right content-type and a well-formed top-level document.
+func readDocument(t *testing.T, res *http.Response) *document {
+	defer res.Body.Close()
+	assert.Equal(t, jsonapi.ContentType, res.Header.Get("Content-Type"))
+	doc := &document{}
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(doc)) {
+		return nil
+	}
+	if res.StatusCode >= 400 {
+		assert.Nil(t, doc.Data)
+		if assert.NotEmpty(t, doc.Errors) {
+			assert.Equal(t, fmt.Sprintf("%d", res.StatusCode), doc.Errors[0].Status)
+			assert.NotEmpty(t, doc.Errors[0].Title)
+		}
+	} else {
+		assert.Empty(t, doc.Errors)
+		assert.NotNil(t, doc.Data)
+	}
+	return doc
+}
+
+// readResource reads a JSON-API response with a single resource as data
+func readResource(t *testing.T, res *http.Response) *resource {
+	doc := readDocument(t, res)
+	if doc == nil || doc.Data == nil {
+		return nil
+	}
+	r := &resource{}
+	if !assert.NoError(t, json.Unmarshal(doc.Data, r)) {
+		return nil
+	}
+	assert.NotEmpty(t, r.Type)
+	assert.NotEmpty(t, r.ID)
+	return r
+}
@@ -0,0 +1,81 @@
+// +build e2e
+
+package e2e
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/intents"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntents(t *testing.T) {
+	dir, cleanup := createFixtureApp(t)
+	defer cleanup()
+
+	manifest := `{"name": "Picker", "slug": "picker", "version": "1.0.0", "permissions": {}, "routes": {"/": {"folder": "/", "index": "index.html"}}, "intents": [{"action": "pick", "type": ["io.cozy.contacts", "image/*"], "href": "/pick"}]}`
+	err := ioutil.WriteFile(filepath.Join(dir, "manifest.webapp"), []byte(manifest), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cmd := exec.Command("git", "-c", "user.name=e2e", "-c", "user.email=e2e@cozy.local", "commit", "-q", "-a", "-m", "Intents")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	res, err := doAdminRequest("POST", "/apps/picker?Source=file://"+dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 202, res.StatusCode)
+	readResource(t, res)
+	assert.Equal(t, apps.Ready, waitAppState(t, "picker"))
+
+	createIntent := func(action, typ string) *http.Response {
+		body := fmt.Sprintf(`{"data": {"type": "io.cozy.intents", "attributes": {"action": %q, "type": %q}}}`, action, typ)
+		res, err := doRequest("POST", "/intents/", "application/vnd.api+json", strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return res
+	}
+
+	res = createIntent("PICK", "image/png")
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 201, res.StatusCode)
+		intent := readResource(t, res)
+		if assert.NotNil(t, intent) {
+			assert.Equal(t, intents.IntentDocType, intent.Type)
+			assert.Equal(t, "PICK", intent.Attributes["action"])
+			services, _ := intent.Attributes["services"].([]interface{})
+			if assert.Len(t, services, 1) {
+				service := services[0].(map[string]interface{})
+				assert.Equal(t, "picker", service["slug"])
+				assert.Equal(t, "/pick", service["href"])
+			}
+		}
+	}
+
+	res = createIntent("EDIT", "io.cozy.contacts")
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 201, res.StatusCode)
+		intent := readResource(t, res)
+		if assert.NotNil(t, intent) {
+			assert.Empty(t, intent.Attributes["services"])
+		}
+	}
+
+	res = createIntent("PICK", "")
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 422, res.StatusCode)
+		readDocument(t, res)
+	}
+}
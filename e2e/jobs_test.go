@@ -0,0 +1,118 @@
+// +build e2e
+
+package e2e
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dcasier/cozy-stack/jobs"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobs(t *testing.T) {
+	push := func(worker, attrs string) *http.Response {
+		body := `{"data": {"type": "io.cozy.jobs", "attributes": ` + attrs + `}}`
+		res, err := doRequest("POST", "/jobs/queue/"+worker, jsonapi.ContentType, strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return res
+	}
+
+	res := push("log", `{"arguments": {"message": "hello"}, "options": {"max_exec_count": 1}}`)
+	if !assert.NotNil(t, res) || !assert.Equal(t, 202, res.StatusCode) {
+		return
+	}
+	job := readResource(t, res)
+	if !assert.NotNil(t, job) {
+		return
+	}
+	assert.Equal(t, jobs.JobDocType, job.Type)
+	assert.Equal(t, "log", job.Attributes["worker"])
+	assert.Equal(t, "/jobs/"+job.ID, job.Links["self"])
+
+	// the log worker executes the job
+	state := ""
+	for i := 0; i < 50 && state != string(jobs.Done); i++ {
+		time.Sleep(100 * time.Millisecond)
+		res, err := doRequest("GET", "/jobs/"+job.ID, "", nil)
+		if !assert.NoError(t, err) || !assert.Equal(t, 200, res.StatusCode) {
+			return
+		}
+		if r := readResource(t, res); r != nil {
+			state, _ = r.Attributes["state"].(string)
+		}
+	}
+	assert.Equal(t, string(jobs.Done), state)
+
+	res = push("unknown", `{"arguments": {}}`)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 404, res.StatusCode)
+		readDocument(t, res)
+	}
+	res, err := doRequest("GET", "/jobs/not-a-job", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		readDocument(t, res)
+	}
+}
+
+func TestTriggers(t *testing.T) {
+	add := func(attrs string) *http.Response {
+		body := `{"data": {"type": "io.cozy.triggers", "attributes": ` + attrs + `}}`
+		res, err := doRequest("POST", "/jobs/triggers", jsonapi.ContentType, strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return res
+	}
+
+	res := add(`{"type": "@cron", "arguments": "0 0 * * *", "worker": "log", "worker_arguments": {"message": "daily"}}`)
+	if !assert.NotNil(t, res) || !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	trigger := readResource(t, res)
+	if !assert.NotNil(t, trigger) {
+		return
+	}
+	assert.Equal(t, jobs.TriggerDocType, trigger.Type)
+	assert.Equal(t, "@cron", trigger.Attributes["type"])
+	assert.NotEmpty(t, trigger.Attributes["next_at"])
+
+	res = add(`{"type": "@cron", "arguments": "every day", "worker": "log"}`)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 422, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	res, err := doRequest("GET", "/jobs/triggers", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		doc := readDocument(t, res)
+		var list []resource
+		// with the trigger of the trash, added when the instance is created
+		if assert.NotNil(t, doc) && assert.NoError(t, json.Unmarshal(doc.Data, &list)) {
+			assert.Len(t, list, 2)
+		}
+	}
+	res, err = doRequest("GET", "/jobs/triggers/"+trigger.ID, "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		readResource(t, res)
+	}
+	res, err = doRequest("DELETE", "/jobs/triggers/"+trigger.ID, "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 204, res.StatusCode)
+		res.Body.Close()
+	}
+	res, err = doRequest("GET", "/jobs/triggers/"+trigger.ID, "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		readDocument(t, res)
+	}
+}
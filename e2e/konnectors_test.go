@@ -0,0 +1,83 @@
+// +build e2e
+
+package e2e
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstallKonnector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-e2e-konnector")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	manifest := `{"name": "Bank", "slug": "bank", "type": "konnector", "version": "1.0.0", "entrypoint": "index.js", "permissions": {"data/io.cozy.bank.operations": {"description": "Fixture", "access": "write"}}}`
+	files := map[string]string{
+		"manifest.konnector": manifest,
+		"index.js":           "console.log('bank')",
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	// a konnector can't be installed as a webapp
+	res, err := doAdminRequest("POST", "/apps/bank?Source=file://"+dir)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 400, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	res, err = doAdminRequest("POST", "/konnectors/bank?Source=file://"+dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 202, res.StatusCode)
+	man := readResource(t, res)
+	if assert.NotNil(t, man) {
+		assert.Equal(t, apps.KonnectorDocType, man.Type)
+		assert.Equal(t, "/index.js", man.Attributes["entrypoint"])
+	}
+
+	var state interface{}
+	for i := 0; i < 50; i++ {
+		res, err = doRequest("GET", "/konnectors/", "", nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		doc := readDocument(t, res)
+		var list []*resource
+		if doc != nil && json.Unmarshal(doc.Data, &list) == nil && len(list) > 0 {
+			state = list[0].Attributes["state"]
+			if state == apps.Ready || state == apps.Errored {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, apps.Ready, state)
+
+	res, err = doRequest("GET", "/files/metadata?Path="+apps.KonnectorsDirectory+"/bank/index.js", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		readResource(t, res)
+	}
+
+	res, err = doRequest("DELETE", "/konnectors/bank", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 204, res.StatusCode)
+		res.Body.Close()
+	}
+}
+
@@ -0,0 +1,83 @@
+// +build e2e
+
+package e2e
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dcasier/cozy-stack/notifications"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifications(t *testing.T) {
+	create := func(attrs string) *http.Response {
+		body := `{"data": {"type": "io.cozy.notifications", "attributes": ` + attrs + `}}`
+		res, err := doRequest("POST", "/notifications/", jsonapi.ContentType, strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return res
+	}
+	unread := func() []resource {
+		res, err := doRequest("GET", "/notifications/", "", nil)
+		if !assert.NoError(t, err) || !assert.Equal(t, 200, res.StatusCode) {
+			return nil
+		}
+		doc := readDocument(t, res)
+		var list []resource
+		if assert.NotNil(t, doc) {
+			assert.NoError(t, json.Unmarshal(doc.Data, &list))
+		}
+		return list
+	}
+
+	res := create(`{"title": "New bill", "content": "Your phone bill is available"}`)
+	if !assert.NotNil(t, res) || !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	first := readResource(t, res)
+	if !assert.NotNil(t, first) {
+		return
+	}
+	assert.Equal(t, notifications.DocType, first.Type)
+	assert.Equal(t, "New bill", first.Attributes["title"])
+	assert.Equal(t, false, first.Attributes["read"])
+	res = create(`{"title": "Meeting in 10 minutes"}`)
+	if assert.NotNil(t, res) && assert.Equal(t, 201, res.StatusCode) {
+		readResource(t, res)
+	}
+	res = create(`{"content": "no title"}`)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 422, res.StatusCode)
+		readDocument(t, res)
+	}
+	assert.Len(t, unread(), 2)
+
+	res, err := doRequest("PUT", "/notifications/"+first.ID+"/read", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		n := readResource(t, res)
+		if assert.NotNil(t, n) {
+			assert.Equal(t, true, n.Attributes["read"])
+			assert.NotEmpty(t, n.Attributes["read_at"])
+		}
+	}
+	assert.Len(t, unread(), 1)
+
+	res, err = doRequest("POST", "/notifications/read", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 204, res.StatusCode)
+		res.Body.Close()
+	}
+	assert.Len(t, unread(), 0)
+
+	res, err = doRequest("PUT", "/notifications/unknown/read", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		readDocument(t, res)
+	}
+}
@@ -0,0 +1,172 @@
+// +build e2e
+
+package e2e
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// realtimeDoctype is the doctype of the documents of TestRealtime
+const realtimeDoctype = "io.cozy.e2e.realtime"
+
+// writeWSMessage sends a masked text frame, as a WebSocket client
+func writeWSMessage(conn net.Conn, msg string) error {
+	mask := []byte{7, 42, 3, 99}
+	frame := []byte{0x81, 0x80 | byte(len(msg))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(msg); i++ {
+		frame = append(frame, msg[i]^mask[i%4])
+	}
+	_, err := conn.Write(frame)
+	return err
+}
+
+// readWSMessage reads a text frame of the server, skipping the pings
+func readWSMessage(r *bufio.Reader) (map[string]interface{}, error) {
+	for {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(r, head); err != nil {
+			return nil, err
+		}
+		length := int(head[1] & 0x7F)
+		if length == 126 {
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(r, ext); err != nil {
+				return nil, err
+			}
+			length = int(ext[0])<<8 | int(ext[1])
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		if head[0]&0x0F != 0x1 {
+			continue
+		}
+		var msg map[string]interface{}
+		err := json.Unmarshal(payload, &msg)
+		return msg, err
+	}
+}
+
+func TestRealtime(t *testing.T) {
+	createDoc := func(name string) string {
+		body := fmt.Sprintf(`{"name": %q}`, name)
+		res, err := doRequest("POST", "/data/"+realtimeDoctype+"/", "application/json", strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer res.Body.Close()
+		assert.Equal(t, 201, res.StatusCode)
+		var out struct {
+			ID string `json:"id"`
+		}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		return out.ID
+	}
+	// the database of the doctype must exist for the subscription
+	createDoc("before")
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	handshake := "GET /realtime/ HTTP/1.1\r\n" +
+		"Host: " + domain + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Cookie: " + sessionCookie.String() + "\r\n\r\n"
+	_, err = conn.Write([]byte(handshake))
+	assert.NoError(t, err)
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.Equal(t, 101, res.StatusCode) {
+		return
+	}
+
+	err = writeWSMessage(conn, `{"method": "SUBSCRIBE", "payload": {}}`)
+	assert.NoError(t, err)
+	msg, err := readWSMessage(r)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "error", msg["event"])
+	}
+
+	err = writeWSMessage(conn, `{"method": "SUBSCRIBE", "payload": {"type": "`+realtimeDoctype+`"}}`)
+	assert.NoError(t, err)
+	// let the watcher of the doctype start following the changes feed
+	time.Sleep(500 * time.Millisecond)
+
+	id := createDoc("after")
+	msg, err = readWSMessage(r)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "CREATED", msg["event"])
+		payload, _ := msg["payload"].(map[string]interface{})
+		assert.Equal(t, realtimeDoctype, payload["type"])
+		assert.Equal(t, id, payload["id"])
+		doc, _ := payload["doc"].(map[string]interface{})
+		assert.Equal(t, "after", doc["name"])
+	}
+}
+
+func TestRealtimeSSE(t *testing.T) {
+	res, err := doRequest("GET", "/realtime/sse", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 422, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	res, err = doRequest("GET", "/realtime/sse?subscribe="+realtimeDoctype, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	r := bufio.NewReader(res.Body)
+	line, err := r.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, ": ok\n", line)
+	// let the watcher of the doctype start following the changes feed
+	time.Sleep(500 * time.Millisecond)
+
+	body := `{"name": "sse"}`
+	created, err := doRequest("POST", "/data/"+realtimeDoctype+"/", "application/json", strings.NewReader(body))
+	if !assert.NoError(t, err) {
+		return
+	}
+	created.Body.Close()
+	assert.Equal(t, 201, created.StatusCode)
+
+	for line == "\n" || strings.HasPrefix(line, ":") {
+		line, err = r.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+	assert.Equal(t, "event: CREATED\n", line)
+	line, err = r.ReadString('\n')
+	if assert.NoError(t, err) && assert.True(t, strings.HasPrefix(line, "data: ")) {
+		var event map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line[len("data: "):]), &event))
+		assert.Equal(t, realtimeDoctype, event["type"])
+		doc, _ := event["doc"].(map[string]interface{})
+		assert.Equal(t, "sse", doc["name"])
+	}
+}
@@ -0,0 +1,105 @@
+// +build e2e
+
+package e2e
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/sessions"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettings(t *testing.T) {
+	res, err := doRequest("GET", "/settings/instance", "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res.StatusCode)
+	settings := readResource(t, res)
+	if !assert.NotNil(t, settings) {
+		return
+	}
+	assert.Equal(t, instance.SettingsDocType, settings.Type)
+	assert.Equal(t, instance.SettingsID, settings.ID)
+	// the secrets are never sent
+	assert.Nil(t, settings.Attributes["passphrase_hash"])
+	assert.Nil(t, settings.Attributes["session_secret"])
+
+	update := func(attrs string) *http.Response {
+		body := `{"data": {"type": "io.cozy.settings", "id": "io.cozy.settings.instance", "attributes": ` + attrs + `}}`
+		res, err := doRequest("PUT", "/settings/instance", jsonapi.ContentType, strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return res
+	}
+	res = update(`{"public_name": "Alice", "email": "alice@example.com", "locale": "fr", "timezone": "UTC"}`)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 200, res.StatusCode)
+		settings = readResource(t, res)
+		if assert.NotNil(t, settings) {
+			assert.Equal(t, "Alice", settings.Attributes["public_name"])
+			assert.Equal(t, "fr", settings.Attributes["locale"])
+		}
+	}
+	res = update(`{"email": "not an email"}`)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 422, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	changePassphrase := func(current, passphrase string) *http.Response {
+		body := fmt.Sprintf(`{"current_passphrase": %q, "new_passphrase": %q}`, current, passphrase)
+		res, err := doRequest("PUT", "/settings/passphrase", "application/json", strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return res
+	}
+	res = changePassphrase("not-the-passphrase", "new-e2e-passphrase")
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 403, res.StatusCode)
+		readDocument(t, res)
+	}
+
+	oldCookie := sessionCookie
+	for _, pass := range [][2]string{
+		{testPassphrase, "new-e2e-passphrase"},
+		{"new-e2e-passphrase", testPassphrase},
+	} {
+		res = changePassphrase(pass[0], pass[1])
+		if !assert.NotNil(t, res) {
+			return
+		}
+		res.Body.Close()
+		if !assert.Equal(t, 204, res.StatusCode) {
+			return
+		}
+		// the browser gets a new session, and the others are closed
+		for _, cookie := range res.Cookies() {
+			if cookie.Name == sessions.CookieName {
+				sessionCookie = cookie
+			}
+		}
+		csrfToken = readCSRFToken(res)
+	}
+	assert.NotEqual(t, oldCookie.Value, sessionCookie.Value)
+	req, _ := http.NewRequest("GET", ts.URL+"/settings/instance", nil)
+	req.Host = domain
+	req.AddCookie(oldCookie)
+	res, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 401, res.StatusCode)
+		readDocument(t, res)
+	}
+	res, err = doRequest("GET", "/settings/instance", "", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res.StatusCode)
+		res.Body.Close()
+	}
+}
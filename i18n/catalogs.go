@@ -0,0 +1,30 @@
+package i18n
+
+// enCatalog is the catalog of the strings of the stack in English, the
+// default locale. All the keys must have a translation here.
+var enCatalog = map[string]string{
+	"onboarding.title":      "Welcome to your cozy",
+	"onboarding.passphrase": "Choose a passphrase",
+	"onboarding.submit":     "Start",
+
+	"error.title":           "Something went wrong",
+	"error.404.title":       "Page not found",
+	"error.404.message":     "The page you are looking for does not exist.",
+	"error.503.title":       "Not available yet",
+	"error.503.message":     "This application is being installed or updated. Please try again in a few moments.",
+	"error.default.message": "An error has occurred. Please try again later.",
+}
+
+// frCatalog is the catalog of the strings of the stack in French
+var frCatalog = map[string]string{
+	"onboarding.title":      "Bienvenue sur votre cozy",
+	"onboarding.passphrase": "Choisissez un mot de passe",
+	"onboarding.submit":     "Commencer",
+
+	"error.title":           "Une erreur est survenue",
+	"error.404.title":       "Page introuvable",
+	"error.404.message":     "La page que vous cherchez n'existe pas.",
+	"error.503.title":       "Pas encore disponible",
+	"error.503.message":     "Cette application est en cours d'installation ou de mise à jour. Merci de réessayer dans quelques instants.",
+	"error.default.message": "Une erreur est survenue. Merci de réessayer plus tard.",
+}
@@ -0,0 +1,109 @@
+// Package i18n has the translation catalogs of the stack, for the strings
+// shown to the owner of an instance in its locale: the emails, the
+// onboarding page and the error pages.
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultLocale is the locale used when the locale of an instance has no
+// translation for a string
+const DefaultLocale = "en"
+
+var (
+	catalogsMu sync.RWMutex
+	catalogs   = make(map[string]map[string]string)
+)
+
+func init() {
+	AddCatalog("en", enCatalog)
+	AddCatalog("fr", frCatalog)
+}
+
+// AddCatalog adds the translations of a catalog for a locale, like fr or
+// fr-FR. They replace the previous translations of the same keys.
+func AddCatalog(locale string, catalog map[string]string) {
+	catalogsMu.Lock()
+	defer catalogsMu.Unlock()
+	translations, ok := catalogs[locale]
+	if !ok {
+		translations = make(map[string]string, len(catalog))
+		catalogs[locale] = translations
+	}
+	for k, v := range catalog {
+		translations[k] = v
+	}
+}
+
+// LoadDir adds the catalogs of a directory, in JSON files named after their
+// locale, like fr-FR.json, with the translations by key. It can be used to
+// change the strings of the stack, or to add a locale.
+func LoadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var catalog map[string]string
+		if err = json.Unmarshal(data, &catalog); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		AddCatalog(strings.TrimSuffix(filepath.Base(file), ".json"), catalog)
+	}
+	return nil
+}
+
+// Fallbacks returns the locales to look for a translation, in order: the
+// locale, like fr-FR, its language, like fr, and the default locale
+func Fallbacks(locale string) []string {
+	var locales []string
+	if locale != "" {
+		locales = append(locales, locale)
+	}
+	if idx := strings.Index(locale, "-"); idx > 0 {
+		locales = append(locales, locale[:idx])
+	}
+	for _, l := range locales {
+		if l == DefaultLocale {
+			return locales
+		}
+	}
+	return append(locales, DefaultLocale)
+}
+
+// Translate returns the translation of a key in the given locale. If args
+// are given, the translation is used as a format for them, like with
+// fmt.Sprintf. The key is returned if it has no translation.
+func Translate(locale, key string, args ...interface{}) string {
+	translation := key
+	catalogsMu.RLock()
+	for _, l := range Fallbacks(locale) {
+		if t, ok := catalogs[l][key]; ok {
+			translation = t
+			break
+		}
+	}
+	catalogsMu.RUnlock()
+	if len(args) > 0 {
+		return fmt.Sprintf(translation, args...)
+	}
+	return translation
+}
+
+// Translator returns a function that translates the keys in the given
+// locale, like for the t function of the templates
+func Translator(locale string) func(key string, args ...interface{}) string {
+	return func(key string, args ...interface{}) string {
+		return Translate(locale, key, args...)
+	}
+}
@@ -0,0 +1,51 @@
+package i18n
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFallbacks(t *testing.T) {
+	assert.Equal(t, []string{"fr-FR", "fr", "en"}, Fallbacks("fr-FR"))
+	assert.Equal(t, []string{"fr", "en"}, Fallbacks("fr"))
+	assert.Equal(t, []string{"en-GB", "en"}, Fallbacks("en-GB"))
+	assert.Equal(t, []string{"en"}, Fallbacks(""))
+}
+
+func TestTranslate(t *testing.T) {
+	assert.Equal(t, "Welcome to your cozy", Translate("en", "onboarding.title"))
+	assert.Equal(t, "Bienvenue sur votre cozy", Translate("fr-FR", "onboarding.title"))
+	assert.Equal(t, "Welcome to your cozy", Translate("de", "onboarding.title"))
+	assert.Equal(t, "unknown.key", Translate("fr", "unknown.key"))
+
+	AddCatalog("fr-CA", map[string]string{"test.hello": "Allô %s"})
+	AddCatalog("fr", map[string]string{"test.hello": "Bonjour %s"})
+	assert.Equal(t, "Allô Alice", Translate("fr-CA", "test.hello", "Alice"))
+	assert.Equal(t, "Bonjour Alice", Translator("fr-FR")("test.hello", "Alice"))
+}
+
+func TestCatalogsHaveSameKeys(t *testing.T) {
+	for key := range frCatalog {
+		assert.Contains(t, enCatalog, key)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-i18n")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "es.json"), []byte(`{"onboarding.submit": "Empezar"}`), 0644)
+	assert.NoError(t, err)
+	assert.NoError(t, LoadDir(dir))
+	assert.Equal(t, "Empezar", Translate("es-ES", "onboarding.submit"))
+
+	err = ioutil.WriteFile(filepath.Join(dir, "it.json"), []byte(`not json`), 0644)
+	assert.NoError(t, err)
+	assert.Error(t, LoadDir(dir))
+}
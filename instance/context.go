@@ -0,0 +1,78 @@
+package instance
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrUnknownContext is used when an instance is created with a context that
+// is not in the configuration of the stack
+var ErrUnknownContext = errors.New("Unknown context")
+
+// A Context is a named profile, like beta or premium, shared by several
+// instances. It controls the applications preinstalled on them, their
+// quota, the features they can use and the branding of their applications.
+type Context struct {
+	Name        string            `json:"name"`
+	DefaultApps []*DefaultApp     `json:"default_apps,omitempty"`
+	Quota       int64             `json:"quota,omitempty"`
+	Features    []string          `json:"features,omitempty"`
+	Branding    map[string]string `json:"branding,omitempty"`
+}
+
+// DefaultApp is an application installed automatically on the new
+// instances of a context. An empty source is for the registry.
+type DefaultApp struct {
+	Slug   string `json:"slug"`
+	Source string `json:"source,omitempty"`
+}
+
+// HasFeature returns true if the feature with the given name is allowed
+// for the instances of this context
+func (c *Context) HasFeature(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	contextsMu sync.RWMutex
+	contexts   = make(map[string]*Context)
+)
+
+// UseContexts sets the contexts that the instances can reference, usually
+// from the configuration file. It replaces the previous contexts.
+func UseContexts(list []*Context) {
+	contextsMu.Lock()
+	defer contextsMu.Unlock()
+	contexts = make(map[string]*Context, len(list))
+	for _, c := range list {
+		contexts[c.Name] = c
+	}
+}
+
+// GetContext returns the context with the given name, or ErrUnknownContext
+func GetContext(name string) (*Context, error) {
+	contextsMu.RLock()
+	defer contextsMu.RUnlock()
+	c, ok := contexts[name]
+	if !ok {
+		return nil, ErrUnknownContext
+	}
+	return c, nil
+}
+
+// GetContext returns the context of the instance. An instance without a
+// context, or whose context has been removed from the configuration, has
+// an empty context: no default apps, no quota and no features.
+func (i *Instance) GetContext() *Context {
+	if i.ContextName != "" {
+		if c, err := GetContext(i.ContextName); err == nil {
+			return c
+		}
+	}
+	return &Context{Name: i.ContextName}
+}
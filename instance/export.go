@@ -0,0 +1,200 @@
+package instance
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/doctypes"
+	"github.com/dcasier/cozy-stack/vfs"
+)
+
+// ExportManifest is the description of an export archive, in its
+// manifest.json entry
+type ExportManifest struct {
+	Domain     string     `json:"domain"`
+	Locale     string     `json:"locale,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	ExportedAt time.Time  `json:"exported_at"`
+	// Databases are the names of the exported databases of the instance,
+	// like io-cozy-files, with a couchdb/<name>.json entry for each of them
+	Databases []string `json:"databases"`
+}
+
+// Export writes in w the export archive of the instance for the given
+// domain. See Instance.Export.
+func Export(ctx context.Context, domain string, w io.Writer) error {
+	i, err := Get(ctx, domain)
+	if err != nil {
+		return err
+	}
+	return i.Export(ctx, w)
+}
+
+// Export writes in w a gzipped tarball with all the data of the instance,
+// under a directory named after its domain:
+//
+//   - manifest.json, with the description of the archive
+//   - couchdb/<name>.json for each database, with the list of its
+//     documents, without the design documents
+//   - files/, with the tree of the files of the VFS, without the trash
+//
+// The databases of the internal doctypes, like the settings with the
+// passphrase, the sessions or the tokens, are not exported, except the
+// files, whose documents describe the files/ tree.
+//
+// It can be used by the owner to take the data out, or to migrate the
+// instance to another hoster.
+func (i *Instance) Export(ctx context.Context, w io.Writer) error {
+	dbprefix := i.GetDatabasePrefix()
+	dbs, err := couchdb.ListDatabases(ctx, dbprefix)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(dbs))
+	for _, db := range dbs {
+		name := db[strings.LastIndex(db, "/")+1:]
+		if !skipExport(name) {
+			names = append(names, name)
+		}
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	base := i.Domain
+	now := time.Now().UTC()
+
+	manifest := &ExportManifest{
+		Domain:     i.Domain,
+		Locale:     i.Locale,
+		ExportedAt: now,
+		Databases:  names,
+	}
+	if !i.CreatedAt.IsZero() {
+		manifest.CreatedAt = &i.CreatedAt
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:     path.Join(base, "manifest.json"),
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  now,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = tw.Write(data); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		entry := path.Join(base, "couchdb", name+".json")
+		if err = exportDatabase(ctx, tw, dbprefix, name, entry, now); err != nil {
+			return err
+		}
+	}
+
+	vfsC, err := i.GetVFSContext(ctx)
+	if err != nil {
+		return err
+	}
+	root, err := vfs.GetDirDoc(vfsC, vfs.RootFolderID, false)
+	if err != nil {
+		return err
+	}
+	if err = vfs.WriteTar(vfsC, root, tw, path.Join(base, "files")); err != nil {
+		return err
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// skipExport returns true if the database is the one of an internal doctype,
+// or of one of its sub-doctypes, except the files
+func skipExport(name string) bool {
+	if name == dbName(vfs.FsDocType) {
+		return false
+	}
+	for _, doctype := range doctypes.Internal() {
+		internal := dbName(doctype)
+		if name == internal || strings.HasPrefix(name, internal+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// dbName returns the name of the database of a doctype, without the prefix
+// of the instance, like io-cozy-files for io.cozy.files
+func dbName(doctype string) string {
+	return strings.ToLower(strings.Replace(doctype, ".", "-", -1))
+}
+
+// exportDatabase writes the documents of a database in an entry of the
+// archive, as a JSON list. The size of an entry must be known before its
+// content, so the documents are first streamed to a temporary file, to
+// export the large databases without keeping them in memory.
+func exportDatabase(ctx context.Context, tw *tar.Writer, dbprefix, name, entry string, modTime time.Time) error {
+	tmp, err := ioutil.TempFile("", "cozy-export-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sep := "[\n"
+	err = couchdb.ForeachDocs(ctx, dbprefix, name, func(doc json.RawMessage) error {
+		if _, err := io.WriteString(tmp, sep); err != nil {
+			return err
+		}
+		sep = ",\n"
+		_, err := tmp.Write(doc)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if sep == "[\n" {
+		_, err = io.WriteString(tmp, "[]\n")
+	} else {
+		_, err = io.WriteString(tmp, "\n]\n")
+	}
+	if err != nil {
+		return err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:     entry,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, tmp)
+	return err
+}
@@ -0,0 +1,95 @@
+package instance
+
+import (
+	"context"
+	"time"
+
+	"github.com/dcasier/cozy-stack/vfs"
+)
+
+const (
+	// StateOnboarding is the state of an instance whose owner has not yet
+	// registered a passphrase
+	StateOnboarding = "onboarding"
+	// StateActive is the state of an instance whose owner has registered
+	// a passphrase
+	StateActive = "active"
+)
+
+// Info is the summary of an instance for the operators of the stack
+type Info struct {
+	Domain     string     `json:"domain"`
+	StorageURL string     `json:"storage"`
+	DiskUsage  int64      `json:"disk_usage"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	State      string     `json:"state"`
+	Context    string     `json:"context,omitempty"`
+	Quota      int64      `json:"quota,omitempty"`
+}
+
+// DiskUsage returns the size in bytes of the files of this instance,
+// including the trash
+func (i *Instance) DiskUsage(ctx context.Context) (int64, error) {
+	vfsC, err := i.GetVFSContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	root, err := vfs.GetDirDoc(vfsC, vfs.RootFolderID, false)
+	if err != nil {
+		return 0, err
+	}
+	return vfs.DirSize(vfsC, root)
+}
+
+// State returns StateActive if the owner of the instance has registered a
+// passphrase, and StateOnboarding else
+func (i *Instance) State(ctx context.Context) (string, error) {
+	settings, err := i.GetSettings(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(settings.PassphraseHash) == 0 {
+		return StateOnboarding, nil
+	}
+	return StateActive, nil
+}
+
+// Info returns the summary of this instance
+func (i *Instance) Info(ctx context.Context) (*Info, error) {
+	usage, err := i.DiskUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state, err := i.State(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info := &Info{
+		Domain:     i.Domain,
+		StorageURL: i.StorageURL,
+		DiskUsage:  usage,
+		State:      state,
+		Context:    i.ContextName,
+		Quota:      i.GetQuota(),
+	}
+	if !i.CreatedAt.IsZero() {
+		createdAt := i.CreatedAt
+		info.CreatedAt = &createdAt
+	}
+	return info, nil
+}
+
+// ListInfos returns the summaries of all the instances of this stack
+func ListInfos(ctx context.Context) ([]*Info, error) {
+	instances, err := List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*Info, len(instances))
+	for idx, i := range instances {
+		if infos[idx], err = i.Info(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
@@ -1,19 +1,49 @@
 package instance
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/dcasier/cozy-stack/couchdb"
 	"github.com/dcasier/cozy-stack/couchdb/mango"
+	"github.com/dcasier/cozy-stack/i18n"
 	"github.com/dcasier/cozy-stack/vfs"
 	"github.com/spf13/afero"
 )
 
 const globalDBPrefix = "global/"
+const listPageSize = 100
 const instanceType = "instances"
 
+var (
+	// ErrExists is used when an instance is created for a domain that
+	// already has one
+	ErrExists = errors.New("An instance already exists for this domain")
+)
+
+// NotFoundError is used when no instance has the given domain
+type NotFoundError struct {
+	Domain string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("No instance for domain %v, use 'cozy-stack instances add'", e.Domain)
+}
+
+// IsNotFound returns true if the error is a NotFoundError
+func IsNotFound(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
+}
+
+// DefaultTrashRetention is the number of days the files are kept in the
+// trash before being destroyed, if the instance has no specific setting
+const DefaultTrashRetention = 30
+
 // An Instance has the informations relatives to the logical cozy instance,
 // like the domain, the locale or the access to the databases and files storage
 // It is a couchdb.Doc to be persisted in couchdb.
@@ -22,7 +52,30 @@ type Instance struct {
 	DocRev     string `json:"_rev,omitempty"` // couchdb _rev
 	Domain     string `json:"domain"`         // The main DNS domain, like example.cozycloud.cc
 	StorageURL string `json:"storage"`        // Where the binaries are persisted
-	storage    afero.Fs
+
+	// Locale is the language code of the owner, like en or fr-FR, for the
+	// strings shown by the stack
+	Locale string `json:"locale,omitempty"`
+
+	// ContextName is the name of the context of the instance, like beta or
+	// premium, empty for the default context
+	ContextName string `json:"context,omitempty"`
+
+	// Date of the creation of the instance, zero for the instances created
+	// before it was recorded
+	CreatedAt time.Time `json:"created_at"`
+
+	// Number of days the files are kept in the trash, 0 for the default
+	TrashRetention int `json:"trash_retention,omitempty"`
+
+	// Maximal size in bytes of the files, 0 for the quota of the context
+	Quota int64 `json:"quota,omitempty"`
+
+	// Secret given to the owner to register the passphrase, until the
+	// onboarding is completed
+	RegisterToken []byte `json:"register_token,omitempty"`
+
+	storage afero.Fs
 }
 
 // DocType implements couchdb.Doc
@@ -44,48 +97,80 @@ func (i *Instance) SetRev(v string) { i.DocRev = v }
 var _ couchdb.Doc = (*Instance)(nil)
 
 // CreateInCouchdb create the instance doc in the global database
-func (i *Instance) createInCouchdb() (err error) {
-	err = couchdb.CreateDoc(globalDBPrefix, i)
+func (i *Instance) createInCouchdb(ctx context.Context) (err error) {
+	err = couchdb.EnsureDBExists(ctx, globalDBPrefix, instanceType, &couchdb.DBOptions{
+		Security: couchdb.AdminOnlySecurity,
+		Indexes:  []mango.IndexDefinitionRequest{mango.IndexOnFields("domain")},
+	})
 	if err != nil {
 		return err
 	}
-	byDomain := mango.IndexOnFields("domain")
-	return couchdb.DefineIndex(globalDBPrefix, instanceType, byDomain)
+	return couchdb.CreateDoc(ctx, globalDBPrefix, i)
 }
 
-// createRootFolder creates the root folder for this instance
-func (i *Instance) createRootFolder() error {
-	vfsC, err := i.GetVFSContext()
+// createRootFolder creates the root and trash folders for this instance
+func (i *Instance) createRootFolder(ctx context.Context) error {
+	vfsC, err := i.GetVFSContext(ctx)
 	if err != nil {
 		return err
 	}
-	return vfs.CreateRootDirectory(vfsC)
+	return vfs.CreateBaseDirectories(vfsC)
 }
 
-// createFSIndexes creates the index needed by VFS
-func (i *Instance) createFSIndexes() (err error) {
-	prefix := i.GetDatabasePrefix()
-	byParent := mango.IndexOnFields("folder_id", "name", "type")
-	byPath := mango.IndexOnFields("path")
-	err = couchdb.DefineIndex(prefix, vfs.FsDocType, byParent)
-	if err != nil {
-		return err
-	}
-	err = couchdb.DefineIndex(prefix, vfs.FsDocType, byPath)
-	return err
+// createFSDatabase creates the database of the VFS, restricted to the
+// admins of CouchDB, with the indexes needed by the VFS
+func (i *Instance) createFSDatabase(ctx context.Context) error {
+	return couchdb.EnsureDBExists(ctx, i.GetDatabasePrefix(), vfs.FsDocType, &couchdb.DBOptions{
+		Security: couchdb.AdminOnlySecurity,
+		Indexes:  vfs.Indexes,
+	})
 }
 
-// Create build an instance and .Create it
-func Create(domain string, locale string, apps []string) (*Instance, error) {
-	// TODO use a base directory provided by stack level config
-	base := "/tmp/cozy2/"
-	storageURL := "file://localhost" + base + "/" + domain + "/"
+// createFSViews creates the views needed by VFS
+func (i *Instance) createFSViews(ctx context.Context) error {
+	return couchdb.DefineViews(ctx, i.GetDatabasePrefix(), vfs.Views)
+}
+
+// Create build an instance and .Create it. The storageURL is where the
+// files of the instance are persisted, like /var/lib/cozy/example.org,
+// mem://example.org/ or any URL with a scheme added by RegisterStorage. If
+// it is empty, a directory named after the domain is used, in the root
+// given to UseFSURL. The contextName,
+// if not empty, must be one of the contexts given to UseContexts. The
+// applications are not installed here, see apps.InstallDefaults.
+func Create(ctx context.Context, domain string, locale string, storageURL string, contextName string) (*Instance, error) {
+	if storageURL == "" {
+		storageURL = defaultStorageURL(domain)
+	} else {
+		var err error
+		if storageURL, err = parseStorageURL(storageURL); err != nil {
+			return nil, err
+		}
+	}
+
+	if locale != "" && !localeRegexp.MatchString(locale) {
+		return nil, ErrInvalidLocale
+	}
+
+	if contextName != "" {
+		if _, err := GetContext(contextName); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := Get(ctx, domain); err == nil {
+		return nil, ErrExists
+	} else if !IsNotFound(err) {
+		return nil, err
+	}
 
 	i := &Instance{
-		Domain:     domain,
-		StorageURL: storageURL,
+		Domain:      domain,
+		StorageURL:  storageURL,
+		Locale:      locale,
+		ContextName: contextName,
 	}
-	err := i.Create()
+	err := i.Create(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -94,26 +179,46 @@ func Create(domain string, locale string, apps []string) (*Instance, error) {
 }
 
 // Create performs the necessary setups for this instance to be usable
-func (i *Instance) Create() error {
-	if err := i.createInCouchdb(); err != nil {
+func (i *Instance) Create(ctx context.Context) error {
+	if i.CreatedAt.IsZero() {
+		i.CreatedAt = time.Now().UTC()
+	}
+	if err := i.generateRegisterToken(); err != nil {
 		return err
 	}
-	if err := i.createRootFolder(); err != nil {
+	if err := i.createInCouchdb(ctx); err != nil {
 		return err
 	}
-	if err := i.createFSIndexes(); err != nil {
+	if err := i.createKeyring(ctx); err != nil {
+		return err
+	}
+	if err := i.createFSDatabase(ctx); err != nil {
+		return err
+	}
+	if err := i.createRootFolder(ctx); err != nil {
+		return err
+	}
+	if err := i.createFSViews(ctx); err != nil {
+		return err
+	}
+	if err := i.EnsureTrashTrigger(ctx); err != nil {
 		return err
 	}
 
+	if i.Locale != "" {
+		settings := &Settings{PublicSettings: PublicSettings{Locale: i.Locale}}
+		if err := saveSettings(ctx, i.GetDatabasePrefix(), settings); err != nil {
+			return err
+		}
+	}
+
 	// TODO atomicity with defer
-	// TODO figure out what to do with locale
-	// TODO install apps
 
 	return nil
 }
 
 // Get retrieves the instance for a request by its host.
-func Get(domainarg string) (*Instance, error) {
+func Get(ctx context.Context, domainarg string) (*Instance, error) {
 	domain := domainarg
 	// TODO this is not fail-safe, to be modified before production
 	if domain == "" || strings.Contains(domain, "127.0.0.1") || strings.Contains(domain, "localhost") {
@@ -125,43 +230,239 @@ func Get(domainarg string) (*Instance, error) {
 		Selector: mango.Equal("domain", domain),
 		Limit:    1,
 	}
-	err := couchdb.FindDocs(globalDBPrefix, instanceType, req, &instances)
+	err := couchdb.FindDocs(ctx, globalDBPrefix, instanceType, req, &instances)
 	if couchdb.IsNoDatabaseError(err) {
-		return nil, fmt.Errorf("No instance for domain %v, use 'cozy-stack instances add'", domain)
+		return nil, &NotFoundError{Domain: domain}
 	}
 	if err != nil {
 		return nil, err
 	}
 
 	if len(instances) == 0 {
-		return nil, fmt.Errorf("No instance for domain %v, use 'cozy-stack instances add'", domain)
+		return nil, &NotFoundError{Domain: domain}
 	}
 
 	return instances[0], nil
 
 }
 
+// List returns all the instances of this stack
+func List(ctx context.Context) ([]*Instance, error) {
+	var all []*Instance
+	for skip := 0; ; skip += listPageSize {
+		var instances []*Instance
+		req := &couchdb.FindRequest{
+			Selector: mango.Empty(),
+			Limit:    listPageSize,
+			Skip:     skip,
+		}
+		err := couchdb.FindDocs(ctx, globalDBPrefix, instanceType, req, &instances)
+		if couchdb.IsNoDatabaseError(err) {
+			return all, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, instances...)
+		if len(instances) < listPageSize {
+			return all, nil
+		}
+	}
+}
+
+// SetTrashRetention changes the number of days the files are kept in the
+// trash of this instance
+func (i *Instance) SetTrashRetention(ctx context.Context, days int) error {
+	i.TrashRetention = days
+	return couchdb.UpdateDoc(ctx, globalDBPrefix, i)
+}
+
+// SetQuota changes the maximal size in bytes of the files of this
+// instance. 0 is for the quota of its context.
+func (i *Instance) SetQuota(ctx context.Context, quota int64) error {
+	i.Quota = quota
+	return couchdb.UpdateDoc(ctx, globalDBPrefix, i)
+}
+
+// GetQuota returns the maximal size in bytes of the files of this instance,
+// or 0 if it has no limit
+func (i *Instance) GetQuota() int64 {
+	if i.Quota > 0 {
+		return i.Quota
+	}
+	return i.GetContext().Quota
+}
+
+// Destroy removes the instance for the given domain, with its databases,
+// its files and its keyring. The instance document is removed last, so
+// that an interrupted destruction can be done again.
+func Destroy(ctx context.Context, domain string) error {
+	i, err := Get(ctx, domain)
+	if err != nil {
+		return err
+	}
+	dbs, err := couchdb.ListDatabases(ctx, i.GetDatabasePrefix())
+	if err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		if err = couchdb.DeleteDB(ctx, "", db); err != nil && !couchdb.IsNoDatabaseError(err) {
+			return err
+		}
+	}
+	fs, err := i.GetStorageProvider()
+	if err != nil {
+		return err
+	}
+	if err = fs.RemoveAll("/"); err != nil {
+		return err
+	}
+	keyring, err := getKeyring(ctx, i.GetDatabasePrefix())
+	if err != nil {
+		return err
+	}
+	if keyring.Rev() != "" {
+		if err = couchdb.DeleteDoc(ctx, globalDBPrefix, keyring); err != nil {
+			return err
+		}
+	}
+	return couchdb.DeleteDoc(ctx, globalDBPrefix, i)
+}
+
+// PurgeTrash destroys the files that have been in the trash of this
+// instance for longer than its retention period
+func (i *Instance) PurgeTrash(ctx context.Context) error {
+	days := i.TrashRetention
+	if days <= 0 {
+		days = DefaultTrashRetention
+	}
+	vfsC, err := i.GetVFSContext(ctx)
+	if err != nil {
+		return err
+	}
+	before := time.Now().AddDate(0, 0, -days)
+	return vfs.PurgeTrash(vfsC, before)
+}
+
+// RecoverMoves finishes or reverts the moves of directories of this
+// instance that have been interrupted
+func (i *Instance) RecoverMoves(ctx context.Context) error {
+	vfsC, err := i.GetVFSContext(ctx)
+	if err != nil {
+		return err
+	}
+	return vfs.RecoverMoves(vfsC)
+}
+
+// Fsck checks and repairs the VFS of this instance: the database, its
+// security, indexes and views are set if they are missing, the interrupted
+// moves of directories are recovered and the sizes of the directories are
+// recomputed. A report is kept in the _local/fsck document of the VFS
+// database.
+func (i *Instance) Fsck(ctx context.Context) error {
+	vfsC, err := i.GetVFSContext(ctx)
+	if err != nil {
+		return err
+	}
+	if err = i.createFSDatabase(ctx); err != nil {
+		return err
+	}
+	if err = i.createFSViews(ctx); err != nil {
+		return err
+	}
+	if err = vfs.RecoverMoves(vfsC); err != nil {
+		return err
+	}
+	root, err := vfs.GetDirDoc(vfsC, vfs.RootFolderID, false)
+	if err != nil {
+		return err
+	}
+	size, err := vfs.RecomputeDirSize(vfsC, root)
+	if err != nil {
+		return err
+	}
+	return i.saveFsckReport(ctx, size)
+}
+
+// fsckReportID is the identifier of the local document with the report of
+// the last fsck
+const fsckReportID = "fsck"
+
+func (i *Instance) saveFsckReport(ctx context.Context, size int64) error {
+	report, err := couchdb.GetLocal(ctx, i.GetDatabasePrefix(), vfs.FsDocType, fsckReportID)
+	if couchdb.IsNotFoundError(err) {
+		report, err = make(map[string]interface{}), nil
+	}
+	if err != nil {
+		return err
+	}
+	report["checked_at"] = time.Now()
+	report["size"] = size
+	return couchdb.PutLocal(ctx, i.GetDatabasePrefix(), vfs.FsDocType, fsckReportID, report)
+}
+
+// LastFsck returns the date of the last fsck of this instance, or the
+// zero time if it has never been checked
+func (i *Instance) LastFsck(ctx context.Context) (time.Time, error) {
+	report, err := couchdb.GetLocal(ctx, i.GetDatabasePrefix(), vfs.FsDocType, fsckReportID)
+	if couchdb.IsNotFoundError(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	checkedAt, _ := report["checked_at"].(string)
+	return time.Parse(time.RFC3339Nano, checkedAt)
+}
+
+// Replicate replicates all the databases of this instance to the CouchDB
+// server at targetURL, for example to export or migrate the instance.
+// The databases keep their names on the target server.
+func (i *Instance) Replicate(ctx context.Context, targetURL string, continuous bool) ([]*couchdb.Replication, error) {
+	dbs, err := couchdb.ListDatabases(ctx, i.GetDatabasePrefix())
+	if err != nil {
+		return nil, err
+	}
+	opts := &couchdb.ReplicationOptions{
+		Continuous:   continuous,
+		CreateTarget: true,
+	}
+	base := strings.TrimSuffix(targetURL, "/") + "/"
+	var repls []*couchdb.Replication
+	for _, db := range dbs {
+		source := couchdb.DBURL("", db)
+		repl, err := couchdb.Replicate(ctx, source, base+url.QueryEscape(db), opts)
+		if err != nil {
+			return repls, err
+		}
+		repls = append(repls, repl)
+	}
+	return repls, nil
+}
+
 // GetStorageProvider returns the afero storage provider where the binaries for
 // the current instance are persisted
 func (i *Instance) GetStorageProvider() (afero.Fs, error) {
 	if i.storage != nil {
 		return i.storage, nil
 	}
-	u, err := url.Parse(i.StorageURL)
+	fs, err := openStorage(i.StorageURL)
 	if err != nil {
 		return nil, err
 	}
-	switch u.Scheme {
-	case "file":
-		i.storage = afero.NewBasePathFs(afero.NewOsFs(), u.Path)
-	case "mem":
-		i.storage = afero.NewMemMapFs()
-	default:
-		return nil, fmt.Errorf("Unknown storage provider: %v", u.Scheme)
-	}
+	i.storage = fs
 	return i.storage, nil
 }
 
+// GetLocale returns the locale of the instance, or the default locale if
+// it has none
+func (i *Instance) GetLocale() string {
+	if i.Locale == "" {
+		return i18n.DefaultLocale
+	}
+	return i.Locale
+}
+
 // GetDatabasePrefix returns the prefix to use in database naming for the
 // current instance
 func (i *Instance) GetDatabasePrefix() string {
@@ -169,11 +470,11 @@ func (i *Instance) GetDatabasePrefix() string {
 }
 
 // GetVFSContext returns a vfs.Context for this Instance
-func (i *Instance) GetVFSContext() (c *vfs.Context, err error) {
+func (i *Instance) GetVFSContext(ctx context.Context) (c *vfs.Context, err error) {
 	dbprefix := i.GetDatabasePrefix()
 	fs, err := i.GetStorageProvider()
 	if err != nil {
 		return nil, err
 	}
-	return vfs.NewContext(fs, dbprefix), nil
+	return vfs.NewContext(fs, dbprefix).WithContext(ctx), nil
 }
@@ -1,19 +1,28 @@
 package instance
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/couchdb/couchdbtest"
 	"github.com/dcasier/cozy-stack/couchdb/mango"
+	"github.com/dcasier/cozy-stack/jobs"
 	"github.com/dcasier/cozy-stack/vfs"
-	"github.com/sourcegraph/checkup"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestGetInstanceNoDB(t *testing.T) {
-	instance, err := Get("no.instance.cozycloud.cc")
+	instance, err := Get(context.Background(), "no.instance.cozycloud.cc")
 	if assert.Error(t, err, "An error is expected") {
 		assert.Nil(t, instance)
 		assert.Contains(t, err.Error(), "No instance", "the error is not explicit")
@@ -22,15 +31,210 @@ func TestGetInstanceNoDB(t *testing.T) {
 }
 
 func TestCreateInstance(t *testing.T) {
-	instance, err := Create("test.cozycloud.cc", "en", nil)
+	instance, err := Create(context.Background(), "test.cozycloud.cc", "en", "", "")
 	if assert.NoError(t, err) {
 		assert.NotEmpty(t, instance.ID())
 		assert.Equal(t, instance.Domain, "test.cozycloud.cc")
 	}
 }
 
+func TestCreateInstanceLocale(t *testing.T) {
+	_, err := Create(context.Background(), "locale.cozycloud.cc", "french", "", "")
+	assert.Equal(t, ErrInvalidLocale, err)
+
+	instance, err := Create(context.Background(), "locale.cozycloud.cc", "fr-FR", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "fr-FR", instance.GetLocale())
+	settings, err := instance.GetSettings(context.Background())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "fr-FR", settings.Locale)
+	}
+
+	p := &PublicSettings{Locale: "fr-CA"}
+	_, err = instance.UpdatePublicSettings(context.Background(), p, "")
+	assert.NoError(t, err)
+	instance, err = Get(context.Background(), "locale.cozycloud.cc")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "fr-CA", instance.GetLocale())
+	}
+
+	assert.Equal(t, "en", (&Instance{}).GetLocale())
+}
+
+func TestCreateInstanceStorageURL(t *testing.T) {
+	ctx := context.Background()
+	_, err := Create(ctx, "storage.cozycloud.cc", "en", "ftp://example.org/", "")
+	assert.Equal(t, ErrInvalidStorageURL, err)
+	_, err = Create(ctx, "storage.cozycloud.cc", "en", "relative/path", "")
+	assert.Equal(t, ErrInvalidStorageURL, err)
+
+	instance, err := Create(ctx, "storage.cozycloud.cc", "en", "mem://storage.cozycloud.cc/", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "mem://storage.cozycloud.cc/", instance.StorageURL)
+
+	instance, err = Get(ctx, "storage.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "mem://storage.cozycloud.cc/", instance.StorageURL)
+	fs, err := instance.GetStorageProvider()
+	if assert.NoError(t, err) {
+		// The trash created with the instance is kept in memory
+		_, err = fs.Stat(vfs.TrashDirName)
+		assert.NoError(t, err)
+	}
+
+	url, err := parseStorageURL("/var/lib/cozy/storage.cozycloud.cc")
+	assert.NoError(t, err)
+	assert.Equal(t, "file://localhost/var/lib/cozy/storage.cozycloud.cc/", url)
+}
+
+func TestUseFSURL(t *testing.T) {
+	defer UseFSURL(testFSURL)
+
+	assert.Equal(t, ErrInvalidStorageURL, UseFSURL("ftp://example.org/"))
+	assert.Equal(t, ErrInvalidStorageURL, UseFSURL("relative/path"))
+
+	assert.NoError(t, UseFSURL("/var/lib/cozy"))
+	assert.Equal(t, "file://localhost/var/lib/cozy/fs.cozycloud.cc/", defaultStorageURL("fs.cozycloud.cc"))
+
+	assert.NoError(t, UseFSURL("mem://fs"))
+	instance, err := Create(context.Background(), "fs.cozycloud.cc", "en", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "mem://fs/fs.cozycloud.cc/", instance.StorageURL)
+}
+
+func TestCreateInstanceContext(t *testing.T) {
+	ctx := context.Background()
+	UseContexts([]*Context{{
+		Name:     "beta",
+		Quota:    1000000,
+		Features: []string{"sharings"},
+		Branding: map[string]string{"color": "#297ef2"},
+	}})
+	defer UseContexts(nil)
+
+	_, err := Create(ctx, "context.cozycloud.cc", "en", "mem://context.cozycloud.cc/", "alpha")
+	assert.Equal(t, ErrUnknownContext, err)
+
+	_, err = Create(ctx, "context.cozycloud.cc", "en", "mem://context.cozycloud.cc/", "beta")
+	if !assert.NoError(t, err) {
+		return
+	}
+	instance, err := Get(ctx, "context.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "beta", instance.ContextName)
+	c := instance.GetContext()
+	assert.Equal(t, int64(1000000), c.Quota)
+	assert.Equal(t, "#297ef2", c.Branding["color"])
+	assert.True(t, c.HasFeature("sharings"))
+	assert.False(t, c.HasFeature("konnectors"))
+
+	// The context may be removed from the configuration
+	UseContexts(nil)
+	c = instance.GetContext()
+	assert.Equal(t, "beta", c.Name)
+	assert.Equal(t, int64(0), c.Quota)
+}
+
+func TestDestroyInstance(t *testing.T) {
+	ctx := context.Background()
+	i, err := Create(ctx, "destroy.cozycloud.cc", "en", "mem://destroy.cozycloud.cc/", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = Create(ctx, "destroy.cozycloud.cc", "en", "mem://destroy.cozycloud.cc/", "")
+	assert.Equal(t, ErrExists, err)
+	_, err = i.GetKey(ctx, KeySessions)
+	assert.NoError(t, err)
+
+	assert.NoError(t, Destroy(ctx, "destroy.cozycloud.cc"))
+	_, err = Get(ctx, "destroy.cozycloud.cc")
+	assert.True(t, IsNotFound(err))
+	dbs, err := couchdb.ListDatabases(ctx, i.GetDatabasePrefix())
+	if assert.NoError(t, err) {
+		assert.Empty(t, dbs)
+	}
+	keyring, err := getKeyring(ctx, i.GetDatabasePrefix())
+	if assert.NoError(t, err) {
+		assert.Empty(t, keyring.Rev())
+	}
+	assert.True(t, IsNotFound(Destroy(ctx, "destroy.cozycloud.cc")))
+}
+
+func TestTrashTrigger(t *testing.T) {
+	ctx := context.Background()
+	i, err := Create(ctx, "trash.cozycloud.cc", "en", "mem://trash.cozycloud.cc/", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer Destroy(ctx, "trash.cozycloud.cc")
+
+	// the trigger is added only once
+	assert.NoError(t, i.EnsureTrashTrigger(ctx))
+	triggers, err := jobs.ListTriggers(ctx, i.GetDatabasePrefix())
+	if assert.NoError(t, err) && assert.Len(t, triggers, 1) {
+		assert.Equal(t, jobs.CronTrigger, triggers[0].Type)
+		assert.Equal(t, TrashWorkerType, triggers[0].WorkerType)
+		assert.NotNil(t, triggers[0].NextAt)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	ctx := context.Background()
+	instance, err := Get(ctx, "test.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the keys are generated with the instance
+	keyring, err := getKeyring(ctx, instance.GetDatabasePrefix())
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, purpose := range []string{KeySessions, KeyApps, KeyOAuth, KeyAdmin} {
+		assert.Len(t, keyring.Keys[purpose], 1, purpose)
+	}
+
+	key, err := instance.GetKey(ctx, KeyOAuth)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, key.Secret, keyLength)
+	assert.Equal(t, keyring.Keys[KeyOAuth][0].ID, key.ID)
+	same, err := instance.GetKey(ctx, KeyOAuth)
+	if assert.NoError(t, err) {
+		assert.Equal(t, key.ID, same.ID)
+	}
+
+	for n := 0; n < maxKeys; n++ {
+		_, err = instance.RotateKey(ctx, KeyOAuth)
+		assert.NoError(t, err)
+	}
+	keys, err := instance.GetKeys(ctx, KeyOAuth)
+	if assert.NoError(t, err) {
+		assert.Len(t, keys, maxKeys)
+		assert.NotEqual(t, key.ID, keys[maxKeys-1].ID)
+	}
+
+	revoked, err := instance.RevokeKeys(ctx, KeyOAuth)
+	assert.NoError(t, err)
+	keys, err = instance.GetKeys(ctx, KeyOAuth)
+	if assert.NoError(t, err) && assert.Len(t, keys, 1) {
+		assert.Equal(t, revoked.ID, keys[0].ID)
+	}
+}
+
 func TestGetWrongInstance(t *testing.T) {
-	instance, err := Get("no.instance.cozycloud.cc")
+	instance, err := Get(context.Background(), "no.instance.cozycloud.cc")
 	if assert.Error(t, err, "An error is expected") {
 		assert.Nil(t, instance)
 		assert.Contains(t, err.Error(), "No instance", "the error is not explicit")
@@ -39,7 +243,7 @@ func TestGetWrongInstance(t *testing.T) {
 }
 
 func TestGetCorrectInstance(t *testing.T) {
-	instance, err := Get("test.cozycloud.cc")
+	instance, err := Get(context.Background(), "test.cozycloud.cc")
 	if assert.NoError(t, err, "An error is expected") {
 		assert.NotNil(t, instance)
 		assert.Equal(t, instance.Domain, "test.cozycloud.cc")
@@ -49,7 +253,7 @@ func TestGetCorrectInstance(t *testing.T) {
 func TestInstanceHasRootFolder(t *testing.T) {
 	var root vfs.DirDoc
 	prefix := getDBPrefix(t, "test.cozycloud.cc")
-	err := couchdb.GetDoc(prefix, vfs.FsDocType, vfs.RootFolderID, &root)
+	err := couchdb.GetDoc(context.Background(), prefix, vfs.FsDocType, vfs.RootFolderID, &root)
 	if assert.NoError(t, err) {
 		assert.Equal(t, root.Fullpath, "/")
 	}
@@ -59,29 +263,181 @@ func TestInstanceHasIndexes(t *testing.T) {
 	var results []*vfs.DirDoc
 	prefix := getDBPrefix(t, "test.cozycloud.cc")
 	req := &couchdb.FindRequest{Selector: mango.Equal("path", "/")}
-	err := couchdb.FindDocs(prefix, vfs.FsDocType, req, &results)
+	err := couchdb.FindDocs(context.Background(), prefix, vfs.FsDocType, req, &results)
 	assert.NoError(t, err)
 	assert.Len(t, results, 1)
 }
 
-func TestMain(m *testing.M) {
-	const CouchDBURL = "http://localhost:5984/"
-	const TestPrefix = "dev/"
+func TestFsckReport(t *testing.T) {
+	instance, err := Get(context.Background(), "test.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	last, err := instance.LastFsck(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, last.IsZero())
+
+	for n := 0; n < 2; n++ {
+		assert.NoError(t, instance.Fsck(context.Background()))
+	}
+	last, err = instance.LastFsck(context.Background())
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), last, time.Minute)
+}
+
+func TestInfo(t *testing.T) {
+	ctx := context.Background()
+	instance, err := Get(ctx, "test.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	info, err := instance.Info(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "test.cozycloud.cc", info.Domain)
+		assert.Equal(t, instance.StorageURL, info.StorageURL)
+		assert.Equal(t, int64(0), info.DiskUsage)
+		assert.Equal(t, StateOnboarding, info.State)
+		if assert.NotNil(t, info.CreatedAt) {
+			assert.WithinDuration(t, time.Now(), *info.CreatedAt, time.Minute)
+		}
+	}
+
+	infos, err := ListInfos(ctx)
+	assert.NoError(t, err)
+	var domains []string
+	for _, info := range infos {
+		domains = append(domains, info.Domain)
+	}
+	assert.Contains(t, domains, "test.cozycloud.cc")
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	i, err := Get(ctx, "test.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, doctype := range []string{"io.cozy.sessions", "io.cozy.apps.tokens", "io.cozy.oauth.tokens", "io.cozy.sharings.links", "io.cozy.contacts"} {
+		doc := &couchdb.JSONDoc{Type: doctype, M: map[string]interface{}{"secret": "foo"}}
+		assert.NoError(t, couchdb.CreateDoc(ctx, i.GetDatabasePrefix(), doc))
+	}
+
+	var buf bytes.Buffer
+	err = Export(ctx, "test.cozycloud.cc", &buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	gr, err := gzip.NewReader(&buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tr := tar.NewReader(gr)
+	entries := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		data, err := ioutil.ReadAll(tr)
+		assert.NoError(t, err)
+		entries[hdr.Name] = data
+	}
+
+	var manifest ExportManifest
+	if assert.Contains(t, entries, "test.cozycloud.cc/manifest.json") {
+		err = json.Unmarshal(entries["test.cozycloud.cc/manifest.json"], &manifest)
+		assert.NoError(t, err)
+		assert.Equal(t, "test.cozycloud.cc", manifest.Domain)
+		assert.Contains(t, manifest.Databases, "io-cozy-files")
+		assert.Contains(t, manifest.Databases, "io-cozy-contacts")
+		for _, name := range manifest.Databases {
+			assert.False(t, skipExport(name), name)
+		}
+		for _, name := range []string{"io-cozy-settings", "io-cozy-sessions", "io-cozy-apps-tokens", "io-cozy-oauth-tokens", "io-cozy-sharings-links"} {
+			assert.NotContains(t, manifest.Databases, name)
+			assert.NotContains(t, entries, "test.cozycloud.cc/couchdb/"+name+".json")
+		}
+	}
+	if assert.Contains(t, entries, "test.cozycloud.cc/couchdb/io-cozy-files.json") {
+		var docs []map[string]interface{}
+		err = json.Unmarshal(entries["test.cozycloud.cc/couchdb/io-cozy-files.json"], &docs)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, docs)
+	}
+	assert.Contains(t, entries, "test.cozycloud.cc/files/")
+
+	err = Export(ctx, "no.instance.cozycloud.cc", &buf)
+	assert.Error(t, err)
+}
+
+func TestRegisterPassphrase(t *testing.T) {
+	ctx := context.Background()
+	instance, err := Get(ctx, "test.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	token := instance.RegisterToken
+	assert.Len(t, token, registerTokenLength)
 
-	db, err := checkup.HTTPChecker{URL: CouchDBURL}.Check()
-	if err != nil || db.Status() != checkup.Healthy {
-		fmt.Println("This test need couchdb to run.")
+	err = instance.RegisterPassphrase(ctx, "a-long-passphrase", []byte("not-the-token"))
+	assert.Equal(t, ErrInvalidRegisterToken, err)
+	err = instance.RegisterPassphrase(ctx, "short", token)
+	assert.Equal(t, ErrPassphraseTooShort, err)
+	err = instance.RegisterPassphrase(ctx, "a-long-passphrase", token)
+	assert.NoError(t, err)
+
+	// the token can't be used again
+	instance, err = Get(ctx, "test.cozycloud.cc")
+	if assert.NoError(t, err) {
+		assert.Empty(t, instance.RegisterToken)
+		state, err := instance.State(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, StateActive, state)
+	}
+	err = instance.RegisterPassphrase(ctx, "another-passphrase", token)
+	assert.Equal(t, ErrPassphraseAlreadySet, err)
+	assert.NoError(t, instance.CheckPassphrase(ctx, "a-long-passphrase"))
+}
+
+// testFSURL is the root of the storages of the instances created by the
+// tests without a storage URL
+const testFSURL = "mem://tests/"
+
+func TestMain(m *testing.M) {
+	couchURL, stop := couchdbtest.Start()
+	if err := couchdb.UseServer(couchdb.ServerOptions{URL: couchURL}); err != nil {
+		fmt.Println("Cant use couchdb", err)
+		os.Exit(1)
+	}
+	if err := UseFSURL(testFSURL); err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
-	couchdb.DeleteDB(globalDBPrefix, instanceType)
-	couchdb.DeleteDB("test.cozycloud.cc/", vfs.FsDocType)
-	os.RemoveAll("/usr/local/var/cozy2/")
+	couchdb.DeleteDB(context.Background(), globalDBPrefix, instanceType)
+	couchdb.DeleteDB(context.Background(), globalDBPrefix, keyringType)
+	couchdb.DeleteDB(context.Background(), "test.cozycloud.cc/", vfs.FsDocType)
+	couchdb.DeleteDB(context.Background(), "test.cozycloud.cc/", SettingsDocType)
+	couchdb.DeleteDB(context.Background(), "locale.cozycloud.cc/", vfs.FsDocType)
+	couchdb.DeleteDB(context.Background(), "locale.cozycloud.cc/", SettingsDocType)
+	couchdb.DeleteDB(context.Background(), "storage.cozycloud.cc/", vfs.FsDocType)
+	couchdb.DeleteDB(context.Background(), "storage.cozycloud.cc/", SettingsDocType)
+	couchdb.DeleteDB(context.Background(), "context.cozycloud.cc/", vfs.FsDocType)
+	couchdb.DeleteDB(context.Background(), "context.cozycloud.cc/", SettingsDocType)
+	couchdb.DeleteDB(context.Background(), "destroy.cozycloud.cc/", vfs.FsDocType)
+	couchdb.DeleteDB(context.Background(), "fs.cozycloud.cc/", vfs.FsDocType)
+	couchdb.DeleteDB(context.Background(), "fs.cozycloud.cc/", SettingsDocType)
 
-	os.Exit(m.Run())
+	res := m.Run()
+	stop()
+	os.Exit(res)
 }
 
 func getDBPrefix(t *testing.T, domain string) string {
-	instance, err := Get(domain)
+	instance, err := Get(context.Background(), domain)
 	if !assert.NoError(t, err, "Should get instance %v", domain) {
 		t.FailNow()
 	}
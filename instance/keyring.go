@@ -0,0 +1,218 @@
+package instance
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+)
+
+// keyringType is the doctype of the keyrings of the instances. They are
+// kept in the global database, that only the stack can read, and not with
+// the documents of the instances.
+const keyringType = "keyrings"
+
+// The purposes of the keys of an instance
+const (
+	// KeySessions is the purpose of the keys used to sign the session
+	// cookies and the CSRF tokens
+	KeySessions = "sessions"
+	// KeyApps is the purpose of the keys used to sign the tokens of the
+	// applications
+	KeyApps = "apps"
+	// KeyOAuth is the purpose of the keys used to sign the tokens of the
+	// OAuth2 clients
+	KeyOAuth = "oauth"
+	// KeyAdmin is the purpose of the keys used to sign the short-lived
+	// tokens that give the hosters the rights of the owner on the API
+	KeyAdmin = "admin"
+)
+
+// keyLength is the number of random bytes of a key
+const keyLength = 32
+
+// maxKeys is the number of keys kept for a purpose: the current key, and
+// the previous ones that are still accepted after a rotation
+const maxKeys = 3
+
+// A Key is a secret of an instance, identified by a random ID
+type Key struct {
+	ID        string    `json:"id"`
+	Secret    []byte    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Keyring is the document with the keys of an instance, by purpose. The
+// first key of a purpose is the current one, used to sign, and the others
+// are the previous keys, still accepted to verify.
+type Keyring struct {
+	KeyringID  string            `json:"_id,omitempty"`
+	KeyringRev string            `json:"_rev,omitempty"`
+	Keys       map[string][]*Key `json:"keys"`
+}
+
+// ID returns the keyring identifier - see couchdb.Doc interface
+func (k *Keyring) ID() string { return k.KeyringID }
+
+// Rev returns the keyring revision - see couchdb.Doc interface
+func (k *Keyring) Rev() string { return k.KeyringRev }
+
+// DocType returns the keyring doctype - see couchdb.Doc interface
+func (k *Keyring) DocType() string { return keyringType }
+
+// SetID changes the keyring identifier - see couchdb.Doc interface
+func (k *Keyring) SetID(id string) { k.KeyringID = id }
+
+// SetRev changes the keyring revision - see couchdb.Doc interface
+func (k *Keyring) SetRev(rev string) { k.KeyringRev = rev }
+
+func newKey() (*Key, error) {
+	secret := make([]byte, keyLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &Key{
+		ID:        hex.EncodeToString(id),
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// getKeyring returns the keyring of the instance with the given database
+// prefix, empty if it has not been saved yet. The keyring is identified by
+// the domain of the instance.
+func getKeyring(ctx context.Context, db string) (*Keyring, error) {
+	keyring := &Keyring{}
+	id := strings.TrimSuffix(db, "/")
+	err := couchdb.GetDoc(ctx, globalDBPrefix, keyringType, id, keyring)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return &Keyring{KeyringID: id, Keys: make(map[string][]*Key)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if keyring.Keys == nil {
+		keyring.Keys = make(map[string][]*Key)
+	}
+	return keyring, nil
+}
+
+func saveKeyring(ctx context.Context, keyring *Keyring) error {
+	if keyring.Rev() != "" {
+		return couchdb.UpdateDoc(ctx, globalDBPrefix, keyring)
+	}
+	err := couchdb.EnsureDBExists(ctx, globalDBPrefix, keyringType, &couchdb.DBOptions{
+		Security: couchdb.AdminOnlySecurity,
+	})
+	if err != nil {
+		return err
+	}
+	return couchdb.CreateNamedDoc(ctx, globalDBPrefix, keyring)
+}
+
+// createKeyring generates the keys of all the purposes for a new instance.
+// The keys of a previous instance with the same domain are replaced.
+func (i *Instance) createKeyring(ctx context.Context) error {
+	keyring, err := getKeyring(ctx, i.GetDatabasePrefix())
+	if err != nil {
+		return err
+	}
+	for _, purpose := range []string{KeySessions, KeyApps, KeyOAuth, KeyAdmin} {
+		key, err := newKey()
+		if err != nil {
+			return err
+		}
+		keyring.Keys[purpose] = []*Key{key}
+	}
+	return saveKeyring(ctx, keyring)
+}
+
+// GetKeys returns the keys of the instance with the given database prefix
+// for a purpose, the current one first. The keys are generated when the
+// instance is created, and a missing key is generated on the first call.
+func GetKeys(ctx context.Context, db, purpose string) ([]*Key, error) {
+	keyring, err := getKeyring(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if keys := keyring.Keys[purpose]; len(keys) > 0 {
+		return keys, nil
+	}
+
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	keyring.Keys[purpose] = []*Key{key}
+	err = saveKeyring(ctx, keyring)
+	if couchdb.IsConflictError(err) {
+		// the key may have been generated by a concurrent call
+		current, errg := getKeyring(ctx, db)
+		if errg == nil && len(current.Keys[purpose]) > 0 {
+			return current.Keys[purpose], nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keyring.Keys[purpose], nil
+}
+
+// GetKeys returns the keys of the instance for a purpose, the current one
+// first
+func (i *Instance) GetKeys(ctx context.Context, purpose string) ([]*Key, error) {
+	return GetKeys(ctx, i.GetDatabasePrefix(), purpose)
+}
+
+// GetKey returns the current key of the instance for a purpose, used to
+// sign
+func (i *Instance) GetKey(ctx context.Context, purpose string) (*Key, error) {
+	keys, err := i.GetKeys(ctx, purpose)
+	if err != nil {
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+// RotateKey generates a new current key for a purpose. The previous keys
+// are still accepted to verify, until they are pushed out by the next
+// rotations.
+func (i *Instance) RotateKey(ctx context.Context, purpose string) (*Key, error) {
+	return i.renewKeys(ctx, purpose, maxKeys)
+}
+
+// RevokeKeys replaces all the keys of a purpose by a new one, so that what
+// has been signed with the previous keys is no longer accepted
+func (i *Instance) RevokeKeys(ctx context.Context, purpose string) (*Key, error) {
+	return i.renewKeys(ctx, purpose, 1)
+}
+
+func (i *Instance) renewKeys(ctx context.Context, purpose string, keep int) (*Key, error) {
+	if _, err := i.GetKeys(ctx, purpose); err != nil {
+		return nil, err
+	}
+	keyring, err := getKeyring(ctx, i.GetDatabasePrefix())
+	if err != nil {
+		return nil, err
+	}
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	keys := append([]*Key{key}, keyring.Keys[purpose]...)
+	if len(keys) > keep {
+		keys = keys[:keep]
+	}
+	keyring.Keys[purpose] = keys
+	if err = saveKeyring(ctx, keyring); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,186 @@
+package instance
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SettingsDocType is the doctype of the settings of an instance
+const SettingsDocType = "io.cozy.settings"
+
+// SettingsID is the identifier of the settings document of an instance
+const SettingsID = "io.cozy.settings.instance"
+
+// minPassphraseLength is the minimal number of characters of a passphrase
+const minPassphraseLength = 8
+
+// registerTokenLength is the number of random bytes of the registration
+// token of an instance
+const registerTokenLength = 16
+
+var (
+	// ErrPassphraseAlreadySet is used when a passphrase is registered for an
+	// instance that already has one
+	ErrPassphraseAlreadySet = errors.New("The passphrase of this instance is already registered")
+	// ErrPassphraseTooShort is used when the passphrase to register is too
+	// short
+	ErrPassphraseTooShort = errors.New("The passphrase is too short")
+	// ErrNoPassphrase is used when the owner logs in on an instance that has
+	// no passphrase yet
+	ErrNoPassphrase = errors.New("No passphrase has been registered for this instance")
+	// ErrInvalidPassphrase is used when the passphrase given to log in is
+	// not the one of the instance
+	ErrInvalidPassphrase = errors.New("Invalid passphrase")
+	// ErrInvalidRegisterToken is used when the passphrase is registered
+	// without the registration token of the instance
+	ErrInvalidRegisterToken = errors.New("Invalid registration token")
+)
+
+// Settings is the document with the settings of an instance, persisted in
+// its own database. The passphrase is stored hashed with bcrypt. Only the
+// public settings can be read with the settings API.
+type Settings struct {
+	SettingsID  string `json:"_id,omitempty"`
+	SettingsRev string `json:"_rev,omitempty"`
+
+	PublicSettings
+
+	PassphraseHash []byte `json:"passphrase_hash,omitempty"`
+}
+
+// ID returns the settings identifier - see couchdb.Doc interface
+func (s *Settings) ID() string { return s.SettingsID }
+
+// Rev returns the settings revision - see couchdb.Doc interface
+func (s *Settings) Rev() string { return s.SettingsRev }
+
+// DocType returns the settings doctype - see couchdb.Doc interface
+func (s *Settings) DocType() string { return SettingsDocType }
+
+// SetID changes the settings identifier - see couchdb.Doc interface
+func (s *Settings) SetID(id string) { s.SettingsID = id }
+
+// SetRev changes the settings revision - see couchdb.Doc interface
+func (s *Settings) SetRev(rev string) { s.SettingsRev = rev }
+
+// GetSettings returns the settings of the instance, empty if they have not
+// been saved yet
+func (i *Instance) GetSettings(ctx context.Context) (*Settings, error) {
+	return getSettings(ctx, i.GetDatabasePrefix())
+}
+
+func getSettings(ctx context.Context, db string) (*Settings, error) {
+	settings := &Settings{}
+	err := couchdb.GetDoc(ctx, db, SettingsDocType, SettingsID, settings)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return &Settings{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// generateRegisterToken generates the registration token of a new
+// instance, given by the hoster to the owner for the onboarding
+func (i *Instance) generateRegisterToken() error {
+	token := make([]byte, registerTokenLength)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	i.RegisterToken = token
+	return nil
+}
+
+// RegisterPassphrase sets the passphrase of the owner of the instance, and
+// generates the key used to sign the session cookies. It can be called
+// only once, when the instance has no passphrase, with the registration
+// token of the instance, that can't be used again after.
+func (i *Instance) RegisterPassphrase(ctx context.Context, passphrase string, token []byte) error {
+	settings, err := i.GetSettings(ctx)
+	if err != nil {
+		return err
+	}
+	if len(settings.PassphraseHash) > 0 {
+		return ErrPassphraseAlreadySet
+	}
+	if len(i.RegisterToken) == 0 || subtle.ConstantTimeCompare(i.RegisterToken, token) != 1 {
+		return ErrInvalidRegisterToken
+	}
+	if len(passphrase) < minPassphraseLength {
+		return ErrPassphraseTooShort
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(passphrase), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if _, err = i.RevokeKeys(ctx, KeySessions); err != nil {
+		return err
+	}
+	settings, err = i.GetSettings(ctx)
+	if err != nil {
+		return err
+	}
+	settings.PassphraseHash = hash
+	if err = saveSettings(ctx, i.GetDatabasePrefix(), settings); err != nil {
+		return err
+	}
+	i.RegisterToken = nil
+	return couchdb.UpdateDoc(ctx, globalDBPrefix, i)
+}
+
+func saveSettings(ctx context.Context, db string, settings *Settings) error {
+	if settings.Rev() == "" {
+		settings.SetID(SettingsID)
+		return couchdb.CreateNamedDocWithDB(ctx, db, settings)
+	}
+	return couchdb.UpdateDoc(ctx, db, settings)
+}
+
+// CheckPassphrase checks that the given passphrase is the one of the owner
+// of the instance
+func (i *Instance) CheckPassphrase(ctx context.Context, passphrase string) error {
+	settings, err := i.GetSettings(ctx)
+	if err != nil {
+		return err
+	}
+	if len(settings.PassphraseHash) == 0 {
+		return ErrNoPassphrase
+	}
+	err = bcrypt.CompareHashAndPassword(settings.PassphraseHash, []byte(passphrase))
+	if err != nil {
+		return ErrInvalidPassphrase
+	}
+	return nil
+}
+
+// UpdatePassphrase changes the passphrase of the owner of the instance,
+// after checking the current one. The keys of the sessions are revoked, so
+// that all the sessions are closed, including the current one.
+func (i *Instance) UpdatePassphrase(ctx context.Context, current, passphrase string) error {
+	if err := i.CheckPassphrase(ctx, current); err != nil {
+		return err
+	}
+	if len(passphrase) < minPassphraseLength {
+		return ErrPassphraseTooShort
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(passphrase), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if _, err = i.RevokeKeys(ctx, KeySessions); err != nil {
+		return err
+	}
+	settings, err := i.GetSettings(ctx)
+	if err != nil {
+		return err
+	}
+	settings.PassphraseHash = hash
+	return saveSettings(ctx, i.GetDatabasePrefix(), settings)
+}
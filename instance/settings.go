@@ -0,0 +1,91 @@
+package instance
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"regexp"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+)
+
+var (
+	// ErrInvalidEmail is used when the email of the settings is not a valid
+	// address
+	ErrInvalidEmail = errors.New("Invalid email address")
+	// ErrInvalidLocale is used when the locale of the settings is not a
+	// language code, like en or fr-FR
+	ErrInvalidLocale = errors.New("Invalid locale")
+	// ErrInvalidTimezone is used when the timezone of the settings is not a
+	// timezone of the IANA database, like Europe/Paris
+	ErrInvalidTimezone = errors.New("Invalid timezone")
+	// ErrSettingsConflict is used when the settings are updated from an old
+	// revision
+	ErrSettingsConflict = errors.New("The settings have been modified since this revision")
+)
+
+var localeRegexp = regexp.MustCompile(`^[a-z]{2}(-[A-Z]{2})?$`)
+
+// PublicSettings are the settings of an instance that its owner, and the
+// applications with a settings scope, can read and change
+type PublicSettings struct {
+	// PublicName is the name of the owner, as shown to the other people
+	PublicName string `json:"public_name,omitempty"`
+	Email      string `json:"email,omitempty"`
+	// Locale is a language code, like en or fr-FR
+	Locale string `json:"locale,omitempty"`
+	// Timezone is a timezone of the IANA database, like Europe/Paris
+	Timezone string `json:"timezone,omitempty"`
+	// Background is the URL of the background image of the home
+	Background string `json:"background,omitempty"`
+}
+
+// Validate checks the format of the public settings. The empty settings are
+// valid, as they are not set yet.
+func (p *PublicSettings) Validate() error {
+	if p.Email != "" {
+		addr, err := mail.ParseAddress(p.Email)
+		if err != nil || addr.Address != p.Email {
+			return ErrInvalidEmail
+		}
+	}
+	if p.Locale != "" && !localeRegexp.MatchString(p.Locale) {
+		return ErrInvalidLocale
+	}
+	if p.Timezone != "" {
+		if _, err := time.LoadLocation(p.Timezone); err != nil || p.Timezone == "Local" {
+			return ErrInvalidTimezone
+		}
+	}
+	return nil
+}
+
+// UpdatePublicSettings replaces the public settings of the instance. If rev
+// is not empty, it must be the current revision of the settings, else
+// the update is rejected with a conflict error.
+func (i *Instance) UpdatePublicSettings(ctx context.Context, p *PublicSettings, rev string) (*Settings, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	settings, err := i.GetSettings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rev != "" && rev != settings.Rev() {
+		return nil, ErrSettingsConflict
+	}
+	settings.PublicSettings = *p
+	if err = saveSettings(ctx, i.GetDatabasePrefix(), settings); err != nil {
+		return nil, err
+	}
+	// the locale is kept on the instance too, for the strings shown by the
+	// stack without reading the settings
+	if p.Locale != "" && p.Locale != i.Locale {
+		i.Locale = p.Locale
+		if err = couchdb.UpdateDoc(ctx, globalDBPrefix, i); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
@@ -0,0 +1,26 @@
+package instance
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePublicSettings(t *testing.T) {
+	assert.NoError(t, (&PublicSettings{}).Validate())
+	valid := &PublicSettings{
+		PublicName: "Alice",
+		Email:      "alice@example.com",
+		Locale:     "fr-FR",
+		Timezone:   "UTC",
+		Background: "/assets/background.jpg",
+	}
+	assert.NoError(t, valid.Validate())
+
+	assert.Equal(t, ErrInvalidEmail, (&PublicSettings{Email: "alice"}).Validate())
+	assert.Equal(t, ErrInvalidEmail, (&PublicSettings{Email: "Alice <alice@example.com>"}).Validate())
+	assert.Equal(t, ErrInvalidLocale, (&PublicSettings{Locale: "french"}).Validate())
+	assert.Equal(t, ErrInvalidLocale, (&PublicSettings{Locale: "fr_FR"}).Validate())
+	assert.Equal(t, ErrInvalidTimezone, (&PublicSettings{Timezone: "Nowhere/Atlantis"}).Validate())
+	assert.Equal(t, ErrInvalidTimezone, (&PublicSettings{Timezone: "Local"}).Validate())
+}
@@ -0,0 +1,129 @@
+package instance
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// ErrInvalidStorageURL is used when the storage URL given for a new instance
+// is not a local path or an URL with a known scheme
+var ErrInvalidStorageURL = errors.New("Invalid storage URL")
+
+// StorageDriver builds the afero storage provider for the storage URL of an
+// instance, like swift://container/ or s3://bucket/prefix/
+type StorageDriver func(u *url.URL) (afero.Fs, error)
+
+var (
+	storageMu      sync.RWMutex
+	storageDrivers = map[string]StorageDriver{
+		"file": fileStorage,
+		"mem":  memStorage,
+	}
+
+	memStoragesMu sync.Mutex
+	memStorages   = make(map[string]afero.Fs)
+
+	// fsURL is the root of the storages of the instances created without
+	// a storage URL
+	fsURL = DefaultFSURL
+)
+
+// DefaultFSURL is the root of the storages of the instances when no fs.url
+// is configured
+const DefaultFSURL = "file://localhost/tmp/cozy2/"
+
+// UseFSURL changes the root of the storages of the new instances created
+// without a storage URL: each of them has a directory named after its
+// domain in it. It can be a local path, like /var/lib/cozy, a file:// URL,
+// mem:// for the tests, or an URL with a scheme added by RegisterStorage.
+func UseFSURL(rawurl string) error {
+	u, err := parseStorageURL(rawurl)
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	storageMu.Lock()
+	defer storageMu.Unlock()
+	fsURL = u
+	return nil
+}
+
+// defaultStorageURL returns the storage URL of a new instance in the root
+// of the storages
+func defaultStorageURL(domain string) string {
+	storageMu.RLock()
+	defer storageMu.RUnlock()
+	return fsURL + domain + "/"
+}
+
+// RegisterStorage adds a driver for the storage URLs with the given scheme,
+// so that the instances can be created on other storage tiers, like an
+// object storage. It replaces the previous driver for this scheme.
+func RegisterStorage(scheme string, driver StorageDriver) {
+	storageMu.Lock()
+	defer storageMu.Unlock()
+	storageDrivers[scheme] = driver
+}
+
+func getStorageDriver(scheme string) (StorageDriver, bool) {
+	storageMu.RLock()
+	defer storageMu.RUnlock()
+	driver, ok := storageDrivers[scheme]
+	return driver, ok
+}
+
+// parseStorageURL checks the storage URL given for a new instance and
+// returns its normalized form. A local path, like /var/lib/cozy/foo, is
+// converted to a file:// URL.
+func parseStorageURL(storageURL string) (string, error) {
+	if filepath.IsAbs(storageURL) {
+		return "file://localhost" + filepath.ToSlash(filepath.Clean(storageURL)) + "/", nil
+	}
+	u, err := url.Parse(storageURL)
+	if err != nil || u.Scheme == "" {
+		return "", ErrInvalidStorageURL
+	}
+	if _, ok := getStorageDriver(u.Scheme); !ok {
+		return "", ErrInvalidStorageURL
+	}
+	return u.String(), nil
+}
+
+func fileStorage(u *url.URL) (afero.Fs, error) {
+	return afero.NewBasePathFs(afero.NewOsFs(), u.Path), nil
+}
+
+// memStorage returns the same storage for the same URL, to keep the files of
+// an instance while the process is alive, even if the instance document is
+// fetched again from CouchDB. It is useful for the tests.
+func memStorage(u *url.URL) (afero.Fs, error) {
+	key := u.Host + u.Path
+	memStoragesMu.Lock()
+	defer memStoragesMu.Unlock()
+	fs, ok := memStorages[key]
+	if !ok {
+		fs = afero.NewMemMapFs()
+		memStorages[key] = fs
+	}
+	return fs, nil
+}
+
+func openStorage(storageURL string) (afero.Fs, error) {
+	u, err := url.Parse(storageURL)
+	if err != nil {
+		return nil, err
+	}
+	driver, ok := getStorageDriver(u.Scheme)
+	if !ok {
+		return nil, fmt.Errorf("Unknown storage provider: %v", u.Scheme)
+	}
+	return driver(u)
+}
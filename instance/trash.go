@@ -0,0 +1,58 @@
+package instance
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/dcasier/cozy-stack/jobs"
+)
+
+// TrashWorkerType is the worker type of the jobs that purge the trash of an
+// instance
+const TrashWorkerType = "trash"
+
+// trashSchedule is the cron expression of the trigger that pushes the jobs
+// of the trash worker
+const trashSchedule = "@hourly"
+
+// trashTimeout is the maximal duration of a purge, longer than the default
+// timeout of the jobs for the big trashes
+const trashTimeout = 10 * time.Minute
+
+func init() {
+	jobs.AddWorkerConfig(&jobs.WorkerConfig{
+		WorkerType: TrashWorkerType,
+		WorkerFunc: trashWorker,
+		Timeout:    trashTimeout,
+	})
+}
+
+// trashWorker is the worker of the trash jobs. It destroys the files that
+// have been in the trash for longer than the retention period.
+func trashWorker(ctx context.Context, job *jobs.Job) error {
+	i, err := Get(ctx, strings.TrimSuffix(job.DBPrefix, "/"))
+	if err != nil {
+		return err
+	}
+	return i.PurgeTrash(ctx)
+}
+
+// EnsureTrashTrigger adds the @cron trigger of the trash worker to the
+// instance, if it doesn't have one
+func (i *Instance) EnsureTrashTrigger(ctx context.Context) error {
+	triggers, err := jobs.ListTriggers(ctx, i.GetDatabasePrefix())
+	if err != nil {
+		return err
+	}
+	for _, t := range triggers {
+		if t.Type == jobs.CronTrigger && t.WorkerType == TrashWorkerType {
+			return nil
+		}
+	}
+	return jobs.AddTrigger(ctx, i.GetDatabasePrefix(), &jobs.Trigger{
+		Type:       jobs.CronTrigger,
+		Arguments:  trashSchedule,
+		WorkerType: TrashWorkerType,
+	})
+}
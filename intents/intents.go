@@ -0,0 +1,112 @@
+// Package intents is for the communication between applications: an
+// application asks for an action on a type of documents, and the stack
+// finds the installed applications that can handle it.
+package intents
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+)
+
+// IntentDocType is the doctype of the intents
+const IntentDocType = "io.cozy.intents"
+
+var (
+	// ErrMissingAction is used when an intent is created without action
+	ErrMissingAction = errors.New("The action of the intent is missing")
+	// ErrMissingType is used when an intent is created without type
+	ErrMissingType = errors.New("The type of the intent is missing")
+)
+
+// Service is an installed application that can handle an intent, with the
+// path of its page for this intent
+type Service struct {
+	Slug string `json:"slug"`
+	Href string `json:"href"`
+}
+
+// Intent is a request of an application, the client, for an action on a
+// type of documents. The services are the applications that can handle
+// it, resolved when the intent is created.
+type Intent struct {
+	IntentID  string `json:"_id,omitempty"`
+	IntentRev string `json:"_rev,omitempty"`
+
+	Action   string    `json:"action"`
+	Type     string    `json:"type"`
+	Client   string    `json:"client,omitempty"`
+	Services []Service `json:"services"`
+}
+
+// ID returns the intent identifier - see couchdb.Doc interface
+func (in *Intent) ID() string { return in.IntentID }
+
+// Rev returns the intent revision - see couchdb.Doc interface
+func (in *Intent) Rev() string { return in.IntentRev }
+
+// DocType returns the intent doctype - see couchdb.Doc interface
+func (in *Intent) DocType() string { return IntentDocType }
+
+// SetID changes the intent identifier - see couchdb.Doc interface
+func (in *Intent) SetID(id string) { in.IntentID = id }
+
+// SetRev changes the intent revision - see couchdb.Doc interface
+func (in *Intent) SetRev(rev string) { in.IntentRev = rev }
+
+// SelfLink is the URL of the intent - see jsonapi.Object interface
+func (in *Intent) SelfLink() string { return "/intents/" + in.IntentID }
+
+// Relationships is part of the jsonapi.Object interface
+func (in *Intent) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{}
+}
+
+// Included is part of the jsonapi.Object interface
+func (in *Intent) Included() []jsonapi.Object {
+	return []jsonapi.Object{}
+}
+
+// FindServices returns the applications that are installed and ready and
+// that declare an intent for the given action on the given type
+func FindServices(ctx context.Context, db string, action, typ string) ([]Service, error) {
+	mans, err := apps.List(ctx, db, apps.Webapp)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	services := []Service{}
+	for _, man := range mans {
+		if man.State != apps.Ready {
+			continue
+		}
+		if intent := man.FindIntent(action, typ); intent != nil {
+			services = append(services, Service{Slug: man.Slug, Href: intent.Href})
+		}
+	}
+	return services, nil
+}
+
+// Create resolves the services of an intent, and persists it. An intent
+// that no application can handle is created with an empty list of
+// services: it is up to the client to tell the user.
+func Create(ctx context.Context, db string, in *Intent) error {
+	in.Action = strings.ToUpper(strings.TrimSpace(in.Action))
+	in.Type = strings.TrimSpace(in.Type)
+	if in.Action == "" {
+		return ErrMissingAction
+	}
+	if in.Type == "" {
+		return ErrMissingType
+	}
+
+	services, err := FindServices(ctx, db, in.Action, in.Type)
+	if err != nil {
+		return err
+	}
+	in.Services = services
+	return couchdb.CreateDoc(ctx, db, in)
+}
@@ -0,0 +1,221 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dcasier/cozy-stack/redis"
+)
+
+// Ref is the reference to a job that is pushed in a queue: the job itself
+// is kept in the database of its instance
+type Ref struct {
+	DBPrefix string `json:"prefix"`
+	JobID    string `json:"id"`
+}
+
+// Broker keeps the queues of the jobs, one queue per worker type
+type Broker interface {
+	// Enqueue pushes a job at the end of the queue of a worker type
+	Enqueue(workerType string, ref *Ref) error
+	// Dequeue takes the first job of the queue of a worker type, and waits
+	// for one if the queue is empty. It returns the error of the context
+	// when it is done.
+	Dequeue(ctx context.Context, workerType string) (*Ref, error)
+	// Len returns the number of jobs in the queue of a worker type
+	Len(workerType string) (int, error)
+}
+
+var broker Broker = NewMemoryBroker()
+
+// UseBroker changes the broker of the jobs. It must be called before the
+// workers are started.
+func UseBroker(b Broker) {
+	broker = b
+}
+
+func getBroker() Broker {
+	return broker
+}
+
+// memoryQueue is a queue of jobs kept in memory. The ready channel has a
+// value when the queue may not be empty.
+type memoryQueue struct {
+	refs  []*Ref
+	ready chan struct{}
+}
+
+// MemoryBroker is a Broker that keeps the queues in the memory of the
+// stack. The queues are not shared between several stacks, and they are
+// lost when the stack is stopped.
+type MemoryBroker struct {
+	mu     sync.Mutex
+	queues map[string]*memoryQueue
+}
+
+// NewMemoryBroker returns an empty MemoryBroker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{queues: make(map[string]*memoryQueue)}
+}
+
+func (b *MemoryBroker) queue(workerType string) *memoryQueue {
+	q, ok := b.queues[workerType]
+	if !ok {
+		q = &memoryQueue{ready: make(chan struct{}, 1)}
+		b.queues[workerType] = q
+	}
+	return q
+}
+
+// Enqueue pushes a job in a queue - see Broker interface
+func (b *MemoryBroker) Enqueue(workerType string, ref *Ref) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queue(workerType)
+	q.refs = append(q.refs, ref)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Dequeue takes a job from a queue - see Broker interface
+func (b *MemoryBroker) Dequeue(ctx context.Context, workerType string) (*Ref, error) {
+	for {
+		b.mu.Lock()
+		q := b.queue(workerType)
+		if len(q.refs) > 0 {
+			ref := q.refs[0]
+			q.refs[0] = nil
+			q.refs = q.refs[1:]
+			if len(q.refs) > 0 {
+				// wake up another worker for the rest of the queue
+				select {
+				case q.ready <- struct{}{}:
+				default:
+				}
+			}
+			b.mu.Unlock()
+			return ref, nil
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Len returns the length of a queue - see Broker interface
+func (b *MemoryBroker) Len(workerType string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.queue(workerType).refs), nil
+}
+
+// redisPollTimeout is the maximal duration of a BRPOP, after which the
+// context of Dequeue is checked again
+const redisPollTimeout = 5 * time.Second
+
+// RedisBroker is a Broker that keeps the queues in Redis lists, to share
+// them between several stacks
+type RedisBroker struct {
+	url    string
+	client *redis.Client
+
+	// BRPOP blocks its connection: each queue has its own client, shared
+	// by the workers of its type that wait in turn
+	mu       sync.Mutex
+	blocking map[string]*redis.Client
+}
+
+// NewRedisBroker returns a RedisBroker for the given Redis URL, like
+// redis://:password@localhost:6379/0
+func NewRedisBroker(rawurl string) (*RedisBroker, error) {
+	client, err := redis.NewClient(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisBroker{
+		url:      rawurl,
+		client:   client,
+		blocking: make(map[string]*redis.Client),
+	}, nil
+}
+
+func redisKey(workerType string) string {
+	return "jobs:" + workerType
+}
+
+// Enqueue pushes a job in a queue - see Broker interface
+func (b *RedisBroker) Enqueue(workerType string, ref *Ref) error {
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	_, err = b.client.Int("LPUSH", redisKey(workerType), string(data))
+	return err
+}
+
+func (b *RedisBroker) blockingClient(workerType string) (*redis.Client, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if client, ok := b.blocking[workerType]; ok {
+		return client, nil
+	}
+	client, err := redis.NewClient(b.url)
+	if err != nil {
+		return nil, err
+	}
+	b.blocking[workerType] = client
+	return client, nil
+}
+
+// Dequeue takes a job from a queue - see Broker interface
+func (b *RedisBroker) Dequeue(ctx context.Context, workerType string) (*Ref, error) {
+	client, err := b.blockingClient(workerType)
+	if err != nil {
+		return nil, err
+	}
+	timeout := strconv.Itoa(int(redisPollTimeout / time.Second))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		reply, err := client.DoTimeout(redisPollTimeout+redis.DefaultTimeout,
+			"BRPOP", redisKey(workerType), timeout)
+		if err != nil {
+			return nil, err
+		}
+		if reply == nil {
+			continue
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return nil, redis.ErrReply
+		}
+		data, ok := items[1].(string)
+		if !ok {
+			return nil, redis.ErrReply
+		}
+		ref := &Ref{}
+		if err = json.Unmarshal([]byte(data), ref); err != nil {
+			return nil, err
+		}
+		return ref, nil
+	}
+}
+
+// Len returns the length of a queue - see Broker interface
+func (b *RedisBroker) Len(workerType string) (int, error) {
+	n, err := b.client.Int("LLEN", redisKey(workerType))
+	return int(n), err
+}
@@ -0,0 +1,175 @@
+package jobs
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCron is used when a cron expression is malformed
+var ErrInvalidCron = errors.New("Invalid cron expression")
+
+// cronDescriptors are the shortcuts for the usual cron expressions
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronSchedule is a parsed cron expression. Each field is a bitmask of the
+// allowed values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// the days match if the day of month or the day of week matches, when
+	// both are restricted, like in the crontab of Vixie
+	domStar, dowStar bool
+}
+
+// cronField is the range of the values of a field of a cron expression
+type cronField struct {
+	min, max int
+}
+
+var (
+	minuteField = cronField{0, 59}
+	hourField   = cronField{0, 23}
+	domField    = cronField{1, 31}
+	monthField  = cronField{1, 12}
+	// 7 is also Sunday
+	dowField = cronField{0, 7}
+)
+
+// parseCron parses a cron expression with 5 fields, minute, hour, day of
+// month, month and day of week, like "*/15 8-18 * * 1-5". A field can be a
+// *, a value, a range, a list and have a step. The descriptors like @daily
+// are also accepted.
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if d, ok := cronDescriptors[expr]; ok {
+		expr = d
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, ErrInvalidCron
+	}
+	s := &cronSchedule{}
+	var err error
+	if s.minute, err = minuteField.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if s.hour, err = hourField.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if s.dom, err = domField.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if s.month, err = monthField.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if s.dow, err = dowField.parse(fields[4]); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = fields[2] == "*"
+	s.dowStar = fields[4] == "*"
+	return s, nil
+}
+
+// parse returns the bitmask of the values of a field
+func (f cronField) parse(field string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[idx+1:]); err != nil || step <= 0 {
+				return 0, ErrInvalidCron
+			}
+			part = part[:idx]
+		}
+		min, max := f.min, f.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if min, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if max, err = f.value(bounds[1]); err != nil {
+				return 0, err
+			}
+			if min > max {
+				return 0, ErrInvalidCron
+			}
+		default:
+			v, err := f.value(part)
+			if err != nil {
+				return 0, err
+			}
+			min = v
+			if step == 1 {
+				max = v
+			}
+		}
+		for v := min; v <= max; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(str string) (int, error) {
+	v, err := strconv.Atoi(str)
+	if err != nil || v < f.min || v > f.max {
+		return 0, ErrInvalidCron
+	}
+	return v, nil
+}
+
+// cronMaxYears is how far the next time of a schedule is searched, for the
+// expressions that never match, like the 30th of February
+const cronMaxYears = 5
+
+// Next returns the first time after t that matches the schedule, or the
+// zero time if there is none
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronMaxYears, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,43 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"* * * * *", "*/15 8-18 * * 1-5", "0 0 1,15 * *", "@daily", "5/10 * * * 7"} {
+		_, err := parseCron(expr)
+		assert.NoError(t, err, expr)
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@often"} {
+		_, err := parseCron(expr)
+		assert.Equal(t, ErrInvalidCron, err, expr)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2016, 11, 2, 10, 7, 30, 0, time.UTC)
+	next := func(expr string) time.Time {
+		s, err := parseCron(expr)
+		if !assert.NoError(t, err, expr) {
+			return time.Time{}
+		}
+		return s.Next(now)
+	}
+	assert.Equal(t, time.Date(2016, 11, 2, 10, 8, 0, 0, time.UTC), next("* * * * *"))
+	assert.Equal(t, time.Date(2016, 11, 2, 10, 15, 0, 0, time.UTC), next("*/15 * * * *"))
+	assert.Equal(t, time.Date(2016, 11, 3, 0, 0, 0, 0, time.UTC), next("@daily"))
+	assert.Equal(t, time.Date(2016, 11, 6, 0, 0, 0, 0, time.UTC), next("@weekly"))
+	assert.Equal(t, time.Date(2016, 11, 6, 0, 0, 0, 0, time.UTC), next("0 0 * * 7"))
+	assert.Equal(t, time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC), next("@monthly"))
+	assert.Equal(t, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), next("@yearly"))
+	assert.Equal(t, time.Date(2016, 11, 3, 8, 0, 0, 0, time.UTC), next("0 8-18 * * 4"))
+	// the day of month or the day of week
+	assert.Equal(t, time.Date(2016, 11, 4, 0, 0, 0, 0, time.UTC), next("0 0 15 * 5"))
+	assert.Equal(t, time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC), next("0 0 29 2 *"))
+	assert.True(t, next("0 0 30 2 *").IsZero())
+}
@@ -0,0 +1,192 @@
+// Package jobs is for the asynchronous tasks of the instances, like the
+// generation of the thumbnails, the purge of the trash, the konnectors or the
+// emails. A job is a document in the database of its instance, with its
+// state, and a reference to it is pushed in the queue of its worker type.
+// The workers of the stack take the jobs from the queues, and retry them
+// with a backoff if they fail.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/realtime"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+)
+
+// JobDocType is the doctype of the jobs
+const JobDocType = "io.cozy.jobs"
+
+// waitInterval is the delay between two checks of the state of a job by
+// Wait
+const waitInterval = 500 * time.Millisecond
+
+// State is the state of a job
+type State string
+
+const (
+	// Queued is the state of a job waiting for a worker, including between
+	// two tries
+	Queued State = "queued"
+	// Running is the state of a job being executed by a worker
+	Running State = "running"
+	// Done is the state of a job that has succeeded
+	Done State = "done"
+	// Errored is the state of a job that has failed on its last try
+	Errored State = "errored"
+)
+
+var (
+	// ErrUnknownWorker is used when a job is pushed for a worker type that
+	// has not been registered
+	ErrUnknownWorker = errors.New("Unknown worker type")
+	// ErrInvalidArguments is used when the arguments of a job are not a
+	// JSON value
+	ErrInvalidArguments = errors.New("The arguments of the job are not valid JSON")
+)
+
+// Options are the options of a job. The values over the limits of the
+// worker are lowered to these limits.
+type Options struct {
+	// MaxExecCount is the maximal number of tries of the job
+	MaxExecCount int `json:"max_exec_count,omitempty"`
+	// Timeout is the maximal duration of a try, in seconds
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// Request is a request to push a job. The trigger and the event are set for
+// the jobs pushed by a trigger.
+type Request struct {
+	WorkerType string
+	Arguments  json.RawMessage
+	Options    *Options
+	TriggerID  string
+	Event      *realtime.Event
+}
+
+// Job is a job of an instance, with its state
+type Job struct {
+	JobID      string          `json:"_id,omitempty"`
+	JobRev     string          `json:"_rev,omitempty"`
+	WorkerType string          `json:"worker"`
+	Arguments  json.RawMessage `json:"arguments,omitempty"`
+	Options    Options         `json:"options"`
+	TriggerID  string          `json:"trigger_id,omitempty"`
+	Event      *JobEvent       `json:"event,omitempty"`
+	State      State           `json:"state"`
+	TryCount   int             `json:"try_count"`
+	Error      string          `json:"error,omitempty"`
+	QueuedAt   time.Time       `json:"queued_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+
+	// DBPrefix is the database prefix of the instance of the job
+	DBPrefix string `json:"-"`
+}
+
+// JobEvent is the event on a document that has fired the trigger of a job
+type JobEvent struct {
+	Verb    string          `json:"verb"`
+	Doctype string          `json:"type"`
+	DocID   string          `json:"id"`
+	Doc     json.RawMessage `json:"doc,omitempty"`
+}
+
+// ID returns the job identifier - see couchdb.Doc interface
+func (j *Job) ID() string { return j.JobID }
+
+// Rev returns the job revision - see couchdb.Doc interface
+func (j *Job) Rev() string { return j.JobRev }
+
+// DocType returns the job doctype - see couchdb.Doc interface
+func (j *Job) DocType() string { return JobDocType }
+
+// SetID changes the job identifier - see couchdb.Doc interface
+func (j *Job) SetID(id string) { j.JobID = id }
+
+// SetRev changes the job revision - see couchdb.Doc interface
+func (j *Job) SetRev(rev string) { j.JobRev = rev }
+
+// SelfLink is the URL of the job - see jsonapi.Object interface
+func (j *Job) SelfLink() string { return "/jobs/" + j.JobID }
+
+// Relationships is part of the jsonapi.Object interface
+func (j *Job) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Included is part of the jsonapi.Object interface
+func (j *Job) Included() []jsonapi.Object { return nil }
+
+// UnmarshalArguments decodes the arguments of the job
+func (j *Job) UnmarshalArguments(v interface{}) error {
+	if len(j.Arguments) == 0 {
+		return ErrInvalidArguments
+	}
+	return json.Unmarshal(j.Arguments, v)
+}
+
+// Push creates a job for an instance, and pushes it in the queue of its
+// worker type
+func Push(ctx context.Context, dbprefix string, req *Request) (*Job, error) {
+	w, ok := getWorker(req.WorkerType)
+	if !ok {
+		return nil, ErrUnknownWorker
+	}
+	if len(req.Arguments) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(req.Arguments, &v); err != nil {
+			return nil, ErrInvalidArguments
+		}
+	}
+
+	job := &Job{
+		WorkerType: req.WorkerType,
+		Arguments:  req.Arguments,
+		Options:    w.options(req.Options),
+		TriggerID:  req.TriggerID,
+		State:      Queued,
+		QueuedAt:   time.Now().UTC(),
+		DBPrefix:   dbprefix,
+	}
+	if e := req.Event; e != nil {
+		job.Event = &JobEvent{Verb: e.Verb, Doctype: e.Doctype, DocID: e.DocID, Doc: e.Doc}
+	}
+	if err := couchdb.CreateDoc(ctx, dbprefix, job); err != nil {
+		return nil, err
+	}
+	if err := getBroker().Enqueue(job.WorkerType, &Ref{DBPrefix: dbprefix, JobID: job.JobID}); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Get returns the job of an instance with the given identifier
+func Get(ctx context.Context, dbprefix, id string) (*Job, error) {
+	job := &Job{}
+	if err := couchdb.GetDoc(ctx, dbprefix, JobDocType, id, job); err != nil {
+		return nil, err
+	}
+	job.DBPrefix = dbprefix
+	return job, nil
+}
+
+// Wait waits for the end of a job, executed by this stack or by another one,
+// and returns it with its final state: Done or Errored
+func Wait(ctx context.Context, dbprefix, id string) (*Job, error) {
+	for {
+		job, err := Get(ctx, dbprefix, id)
+		if err != nil {
+			return nil, err
+		}
+		if job.State == Done || job.State == Errored {
+			return job, nil
+		}
+		select {
+		case <-time.After(waitInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package jobs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBroker(t *testing.T) {
+	b := NewMemoryBroker()
+	assert.NoError(t, b.Enqueue("log", &Ref{DBPrefix: "alice/", JobID: "1"}))
+	assert.NoError(t, b.Enqueue("log", &Ref{DBPrefix: "bob/", JobID: "2"}))
+	assert.NoError(t, b.Enqueue("sendmail", &Ref{DBPrefix: "alice/", JobID: "3"}))
+	n, _ := b.Len("log")
+	assert.Equal(t, 2, n)
+
+	ctx := context.Background()
+	ref, err := b.Dequeue(ctx, "log")
+	assert.NoError(t, err)
+	assert.Equal(t, &Ref{DBPrefix: "alice/", JobID: "1"}, ref)
+	ref, err = b.Dequeue(ctx, "log")
+	assert.NoError(t, err)
+	assert.Equal(t, &Ref{DBPrefix: "bob/", JobID: "2"}, ref)
+	n, _ = b.Len("log")
+	assert.Equal(t, 0, n)
+
+	// Dequeue waits for a job
+	done := make(chan *Ref)
+	go func() {
+		ref, _ := b.Dequeue(ctx, "log")
+		done <- ref
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, b.Enqueue("log", &Ref{DBPrefix: "alice/", JobID: "4"}))
+	select {
+	case ref = <-done:
+		assert.Equal(t, "4", ref.JobID)
+	case <-time.After(time.Second):
+		t.Fatal("the job has not been dequeued")
+	}
+
+	// and stops with its context
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = b.Dequeue(ctx, "log")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestOptions(t *testing.T) {
+	w := &WorkerConfig{MaxExecCount: 3, Timeout: time.Minute}
+	assert.Equal(t, Options{MaxExecCount: 3, Timeout: 60}, w.options(nil))
+	assert.Equal(t, Options{MaxExecCount: 2, Timeout: 30}, w.options(&Options{MaxExecCount: 2, Timeout: 30}))
+	assert.Equal(t, Options{MaxExecCount: 3, Timeout: 60}, w.options(&Options{MaxExecCount: 10, Timeout: 3600}))
+}
+
+func TestRetryDelay(t *testing.T) {
+	w := &WorkerConfig{RetryDelay: 10 * time.Second}
+	assert.Equal(t, 10*time.Second, w.retryDelay(1))
+	assert.Equal(t, 20*time.Second, w.retryDelay(2))
+	assert.Equal(t, 40*time.Second, w.retryDelay(3))
+	assert.Equal(t, maxRetryDelay, w.retryDelay(100))
+}
+
+func TestJobTries(t *testing.T) {
+	now := time.Now()
+	job := &Job{State: Queued, Options: Options{MaxExecCount: 2}}
+
+	job.start(now)
+	assert.Equal(t, Running, job.State)
+	assert.Equal(t, 1, job.TryCount)
+	assert.True(t, job.finish(errors.New("boom"), now))
+	assert.Equal(t, Queued, job.State)
+	assert.Equal(t, "boom", job.Error)
+
+	job.start(now)
+	assert.Nil(t, job.FinishedAt)
+	assert.False(t, job.finish(errors.New("boom again"), now))
+	assert.Equal(t, Errored, job.State)
+	assert.Equal(t, 2, job.TryCount)
+
+	job = &Job{State: Queued, Options: Options{MaxExecCount: 2}}
+	job.start(now)
+	assert.False(t, job.finish(nil, now))
+	assert.Equal(t, Done, job.State)
+	assert.NotNil(t, job.FinishedAt)
+}
+
+func TestRun(t *testing.T) {
+	job := &Job{Options: Options{Timeout: 1}}
+	w := &WorkerConfig{WorkerType: "panic", WorkerFunc: func(ctx context.Context, job *Job) error {
+		panic("oops")
+	}}
+	assert.Equal(t, ErrPanic, run(context.Background(), w, job))
+
+	w = &WorkerConfig{WorkerType: "slow", WorkerFunc: func(ctx context.Context, job *Job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	job.Options.Timeout = 0
+	assert.Equal(t, context.DeadlineExceeded, run(context.Background(), w, job))
+}
+
+func TestPushUnknownWorker(t *testing.T) {
+	_, err := Push(context.Background(), "alice/", &Request{WorkerType: "unknown"})
+	assert.Equal(t, ErrUnknownWorker, err)
+	_, err = Push(context.Background(), "alice/", &Request{
+		WorkerType: LogWorkerType,
+		Arguments:  []byte("{not json"),
+	})
+	assert.Equal(t, ErrInvalidArguments, err)
+}
+
+func TestAddWorker(t *testing.T) {
+	AddWorker("test", func(ctx context.Context, job *Job) error { return nil })
+	w, ok := getWorker("test")
+	if assert.True(t, ok) {
+		assert.Equal(t, DefaultConcurrency, w.Concurrency)
+		assert.Equal(t, DefaultMaxExecCount, w.MaxExecCount)
+		assert.Equal(t, DefaultTimeout, w.Timeout)
+		assert.Equal(t, DefaultRetryDelay, w.RetryDelay)
+	}
+	_, ok = getWorker(LogWorkerType)
+	assert.True(t, ok)
+}
+
+func TestRedisBroker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	// a fake Redis with a single list
+	var mu sync.Mutex
+	var list []string
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					args := make([]string, n)
+					for i := range args {
+						header, _ := r.ReadString('\n')
+						size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+						arg := make([]byte, size+2)
+						if _, err = io.ReadFull(r, arg); err != nil {
+							return
+						}
+						args[i] = string(arg[:size])
+					}
+					mu.Lock()
+					switch args[0] {
+					case "LPUSH":
+						list = append([]string{args[2]}, list...)
+						fmt.Fprintf(conn, ":%d\r\n", len(list))
+					case "LLEN":
+						fmt.Fprintf(conn, ":%d\r\n", len(list))
+					case "BRPOP":
+						if len(list) == 0 {
+							conn.Write([]byte("*-1\r\n"))
+						} else {
+							item := list[len(list)-1]
+							list = list[:len(list)-1]
+							fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+								len(args[1]), args[1], len(item), item)
+						}
+					default:
+						conn.Write([]byte("-ERR unknown command\r\n"))
+					}
+					mu.Unlock()
+				}
+			}(conn)
+		}
+	}()
+
+	b, err := NewRedisBroker("redis://" + l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, b.Enqueue("log", &Ref{DBPrefix: "alice/", JobID: "1"}))
+	assert.NoError(t, b.Enqueue("log", &Ref{DBPrefix: "bob/", JobID: "2"}))
+	n, err := b.Len("log")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	ref, err := b.Dequeue(context.Background(), "log")
+	assert.NoError(t, err)
+	assert.Equal(t, &Ref{DBPrefix: "alice/", JobID: "1"}, ref)
+	ref, err = b.Dequeue(context.Background(), "log")
+	assert.NoError(t, err)
+	assert.Equal(t, &Ref{DBPrefix: "bob/", JobID: "2"}, ref)
+}
+
+// racyBroker gives a job to a worker that is being stopped
+type racyBroker struct {
+	MemoryBroker
+	enqueued []*Ref
+}
+
+func (b *racyBroker) Enqueue(workerType string, ref *Ref) error {
+	b.enqueued = append(b.enqueued, ref)
+	return nil
+}
+
+func (b *racyBroker) Dequeue(ctx context.Context, workerType string) (*Ref, error) {
+	<-ctx.Done()
+	return &Ref{DBPrefix: "alice/", JobID: "1"}, nil
+}
+
+func TestWorkStopped(t *testing.T) {
+	b := &racyBroker{}
+	previous := getBroker()
+	UseBroker(b)
+	defer UseBroker(previous)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := &WorkerConfig{WorkerType: "test"}
+	work(ctx, context.Background(), w)
+	// the job is pushed back in its queue for the next stack
+	assert.Equal(t, []*Ref{{DBPrefix: "alice/", JobID: "1"}}, b.enqueued)
+}
+
+func TestShutdown(t *testing.T) {
+	Start()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, Shutdown(ctx))
+	workersMu.Lock()
+	assert.Nil(t, workersCtx)
+	assert.Nil(t, jobsCtx)
+	workersMu.Unlock()
+	// it does nothing when the workers are not started
+	assert.NoError(t, Shutdown(ctx))
+}
@@ -0,0 +1,86 @@
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/dcasier/cozy-stack/redis"
+)
+
+// Locker elects the leader of the stacks that share the queues: only the
+// scheduler of the leader pushes the jobs of the triggers
+type Locker interface {
+	// TryLock takes the lock, or renews it if this stack already has it,
+	// for the given duration. It returns false if another stack has it.
+	TryLock(ttl time.Duration) (bool, error)
+	// Unlock releases the lock, if this stack has it
+	Unlock() error
+}
+
+// memoryLocker is the Locker of a single stack, that is always the leader
+type memoryLocker struct{}
+
+func (memoryLocker) TryLock(ttl time.Duration) (bool, error) { return true, nil }
+func (memoryLocker) Unlock() error                           { return nil }
+
+// lockScript takes or renews the lock: it returns 1 if the lock belongs to
+// the given stack
+const lockScript = `
+local owner = redis.call("GET", KEYS[1])
+if owner == ARGV[1] then
+  redis.call("PEXPIRE", KEYS[1], ARGV[2])
+  return 1
+end
+if not owner then
+  redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+  return 1
+end
+return 0
+`
+
+// unlockScript releases the lock if it belongs to the given stack
+const unlockScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
+// redisLockKey is the key of the lock of the scheduler in Redis
+const redisLockKey = "jobs:scheduler:leader"
+
+// RedisLocker is a Locker for the stacks that share a Redis server. The
+// lock expires if its leader stops renewing it.
+type RedisLocker struct {
+	client *redis.Client
+	owner  string
+}
+
+// NewRedisLocker returns a RedisLocker for the given Redis URL, like
+// redis://:password@localhost:6379/0
+func NewRedisLocker(rawurl string) (*RedisLocker, error) {
+	client, err := redis.NewClient(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &RedisLocker{client: client, owner: hex.EncodeToString(id)}, nil
+}
+
+// TryLock takes or renews the lock - see Locker interface
+func (l *RedisLocker) TryLock(ttl time.Duration) (bool, error) {
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	n, err := l.client.Int("EVAL", lockScript, "1", redisLockKey, l.owner, ms)
+	return n == 1, err
+}
+
+// Unlock releases the lock - see Locker interface
+func (l *RedisLocker) Unlock() error {
+	_, err := l.client.Int("EVAL", unlockScript, "1", redisLockKey, l.owner)
+	return err
+}
@@ -0,0 +1,20 @@
+package jobs
+
+import (
+	"context"
+
+	"github.com/dcasier/cozy-stack/logger"
+)
+
+// LogWorkerType is the worker type of the jobs that only write their
+// arguments in the logs of the stack, to check that the jobs are executed
+const LogWorkerType = "log"
+
+func init() {
+	AddWorker(LogWorkerType, logWorker)
+}
+
+func logWorker(ctx context.Context, job *Job) error {
+	logger.Infof("jobs", "log job %s of %s: %s", job.JobID, job.DBPrefix, job.Arguments)
+	return nil
+}
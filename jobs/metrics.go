@@ -0,0 +1,78 @@
+package jobs
+
+import (
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queueLengthDesc = prometheus.NewDesc(
+		"cozy_jobs_queue_length",
+		"Number of jobs waiting in the queue of a worker type",
+		[]string{"worker"}, nil)
+
+	executionsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cozy",
+		Subsystem: "jobs",
+		Name:      "executions_total",
+		Help:      "Number of tries of the jobs, by worker type and result",
+	}, []string{"worker", "result"})
+
+	executionDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cozy",
+		Subsystem: "jobs",
+		Name:      "execution_duration_seconds",
+		Help:      "Duration of the tries of the jobs, by worker type",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"worker"})
+)
+
+func init() {
+	prometheus.MustRegister(queueCollector{}, executionsCounter, executionDurationHistogram)
+}
+
+// queueCollector collects the length of the queues of the registered
+// worker types from the broker, each time the metrics are read, as the
+// queues in Redis are shared with the other stacks
+type queueCollector struct{}
+
+// Describe is part of the prometheus.Collector interface
+func (queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueLengthDesc
+}
+
+// Collect is part of the prometheus.Collector interface
+func (queueCollector) Collect(ch chan<- prometheus.Metric) {
+	broker := getBroker()
+	for _, workerType := range workerTypes() {
+		n, err := broker.Len(workerType)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(n), workerType)
+	}
+}
+
+// workerTypes returns the registered worker types, sorted
+func workerTypes() []string {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	types := make([]string, 0, len(workers))
+	for workerType := range workers {
+		types = append(types, workerType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// observeExecution records the metrics of a try of a job
+func observeExecution(workerType string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	executionsCounter.WithLabelValues(workerType, result).Inc()
+	executionDurationHistogram.WithLabelValues(workerType).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,255 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/logger"
+	"github.com/dcasier/cozy-stack/realtime"
+)
+
+// schedulerInterval is the delay between two checks of the triggers of the
+// instances by the scheduler
+const schedulerInterval = 10 * time.Second
+
+// leaderTTL is the duration of the lock of the leader: another stack
+// becomes the leader if it is not renewed in time
+const leaderTTL = 3 * schedulerInterval
+
+// Scheduler pushes the jobs of the triggers of the instances. Each stack
+// has a scheduler, but only the one of the leader pushes the jobs: the
+// triggers on the time are checked periodically, and the changes of the
+// doctypes of the triggers on the events are watched with the realtime hub.
+// The hub follows the changes feeds of CouchDB, that are shared by all the
+// stacks: the leader sees the events of the documents written through the
+// other stacks too.
+type Scheduler struct {
+	locker   Locker
+	prefixes func(ctx context.Context) ([]string, error)
+	hub      *realtime.Hub
+	now      func() time.Time
+
+	mu       sync.Mutex
+	watchers map[string]*eventWatcher
+	stop     context.CancelFunc
+	done     chan struct{}
+}
+
+// NewScheduler returns a scheduler for the instances with the database
+// prefixes returned by the given function. The locker elects the leader,
+// nil is for a single stack.
+func NewScheduler(locker Locker, prefixes func(ctx context.Context) ([]string, error)) *Scheduler {
+	if locker == nil {
+		locker = memoryLocker{}
+	}
+	return &Scheduler{
+		locker:   locker,
+		prefixes: prefixes,
+		hub:      realtime.GetHub(),
+		now:      time.Now,
+		watchers: make(map[string]*eventWatcher),
+	}
+}
+
+// Start starts the scheduler, until Stop is called
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, s.stop = context.WithCancel(context.Background())
+	s.done = make(chan struct{})
+	go s.run(ctx, s.done)
+}
+
+// Stop stops the scheduler, and releases the lock of the leader
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	cancel, done := s.stop, s.done
+	s.stop = nil
+	s.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+	s.closeWatchers(nil)
+	if err := s.locker.Unlock(); err != nil {
+		logger.Errorf("jobs", "cannot release the lock of the scheduler: %v", err)
+	}
+}
+
+func (s *Scheduler) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+	for {
+		s.tick(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// tick checks the triggers of all the instances, if this stack is the
+// leader
+func (s *Scheduler) tick(ctx context.Context) {
+	leader, err := s.locker.TryLock(leaderTTL)
+	if err != nil {
+		logger.Errorf("jobs", "cannot take the lock of the scheduler: %v", err)
+	}
+	if !leader {
+		s.closeWatchers(nil)
+		return
+	}
+
+	prefixes, err := s.prefixes(ctx)
+	if err != nil {
+		logger.Errorf("jobs", "cannot list the instances: %v", err)
+		return
+	}
+	seen := make(map[string]bool, len(prefixes))
+	for _, prefix := range prefixes {
+		seen[prefix] = true
+		triggers, err := ListTriggers(ctx, prefix)
+		if err != nil {
+			logger.Errorf("jobs", "cannot list the triggers of %s: %v", prefix, err)
+			continue
+		}
+		var events []*Trigger
+		for _, t := range triggers {
+			if t.Type == EventTrigger {
+				events = append(events, t)
+			} else {
+				s.fire(ctx, t)
+			}
+		}
+		s.watch(prefix, events)
+	}
+	s.closeWatchers(seen)
+}
+
+// fire pushes the job of a trigger on the time if its time has come. The
+// trigger is saved with its next time, or removed for a one-shot trigger,
+// before the job is pushed: if another scheduler has done it first, the
+// conflict prevents a second job.
+func (s *Scheduler) fire(ctx context.Context, t *Trigger) {
+	now := s.now().UTC()
+	if t.NextAt == nil || t.NextAt.After(now) {
+		return
+	}
+	var err error
+	if t.IsOneShot() {
+		err = couchdb.DeleteDoc(ctx, t.DBPrefix, t)
+	} else {
+		t.NextAt = nil
+		if next, ok := t.nextAfter(now); ok {
+			t.NextAt = &next
+		}
+		err = couchdb.UpdateDoc(ctx, t.DBPrefix, t)
+	}
+	if err != nil {
+		logger.Errorf("jobs", "cannot update the trigger %s of %s: %v", t.TID, t.DBPrefix, err)
+		return
+	}
+	if _, err = Push(ctx, t.DBPrefix, t.request()); err != nil {
+		logger.Errorf("jobs", "cannot push the job of the trigger %s of %s: %v", t.TID, t.DBPrefix, err)
+	}
+}
+
+// eventWatcher receives the events of an instance for its event triggers
+type eventWatcher struct {
+	sub *realtime.Subscriber
+
+	mu       sync.Mutex
+	triggers []*Trigger
+	doctypes map[string]bool
+}
+
+// watch updates the event triggers of an instance, and the doctypes
+// watched for them
+func (s *Scheduler) watch(prefix string, triggers []*Trigger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.watchers[prefix]
+	if len(triggers) == 0 {
+		if ok {
+			w.sub.Close()
+			delete(s.watchers, prefix)
+		}
+		return
+	}
+	if !ok {
+		w = &eventWatcher{
+			sub:      s.hub.Subscribe(prefix),
+			doctypes: make(map[string]bool),
+		}
+		s.watchers[prefix] = w
+		go s.listen(prefix, w)
+	}
+
+	doctypes := make(map[string]bool)
+	for _, t := range triggers {
+		if doctype, _, err := parseEventArguments(t.Arguments); err == nil {
+			doctypes[doctype] = true
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.triggers = triggers
+	for doctype := range doctypes {
+		if !w.doctypes[doctype] {
+			w.sub.Watch(doctype, "")
+		}
+	}
+	for doctype := range w.doctypes {
+		if !doctypes[doctype] {
+			w.sub.Unwatch(doctype, "")
+		}
+	}
+	w.doctypes = doctypes
+}
+
+// listen pushes the jobs of the event triggers of an instance, until its
+// subscriber is closed. A subscriber closed by the hub, because it was too
+// slow, is replaced on the next tick.
+func (s *Scheduler) listen(prefix string, w *eventWatcher) {
+	for e := range w.sub.C {
+		w.mu.Lock()
+		triggers := w.triggers
+		w.mu.Unlock()
+		for _, t := range triggers {
+			if !t.matches(e) {
+				continue
+			}
+			req := t.request()
+			req.Event = e
+			if _, err := Push(context.Background(), prefix, req); err != nil {
+				logger.Errorf("jobs", "cannot push the job of the trigger %s of %s: %v", t.TID, prefix, err)
+			}
+		}
+	}
+	s.mu.Lock()
+	if s.watchers[prefix] == w {
+		delete(s.watchers, prefix)
+	}
+	s.mu.Unlock()
+}
+
+// closeWatchers closes the watchers of the instances that are not kept
+func (s *Scheduler) closeWatchers(keep map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for prefix, w := range s.watchers {
+		if !keep[prefix] {
+			w.sub.Close()
+			delete(s.watchers, prefix)
+		}
+	}
+}
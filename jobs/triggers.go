@@ -0,0 +1,267 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/realtime"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+)
+
+// TriggerDocType is the doctype of the triggers
+const TriggerDocType = "io.cozy.triggers"
+
+// The types of the triggers
+const (
+	// CronTrigger pushes a job at the times of a cron expression, like
+	// "0 */2 * * *"
+	CronTrigger = "@cron"
+	// EventTrigger pushes a job for the changes of the documents of a
+	// doctype, like "io.cozy.files" or "io.cozy.files:CREATED,DELETED"
+	EventTrigger = "@event"
+	// InTrigger pushes a job once, after a duration, like "10m"
+	InTrigger = "@in"
+	// AtTrigger pushes a job once, at a time in the RFC 3339 format, like
+	// "2016-12-12T15:36:25Z"
+	AtTrigger = "@at"
+)
+
+var (
+	// ErrUnknownTrigger is used when the type of a trigger is unknown
+	ErrUnknownTrigger = errors.New("Unknown trigger type")
+	// ErrInvalidTrigger is used when the arguments of a trigger are not
+	// valid for its type
+	ErrInvalidTrigger = errors.New("Invalid arguments for the trigger type")
+)
+
+// Trigger is a rule of an instance to push jobs, at some times or for some
+// events on its documents
+type Trigger struct {
+	TID             string          `json:"_id,omitempty"`
+	TRev            string          `json:"_rev,omitempty"`
+	Type            string          `json:"type"`
+	Arguments       string          `json:"arguments"`
+	WorkerType      string          `json:"worker"`
+	WorkerArguments json.RawMessage `json:"worker_arguments,omitempty"`
+	Options         *Options        `json:"options,omitempty"`
+	CreatedAt       time.Time       `json:"created_at"`
+	// NextAt is the time of the next job of a trigger on the time
+	NextAt *time.Time `json:"next_at,omitempty"`
+
+	// DBPrefix is the database prefix of the instance of the trigger
+	DBPrefix string `json:"-"`
+}
+
+// ID returns the trigger identifier - see couchdb.Doc interface
+func (t *Trigger) ID() string { return t.TID }
+
+// Rev returns the trigger revision - see couchdb.Doc interface
+func (t *Trigger) Rev() string { return t.TRev }
+
+// DocType returns the trigger doctype - see couchdb.Doc interface
+func (t *Trigger) DocType() string { return TriggerDocType }
+
+// SetID changes the trigger identifier - see couchdb.Doc interface
+func (t *Trigger) SetID(id string) { t.TID = id }
+
+// SetRev changes the trigger revision - see couchdb.Doc interface
+func (t *Trigger) SetRev(rev string) { t.TRev = rev }
+
+// SelfLink is the URL of the trigger - see jsonapi.Object interface
+func (t *Trigger) SelfLink() string { return "/jobs/triggers/" + t.TID }
+
+// Relationships is part of the jsonapi.Object interface
+func (t *Trigger) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Included is part of the jsonapi.Object interface
+func (t *Trigger) Included() []jsonapi.Object { return nil }
+
+// validate checks the type and the arguments of the trigger
+func (t *Trigger) validate() error {
+	if _, ok := getWorker(t.WorkerType); !ok {
+		return ErrUnknownWorker
+	}
+	if len(t.WorkerArguments) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(t.WorkerArguments, &v); err != nil {
+			return ErrInvalidArguments
+		}
+	}
+	switch t.Type {
+	case CronTrigger:
+		if _, err := parseCron(t.Arguments); err != nil {
+			return ErrInvalidTrigger
+		}
+	case InTrigger:
+		if d, err := time.ParseDuration(t.Arguments); err != nil || d < 0 {
+			return ErrInvalidTrigger
+		}
+	case AtTrigger:
+		if _, err := time.Parse(time.RFC3339, t.Arguments); err != nil {
+			return ErrInvalidTrigger
+		}
+	case EventTrigger:
+		if _, _, err := parseEventArguments(t.Arguments); err != nil {
+			return err
+		}
+	default:
+		return ErrUnknownTrigger
+	}
+	return nil
+}
+
+// IsOneShot returns true for the triggers that push a single job, and are
+// then removed
+func (t *Trigger) IsOneShot() bool {
+	return t.Type == InTrigger || t.Type == AtTrigger
+}
+
+// nextAfter returns the time of the first job of a trigger on the time
+// after now, and false if there is none
+func (t *Trigger) nextAfter(now time.Time) (time.Time, bool) {
+	switch t.Type {
+	case CronTrigger:
+		s, err := parseCron(t.Arguments)
+		if err != nil {
+			return time.Time{}, false
+		}
+		next := s.Next(now)
+		return next, !next.IsZero()
+	case InTrigger:
+		d, err := time.ParseDuration(t.Arguments)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return t.CreatedAt.Add(d), true
+	case AtTrigger:
+		at, err := time.Parse(time.RFC3339, t.Arguments)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return at.UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// parseEventArguments parses the arguments of an event trigger: a doctype,
+// optionally followed by a colon and a list of verbs. No verbs is for all
+// the verbs.
+func parseEventArguments(args string) (string, []string, error) {
+	parts := strings.SplitN(strings.TrimSpace(args), ":", 2)
+	doctype := parts[0]
+	// the jobs pushed for the events on the jobs would fire the trigger again
+	if doctype == "" || strings.ContainsAny(doctype, " /") ||
+		doctype == JobDocType || doctype == TriggerDocType {
+		return "", nil, ErrInvalidTrigger
+	}
+	if len(parts) == 1 {
+		return doctype, nil, nil
+	}
+	verbs := strings.Split(parts[1], ",")
+	for _, verb := range verbs {
+		switch verb {
+		case realtime.EventCreate, realtime.EventUpdate, realtime.EventDelete:
+		default:
+			return "", nil, ErrInvalidTrigger
+		}
+	}
+	return doctype, verbs, nil
+}
+
+// EventDoctype returns the doctype of the events of an event trigger, or
+// false if it is not a valid event trigger
+func (t *Trigger) EventDoctype() (string, bool) {
+	if t.Type != EventTrigger {
+		return "", false
+	}
+	doctype, _, err := parseEventArguments(t.Arguments)
+	return doctype, err == nil
+}
+
+// matches returns true if an event trigger fires for the event
+func (t *Trigger) matches(e *realtime.Event) bool {
+	if t.Type != EventTrigger {
+		return false
+	}
+	doctype, verbs, err := parseEventArguments(t.Arguments)
+	if err != nil || doctype != e.Doctype {
+		return false
+	}
+	if len(verbs) == 0 {
+		return true
+	}
+	for _, verb := range verbs {
+		if verb == e.Verb {
+			return true
+		}
+	}
+	return false
+}
+
+// request returns the request of a job pushed by the trigger
+func (t *Trigger) request() *Request {
+	return &Request{
+		WorkerType: t.WorkerType,
+		Arguments:  t.WorkerArguments,
+		Options:    t.Options,
+		TriggerID:  t.TID,
+	}
+}
+
+// AddTrigger creates a trigger for an instance, after checking its type
+// and arguments
+func AddTrigger(ctx context.Context, dbprefix string, t *Trigger) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	t.SetID("")
+	t.SetRev("")
+	t.DBPrefix = dbprefix
+	t.CreatedAt = time.Now().UTC()
+	t.NextAt = nil
+	if next, ok := t.nextAfter(t.CreatedAt); ok {
+		t.NextAt = &next
+	}
+	return couchdb.CreateDoc(ctx, dbprefix, t)
+}
+
+// GetTrigger returns the trigger of an instance with the given identifier
+func GetTrigger(ctx context.Context, dbprefix, id string) (*Trigger, error) {
+	t := &Trigger{}
+	if err := couchdb.GetDoc(ctx, dbprefix, TriggerDocType, id, t); err != nil {
+		return nil, err
+	}
+	t.DBPrefix = dbprefix
+	return t, nil
+}
+
+// ListTriggers returns all the triggers of an instance
+func ListTriggers(ctx context.Context, dbprefix string) ([]*Trigger, error) {
+	var triggers []*Trigger
+	err := couchdb.ForeachDocs(ctx, dbprefix, TriggerDocType, func(doc json.RawMessage) error {
+		t := &Trigger{}
+		if err := json.Unmarshal(doc, t); err != nil {
+			return err
+		}
+		t.DBPrefix = dbprefix
+		triggers = append(triggers, t)
+		return nil
+	})
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	return triggers, err
+}
+
+// DeleteTrigger removes a trigger of an instance
+func DeleteTrigger(ctx context.Context, dbprefix, id string) error {
+	t, err := GetTrigger(ctx, dbprefix, id)
+	if err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(ctx, dbprefix, t)
+}
@@ -0,0 +1,156 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/couchdb/couchdbtest"
+	"github.com/dcasier/cozy-stack/realtime"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTriggerValidate(t *testing.T) {
+	valid := []*Trigger{
+		{Type: CronTrigger, Arguments: "0 */2 * * *", WorkerType: LogWorkerType},
+		{Type: EventTrigger, Arguments: "io.cozy.files", WorkerType: LogWorkerType},
+		{Type: EventTrigger, Arguments: "io.cozy.files:CREATED,DELETED", WorkerType: LogWorkerType},
+		{Type: InTrigger, Arguments: "10m", WorkerType: LogWorkerType},
+		{Type: AtTrigger, Arguments: "2016-12-12T15:36:25+01:00", WorkerType: LogWorkerType},
+	}
+	for _, trigger := range valid {
+		assert.NoError(t, trigger.validate(), trigger.Arguments)
+	}
+
+	assert.Equal(t, ErrUnknownWorker, (&Trigger{Type: InTrigger, Arguments: "10m", WorkerType: "unknown"}).validate())
+	assert.Equal(t, ErrUnknownTrigger, (&Trigger{Type: "@never", WorkerType: LogWorkerType}).validate())
+	invalid := []*Trigger{
+		{Type: CronTrigger, Arguments: "every minute", WorkerType: LogWorkerType},
+		{Type: EventTrigger, Arguments: "", WorkerType: LogWorkerType},
+		{Type: EventTrigger, Arguments: "io.cozy.files:TOUCHED", WorkerType: LogWorkerType},
+		{Type: EventTrigger, Arguments: JobDocType, WorkerType: LogWorkerType},
+		{Type: InTrigger, Arguments: "-1h", WorkerType: LogWorkerType},
+		{Type: AtTrigger, Arguments: "tomorrow", WorkerType: LogWorkerType},
+	}
+	for _, trigger := range invalid {
+		assert.Equal(t, ErrInvalidTrigger, trigger.validate(), trigger.Arguments)
+	}
+}
+
+func TestTriggerNextAfter(t *testing.T) {
+	now := time.Date(2016, 11, 2, 10, 7, 30, 0, time.UTC)
+
+	trigger := &Trigger{Type: CronTrigger, Arguments: "0 * * * *"}
+	next, ok := trigger.nextAfter(now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2016, 11, 2, 11, 0, 0, 0, time.UTC), next)
+	assert.False(t, trigger.IsOneShot())
+
+	trigger = &Trigger{Type: InTrigger, Arguments: "1h", CreatedAt: now}
+	next, ok = trigger.nextAfter(now.Add(time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Hour), next)
+	assert.True(t, trigger.IsOneShot())
+
+	trigger = &Trigger{Type: AtTrigger, Arguments: "2016-12-12T15:36:25+01:00"}
+	next, ok = trigger.nextAfter(now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2016, 12, 12, 14, 36, 25, 0, time.UTC), next)
+
+	trigger = &Trigger{Type: EventTrigger, Arguments: "io.cozy.files"}
+	_, ok = trigger.nextAfter(now)
+	assert.False(t, ok)
+}
+
+func TestTriggerMatches(t *testing.T) {
+	created := &realtime.Event{Verb: realtime.EventCreate, Doctype: "io.cozy.files", DocID: "1"}
+	updated := &realtime.Event{Verb: realtime.EventUpdate, Doctype: "io.cozy.files", DocID: "1"}
+	contact := &realtime.Event{Verb: realtime.EventCreate, Doctype: "io.cozy.contacts", DocID: "2"}
+
+	trigger := &Trigger{Type: EventTrigger, Arguments: "io.cozy.files"}
+	assert.True(t, trigger.matches(created))
+	assert.True(t, trigger.matches(updated))
+	assert.False(t, trigger.matches(contact))
+
+	trigger = &Trigger{Type: EventTrigger, Arguments: "io.cozy.files:CREATED,DELETED"}
+	assert.True(t, trigger.matches(created))
+	assert.False(t, trigger.matches(updated))
+
+	trigger = &Trigger{Type: CronTrigger, Arguments: "io.cozy.files"}
+	assert.False(t, trigger.matches(created))
+}
+
+func TestSchedulerFollower(t *testing.T) {
+	s := NewScheduler(followerLocker{}, func(ctx context.Context) ([]string, error) {
+		t.Fatal("a follower must not list the instances")
+		return nil, nil
+	})
+	s.hub = realtime.NewHub()
+	s.watchers["alice/"] = &eventWatcher{sub: s.hub.Subscribe("alice/")}
+	s.tick(context.Background())
+	assert.Empty(t, s.watchers)
+}
+
+func TestSchedulerEventsOfOtherStacks(t *testing.T) {
+	ctx := context.Background()
+	prefix := "scheduler-test/"
+	b := NewMemoryBroker()
+	UseBroker(b)
+	defer UseBroker(NewMemoryBroker())
+
+	trigger := &Trigger{Type: EventTrigger, Arguments: "io.cozy.files:CREATED", WorkerType: LogWorkerType}
+	if !assert.NoError(t, AddTrigger(ctx, prefix, trigger)) {
+		return
+	}
+	// the database of the files must exist before the changes feed is followed
+	before := &couchdb.JSONDoc{Type: "io.cozy.files", M: map[string]interface{}{"name": "before"}}
+	if !assert.NoError(t, couchdb.CreateDoc(ctx, prefix, before)) {
+		return
+	}
+	s := NewScheduler(nil, func(ctx context.Context) ([]string, error) {
+		return []string{prefix}, nil
+	})
+	s.hub = realtime.NewHub()
+	s.tick(ctx)
+	defer s.closeWatchers(nil)
+	// let the watcher of the changes feed start
+	time.Sleep(100 * time.Millisecond)
+
+	// the file is written directly in CouchDB, like another stack would do:
+	// nothing is published on the hub of this stack
+	doc := &couchdb.JSONDoc{Type: "io.cozy.files", M: map[string]interface{}{"name": "foo"}}
+	if !assert.NoError(t, couchdb.CreateDoc(ctx, prefix, doc)) {
+		return
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	ref, err := b.Dequeue(waitCtx, LogWorkerType)
+	if !assert.NoError(t, err) {
+		return
+	}
+	job, err := Get(ctx, prefix, ref.JobID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, trigger.ID(), job.TriggerID)
+		assert.Equal(t, doc.ID(), job.Event.DocID)
+	}
+}
+
+// followerLocker is a Locker of a stack that is never the leader
+type followerLocker struct{}
+
+func (followerLocker) TryLock(ttl time.Duration) (bool, error) { return false, nil }
+func (followerLocker) Unlock() error                           { return nil }
+
+func TestMain(m *testing.M) {
+	couchURL, stop := couchdbtest.Start()
+	if err := couchdb.UseServer(couchdb.ServerOptions{URL: couchURL}); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res := m.Run()
+	stop()
+	os.Exit(res)
+}
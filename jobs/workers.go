@@ -0,0 +1,312 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/logger"
+)
+
+const (
+	// DefaultConcurrency is the number of jobs of a worker type that are
+	// executed at the same time
+	DefaultConcurrency = 2
+	// DefaultMaxExecCount is the maximal number of tries of a job
+	DefaultMaxExecCount = 3
+	// DefaultTimeout is the maximal duration of a try
+	DefaultTimeout = 60 * time.Second
+	// DefaultRetryDelay is the delay before the second try of a job. It is
+	// doubled for each of the next tries, up to maxRetryDelay.
+	DefaultRetryDelay = 10 * time.Second
+)
+
+// maxRetryDelay is the maximal delay between two tries of a job
+const maxRetryDelay = time.Hour
+
+// dequeueErrorDelay is the delay before taking a job from a queue again,
+// after an error of the broker
+const dequeueErrorDelay = 5 * time.Second
+
+// ErrPanic is used when a worker has panicked on a job
+var ErrPanic = errors.New("The worker has panicked")
+
+// WorkerFunc is the function that executes a job. The context is canceled
+// after the timeout of the job.
+type WorkerFunc func(ctx context.Context, job *Job) error
+
+// WorkerConfig is the configuration of a worker type. A zero value keeps
+// the default.
+type WorkerConfig struct {
+	WorkerType   string
+	WorkerFunc   WorkerFunc
+	Concurrency  int
+	MaxExecCount int
+	Timeout      time.Duration
+	RetryDelay   time.Duration
+}
+
+// options returns the options of a job, lowered to the limits of the worker
+func (w *WorkerConfig) options(opts *Options) Options {
+	res := Options{
+		MaxExecCount: w.MaxExecCount,
+		Timeout:      int(w.Timeout / time.Second),
+	}
+	if opts == nil {
+		return res
+	}
+	if opts.MaxExecCount > 0 && opts.MaxExecCount < res.MaxExecCount {
+		res.MaxExecCount = opts.MaxExecCount
+	}
+	if opts.Timeout > 0 && opts.Timeout < res.Timeout {
+		res.Timeout = opts.Timeout
+	}
+	return res
+}
+
+// retryDelay returns the delay before the next try of a job, after the
+// given number of tries
+func (w *WorkerConfig) retryDelay(tries int) time.Duration {
+	delay := w.RetryDelay
+	for i := 1; i < tries && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+var (
+	workersMu sync.Mutex
+	workers   = make(map[string]*WorkerConfig)
+	// workersCtx is the context of the started workers, and stop cancels
+	// it: the workers no longer take new jobs from the queues. jobsCtx is
+	// the context of the jobs being executed, and cancelJobs cancels it.
+	// They are nil when the workers are not started.
+	workersCtx context.Context
+	stop       context.CancelFunc
+	jobsCtx    context.Context
+	cancelJobs context.CancelFunc
+	running    sync.WaitGroup
+)
+
+// AddWorker registers a worker type with the default configuration
+func AddWorker(workerType string, fn WorkerFunc) {
+	AddWorkerConfig(&WorkerConfig{WorkerType: workerType, WorkerFunc: fn})
+}
+
+// AddWorkerConfig registers a worker type. If the workers are started, the
+// workers of this type are started too.
+func AddWorkerConfig(w *WorkerConfig) {
+	if w.Concurrency <= 0 {
+		w.Concurrency = DefaultConcurrency
+	}
+	if w.MaxExecCount <= 0 {
+		w.MaxExecCount = DefaultMaxExecCount
+	}
+	if w.Timeout <= 0 {
+		w.Timeout = DefaultTimeout
+	}
+	if w.RetryDelay <= 0 {
+		w.RetryDelay = DefaultRetryDelay
+	}
+
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	workers[w.WorkerType] = w
+	if workersCtx != nil {
+		startWorker(w)
+	}
+}
+
+func getWorker(workerType string) (*WorkerConfig, bool) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	w, ok := workers[workerType]
+	return w, ok
+}
+
+// Start starts the workers of the registered worker types. They take the
+// jobs from the queues of the broker until Stop is called.
+func Start() {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	if workersCtx != nil {
+		return
+	}
+	workersCtx, stop = context.WithCancel(context.Background())
+	jobsCtx, cancelJobs = context.WithCancel(context.Background())
+	for _, w := range workers {
+		startWorker(w)
+	}
+}
+
+// startWorker starts the goroutines of a worker type. workersMu must be
+// held.
+func startWorker(w *WorkerConfig) {
+	ctx, jctx := workersCtx, jobsCtx
+	for i := 0; i < w.Concurrency; i++ {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			work(ctx, jctx, w)
+		}()
+	}
+}
+
+// Stop stops the workers, and waits for the end of the jobs being executed,
+// after having canceled them
+func Stop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	Shutdown(ctx)
+}
+
+// Shutdown stops the workers: they no longer take new jobs from the queues,
+// and it waits for the end of the jobs being executed. If the context is
+// done before, these jobs are canceled, and they are pushed again in their
+// queues to be tried by the next stack.
+func Shutdown(ctx context.Context) error {
+	workersMu.Lock()
+	stopWorkers, stopJobs := stop, cancelJobs
+	stop, cancelJobs = nil, nil
+	workersCtx, jobsCtx = nil, nil
+	workersMu.Unlock()
+	if stopWorkers == nil {
+		return nil
+	}
+
+	stopWorkers()
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		stopJobs()
+		return nil
+	case <-ctx.Done():
+		stopJobs()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// work takes the jobs from the queue of a worker type, and executes them
+// with the jobs context, until the workers context is done
+func work(ctx, jctx context.Context, w *WorkerConfig) {
+	b := getBroker()
+	for {
+		ref, err := b.Dequeue(ctx, w.WorkerType)
+		if ctx.Err() != nil {
+			if err == nil && ref != nil {
+				// the job has been taken while the workers were stopped
+				if err = b.Enqueue(w.WorkerType, ref); err != nil {
+					logger.Errorf("jobs", "cannot push back the job %s of %s: %v", ref.JobID, ref.DBPrefix, err)
+				}
+			}
+			return
+		}
+		if err != nil {
+			logger.Errorf("jobs", "cannot take a %s job: %v", w.WorkerType, err)
+			select {
+			case <-time.After(dequeueErrorDelay):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		job, err := Get(jctx, ref.DBPrefix, ref.JobID)
+		if err != nil {
+			logger.Errorf("jobs", "cannot get the job %s of %s: %v", ref.JobID, ref.DBPrefix, err)
+			continue
+		}
+		if job.State != Queued {
+			continue
+		}
+		process(jctx, w, job)
+	}
+}
+
+// process executes a job, and saves its state before and after. A failed
+// job is pushed again in its queue after the retry delay, until its
+// maximal number of tries.
+func process(ctx context.Context, w *WorkerConfig, job *Job) {
+	job.start(time.Now().UTC())
+	if err := couchdb.UpdateDoc(ctx, job.DBPrefix, job); err != nil {
+		// another stack may have taken the job
+		logger.Errorf("jobs", "cannot start the job %s of %s: %v", job.JobID, job.DBPrefix, err)
+		return
+	}
+
+	start := time.Now()
+	err := run(ctx, w, job)
+	observeExecution(w.WorkerType, start, err)
+	retry := job.finish(err, time.Now().UTC())
+	// the state is saved even if the workers are stopped
+	if uerr := couchdb.UpdateDoc(context.Background(), job.DBPrefix, job); uerr != nil {
+		logger.Errorf("jobs", "cannot save the job %s of %s: %v", job.JobID, job.DBPrefix, uerr)
+		return
+	}
+	if !retry {
+		return
+	}
+
+	ref := &Ref{DBPrefix: job.DBPrefix, JobID: job.JobID}
+	if ctx.Err() != nil {
+		// the job has been interrupted by the shutdown of the workers, and
+		// the stack may exit before the retry delay
+		if err := getBroker().Enqueue(w.WorkerType, ref); err != nil {
+			logger.Errorf("jobs", "cannot retry the job %s of %s: %v", ref.JobID, ref.DBPrefix, err)
+		}
+		return
+	}
+	time.AfterFunc(w.retryDelay(job.TryCount), func() {
+		if err := getBroker().Enqueue(w.WorkerType, ref); err != nil {
+			logger.Errorf("jobs", "cannot retry the job %s of %s: %v", ref.JobID, ref.DBPrefix, err)
+		}
+	})
+}
+
+// run calls the worker function, with the timeout of the job
+func run(ctx context.Context, w *WorkerConfig, job *Job) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(job.Options.Timeout)*time.Second)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("jobs", "the %s worker has panicked: %v", w.WorkerType, r)
+			err = ErrPanic
+		}
+	}()
+	return w.WorkerFunc(ctx, job)
+}
+
+// start marks the job as running for a new try
+func (j *Job) start(now time.Time) {
+	j.State = Running
+	j.TryCount++
+	j.StartedAt = &now
+	j.FinishedAt = nil
+}
+
+// finish records the result of a try. It returns true if the job must be
+// tried again.
+func (j *Job) finish(err error, now time.Time) bool {
+	j.FinishedAt = &now
+	if err == nil {
+		j.State = Done
+		j.Error = ""
+		return false
+	}
+	j.Error = err.Error()
+	if j.TryCount < j.Options.MaxExecCount {
+		j.State = Queued
+		return true
+	}
+	j.State = Errored
+	return false
+}
@@ -0,0 +1,77 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+)
+
+// rotatingFile writes the lines to a file. When the file reaches its maximal
+// size, it is renamed with the .1 suffix, the previous backups are shifted
+// (.1 to .2, etc.), and a new file is created.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	infos, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size = f, infos.Size()
+	return nil
+}
+
+func (r *rotatingFile) WriteLine(level Level, line []byte) error {
+	line = append(line, '\n')
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(line)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	return err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	if r.maxBackups > 0 {
+		os.Remove(r.backup(r.maxBackups))
+		for i := r.maxBackups - 1; i > 0; i-- {
+			os.Rename(r.backup(i), r.backup(i+1))
+		}
+		if err := os.Rename(r.path, r.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) backup(n int) string {
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
+
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
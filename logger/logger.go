@@ -0,0 +1,220 @@
+// Package logger writes the logs of the stack. Each line has a level, to
+// filter the verbose ones, and a tag for the component that writes it, like
+// jobs or couchdb. The lines are written in text or in JSON, on stderr, in a
+// file rotated by size, or to syslog.
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the importance of a log line
+type Level int
+
+const (
+	// DebugLevel is for the details useful to debug, like the requests to
+	// CouchDB
+	DebugLevel Level = iota
+	// InfoLevel is for the normal events, like the HTTP requests
+	InfoLevel
+	// WarnLevel is for the unexpected events that are not errors
+	WarnLevel
+	// ErrorLevel is for the failures
+	ErrorLevel
+)
+
+// The formats of the log lines
+const (
+	// TextFormat writes lines like: 2016-10-19T09:42:07Z info  [jobs] message
+	TextFormat = "text"
+	// JSONFormat writes a JSON object by line, with the time, level, tag and
+	// msg fields
+	JSONFormat = "json"
+)
+
+var (
+	// ErrInvalidLevel is used when a level is not debug, info, warn or error
+	ErrInvalidLevel = errors.New("The log level must be debug, info, warn or error")
+	// ErrInvalidFormat is used when a format is not text or json
+	ErrInvalidFormat = errors.New("The log format must be text or json")
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// String returns the name of the level
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level for a name, info for an empty name
+func ParseLevel(name string) (Level, error) {
+	if name == "" {
+		return InfoLevel, nil
+	}
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return WarnLevel, nil
+	}
+	return InfoLevel, ErrInvalidLevel
+}
+
+// Options are the configuration of the logs
+type Options struct {
+	// Level is the minimal level of the written lines
+	Level Level
+	// Format is text or json, text by default
+	Format string
+	// Output is stderr (the default), stdout, syslog, or the path of a file
+	Output string
+	// MaxSize is the size in bytes after which the file is rotated, 0 to
+	// never rotate it, and MaxBackups the number of rotated files kept
+	MaxSize    int64
+	MaxBackups int
+}
+
+// lineWriter is where the lines are written. Syslog has its own levels.
+type lineWriter interface {
+	WriteLine(level Level, line []byte) error
+	Close() error
+}
+
+var (
+	mu       sync.Mutex
+	minLevel            = InfoLevel
+	format              = TextFormat
+	output   lineWriter = &streamWriter{w: os.Stderr}
+)
+
+// Configure changes the level, the format and the output of the logs. The
+// previous output is closed.
+func Configure(opts *Options) error {
+	if opts.Format == "" {
+		opts.Format = TextFormat
+	}
+	if opts.Format != TextFormat && opts.Format != JSONFormat {
+		return ErrInvalidFormat
+	}
+	out, err := openOutput(opts)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	previous := output
+	minLevel, format, output = opts.Level, opts.Format, out
+	return previous.Close()
+}
+
+func openOutput(opts *Options) (lineWriter, error) {
+	switch opts.Output {
+	case "", "stderr":
+		return &streamWriter{w: os.Stderr}, nil
+	case "stdout":
+		return &streamWriter{w: os.Stdout}, nil
+	case "syslog":
+		return openSyslog()
+	}
+	return openRotatingFile(opts.Output, opts.MaxSize, opts.MaxBackups)
+}
+
+// Enabled returns true if the lines of the given level are written
+func Enabled(level Level) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return level >= minLevel
+}
+
+// Log writes a line with the level and the tag, if the level is enabled
+func Log(level Level, tag, msg string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if level < minLevel {
+		return
+	}
+	now := time.Now().UTC()
+	var line []byte
+	if format == JSONFormat {
+		line, _ = json.Marshal(&struct {
+			Time  time.Time `json:"time"`
+			Level string    `json:"level"`
+			Tag   string    `json:"tag"`
+			Msg   string    `json:"msg"`
+		}{now, level.String(), tag, msg})
+	} else {
+		line = []byte(fmt.Sprintf("%s %-5s [%s] %s",
+			now.Format(time.RFC3339), level, tag, msg))
+	}
+	if err := output.WriteLine(level, line); err != nil {
+		fmt.Fprintf(os.Stderr, "[logger] cannot write a log line: %v\n", err)
+	}
+}
+
+// Debugf writes a line at the debug level
+func Debugf(tag, format string, args ...interface{}) {
+	if Enabled(DebugLevel) {
+		Log(DebugLevel, tag, fmt.Sprintf(format, args...))
+	}
+}
+
+// Infof writes a line at the info level
+func Infof(tag, format string, args ...interface{}) {
+	Log(InfoLevel, tag, fmt.Sprintf(format, args...))
+}
+
+// Warnf writes a line at the warn level
+func Warnf(tag, format string, args ...interface{}) {
+	Log(WarnLevel, tag, fmt.Sprintf(format, args...))
+}
+
+// Errorf writes a line at the error level
+func Errorf(tag, format string, args ...interface{}) {
+	Log(ErrorLevel, tag, fmt.Sprintf(format, args...))
+}
+
+// Writer returns an io.Writer that writes a log line with the level and the
+// tag for each line written to it, for the libraries that write their logs
+// to an io.Writer, like gin
+func Writer(level Level, tag string) io.Writer {
+	return &tagWriter{level: level, tag: tag}
+}
+
+type tagWriter struct {
+	level Level
+	tag   string
+}
+
+func (w *tagWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line != "" {
+			Log(w.level, w.tag, line)
+		}
+	}
+	return len(p), nil
+}
+
+// streamWriter writes the lines to stderr or stdout
+type streamWriter struct {
+	w io.Writer
+}
+
+func (s *streamWriter) WriteLine(level Level, line []byte) error {
+	_, err := s.w.Write(append(line, '\n'))
+	return err
+}
+
+func (s *streamWriter) Close() error { return nil }
@@ -0,0 +1,93 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func useBuffer(level Level, f string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	mu.Lock()
+	minLevel, format, output = level, f, &streamWriter{w: buf}
+	mu.Unlock()
+	return buf
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("debug")
+	assert.NoError(t, err)
+	assert.Equal(t, DebugLevel, level)
+	level, err = ParseLevel("WARNING")
+	assert.NoError(t, err)
+	assert.Equal(t, WarnLevel, level)
+	level, err = ParseLevel("")
+	assert.NoError(t, err)
+	assert.Equal(t, InfoLevel, level)
+	_, err = ParseLevel("verbose")
+	assert.Equal(t, ErrInvalidLevel, err)
+}
+
+func TestTextFormat(t *testing.T) {
+	buf := useBuffer(InfoLevel, TextFormat)
+	Debugf("couchdb", "GET %s", "/db/doc")
+	Infof("jobs", "log job %d", 42)
+	Errorf("apps", "cannot install %s", "emails")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.True(t, strings.HasSuffix(lines[0], "info  [jobs] log job 42"), lines[0])
+		assert.True(t, strings.HasSuffix(lines[1], "error [apps] cannot install emails"), lines[1])
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	buf := useBuffer(DebugLevel, JSONFormat)
+	Writer(WarnLevel, "http").Write([]byte("first\nsecond\n"))
+
+	var line struct {
+		Level string `json:"level"`
+		Tag   string `json:"tag"`
+		Msg   string `json:"msg"`
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &line))
+		assert.Equal(t, "warn", line.Level)
+		assert.Equal(t, "http", line.Tag)
+		assert.Equal(t, "second", line.Msg)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-logs")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stack.log")
+
+	r, err := openRotatingFile(path, 10, 2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, line := range []string{"one", "two", "three", "four", "five"} {
+		assert.NoError(t, r.WriteLine(InfoLevel, []byte(line+"-line")))
+	}
+	assert.NoError(t, r.Close())
+
+	content, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "five-line\n", string(content))
+	content, _ = ioutil.ReadFile(path + ".1")
+	assert.Equal(t, "four-line\n", string(content))
+	content, _ = ioutil.ReadFile(path + ".2")
+	assert.Equal(t, "three-line\n", string(content))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package logger
+
+import "log/syslog"
+
+// syslogWriter sends the lines to the local syslog daemon, with the
+// severity of their level
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func openSyslog() (lineWriter, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "cozy-stack")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+func (s *syslogWriter) WriteLine(level Level, line []byte) error {
+	msg := string(line)
+	switch level {
+	case DebugLevel:
+		return s.w.Debug(msg)
+	case WarnLevel:
+		return s.w.Warning(msg)
+	case ErrorLevel:
+		return s.w.Err(msg)
+	}
+	return s.w.Info(msg)
+}
+
+func (s *syslogWriter) Close() error {
+	return s.w.Close()
+}
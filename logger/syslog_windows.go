@@ -0,0 +1,11 @@
+package logger
+
+import "errors"
+
+// ErrSyslogUnsupported is used when the logs are sent to syslog on a
+// platform without syslog
+var ErrSyslogUnsupported = errors.New("Syslog is not supported on this platform")
+
+func openSyslog() (lineWriter, error) {
+	return nil, ErrSyslogUnsupported
+}
@@ -0,0 +1,195 @@
+// Package mails is for the emails sent by the stack, for the applications
+// and for its own needs, like the onboarding or the reset of the
+// passphrase. The emails are sent by the sendmail worker of the jobs, with
+// the SMTP server of the configuration.
+package mails
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"strings"
+
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/jobs"
+)
+
+// WorkerType is the worker type of the jobs that send emails
+const WorkerType = "sendmail"
+
+// The modes of the emails
+const (
+	// ModeNoReply is for the emails sent by the stack to the owner of the
+	// instance, from the noreply address of its domain
+	ModeNoReply = "noreply"
+	// ModeFrom is for the emails sent on behalf of the owner of the
+	// instance, from its email address
+	ModeFrom = "from"
+)
+
+// The types of the parts of an email
+const (
+	// TextPart is the plain text version of an email
+	TextPart = "text/plain"
+	// HTMLPart is the HTML version of an email
+	HTMLPart = "text/html"
+)
+
+var (
+	// ErrInvalidMode is used when the mode of an email is unknown
+	ErrInvalidMode = errors.New("Invalid mode for the email")
+	// ErrNoRecipient is used when an email has no recipient
+	ErrNoRecipient = errors.New("The email has no recipient")
+	// ErrInvalidAddress is used when the address of a recipient is not
+	// valid
+	ErrInvalidAddress = errors.New("Invalid email address")
+	// ErrNoOwnerEmail is used when the owner of the instance has no email
+	// address in the settings
+	ErrNoOwnerEmail = errors.New("The owner of the instance has no email address")
+	// ErrNoBody is used when an email has no part and no template
+	ErrNoBody = errors.New("The email has no body")
+	// ErrInvalidPartType is used when a part of an email is not text or
+	// html
+	ErrInvalidPartType = errors.New("Invalid type for a part of the email")
+)
+
+// Address is an email address, with an optional name
+type Address struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email"`
+}
+
+// String returns the address in the format of the headers
+func (a *Address) String() string {
+	addr := &mail.Address{Name: a.Name, Address: a.Email}
+	return addr.String()
+}
+
+// Part is a version of the body of an email
+type Part struct {
+	Type string `json:"type"`
+	Body string `json:"body"`
+}
+
+// Options are the arguments of the jobs of the sendmail worker. The body
+// of the email is given by its parts, or rendered from a template with the
+// locale of the instance.
+type Options struct {
+	Mode           string                 `json:"mode"`
+	To             []*Address             `json:"to,omitempty"`
+	Subject        string                 `json:"subject,omitempty"`
+	Parts          []*Part                `json:"parts,omitempty"`
+	TemplateName   string                 `json:"template_name,omitempty"`
+	TemplateValues map[string]interface{} `json:"template_values,omitempty"`
+	Locale         string                 `json:"locale,omitempty"`
+}
+
+// Send pushes a job to send an email for an instance
+func Send(ctx context.Context, dbprefix string, opts *Options) (*jobs.Job, error) {
+	args, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	return jobs.Push(ctx, dbprefix, &jobs.Request{
+		WorkerType: WorkerType,
+		Arguments:  args,
+	})
+}
+
+func init() {
+	jobs.AddWorker(WorkerType, sendMailWorker)
+}
+
+// sendMailWorker is the worker of the sendmail jobs
+func sendMailWorker(ctx context.Context, job *jobs.Job) error {
+	opts := &Options{}
+	if err := job.UnmarshalArguments(opts); err != nil {
+		return err
+	}
+	domain := strings.TrimSuffix(job.DBPrefix, "/")
+	i, err := instance.Get(ctx, domain)
+	if err != nil {
+		return err
+	}
+	settings, err := i.GetSettings(ctx)
+	if err != nil {
+		return err
+	}
+	if settings.Locale == "" {
+		settings.Locale = i.Locale
+	}
+	msg, err := newMessage(domain, &settings.PublicSettings, opts)
+	if err != nil {
+		return err
+	}
+	return send(ctx, getSMTP(), msg)
+}
+
+// message is an email ready to be sent
+type message struct {
+	From    *Address
+	To      []*Address
+	Subject string
+	Parts   []*Part
+}
+
+// newMessage returns the email for the options of a job of an instance
+func newMessage(domain string, settings *instance.PublicSettings, opts *Options) (*message, error) {
+	msg := &message{Subject: opts.Subject}
+	switch opts.Mode {
+	case ModeNoReply:
+		if settings.Email == "" {
+			return nil, ErrNoOwnerEmail
+		}
+		msg.From = &Address{Email: "noreply@" + domain}
+		msg.To = []*Address{{Name: settings.PublicName, Email: settings.Email}}
+	case ModeFrom:
+		if settings.Email == "" {
+			return nil, ErrNoOwnerEmail
+		}
+		msg.From = &Address{Name: settings.PublicName, Email: settings.Email}
+		for _, to := range opts.To {
+			if to == nil {
+				continue
+			}
+			if addr, err := mail.ParseAddress(to.Email); err != nil || addr.Address != to.Email {
+				return nil, ErrInvalidAddress
+			}
+			msg.To = append(msg.To, to)
+		}
+	default:
+		return nil, ErrInvalidMode
+	}
+	if len(msg.To) == 0 {
+		return nil, ErrNoRecipient
+	}
+
+	if opts.TemplateName != "" {
+		locale := opts.Locale
+		if locale == "" {
+			locale = settings.Locale
+		}
+		values := map[string]interface{}{"PublicName": settings.PublicName}
+		for k, v := range opts.TemplateValues {
+			values[k] = v
+		}
+		subject, parts, err := renderTemplate(opts.TemplateName, locale, values)
+		if err != nil {
+			return nil, err
+		}
+		msg.Subject = subject
+		msg.Parts = parts
+	} else {
+		for _, part := range opts.Parts {
+			if part.Type != TextPart && part.Type != HTMLPart {
+				return nil, ErrInvalidPartType
+			}
+		}
+		msg.Parts = opts.Parts
+	}
+	if len(msg.Parts) == 0 {
+		return nil, ErrNoBody
+	}
+	return msg, nil
+}
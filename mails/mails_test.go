@@ -0,0 +1,200 @@
+package mails
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/stretchr/testify/assert"
+)
+
+var alice = &instance.PublicSettings{
+	PublicName: "Alice",
+	Email:      "alice@example.com",
+	Locale:     "fr-FR",
+}
+
+func TestNewMessage(t *testing.T) {
+	parts := []*Part{{Type: TextPart, Body: "Hello"}}
+	msg, err := newMessage("alice.cozy.example", alice, &Options{Mode: ModeNoReply, Subject: "Hi", Parts: parts})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "noreply@alice.cozy.example", msg.From.Email)
+		assert.Equal(t, []*Address{{Name: "Alice", Email: "alice@example.com"}}, msg.To)
+		assert.Equal(t, "Hi", msg.Subject)
+	}
+
+	bob := &Address{Name: "Bob", Email: "bob@example.com"}
+	msg, err = newMessage("alice.cozy.example", alice, &Options{Mode: ModeFrom, To: []*Address{bob}, Parts: parts})
+	if assert.NoError(t, err) {
+		assert.Equal(t, &Address{Name: "Alice", Email: "alice@example.com"}, msg.From)
+		assert.Equal(t, []*Address{bob}, msg.To)
+	}
+
+	_, err = newMessage("alice.cozy.example", alice, &Options{Mode: "spam", Parts: parts})
+	assert.Equal(t, ErrInvalidMode, err)
+	_, err = newMessage("alice.cozy.example", alice, &Options{Mode: ModeFrom, Parts: parts})
+	assert.Equal(t, ErrNoRecipient, err)
+	_, err = newMessage("alice.cozy.example", alice, &Options{Mode: ModeFrom, To: []*Address{{Email: "bob@example.com\r\nBcc: eve@example.com"}}, Parts: parts})
+	assert.Equal(t, ErrInvalidAddress, err)
+	_, err = newMessage("alice.cozy.example", &instance.PublicSettings{}, &Options{Mode: ModeNoReply, Parts: parts})
+	assert.Equal(t, ErrNoOwnerEmail, err)
+	_, err = newMessage("alice.cozy.example", alice, &Options{Mode: ModeNoReply})
+	assert.Equal(t, ErrNoBody, err)
+	_, err = newMessage("alice.cozy.example", alice, &Options{Mode: ModeNoReply, Parts: []*Part{{Type: "image/png"}}})
+	assert.Equal(t, ErrInvalidPartType, err)
+	_, err = newMessage("alice.cozy.example", alice, &Options{Mode: ModeNoReply, TemplateName: "unknown"})
+	assert.Equal(t, ErrUnknownTemplate, err)
+}
+
+func TestTemplates(t *testing.T) {
+	values := map[string]interface{}{"ResetURL": "https://alice.cozy.example/reset?token=<123>"}
+	msg, err := newMessage("alice.cozy.example", alice, &Options{
+		Mode:           ModeNoReply,
+		TemplateName:   "passphrase_reset",
+		TemplateValues: values,
+	})
+	if assert.NoError(t, err) && assert.Len(t, msg.Parts, 2) {
+		// fr-FR is translated with fr
+		assert.Equal(t, "Réinitialisation du mot de passe de votre Cozy", msg.Subject)
+		assert.Contains(t, msg.Parts[0].Body, "Bonjour Alice,")
+		assert.Contains(t, msg.Parts[0].Body, "token=<123>")
+		assert.Equal(t, HTMLPart, msg.Parts[1].Type)
+		assert.Contains(t, msg.Parts[1].Body, "token=%3c123%3e")
+	}
+
+	msg, err = newMessage("alice.cozy.example", alice, &Options{
+		Mode:           ModeNoReply,
+		TemplateName:   "onboarding",
+		TemplateValues: map[string]interface{}{"URL": "https://alice.cozy.example/"},
+		Locale:         "de",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Welcome to your Cozy", msg.Subject)
+	}
+}
+
+func TestMessageBytes(t *testing.T) {
+	msg := &message{
+		From:    &Address{Name: "Alice", Email: "alice@example.com"},
+		To:      []*Address{{Name: "Bob", Email: "bob@example.com"}, {Email: "carol@example.com"}},
+		Subject: "Café",
+		Parts: []*Part{
+			{Type: HTMLPart, Body: "<p>Un café ?</p>"},
+			{Type: TextPart, Body: "Un café ?"},
+		},
+	}
+	raw, err := msg.bytes(time.Date(2016, 11, 2, 10, 0, 0, 0, time.UTC))
+	if !assert.NoError(t, err) {
+		return
+	}
+	m, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, `"Alice" <alice@example.com>`, m.Header.Get("From"))
+	assert.Equal(t, `"Bob" <bob@example.com>, <carol@example.com>`, m.Header.Get("To"))
+	subject, _ := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	assert.Equal(t, "Café", subject)
+	assert.Equal(t, "Wed, 02 Nov 2016 10:00:00 +0000", m.Header.Get("Date"))
+	assert.True(t, strings.HasSuffix(m.Header.Get("Message-ID"), "@example.com>"))
+
+	mediatype, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "multipart/alternative", mediatype)
+	r := multipart.NewReader(m.Body, params["boundary"])
+	var types, bodies []string
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(p)
+		types = append(types, p.Header.Get("Content-Type"))
+		bodies = append(bodies, string(body))
+	}
+	// the plain text is the first alternative
+	assert.Equal(t, []string{"text/plain; charset=utf-8", "text/html; charset=utf-8"}, types)
+	assert.Equal(t, []string{"Un café ?", "<p>Un café ?</p>"}, bodies)
+}
+
+func TestSend(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	// a fake SMTP server, without STARTTLS and authentication
+	commands := make(chan string, 10)
+	data := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost ESMTP\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.TrimSpace(line)
+			commands <- cmd
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"):
+				conn.Write([]byte("250-localhost\r\n250 8BITMIME\r\n"))
+			case cmd == "DATA":
+				conn.Write([]byte("354 Go ahead\r\n"))
+				var body []string
+				for {
+					line, err = r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					body = append(body, line)
+				}
+				data <- strings.Join(body, "")
+				conn.Write([]byte("250 OK\r\n"))
+			case cmd == "QUIT":
+				conn.Write([]byte("221 Bye\r\n"))
+				return
+			default:
+				conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	msg := &message{
+		From:    &Address{Email: "noreply@alice.cozy.example"},
+		To:      []*Address{{Name: "Alice", Email: "alice@example.com"}},
+		Subject: "Hello",
+		Parts:   []*Part{{Type: TextPart, Body: "Hello Alice"}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = send(ctx, &SMTPConfig{Host: host, Port: p}, msg)
+	assert.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(<-commands, "EHLO"))
+	assert.Equal(t, "MAIL FROM:<noreply@alice.cozy.example> BODY=8BITMIME", <-commands)
+	assert.Equal(t, "RCPT TO:<alice@example.com>", <-commands)
+	assert.Equal(t, "DATA", <-commands)
+	body := <-data
+	assert.Contains(t, body, "Subject: Hello\r\n")
+	assert.Contains(t, body, "Hello Alice")
+}
@@ -0,0 +1,86 @@
+package mails
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// bytes returns the email in the MIME format, with the given date. The
+// parts are the alternatives of a multipart body, the plain text first.
+func (m *message) bytes(date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	to := make([]string, len(m.To))
+	for i, addr := range m.To {
+		to[i] = addr.String()
+	}
+	headers := [][2]string{
+		{"From", m.From.String()},
+		{"To", strings.Join(to, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"Message-ID", messageID(m.From.Email)},
+		{"MIME-Version", "1.0"},
+	}
+	for _, h := range headers {
+		buf.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+
+	mw := multipart.NewWriter(&buf)
+	buf.WriteString("Content-Type: multipart/alternative; boundary=" + mw.Boundary() + "\r\n\r\n")
+	for _, part := range m.sortedParts() {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.Type+"; charset=utf-8")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		w, err := mw.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err = qp.Write([]byte(part.Body)); err != nil {
+			return nil, err
+		}
+		if err = qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sortedParts returns the parts with the plain text ones first, as the
+// clients show the last alternative that they can display
+func (m *message) sortedParts() []*Part {
+	parts := make([]*Part, 0, len(m.Parts))
+	for _, part := range m.Parts {
+		if part.Type == TextPart {
+			parts = append(parts, part)
+		}
+	}
+	for _, part := range m.Parts {
+		if part.Type != TextPart {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// messageID returns a unique identifier for an email, on the domain of its
+// sender
+func messageID(from string) string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	domain := "localhost"
+	if idx := strings.LastIndex(from, "@"); idx >= 0 {
+		domain = from[idx+1:]
+	}
+	return "<" + hex.EncodeToString(id) + "@" + domain + ">"
+}
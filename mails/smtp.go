@@ -0,0 +1,127 @@
+package mails
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// dialTimeout is the maximal duration to connect to the SMTP server
+const dialTimeout = 10 * time.Second
+
+// SMTPConfig is the configuration of the SMTP server of the emails
+type SMTPConfig struct {
+	Host string
+	Port int
+	// Username and Password are the credentials for the server, if it
+	// requires an authentication
+	Username string
+	Password string
+	// DisableTLS sends the emails without STARTTLS, even if the server
+	// supports it
+	DisableTLS bool
+	// SkipCertificateValidation accepts any certificate from the server
+	SkipCertificateValidation bool
+}
+
+var (
+	smtpMu     sync.RWMutex
+	smtpConfig = &SMTPConfig{Host: "localhost", Port: 25}
+)
+
+// UseSMTP changes the SMTP server of the emails. A zero value keeps the
+// default, localhost:25. It can be called again when the configuration is
+// reloaded.
+func UseSMTP(cfg *SMTPConfig) {
+	c := *cfg
+	if c.Host == "" {
+		c.Host = "localhost"
+	}
+	if c.Port == 0 {
+		c.Port = 25
+	}
+	smtpMu.Lock()
+	smtpConfig = &c
+	smtpMu.Unlock()
+}
+
+// getSMTP returns the current configuration of the SMTP server
+func getSMTP() *SMTPConfig {
+	smtpMu.RLock()
+	defer smtpMu.RUnlock()
+	return smtpConfig
+}
+
+// send sends an email with the SMTP server. The connection is closed if the
+// context is done before the end.
+func send(ctx context.Context, cfg *SMTPConfig, msg *message) error {
+	body, err := msg.bytes(time.Now())
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	c, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && !cfg.DisableTLS {
+		tlsConfig := &tls.Config{
+			ServerName:         cfg.Host,
+			InsecureSkipVerify: cfg.SkipCertificateValidation,
+		}
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if cfg.Username != "" {
+		auth := smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+		if err = c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(msg.From.Email); err != nil {
+		return err
+	}
+	for _, to := range msg.To {
+		if err = c.Rcpt(to.Email); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(body); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
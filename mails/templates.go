@@ -0,0 +1,139 @@
+package mails
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"text/template"
+
+	"github.com/dcasier/cozy-stack/i18n"
+)
+
+// ErrUnknownTemplate is used when an email is sent with an unknown template
+var ErrUnknownTemplate = errors.New("Unknown template for the email")
+
+// mailTemplate is a translation of a template: the subject and the plain
+// text body are text templates, and the HTML body is an HTML template
+type mailTemplate struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+func newTemplate(name, subject, text, html string) *mailTemplate {
+	return &mailTemplate{
+		subject: template.Must(template.New(name + ".subject").Parse(subject)),
+		text:    template.Must(template.New(name + ".text").Parse(text)),
+		html:    htmltemplate.Must(htmltemplate.New(name + ".html").Parse(html)),
+	}
+}
+
+// templates are the templates of the emails of the stack, by name and by
+// locale
+var templates = map[string]map[string]*mailTemplate{
+	"onboarding": {
+		"en": newTemplate("onboarding",
+			`Welcome to your Cozy`,
+			`Hello {{.PublicName}},
+
+Your Cozy is ready at {{.URL}}.
+Use this link to choose your passphrase: {{.RegisterURL}}
+
+The Cozy team
+`,
+			`<p>Hello {{.PublicName}},</p>
+<p>Your Cozy is ready at <a href="{{.URL}}">{{.URL}}</a>.</p>
+<p><a href="{{.RegisterURL}}">Choose your passphrase</a></p>
+<p>The Cozy team</p>
+`),
+		"fr": newTemplate("onboarding",
+			`Bienvenue sur votre Cozy`,
+			`Bonjour {{.PublicName}},
+
+Votre Cozy est prêt à l'adresse {{.URL}}.
+Utilisez ce lien pour choisir votre mot de passe : {{.RegisterURL}}
+
+L'équipe Cozy
+`,
+			`<p>Bonjour {{.PublicName}},</p>
+<p>Votre Cozy est prêt à l'adresse <a href="{{.URL}}">{{.URL}}</a>.</p>
+<p><a href="{{.RegisterURL}}">Choisir votre mot de passe</a></p>
+<p>L'équipe Cozy</p>
+`),
+	},
+	"passphrase_reset": {
+		"en": newTemplate("passphrase_reset",
+			`Reset of the passphrase of your Cozy`,
+			`Hello {{.PublicName}},
+
+A reset of the passphrase of your Cozy has been asked.
+Use this link to choose a new passphrase: {{.ResetURL}}
+
+If you have not asked it, you can ignore this email.
+
+The Cozy team
+`,
+			`<p>Hello {{.PublicName}},</p>
+<p>A reset of the passphrase of your Cozy has been asked.</p>
+<p><a href="{{.ResetURL}}">Choose a new passphrase</a></p>
+<p>If you have not asked it, you can ignore this email.</p>
+<p>The Cozy team</p>
+`),
+		"fr": newTemplate("passphrase_reset",
+			`Réinitialisation du mot de passe de votre Cozy`,
+			`Bonjour {{.PublicName}},
+
+Une réinitialisation du mot de passe de votre Cozy a été demandée.
+Utilisez ce lien pour choisir un nouveau mot de passe : {{.ResetURL}}
+
+Si vous ne l'avez pas demandée, vous pouvez ignorer cet email.
+
+L'équipe Cozy
+`,
+			`<p>Bonjour {{.PublicName}},</p>
+<p>Une réinitialisation du mot de passe de votre Cozy a été demandée.</p>
+<p><a href="{{.ResetURL}}">Choisir un nouveau mot de passe</a></p>
+<p>Si vous ne l'avez pas demandée, vous pouvez ignorer cet email.</p>
+<p>L'équipe Cozy</p>
+`),
+	},
+}
+
+// findTemplate returns the translation of a template for a locale, like
+// fr-FR, or its language, like fr, or else the default locale
+func findTemplate(name, locale string) (*mailTemplate, bool) {
+	translations, ok := templates[name]
+	if !ok {
+		return nil, false
+	}
+	for _, l := range i18n.Fallbacks(locale) {
+		if t, ok := translations[l]; ok {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// renderTemplate returns the subject and the parts of an email rendered
+// from a template, in the given locale
+func renderTemplate(name, locale string, values map[string]interface{}) (string, []*Part, error) {
+	t, ok := findTemplate(name, locale)
+	if !ok {
+		return "", nil, ErrUnknownTemplate
+	}
+	var subject, text, html bytes.Buffer
+	if err := t.subject.Execute(&subject, values); err != nil {
+		return "", nil, err
+	}
+	if err := t.text.Execute(&text, values); err != nil {
+		return "", nil, err
+	}
+	if err := t.html.Execute(&html, values); err != nil {
+		return "", nil, err
+	}
+	parts := []*Part{
+		{Type: TextPart, Body: text.String()},
+		{Type: HTMLPart, Body: html.String()},
+	}
+	return subject.String(), parts, nil
+}
@@ -0,0 +1,206 @@
+// Package notifications is for the notification center of an instance: the
+// applications and the konnectors create notifications for the user, and the
+// home application displays the unread ones.
+package notifications
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/couchdb/mango"
+	"github.com/dcasier/cozy-stack/doctypes"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+)
+
+// DocType is the doctype of the notifications
+const DocType = "io.cozy.notifications"
+
+// listLimit is the maximal number of unread notifications returned by
+// ListUnread
+const listLimit = 100
+
+// ErrMissingTitle is used when a notification is created without title
+var ErrMissingTitle = errors.New("The title of the notification is missing")
+
+// Indexes are the indexes of the database of the notifications
+var Indexes = []mango.IndexDefinitionRequest{
+	mango.IndexOnFields("read"),
+}
+
+// schema is the JSON schema of the notifications written with the data API
+const schema = `{
+	"type": "object",
+	"required": ["title"],
+	"properties": {
+		"source": {"type": "string"},
+		"title": {"type": "string", "minLength": 1},
+		"content": {"type": "string"},
+		"link": {"type": "string"},
+		"read": {"type": "boolean"},
+		"created_at": {"type": "string"},
+		"read_at": {"type": ["string", "null"]}
+	}
+}`
+
+func init() {
+	doctypes.MustRegister(&doctypes.Doctype{
+		Name:        DocType,
+		Description: "The notifications of the applications and konnectors for the user",
+		Schema:      doctypes.MustParseSchema(schema),
+		Validate:    validate,
+	})
+}
+
+// validate checks that the title of a notification is not blank, like
+// Create does
+func validate(doc map[string]interface{}) doctypes.ValidationErrors {
+	if title, _ := doc["title"].(string); strings.TrimSpace(title) == "" {
+		return doctypes.ValidationErrors{{Field: "/title", Message: ErrMissingTitle.Error()}}
+	}
+	return nil
+}
+
+// Notification is a message for the user, from an application or a
+// konnector, the source. It stays unread until the user has seen it.
+type Notification struct {
+	NotificationID  string `json:"_id,omitempty"`
+	NotificationRev string `json:"_rev,omitempty"`
+
+	Source    string     `json:"source,omitempty"`
+	Title     string     `json:"title"`
+	Content   string     `json:"content,omitempty"`
+	Link      string     `json:"link,omitempty"`
+	Read      bool       `json:"read"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+}
+
+// ID returns the notification identifier - see couchdb.Doc interface
+func (n *Notification) ID() string { return n.NotificationID }
+
+// Rev returns the notification revision - see couchdb.Doc interface
+func (n *Notification) Rev() string { return n.NotificationRev }
+
+// DocType returns the notification doctype - see couchdb.Doc interface
+func (n *Notification) DocType() string { return DocType }
+
+// SetID changes the notification identifier - see couchdb.Doc interface
+func (n *Notification) SetID(id string) { n.NotificationID = id }
+
+// SetRev changes the notification revision - see couchdb.Doc interface
+func (n *Notification) SetRev(rev string) { n.NotificationRev = rev }
+
+// SelfLink is the URL of the notification - see jsonapi.Object interface
+func (n *Notification) SelfLink() string { return "/notifications/" + n.NotificationID }
+
+// Relationships is part of the jsonapi.Object interface
+func (n *Notification) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{}
+}
+
+// Included is part of the jsonapi.Object interface
+func (n *Notification) Included() []jsonapi.Object {
+	return []jsonapi.Object{}
+}
+
+// markAsRead changes the notification to read, if it was not already
+func (n *Notification) markAsRead(now time.Time) bool {
+	if n.Read {
+		return false
+	}
+	n.Read = true
+	n.ReadAt = &now
+	return true
+}
+
+// byCreatedAt sorts the notifications, the most recent first
+type byCreatedAt []*Notification
+
+func (s byCreatedAt) Len() int           { return len(s) }
+func (s byCreatedAt) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byCreatedAt) Less(i, j int) bool { return s[i].CreatedAt.After(s[j].CreatedAt) }
+
+// Create validates a notification and persists it as unread. The
+// subscribers of the realtime events on the doctype, like the home
+// application, receive it from the changes feed of its database.
+func Create(ctx context.Context, db string, n *Notification) error {
+	n.Title = strings.TrimSpace(n.Title)
+	if n.Title == "" {
+		return ErrMissingTitle
+	}
+	n.Read = false
+	n.ReadAt = nil
+	n.CreatedAt = time.Now().UTC()
+
+	err := couchdb.EnsureDBExists(ctx, db, DocType, &couchdb.DBOptions{
+		Indexes: Indexes,
+	})
+	if err != nil {
+		return err
+	}
+	return couchdb.CreateDoc(ctx, db, n)
+}
+
+// Get returns the notification with the given identifier
+func Get(ctx context.Context, db, id string) (*Notification, error) {
+	n := &Notification{}
+	if err := couchdb.GetDoc(ctx, db, DocType, id, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ListUnread returns the unread notifications, the most recent first. At
+// most 100 notifications are returned.
+func ListUnread(ctx context.Context, db string) ([]*Notification, error) {
+	var list []*Notification
+	req := &couchdb.FindRequest{Selector: mango.Equal("read", false), Limit: listLimit}
+	err := couchdb.FindDocs(ctx, db, DocType, req, &list)
+	if couchdb.IsNoDatabaseError(err) {
+		return []*Notification{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byCreatedAt(list))
+	return list, nil
+}
+
+// MarkAsRead changes a notification to read. It does nothing if the
+// notification has already been read.
+func MarkAsRead(ctx context.Context, db, id string) (*Notification, error) {
+	n, err := Get(ctx, db, id)
+	if err != nil {
+		return nil, err
+	}
+	if n.markAsRead(time.Now().UTC()) {
+		if err = couchdb.UpdateDoc(ctx, db, n); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// MarkAllAsRead changes all the unread notifications to read, and returns
+// their number
+func MarkAllAsRead(ctx context.Context, db string) (int, error) {
+	count := 0
+	now := time.Now().UTC()
+	for {
+		list, err := ListUnread(ctx, db)
+		if err != nil || len(list) == 0 {
+			return count, err
+		}
+		for _, n := range list {
+			n.markAsRead(now)
+			if err = couchdb.UpdateDoc(ctx, db, n); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+}
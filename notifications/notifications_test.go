@@ -0,0 +1,40 @@
+package notifications
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateWithoutTitle(t *testing.T) {
+	err := Create(context.Background(), "test/", &Notification{Title: "  ", Content: "foo"})
+	assert.Equal(t, ErrMissingTitle, err)
+}
+
+func TestMarkAsRead(t *testing.T) {
+	n := &Notification{Title: "Hello"}
+	now := time.Date(2016, 11, 2, 10, 0, 0, 0, time.UTC)
+	assert.True(t, n.markAsRead(now))
+	assert.True(t, n.Read)
+	if assert.NotNil(t, n.ReadAt) {
+		assert.Equal(t, now, *n.ReadAt)
+	}
+	assert.False(t, n.markAsRead(now.Add(time.Hour)))
+	assert.Equal(t, now, *n.ReadAt)
+}
+
+func TestSortByCreatedAt(t *testing.T) {
+	now := time.Now()
+	list := []*Notification{
+		{Title: "old", CreatedAt: now.Add(-time.Hour)},
+		{Title: "new", CreatedAt: now},
+		{Title: "older", CreatedAt: now.Add(-2 * time.Hour)},
+	}
+	sort.Sort(byCreatedAt(list))
+	assert.Equal(t, "new", list[0].Title)
+	assert.Equal(t, "old", list[1].Title)
+	assert.Equal(t, "older", list[2].Title)
+}
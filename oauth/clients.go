@@ -0,0 +1,165 @@
+// Package oauth is the OAuth2 authorization server of an instance. The
+// external clients, like the mobile and desktop sync clients, register
+// themselves dynamically, and obtain from the owner of the instance some
+// tokens limited to a scope, instead of using the passphrase.
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+)
+
+// ClientDocType is the doctype of the OAuth2 clients
+const ClientDocType = "io.cozy.oauth.clients"
+
+// secretLength is the number of random bytes of the secrets, codes and
+// tokens
+const secretLength = 24
+
+var (
+	// ErrInvalidRedirectURI is used when a redirect URI of a client is
+	// missing or is not an absolute URL without fragment
+	ErrInvalidRedirectURI = errors.New("Invalid redirect URI")
+	// ErrMissingClientName is used when a client registers without name
+	ErrMissingClientName = errors.New("The client name is missing")
+	// ErrMissingSoftwareID is used when a client registers without the
+	// identifier of its software
+	ErrMissingSoftwareID = errors.New("The software identifier is missing")
+	// ErrInvalidClient is used when the client identifier or secret is
+	// unknown or does not match
+	ErrInvalidClient = errors.New("Invalid client")
+)
+
+// Client is an external application registered on the instance, as
+// described by the OAuth 2.0 Dynamic Client Registration Protocol
+// (RFC 7591). The client identifier is the identifier of the document.
+type Client struct {
+	ClientID  string `json:"_id,omitempty"`
+	ClientRev string `json:"_rev,omitempty"`
+
+	ClientSecret    string   `json:"client_secret"`
+	SecretExpiresAt int      `json:"client_secret_expires_at"`
+	RedirectURIs    []string `json:"redirect_uris"`
+	GrantTypes      []string `json:"grant_types"`
+	ResponseTypes   []string `json:"response_types"`
+	ClientName      string   `json:"client_name"`
+	ClientKind      string   `json:"client_kind,omitempty"`
+	ClientURI       string   `json:"client_uri,omitempty"`
+	LogoURI         string   `json:"logo_uri,omitempty"`
+	SoftwareID      string   `json:"software_id"`
+	SoftwareVersion string   `json:"software_version,omitempty"`
+}
+
+// ID returns the client identifier - see couchdb.Doc interface
+func (c *Client) ID() string { return c.ClientID }
+
+// Rev returns the client revision - see couchdb.Doc interface
+func (c *Client) Rev() string { return c.ClientRev }
+
+// DocType returns the client doctype - see couchdb.Doc interface
+func (c *Client) DocType() string { return ClientDocType }
+
+// SetID changes the client identifier - see couchdb.Doc interface
+func (c *Client) SetID(id string) { c.ClientID = id }
+
+// SetRev changes the client revision - see couchdb.Doc interface
+func (c *Client) SetRev(rev string) { c.ClientRev = rev }
+
+// randomString returns a random string, for the secrets and the tokens
+func randomString() (string, error) {
+	b := make([]byte, secretLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// checkRegistration validates the metadata of a client that registers
+func (c *Client) checkRegistration() error {
+	if len(c.RedirectURIs) == 0 {
+		return ErrInvalidRedirectURI
+	}
+	for _, redirectURI := range c.RedirectURIs {
+		u, err := url.Parse(redirectURI)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Fragment != "" {
+			return ErrInvalidRedirectURI
+		}
+	}
+	if strings.TrimSpace(c.ClientName) == "" {
+		return ErrMissingClientName
+	}
+	if strings.TrimSpace(c.SoftwareID) == "" {
+		return ErrMissingSoftwareID
+	}
+	return nil
+}
+
+// Register validates the metadata of a new client, generates its
+// identifier and secret, and persists it. Only the authorization code grant
+// is supported, with the refresh tokens.
+func Register(ctx context.Context, db string, c *Client) error {
+	if err := c.checkRegistration(); err != nil {
+		return err
+	}
+	id, err := randomString()
+	if err != nil {
+		return err
+	}
+	secret, err := randomString()
+	if err != nil {
+		return err
+	}
+	c.ClientID = id
+	c.ClientRev = ""
+	c.ClientSecret = secret
+	c.SecretExpiresAt = 0
+	c.GrantTypes = []string{"authorization_code", "refresh_token"}
+	c.ResponseTypes = []string{"code"}
+	return couchdb.CreateNamedDocWithDB(ctx, db, c)
+}
+
+// FindClient returns the client with the given identifier
+func FindClient(ctx context.Context, db, id string) (*Client, error) {
+	if id == "" {
+		return nil, ErrInvalidClient
+	}
+	c := &Client{}
+	err := couchdb.GetDoc(ctx, db, ClientDocType, id, c)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, ErrInvalidClient
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Authenticate returns the client with the given identifier, if the secret
+// matches
+func Authenticate(ctx context.Context, db, id, secret string) (*Client, error) {
+	c, err := FindClient(ctx, db, id)
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" || !secureCompare(c.ClientSecret, secret) {
+		return nil, ErrInvalidClient
+	}
+	return c, nil
+}
+
+// AcceptRedirectURI returns true if the redirect URI is one of the URIs
+// registered by the client
+func (c *Client) AcceptRedirectURI(redirectURI string) bool {
+	for _, uri := range c.RedirectURIs {
+		if uri == redirectURI {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package oauth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckRegistration(t *testing.T) {
+	c := &Client{
+		RedirectURIs: []string{"http://localhost:4242/oauth/callback"},
+		ClientName:   "cozy-desktop",
+		SoftwareID:   "github.com/cozy-labs/cozy-desktop",
+	}
+	assert.NoError(t, c.checkRegistration())
+
+	c.RedirectURIs = nil
+	assert.Equal(t, ErrInvalidRedirectURI, c.checkRegistration())
+	c.RedirectURIs = []string{"/oauth/callback"}
+	assert.Equal(t, ErrInvalidRedirectURI, c.checkRegistration())
+	c.RedirectURIs = []string{"http://localhost:4242/oauth#callback"}
+	assert.Equal(t, ErrInvalidRedirectURI, c.checkRegistration())
+	c.RedirectURIs = []string{"io.cozy.mobile://oauth/callback"}
+	assert.NoError(t, c.checkRegistration())
+
+	c.ClientName = " "
+	assert.Equal(t, ErrMissingClientName, c.checkRegistration())
+	c.ClientName = "cozy-desktop"
+	c.SoftwareID = ""
+	assert.Equal(t, ErrMissingSoftwareID, c.checkRegistration())
+}
+
+func TestAcceptRedirectURI(t *testing.T) {
+	c := &Client{
+		RedirectURIs: []string{
+			"http://localhost:4242/oauth/callback",
+			"io.cozy.mobile://oauth/callback",
+		},
+	}
+	assert.True(t, c.AcceptRedirectURI("http://localhost:4242/oauth/callback"))
+	assert.True(t, c.AcceptRedirectURI("io.cozy.mobile://oauth/callback"))
+	assert.False(t, c.AcceptRedirectURI(""))
+	assert.False(t, c.AcceptRedirectURI("http://localhost:4242/oauth/callback?evil=1"))
+	assert.False(t, c.AcceptRedirectURI("http://evil.example/oauth/callback"))
+}
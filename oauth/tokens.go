@@ -0,0 +1,277 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/couchdb"
+)
+
+const (
+	// AccessCodeDocType is the doctype of the authorization codes
+	AccessCodeDocType = "io.cozy.oauth.access_codes"
+	// TokenDocType is the doctype of the access and refresh tokens
+	TokenDocType = "io.cozy.oauth.tokens"
+)
+
+const (
+	// accessCodeTTL is the duration of an authorization code: it must be
+	// exchanged for tokens just after the redirection
+	accessCodeTTL = 10 * time.Minute
+	// AccessTokenTTL is the duration of an access token, that can be
+	// renewed with the refresh token
+	AccessTokenTTL = time.Hour
+)
+
+// CodeChallengeS256 is the only method of the PKCE code challenges that is
+// supported: the challenge is the SHA-256 of the verifier, encoded in
+// base64url without padding (RFC 7636)
+const CodeChallengeS256 = "S256"
+
+// codeVerifierReg is the format of a PKCE code verifier
+var codeVerifierReg = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// The kinds of tokens
+const (
+	accessTokenKind  = "access"
+	refreshTokenKind = "refresh"
+)
+
+var (
+	// ErrInvalidGrant is used when an authorization code or a refresh token
+	// is unknown, expired, or for another client
+	ErrInvalidGrant = errors.New("Invalid grant")
+	// ErrInvalidToken is used when an access token is unknown or expired
+	ErrInvalidToken = errors.New("Invalid access token")
+	// ErrInvalidCodeChallenge is used when the PKCE code challenge of an
+	// authorization request is malformed or has an unsupported method
+	ErrInvalidCodeChallenge = errors.New("Invalid code challenge")
+)
+
+// AccessCode is an authorization code, given to a client after the owner of
+// the instance has accepted its request, to be exchanged for tokens. The
+// code is the identifier of the document. If the client has sent a PKCE
+// code challenge, the code can only be exchanged with its verifier.
+type AccessCode struct {
+	Code          string      `json:"_id,omitempty"`
+	CodeRev       string      `json:"_rev,omitempty"`
+	ClientID      string      `json:"client_id"`
+	Scope         apps.Scopes `json:"scope"`
+	RedirectURI   string      `json:"redirect_uri"`
+	CodeChallenge string      `json:"code_challenge,omitempty"`
+	ExpiresAt     time.Time   `json:"expires_at"`
+}
+
+// ID returns the code - see couchdb.Doc interface
+func (ac *AccessCode) ID() string { return ac.Code }
+
+// Rev returns the code revision - see couchdb.Doc interface
+func (ac *AccessCode) Rev() string { return ac.CodeRev }
+
+// DocType returns the code doctype - see couchdb.Doc interface
+func (ac *AccessCode) DocType() string { return AccessCodeDocType }
+
+// SetID changes the code - see couchdb.Doc interface
+func (ac *AccessCode) SetID(id string) { ac.Code = id }
+
+// SetRev changes the code revision - see couchdb.Doc interface
+func (ac *AccessCode) SetRev(rev string) { ac.CodeRev = rev }
+
+// Token is an access or refresh token of a client, limited to a scope. The
+// token is the identifier of the document. The access tokens expire, but
+// not the refresh tokens.
+type Token struct {
+	TokenID   string      `json:"_id,omitempty"`
+	TokenRev  string      `json:"_rev,omitempty"`
+	Kind      string      `json:"kind"`
+	ClientID  string      `json:"client_id"`
+	Scope     apps.Scopes `json:"scope"`
+	CreatedAt time.Time   `json:"created_at"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+}
+
+// ID returns the token - see couchdb.Doc interface
+func (t *Token) ID() string { return t.TokenID }
+
+// Rev returns the token revision - see couchdb.Doc interface
+func (t *Token) Rev() string { return t.TokenRev }
+
+// DocType returns the token doctype - see couchdb.Doc interface
+func (t *Token) DocType() string { return TokenDocType }
+
+// SetID changes the token - see couchdb.Doc interface
+func (t *Token) SetID(id string) { t.TokenID = id }
+
+// SetRev changes the token revision - see couchdb.Doc interface
+func (t *Token) SetRev(rev string) { t.TokenRev = rev }
+
+// secureCompare compares two secrets in constant time
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// CheckCodeChallenge returns an error if the PKCE code challenge of an
+// authorization request is not valid. An empty challenge is for a client
+// that doesn't use PKCE.
+func CheckCodeChallenge(challenge, method string) error {
+	if challenge == "" && method == "" {
+		return nil
+	}
+	if method != CodeChallengeS256 {
+		return ErrInvalidCodeChallenge
+	}
+	// the challenge is a SHA-256, in base64url without padding
+	if raw, err := base64.RawURLEncoding.DecodeString(challenge); err != nil || len(raw) != sha256.Size {
+		return ErrInvalidCodeChallenge
+	}
+	return nil
+}
+
+// verifyCodeChallenge returns true if the verifier matches the challenge
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if !codeVerifierReg.MatchString(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return secureCompare(challenge, base64.RawURLEncoding.EncodeToString(sum[:]))
+}
+
+// CreateAccessCode creates an authorization code for the client, after the
+// owner of the instance has accepted to give it the scope. The challenge is
+// the PKCE code challenge of the request, checked by CheckCodeChallenge, or
+// empty.
+func CreateAccessCode(ctx context.Context, db string, c *Client, scope apps.Scopes, redirectURI, challenge string) (*AccessCode, error) {
+	code, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	ac := &AccessCode{
+		Code:          code,
+		ClientID:      c.ClientID,
+		Scope:         scope,
+		RedirectURI:   redirectURI,
+		CodeChallenge: challenge,
+		ExpiresAt:     time.Now().Add(accessCodeTTL),
+	}
+	if err = couchdb.CreateNamedDocWithDB(ctx, db, ac); err != nil {
+		return nil, err
+	}
+	return ac, nil
+}
+
+// ExchangeCode exchanges an authorization code for an access token and a
+// refresh token. The code can be used only once. If the redirect URI was
+// given to obtain the code, the same one must be given to exchange it, and
+// the verifier must match the PKCE code challenge, if there was one.
+func ExchangeCode(ctx context.Context, db string, c *Client, code, redirectURI, verifier string) (access *Token, refresh *Token, err error) {
+	if code == "" {
+		return nil, nil, ErrInvalidGrant
+	}
+	ac := &AccessCode{}
+	err = couchdb.GetDoc(ctx, db, AccessCodeDocType, code, ac)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = couchdb.DeleteDoc(ctx, db, ac); err != nil {
+		// the code has already been used by a concurrent request
+		if couchdb.IsConflictError(err) || couchdb.IsNotFoundError(err) {
+			return nil, nil, ErrInvalidGrant
+		}
+		return nil, nil, err
+	}
+	if ac.ClientID != c.ClientID || time.Now().After(ac.ExpiresAt) {
+		return nil, nil, ErrInvalidGrant
+	}
+	if redirectURI != "" && redirectURI != ac.RedirectURI {
+		return nil, nil, ErrInvalidGrant
+	}
+	if ac.CodeChallenge != "" && !verifyCodeChallenge(ac.CodeChallenge, verifier) {
+		return nil, nil, ErrInvalidGrant
+	}
+
+	refresh, err = createToken(ctx, db, refreshTokenKind, c.ClientID, ac.Scope)
+	if err != nil {
+		return nil, nil, err
+	}
+	access, err = createToken(ctx, db, accessTokenKind, c.ClientID, ac.Scope)
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// Refresh creates a new access token for the client, with the scope of the
+// given refresh token
+func Refresh(ctx context.Context, db string, c *Client, refreshToken string) (*Token, error) {
+	refresh, err := getToken(ctx, db, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if refresh.Kind != refreshTokenKind || refresh.ClientID != c.ClientID {
+		return nil, ErrInvalidGrant
+	}
+	return createToken(ctx, db, accessTokenKind, c.ClientID, refresh.Scope)
+}
+
+// GetAccessToken returns the access token, if it exists and has not
+// expired
+func GetAccessToken(ctx context.Context, db, token string) (*Token, error) {
+	t, err := getToken(ctx, db, token)
+	if err == ErrInvalidGrant {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.Kind != accessTokenKind || t.ExpiresAt == nil || time.Now().After(*t.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+	return t, nil
+}
+
+func getToken(ctx context.Context, db, token string) (*Token, error) {
+	if token == "" {
+		return nil, ErrInvalidGrant
+	}
+	t := &Token{}
+	err := couchdb.GetDoc(ctx, db, TokenDocType, token, t)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func createToken(ctx context.Context, db, kind, clientID string, scope apps.Scopes) (*Token, error) {
+	id, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	t := &Token{
+		TokenID:   id,
+		Kind:      kind,
+		ClientID:  clientID,
+		Scope:     scope,
+		CreatedAt: now,
+	}
+	if kind == accessTokenKind {
+		expiresAt := now.Add(AccessTokenTTL)
+		t.ExpiresAt = &expiresAt
+	}
+	if err = couchdb.CreateNamedDocWithDB(ctx, db, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,25 @@
+package oauth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodeChallenge(t *testing.T) {
+	// the example of the appendix B of RFC 7636
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	assert.NoError(t, CheckCodeChallenge("", ""))
+	assert.NoError(t, CheckCodeChallenge(challenge, CodeChallengeS256))
+	assert.Equal(t, ErrInvalidCodeChallenge, CheckCodeChallenge(challenge, ""))
+	assert.Equal(t, ErrInvalidCodeChallenge, CheckCodeChallenge(verifier, "plain"))
+	assert.Equal(t, ErrInvalidCodeChallenge, CheckCodeChallenge("", CodeChallengeS256))
+	assert.Equal(t, ErrInvalidCodeChallenge, CheckCodeChallenge("not-a-sha256", CodeChallengeS256))
+
+	assert.True(t, verifyCodeChallenge(challenge, verifier))
+	assert.False(t, verifyCodeChallenge(challenge, ""))
+	assert.False(t, verifyCodeChallenge(challenge, verifier[1:]+"a"))
+	assert.False(t, verifyCodeChallenge(verifier, verifier))
+}
@@ -0,0 +1,120 @@
+// Package ratelimit limits the number of requests that a client can make to
+// an instance, with token buckets. Each client has a bucket of tokens,
+// refilled at a constant rate, and a request takes a token from it: a
+// client can make a burst of requests, but not more than the rate in the
+// long run. It protects the small self-hosted boxes from the clients that
+// make too many requests, and the authentication from brute force attacks.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is the budget of requests of a client: its bucket has Burst tokens,
+// and it is refilled at Rate tokens per second
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+var (
+	// DefaultLimit is the budget of requests of a client on an instance
+	DefaultLimit = Limit{Rate: 20, Burst: 200}
+	// DefaultAuthLimit is the stricter budget of requests of a client on
+	// the authentication routes of an instance: 10 attempts, and then one
+	// every 6 seconds
+	DefaultAuthLimit = Limit{Rate: 1.0 / 6, Burst: 10}
+)
+
+// Enabled returns true if the limit can be enforced
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// fullAfter returns the duration after which an empty bucket is full again
+func (l Limit) fullAfter() time.Duration {
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+// Store keeps the token buckets of the clients
+type Store interface {
+	// Take takes a token from the bucket with the given key. It returns 0
+	// if there was a token, or else the duration to wait for the next
+	// token.
+	Take(key string, limit Limit) (time.Duration, error)
+}
+
+// bucket is a token bucket kept in memory
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// take refills the bucket for the duration since the last request, and
+// takes a token
+func (b *bucket) take(limit Limit, now time.Time) time.Duration {
+	elapsed := now.Sub(b.at).Seconds()
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+	b.at = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// sweepInterval is the delay between two removals of the full buckets of
+// a MemoryStore
+const sweepInterval = 10 * time.Minute
+
+// MemoryStore is a Store that keeps the buckets in the memory of the
+// stack. The buckets are not shared between several stacks.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	limits  map[string]Limit
+	sweptAt time.Time
+	now     func() time.Time
+}
+
+// NewMemoryStore returns a new MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		limits:  make(map[string]Limit),
+		sweptAt: time.Now(),
+		now:     time.Now,
+	}
+}
+
+// Take takes a token from a bucket - see Store interface
+func (s *MemoryStore) Take(key string, limit Limit) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.sweptAt) > sweepInterval {
+		s.sweep(now)
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), at: now}
+		s.buckets[key] = b
+		s.limits[key] = limit
+	}
+	return b.take(limit, now), nil
+}
+
+// sweep removes the buckets that are full again, as they are the same as
+// the new buckets
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if now.Sub(b.at) > s.limits[key].fullAfter() {
+			delete(s.buckets, key)
+			delete(s.limits, key)
+		}
+	}
+	s.sweptAt = now
+}
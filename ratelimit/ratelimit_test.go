@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Now()
+	s := NewMemoryStore()
+	s.now = func() time.Time { return now }
+	limit := Limit{Rate: 1, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		wait, err := s.Take("alice", limit)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), wait)
+	}
+	wait, err := s.Take("alice", limit)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, wait)
+
+	// the buckets are not shared
+	wait, _ = s.Take("bob", limit)
+	assert.Equal(t, time.Duration(0), wait)
+
+	now = now.Add(500 * time.Millisecond)
+	wait, _ = s.Take("alice", limit)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	now = now.Add(500 * time.Millisecond)
+	wait, _ = s.Take("alice", limit)
+	assert.Equal(t, time.Duration(0), wait)
+	wait, _ = s.Take("alice", limit)
+	assert.NotEqual(t, time.Duration(0), wait)
+
+	// the bucket is never filled over its burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		wait, _ = s.Take("alice", limit)
+		assert.Equal(t, time.Duration(0), wait)
+	}
+	wait, _ = s.Take("alice", limit)
+	assert.NotEqual(t, time.Duration(0), wait)
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	now := time.Now()
+	s := NewMemoryStore()
+	s.now = func() time.Time { return now }
+	s.Take("alice", Limit{Rate: 1, Burst: 3})
+	s.Take("bob", Limit{Rate: 0.001, Burst: 3})
+	assert.Len(t, s.buckets, 2)
+
+	now = now.Add(sweepInterval + time.Minute)
+	s.Take("carol", Limit{Rate: 1, Burst: 3})
+	assert.Len(t, s.buckets, 2)
+	assert.Contains(t, s.buckets, "bob")
+	assert.Contains(t, s.buckets, "carol")
+}
+
+func TestLimitEnabled(t *testing.T) {
+	assert.True(t, DefaultLimit.Enabled())
+	assert.True(t, DefaultAuthLimit.Enabled())
+	assert.False(t, Limit{}.Enabled())
+	assert.False(t, Limit{Rate: 1}.Enabled())
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/dcasier/cozy-stack/redis"
+)
+
+// takeScript is the Lua script that takes a token from a bucket in Redis,
+// so that the buckets can be shared by several stacks. A bucket is a hash
+// with its tokens and the time of the last request, in milliseconds, that
+// expires when the bucket is full again. It returns the number of
+// milliseconds to wait for the next token.
+const takeScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "at")
+local tokens = tonumber(bucket[1]) or burst
+local at = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - at) * rate / 1000)
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+else
+  wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "at", ARGV[3])
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate))
+return wait
+`
+
+// RedisStore is a Store that keeps the buckets in Redis, to share them
+// between several stacks
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore returns a RedisStore for the given Redis URL, like
+// redis://:password@localhost:6379/0. The password and the database are
+// optional.
+func NewRedisStore(rawurl string) (*RedisStore, error) {
+	client, err := redis.NewClient(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisStore{client: client}, nil
+}
+
+// Take takes a token from a bucket - see Store interface
+func (s *RedisStore) Take(key string, limit Limit) (time.Duration, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	wait, err := s.client.Int("EVAL", takeScript, "1", "ratelimit:"+key,
+		strconv.FormatFloat(limit.Rate, 'f', -1, 64),
+		strconv.Itoa(limit.Burst),
+		strconv.FormatInt(now, 10))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRedisStore(t *testing.T) {
+	_, err := NewRedisStore("redis://:secret@redis.example:6380/2")
+	assert.NoError(t, err)
+	_, err = NewRedisStore("http://localhost:6379")
+	assert.Error(t, err)
+}
+
+func TestRedisStoreTake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	commands := make(chan string, 2)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for _, reply := range []string{"+OK\r\n", ":1500\r\n"} {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			// the arguments are bulk strings, with new lines in the script
+			n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			for i := 0; i < n; i++ {
+				header, _ := r.ReadString('\n')
+				size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+				arg := make([]byte, size+2)
+				if _, err = io.ReadFull(r, arg); err != nil {
+					return
+				}
+				if i == 0 {
+					commands <- string(arg[:size])
+				}
+			}
+			conn.Write([]byte(reply))
+		}
+	}()
+
+	s, err := NewRedisStore("redis://:secret@" + l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	wait, err := s.Take("auth:alice.cozy.example:127.0.0.1", Limit{Rate: 1, Burst: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 1500*time.Millisecond, wait)
+	assert.Equal(t, "AUTH", <-commands)
+	assert.Equal(t, "EVAL", <-commands)
+}
@@ -0,0 +1,314 @@
+// Package realtime is for the events on the documents of an instance, that
+// are sent to the clients as soon as they happen, so that they don't have to
+// poll the data API. The events come from the changes feeds of the CouchDB
+// databases of the instance.
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/logger"
+)
+
+// The verbs of the events
+const (
+	// EventCreate is the verb of an event for a new document
+	EventCreate = "CREATED"
+	// EventUpdate is the verb of an event for a modified document
+	EventUpdate = "UPDATED"
+	// EventDelete is the verb of an event for a deleted document
+	EventDelete = "DELETED"
+)
+
+// bufferSize is the number of events that can wait for a subscriber before
+// it is considered too slow and is closed
+const bufferSize = 64
+
+// pollTimeout is the maximal duration of a longpoll request on a changes
+// feed, so that the watchers of the unused doctypes stop in time
+const pollTimeout = 30 * time.Second
+
+// retryDelay is the time to wait before polling a changes feed again after
+// an error, or while its database does not exist yet
+const retryDelay = 5 * time.Second
+
+// Event is a change on a document of an instance
+type Event struct {
+	Verb    string          `json:"-"`
+	Doctype string          `json:"type"`
+	DocID   string          `json:"id"`
+	Doc     json.RawMessage `json:"doc,omitempty"`
+}
+
+// eventFromChange returns the event for a change of the changes feed of a
+// doctype, or nil for the changes that are not sent to the clients
+func eventFromChange(doctype string, change *couchdb.Change) *Event {
+	if strings.HasPrefix(change.DocID, "_design/") {
+		return nil
+	}
+	verb := EventUpdate
+	if change.Deleted {
+		verb = EventDelete
+	} else if strings.HasPrefix(change.Rev(), "1-") {
+		verb = EventCreate
+	}
+	return &Event{Verb: verb, Doctype: doctype, DocID: change.DocID, Doc: change.Doc}
+}
+
+// Hub dispatches the events of the instances to their subscribers. For each
+// instance and doctype with at least one subscriber, a watcher follows the
+// changes feed of the database of the doctype.
+type Hub struct {
+	mu     sync.Mutex
+	topics map[string]*topic
+
+	// watch follows the changes of a topic until its context is canceled
+	watch func(ctx context.Context, t *topic)
+}
+
+// topic is a doctype of an instance, with its subscribers
+type topic struct {
+	dbprefix string
+	doctype  string
+	subs     map[*Subscriber]struct{}
+	cancel   context.CancelFunc
+}
+
+func topicKey(dbprefix, doctype string) string {
+	return dbprefix + "/" + doctype
+}
+
+// NewHub returns a new hub, without subscribers
+func NewHub() *Hub {
+	h := &Hub{topics: make(map[string]*topic)}
+	h.watch = h.pollChanges
+	return h
+}
+
+var globalHub = NewHub()
+
+// GetHub returns the hub of the stack
+func GetHub() *Hub {
+	return globalHub
+}
+
+// Subscriber receives the events of an instance for the doctypes and the
+// documents that it watches, on its channel. The channel is closed when the
+// subscriber is closed, or when it doesn't read its events fast enough.
+type Subscriber struct {
+	// C is the channel of the events
+	C <-chan *Event
+
+	c        chan *Event
+	hub      *Hub
+	dbprefix string
+	closed   bool
+	// watched are the watched doctypes, with the watched documents, or nil
+	// for all the documents of the doctype
+	watched map[string]map[string]struct{}
+}
+
+// Subscribe returns a new subscriber for the events of an instance
+func (h *Hub) Subscribe(dbprefix string) *Subscriber {
+	c := make(chan *Event, bufferSize)
+	return &Subscriber{
+		C:        c,
+		c:        c,
+		hub:      h,
+		dbprefix: dbprefix,
+		watched:  make(map[string]map[string]struct{}),
+	}
+}
+
+// Watch adds the events of a document to the events of the subscriber, or
+// of all the documents of the doctype if id is empty
+func (s *Subscriber) Watch(doctype, id string) {
+	h := s.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s.closed {
+		return
+	}
+
+	ids, ok := s.watched[doctype]
+	switch {
+	case !ok && id == "":
+		s.watched[doctype] = nil
+	case !ok:
+		s.watched[doctype] = map[string]struct{}{id: {}}
+	case ids != nil && id == "":
+		s.watched[doctype] = nil
+	case ids != nil:
+		ids[id] = struct{}{}
+	}
+	if !ok {
+		h.addToTopic(s, doctype)
+	}
+}
+
+// Unwatch removes the events of a document from the events of the
+// subscriber, or of the whole doctype if id is empty
+func (s *Subscriber) Unwatch(doctype, id string) {
+	h := s.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ids, ok := s.watched[doctype]
+	if !ok {
+		return
+	}
+	if id != "" && ids != nil {
+		delete(ids, id)
+		if len(ids) > 0 {
+			return
+		}
+	} else if id != "" {
+		// the whole doctype stays watched
+		return
+	}
+	delete(s.watched, doctype)
+	h.removeFromTopic(s, doctype)
+}
+
+// Close stops the events of the subscriber, and closes its channel
+func (s *Subscriber) Close() {
+	h := s.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.close(s)
+}
+
+func (s *Subscriber) matches(e *Event) bool {
+	ids, ok := s.watched[e.Doctype]
+	if !ok {
+		return false
+	}
+	if ids == nil {
+		return true
+	}
+	_, ok = ids[e.DocID]
+	return ok
+}
+
+// Publish sends an event on the documents of an instance to the subscribers
+// that watch it
+func (h *Hub) Publish(dbprefix string, e *Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.topics[topicKey(dbprefix, e.Doctype)]
+	if !ok {
+		return
+	}
+	for s := range t.subs {
+		if !s.matches(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			// the subscriber will have to resynchronize its documents
+			logger.Warnf("realtime", "closing a slow subscriber of %s", dbprefix)
+			h.close(s)
+		}
+	}
+}
+
+// CloseAll closes all the subscribers, for example when the stack is
+// stopped: their clients can then reconnect to another stack
+func (h *Hub) CloseAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, t := range h.topics {
+		for s := range t.subs {
+			h.close(s)
+		}
+	}
+}
+
+// close must be called with the lock of the hub
+func (h *Hub) close(s *Subscriber) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for doctype := range s.watched {
+		h.removeFromTopic(s, doctype)
+	}
+	s.watched = nil
+	close(s.c)
+}
+
+// addToTopic must be called with the lock of the hub
+func (h *Hub) addToTopic(s *Subscriber, doctype string) {
+	key := topicKey(s.dbprefix, doctype)
+	t, ok := h.topics[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		t = &topic{
+			dbprefix: s.dbprefix,
+			doctype:  doctype,
+			subs:     make(map[*Subscriber]struct{}),
+			cancel:   cancel,
+		}
+		h.topics[key] = t
+		go h.watch(ctx, t)
+	}
+	t.subs[s] = struct{}{}
+}
+
+// removeFromTopic must be called with the lock of the hub
+func (h *Hub) removeFromTopic(s *Subscriber, doctype string) {
+	key := topicKey(s.dbprefix, doctype)
+	t, ok := h.topics[key]
+	if !ok {
+		return
+	}
+	delete(t.subs, s)
+	if len(t.subs) == 0 {
+		t.cancel()
+		delete(h.topics, key)
+	}
+}
+
+// pollChanges publishes the changes of the database of a topic, from the
+// moment it is called, until its context is canceled
+func (h *Hub) pollChanges(ctx context.Context, t *topic) {
+	since := couchdb.Seq("now")
+	for {
+		res, err := couchdb.GetChanges(ctx, t.dbprefix, t.doctype, &couchdb.ChangesRequest{
+			Feed:        couchdb.LongPollFeed,
+			Since:       since,
+			IncludeDocs: true,
+			Timeout:     pollTimeout,
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if couchdb.IsNoDatabaseError(err) {
+				// all the changes of the future database will be new
+				since = ""
+			} else {
+				logger.Errorf("realtime", "cannot get the changes of %s: %v",
+					topicKey(t.dbprefix, t.doctype), err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryDelay):
+			}
+			continue
+		}
+		for i := range res.Results {
+			if e := eventFromChange(t.doctype, &res.Results[i]); e != nil {
+				h.Publish(t.dbprefix, e)
+			}
+		}
+		since = res.LastSeq
+	}
+}
@@ -0,0 +1,121 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestHub returns a hub that doesn't follow the changes feeds
+func newTestHub() *Hub {
+	h := NewHub()
+	h.watch = func(ctx context.Context, t *topic) {}
+	return h
+}
+
+func watchedTopics(h *Hub) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := []string{}
+	for key := range h.topics {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestEventFromChange(t *testing.T) {
+	var change couchdb.Change
+	err := json.Unmarshal([]byte(`{"seq": "1", "id": "foo", "changes": [{"rev": "1-abc"}], "doc": {"_id": "foo"}}`), &change)
+	assert.NoError(t, err)
+	e := eventFromChange("io.cozy.contacts", &change)
+	assert.Equal(t, EventCreate, e.Verb)
+	assert.Equal(t, "io.cozy.contacts", e.Doctype)
+	assert.Equal(t, "foo", e.DocID)
+	assert.Equal(t, `{"_id": "foo"}`, string(e.Doc))
+
+	change.Changes[0].Rev = "2-def"
+	assert.Equal(t, EventUpdate, eventFromChange("io.cozy.contacts", &change).Verb)
+	change.Deleted = true
+	assert.Equal(t, EventDelete, eventFromChange("io.cozy.contacts", &change).Verb)
+
+	change.DocID = "_design/by-name"
+	assert.Nil(t, eventFromChange("io.cozy.contacts", &change))
+}
+
+func TestSubscribe(t *testing.T) {
+	h := newTestHub()
+	alice := h.Subscribe("alice-cozy-")
+	bob := h.Subscribe("bob-cozy-")
+	alice.Watch("io.cozy.contacts", "")
+	alice.Watch("io.cozy.files", "123")
+	bob.Watch("io.cozy.contacts", "")
+	assert.Len(t, watchedTopics(h), 3)
+
+	h.Publish("alice-cozy-", &Event{Verb: EventCreate, Doctype: "io.cozy.contacts", DocID: "1"})
+	h.Publish("alice-cozy-", &Event{Verb: EventUpdate, Doctype: "io.cozy.files", DocID: "456"})
+	h.Publish("alice-cozy-", &Event{Verb: EventUpdate, Doctype: "io.cozy.files", DocID: "123"})
+	h.Publish("alice-cozy-", &Event{Verb: EventCreate, Doctype: "io.cozy.events", DocID: "2"})
+
+	e := <-alice.C
+	assert.Equal(t, "io.cozy.contacts", e.Doctype)
+	e = <-alice.C
+	assert.Equal(t, "123", e.DocID)
+	assert.Len(t, alice.C, 0)
+	// the events of an instance are not sent to the other instances
+	assert.Len(t, bob.C, 0)
+
+	alice.Unwatch("io.cozy.files", "123")
+	h.Publish("alice-cozy-", &Event{Verb: EventUpdate, Doctype: "io.cozy.files", DocID: "123"})
+	assert.Len(t, alice.C, 0)
+	assert.Len(t, watchedTopics(h), 2)
+
+	// a whole doctype includes its documents
+	alice.Watch("io.cozy.contacts", "1")
+	alice.Unwatch("io.cozy.contacts", "1")
+	h.Publish("alice-cozy-", &Event{Verb: EventDelete, Doctype: "io.cozy.contacts", DocID: "3"})
+	assert.Len(t, alice.C, 1)
+
+	alice.Close()
+	bob.Close()
+	_, ok := <-bob.C
+	assert.False(t, ok)
+	assert.Len(t, watchedTopics(h), 0)
+	// closing twice is fine
+	bob.Close()
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	h := newTestHub()
+	s := h.Subscribe("alice-cozy-")
+	s.Watch("io.cozy.contacts", "")
+	for i := 0; i <= bufferSize; i++ {
+		h.Publish("alice-cozy-", &Event{Verb: EventUpdate, Doctype: "io.cozy.contacts", DocID: "1"})
+	}
+	for i := 0; i < bufferSize; i++ {
+		<-s.C
+	}
+	_, ok := <-s.C
+	assert.False(t, ok)
+	assert.Len(t, watchedTopics(h), 0)
+}
+
+func TestCloseAll(t *testing.T) {
+	h := newTestHub()
+	alice := h.Subscribe("alice-cozy-")
+	bob := h.Subscribe("bob-cozy-")
+	alice.Watch("io.cozy.contacts", "")
+	alice.Watch("io.cozy.files", "123")
+	bob.Watch("io.cozy.contacts", "")
+
+	h.CloseAll()
+	assert.Empty(t, watchedTopics(h))
+	_, ok := <-alice.C
+	assert.False(t, ok)
+	_, ok = <-bob.C
+	assert.False(t, ok)
+	// closing again a subscriber is a no-op
+	alice.Close()
+}
@@ -0,0 +1,221 @@
+// Package redis is a minimal client for Redis, for the features of the stack
+// that can be shared between several stacks: the budgets of the rate limiter
+// and the queues of the jobs. It speaks the Redis protocol (RESP) on a
+// single connection, opened again after an error.
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is the maximal duration to connect to Redis, and of a
+// command
+const DefaultTimeout = time.Second
+
+// ErrReply is used when Redis answers something unexpected
+var ErrReply = errors.New("Unexpected reply from Redis")
+
+// Error is an error sent by Redis
+type Error string
+
+func (e Error) Error() string { return "Redis: " + string(e) }
+
+// Client is a connection to a Redis server. The commands are serialized:
+// a blocking command, like BRPOP, should have its own client.
+type Client struct {
+	addr     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewClient returns a client for the given Redis URL, like
+// redis://:password@localhost:6379/0. The password and the database are
+// optional. The connection is opened on the first command.
+func NewClient(rawurl string) (*Client, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("Invalid Redis URL: %s", rawurl)
+	}
+	c := &Client{addr: u.Host}
+	if !strings.Contains(u.Host, ":") {
+		c.addr += ":6379"
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("Invalid Redis database: %s", db)
+		}
+	}
+	return c, nil
+}
+
+// Do sends a command, and returns its reply: an int64 for an integer, a
+// string for a status or a bulk string, nil for a null bulk string or
+// array, and a []interface{} for an array
+func (c *Client) Do(args ...string) (interface{}, error) {
+	return c.DoTimeout(DefaultTimeout, args...)
+}
+
+// DoTimeout is like Do, with the maximal duration of the command, for the
+// blocking commands
+func (c *Client) DoTimeout(timeout time.Duration, args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.command(timeout, args...)
+	if _, isRedisErr := err.(Error); err != nil && !isRedisErr {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// Int sends a command with an integer reply
+func (c *Client) Int(args ...string) (int64, error) {
+	reply, err := c.Do(args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, ErrReply
+	}
+	return n, nil
+}
+
+// Ping checks that the server answers to the commands
+func (c *Client) Ping() error {
+	reply, err := c.Do("PING")
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return ErrReply
+	}
+	return nil
+}
+
+// connect opens the connection, and selects the database
+func (c *Client) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, DefaultTimeout)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.r = bufio.NewReader(conn)
+	if c.password != "" {
+		if _, err = c.command(DefaultTimeout, "AUTH", c.password); err != nil {
+			conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	if c.db != 0 {
+		if _, err = c.command(DefaultTimeout, "SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) command(timeout time.Duration, args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	if err := writeCommand(c.conn, args); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+// writeCommand writes a command in the Redis protocol
+func writeCommand(w io.Writer, args []string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readReply reads the reply of a command
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, ErrReply
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, ErrReply
+		}
+		return n, nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, ErrReply
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, ErrReply
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			items[i], err = readReply(r)
+			if e, isRedisErr := err.(Error); isRedisErr {
+				// the rest of the array must still be read
+				items[i] = e
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, ErrReply
+}
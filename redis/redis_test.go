@@ -0,0 +1,63 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewClient(t *testing.T) {
+	c, err := NewClient("redis://localhost")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "localhost:6379", c.addr)
+		assert.Equal(t, "", c.password)
+		assert.Equal(t, 0, c.db)
+	}
+	c, err = NewClient("redis://:secret@redis.example:6380/2")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "redis.example:6380", c.addr)
+		assert.Equal(t, "secret", c.password)
+		assert.Equal(t, 2, c.db)
+	}
+	_, err = NewClient("http://localhost:6379")
+	assert.Error(t, err)
+	_, err = NewClient("redis://localhost/db")
+	assert.Error(t, err)
+}
+
+func TestWriteCommand(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, writeCommand(&buf, []string{"SELECT", "12"}))
+	assert.Equal(t, "*2\r\n$6\r\nSELECT\r\n$2\r\n12\r\n", buf.String())
+}
+
+func TestReadReply(t *testing.T) {
+	read := func(s string) (interface{}, error) {
+		return readReply(bufio.NewReader(strings.NewReader(s)))
+	}
+	reply, err := read(":1500\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1500), reply)
+	reply, err = read("+OK\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "OK", reply)
+	_, err = read("-ERR wrong number of arguments\r\n")
+	assert.Equal(t, Error("ERR wrong number of arguments"), err)
+	reply, err = read("$5\r\nfoo\r\n\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo\r\n", reply)
+	reply, err = read("$-1\r\n")
+	assert.NoError(t, err)
+	assert.Nil(t, reply)
+	reply, err = read("*2\r\n$4\r\njobs\r\n:42\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"jobs", int64(42)}, reply)
+	reply, err = read("*-1\r\n")
+	assert.NoError(t, err)
+	assert.Nil(t, reply)
+	_, err = read("!oops\r\n")
+	assert.Equal(t, ErrReply, err)
+}
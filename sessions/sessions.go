@@ -0,0 +1,184 @@
+// Package sessions is for the sessions of the owner of an instance, opened
+// by a login with the passphrase. A session is a document in the database
+// of the instance, and its identifier is sent to the browser in a cookie
+// signed with a sessions key of the keyring of the instance.
+package sessions
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/instance"
+)
+
+// SessionDocType is the doctype of the sessions
+const SessionDocType = "io.cozy.sessions"
+
+// CookieName is the name of the cookie of the session
+const CookieName = "cozysessid"
+
+// MaxAge is the duration of a session
+const MaxAge = 7 * 24 * time.Hour
+
+// idLength is the number of random bytes of the identifier of a session
+const idLength = 24
+
+var (
+	// ErrInvalidSession is used when the cookie of a session is malformed,
+	// badly signed, or for a session that does not exist anymore
+	ErrInvalidSession = errors.New("Invalid session")
+	// ErrSessionExpired is used when the session is too old
+	ErrSessionExpired = errors.New("Session has expired")
+)
+
+// Session is a session of the owner of an instance
+type Session struct {
+	SessionID  string    `json:"_id,omitempty"`
+	SessionRev string    `json:"_rev,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+
+	cookie string
+	secret []byte
+}
+
+// ID returns the session identifier - see couchdb.Doc interface
+func (s *Session) ID() string { return s.SessionID }
+
+// Rev returns the session revision - see couchdb.Doc interface
+func (s *Session) Rev() string { return s.SessionRev }
+
+// DocType returns the session doctype - see couchdb.Doc interface
+func (s *Session) DocType() string { return SessionDocType }
+
+// SetID changes the session identifier - see couchdb.Doc interface
+func (s *Session) SetID(id string) { s.SessionID = id }
+
+// SetRev changes the session revision - see couchdb.Doc interface
+func (s *Session) SetRev(rev string) { s.SessionRev = rev }
+
+// Cookie returns the signed value of the cookie of the session
+func (s *Session) Cookie() string { return s.cookie }
+
+// CSRFToken returns the token that the browser must send with the requests
+// that change something, to prove that they come from a page of the
+// instance and not from another site. It is derived from the session, so
+// that it can't be used with the session of another browser.
+func (s *Session) CSRFToken() string {
+	return sign(s.secret, "csrf."+s.SessionID)
+}
+
+// CheckCSRFToken returns true if the given token is the CSRF token of the
+// session
+func (s *Session) CheckCSRFToken(token string) bool {
+	return token != "" && hmac.Equal([]byte(token), []byte(s.CSRFToken()))
+}
+
+// New creates a new session for the owner of the instance. The instance
+// must have a registered passphrase. The cookie is signed with the current
+// sessions key of the instance.
+func New(ctx context.Context, i *instance.Instance) (*Session, error) {
+	keys, err := sessionKeys(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	secret := keys[0].Secret
+
+	b := make([]byte, idLength)
+	if _, err = rand.Read(b); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	s := &Session{
+		SessionID: hex.EncodeToString(b),
+		CreatedAt: now,
+		ExpiresAt: now.Add(MaxAge),
+	}
+	if err = couchdb.CreateNamedDocWithDB(ctx, i.GetDatabasePrefix(), s); err != nil {
+		return nil, err
+	}
+	s.cookie = s.SessionID + "." + sign(secret, s.SessionID)
+	s.secret = secret
+	return s, nil
+}
+
+// Get returns the session of the given cookie, after checking its
+// signature and its expiration. The cookies signed with the previous
+// sessions keys, before a rotation, are still accepted.
+func Get(ctx context.Context, i *instance.Instance, cookie string) (*Session, error) {
+	parts := strings.SplitN(cookie, ".", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, ErrInvalidSession
+	}
+	keys, err := sessionKeys(ctx, i)
+	if err == instance.ErrNoPassphrase {
+		return nil, ErrInvalidSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	var secret []byte
+	for _, key := range keys {
+		if hmac.Equal([]byte(parts[1]), []byte(sign(key.Secret, parts[0]))) {
+			secret = key.Secret
+			break
+		}
+	}
+	if secret == nil {
+		return nil, ErrInvalidSession
+	}
+
+	s := &Session{}
+	err = couchdb.GetDoc(ctx, i.GetDatabasePrefix(), SessionDocType, parts[0], s)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, ErrInvalidSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(s.ExpiresAt) {
+		s.Delete(ctx, i)
+		return nil, ErrSessionExpired
+	}
+	s.cookie = cookie
+	s.secret = secret
+	return s, nil
+}
+
+// Delete destroys the session, for a logout
+func (s *Session) Delete(ctx context.Context, i *instance.Instance) error {
+	err := couchdb.DeleteDoc(ctx, i.GetDatabasePrefix(), s)
+	if couchdb.IsNotFoundError(err) {
+		return nil
+	}
+	return err
+}
+
+// sessionKeys returns the keys used to sign the cookies of the sessions of
+// the instance, the current one first. There is no session before the
+// registration of the passphrase.
+func sessionKeys(ctx context.Context, i *instance.Instance) ([]*instance.Key, error) {
+	settings, err := i.GetSettings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(settings.PassphraseHash) == 0 {
+		return nil, instance.ErrNoPassphrase
+	}
+	return i.GetKeys(ctx, instance.KeySessions)
+}
+
+// sign returns the HMAC-SHA256 of the session identifier
+func sign(secret []byte, id string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
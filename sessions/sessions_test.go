@@ -0,0 +1,37 @@
+package sessions
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSign(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	sig := sign(secret, "session-id")
+	assert.NotEmpty(t, sig)
+	assert.Equal(t, sig, sign(secret, "session-id"))
+	assert.NotEqual(t, sig, sign(secret, "another-id"))
+	assert.NotEqual(t, sig, sign([]byte("another secret"), "session-id"))
+}
+
+func TestGetMalformedCookie(t *testing.T) {
+	for _, cookie := range []string{"", "no-signature", ".signature"} {
+		_, err := Get(context.Background(), nil, cookie)
+		assert.Equal(t, ErrInvalidSession, err)
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	s := &Session{SessionID: "session-id", secret: secret}
+	token := s.CSRFToken()
+	assert.NotEmpty(t, token)
+	assert.True(t, s.CheckCSRFToken(token))
+	assert.False(t, s.CheckCSRFToken(""))
+	assert.False(t, s.CheckCSRFToken(sign(secret, "session-id")))
+
+	other := &Session{SessionID: "another-id", secret: secret}
+	assert.False(t, other.CheckCSRFToken(token))
+}
@@ -0,0 +1,162 @@
+// Package sharings is for sharing files and directories with people
+// that don't have a cozy, via public links.
+package sharings
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/vfs"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LinkDocType is the doctype of the sharing links
+const LinkDocType = "io.cozy.sharings.links"
+
+// tokenLength is the number of random bytes used for a token
+const tokenLength = 24
+
+var (
+	// ErrLinkExpired is used when the sharing link has expired
+	ErrLinkExpired = errors.New("Sharing link has expired")
+	// ErrInvalidPassword is used when the password of a sharing link is
+	// missing or does not match
+	ErrInvalidPassword = errors.New("Invalid password for this sharing link")
+	// ErrIllegalExpiration is used when the expiration date of a
+	// sharing link is in the past
+	ErrIllegalExpiration = errors.New("Expiration date is in the past")
+)
+
+// Link is a public link to a file or a directory. The token is used as
+// the identifier of the document, and the password, if any, is stored
+// hashed with bcrypt.
+type Link struct {
+	LinkID  string `json:"_id,omitempty"`
+	LinkRev string `json:"_rev,omitempty"`
+
+	FileID       string     `json:"file_id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	PasswordHash []byte     `json:"password_hash,omitempty"`
+	Protected    bool       `json:"protected"`
+}
+
+// ID returns the token of the link - see couchdb.Doc interface
+func (l *Link) ID() string { return l.LinkID }
+
+// Rev returns the link revision - see couchdb.Doc interface
+func (l *Link) Rev() string { return l.LinkRev }
+
+// DocType returns the link doctype - see couchdb.Doc interface
+func (l *Link) DocType() string { return LinkDocType }
+
+// SetID changes the link token - see couchdb.Doc interface
+func (l *Link) SetID(id string) { l.LinkID = id }
+
+// SetRev changes the link revision - see couchdb.Doc interface
+func (l *Link) SetRev(rev string) { l.LinkRev = rev }
+
+// SelfLink is the public URL of the link - see jsonapi.Object interface
+func (l *Link) SelfLink() string { return "/public/files/" + l.LinkID }
+
+// Relationships is used to generate the shared file relationship in
+// JSON-API format - see jsonapi.Object interface
+func (l *Link) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"file": jsonapi.Relationship{
+			Links: &jsonapi.LinksList{
+				Related: "/files/" + l.FileID,
+			},
+			Data: jsonapi.ResourceIdentifier{
+				ID:   l.FileID,
+				Type: vfs.FsDocType,
+			},
+		},
+	}
+}
+
+// Included is part of the jsonapi.Object interface
+func (l *Link) Included() []jsonapi.Object {
+	return []jsonapi.Object{}
+}
+
+// Expired returns true if the link can no longer be used
+func (l *Link) Expired() bool {
+	return l.ExpiresAt != nil && l.ExpiresAt.Before(time.Now())
+}
+
+// Check returns an error if the link has expired or if the given
+// password does not match the one of the link.
+func (l *Link) Check(password string) error {
+	if l.Expired() {
+		return ErrLinkExpired
+	}
+	if !l.Protected {
+		return nil
+	}
+	if password == "" {
+		return ErrInvalidPassword
+	}
+	if bcrypt.CompareHashAndPassword(l.PasswordHash, []byte(password)) != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// CreateLink creates a new sharing link for the file or directory with
+// the given identifier. The expiration date and the password are
+// optional.
+func CreateLink(ctx context.Context, db, fileID string, expiresAt *time.Time, password string) (*Link, error) {
+	if expiresAt != nil && expiresAt.Before(time.Now()) {
+		return nil, ErrIllegalExpiration
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	link := &Link{
+		LinkID:    token,
+		FileID:    fileID,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+
+	if password != "" {
+		link.PasswordHash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		link.Protected = true
+	}
+
+	if err = couchdb.CreateNamedDocWithDB(ctx, db, link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// GetLink fetches the sharing link with the given token
+func GetLink(ctx context.Context, db, token string) (*Link, error) {
+	link := &Link{}
+	if err := couchdb.GetDoc(ctx, db, LinkDocType, token, link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func newToken() (string, error) {
+	b := make([]byte, tokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+var _ jsonapi.Object = &Link{}
@@ -0,0 +1,86 @@
+package sharings
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/couchdb/couchdbtest"
+	"github.com/stretchr/testify/assert"
+)
+
+const TestPrefix = "test/"
+
+func TestCreateAndGetLink(t *testing.T) {
+	link, err := CreateLink(context.Background(), TestPrefix, "foo", nil, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, link.ID(), 2*tokenLength)
+	assert.NotEmpty(t, link.Rev())
+	assert.False(t, link.Protected)
+
+	fetched, err := GetLink(context.Background(), TestPrefix, link.ID())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "foo", fetched.FileID)
+		assert.NoError(t, fetched.Check(""))
+		assert.NoError(t, fetched.Check("whatever"))
+	}
+
+	_, err = GetLink(context.Background(), TestPrefix, "nooooop")
+	assert.True(t, couchdb.IsNotFoundError(err))
+}
+
+func TestLinkWithPassword(t *testing.T) {
+	link, err := CreateLink(context.Background(), TestPrefix, "foo", nil, "secret")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, link.Protected)
+
+	fetched, err := GetLink(context.Background(), TestPrefix, link.ID())
+	if assert.NoError(t, err) {
+		assert.Equal(t, ErrInvalidPassword, fetched.Check(""))
+		assert.Equal(t, ErrInvalidPassword, fetched.Check("wrong"))
+		assert.NoError(t, fetched.Check("secret"))
+	}
+}
+
+func TestLinkExpiration(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	_, err := CreateLink(context.Background(), TestPrefix, "foo", &past, "")
+	assert.Equal(t, ErrIllegalExpiration, err)
+
+	future := time.Now().Add(time.Hour)
+	link, err := CreateLink(context.Background(), TestPrefix, "foo", &future, "")
+	if assert.NoError(t, err) {
+		assert.False(t, link.Expired())
+		assert.NoError(t, link.Check(""))
+	}
+
+	link.ExpiresAt = &past
+	assert.True(t, link.Expired())
+	assert.Equal(t, ErrLinkExpired, link.Check(""))
+}
+
+func TestMain(m *testing.M) {
+	couchURL, stop := couchdbtest.Start()
+	err := couchdb.UseServer(couchdb.ServerOptions{URL: couchURL})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = couchdb.ResetDB(context.Background(), TestPrefix, LinkDocType)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	res := m.Run()
+	stop()
+	os.Exit(res)
+}
@@ -0,0 +1,195 @@
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// ScanClean is the antivirus status of a file with no known threat
+	ScanClean = "clean"
+	// ScanInfected is the antivirus status of a file where a threat has
+	// been found
+	ScanInfected = "infected"
+	// ScanUnscanned is the antivirus status of a file that has been
+	// accepted while the antivirus was unavailable
+	ScanUnscanned = "unscanned"
+)
+
+const (
+	// AntivirusReject is the action used to refuse infected uploads
+	AntivirusReject = "reject"
+	// AntivirusQuarantine is the action used to keep infected uploads
+	// but forbid their download
+	AntivirusQuarantine = "quarantine"
+)
+
+// clamdChunkSize is the maximum size of the chunks sent to clamd
+const clamdChunkSize = 32 * 1024
+
+// AntivirusStatus is the result of the scan of a file content. It is
+// stored on the FileDoc.
+type AntivirusStatus struct {
+	Status    string    `json:"status"`
+	Signature string    `json:"signature,omitempty"`
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+// Infected returns true if a threat has been found in the file
+func (s *AntivirusStatus) Infected() bool {
+	return s != nil && s.Status == ScanInfected
+}
+
+// Scanner is the interface that should be implemented by an antivirus
+// to check the content of the uploaded files. The Scan method is fed
+// with the content of the file while it is written in the VFS.
+type Scanner interface {
+	Scan(r io.Reader) (*AntivirusStatus, error)
+}
+
+var scanner Scanner
+var scanAction = AntivirusReject
+var scanFailOpen = false
+
+// UseScanner sets the scanner used to check the content of the files
+// written in the VFS, and the action to take when a file is infected.
+// A nil scanner disables the scanning.
+//
+// When the scanner fails, like when clamd is down, the uploads are
+// rejected by default. With failOpen, they are accepted and their
+// antivirus status is unscanned.
+func UseScanner(s Scanner, action string, failOpen bool) {
+	scanner = s
+	scanFailOpen = failOpen
+	if action == AntivirusQuarantine {
+		scanAction = AntivirusQuarantine
+	} else {
+		scanAction = AntivirusReject
+	}
+}
+
+type scanResult struct {
+	status *AntivirusStatus
+	err    error
+}
+
+// startScan starts a scan in a goroutine. The returned writer should
+// be fed with the file content and closed at the end of the file. The
+// result can then be read on the returned channel. With failOpen, an
+// error of the scanner does not interrupt the writes of the file.
+func startScan(s Scanner, failOpen bool) (*io.PipeWriter, <-chan *scanResult) {
+	pr, pw := io.Pipe()
+	resc := make(chan *scanResult, 1)
+	go func() {
+		status, err := s.Scan(pr)
+		if err != nil && !failOpen {
+			pr.CloseWithError(err)
+		} else {
+			// the scanner may have stopped reading before the end of the
+			// file: drain it so that the writes are not blocked.
+			io.Copy(ioutil.Discard, pr)
+		}
+		resc <- &scanResult{status, err}
+	}()
+	return pw, resc
+}
+
+// ClamdScanner is a Scanner streaming the content to a clamd daemon
+// with the INSTREAM command.
+type ClamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClamdScanner creates a ClamdScanner for the clamd socket given as
+// an URL, like unix:///var/run/clamav/clamd.ctl or tcp://localhost:3310
+func NewClamdScanner(rawurl string) (*ClamdScanner, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	s := &ClamdScanner{timeout: 2 * time.Minute}
+	switch u.Scheme {
+	case "unix":
+		s.network, s.address = "unix", u.Path
+	case "tcp":
+		s.network, s.address = "tcp", u.Host
+	default:
+		return nil, fmt.Errorf("Unknown clamd socket scheme: %v", u.Scheme)
+	}
+	return s, nil
+}
+
+// Scan implements the Scanner interface
+func (s *ClamdScanner) Scan(r io.Reader) (*AntivirusStatus, error) {
+	conn, err := net.DialTimeout(s.network, s.address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, err
+	}
+
+	size := make([]byte, 4)
+	buf := make([]byte, clamdChunkSize)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err = conn.Write(size); err != nil {
+				return nil, err
+			}
+			if _, err = conn.Write(buf[:n]); err != nil {
+				return nil, err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return nil, rerr
+		}
+	}
+
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err = conn.Write(size); err != nil {
+		return nil, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseClamdReply parses the reply of clamd to an INSTREAM command, like
+// "stream: OK" or "stream: Eicar-Test-Signature FOUND"
+func parseClamdReply(reply string) (*AntivirusStatus, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	status := &AntivirusStatus{ScannedAt: time.Now()}
+	switch {
+	case reply == "OK":
+		status.Status = ScanClean
+	case strings.HasSuffix(reply, " FOUND"):
+		status.Status = ScanInfected
+		status.Signature = strings.TrimSuffix(reply, " FOUND")
+	default:
+		return nil, fmt.Errorf("Unexpected reply from clamd: %s", reply)
+	}
+	return status, nil
+}
+
+var _ Scanner = &ClamdScanner{}
@@ -1,6 +1,7 @@
 package vfs
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
@@ -35,9 +36,20 @@ type DirDoc struct {
 	Fullpath string   `json:"path"`
 	Tags     []string `json:"tags"`
 
+	// Size of the files in the directory and its sub-directories. It is
+	// kept up-to-date incrementally in a document of DirSizeDocType, and
+	// only set by DirSize, LoadDirSizes and FetchFiles.
+	Size int64 `json:"size,string"`
+
+	// Date of the move to the trash, if the directory has been trashed
+	TrashedAt *time.Time `json:"trashed_at,omitempty"`
+
 	parent *DirDoc
 	files  []*FileDoc
 	dirs   []*DirDoc
+	// count is the total number of children, when only a page of them
+	// has been fetched
+	count int
 }
 
 // ID returns the directory qualified identifier - see couchdb.Doc interface
@@ -68,6 +80,21 @@ func (d *DirDoc) SetRev(rev string) {
 	d.ObjRev = rev
 }
 
+// clone returns a copy of the directory document, that can be modified
+// without changing the original
+func (d *DirDoc) clone() *DirDoc {
+	cloned := *d
+	if d.Tags != nil {
+		cloned.Tags = make([]string, len(d.Tags))
+		copy(cloned.Tags, d.Tags)
+	}
+	if d.TrashedAt != nil {
+		trashedAt := *d.TrashedAt
+		cloned.TrashedAt = &trashedAt
+	}
+	return &cloned
+}
+
 // Path is used to generate the file path
 func (d *DirDoc) Path(c *Context) (string, error) {
 	if d.Fullpath == "" {
@@ -120,6 +147,9 @@ func (d *DirDoc) Relationships() jsonapi.RelationshipMap {
 	}
 
 	contents := jsonapi.Relationship{Data: data}
+	if d.count > 0 {
+		contents.Meta = &jsonapi.ListMeta{Count: d.count}
+	}
 
 	var parent jsonapi.Relationship
 	if d.ID() != RootFolderID {
@@ -153,11 +183,46 @@ func (d *DirDoc) Included() []jsonapi.Object {
 }
 
 // FetchFiles is used to fetch direct children of the directory.
-//
-// @TODO: add pagination control
 func (d *DirDoc) FetchFiles(c *Context) (err error) {
 	d.files, d.dirs, err = fetchChildren(c, d)
-	return err
+	if err != nil {
+		return err
+	}
+	return LoadDirSizes(c, append([]*DirDoc{d}, d.dirs...))
+}
+
+// FetchFilesPage is like FetchFiles, but it fetches at most limit children,
+// from the cursor of a previous page. It returns the cursor of the next
+// page, empty for the last one, and the total number of children.
+func (d *DirDoc) FetchFilesPage(c *Context, limit int, cursor string) (next string, total int, err error) {
+	sel := mango.Equal("folder_id", d.ID())
+	total, err = couchdb.CountDocs(c.ctx, c.db, FsDocType, sel)
+	if err != nil {
+		return
+	}
+	req := &couchdb.FindRequest{Selector: sel, Limit: limit, Bookmark: cursor}
+	var docs []*dirOrFile
+	res, err := couchdb.FindDocsRaw(c.ctx, c.db, FsDocType, req, &docs)
+	if err != nil {
+		return
+	}
+	d.files, d.dirs, d.count = nil, nil, total
+	for _, doc := range docs {
+		typ, dir, file := doc.refine()
+		switch typ {
+		case FileType:
+			file.parent = d
+			d.files = append(d.files, file)
+		case DirType:
+			dir.parent = d
+			d.dirs = append(d.dirs, dir)
+		}
+	}
+	if len(docs) == limit {
+		next = res.Bookmark
+	}
+	err = LoadDirSizes(c, append([]*DirDoc{d}, d.dirs...))
+	return
 }
 
 // NewDirDoc is the DirDoc constructor. The given name is validated.
@@ -189,19 +254,29 @@ func NewDirDoc(name, folderID string, tags []string, parent *DirDoc) (doc *DirDo
 }
 
 // GetDirDoc is used to fetch directory document information
-// form the database.
+// form the database. The concurrent fetches of the same directory share a
+// single request to CouchDB, and each caller gets its own copy. The shared
+// request is not canceled with the context of the caller that has made it,
+// as the other callers wait for it.
 func GetDirDoc(c *Context, fileID string, withChildren bool) (*DirDoc, error) {
-	doc := &DirDoc{}
-	err := couchdb.GetDoc(c.db, FsDocType, fileID, doc)
-	if couchdb.IsNotFoundError(err) {
-		err = ErrParentDoesNotExist
-	}
+	v, err := dirFlights.do(c.db+"/id/"+fileID, func() (interface{}, error) {
+		doc := &DirDoc{}
+		err := couchdb.GetDoc(context.Background(), c.db, FsDocType, fileID, doc)
+		if couchdb.IsNotFoundError(err) {
+			err = ErrParentDoesNotExist
+		}
+		if err != nil {
+			return nil, err
+		}
+		if doc.Type != DirType {
+			return nil, os.ErrNotExist
+		}
+		return doc, nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	if doc.Type != DirType {
-		return nil, os.ErrNotExist
-	}
+	doc := v.(*DirDoc).clone()
 	if withChildren {
 		err = doc.FetchFiles(c)
 	}
@@ -209,22 +284,26 @@ func GetDirDoc(c *Context, fileID string, withChildren bool) (*DirDoc, error) {
 }
 
 // GetDirDocFromPath is used to fetch directory document information from
-// the database from its path.
+// the database from its path. Like GetDirDoc, the concurrent fetches of the
+// same path share a single request.
 func GetDirDocFromPath(c *Context, name string, withChildren bool) (*DirDoc, error) {
-	var doc *DirDoc
-	var err error
-
-	var docs []*DirDoc
-	sel := mango.Equal("path", path.Clean(name))
-	req := &couchdb.FindRequest{Selector: sel, Limit: 1}
-	err = couchdb.FindDocs(c.db, FsDocType, req, &docs)
+	name = path.Clean(name)
+	v, err := dirFlights.do(c.db+"/path/"+name, func() (interface{}, error) {
+		var docs []*DirDoc
+		sel := mango.Equal("path", name)
+		req := &couchdb.FindRequest{Selector: sel, Limit: 1}
+		if err := couchdb.FindDocs(context.Background(), c.db, FsDocType, req, &docs); err != nil {
+			return nil, err
+		}
+		if len(docs) == 0 {
+			return nil, os.ErrNotExist
+		}
+		return docs[0], nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	if len(docs) == 0 {
-		return nil, os.ErrNotExist
-	}
-	doc = docs[0]
+	doc := v.(*DirDoc).clone()
 
 	if withChildren {
 		err = doc.FetchFiles(c)
@@ -250,16 +329,12 @@ func CreateDirectory(c *Context, doc *DirDoc) (err error) {
 		}
 	}()
 
-	return couchdb.CreateDoc(c.db, doc)
+	return couchdb.CreateDoc(c.ctx, c.db, doc)
 }
 
 // CreateRootDirectory creates the root folder for this context
 func CreateRootDirectory(c *Context) (err error) {
-	root := &DirDoc{
-		Type:     DirType,
-		ObjID:    RootFolderID,
-		Fullpath: "/",
-	}
+	root := newRootDirDoc()
 	err = c.fs.MkdirAll(root.Fullpath, 0755)
 	if err != nil {
 		return err
@@ -271,7 +346,33 @@ func CreateRootDirectory(c *Context) (err error) {
 		}
 	}()
 
-	return couchdb.CreateNamedDocWithDB(c.db, root)
+	return couchdb.CreateNamedDocWithDB(c.ctx, c.db, root)
+}
+
+// CreateBaseDirectories creates the root and trash folders for this
+// context, with a single request to CouchDB
+func CreateBaseDirectories(c *Context) (err error) {
+	root := newRootDirDoc()
+	trash := newTrashDirDoc()
+	if err = c.fs.MkdirAll(trash.Fullpath, 0755); err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			c.fs.Remove(trash.Fullpath)
+		}
+	}()
+
+	return couchdb.BulkDocs(c.ctx, c.db, FsDocType, []couchdb.Doc{root, trash})
+}
+
+func newRootDirDoc() *DirDoc {
+	return &DirDoc{
+		Type:     DirType,
+		ObjID:    RootFolderID,
+		Fullpath: "/",
+	}
 }
 
 // ModifyDirMetadata modify the metadata associated to a directory. It
@@ -309,9 +410,14 @@ func ModifyDirMetadata(c *Context, olddoc *DirDoc, patch *DocPatch) (newdoc *Dir
 	newdoc.SetRev(olddoc.Rev())
 	newdoc.CreatedAt = cdate
 	newdoc.UpdatedAt = *patch.UpdatedAt
+	newdoc.TrashedAt = olddoc.TrashedAt
+	if patch.TrashedAt != nil {
+		newdoc.TrashedAt = patch.TrashedAt
+	}
 	newdoc.parent = parent
 	newdoc.files = olddoc.files
 	newdoc.dirs = olddoc.dirs
+	newdoc.count = olddoc.count
 
 	oldpath, err := olddoc.Path(c)
 	if err != nil {
@@ -323,74 +429,85 @@ func ModifyDirMetadata(c *Context, olddoc *DirDoc, patch *DocPatch) (newdoc *Dir
 	}
 
 	if oldpath != newpath {
-		err = safeRenameDirectory(c, oldpath, newpath)
-		if err != nil {
-			return
-		}
-		err = bulkUpdateDocsPath(c, oldpath, newpath)
-		if err != nil {
-			return
-		}
+		err = moveDirectory(c, newdoc, oldpath, newpath)
+	} else {
+		err = couchdb.UpdateDoc(c.ctx, c.db, newdoc)
+	}
+	if err != nil {
+		return
 	}
 
-	err = couchdb.UpdateDoc(c.db, newdoc)
+	if _, err = DirSize(c, newdoc); err != nil {
+		return
+	}
+	err = moveDirSizes(c, olddoc.FolderID, newdoc.FolderID, newdoc.Size)
 	return
 }
 
-// @TODO remove this method and use couchdb bulk updates instead
+// pathUpdatePageSize is the number of directories updated by each bulk
+// request when a directory is moved
+const pathUpdatePageSize = 100
+
+// bulkUpdateDocsPath rewrites the path of all the sub-directories of
+// oldpath to put them under newpath
 func bulkUpdateDocsPath(c *Context, oldpath, newpath string) error {
-	var children []*DirDoc
 	sel := mango.StartWith("path", oldpath+"/")
-	req := &couchdb.FindRequest{Selector: sel}
-	err := couchdb.FindDocs(c.db, FsDocType, req, &children)
-	if err != nil || len(children) == 0 {
-		return err
-	}
-
-	errc := make(chan error)
+	for {
+		// the updated directories no longer match the selector, so the
+		// next page always starts at the beginning
+		var children []*DirDoc
+		req := &couchdb.FindRequest{Selector: sel, Limit: pathUpdatePageSize}
+		err := couchdb.FindDocs(c.ctx, c.db, FsDocType, req, &children)
+		if err != nil || len(children) == 0 {
+			return err
+		}
 
-	for _, child := range children {
-		go func(child *DirDoc) {
+		docs := make([]couchdb.Doc, len(children))
+		for i, child := range children {
 			if !strings.HasPrefix(child.Fullpath, oldpath+"/") {
-				errc <- fmt.Errorf("Child has wrong base directory")
-			} else {
-				child.Fullpath = path.Join(newpath, child.Fullpath[len(oldpath)+1:])
-				errc <- couchdb.UpdateDoc(c.db, child)
+				return fmt.Errorf("Child has wrong base directory")
 			}
-		}(child)
-	}
+			child.Fullpath = path.Join(newpath, child.Fullpath[len(oldpath)+1:])
+			docs[i] = child
+		}
 
-	for range children {
-		if e := <-errc; e != nil {
-			err = e
+		if err = couchdb.BulkDocs(c.ctx, c.db, FsDocType, docs); err != nil {
+			return err
+		}
+		if len(children) < pathUpdatePageSize {
+			return nil
 		}
 	}
-
-	return err
 }
 
 func fetchChildren(c *Context, parent *DirDoc) (files []*FileDoc, dirs []*DirDoc, err error) {
-	var docs []*dirOrFile
 	sel := mango.Equal("folder_id", parent.ID())
-	req := &couchdb.FindRequest{Selector: sel, Limit: 10}
-	err = couchdb.FindDocs(c.db, FsDocType, req, &docs)
-	if err != nil {
-		return
-	}
+	req := &couchdb.FindRequest{Selector: sel, Limit: childrenPageSize}
+	for {
+		var docs []*dirOrFile
+		var res *couchdb.FindResponse
+		res, err = couchdb.FindDocsRaw(c.ctx, c.db, FsDocType, req, &docs)
+		if err != nil {
+			return
+		}
 
-	for _, doc := range docs {
-		typ, dir, file := doc.refine()
-		switch typ {
-		case FileType:
-			file.parent = parent
-			files = append(files, file)
-		case DirType:
-			dir.parent = parent
-			dirs = append(dirs, dir)
+		for _, doc := range docs {
+			typ, dir, file := doc.refine()
+			switch typ {
+			case FileType:
+				file.parent = parent
+				files = append(files, file)
+			case DirType:
+				dir.parent = parent
+				dirs = append(dirs, dir)
+			}
 		}
-	}
 
-	return
+		if len(docs) < childrenPageSize {
+			return
+		}
+		req.Bookmark = res.Bookmark
+	}
 }
 
 func safeRenameDirectory(c *Context, oldpath, newpath string) error {
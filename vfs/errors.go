@@ -20,4 +20,10 @@ var (
 	// ErrContentLengthMismatch is used when the content-length does not
 	// match the calculated one
 	ErrContentLengthMismatch = errors.New("Content length does not match")
+	// ErrInfectedFile is used when the antivirus has found a threat in
+	// the content of a file
+	ErrInfectedFile = errors.New("File is infected by a virus")
+	// ErrFileInTrash is used when trying to trash a file or directory
+	// that is already in the trash
+	ErrFileInTrash = errors.New("File or directory is already in the trash")
 )
@@ -6,6 +6,8 @@ import (
 	"encoding/base64"
 	"fmt"
 	"hash"
+	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path"
@@ -14,6 +16,7 @@ import (
 
 	"github.com/dcasier/cozy-stack/couchdb"
 	"github.com/dcasier/cozy-stack/couchdb/mango"
+	"github.com/dcasier/cozy-stack/logger"
 	"github.com/dcasier/cozy-stack/web/jsonapi"
 	"github.com/spf13/afero"
 )
@@ -43,6 +46,14 @@ type FileDoc struct {
 	Executable bool     `json:"executable"`
 	Tags       []string `json:"tags"`
 
+	// Result of the antivirus scan, if any
+	Antivirus *AntivirusStatus `json:"antivirus,omitempty"`
+	// Date of the move to the trash, if the file has been trashed
+	TrashedAt *time.Time `json:"trashed_at,omitempty"`
+	// Documents of other doctypes that reference the file, like the albums
+	// of a photo
+	ReferencedBy []jsonapi.ResourceIdentifier `json:"referenced_by,omitempty"`
+
 	parent *DirDoc
 }
 
@@ -109,9 +120,13 @@ func (f *FileDoc) Parent(c *Context) (*DirDoc, error) {
 	return parent, nil
 }
 
-// Relationships is used to generate the parent relationship in JSON-API format
-// (part of the jsonapi.Object interface)
+// Relationships is used to generate the parent and referenced_by
+// relationships in JSON-API format (part of the jsonapi.Object interface)
 func (f *FileDoc) Relationships() jsonapi.RelationshipMap {
+	refs := f.ReferencedBy
+	if refs == nil {
+		refs = []jsonapi.ResourceIdentifier{}
+	}
 	return jsonapi.RelationshipMap{
 		"parent": jsonapi.Relationship{
 			Links: &jsonapi.LinksList{
@@ -122,6 +137,12 @@ func (f *FileDoc) Relationships() jsonapi.RelationshipMap {
 				Type: FsDocType,
 			},
 		},
+		"referenced_by": jsonapi.Relationship{
+			Links: &jsonapi.LinksList{
+				Self: "/files/" + f.ObjID + "/relationships/referenced_by",
+			},
+			Data: refs,
+		},
 	}
 }
 
@@ -165,7 +186,7 @@ func NewFileDoc(name, folderID string, size int64, md5Sum []byte, mime, class st
 // database.
 func GetFileDoc(c *Context, fileID string) (*FileDoc, error) {
 	doc := &FileDoc{}
-	err := couchdb.GetDoc(c.db, FsDocType, fileID, doc)
+	err := couchdb.GetDoc(c.ctx, c.db, FsDocType, fileID, doc)
 	if err != nil {
 		return nil, err
 	}
@@ -200,7 +221,7 @@ func GetFileDocFromPath(c *Context, name string) (*FileDoc, error) {
 		Selector: selector,
 		Limit:    1,
 	}
-	err = couchdb.FindDocs(c.db, FsDocType, req, &docs)
+	err = couchdb.FindDocs(c.ctx, c.db, FsDocType, req, &docs)
 	if err != nil {
 		return nil, err
 	}
@@ -219,18 +240,27 @@ func GetFileDocFromPath(c *Context, name string) (*FileDoc, error) {
 //
 // It uses internally http.ServeContent and benefits from it by
 // offering support to Range, If-Modified-Since and If-None-Match
-// requests. It uses the revision of the file as the Etag value for
-// non-ranged requests
+// requests. It uses the md5 checksum of the content as the Etag value.
 //
 // The content disposition is inlined.
+//
+// The files put in quarantine by the antivirus are not served.
 func ServeFileContent(c *Context, doc *FileDoc, disposition string, req *http.Request, w http.ResponseWriter) (err error) {
+	if doc.Antivirus.Infected() {
+		return ErrInfectedFile
+	}
+
 	header := w.Header()
 	header.Set("Content-Type", doc.Mime)
-	header.Set("Content-Disposition", fmt.Sprintf("%s; filename=%s", disposition, doc.Name))
+	header.Set("Content-Disposition", ContentDisposition(disposition, doc.Name))
 
-	if header.Get("Range") == "" {
+	// The ETag is the md5 checksum of the content. It is quoted, as
+	// http.ServeContent expects it for handling the If-None-Match and
+	// If-Range requests. Without checksum, an empty ETag would match the
+	// content of any other file without checksum.
+	if len(doc.MD5Sum) > 0 {
 		eTag := base64.StdEncoding.EncodeToString(doc.MD5Sum)
-		header.Set("Etag", eTag)
+		header.Set("Etag", fmt.Sprintf(`"%s"`, eTag))
 	}
 
 	name, err := doc.Path(c)
@@ -248,6 +278,16 @@ func ServeFileContent(c *Context, doc *FileDoc, disposition string, req *http.Re
 	return
 }
 
+// ContentDisposition returns the value of the Content-Disposition header
+// for a file with the given name, quoted or encoded when it has spaces or
+// other special characters
+func ContentDisposition(disposition, filename string) string {
+	if value := mime.FormatMediaType(disposition, map[string]string{"filename": filename}); value != "" {
+		return value
+	}
+	return disposition
+}
+
 // FileCreation represents a file open for writing. It is used to
 // create of file or to modify the content of a file.
 //
@@ -263,6 +303,9 @@ type FileCreation struct {
 	tmppath   string    // temporary file path in case of modifying an existing file
 	checkHash bool      // whether or not we need the assert the hash is good
 	hash      hash.Hash // hash we build up along the file
+
+	scan  *io.PipeWriter     // writer feeding the antivirus, if any
+	scanc <-chan *scanResult // result of the antivirus scan
 }
 
 // CreateFile is used to create file or modify an existing file
@@ -294,6 +337,7 @@ func CreateFile(c *Context, newdoc, olddoc *FileDoc) (*FileCreation, error) {
 		newdoc.SetID(olddoc.ID())
 		newdoc.SetRev(olddoc.Rev())
 		newdoc.CreatedAt = olddoc.CreatedAt
+		newdoc.ReferencedBy = olddoc.ReferencedBy
 	} else {
 		newdoc.CreatedAt = now
 	}
@@ -307,6 +351,12 @@ func CreateFile(c *Context, newdoc, olddoc *FileDoc) (*FileCreation, error) {
 
 	hash := md5.New() // #nosec
 
+	var scan *io.PipeWriter
+	var scanc <-chan *scanResult
+	if scanner != nil {
+		scan, scanc = startScan(scanner, scanFailOpen)
+	}
+
 	return &FileCreation{
 		c: c,
 		f: f,
@@ -319,6 +369,9 @@ func CreateFile(c *Context, newdoc, olddoc *FileDoc) (*FileCreation, error) {
 
 		checkHash: newdoc.MD5Sum != nil,
 		hash:      hash,
+
+		scan:  scan,
+		scanc: scanc,
 	}, nil
 }
 
@@ -332,6 +385,13 @@ func (fc *FileCreation) Write(p []byte) (n int, err error) {
 	fc.w += int64(n)
 
 	_, err = fc.hash.Write(p)
+	if err != nil {
+		return
+	}
+
+	if fc.scan != nil {
+		_, err = fc.scan.Write(p)
+	}
 	return
 }
 
@@ -348,6 +408,13 @@ func (fc *FileCreation) Close() error {
 	}()
 
 	err = fc.f.Close()
+
+	var scanRes *scanResult
+	if fc.scan != nil {
+		fc.scan.Close()
+		scanRes = <-fc.scanc
+	}
+
 	if err != nil {
 		return err
 	}
@@ -373,10 +440,29 @@ func (fc *FileCreation) Close() error {
 		return err
 	}
 
+	if scanRes != nil {
+		if scanRes.err != nil {
+			if !scanFailOpen {
+				err = scanRes.err
+				return err
+			}
+			logger.Errorf("vfs", "cannot scan %s, it is accepted unscanned: %v", newdoc.Name, scanRes.err)
+			scanRes.status = &AntivirusStatus{Status: ScanUnscanned, ScannedAt: time.Now()}
+		}
+		if scanRes.status.Infected() && scanAction == AntivirusReject {
+			err = ErrInfectedFile
+			return err
+		}
+		newdoc.Antivirus = scanRes.status
+	}
+
 	if olddoc != nil {
-		err = couchdb.UpdateDoc(c.db, newdoc)
+		// The document is updated with the revision of olddoc: when the
+		// file is modified concurrently, only one of the updates succeeds,
+		// and the others get a conflict and remove their content.
+		err = couchdb.UpdateDoc(c.ctx, c.db, newdoc)
 	} else {
-		err = couchdb.CreateDoc(c.db, newdoc)
+		err = couchdb.CreateDoc(c.ctx, c.db, newdoc)
 	}
 
 	if err != nil {
@@ -385,9 +471,26 @@ func (fc *FileCreation) Close() error {
 
 	if fc.tmppath != fc.path {
 		err = c.fs.Rename(fc.tmppath, fc.path)
+		if err != nil {
+			return err
+		}
 	}
 
-	return err
+	// The file is committed: a failure on the aggregates must not remove
+	// it. They can be repaired later with RecomputeDirSize.
+	if olddoc != nil {
+		err = moveDirSizes(c, olddoc.FolderID, newdoc.FolderID, olddoc.Size)
+		if err == nil {
+			err = updateDirSizes(c, newdoc.FolderID, newdoc.Size-olddoc.Size)
+		}
+	} else {
+		err = updateDirSizes(c, newdoc.FolderID, newdoc.Size)
+	}
+	if err != nil {
+		logger.Errorf("vfs", "cannot update the sizes of the parents of %s: %v", newdoc.ID(), err)
+	}
+
+	return nil
 }
 
 // ModifyFileMetadata modify the metadata associated to a file. It can
@@ -435,6 +538,12 @@ func ModifyFileMetadata(c *Context, olddoc *FileDoc, patch *DocPatch) (newdoc *F
 	newdoc.SetRev(olddoc.Rev())
 	newdoc.CreatedAt = cdate
 	newdoc.UpdatedAt = *patch.UpdatedAt
+	newdoc.Antivirus = olddoc.Antivirus
+	newdoc.TrashedAt = olddoc.TrashedAt
+	if patch.TrashedAt != nil {
+		newdoc.TrashedAt = patch.TrashedAt
+	}
+	newdoc.ReferencedBy = olddoc.ReferencedBy
 	newdoc.parent = parent
 
 	oldpath, err := olddoc.Path(c)
@@ -460,7 +569,20 @@ func ModifyFileMetadata(c *Context, olddoc *FileDoc, patch *DocPatch) (newdoc *F
 		}
 	}
 
-	err = couchdb.UpdateDoc(c.db, newdoc)
+	err = couchdb.UpdateDoc(c.ctx, c.db, newdoc)
+	if err != nil {
+		// the document has not been updated (for example, its revision
+		// has changed in the meantime): revert the changes on the storage
+		if newdoc.Executable != olddoc.Executable {
+			c.fs.Chmod(newpath, getFileMode(olddoc.Executable))
+		}
+		if newpath != oldpath {
+			c.fs.Rename(newpath, oldpath)
+		}
+		return
+	}
+
+	err = moveDirSizes(c, olddoc.FolderID, newdoc.FolderID, newdoc.Size)
 	return
 }
 
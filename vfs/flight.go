@@ -0,0 +1,61 @@
+package vfs
+
+import "sync"
+
+// flightCall is a fetch in progress, or done, for a key of a flightGroup
+type flightCall struct {
+	wg   sync.WaitGroup
+	val  interface{}
+	err  error
+	dups int
+}
+
+// flightGroup deduplicates the concurrent fetches of the same document:
+// the first caller for a key does the fetch, and the callers that come
+// while it is in progress wait for it and share its result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// do calls fn for the key, or waits for the call in progress for the same
+// key. The value is shared by all the callers: they must not modify it.
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		call.dups++
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.val, call.err = fn()
+	call.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return call.val, call.err
+}
+
+// waiting returns the number of callers waiting for the call in progress
+// for the key
+func (g *flightGroup) waiting(key string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call, ok := g.calls[key]; ok {
+		return call.dups
+	}
+	return 0
+}
+
+// dirFlights are the fetches of the directories by GetDirDoc and
+// GetDirDocFromPath
+var dirFlights flightGroup
@@ -0,0 +1,208 @@
+package vfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/logger"
+)
+
+// MoveJournalDocType is the doctype of the journal of the moves of
+// directories
+const MoveJournalDocType = "io.cozy.files.moves"
+
+const (
+	// movePrepared is the phase of a move that has been journaled, but
+	// not yet done on the storage
+	movePrepared = "prepared"
+	// moveRenamed is the phase of a move where the directory has been
+	// renamed on the storage, but the documents may not be up-to-date
+	moveRenamed = "renamed"
+)
+
+// MoveGracePeriod is the age under which a journal entry is not recovered,
+// as its move may still be in progress, in another process of the stack
+// for example. A move of directory is expected to finish well before it.
+const MoveGracePeriod = 5 * time.Minute
+
+// moveJournal is an entry in the journal of the moves of directories.
+// It is written before the directory is renamed on the storage and
+// deleted when all the documents of the subtree have been updated.
+type moveJournal struct {
+	JID  string `json:"_id,omitempty"`
+	JRev string `json:"_rev,omitempty"`
+
+	Phase     string    `json:"phase"`
+	OldPath   string    `json:"old_path"`
+	NewPath   string    `json:"new_path"`
+	Doc       *DirDoc   `json:"doc"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ID returns the journal entry identifier - see couchdb.Doc interface
+func (j *moveJournal) ID() string { return j.JID }
+
+// Rev returns the journal entry revision - see couchdb.Doc interface
+func (j *moveJournal) Rev() string { return j.JRev }
+
+// DocType returns the journal doctype - see couchdb.Doc interface
+func (j *moveJournal) DocType() string { return MoveJournalDocType }
+
+// SetID changes the journal entry identifier - see couchdb.Doc interface
+func (j *moveJournal) SetID(id string) { j.JID = id }
+
+// SetRev changes the journal entry revision - see couchdb.Doc interface
+func (j *moveJournal) SetRev(rev string) { j.JRev = rev }
+
+// moveDirectory moves the directory from oldpath to newpath on the
+// storage, and updates the documents of its subtree and its own
+// document. It can't be done atomically, so the move is journaled: if
+// the stack crashes in the middle of it, RecoverMoves will finish or
+// revert it.
+func moveDirectory(c *Context, newdoc *DirDoc, oldpath, newpath string) error {
+	j := &moveJournal{
+		Phase:     movePrepared,
+		OldPath:   oldpath,
+		NewPath:   newpath,
+		Doc:       newdoc,
+		CreatedAt: time.Now(),
+	}
+	if err := couchdb.CreateDoc(c.ctx, c.db, j); err != nil {
+		return err
+	}
+
+	err := safeRenameDirectory(c, oldpath, newpath)
+	if err != nil {
+		couchdb.DeleteDoc(c.ctx, c.db, j)
+		return err
+	}
+
+	j.Phase = moveRenamed
+	if err = couchdb.UpdateDoc(c.ctx, c.db, j); err == nil {
+		if err = bulkUpdateDocsPath(c, oldpath, newpath); err == nil {
+			err = couchdb.UpdateDoc(c.ctx, c.db, newdoc)
+		}
+	}
+
+	if err != nil {
+		// the document has not been updated (for example, its revision
+		// has changed in the meantime): revert the move of the subtree.
+		// If it fails, the journal is kept for RecoverMoves.
+		if rerr := c.fs.Rename(newpath, oldpath); rerr != nil {
+			return err
+		}
+		if rerr := bulkUpdateDocsPath(c, newpath, oldpath); rerr != nil {
+			return err
+		}
+	}
+
+	if derr := couchdb.DeleteDoc(c.ctx, c.db, j); err == nil {
+		err = derr
+	}
+	return err
+}
+
+// RecoverMoves finishes or reverts the moves of directories that have
+// been interrupted, by a crash for example. A move that was only prepared
+// is reverted, and the storage is used as the reference for a move that
+// was renamed: if the directory has been renamed, the documents are
+// updated to the new path, else they are reverted to the old one.
+//
+// The journal entries younger than MoveGracePeriod are skipped, as their
+// moves may still be in progress. A move that can't be recovered is
+// logged and skipped: its journal is kept for the next try, and the other
+// moves are still recovered.
+func RecoverMoves(c *Context) error {
+	var journals []*moveJournal
+	err := couchdb.ForeachDocs(c.ctx, c.db, MoveJournalDocType, func(doc json.RawMessage) error {
+		var j moveJournal
+		if err := json.Unmarshal(doc, &j); err != nil {
+			return err
+		}
+		journals = append(journals, &j)
+		return nil
+	})
+	if couchdb.IsNoDatabaseError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, j := range journals {
+		if time.Since(j.CreatedAt) < MoveGracePeriod {
+			continue
+		}
+		if err := recoverMove(c, j); err != nil {
+			logger.Errorf("vfs", "cannot recover the move of %s to %s in %s: %v",
+				j.OldPath, j.NewPath, c.db, err)
+		}
+	}
+	return nil
+}
+
+func recoverMove(c *Context, j *moveJournal) error {
+	_, errOld := c.fs.Stat(j.OldPath)
+	_, errNew := c.fs.Stat(j.NewPath)
+
+	switch j.Phase {
+	case movePrepared:
+		// the documents have not been touched, only the storage may have
+		// to be reverted
+		switch {
+		case errOld == nil && os.IsNotExist(errNew):
+		case os.IsNotExist(errOld) && errNew == nil:
+			if err := c.fs.Rename(j.NewPath, j.OldPath); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Cannot revert the move of %s to %s", j.OldPath, j.NewPath)
+		}
+	case moveRenamed:
+		if err := recoverRenamedMove(c, j, errOld, errNew); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown phase %q for the move of %s to %s", j.Phase, j.OldPath, j.NewPath)
+	}
+
+	return couchdb.DeleteDoc(c.ctx, c.db, j)
+}
+
+func recoverRenamedMove(c *Context, j *moveJournal, errOld, errNew error) error {
+	switch {
+	case os.IsNotExist(errOld) && errNew == nil:
+		if err := bulkUpdateDocsPath(c, j.OldPath, j.NewPath); err != nil {
+			return err
+		}
+		current, err := GetDirDoc(c, j.Doc.ID(), false)
+		if err != nil {
+			return err
+		}
+		if current.Fullpath != j.NewPath {
+			j.Doc.SetRev(current.Rev())
+			if err = couchdb.UpdateDoc(c.ctx, c.db, j.Doc); err != nil {
+				return err
+			}
+			if _, err = DirSize(c, j.Doc); err != nil {
+				return err
+			}
+			if err = moveDirSizes(c, current.FolderID, j.Doc.FolderID, j.Doc.Size); err != nil {
+				return err
+			}
+		}
+	case errOld == nil && os.IsNotExist(errNew):
+		// the move was being reverted
+		if err := bulkUpdateDocsPath(c, j.NewPath, j.OldPath); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Cannot recover the move of %s to %s", j.OldPath, j.NewPath)
+	}
+	return nil
+}
+
+var _ couchdb.Doc = &moveJournal{}
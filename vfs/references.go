@@ -0,0 +1,47 @@
+package vfs
+
+import (
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+)
+
+// AddReferencedBy adds the given documents to the documents that reference
+// the file. The references already known are ignored.
+func AddReferencedBy(c *Context, doc *FileDoc, refs []jsonapi.ResourceIdentifier) error {
+	changed := false
+	for _, ref := range refs {
+		if indexOfRef(doc.ReferencedBy, ref) < 0 {
+			doc.ReferencedBy = append(doc.ReferencedBy, ref)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return couchdb.UpdateDoc(c.ctx, c.db, doc)
+}
+
+// RemoveReferencedBy removes the given documents from the documents that
+// reference the file. The unknown references are ignored.
+func RemoveReferencedBy(c *Context, doc *FileDoc, refs []jsonapi.ResourceIdentifier) error {
+	changed := false
+	for _, ref := range refs {
+		if i := indexOfRef(doc.ReferencedBy, ref); i >= 0 {
+			doc.ReferencedBy = append(doc.ReferencedBy[:i], doc.ReferencedBy[i+1:]...)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return couchdb.UpdateDoc(c.ctx, c.db, doc)
+}
+
+func indexOfRef(refs []jsonapi.ResourceIdentifier, ref jsonapi.ResourceIdentifier) int {
+	for i, r := range refs {
+		if r == ref {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,188 @@
+package vfs
+
+import (
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/couchdb/mango"
+)
+
+// DirSizeDocType is the doctype of the aggregates of the sizes of the
+// directories. They are kept out of the documents of the directories, so
+// that their updates don't change the revisions of the directories, that
+// the clients use for If-Match.
+const DirSizeDocType = "io.cozy.files.sizes"
+
+// maxSizeUpdateRetries is the number of times the update of the size of
+// a directory is retried when there is a conflict with another update
+const maxSizeUpdateRetries = 5
+
+// childrenPageSize is the number of children fetched at once when the
+// size of a directory is computed by walking its tree
+const childrenPageSize = 100
+
+// dirSize is the aggregate of the size of a directory. It has the same
+// identifier as the directory.
+type dirSize struct {
+	DocID  string `json:"_id"`
+	DocRev string `json:"_rev,omitempty"`
+	Size   int64  `json:"size"`
+}
+
+func (s *dirSize) ID() string        { return s.DocID }
+func (s *dirSize) Rev() string       { return s.DocRev }
+func (s *dirSize) DocType() string   { return DirSizeDocType }
+func (s *dirSize) SetID(id string)   { s.DocID = id }
+func (s *dirSize) SetRev(rev string) { s.DocRev = rev }
+
+// getDirSize returns the aggregate of the directory, with a zero size if
+// it has not been saved yet
+func getDirSize(c *Context, dirID string) (*dirSize, error) {
+	s := &dirSize{}
+	err := couchdb.GetDoc(c.ctx, c.db, DirSizeDocType, dirID, s)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return &dirSize{DocID: dirID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// saveDirSize creates or updates the aggregate of a directory
+func saveDirSize(c *Context, s *dirSize) error {
+	if s.DocRev == "" {
+		return couchdb.CreateNamedDocWithDB(c.ctx, c.db, s)
+	}
+	return couchdb.UpdateDoc(c.ctx, c.db, s)
+}
+
+// deleteDirSize removes the aggregate of a destroyed directory
+func deleteDirSize(c *Context, dirID string) error {
+	s, err := getDirSize(c, dirID)
+	if err != nil || s.DocRev == "" {
+		return err
+	}
+	return couchdb.DeleteDoc(c.ctx, c.db, s)
+}
+
+// DirSize returns the size in bytes of all the files in the directory
+// and in its sub-directories, and sets it in dir.Size. It doesn't walk the
+// tree, but uses the aggregate that is kept up-to-date each time a file is
+// created, modified, moved or destroyed.
+func DirSize(c *Context, dir *DirDoc) (int64, error) {
+	s, err := getDirSize(c, dir.ID())
+	if err != nil {
+		return 0, err
+	}
+	dir.Size = s.Size
+	return s.Size, nil
+}
+
+// LoadDirSizes sets the sizes of the directories from their aggregates,
+// fetched at once
+func LoadDirSizes(c *Context, dirs []*DirDoc) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+	ids := make([]interface{}, len(dirs))
+	for i, dir := range dirs {
+		ids[i] = dir.ID()
+	}
+	var sizes []*dirSize
+	req := &couchdb.FindRequest{Selector: mango.In("_id", ids...), Limit: len(dirs)}
+	err := couchdb.FindDocs(c.ctx, c.db, DirSizeDocType, req, &sizes)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return err
+	}
+	byID := make(map[string]int64, len(sizes))
+	for _, s := range sizes {
+		byID[s.DocID] = s.Size
+	}
+	for _, dir := range dirs {
+		dir.Size = byID[dir.ID()]
+	}
+	return nil
+}
+
+// RecomputeDirSize walks the tree of the directory to compute its size,
+// and saves the aggregates of the directory and of its sub-directories.
+// It can be used to repair the aggregates if they have drifted.
+func RecomputeDirSize(c *Context, dir *DirDoc) (int64, error) {
+	var size int64
+	sel := mango.Equal("folder_id", dir.ID())
+	for skip := 0; ; skip += childrenPageSize {
+		var docs []*dirOrFile
+		req := &couchdb.FindRequest{Selector: sel, Limit: childrenPageSize, Skip: skip}
+		if err := couchdb.FindDocs(c.ctx, c.db, FsDocType, req, &docs); err != nil {
+			return 0, err
+		}
+		for _, doc := range docs {
+			typ, child, file := doc.refine()
+			switch typ {
+			case DirType:
+				childSize, err := RecomputeDirSize(c, child)
+				if err != nil {
+					return 0, err
+				}
+				size += childSize
+			case FileType:
+				size += file.Size
+			}
+		}
+		if len(docs) < childrenPageSize {
+			break
+		}
+	}
+
+	s, err := getDirSize(c, dir.ID())
+	if err != nil {
+		return 0, err
+	}
+	s.Size = size
+	dir.Size = size
+	return size, saveDirSize(c, s)
+}
+
+// updateDirSizes adds delta to the size of the directory with the given
+// identifier and to the sizes of all its ancestors. Only their aggregates
+// are updated, not the documents of the directories.
+func updateDirSizes(c *Context, folderID string, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+
+	for folderID != "" {
+		for i := 0; ; i++ {
+			s, err := getDirSize(c, folderID)
+			if err != nil {
+				return err
+			}
+			s.Size += delta
+			err = saveDirSize(c, s)
+			if err == nil {
+				break
+			}
+			if !couchdb.IsConflictError(err) || i >= maxSizeUpdateRetries {
+				return err
+			}
+		}
+		dir, err := GetDirDoc(c, folderID, false)
+		if err != nil {
+			return err
+		}
+		folderID = dir.FolderID
+	}
+
+	return nil
+}
+
+// moveDirSizes moves size bytes from the aggregates of the ancestors of
+// oldFolderID to the ones of newFolderID.
+func moveDirSizes(c *Context, oldFolderID, newFolderID string, size int64) error {
+	if oldFolderID == newFolderID {
+		return nil
+	}
+	if err := updateDirSizes(c, oldFolderID, -size); err != nil {
+		return err
+	}
+	return updateDirSizes(c, newFolderID, size)
+}
@@ -0,0 +1,75 @@
+package vfs
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+)
+
+// WriteTar writes in tw the content of the given directory and of all its
+// sub-directories, under the prefix, like WriteZip. It is used to export
+// the files of an instance, with the other entries of its archive.
+//
+// The trash and the files put in quarantine by the antivirus are skipped.
+func WriteTar(c *Context, doc *DirDoc, tw *tar.Writer, prefix string) error {
+	files, dirs, err := fetchChildren(c, doc)
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:     prefix + "/",
+		Mode:     0755,
+		ModTime:  doc.UpdatedAt,
+		Typeflag: tar.TypeDir,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.Antivirus.Infected() {
+			continue
+		}
+		if err = writeTarFile(c, tw, file, path.Join(doc.Fullpath, file.Name), path.Join(prefix, file.Name)); err != nil {
+			return err
+		}
+	}
+
+	for _, child := range dirs {
+		if child.ID() == TrashFolderID {
+			continue
+		}
+		if err = WriteTar(c, child, tw, path.Join(prefix, child.Name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeTarFile(c *Context, tw *tar.Writer, doc *FileDoc, fullpath, name string) error {
+	content, err := c.fs.Open(fullpath)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	var mode int64 = 0644
+	if doc.Executable {
+		mode = 0755
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     mode,
+		Size:     doc.Size,
+		ModTime:  doc.UpdatedAt,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(tw, content, doc.Size)
+	return err
+}
@@ -0,0 +1,232 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/couchdb/mango"
+)
+
+// TrashFolderID is the identifier of the trash directory
+const TrashFolderID = "io.cozy.files.trashdir"
+
+// TrashDirName is the path of the trash directory
+const TrashDirName = "/.cozy_trash"
+
+// trashPageSize is the number of documents fetched at once when
+// listing the content of the trash
+const trashPageSize = 100
+
+// CreateTrashDirectory creates the trash folder for this context
+func CreateTrashDirectory(c *Context) (err error) {
+	trash := newTrashDirDoc()
+	err = c.fs.MkdirAll(trash.Fullpath, 0755)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			c.fs.Remove(trash.Fullpath)
+		}
+	}()
+
+	return couchdb.CreateNamedDocWithDB(c.ctx, c.db, trash)
+}
+
+func newTrashDirDoc() *DirDoc {
+	trash := &DirDoc{
+		Type:     DirType,
+		ObjID:    TrashFolderID,
+		Name:     TrashDirName[1:],
+		FolderID: RootFolderID,
+		Fullpath: TrashDirName,
+	}
+	trash.CreatedAt = time.Now()
+	trash.UpdatedAt = trash.CreatedAt
+	return trash
+}
+
+// ensureTrashDirectory creates the trash directory of the instances
+// created before its introduction
+func ensureTrashDirectory(c *Context) error {
+	_, err := GetDirDoc(c, TrashFolderID, false)
+	if err == ErrParentDoesNotExist {
+		err = CreateTrashDirectory(c)
+	}
+	return err
+}
+
+// trashedName returns the name to use in the trash when a file or
+// directory with the same name is already there
+func trashedName(name, id string) string {
+	return fmt.Sprintf("%s (%s)", name, id)
+}
+
+// TrashFile moves a file to the trash
+func TrashFile(c *Context, olddoc *FileDoc) (newdoc *FileDoc, err error) {
+	if olddoc.TrashedAt != nil {
+		return nil, ErrFileInTrash
+	}
+	if err = ensureTrashDirectory(c); err != nil {
+		return nil, err
+	}
+
+	trashID := TrashFolderID
+	trashedAt := time.Now()
+	newdoc, err = ModifyFileMetadata(c, olddoc, &DocPatch{FolderID: &trashID, TrashedAt: &trashedAt})
+	if os.IsExist(err) {
+		name := trashedName(olddoc.Name, olddoc.ID())
+		newdoc, err = ModifyFileMetadata(c, olddoc, &DocPatch{FolderID: &trashID, Name: &name, TrashedAt: &trashedAt})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
+// TrashDir moves a directory, and its subtree, to the trash
+func TrashDir(c *Context, olddoc *DirDoc) (newdoc *DirDoc, err error) {
+	if olddoc.ID() == RootFolderID || olddoc.ID() == TrashFolderID {
+		return nil, ErrForbiddenDocMove
+	}
+	if olddoc.TrashedAt != nil {
+		return nil, ErrFileInTrash
+	}
+	if err = ensureTrashDirectory(c); err != nil {
+		return nil, err
+	}
+
+	trashID := TrashFolderID
+	trashedAt := time.Now()
+	newdoc, err = ModifyDirMetadata(c, olddoc, &DocPatch{FolderID: &trashID, TrashedAt: &trashedAt})
+	if os.IsExist(err) {
+		name := trashedName(olddoc.Name, olddoc.ID())
+		newdoc, err = ModifyDirMetadata(c, olddoc, &DocPatch{FolderID: &trashID, Name: &name, TrashedAt: &trashedAt})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
+// DestroyFile removes a file from the storage and its document from
+// couchdb. It can't be undone.
+func DestroyFile(c *Context, doc *FileDoc) error {
+	name, err := doc.Path(c)
+	if err != nil {
+		return err
+	}
+	if err = c.fs.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = couchdb.DeleteDoc(c.ctx, c.db, doc); err != nil {
+		return err
+	}
+	return updateDirSizes(c, doc.FolderID, -doc.Size)
+}
+
+// DestroyDirAndContent removes a directory and all its content from the
+// storage and from couchdb. It can't be undone.
+func DestroyDirAndContent(c *Context, doc *DirDoc) error {
+	files, dirs, err := fetchChildren(c, doc)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = DestroyFile(c, file); err != nil {
+			return err
+		}
+	}
+	for _, dir := range dirs {
+		if err = DestroyDirAndContent(c, dir); err != nil {
+			return err
+		}
+	}
+
+	name, err := doc.Path(c)
+	if err != nil {
+		return err
+	}
+	if err = c.fs.RemoveAll(name); err != nil {
+		return err
+	}
+
+	// The size of the directory is the one of the files that couldn't be
+	// destroyed, if its aggregate has drifted
+	size, err := DirSize(c, doc)
+	if err != nil {
+		return err
+	}
+	if err = couchdb.DeleteDoc(c.ctx, c.db, doc); err != nil {
+		return err
+	}
+	if err = deleteDirSize(c, doc.ID()); err != nil {
+		return err
+	}
+	return updateDirSizes(c, doc.FolderID, -size)
+}
+
+// PurgeTrash permanently destroys the files and directories that have
+// been put in the trash before the given date.
+func PurgeTrash(c *Context, before time.Time) error {
+	return destroyTrashed(c, func(trashedAt *time.Time) bool {
+		return trashedAt != nil && trashedAt.Before(before)
+	})
+}
+
+// EmptyTrash permanently destroys all the files and directories in the
+// trash.
+func EmptyTrash(c *Context) error {
+	return destroyTrashed(c, func(trashedAt *time.Time) bool {
+		return true
+	})
+}
+
+func destroyTrashed(c *Context, expired func(trashedAt *time.Time) bool) error {
+	if err := ensureTrashDirectory(c); err != nil {
+		return err
+	}
+
+	trash := &DirDoc{ObjID: TrashFolderID, Fullpath: TrashDirName}
+
+	// The documents are listed before being destroyed, so that the
+	// pagination is not disturbed by the deletions.
+	var expiredDocs []*dirOrFile
+	sel := mango.Equal("folder_id", TrashFolderID)
+	for skip := 0; ; skip += trashPageSize {
+		var docs []*dirOrFile
+		req := &couchdb.FindRequest{Selector: sel, Limit: trashPageSize, Skip: skip}
+		if err := couchdb.FindDocs(c.ctx, c.db, FsDocType, req, &docs); err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if expired(doc.TrashedAt) {
+				expiredDocs = append(expiredDocs, doc)
+			}
+		}
+		if len(docs) < trashPageSize {
+			break
+		}
+	}
+
+	for _, doc := range expiredDocs {
+		var err error
+		typ, dir, file := doc.refine()
+		switch typ {
+		case DirType:
+			dir.parent = trash
+			err = DestroyDirAndContent(c, dir)
+		case FileType:
+			file.parent = trash
+			err = DestroyFile(c, file)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
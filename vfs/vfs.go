@@ -6,6 +6,7 @@
 package vfs
 
 import (
+	"context"
 	mimetype "mime"
 	"os"
 	"path"
@@ -13,6 +14,7 @@ import (
 	"time"
 
 	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/couchdb/mango"
 	"github.com/spf13/afero"
 )
 
@@ -28,6 +30,13 @@ const RootFolderID = "io.cozy.files.rootdir"
 // FsDocType is document type
 const FsDocType = "io.cozy.files"
 
+// Indexes is the list of the mango indexes used by the VFS. The selectors
+// on folder_id alone use the first one.
+var Indexes = []mango.IndexDefinitionRequest{
+	mango.IndexOnFields("folder_id", "name", "type"),
+	mango.IndexOnFields("path"),
+}
+
 const (
 	// DirType is the type attribute for directories
 	DirType = "directory"
@@ -43,6 +52,10 @@ type DocPatch struct {
 	Tags       *[]string  `json:"tags,omitempty"`
 	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
 	Executable *bool      `json:"executable,omitempty"`
+
+	// TrashedAt is set when the file or directory is moved to the trash.
+	// It can't be changed by the clients.
+	TrashedAt *time.Time `json:"-"`
 }
 
 // dirOrFile is a union struct of FileDoc and DirDoc. It is useful to
@@ -56,6 +69,8 @@ type dirOrFile struct {
 	Mime       string `json:"mime"`
 	Class      string `json:"class"`
 	Executable bool   `json:"executable"`
+
+	Antivirus *AntivirusStatus `json:"antivirus,omitempty"`
 }
 
 func (fd *dirOrFile) refine() (typ string, dir *DirDoc, file *FileDoc) {
@@ -78,6 +93,8 @@ func (fd *dirOrFile) refine() (typ string, dir *DirDoc, file *FileDoc) {
 			Class:      fd.Class,
 			Executable: fd.Executable,
 			Tags:       fd.Tags,
+			Antivirus:  fd.Antivirus,
+			TrashedAt:  fd.TrashedAt,
 		}
 	}
 	return
@@ -87,7 +104,7 @@ func (fd *dirOrFile) refine() (typ string, dir *DirDoc, file *FileDoc) {
 // without knowing in advance its type.
 func GetDirOrFileDoc(c *Context, fileID string, withChildren bool) (typ string, dirDoc *DirDoc, fileDoc *FileDoc, err error) {
 	dirOrFile := &dirOrFile{}
-	err = couchdb.GetDoc(c.db, FsDocType, fileID, dirOrFile)
+	err = couchdb.GetDoc(c.ctx, c.db, FsDocType, fileID, dirOrFile)
 	if err != nil {
 		return
 	}
@@ -124,15 +141,25 @@ func GetDirOrFileDocFromPath(c *Context, name string, withChildren bool) (typ st
 }
 
 // Context is used to convey the afero.Fs object along with the
-// CouchDb database prefix.
+// CouchDb database prefix, and the context.Context of the requests to
+// CouchDB.
 type Context struct {
-	fs afero.Fs
-	db string
+	fs  afero.Fs
+	db  string
+	ctx context.Context
 }
 
 // NewContext is the constructor function for Context
 func NewContext(fs afero.Fs, dbprefix string) *Context {
-	return &Context{fs, dbprefix}
+	return &Context{fs, dbprefix, context.Background()}
+}
+
+// WithContext returns a copy of the VFS context that uses ctx for its
+// requests to CouchDB, so that they are canceled with ctx.
+func (c *Context) WithContext(ctx context.Context) *Context {
+	c2 := *c
+	c2.ctx = ctx
+	return &c2
 }
 
 // Stat returns the FileInfo of the specified file or directory.
@@ -2,22 +2,40 @@ package vfs
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/couchdb/couchdbtest"
 	"github.com/dcasier/cozy-stack/couchdb/mango"
-	"github.com/sourcegraph/checkup"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
 
-const CouchDBURL = "http://localhost:5984/"
-
 const TestPrefix = "dev/"
 
+// revGeneration returns the number of the revision of a document
+func revGeneration(rev string) int {
+	n, _ := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	return n
+}
+
 var vfsC *Context
 
 func TestGetFileDocFromPathAtRoot(t *testing.T) {
@@ -70,18 +88,678 @@ func TestGetFileDocFromPath(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestServeFileContent(t *testing.T) {
+	doc, err := createFileWithContent("served", "hello !")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	req := httptest.NewRequest("GET", "/served", nil)
+	w := httptest.NewRecorder()
+	assert.NoError(t, ServeFileContent(vfsC, doc, "inline", req, w))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello !", w.Body.String())
+	etag := w.Header().Get("Etag")
+	assert.Equal(t, `"MHm6zuV/0aAEzvWpObXh4A=="`, etag)
+
+	req = httptest.NewRequest("GET", "/served", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	assert.NoError(t, ServeFileContent(vfsC, doc, "inline", req, w))
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	// without checksum, there is no ETag that could match another file
+	doc.MD5Sum = nil
+	req = httptest.NewRequest("GET", "/served", nil)
+	req.Header.Set("If-None-Match", `""`)
+	w = httptest.NewRecorder()
+	assert.NoError(t, ServeFileContent(vfsC, doc, "inline", req, w))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Etag"))
+}
+
+type fakeScanner struct{}
+
+func (s *fakeScanner) Scan(r io.Reader) (*AntivirusStatus, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	status := &AntivirusStatus{Status: ScanClean, ScannedAt: time.Now()}
+	if strings.Contains(string(content), "EICAR") {
+		status.Status = ScanInfected
+		status.Signature = "Eicar-Test-Signature"
+	}
+	return status, nil
+}
+
+func createFileWithContent(name, content string) (*FileDoc, error) {
+	return createFileInDir(name, "", content)
+}
+
+func createFileInDir(name, folderID, content string) (*FileDoc, error) {
+	doc, err := NewFileDoc(name, folderID, -1, nil, "foo/bar", "foo", false, []string{})
+	if err != nil {
+		return nil, err
+	}
+	file, err := CreateFile(vfsC, doc, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(file, strings.NewReader(content)); err != nil {
+		return nil, err
+	}
+	return doc, file.Close()
+}
+
+func TestAntivirusReject(t *testing.T) {
+	UseScanner(&fakeScanner{}, AntivirusReject, false)
+	defer UseScanner(nil, "", false)
+
+	doc, err := createFileWithContent("cleanfile", "hello !")
+	if assert.NoError(t, err) {
+		assert.Equal(t, ScanClean, doc.Antivirus.Status)
+	}
+
+	_, err = createFileWithContent("virusfile", "X5O!P%@AP EICAR")
+	assert.Equal(t, ErrInfectedFile, err)
+
+	_, err = GetFileDocFromPath(vfsC, "/virusfile")
+	assert.Error(t, err)
+}
+
+func TestAntivirusQuarantine(t *testing.T) {
+	UseScanner(&fakeScanner{}, AntivirusQuarantine, false)
+	defer UseScanner(nil, "", false)
+
+	doc, err := createFileWithContent("quarantinedfile", "X5O!P%@AP EICAR")
+	if assert.NoError(t, err) {
+		assert.True(t, doc.Antivirus.Infected())
+		assert.Equal(t, "Eicar-Test-Signature", doc.Antivirus.Signature)
+	}
+
+	fetched, err := GetFileDocFromPath(vfsC, "/quarantinedfile")
+	if assert.NoError(t, err) {
+		assert.True(t, fetched.Antivirus.Infected())
+	}
+}
+
+func TestClamdScanner(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		cmd := make([]byte, len("zINSTREAM\x00"))
+		io.ReadFull(conn, cmd)
+		var content []byte
+		size := make([]byte, 4)
+		for {
+			io.ReadFull(conn, size)
+			n := binary.BigEndian.Uint32(size)
+			if n == 0 {
+				break
+			}
+			chunk := make([]byte, n)
+			io.ReadFull(conn, chunk)
+			content = append(content, chunk...)
+		}
+		if strings.Contains(string(content), "EICAR") {
+			conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		} else {
+			conn.Write([]byte("stream: OK\x00"))
+		}
+	}()
+
+	s, err := NewClamdScanner("tcp://" + l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	status, err := s.Scan(strings.NewReader("X5O!P%@AP EICAR"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, ScanInfected, status.Status)
+		assert.Equal(t, "Eicar-Test-Signature", status.Signature)
+	}
+
+	_, err = NewClamdScanner("http://localhost:3310")
+	assert.Error(t, err)
+}
+
+func TestClamdDown(t *testing.T) {
+	// a port where nothing listens, like when clamd is stopped
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s, err := NewClamdScanner("tcp://" + addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer UseScanner(nil, "", false)
+
+	UseScanner(s, AntivirusReject, false)
+	_, err = createFileWithContent("failclosedfile", "hello !")
+	assert.Error(t, err)
+	_, err = GetFileDocFromPath(vfsC, "/failclosedfile")
+	assert.True(t, os.IsNotExist(err))
+
+	UseScanner(s, AntivirusReject, true)
+	doc, err := createFileWithContent("failopenfile", "hello !")
+	if assert.NoError(t, err) {
+		assert.Equal(t, ScanUnscanned, doc.Antivirus.Status)
+		assert.False(t, doc.Antivirus.Infected())
+	}
+}
+
+func TestTrashAndPurge(t *testing.T) {
+	dir, err := NewDirDoc("trashme", "", nil, nil)
+	if !assert.NoError(t, err) || !assert.NoError(t, CreateDirectory(vfsC, dir)) {
+		return
+	}
+	_, err = createFileWithContent("trashedfile", "foo")
+	if !assert.NoError(t, err) {
+		return
+	}
+	file, err := GetFileDocFromPath(vfsC, "/trashedfile")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the document is moved and marked as trashed in a single update
+	dirRev, fileRev := revGeneration(dir.Rev()), revGeneration(file.Rev())
+	trashedDir, err := TrashDir(vfsC, dir)
+	if assert.NoError(t, err) {
+		assert.Equal(t, TrashFolderID, trashedDir.FolderID)
+		assert.NotNil(t, trashedDir.TrashedAt)
+		assert.Equal(t, dirRev+1, revGeneration(trashedDir.Rev()))
+	}
+	trashedFile, err := TrashFile(vfsC, file)
+	if assert.NoError(t, err) {
+		assert.Equal(t, TrashFolderID, trashedFile.FolderID)
+		assert.NotNil(t, trashedFile.TrashedAt)
+		assert.Equal(t, fileRev+1, revGeneration(trashedFile.Rev()))
+	}
+
+	_, err = TrashFile(vfsC, trashedFile)
+	assert.Equal(t, ErrFileInTrash, err)
+
+	_, err = GetFileDocFromPath(vfsC, TrashDirName+"/trashedfile")
+	assert.NoError(t, err)
+
+	// nothing has been trashed for long enough
+	assert.NoError(t, PurgeTrash(vfsC, time.Now().Add(-time.Hour)))
+	_, err = GetFileDocFromPath(vfsC, TrashDirName+"/trashedfile")
+	assert.NoError(t, err)
+	_, err = GetDirDocFromPath(vfsC, TrashDirName+"/trashme", false)
+	assert.NoError(t, err)
+
+	assert.NoError(t, PurgeTrash(vfsC, time.Now().Add(time.Hour)))
+	_, err = GetFileDocFromPath(vfsC, TrashDirName+"/trashedfile")
+	assert.Error(t, err)
+	_, err = GetDirDocFromPath(vfsC, TrashDirName+"/trashme", false)
+	assert.Error(t, err)
+	_, err = vfsC.Stat(TrashDirName + "/trashedfile")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestEmptyTrash(t *testing.T) {
+	_, err := createFileWithContent("emptytrash", "foo")
+	if !assert.NoError(t, err) {
+		return
+	}
+	file, err := GetFileDocFromPath(vfsC, "/emptytrash")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = TrashFile(vfsC, file)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, EmptyTrash(vfsC))
+	_, err = GetFileDocFromPath(vfsC, TrashDirName+"/emptytrash")
+	assert.Error(t, err)
+}
+
+func TestDirSize(t *testing.T) {
+	dirA, err := NewDirDoc("sizeA", "", nil, nil)
+	if !assert.NoError(t, err) || !assert.NoError(t, CreateDirectory(vfsC, dirA)) {
+		return
+	}
+	dirB, err := NewDirDoc("sizeB", dirA.ID(), nil, nil)
+	if !assert.NoError(t, err) || !assert.NoError(t, CreateDirectory(vfsC, dirB)) {
+		return
+	}
+
+	fileA, err := createFileInDir("fileA", dirA.ID(), "12")
+	if !assert.NoError(t, err) {
+		return
+	}
+	fileB, err := createFileInDir("fileB", dirB.ID(), "345")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	size, err := DirSize(vfsC, dirA)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), size)
+
+	// the aggregates are not in the documents of the directories, so their
+	// revisions don't change
+	fetchedA, err := GetDirDoc(vfsC, dirA.ID(), false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, dirA.Rev(), fetchedA.Rev())
+	}
+	if assert.NoError(t, fetchedA.FetchFiles(vfsC)) {
+		assert.Equal(t, int64(5), fetchedA.Size)
+		if assert.Len(t, fetchedA.dirs, 1) {
+			assert.Equal(t, int64(3), fetchedA.dirs[0].Size)
+		}
+	}
+	size, err = DirSize(vfsC, dirB)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), size)
+
+	// overwrite the content of fileB with a bigger one
+	newdoc, err := NewFileDoc(fileB.Name, dirB.ID(), -1, nil, "foo/bar", "foo", false, []string{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	file, err := CreateFile(vfsC, newdoc, fileB)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.Copy(file, strings.NewReader("3456789"))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	size, err = DirSize(vfsC, dirB)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), size)
+
+	// move fileA in dirB
+	dirBID := dirB.ID()
+	_, err = ModifyFileMetadata(vfsC, fileA, &DocPatch{FolderID: &dirBID})
+	assert.NoError(t, err)
+	size, err = DirSize(vfsC, dirA)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9), size)
+	size, err = DirSize(vfsC, dirB)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9), size)
+
+	// the computed size is the same as the aggregate
+	size, err = RecomputeDirSize(vfsC, dirA)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9), size)
+
+	fetchedB, err := GetDirDoc(vfsC, dirB.ID(), false)
+	if assert.NoError(t, err) {
+		assert.NoError(t, DestroyDirAndContent(vfsC, fetchedB))
+	}
+	size, err = DirSize(vfsC, dirA)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+}
+
+func TestModifyFileMetadataConflict(t *testing.T) {
+	doc, err := createFileWithContent("conflictfile", "foo")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	stale := *doc
+	stale.SetRev("1-badrev")
+	newname := "conflictfile-renamed"
+	_, err = ModifyFileMetadata(vfsC, &stale, &DocPatch{Name: &newname})
+	assert.Error(t, err)
+
+	// the file has not been moved on the storage
+	_, err = vfsC.Stat("/conflictfile")
+	assert.NoError(t, err)
+	_, err = vfsC.Stat("/conflictfile-renamed")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestModifyContentConcurrently(t *testing.T) {
+	doc, err := createFileWithContent("concurrentfile", "foo")
+	if !assert.NoError(t, err) {
+		return
+	}
+	olddoc, err := GetFileDoc(vfsC, doc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// all the modifications are made from the same revision: only one of
+	// them succeeds, and the others get a conflict
+	var wg sync.WaitGroup
+	var successes int32
+	winner := make(chan string, 1)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			newdoc, err := NewFileDoc(olddoc.Name, olddoc.FolderID, -1, nil, "foo/bar", "foo", false, []string{})
+			if !assert.NoError(t, err) {
+				return
+			}
+			file, err := CreateFile(vfsC, newdoc, olddoc)
+			if !assert.NoError(t, err) {
+				return
+			}
+			content := "content " + strconv.Itoa(i)
+			_, err = io.WriteString(file, content)
+			assert.NoError(t, err)
+			if err = file.Close(); err != nil {
+				assert.True(t, couchdb.IsConflictError(err))
+				return
+			}
+			atomic.AddInt32(&successes, 1)
+			winner <- content
+		}(i)
+	}
+	wg.Wait()
+	if !assert.Equal(t, int32(1), successes) {
+		return
+	}
+
+	// the content on the storage is the one of the winner, and the
+	// contents of the others have been removed
+	content, err := afero.ReadFile(vfsC.fs, "/concurrentfile")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, <-winner, string(content))
+	fetched, err := GetFileDoc(vfsC, doc.ID())
+	if assert.NoError(t, err) {
+		sum := md5.Sum(content)
+		assert.Equal(t, fetched.MD5Sum, sum[:])
+	}
+	infos, err := afero.ReadDir(vfsC.fs, "/")
+	if assert.NoError(t, err) {
+		for _, info := range infos {
+			assert.False(t, strings.HasPrefix(info.Name(), doc.ID()+"_"))
+		}
+	}
+}
+
+func TestRecoverInterruptedMove(t *testing.T) {
+	dir, err := NewDirDoc("interrupted", "", nil, nil)
+	if !assert.NoError(t, err) || !assert.NoError(t, CreateDirectory(vfsC, dir)) {
+		return
+	}
+	sub, err := NewDirDoc("sub", dir.ID(), nil, nil)
+	if !assert.NoError(t, err) || !assert.NoError(t, CreateDirectory(vfsC, sub)) {
+		return
+	}
+
+	// simulate a crash after the rename on the storage
+	moved := *dir
+	moved.Name = "interrupted-moved"
+	moved.Fullpath = "/interrupted-moved"
+	j := &moveJournal{
+		Phase:   moveRenamed,
+		OldPath: "/interrupted",
+		NewPath: "/interrupted-moved",
+		Doc:     &moved,
+	}
+	if !assert.NoError(t, couchdb.CreateDoc(context.Background(), TestPrefix, j)) {
+		return
+	}
+	if !assert.NoError(t, vfsC.fs.Rename("/interrupted", "/interrupted-moved")) {
+		return
+	}
+
+	assert.NoError(t, RecoverMoves(vfsC))
+
+	fetched, err := GetDirDoc(vfsC, dir.ID(), false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "interrupted-moved", fetched.Name)
+		assert.Equal(t, "/interrupted-moved", fetched.Fullpath)
+	}
+	fetchedSub, err := GetDirDoc(vfsC, sub.ID(), false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/interrupted-moved/sub", fetchedSub.Fullpath)
+	}
+
+	// simulate a crash before the rename on the storage
+	j = &moveJournal{
+		Phase:   movePrepared,
+		OldPath: "/interrupted-moved",
+		NewPath: "/interrupted-again",
+		Doc:     fetched,
+	}
+	if !assert.NoError(t, couchdb.CreateDoc(context.Background(), TestPrefix, j)) {
+		return
+	}
+	// a move that can't be recovered, as both paths exist, is skipped
+	broken := &moveJournal{
+		Phase:   moveRenamed,
+		OldPath: "/interrupted-moved",
+		NewPath: "/interrupted-moved/sub",
+		Doc:     fetchedSub,
+	}
+	if !assert.NoError(t, couchdb.CreateDoc(context.Background(), TestPrefix, broken)) {
+		return
+	}
+
+	assert.NoError(t, RecoverMoves(vfsC))
+
+	fetched, err = GetDirDoc(vfsC, dir.ID(), false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/interrupted-moved", fetched.Fullpath)
+	}
+	fetchedSub, err = GetDirDoc(vfsC, sub.ID(), false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/interrupted-moved/sub", fetchedSub.Fullpath)
+	}
+
+	var journals []*moveJournal
+	req := &couchdb.FindRequest{Selector: mango.Empty()}
+	assert.NoError(t, couchdb.FindDocs(context.Background(), TestPrefix, MoveJournalDocType, req, &journals))
+	if assert.Len(t, journals, 1) {
+		assert.Equal(t, broken.ID(), journals[0].ID())
+		assert.NoError(t, couchdb.DeleteDoc(context.Background(), TestPrefix, journals[0]))
+	}
+}
+
+func TestRecoverPreparedMove(t *testing.T) {
+	dir, err := NewDirDoc("prepared", "", nil, nil)
+	if !assert.NoError(t, err) || !assert.NoError(t, CreateDirectory(vfsC, dir)) {
+		return
+	}
+
+	// a recent move may still be in progress: it is not recovered
+	recent := &moveJournal{
+		Phase:     movePrepared,
+		OldPath:   "/prepared",
+		NewPath:   "/prepared-moved",
+		Doc:       dir,
+		CreatedAt: time.Now(),
+	}
+	if !assert.NoError(t, couchdb.CreateDoc(context.Background(), TestPrefix, recent)) {
+		return
+	}
+	if !assert.NoError(t, vfsC.fs.Rename("/prepared", "/prepared-moved")) {
+		return
+	}
+	assert.NoError(t, RecoverMoves(vfsC))
+	exists, err := afero.DirExists(vfsC.fs, "/prepared-moved")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// an old move that was only prepared is reverted on the storage
+	recent.CreatedAt = time.Now().Add(-2 * MoveGracePeriod)
+	if !assert.NoError(t, couchdb.UpdateDoc(context.Background(), TestPrefix, recent)) {
+		return
+	}
+	assert.NoError(t, RecoverMoves(vfsC))
+	exists, err = afero.DirExists(vfsC.fs, "/prepared")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = afero.DirExists(vfsC.fs, "/prepared-moved")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	fetched, err := GetDirDoc(vfsC, dir.ID(), false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/prepared", fetched.Fullpath)
+	}
+	var journals []*moveJournal
+	req := &couchdb.FindRequest{Selector: mango.Empty()}
+	assert.NoError(t, couchdb.FindDocs(context.Background(), TestPrefix, MoveJournalDocType, req, &journals))
+	assert.Len(t, journals, 0)
+}
+
+func TestCountChildren(t *testing.T) {
+	dir, err := NewDirDoc("countme", "", nil, nil)
+	if !assert.NoError(t, err) || !assert.NoError(t, CreateDirectory(vfsC, dir)) {
+		return
+	}
+	sub, err := NewDirDoc("sub", dir.ID(), nil, nil)
+	if !assert.NoError(t, err) || !assert.NoError(t, CreateDirectory(vfsC, sub)) {
+		return
+	}
+	for _, name := range []string{"one", "two"} {
+		if _, err = createFileInDir(name, dir.ID(), "foo"); !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	files, dirs, err := CountChildren(vfsC, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, files)
+	assert.Equal(t, 1, dirs)
+
+	files, dirs, err = CountChildren(vfsC, sub)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, files)
+	assert.Equal(t, 0, dirs)
+}
+
+func TestReferencedBy(t *testing.T) {
+	doc, err := createFileWithContent("referenced", "foo")
+	if !assert.NoError(t, err) {
+		return
+	}
+	album := jsonapi.ResourceIdentifier{ID: "album-1", Type: "io.cozy.photos.albums"}
+	other := jsonapi.ResourceIdentifier{ID: "album-2", Type: "io.cozy.photos.albums"}
+
+	err = AddReferencedBy(vfsC, doc, []jsonapi.ResourceIdentifier{album, other, album})
+	assert.NoError(t, err)
+	fetched, err := GetFileDoc(vfsC, doc.ID())
+	if assert.NoError(t, err) {
+		assert.Equal(t, []jsonapi.ResourceIdentifier{album, other}, fetched.ReferencedBy)
+	}
+
+	// the references are kept when the file is renamed
+	newname := "referenced-renamed"
+	fetched, err = ModifyFileMetadata(vfsC, fetched, &DocPatch{Name: &newname})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, fetched.ReferencedBy, 2)
+
+	err = RemoveReferencedBy(vfsC, fetched, []jsonapi.ResourceIdentifier{album})
+	assert.NoError(t, err)
+	fetched, err = GetFileDoc(vfsC, doc.ID())
+	if assert.NoError(t, err) {
+		assert.Equal(t, []jsonapi.ResourceIdentifier{other}, fetched.ReferencedBy)
+	}
+}
+
+func TestGetDirDocConcurrently(t *testing.T) {
+	var g flightGroup
+	var calls int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := g.do("key", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				// the fetch is done once all the other callers wait for it
+				for g.waiting("key") < 9 {
+					runtime.Gosched()
+				}
+				return "value", nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "value", v)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	dir, err := NewDirDoc("shared", "", []string{"foo"}, nil)
+	if !assert.NoError(t, err) || !assert.NoError(t, CreateDirectory(vfsC, dir)) {
+		return
+	}
+	docs := make([]*DirDoc, 10)
+	for i := range docs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			doc, err := GetDirDoc(vfsC, dir.ID(), false)
+			assert.NoError(t, err)
+			docs[i] = doc
+		}(i)
+	}
+	wg.Wait()
+	for i, doc := range docs {
+		if assert.NotNil(t, doc) {
+			assert.Equal(t, "/shared", doc.Fullpath)
+		}
+		for _, other := range docs[:i] {
+			assert.False(t, doc == other, "each caller must have its own copy")
+		}
+	}
+	docs[0].Tags[0] = "bar"
+	assert.Equal(t, "foo", docs[1].Tags[0])
+
+	// the shared fetch is not canceled with the context of its caller
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	doc, err := GetDirDoc(vfsC.WithContext(ctx), dir.ID(), false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/shared", doc.Fullpath)
+	}
+}
+
 func TestMain(m *testing.M) {
-	db, err := checkup.HTTPChecker{URL: CouchDBURL}.Check()
-	if err != nil || db.Status() != checkup.Healthy {
-		fmt.Println("This test need couchdb to run.")
+	couchURL, stop := couchdbtest.Start()
+	err := couchdb.UseServer(couchdb.ServerOptions{URL: couchURL})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = couchdb.ResetDB(context.Background(), TestPrefix, FsDocType)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = couchdb.ResetDB(context.Background(), TestPrefix, MoveJournalDocType)
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
-	err = couchdb.ResetDB(TestPrefix, FsDocType)
+	err = couchdb.EnsureDBExists(context.Background(), TestPrefix, FsDocType, &couchdb.DBOptions{Indexes: Indexes})
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	err = couchdb.DefineIndex(TestPrefix, FsDocType, mango.IndexOnFields("folder_id", "name"))
+	err = couchdb.DefineViews(context.Background(), TestPrefix, Views)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -96,5 +774,7 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
-	os.Exit(m.Run())
+	res := m.Run()
+	stop()
+	os.Exit(res)
 }
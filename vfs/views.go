@@ -0,0 +1,44 @@
+package vfs
+
+import "github.com/dcasier/cozy-stack/couchdb"
+
+// ChildrenByTypeView counts the children of the directories, by type
+var ChildrenByTypeView = &couchdb.View{
+	Name:    "children-by-type",
+	Doctype: FsDocType,
+	Map:     "function(doc) { emit([doc.folder_id, doc.type], null); }",
+	Reduce:  "_count",
+}
+
+// Views is the list of the views used by the VFS
+var Views = []*couchdb.View{
+	ChildrenByTypeView,
+}
+
+// CountChildren returns the number of files and sub-directories that are
+// directly inside the given directory
+func CountChildren(c *Context, dir *DirDoc) (files, dirs int, err error) {
+	res, err := couchdb.QueryView(c.ctx, c.db, ChildrenByTypeView, &couchdb.ViewRequest{
+		StartKey: []interface{}{dir.ID()},
+		EndKey:   []interface{}{dir.ID(), map[string]interface{}{}},
+		Group:    true,
+	})
+	if err != nil {
+		return
+	}
+
+	for _, row := range res.Rows {
+		key, ok := row.Key.([]interface{})
+		if !ok || len(key) != 2 {
+			continue
+		}
+		count, _ := row.Value.(float64)
+		switch key[1] {
+		case FileType:
+			files = int(count)
+		case DirType:
+			dirs = int(count)
+		}
+	}
+	return
+}
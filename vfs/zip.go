@@ -0,0 +1,72 @@
+package vfs
+
+import (
+	"archive/zip"
+	"io"
+	"path"
+)
+
+// WriteZip writes in w a zip archive with the content of the given
+// directory and of all its sub-directories.
+//
+// The files put in quarantine by the antivirus, and the trash, are
+// skipped.
+func WriteZip(c *Context, doc *DirDoc, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	if err := writeZipDir(c, zw, doc, doc.Name); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeZipDir(c *Context, zw *zip.Writer, dir *DirDoc, prefix string) error {
+	files, dirs, err := fetchChildren(c, dir)
+	if err != nil {
+		return err
+	}
+
+	if _, err = zw.Create(prefix + "/"); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.Antivirus.Infected() {
+			continue
+		}
+		if err = writeZipFile(c, zw, file, path.Join(dir.Fullpath, file.Name), path.Join(prefix, file.Name)); err != nil {
+			return err
+		}
+	}
+
+	for _, child := range dirs {
+		if child.ID() == TrashFolderID {
+			continue
+		}
+		if err = writeZipDir(c, zw, child, path.Join(prefix, child.Name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeZipFile(c *Context, zw *zip.Writer, doc *FileDoc, fullpath, name string) error {
+	content, err := c.fs.Open(fullpath)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	header := &zip.FileHeader{
+		Name:   name,
+		Method: zip.Deflate,
+	}
+	header.SetModTime(doc.UpdatedAt)
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, content)
+	return err
+}
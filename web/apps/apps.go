@@ -3,93 +3,439 @@
 package apps
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net/http"
 	"net/url"
 
 	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/couchdb"
 	"github.com/dcasier/cozy-stack/web/jsonapi"
 	"github.com/dcasier/cozy-stack/web/middlewares"
 	"github.com/gin-gonic/gin"
 )
 
+var (
+	errUnknownState = errors.New("Unknown state of application")
+)
+
+// devMode is true if the stack has been started with an application in
+// development
+var devMode bool
+
+// UseDevMode accepts the local sources of applications from all the clients,
+// if enabled is true, and not only from the command line
+func UseDevMode(enabled bool) {
+	devMode = enabled
+}
+
+// allowedSource returns false for a local source, like file:///home/dev/app,
+// unless the request has been made by the command line, with an admin
+// token, or the stack is in development mode
+func allowedSource(c *gin.Context, src string) bool {
+	return !apps.IsLocalSource(src) || middlewares.IsAdmin(c) || devMode
+}
+
 func wrapAppsError(err error) *jsonapi.Error {
 	if urlErr, isURLErr := err.(*url.Error); isURLErr {
 		return jsonapi.InvalidParameter("Source", urlErr)
 	}
+	if couchErr, isCouchErr := err.(*couchdb.Error); isCouchErr {
+		return jsonapi.WrapCouchError(couchErr)
+	}
 
 	switch err {
 	case apps.ErrInvalidSlugName:
 		return jsonapi.InvalidParameter("slug", err)
-	case apps.ErrNotSupportedSource:
+	case apps.ErrNotSupportedSource, apps.ErrNoRegistry:
 		return jsonapi.InvalidParameter("Source", err)
 	case apps.ErrSourceNotReachable:
 		return jsonapi.BadRequest(err)
-	case apps.ErrBadManifest:
+	case apps.ErrBadManifest, apps.ErrBadChecksum:
+		return jsonapi.BadRequest(err)
+	case apps.ErrBadSignature, apps.ErrMissingSignature:
 		return jsonapi.BadRequest(err)
+	case apps.ErrMissingEntrypoint:
+		return jsonapi.BadRequest(err)
+	case apps.ErrNoPreviousVersion:
+		return jsonapi.NotFound(err)
+	case apps.ErrBadState:
+		return jsonapi.PreconditionFailed("state", err)
+	case apps.ErrLocked:
+		return jsonapi.Conflict(err)
+	case apps.ErrLocalSource:
+		return jsonapi.Forbidden(err)
 	}
 	return jsonapi.InternalServerError(err)
 }
 
-// InstallHandler handles all POST /:slug request and tries to install
-// the application with the given Source.
-func InstallHandler(c *gin.Context) {
-	instance := middlewares.GetInstance(c)
-	vfsC, err := instance.GetVFSContext()
-	if err != nil {
-		jsonapi.AbortWithError(c, jsonapi.InternalServerError(err))
+// abortWithAppsError sends the error in the JSON-API format. An invalid
+// manifest gives an invalid-parameter error for each of its invalid fields.
+func abortWithAppsError(c *gin.Context, err error) {
+	if manErrs, isManErrs := err.(apps.ManifestErrors); isManErrs {
+		errs := make(jsonapi.ErrorList, len(manErrs))
+		for i, e := range manErrs {
+			errs[i] = jsonapi.InvalidParameter("manifest."+e.Field, e)
+		}
+		jsonapi.AbortWithErrors(c, errs)
 		return
 	}
+	jsonapi.AbortWithError(c, wrapAppsError(err))
+}
 
-	db := instance.GetDatabasePrefix()
-	src := c.Query("Source")
-	slug := c.Param("slug")
-	inst, err := apps.NewInstaller(vfsC, db, slug, src)
-	if err != nil {
-		jsonapi.AbortWithError(c, wrapAppsError(err))
-		return
-	}
+// installHandler returns the handler of the POST /:slug requests, that
+// installs the application of the given type with the given Source.
+//
+// swagger:route POST /apps/:slug apps installApp
+// swagger:route POST /konnectors/:slug konnectors installKonnector
+//
+// Installs an application or a konnector from the given Source. The
+// installation continues in the background, and its progress can be
+// followed on the events route.
+//
+// Responses:
+//   202: the manifest of the application being installed
+func installHandler(typ apps.AppType) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		instance := middlewares.GetInstance(c)
+		// the installation goes on after the response, it must not be
+		// canceled with the request
+		ctx := context.Background()
+		vfsC, err := instance.GetVFSContext(ctx)
+		if err != nil {
+			jsonapi.AbortWithError(c, jsonapi.InternalServerError(err))
+			return
+		}
+
+		db := instance.GetDatabasePrefix()
+		src := c.Query("Source")
+		slug := c.Param("slug")
+		if !allowedSource(c, src) {
+			abortWithAppsError(c, apps.ErrLocalSource)
+			return
+		}
+		inst, err := apps.NewInstaller(ctx, vfsC, db, typ, slug, src)
+		if err != nil {
+			abortWithAppsError(c, err)
+			return
+		}
+		if err = inst.PinChecksum(c.Query("Checksum")); err != nil {
+			jsonapi.AbortWithError(c, jsonapi.InvalidParameter("Checksum", err))
+			return
+		}
 
-	go inst.Install()
+		go inst.Install()
 
-	man, err := inst.WaitManifest()
-	if err != nil {
-		jsonapi.AbortWithError(c, wrapAppsError(err))
-		return
+		man, err := inst.WaitManifest()
+		if err != nil {
+			abortWithAppsError(c, err)
+			return
+		}
+
+		jsonapi.Data(c, http.StatusAccepted, man, nil)
+
+		// the progress is sent to the clients of GET /:slug/events
+		go func() {
+			for {
+				man, err := inst.WaitManifest()
+				if err != nil || man.State == apps.Ready {
+					break
+				}
+			}
+		}()
 	}
+}
 
-	jsonapi.Data(c, http.StatusAccepted, man, nil)
+// updateHandler returns the handler of the PUT /:slug requests, that
+// updates the installed application of the given type to the last version
+// of its source.
+//
+// swagger:route PUT /apps/:slug apps updateApp
+// swagger:route PUT /konnectors/:slug konnectors updateKonnector
+//
+// Updates an installed application or konnector to the last version of
+// its source. The update continues in the background.
+//
+// Responses:
+//   202: the manifest of the application being updated
+func updateHandler(typ apps.AppType) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		instance := middlewares.GetInstance(c)
+		// the update goes on after the response, it must not be canceled
+		// with the request
+		ctx := context.Background()
+		vfsC, err := instance.GetVFSContext(ctx)
+		if err != nil {
+			jsonapi.AbortWithError(c, jsonapi.InternalServerError(err))
+			return
+		}
 
-	go func() {
-		for {
-			_, err := inst.WaitManifest()
-			if err != nil {
-				break
+		db := instance.GetDatabasePrefix()
+		slug := c.Param("slug")
+		updater, err := apps.NewUpdater(ctx, vfsC, db, typ, slug)
+		if err != nil {
+			abortWithAppsError(c, err)
+			return
+		}
+		if !allowedSource(c, updater.Source()) {
+			abortWithAppsError(c, apps.ErrLocalSource)
+			return
+		}
+
+		go updater.Update()
+
+		man, err := updater.WaitManifest()
+		if err != nil {
+			abortWithAppsError(c, err)
+			return
+		}
+
+		jsonapi.Data(c, http.StatusAccepted, man, nil)
+
+		// the manifest is already ready if the application is up-to-date
+		if man.State != apps.Upgrading {
+			return
+		}
+		go func() {
+			for {
+				man, err := updater.WaitManifest()
+				if err != nil || man.State == apps.Ready {
+					break
+				}
 			}
-			// TODO: do nothing for now
+		}()
+	}
+}
+
+// uninstallHandler returns the handler of the DELETE /:slug requests, that
+// removes the installed application of the given type
+//
+// swagger:route DELETE /apps/:slug apps uninstallApp
+// swagger:route DELETE /konnectors/:slug konnectors uninstallKonnector
+//
+// Removes an installed application or konnector.
+//
+// Responses:
+//   204: the application has been removed
+func uninstallHandler(typ apps.AppType) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		instance := middlewares.GetInstance(c)
+		ctx := c.Request.Context()
+		vfsC, err := instance.GetVFSContext(ctx)
+		if err != nil {
+			jsonapi.AbortWithError(c, jsonapi.InternalServerError(err))
+			return
 		}
-	}()
+
+		db := instance.GetDatabasePrefix()
+		if err = apps.Uninstall(ctx, vfsC, db, typ, c.Param("slug")); err != nil {
+			abortWithAppsError(c, err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// rollbackHandler returns the handler of the POST /:slug/rollback requests,
+// that restores the previous version of the installed application of the
+// given type
+//
+// swagger:route POST /apps/:slug/rollback apps rollbackApp
+// swagger:route POST /konnectors/:slug/rollback konnectors rollbackKonnector
+//
+// Restores the previous version of an installed application or
+// konnector.
+func rollbackHandler(typ apps.AppType) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		instance := middlewares.GetInstance(c)
+		ctx := c.Request.Context()
+		vfsC, err := instance.GetVFSContext(ctx)
+		if err != nil {
+			jsonapi.AbortWithError(c, jsonapi.InternalServerError(err))
+			return
+		}
+
+		db := instance.GetDatabasePrefix()
+		man, err := apps.Rollback(ctx, vfsC, db, typ, c.Param("slug"))
+		if err != nil {
+			abortWithAppsError(c, err)
+			return
+		}
+
+		jsonapi.Data(c, http.StatusOK, man, nil)
+	}
 }
 
-// ListHandler handles all GET / requests which can be used to list
-// installed applications.
-func ListHandler(c *gin.Context) {
+// eventsHandler returns the handler of the GET /:slug/events requests. It
+// streams the progress of the installation or update of the application of
+// the given type, as server-sent events, until it is done or has failed.
+//
+// swagger:route GET /apps/:slug/events apps appEvents
+// swagger:route GET /konnectors/:slug/events konnectors konnectorEvents
+//
+// Streams the progress of the installation or update of an application
+// or konnector, as server-sent events, until it is done or has failed.
+//
+// Produces:
+//   - text/event-stream
+func eventsHandler(typ apps.AppType) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		instance := middlewares.GetInstance(c)
+		db := instance.GetDatabasePrefix()
+		slug := c.Param("slug")
+
+		// subscribe before reading the manifest to not miss an event
+		events, unsubscribe := apps.Subscribe(db, slug)
+		defer unsubscribe()
+
+		man, err := apps.GetBySlug(c.Request.Context(), db, typ, slug)
+		if err != nil {
+			abortWithAppsError(c, err)
+			return
+		}
+
+		next := apps.CurrentEvent(man)
+		closed := c.Writer.CloseNotify()
+		c.Stream(func(w io.Writer) bool {
+			if next == nil {
+				select {
+				case next = <-events:
+				case <-closed:
+					return false
+				}
+			}
+			c.SSEvent("progress", next)
+			final := next.Final()
+			next = nil
+			return !final
+		})
+	}
+}
+
+// TokenHandler handles all POST /:slug/token requests and creates a token
+// for the installed application with the given slug. The application can
+// then use this token to access the data and files allowed by its scopes.
+//
+// swagger:route POST /apps/:slug/token apps createAppToken
+//
+// Responses:
+//   201: the token of the application
+func TokenHandler(c *gin.Context) {
+	if middlewares.GetApp(c) != nil {
+		jsonapi.AbortWithError(c, jsonapi.Forbidden(middlewares.ErrForbiddenScope))
+		return
+	}
+
 	instance := middlewares.GetInstance(c)
-	docs, err := apps.List(instance.GetDatabasePrefix())
+	db := instance.GetDatabasePrefix()
+	token, err := apps.CreateToken(c.Request.Context(), db, c.Param("slug"))
 	if err != nil {
-		jsonapi.AbortWithError(c, wrapAppsError(err))
+		abortWithAppsError(c, err)
 		return
 	}
 
-	objs := make([]jsonapi.Object, len(docs))
-	for i, d := range docs {
-		objs[i] = jsonapi.Object(d)
+	jsonapi.Data(c, http.StatusCreated, token, nil)
+}
+
+// showHandler returns the handler of the GET /:slug requests, that fetches
+// the manifest of an installed application of the given type.
+//
+// swagger:route GET /apps/:slug apps showApp
+// swagger:route GET /konnectors/:slug konnectors showKonnector
+//
+// Responds with the manifest of an installed application or konnector.
+func showHandler(typ apps.AppType) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		instance := middlewares.GetInstance(c)
+		slug := c.Param("slug")
+		man, err := apps.GetBySlug(c.Request.Context(), instance.GetDatabasePrefix(), typ, slug)
+		if err != nil {
+			abortWithAppsError(c, err)
+			return
+		}
+
+		jsonapi.Data(c, http.StatusOK, man, nil)
+	}
+}
+
+// listHandler returns the handler of the GET / requests, that lists the
+// installed applications of the given type. They can be filtered by state
+// with ?state=, and the list is paginated with page[limit] and
+// page[cursor].
+//
+// swagger:route GET /apps/ apps listApps
+// swagger:route GET /konnectors/ konnectors listKonnectors
+//
+// Lists the installed applications or konnectors. They can be filtered
+// by state with ?state=, and the list is paginated with page[limit] and
+// page[cursor].
+func listHandler(typ apps.AppType) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		page, perr := jsonapi.PageParams(c)
+		if perr != nil {
+			jsonapi.AbortWithError(c, perr)
+			return
+		}
+		opts := &apps.ListOptions{Limit: page.Limit, Cursor: page.Cursor}
+		if state := c.Query("state"); state != "" {
+			opts.State = apps.State(state)
+			if !isKnownState(opts.State) {
+				jsonapi.AbortWithError(c, jsonapi.InvalidParameter("state", errUnknownState))
+				return
+			}
+		}
+
+		instance := middlewares.GetInstance(c)
+		docs, next, total, err := apps.ListPage(c.Request.Context(), instance.GetDatabasePrefix(), typ, opts)
+		if err != nil {
+			abortWithAppsError(c, err)
+			return
+		}
+
+		objs := make([]jsonapi.Object, len(docs))
+		for i, d := range docs {
+			objs[i] = jsonapi.Object(d)
+		}
+		jsonapi.PaginatedDataList(c, http.StatusOK, objs, &jsonapi.PageInfo{
+			Count:      total,
+			NextCursor: next,
+		})
 	}
+}
 
-	jsonapi.DataList(c, http.StatusOK, objs, nil)
+// isKnownState returns true if the given state is one of the states of the
+// applications
+func isKnownState(state apps.State) bool {
+	switch state {
+	case apps.Available, apps.Installing, apps.Upgrading,
+		apps.Uninstalling, apps.Errored, apps.Ready:
+		return true
+	}
+	return false
 }
 
 // Routes sets the routing for the apps service
 func Routes(router *gin.RouterGroup) {
-	router.GET("/", ListHandler)
-	router.POST("/:slug", InstallHandler)
+	router.GET("/", listHandler(apps.Webapp))
+	router.GET("/:slug", showHandler(apps.Webapp))
+	router.POST("/:slug", installHandler(apps.Webapp))
+	router.PUT("/:slug", updateHandler(apps.Webapp))
+	router.DELETE("/:slug", uninstallHandler(apps.Webapp))
+	router.POST("/:slug/rollback", rollbackHandler(apps.Webapp))
+	router.GET("/:slug/events", eventsHandler(apps.Webapp))
+	router.POST("/:slug/token", TokenHandler)
+}
+
+// KonnectorsRoutes sets the routing for the konnectors service, that
+// installs and lists the konnectors like the webapps
+func KonnectorsRoutes(router *gin.RouterGroup) {
+	router.GET("/", listHandler(apps.Konnector))
+	router.GET("/:slug", showHandler(apps.Konnector))
+	router.POST("/:slug", installHandler(apps.Konnector))
+	router.PUT("/:slug", updateHandler(apps.Konnector))
+	router.DELETE("/:slug", uninstallHandler(apps.Konnector))
+	router.POST("/:slug/rollback", rollbackHandler(apps.Konnector))
+	router.GET("/:slug/events", eventsHandler(apps.Konnector))
 }
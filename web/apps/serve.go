@@ -0,0 +1,272 @@
+package apps
+
+import (
+	"errors"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/i18n"
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/vfs"
+	"github.com/dcasier/cozy-stack/web/files"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+// hstsMaxAge is the duration, in seconds, that the browsers must remember
+// to use only HTTPS for the domain of the instance and its subdomains
+const hstsMaxAge = "31536000"
+
+// assetsMaxAge is the duration, in seconds, that the browsers can keep the
+// assets of an application in cache without checking them again
+const assetsMaxAge = "3600"
+
+// versionedAssetsMaxAge is the duration, in seconds, that the browsers can
+// keep in cache the assets requested with the version of the application:
+// their URL changes with each new version, so they never need to be checked
+const versionedAssetsMaxAge = "31536000"
+
+// versionParam is the parameter of the query string used by the
+// applications to reference their assets with their version, for cache
+// busting, like app.js?v=1.2.3
+const versionParam = "v"
+
+var (
+	errAppNotReady = errors.New("Application is not ready")
+	errNoRoute     = errors.New("No route of the application matches this path")
+)
+
+// Serve creates a gin middleware that serves the files of the installed
+// applications, on the subdomains of the instance, like
+// calendar.example.cozycloud.cc. The requests on the instance domain are
+// passed to the next handlers.
+func Serve() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		slug := middlewares.GetAppSlug(c)
+		if slug == "" {
+			return
+		}
+		c.Abort()
+		setSecurityHeaders(c)
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			c.Header("Allow", "GET, HEAD")
+			c.Status(http.StatusMethodNotAllowed)
+			return
+		}
+		if redirectToOnboarding(c) {
+			return
+		}
+		serveApp(c, slug)
+	}
+}
+
+// redirectToOnboarding redirects the requests on the applications of an
+// instance whose owner has not yet registered a passphrase to the
+// onboarding page on the instance domain, with the registration token of
+// the request if any. It returns true if the request has been answered.
+func redirectToOnboarding(c *gin.Context) bool {
+	i := middlewares.GetInstance(c)
+	state, err := i.State(c.Request.Context())
+	if err != nil {
+		jsonapi.AbortWithError(c, jsonapi.InternalServerError(err))
+		return true
+	}
+	if state != instance.StateOnboarding {
+		return false
+	}
+	// the host of the instance is the one of the application, without
+	// the slug, to keep the port
+	parts := strings.SplitN(c.Request.Host, ".", 2)
+	u := &url.URL{
+		Scheme: middlewares.RequestScheme(c),
+		Host:   parts[len(parts)-1],
+		Path:   "/auth/passphrase",
+	}
+	if token := c.Query("registerToken"); token != "" {
+		u.RawQuery = url.Values{"registerToken": {token}}.Encode()
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, u.String())
+	return true
+}
+
+// serveApp serves a file of the application, from its directory in the
+// VFS, following the routes of its manifest. A request on a folder serves
+// the index of its route.
+func serveApp(c *gin.Context, slug string) {
+	instance := middlewares.GetInstance(c)
+	ctx := c.Request.Context()
+	man, err := apps.GetBySlug(ctx, instance.GetDatabasePrefix(), apps.Webapp, slug)
+	if err != nil {
+		abortWithErrorPage(c, wrapAppsError(err))
+		return
+	}
+	if man.State != apps.Ready {
+		abortWithErrorPage(c, &jsonapi.Error{
+			Status: http.StatusServiceUnavailable,
+			Title:  http.StatusText(http.StatusServiceUnavailable),
+			Detail: errAppNotReady.Error(),
+		})
+		return
+	}
+
+	setCSP(c, man)
+
+	// TODO: check the session of the owner of the instance for the routes
+	// that are not public, when the authentication is available, and then
+	// inject the token of the application (man.Token) in their index
+	route, rest := man.Routes.FindRoute(c.Request.URL.Path)
+	if route == nil {
+		abortWithErrorPage(c, jsonapi.NotFound(errNoRoute))
+		return
+	}
+
+	vfsC, err := instance.GetVFSContext(ctx)
+	if err != nil {
+		abortWithErrorPage(c, jsonapi.InternalServerError(err))
+		return
+	}
+
+	name := path.Join(apps.AppsDirectory, slug, route.Folder, rest)
+	typ, _, file, err := vfs.GetDirOrFileDocFromPath(vfsC, name, false)
+	if err == nil && typ != vfs.FileType {
+		if route.Index == "" {
+			abortWithErrorPage(c, jsonapi.NotFound(errNoRoute))
+			return
+		}
+		file, err = vfs.GetFileDocFromPath(vfsC, path.Join(name, route.Index))
+	}
+	if err != nil {
+		abortWithErrorPage(c, files.WrapVfsError(err))
+		return
+	}
+
+	file.Mime = contentType(file)
+	c.Header("Cache-Control", cacheControl(c, man, route, file))
+	if err = vfs.ServeFileContent(vfsC, file, "inline", c.Request, c.Writer); err != nil {
+		jsonapi.AbortWithError(c, files.WrapVfsError(err))
+	}
+}
+
+// cacheControl returns the Cache-Control header of a file of an
+// application. The index references the other assets, it must be
+// revalidated to get a new version of the application after an update.
+// The assets requested with the current version of the application can be
+// kept forever, but not the ones requested with another version, as their
+// content is the one of the current version. The conditional requests are
+// answered with the ETag of the file, the hash of its content.
+func cacheControl(c *gin.Context, man *apps.Manifest, route *apps.Route, file *vfs.FileDoc) string {
+	if file.Name == route.Index {
+		return "private, no-cache"
+	}
+	version, ok := c.GetQuery(versionParam)
+	if !ok {
+		return "private, max-age=" + assetsMaxAge
+	}
+	if man.Version == "" || version != man.Version {
+		return "private, no-cache"
+	}
+	return "private, max-age=" + versionedAssetsMaxAge + ", immutable"
+}
+
+// errorTemplate is the page shown in the browsers for the errors of the
+// applications, in the locale of the instance
+var errorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="{{.Locale}}">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`))
+
+// errorPage is the data of the error template
+type errorPage struct {
+	Locale  string
+	Title   string
+	Message string
+}
+
+// abortWithErrorPage sends an error of an application as a localized HTML
+// page to the browsers, and in the JSON-API format to the other clients
+func abortWithErrorPage(c *gin.Context, e *jsonapi.Error) {
+	if !strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		jsonapi.AbortWithError(c, e)
+		return
+	}
+	locale := middlewares.GetInstance(c).GetLocale()
+	page := &errorPage{
+		Locale:  locale,
+		Title:   i18n.Translate(locale, "error.title"),
+		Message: i18n.Translate(locale, "error.default.message"),
+	}
+	switch e.Status {
+	case http.StatusNotFound, http.StatusServiceUnavailable:
+		prefix := "error." + strconv.Itoa(e.Status)
+		page.Title = i18n.Translate(locale, prefix+".title")
+		page.Message = i18n.Translate(locale, prefix+".message")
+	}
+	c.Abort()
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Status(e.Status)
+	if err := errorTemplate.Execute(c.Writer, page); err != nil {
+		c.Error(err)
+	}
+}
+
+// setSecurityHeaders adds the headers that protect the applications
+// against the sniffing of the content types and the clickjacking, and that
+// force HTTPS once the browser has seen the instance over HTTPS
+func setSecurityHeaders(c *gin.Context) {
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("X-Frame-Options", "SAMEORIGIN")
+	c.Header("Referrer-Policy", "same-origin")
+	if middlewares.RequestScheme(c) == "https" {
+		c.Header("Strict-Transport-Security", "max-age="+hstsMaxAge+"; includeSubDomains")
+	}
+}
+
+// setCSP adds the Content-Security-Policy of the application: its files
+// can only call the API of the stack on the domain of the instance, and
+// embed the other applications of the instance, in addition to the sources
+// declared in its manifest
+func setCSP(c *gin.Context, man *apps.Manifest) {
+	domain := middlewares.GetInstance(c).Domain
+	scheme, ws := middlewares.RequestScheme(c), "ws"
+	if scheme == "https" {
+		ws = "wss"
+	}
+	policy := man.CSP.Policy(scheme+"://"+domain, ws+"://"+domain, scheme+"://*."+domain)
+	c.Header("Content-Security-Policy", policy)
+}
+
+// contentType returns the content-type of a file of an application, from
+// its extension if the VFS does not know it, with the charset for the text
+// files
+func contentType(file *vfs.FileDoc) string {
+	ct := file.Mime
+	if ct == "" || ct == vfs.DefaultContentType {
+		if ext := mime.TypeByExtension(path.Ext(file.Name)); ext != "" {
+			ct, _ = vfs.ExtractMimeAndClass(ext)
+		}
+	}
+	if ct == "" {
+		return vfs.DefaultContentType
+	}
+	if strings.HasPrefix(ct, "text/") || ct == "application/javascript" {
+		ct += "; charset=utf-8"
+	}
+	return ct
+}
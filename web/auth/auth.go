@@ -0,0 +1,187 @@
+// Package auth is the HTTP frontend for the authentication of the owner of
+// an instance: the registration of the passphrase, and the login and
+// logout, with a session cookie. It is also the OAuth2 authorization server
+// for the external clients.
+package auth
+
+import (
+	"encoding/hex"
+	"html/template"
+	"net/http"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/i18n"
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/sessions"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+func wrapAuthError(err error) *jsonapi.Error {
+	if couchErr, isCouchErr := err.(*couchdb.Error); isCouchErr {
+		return jsonapi.WrapCouchError(couchErr)
+	}
+	switch err {
+	case instance.ErrPassphraseTooShort:
+		return jsonapi.InvalidParameter("passphrase", err)
+	case instance.ErrPassphraseAlreadySet:
+		return jsonapi.Conflict(err)
+	case instance.ErrNoPassphrase, instance.ErrInvalidPassphrase:
+		return jsonapi.Unauthorized(err)
+	case instance.ErrInvalidRegisterToken:
+		return jsonapi.Forbidden(err)
+	}
+	return jsonapi.InternalServerError(err)
+}
+
+// onboardingTemplate is the page where the owner of a new instance
+// registers the passphrase, with the registration token given by the hoster
+var onboardingTemplate = template.Must(template.New("onboarding").Parse(`<!DOCTYPE html>
+<html lang="{{.Locale}}">
+<head>
+<meta charset="utf-8">
+<title>{{.T "onboarding.title"}}</title>
+</head>
+<body>
+<h1>{{.T "onboarding.title"}}</h1>
+<form method="POST" action="/auth/passphrase">
+<input type="hidden" name="register_token" value="{{.RegisterToken}}">
+<label>{{.T "onboarding.passphrase"}} <input type="password" name="passphrase" minlength="8" required></label>
+<button type="submit">{{.T "onboarding.submit"}}</button>
+</form>
+</body>
+</html>
+`))
+
+// onboardingPage is the data of the onboarding template
+type onboardingPage struct {
+	Locale        string
+	RegisterToken string
+}
+
+// T translates a string of the page in the locale of the instance
+func (p *onboardingPage) T(key string) string {
+	return i18n.Translate(p.Locale, key)
+}
+
+// onboardingForm handles GET /auth/passphrase requests. It shows the
+// onboarding page, with the registration token of the registerToken
+// parameter, until the owner has registered the passphrase.
+//
+// swagger:route GET /auth/passphrase auth onboardingForm
+//
+// Produces:
+//   - text/html
+func onboardingForm(c *gin.Context) {
+	i := middlewares.GetInstance(c)
+	state, err := i.State(c.Request.Context())
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapAuthError(err))
+		return
+	}
+	if state != instance.StateOnboarding {
+		jsonapi.AbortWithError(c, wrapAuthError(instance.ErrPassphraseAlreadySet))
+		return
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	page := &onboardingPage{
+		Locale:        i.GetLocale(),
+		RegisterToken: c.Query("registerToken"),
+	}
+	if err := onboardingTemplate.Execute(c.Writer, page); err != nil {
+		c.Error(err)
+	}
+}
+
+// registerPassphrase handles POST /auth/passphrase requests. It sets the
+// passphrase of an instance that has none yet, with the registration token
+// in hexadecimal, and logs in its owner.
+//
+// swagger:route POST /auth/passphrase auth registerPassphrase
+//
+// Consumes:
+//   - application/x-www-form-urlencoded
+//
+// Responses:
+//   204: the passphrase has been registered and a session opened
+func registerPassphrase(c *gin.Context) {
+	i := middlewares.GetInstance(c)
+	ctx := c.Request.Context()
+	token, err := hex.DecodeString(c.PostForm("register_token"))
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapAuthError(instance.ErrInvalidRegisterToken))
+		return
+	}
+	if err = i.RegisterPassphrase(ctx, c.PostForm("passphrase"), token); err != nil {
+		jsonapi.AbortWithError(c, wrapAuthError(err))
+		return
+	}
+	login(c)
+}
+
+// loginHandler handles POST /auth/login requests. It checks the passphrase
+// and opens a session for the owner of the instance.
+//
+// swagger:route POST /auth/login auth login
+//
+// Consumes:
+//   - application/x-www-form-urlencoded
+//
+// Responses:
+//   204: a session has been opened
+func loginHandler(c *gin.Context) {
+	i := middlewares.GetInstance(c)
+	if err := i.CheckPassphrase(c.Request.Context(), c.PostForm("passphrase")); err != nil {
+		jsonapi.AbortWithError(c, wrapAuthError(err))
+		return
+	}
+	login(c)
+}
+
+func login(c *gin.Context) {
+	i := middlewares.GetInstance(c)
+	session, err := sessions.New(c.Request.Context(), i)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapAuthError(err))
+		return
+	}
+	middlewares.SetSessionCookies(c, session, int(sessions.MaxAge.Seconds()))
+	c.Status(http.StatusNoContent)
+}
+
+// logoutHandler handles DELETE /auth/login requests. It destroys the
+// session and removes the cookie.
+//
+// swagger:route DELETE /auth/login auth logout
+//
+// Responses:
+//   204: the session has been closed
+func logoutHandler(c *gin.Context) {
+	session := middlewares.GetSession(c)
+	if session == nil {
+		jsonapi.AbortWithError(c, jsonapi.Unauthorized(middlewares.ErrNotLoggedIn))
+		return
+	}
+	i := middlewares.GetInstance(c)
+	if err := session.Delete(c.Request.Context(), i); err != nil {
+		jsonapi.AbortWithError(c, wrapAuthError(err))
+		return
+	}
+	middlewares.SetSessionCookies(c, nil, -1)
+	c.Status(http.StatusNoContent)
+}
+
+// Routes sets the routing for the authentication
+func Routes(router *gin.RouterGroup) {
+	router.GET("/passphrase", onboardingForm)
+	router.POST("/passphrase", registerPassphrase)
+	router.POST("/login", loginHandler)
+	router.DELETE("/login", logoutHandler)
+	router.POST("/register", registerClient)
+	router.GET("/authorize", middlewares.NeedSession(), authorizeForm)
+	router.POST("/authorize", middlewares.NeedSession(), authorize)
+	router.POST("/access_token", accessToken)
+}
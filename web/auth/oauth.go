@@ -0,0 +1,307 @@
+package auth
+
+import (
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/oauth"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+// registrationMaxSize is the maximal size of the metadata of a client
+const registrationMaxSize = 64 * 1024
+
+// clientResponse is the response of a client registration (RFC 7591). The
+// fields of the CouchDB document are hidden by the empty fields with the
+// same JSON names.
+type clientResponse struct {
+	ClientID string `json:"client_id"`
+	*oauth.Client
+	CouchID  string `json:"_id,omitempty"`
+	CouchRev string `json:"_rev,omitempty"`
+}
+
+// tokenResponse is the response of the token endpoint (RFC 6749)
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+// oauthError sends an error in the format of the OAuth2 specifications,
+// used by the registration and the token endpoints
+func oauthError(c *gin.Context, status int, code string, err error) {
+	body := gin.H{"error": code}
+	if err != nil {
+		body["error_description"] = err.Error()
+	}
+	c.JSON(status, body)
+	c.Abort()
+}
+
+// registerClient handles POST /auth/register requests, for the dynamic
+// registration of the OAuth2 clients
+//
+// swagger:route POST /auth/register auth registerClient
+//
+// Responses:
+//   201: the registered client
+func registerClient(c *gin.Context) {
+	client := &oauth.Client{}
+	body := io.LimitReader(c.Request.Body, registrationMaxSize)
+	if err := json.NewDecoder(body).Decode(client); err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_client_metadata", err)
+		return
+	}
+
+	i := middlewares.GetInstance(c)
+	err := oauth.Register(c.Request.Context(), i.GetDatabasePrefix(), client)
+	switch err {
+	case nil:
+	case oauth.ErrInvalidRedirectURI:
+		oauthError(c, http.StatusBadRequest, "invalid_redirect_uri", err)
+		return
+	case oauth.ErrMissingClientName, oauth.ErrMissingSoftwareID:
+		oauthError(c, http.StatusBadRequest, "invalid_client_metadata", err)
+		return
+	default:
+		oauthError(c, http.StatusInternalServerError, "server_error", err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, &clientResponse{ClientID: client.ClientID, Client: client})
+}
+
+// authorizeRequest is an authorization request of a client, validated by
+// checkAuthorize
+type authorizeRequest struct {
+	Client              *oauth.Client
+	RedirectURI         string
+	State               string
+	Scope               apps.Scopes
+	CodeChallenge       string
+	CodeChallengeMethod string
+	CSRFToken           string
+}
+
+// checkAuthorize validates the parameters of an authorization request. If
+// the client or its redirect URI is not valid, an error is sent to the
+// browser. Else, the errors are sent to the client, via the redirect URI.
+func checkAuthorize(c *gin.Context, params url.Values) *authorizeRequest {
+	i := middlewares.GetInstance(c)
+	client, err := oauth.FindClient(c.Request.Context(), i.GetDatabasePrefix(), params.Get("client_id"))
+	if err == oauth.ErrInvalidClient {
+		jsonapi.AbortWithError(c, jsonapi.InvalidParameter("client_id", err))
+		return nil
+	}
+	if err != nil {
+		jsonapi.AbortWithError(c, jsonapi.InternalServerError(err))
+		return nil
+	}
+	redirectURI := params.Get("redirect_uri")
+	if !client.AcceptRedirectURI(redirectURI) {
+		jsonapi.AbortWithError(c, jsonapi.InvalidParameter("redirect_uri", oauth.ErrInvalidRedirectURI))
+		return nil
+	}
+
+	req := &authorizeRequest{
+		Client:              client,
+		RedirectURI:         redirectURI,
+		State:               params.Get("state"),
+		CodeChallenge:       params.Get("code_challenge"),
+		CodeChallengeMethod: params.Get("code_challenge_method"),
+	}
+	if params.Get("response_type") != "code" {
+		redirectClient(c, req, url.Values{"error": {"unsupported_response_type"}})
+		return nil
+	}
+	req.Scope, err = apps.ParseScopeString(params.Get("scope"))
+	if err != nil {
+		redirectClient(c, req, url.Values{"error": {"invalid_scope"}})
+		return nil
+	}
+	if err = oauth.CheckCodeChallenge(req.CodeChallenge, req.CodeChallengeMethod); err != nil {
+		redirectClient(c, req, url.Values{
+			"error":             {"invalid_request"},
+			"error_description": {err.Error()},
+		})
+		return nil
+	}
+	return req
+}
+
+// redirectClient redirects the browser to the client, with the given
+// parameters and the state of the request
+func redirectClient(c *gin.Context, req *authorizeRequest, params url.Values) {
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		jsonapi.AbortWithError(c, jsonapi.InvalidParameter("redirect_uri", err))
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	u.RawQuery = q.Encode()
+	c.Redirect(http.StatusFound, u.String())
+	c.Abort()
+}
+
+// authorizeTemplate is the page where the owner of the instance accepts to
+// give some permissions to a client
+var authorizeTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Authorize {{.Client.ClientName}}</title>
+</head>
+<body>
+<h1>{{.Client.ClientName}} wants to access your cozy</h1>
+<ul>
+{{range .Scope}}<li>{{.}}</li>
+{{end}}</ul>
+<form method="POST" action="/auth/authorize">
+<input type="hidden" name="client_id" value="{{.Client.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="response_type" value="code">
+<input type="hidden" name="scope" value="{{.ScopeString}}">
+{{if .CodeChallenge}}<input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.CodeChallengeMethod}}">
+{{end}}<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<button type="submit">Authorize</button>
+</form>
+</body>
+</html>
+`))
+
+// ScopeString returns the scope of the request, for the form
+func (req *authorizeRequest) ScopeString() string {
+	return req.Scope.String()
+}
+
+// authorizeForm handles GET /auth/authorize requests. It shows to the
+// logged-in owner of the instance the permissions asked by the client. The
+// page can't be embedded in a frame, where a malicious site could trick
+// the owner into clicking on the button.
+//
+// swagger:route GET /auth/authorize auth authorizeForm
+//
+// Produces:
+//   - text/html
+func authorizeForm(c *gin.Context) {
+	req := checkAuthorize(c, c.Request.URL.Query())
+	if req == nil {
+		return
+	}
+	req.CSRFToken = middlewares.GetSession(c).CSRFToken()
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	c.Status(http.StatusOK)
+	if err := authorizeTemplate.Execute(c.Writer, req); err != nil {
+		c.Error(err)
+	}
+}
+
+// authorize handles POST /auth/authorize requests, when the owner accepts
+// the request of the client. The browser is redirected to the client with
+// an authorization code. The form has the CSRF token of the session, checked
+// by the CheckCSRF middleware.
+//
+// swagger:route POST /auth/authorize auth authorize
+//
+// Consumes:
+//   - application/x-www-form-urlencoded
+//
+// Responses:
+//   302: the redirection to the client with the authorization code
+func authorize(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		jsonapi.AbortWithError(c, jsonapi.BadRequest(err))
+		return
+	}
+	req := checkAuthorize(c, c.Request.PostForm)
+	if req == nil {
+		return
+	}
+	i := middlewares.GetInstance(c)
+	code, err := oauth.CreateAccessCode(c.Request.Context(), i.GetDatabasePrefix(), req.Client, req.Scope, req.RedirectURI, req.CodeChallenge)
+	if err != nil {
+		redirectClient(c, req, url.Values{"error": {"server_error"}})
+		return
+	}
+	redirectClient(c, req, url.Values{"code": {code.Code}})
+}
+
+// accessToken handles POST /auth/access_token requests. It gives an access
+// token to the client, in exchange of an authorization code or a refresh
+// token.
+//
+// swagger:route POST /auth/access_token auth accessToken
+//
+// Consumes:
+//   - application/x-www-form-urlencoded
+func accessToken(c *gin.Context) {
+	i := middlewares.GetInstance(c)
+	ctx := c.Request.Context()
+	db := i.GetDatabasePrefix()
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	client, err := oauth.Authenticate(ctx, db, c.PostForm("client_id"), c.PostForm("client_secret"))
+	if err == oauth.ErrInvalidClient {
+		oauthError(c, http.StatusUnauthorized, "invalid_client", err)
+		return
+	}
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", err)
+		return
+	}
+
+	var access, refresh *oauth.Token
+	switch grant := c.PostForm("grant_type"); grant {
+	case "authorization_code":
+		access, refresh, err = oauth.ExchangeCode(ctx, db, client, c.PostForm("code"), c.PostForm("redirect_uri"), c.PostForm("code_verifier"))
+	case "refresh_token":
+		access, err = oauth.Refresh(ctx, db, client, c.PostForm("refresh_token"))
+	case "":
+		oauthError(c, http.StatusBadRequest, "invalid_request", nil)
+		return
+	default:
+		oauthError(c, http.StatusBadRequest, "unsupported_grant_type", nil)
+		return
+	}
+	if err == oauth.ErrInvalidGrant {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", err)
+		return
+	}
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", err)
+		return
+	}
+
+	res := &tokenResponse{
+		AccessToken: access.TokenID,
+		TokenType:   "bearer",
+		ExpiresIn:   int(oauth.AccessTokenTTL.Seconds()),
+		Scope:       access.Scope.String(),
+	}
+	if refresh != nil {
+		res.RefreshToken = refresh.TokenID
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,158 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrInvalidAllDocsParam is used for a limit, startkey or include_docs
+// parameter of _all_docs that can't be parsed
+var ErrInvalidAllDocsParam = errors.New("The parameter must be a positive integer for limit, a document id for startkey, and a boolean for include_docs")
+
+// jsonapiDoc is a document of the data API, as a JSON-API object
+type jsonapiDoc struct {
+	couchdb.JSONDoc
+}
+
+// SelfLink is part of the jsonapi.Object interface
+func (d jsonapiDoc) SelfLink() string {
+	return "/data/" + d.Type + "/" + d.ID()
+}
+
+// Relationships is part of the jsonapi.Object interface
+func (d jsonapiDoc) Relationships() jsonapi.RelationshipMap {
+	return nil
+}
+
+// Included is part of the jsonapi.Object interface
+func (d jsonapiDoc) Included() []jsonapi.Object {
+	return nil
+}
+
+// MarshalJSON returns the attributes of the document, without the _id and
+// _rev fields that are the id and meta.rev of the JSON-API object
+func (d jsonapiDoc) MarshalJSON() ([]byte, error) {
+	attrs := make(map[string]interface{}, len(d.M))
+	for k, v := range d.M {
+		if k != "_id" && k != "_rev" && k != "_type" {
+			attrs[k] = v
+		}
+	}
+	return json.Marshal(attrs)
+}
+
+// allDocsParams reads the limit, startkey and include_docs parameters of
+// an _all_docs request. The startkey is a document id, that can be quoted
+// like for CouchDB.
+func allDocsParams(query url.Values) (*couchdb.AllDocsRequest, string) {
+	req := &couchdb.AllDocsRequest{Limit: defaultFindLimit}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, "limit"
+		}
+		req.Limit = n
+	}
+	if req.Limit > maxFindLimit {
+		req.Limit = maxFindLimit
+	}
+	req.StartKey = query.Get("startkey")
+	if strings.HasPrefix(req.StartKey, `"`) {
+		if err := json.Unmarshal([]byte(req.StartKey), &req.StartKey); err != nil {
+			return nil, "startkey"
+		}
+	}
+	if include := query.Get("include_docs"); include != "" {
+		b, err := strconv.ParseBool(include)
+		if err != nil {
+			return nil, "include_docs"
+		}
+		req.IncludeDocs = b
+	}
+	return req, ""
+}
+
+// nextAllDocsLink returns the link to the next page of _all_docs, with the
+// same parameters and the id of its first document as startkey
+func nextAllDocsLink(u *url.URL, startkey string) string {
+	q := u.Query()
+	q.Set("startkey", startkey)
+	return (&url.URL{Path: u.Path, RawQuery: q.Encode()}).String()
+}
+
+// allDocs handles GET /data/:doctype/_all_docs requests. It returns the
+// documents of a doctype in the order of their ids, by pages of limit
+// documents, from the startkey parameter. The response is the one of
+// CouchDB, with the link to the next page in a Link header, or a JSON-API
+// document if the client accepts it, with the link in links.next. The
+// design documents are not sent.
+//
+// swagger:route GET /data/:doctype/_all_docs data allDocs
+func allDocs(c *gin.Context) {
+	doctype := c.MustGet("doctype").(string)
+	req, param := allDocsParams(c.Request.URL.Query())
+	if param != "" {
+		jsonapi.AbortWithError(c, jsonapi.InvalidParameter(param, ErrInvalidAllDocsParam))
+		return
+	}
+	asJSONAPI := strings.Contains(c.Request.Header.Get("Accept"), jsonapi.ContentType)
+	if asJSONAPI {
+		req.IncludeDocs = true
+	}
+
+	// one more document is fetched to know the startkey of the next page
+	limit := req.Limit
+	req.Limit++
+	instance := middlewares.GetInstance(c)
+	res, err := couchdb.GetAllDocs(c.Request.Context(), instance.GetDatabasePrefix(), doctype, req)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapDataError(err))
+		return
+	}
+
+	next := ""
+	if len(res.Rows) > limit {
+		next = res.Rows[limit].ID
+		res.Rows = res.Rows[:limit]
+	}
+	rows := make([]couchdb.AllDocsRow, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		if !strings.HasPrefix(row.ID, designDocPrefix) {
+			rows = append(rows, row)
+		}
+	}
+	res.Rows = rows
+
+	if !asJSONAPI {
+		if next != "" {
+			c.Header("Link", `<`+nextAllDocsLink(c.Request.URL, next)+`>; rel="next"`)
+		}
+		c.JSON(http.StatusOK, res)
+		return
+	}
+
+	objs := make([]jsonapi.Object, 0, len(rows))
+	for _, row := range rows {
+		doc := jsonapiDoc{couchdb.JSONDoc{Type: doctype}}
+		if err := json.Unmarshal(row.Doc, &doc.JSONDoc); err != nil {
+			jsonapi.AbortWithError(c, jsonapi.InternalServerError(err))
+			return
+		}
+		doc.Type = doctype
+		objs = append(objs, doc)
+	}
+	var links *jsonapi.LinksList
+	if next != "" {
+		links = &jsonapi.LinksList{Next: nextAllDocsLink(c.Request.URL, next)}
+	}
+	jsonapi.DataList(c, http.StatusOK, objs, links)
+}
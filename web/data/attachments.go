@@ -0,0 +1,164 @@
+package data
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/vfs"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+// maxAttachmentSize is the maximal size of an attachment, in bytes. The
+// attachments are for small binary payloads, like avatars or icons, the
+// files API should be used for the larger ones.
+const maxAttachmentSize = 10 << 20
+
+// defaultAttachmentType is the Content-Type of an attachment sent without
+// one
+const defaultAttachmentType = "application/octet-stream"
+
+// safeAttachmentTypes are the types of the attachments that a browser
+// can display inline without running a script. The other ones, like HTML or
+// SVG, are always downloaded.
+var safeAttachmentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"text/plain": true,
+}
+
+// ErrAttachmentTooLarge is used when the content of an attachment is larger
+// than maxAttachmentSize
+var ErrAttachmentTooLarge = errors.New("The attachment is too large")
+
+// putAttachment handles PUT /data/:doctype/:docid/:attachment-name
+// requests. The body of the request is streamed to CouchDB as the content
+// of the attachment, that is added to the document or replaces the
+// previous one. The revision of the document must be given in the If-Match
+// header or the rev parameter, except to create a new document with only
+// this attachment.
+//
+// swagger:route PUT /data/:doctype/:docid/:attachment-name data putAttachment
+//
+// Consumes:
+//   - */*
+//
+// Responses:
+//   201: the new revision of the document
+func putAttachment(c *gin.Context) {
+	instance := middlewares.GetInstance(c)
+	doctype := c.MustGet("doctype").(string)
+	docid := c.Param("docid")
+	name := c.Param("attachment-name")
+
+	if c.Request.ContentLength > maxAttachmentSize {
+		jsonapi.AbortWithError(c, jsonapi.PayloadTooLarge(ErrAttachmentTooLarge))
+		return
+	}
+	rev, err := requestRev(c, "")
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapDataError(err))
+		return
+	}
+	contentType := c.ContentType()
+	if contentType == "" {
+		contentType = defaultAttachmentType
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxAttachmentSize)
+	newrev, err := couchdb.PutAttachment(c.Request.Context(), instance.GetDatabasePrefix(),
+		doctype, docid, rev, name, contentType, body)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapDataError(err))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"ok":   true,
+		"id":   docid,
+		"rev":  newrev,
+		"type": doctype,
+	})
+}
+
+// getAttachment handles GET /data/:doctype/:docid/:attachment-name
+// requests. The content of the attachment is streamed from CouchDB, with
+// its digest as ETag. As its type is chosen by the client that has put it,
+// the attachment is sandboxed, and downloaded unless its type is safe.
+//
+// swagger:route GET /data/:doctype/:docid/:attachment-name data getAttachment
+//
+// Produces:
+//   - */*
+func getAttachment(c *gin.Context) {
+	instance := middlewares.GetInstance(c)
+	doctype := c.MustGet("doctype").(string)
+	docid := c.Param("docid")
+	name := c.Param("attachment-name")
+
+	att, err := couchdb.GetAttachment(c.Request.Context(), instance.GetDatabasePrefix(),
+		doctype, docid, name)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapDataError(err))
+		return
+	}
+	defer att.Body.Close()
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", att.ContentType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "sandbox")
+	if mediatype, _, err := mime.ParseMediaType(att.ContentType); err != nil || !safeAttachmentTypes[mediatype] {
+		header.Set("Content-Disposition", vfs.ContentDisposition("attachment", name))
+	}
+	if att.Length >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(att.Length, 10))
+	}
+	if att.Digest != "" {
+		header.Set("Etag", att.Digest)
+	}
+	c.Status(http.StatusOK)
+	io.Copy(c.Writer, att.Body)
+}
+
+// deleteAttachment handles DELETE /data/:doctype/:docid/:attachment-name
+// requests. Like for the deletion of a document, the revision must be
+// given in the rev parameter or the If-Match header.
+//
+// swagger:route DELETE /data/:doctype/:docid/:attachment-name data deleteAttachment
+func deleteAttachment(c *gin.Context) {
+	instance := middlewares.GetInstance(c)
+	doctype := c.MustGet("doctype").(string)
+	docid := c.Param("docid")
+	name := c.Param("attachment-name")
+
+	rev, err := requestRev(c, "")
+	if err == nil && rev == "" {
+		err = ErrMissingRev
+	}
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapDataError(err))
+		return
+	}
+
+	newrev, err := couchdb.DeleteAttachment(c.Request.Context(), instance.GetDatabasePrefix(),
+		doctype, docid, rev, name)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapDataError(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":   true,
+		"id":   docid,
+		"rev":  newrev,
+		"type": doctype,
+	})
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/doctypes"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+// maxBulkDocs is the maximal number of documents in a _bulk_docs request
+const maxBulkDocs = 1000
+
+var (
+	// ErrMissingDocs is used when a _bulk_docs request has no documents
+	ErrMissingDocs = errors.New("The request must have a list of documents")
+	// ErrTooManyDocs is used when a _bulk_docs request has more than
+	// maxBulkDocs documents
+	ErrTooManyDocs = errors.New("The request has too many documents")
+)
+
+// bulkDocResult is the result of one document of a _bulk_docs request,
+// like in CouchDB: its id and new revision, or the error
+type bulkDocResult struct {
+	Ok     bool   `json:"ok,omitempty"`
+	ID     string `json:"id"`
+	Rev    string `json:"rev,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// readBulkDocs reads the documents of the body of a _bulk_docs request: a
+// list of documents, or an object with the list in docs, like for CouchDB
+func readBulkDocs(body []byte) ([]couchdb.JSONDoc, error) {
+	var docs []couchdb.JSONDoc
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		if err := json.Unmarshal(body, &docs); err != nil {
+			return nil, err
+		}
+	} else {
+		var req struct {
+			Docs []couchdb.JSONDoc `json:"docs"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, err
+		}
+		docs = req.Docs
+	}
+	return docs, nil
+}
+
+// bulkDocs handles POST /data/:doctype/_bulk_docs requests. It creates,
+// updates and deletes several documents of a doctype in a single request,
+// and returns the result of each document in the same order. The documents
+// without _id are created, and the ones with _deleted are deleted. A
+// document that can't be written, like an update with a stale revision,
+// does not prevent the others to be written, but nothing is written if a
+// document doesn't match the schema of the doctype.
+//
+// swagger:route POST /data/:doctype/_bulk_docs data bulkDocs
+//
+// Responses:
+//   201: the results of the documents
+func bulkDocs(c *gin.Context) {
+	doctype := c.MustGet("doctype").(string)
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		jsonapi.AbortWithError(c, jsonapi.BadJSON())
+		return
+	}
+	docs, err := readBulkDocs(body)
+	if err != nil {
+		jsonapi.AbortWithError(c, jsonapi.BadJSON())
+		return
+	}
+	if len(docs) == 0 {
+		jsonapi.AbortWithError(c, jsonapi.BadRequest(ErrMissingDocs))
+		return
+	}
+	if len(docs) > maxBulkDocs {
+		jsonapi.AbortWithError(c, jsonapi.BadRequest(ErrTooManyDocs))
+		return
+	}
+
+	couchDocs := make([]couchdb.Doc, len(docs))
+	var invalid jsonapi.ErrorList
+	for i := range docs {
+		if docs[i].M == nil {
+			jsonapi.AbortWithError(c, jsonapi.BadJSON())
+			return
+		}
+		docs[i].Type = doctype
+		couchDocs[i] = docs[i]
+		if deleted, _ := docs[i].M["_deleted"].(bool); !deleted {
+			errs := doctypes.Validate(doctype, docs[i].M)
+			invalid = append(invalid, validationErrors("/"+strconv.Itoa(i), errs)...)
+		}
+	}
+	if len(invalid) > 0 {
+		jsonapi.AbortWithErrors(c, invalid)
+		return
+	}
+
+	instance := middlewares.GetInstance(c)
+	res, err := couchdb.BulkDocsResults(c.Request.Context(), instance.GetDatabasePrefix(), doctype, couchDocs)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapDataError(err))
+		return
+	}
+
+	results := make([]bulkDocResult, len(res))
+	for i, r := range res {
+		results[i] = bulkDocResult{
+			Ok:     r.Ok(),
+			ID:     r.ID,
+			Rev:    r.Rev,
+			Error:  r.Error,
+			Reason: r.Reason,
+		}
+	}
+	c.JSON(http.StatusCreated, results)
+}
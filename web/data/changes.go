@@ -0,0 +1,67 @@
+package data
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrInvalidChangesParam is used for a limit or include_docs parameter of
+// the changes feed that can't be parsed
+var ErrInvalidChangesParam = errors.New("The parameter must be a positive integer for limit, and a boolean for include_docs")
+
+// designDocPrefix is the prefix of the ids of the design documents, where
+// the stack keeps the indexes of the doctypes
+const designDocPrefix = "_design/"
+
+// changesFeed handles GET /data/:doctype/_changes requests. It returns the
+// changes of the documents of a doctype, since the since parameter, like
+// the _changes of CouchDB, so that the client-side databases like PouchDB
+// can replicate the doctype. The design documents are not sent.
+//
+// swagger:route GET /data/:doctype/_changes data changesFeed
+func changesFeed(c *gin.Context) {
+	doctype := c.MustGet("doctype").(string)
+	req := &couchdb.ChangesRequest{
+		Feed:  couchdb.NormalFeed,
+		Since: couchdb.Seq(c.Query("since")),
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			jsonapi.AbortWithError(c, jsonapi.InvalidParameter("limit", ErrInvalidChangesParam))
+			return
+		}
+		req.Limit = n
+	}
+	if include := c.Query("include_docs"); include != "" {
+		b, err := strconv.ParseBool(include)
+		if err != nil {
+			jsonapi.AbortWithError(c, jsonapi.InvalidParameter("include_docs", ErrInvalidChangesParam))
+			return
+		}
+		req.IncludeDocs = b
+	}
+
+	instance := middlewares.GetInstance(c)
+	res, err := couchdb.GetChanges(c.Request.Context(), instance.GetDatabasePrefix(), doctype, req)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapDataError(err))
+		return
+	}
+
+	results := make([]couchdb.Change, 0, len(res.Results))
+	for _, change := range res.Results {
+		if !strings.HasPrefix(change.DocID, designDocPrefix) {
+			results = append(results, change)
+		}
+	}
+	res.Results = results
+	c.JSON(http.StatusOK, res)
+}
@@ -2,10 +2,12 @@
 package data
 
 import (
-	"fmt"
-	"net/http"
+	"strings"
 
+	"github.com/dcasier/cozy-stack/apps"
 	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/doctypes"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
 	"github.com/dcasier/cozy-stack/web/middlewares"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
@@ -15,31 +17,54 @@ func validDoctype(c *gin.Context) {
 	// TODO extends me to verificate characters allowed in db name.
 	doctype := c.Param("doctype")
 	if doctype == "" {
-		c.AbortWithError(http.StatusBadRequest, invalidDoctypeErr(doctype))
+		jsonapi.AbortWithError(c, jsonapi.BadRequest(invalidDoctypeErr(doctype)))
+	} else if apps.IsInternalDoctype(doctype) {
+		// even for the owner, so that the secrets and the rights of the
+		// instance are only changed by the stack
+		jsonapi.AbortWithError(c, jsonapi.Forbidden(ErrInternalDoctype))
 	} else {
 		c.Set("doctype", doctype)
 	}
 }
 
 // GetDoc get a doc by its type and id
+//
+// swagger:route GET /data/:doctype/:docid data getDoc
 func getDoc(c *gin.Context) {
 	instance := middlewares.GetInstance(c)
 	doctype := c.MustGet("doctype").(string)
 	docid := c.Param("docid")
 
+	// @TODO: declare separate routes for the changes feed and _all_docs
+	// when switching to echo/httprouterv2
+	switch docid {
+	case "_changes":
+		changesFeed(c)
+		return
+	case "_all_docs":
+		allDocs(c)
+		return
+	}
+
 	prefix := instance.GetDatabasePrefix()
 
 	var out couchdb.JSONDoc
-	err := couchdb.GetDoc(prefix, doctype, docid, &out)
+	err := couchdb.GetDoc(c.Request.Context(), prefix, doctype, docid, &out)
 	if err != nil {
-		c.AbortWithError(HTTPStatus(err), err)
+		jsonapi.AbortWithError(c, wrapDataError(err))
 		return
 	}
 	out.Type = doctype
+	c.Header("Etag", `"`+out.Rev()+`"`)
 	c.JSON(200, out.ToMapWithType())
 }
 
 // CreateDoc create doc from the json passed as body
+//
+// swagger:route POST /data/:doctype/ data createDoc
+//
+// Responses:
+//   201: the created document
 func createDoc(c *gin.Context) {
 	doctype := c.MustGet("doctype").(string)
 	instance := middlewares.GetInstance(c)
@@ -47,19 +72,23 @@ func createDoc(c *gin.Context) {
 
 	var doc = couchdb.JSONDoc{Type: doctype}
 	if err := binding.JSON.Bind(c.Request, &doc.M); err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+		jsonapi.AbortWithError(c, jsonapi.BadJSON())
 		return
 	}
 
 	if doc.ID() != "" {
-		err := fmt.Errorf("Cannot create a document with _id")
-		c.AbortWithError(http.StatusBadRequest, err)
+		jsonapi.AbortWithError(c, wrapDataError(ErrCreateWithID))
+		return
+	}
+
+	if errs := doctypes.Validate(doctype, doc.M); len(errs) > 0 {
+		jsonapi.AbortWithErrors(c, validationErrors("", errs))
 		return
 	}
 
-	err := couchdb.CreateDoc(prefix, doc)
+	err := couchdb.CreateDoc(c.Request.Context(), prefix, doc)
 	if err != nil {
-		c.AbortWithError(HTTPStatus(err), err)
+		jsonapi.AbortWithError(c, wrapDataError(err))
 		return
 	}
 
@@ -72,40 +101,57 @@ func createDoc(c *gin.Context) {
 	})
 }
 
+// updateDoc updates a document, or creates it with the id of the URL if
+// the body has no _id. The revision of an update can be given in the _rev
+// field, the rev parameter or the If-Match header, and a revision that is
+// not the current one gives a 409 Conflict.
+//
+// swagger:route PUT /data/:doctype/:docid data updateDoc
 func updateDoc(c *gin.Context) {
 	instance := middlewares.GetInstance(c)
 	prefix := instance.GetDatabasePrefix()
 
 	var doc couchdb.JSONDoc
 	if err := binding.JSON.Bind(c.Request, &doc); err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+		jsonapi.AbortWithError(c, jsonapi.BadJSON())
 		return
 	}
 
 	doc.Type = c.Param("doctype")
 
+	rev, err := requestRev(c, doc.Rev())
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapDataError(err))
+		return
+	}
+	if rev != "" {
+		doc.SetRev(rev)
+	}
+
 	if (doc.ID() == "") != (doc.Rev() == "") {
-		err := fmt.Errorf("You must either provide an _id and _rev in document (update) or neither (create with  fixed id).")
-		c.AbortWithError(http.StatusBadRequest, err)
+		jsonapi.AbortWithError(c, wrapDataError(ErrIDWithoutRev))
 		return
 	}
 
 	if doc.ID() != "" && doc.ID() != c.Param("docid") {
-		err := fmt.Errorf("document _id doesnt match url")
-		c.AbortWithError(http.StatusBadRequest, err)
+		jsonapi.AbortWithError(c, wrapDataError(ErrIDMismatch))
+		return
+	}
+
+	if errs := doctypes.Validate(doc.Type, doc.M); len(errs) > 0 {
+		jsonapi.AbortWithErrors(c, validationErrors("", errs))
 		return
 	}
 
-	var err error
 	if doc.ID() == "" {
 		doc.SetID(c.Param("docid"))
-		err = couchdb.CreateNamedDoc(prefix, doc)
+		err = couchdb.CreateNamedDoc(c.Request.Context(), prefix, doc)
 	} else {
-		err = couchdb.UpdateDoc(prefix, doc)
+		err = couchdb.UpdateDoc(c.Request.Context(), prefix, doc)
 	}
 
 	if err != nil {
-		c.AbortWithError(HTTPStatus(err), err)
+		jsonapi.AbortWithError(c, wrapDataError(err))
 		return
 	}
 
@@ -118,32 +164,29 @@ func updateDoc(c *gin.Context) {
 	})
 }
 
+// deleteDoc deletes a document. Its revision must be given in the rev
+// parameter or the If-Match header, and a revision that is not the current
+// one gives a 409 Conflict.
+//
+// swagger:route DELETE /data/:doctype/:docid data deleteDoc
 func deleteDoc(c *gin.Context) {
 	instance := middlewares.GetInstance(c)
 	doctype := c.MustGet("doctype").(string)
 	docid := c.Param("docid")
 	prefix := instance.GetDatabasePrefix()
-	revHeader := c.Request.Header.Get("If-Match")
-	revQuery := c.Query("rev")
-	rev := ""
 
-	if revHeader != "" && revQuery != "" && revQuery != revHeader {
-		err := fmt.Errorf("If-Match Header and rev query parameters mismatch")
-		c.AbortWithError(http.StatusBadRequest, err)
-		return
-	} else if revHeader != "" {
-		rev = revHeader
-	} else if revQuery != "" {
-		rev = revQuery
-	} else {
-		err := fmt.Errorf("delete without revision")
-		c.AbortWithError(http.StatusBadRequest, err)
+	rev, err := requestRev(c, "")
+	if err == nil && rev == "" {
+		err = ErrMissingRev
+	}
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapDataError(err))
 		return
 	}
 
-	tombrev, err := couchdb.Delete(prefix, doctype, docid, rev)
+	tombrev, err := couchdb.Delete(c.Request.Context(), prefix, doctype, docid, rev)
 	if err != nil {
-		c.AbortWithError(HTTPStatus(err), err)
+		jsonapi.AbortWithError(c, wrapDataError(err))
 		return
 	}
 
@@ -154,14 +197,42 @@ func deleteDoc(c *gin.Context) {
 		"type":    doctype,
 		"deleted": true,
 	})
+}
 
+// requestRev returns the revision of the document given by the client, in
+// the If-Match header, the rev parameter or the _rev field of the body. The
+// ETag of the GET routes can be used as is in the If-Match header. It is
+// an error to give different revisions.
+func requestRev(c *gin.Context, bodyRev string) (string, error) {
+	header := strings.TrimPrefix(c.Request.Header.Get("If-Match"), "W/")
+	header = strings.Trim(header, `"`)
+	rev := ""
+	for _, r := range []string{header, c.Query("rev"), bodyRev} {
+		if r == "" {
+			continue
+		}
+		if rev != "" && r != rev {
+			return "", ErrRevMismatch
+		}
+		rev = r
+	}
+	return rev, nil
 }
 
 // Routes sets the routing for the status service
 func Routes(router *gin.RouterGroup) {
-	router.GET("/:doctype/:docid", validDoctype, getDoc)
-	router.PUT("/:doctype/:docid", validDoctype, updateDoc)
-	router.DELETE("/:doctype/:docid", validDoctype, deleteDoc)
-	router.POST("/:doctype/", validDoctype, createDoc)
+	router.GET("/:doctype", listDoctypes)
+	router.GET("/:doctype/:docid", validDoctype, middlewares.AllowDoctype(), getDoc)
+	jsonBody := middlewares.BodyLimit(middlewares.BodyLimitJSON)
+	router.PUT("/:doctype/:docid", jsonBody, validDoctype, middlewares.AllowDoctype(), updateDoc)
+	router.DELETE("/:doctype/:docid", validDoctype, middlewares.AllowDoctype(), deleteDoc)
+	router.POST("/:doctype/", jsonBody, validDoctype, middlewares.AllowDoctype(), createDoc)
+	router.POST("/:doctype/_find", jsonBody, validDoctype, findDocs)
+	router.POST("/:doctype/_bulk_docs", jsonBody, validDoctype, middlewares.AllowDoctype(), bulkDocs)
+	router.GET("/:doctype/:docid/:attachment-name", validDoctype, middlewares.AllowDoctype(), getAttachment)
+	// the attachments are streamed to CouchDB, with their own limit
+	router.PUT("/:doctype/:docid/:attachment-name", middlewares.BodyLimit(middlewares.BodyLimitFiles),
+		validDoctype, middlewares.AllowDoctype(), putAttachment)
+	router.DELETE("/:doctype/:docid/:attachment-name", validDoctype, middlewares.AllowDoctype(), deleteAttachment)
 	// router.DELETE("/:doctype/:docid", DeleteDoc)
 }
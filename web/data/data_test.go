@@ -2,26 +2,32 @@ package data
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/couchdb/couchdbtest"
+	"github.com/dcasier/cozy-stack/doctypes"
 	"github.com/dcasier/cozy-stack/instance"
 	"github.com/dcasier/cozy-stack/web/middlewares"
 	"github.com/gin-gonic/gin"
-	"github.com/sourcegraph/checkup"
 	"github.com/stretchr/testify/assert"
 )
 
 var client = &http.Client{}
 
-const CouchURL = "http://localhost:5984/"
+// CouchURL is the URL of the CouchDB used by the tests, see TestMain
+var CouchURL string
+
 const Host = "example.com"
 const Type = "io.cozy.events"
 const ID = "4521C325F6478E45"
@@ -106,15 +112,25 @@ func injectInstance(instance *instance.Instance) gin.HandlerFunc {
 
 func getDocForTest() couchdb.JSONDoc {
 	doc := couchdb.JSONDoc{Type: Type, M: map[string]interface{}{"test": "value"}}
-	couchdb.CreateDoc(TestPrefix, &doc)
+	couchdb.CreateDoc(context.Background(), TestPrefix, &doc)
 	return doc
 }
 
+func assertJSONAPIError(t *testing.T, out map[string]interface{}, status, detail string) {
+	errs, ok := out["errors"].([]interface{})
+	if !assert.True(t, ok, "should give a JSON-API error") || !assert.Len(t, errs, 1) {
+		return
+	}
+	e := errs[0].(map[string]interface{})
+	assert.Equal(t, status, e["status"])
+	assert.Equal(t, detail, e["detail"])
+}
+
 func TestMain(m *testing.M) {
-	// First we make sure couchdb is started
-	couchdb, err := checkup.HTTPChecker{URL: CouchURL}.Check()
-	if err != nil || couchdb.Status() != checkup.Healthy {
-		fmt.Println("This test need couchdb to run.")
+	var stop func()
+	CouchURL, stop = couchdbtest.Start()
+	if err := couchdb.UseServer(couchdb.ServerOptions{URL: CouchURL}); err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
 
@@ -133,8 +149,10 @@ func TestMain(m *testing.M) {
 	couchReq("PUT", ExpectedDBName, nil)
 	couchReq("PUT", ExpectedDBName+"/"+ID, bytes.NewReader(DOCUMENT))
 
-	defer ts.Close()
-	os.Exit(m.Run())
+	res := m.Run()
+	ts.Close()
+	stop()
+	os.Exit(res)
 }
 
 func TestSuccessGet(t *testing.T) {
@@ -154,13 +172,33 @@ func TestWrongDoctype(t *testing.T) {
 	out, res, err := doRequest(req, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, "404 Not Found", res.Status, "should get a 404")
-	if assert.Contains(t, out, "error") {
-		assert.Equal(t, "not_found", out["error"], "should give a json error")
-	}
-	if assert.Contains(t, out, "reason") {
-		assert.Equal(t, "wrong_doctype", out["reason"], "should give a reason")
+	assertJSONAPIError(t, out, "404", "not_found: wrong_doctype")
+}
+
+func TestInternalDoctype(t *testing.T) {
+	for _, path := range []string{"/data/io.cozy.settings/io.cozy.settings.instance", "/data/io.cozy.apps.tokens/_all_docs"} {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Header.Add("Host", Host)
+		out, res, err := doRequest(req, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "403 Forbidden", res.Status, path)
+		assertJSONAPIError(t, out, "403", ErrInternalDoctype.Error())
 	}
 
+	req, _ := http.NewRequest("POST", ts.URL+"/data/io.cozy.apps.tokens/", strings.NewReader(`{"slug": "mini"}`))
+	req.Header.Add("Host", Host)
+	req.Header.Add("Content-Type", "application/json")
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "403 Forbidden", res.Status)
+
+	// the files can only be modified by the /files routes
+	req, _ = http.NewRequest("DELETE", ts.URL+"/data/io.cozy.files/io.cozy.files.rootdir", nil)
+	req.Header.Add("Host", Host)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "403 Forbidden", res.Status)
+	assertJSONAPIError(t, out, "403", ErrInternalDoctype.Error())
 }
 
 func TestWrongID(t *testing.T) {
@@ -169,12 +207,7 @@ func TestWrongID(t *testing.T) {
 	out, res, err := doRequest(req, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, "404 Not Found", res.Status, "should get a 404")
-	if assert.Contains(t, out, "error") {
-		assert.Equal(t, "not_found", out["error"], "should give a json error")
-	}
-	if assert.Contains(t, out, "reason") {
-		assert.Equal(t, "missing", out["reason"], "should give a reason")
-	}
+	assertJSONAPIError(t, out, "404", "not_found: missing")
 }
 
 func TestWrongHost(t *testing.T) {
@@ -362,9 +395,63 @@ func TestPreviousRevInDocUpdate(t *testing.T) {
 	})
 	req2, _ := http.NewRequest("PUT", url, in2)
 	req2.Header.Add("Host", Host)
-	_, res2, err := doRequest(req2, nil)
+	out, res2, err := doRequest(req2, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, "409 Conflict", res2.Status, "should get a 409")
+	assertJSONAPIError(t, out, "409", "conflict: Document update conflict.")
+}
+
+func TestUpdateIfMatch(t *testing.T) {
+	doc := getDocForTest()
+	url := ts.URL + "/data/" + doc.DocType() + "/" + doc.ID()
+
+	// the ETag of the GET can be used in the If-Match header
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("Host", Host)
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	etag := res.Header.Get("Etag")
+	assert.Equal(t, `"`+doc.Rev()+`"`, etag)
+
+	var in = jsonReader(&map[string]interface{}{
+		"_id":       doc.ID(),
+		"somefield": "anewvalue",
+	})
+	req, _ = http.NewRequest("PUT", url, in)
+	req.Header.Add("Host", Host)
+	req.Header.Add("If-Match", etag)
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should update with the If-Match revision")
+
+	// the revision is no longer the current one
+	in = jsonReader(&map[string]interface{}{
+		"_id":       doc.ID(),
+		"somefield": "anewvalue2",
+	})
+	req, _ = http.NewRequest("PUT", url, in)
+	req.Header.Add("Host", Host)
+	req.Header.Add("If-Match", etag)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "409 Conflict", res.Status, "should get a 409")
+	assertJSONAPIError(t, out, "409", "conflict: Document update conflict.")
+}
+
+func TestUpdateIfMatchAndRevMismatch(t *testing.T) {
+	doc := getDocForTest()
+	url := ts.URL + "/data/" + doc.DocType() + "/" + doc.ID()
+	var in = jsonReader(&map[string]interface{}{
+		"_id":       doc.ID(),
+		"_rev":      doc.Rev(),
+		"somefield": "anewvalue",
+	})
+	req, _ := http.NewRequest("PUT", url, in)
+	req.Header.Add("Host", Host)
+	req.Header.Add("If-Match", "1-238238232322121")
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "400 Bad Request", res.Status, "should get a 400")
 }
 
 func TestSuccessDeleteIfMatch(t *testing.T) {
@@ -396,10 +483,29 @@ func TestFailDeleteIfNotMatch(t *testing.T) {
 	req, _ := http.NewRequest("DELETE", url, nil)
 	req.Header.Add("If-Match", "1-238238232322121") // not correct rev
 	req.Header.Add("Host", Host)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "409 Conflict", res.Status, "should get a 409")
+	assertJSONAPIError(t, out, "409", "conflict: Document update conflict.")
+}
+
+func TestSuccessDeleteRevQuery(t *testing.T) {
+	doc := getDocForTest()
+	url := ts.URL + "/data/" + doc.DocType() + "/" + doc.ID() + "?rev=" + doc.Rev()
+	req, _ := http.NewRequest("DELETE", url, nil)
+	req.Header.Add("Host", Host)
 	var out stackUpdateResponse
 	_, res, err := doRequest(req, &out)
 	assert.NoError(t, err)
-	assert.Equal(t, "409 Conflict", res.Status, "should get a 409")
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	assert.True(t, out.Deleted)
+
+	// the document is now deleted
+	req, _ = http.NewRequest("DELETE", url, nil)
+	req.Header.Add("Host", Host)
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "200 OK", res.Status)
 }
 
 func TestFailDeleteIfHeaderAndRevMismatch(t *testing.T) {
@@ -430,3 +536,343 @@ func TestFailDeleteIfNoRev(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "400 Bad Request", res.Status, "should get a 400")
 }
+
+func TestFindRequestValidation(t *testing.T) {
+	body := &findRequest{
+		Selector: json.RawMessage(`{"test": {"$gt": "a"}}`),
+		Sort:     json.RawMessage(`[{"test": "desc"}]`),
+		UseIndex: "_design/by-test",
+	}
+	req, e := body.toFindRequest()
+	if assert.Nil(t, e) {
+		assert.Equal(t, defaultFindLimit, req.Limit)
+		assert.Equal(t, "_design/by-test", req.UseIndex)
+		assert.Len(t, req.Sort, 1)
+	}
+
+	body.Limit = 5000
+	req, e = body.toFindRequest()
+	if assert.Nil(t, e) {
+		assert.Equal(t, maxFindLimit, req.Limit)
+	}
+
+	_, e = (&findRequest{}).toFindRequest()
+	if assert.NotNil(t, e) {
+		assert.Equal(t, "/selector", e.Source.Pointer)
+	}
+	_, e = (&findRequest{Selector: json.RawMessage(`{"test": {"$foo": 1}}`)}).toFindRequest()
+	if assert.NotNil(t, e) {
+		assert.Equal(t, "/selector", e.Source.Pointer)
+	}
+	_, e = (&findRequest{Selector: json.RawMessage(`{}`), Sort: json.RawMessage(`{"test": "asc"}`)}).toFindRequest()
+	if assert.NotNil(t, e) {
+		assert.Equal(t, "/sort", e.Source.Pointer)
+	}
+	_, e = (&findRequest{Selector: json.RawMessage(`{}`), Limit: -1}).toFindRequest()
+	assert.NotNil(t, e)
+}
+
+func TestFindDocs(t *testing.T) {
+	for _, v := range []string{"findme-1", "findme-2", "findme-3"} {
+		doc := couchdb.JSONDoc{Type: Type, M: map[string]interface{}{"findfield": v}}
+		assert.NoError(t, couchdb.CreateDoc(context.Background(), TestPrefix, &doc))
+	}
+
+	var in = jsonReader(&map[string]interface{}{
+		"selector": map[string]interface{}{"findfield": map[string]interface{}{"$gte": "findme-2"}},
+		"limit":    1,
+	})
+	req, _ := http.NewRequest("POST", ts.URL+"/data/"+Type+"/_find", in)
+	req.Header.Add("Host", Host)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	docs, ok := out["docs"].([]interface{})
+	if assert.True(t, ok) && assert.Len(t, docs, 1) {
+		doc := docs[0].(map[string]interface{})
+		assert.Equal(t, Type, doc["_type"])
+	}
+	assert.Equal(t, true, out["next"])
+	assert.NotEmpty(t, out["bookmark"])
+
+	in = jsonReader(&map[string]interface{}{
+		"selector": map[string]interface{}{"findfield": map[string]interface{}{"$where": "1"}},
+	})
+	req, _ = http.NewRequest("POST", ts.URL+"/data/"+Type+"/_find", in)
+	req.Header.Add("Host", Host)
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "400 Bad Request", res.Status, "should get a 400")
+}
+
+func TestChangesFeed(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/data/"+Type+"/_changes?limit=1", nil)
+	req.Header.Add("Host", Host)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	assert.Contains(t, out, "last_seq")
+	results, ok := out["results"].([]interface{})
+	if assert.True(t, ok) {
+		assert.Len(t, results, 1)
+	}
+
+	// a document created after the last sequence is in the next changes
+	since := fmt.Sprintf("%v", out["last_seq"])
+	doc := getDocForTest()
+	req, _ = http.NewRequest("GET", ts.URL+"/data/"+Type+"/_changes?include_docs=true&since="+since, nil)
+	req.Header.Add("Host", Host)
+	out, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	found := false
+	for _, r := range out["results"].([]interface{}) {
+		change := r.(map[string]interface{})
+		if change["id"] == doc.ID() {
+			found = true
+			assert.Contains(t, change, "doc")
+		}
+	}
+	assert.True(t, found, "should have the change of the new document")
+
+	req, _ = http.NewRequest("GET", ts.URL+"/data/"+Type+"/_changes?limit=foo", nil)
+	req.Header.Add("Host", Host)
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "422 Unprocessable Entity", res.Status, "should get a 422")
+}
+
+func TestReadBulkDocs(t *testing.T) {
+	docs, err := readBulkDocs([]byte(` [{"a": 1}, {"_id": "foo", "_rev": "1-abc"}]`))
+	if assert.NoError(t, err) && assert.Len(t, docs, 2) {
+		assert.Equal(t, "foo", docs[1].ID())
+	}
+	docs, err = readBulkDocs([]byte(`{"docs": [{"a": 1}]}`))
+	if assert.NoError(t, err) {
+		assert.Len(t, docs, 1)
+	}
+	_, err = readBulkDocs([]byte(`{"docs": `))
+	assert.Error(t, err)
+}
+
+func TestBulkDocs(t *testing.T) {
+	doc := getDocForTest()
+	body, _ := json.Marshal(map[string]interface{}{
+		"docs": []map[string]interface{}{
+			{"bulkfield": "created"},
+			{"_id": doc.ID(), "_rev": doc.Rev(), "bulkfield": "updated"},
+			{"_id": doc.ID(), "_rev": "1-238238232322121", "bulkfield": "conflict"},
+		},
+	})
+	req, _ := http.NewRequest("POST", ts.URL+"/data/"+Type+"/_bulk_docs", bytes.NewReader(body))
+	req.Header.Add("Host", Host)
+	var out []map[string]interface{}
+	_, res, err := doRequest(req, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "201 Created", res.Status, "should get a 201")
+	if assert.Len(t, out, 3) {
+		assert.Equal(t, true, out[0]["ok"])
+		assert.NotEmpty(t, out[0]["id"])
+		assert.Equal(t, true, out[1]["ok"])
+		assert.Equal(t, doc.ID(), out[1]["id"])
+		assert.Equal(t, "conflict", out[2]["error"])
+	}
+
+	req, _ = http.NewRequest("POST", ts.URL+"/data/"+Type+"/_bulk_docs", bytes.NewReader([]byte(`[]`)))
+	req.Header.Add("Host", Host)
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "400 Bad Request", res.Status, "should get a 400")
+}
+
+func TestAllDocsParams(t *testing.T) {
+	req, param := allDocsParams(url.Values{})
+	if assert.Empty(t, param) {
+		assert.Equal(t, defaultFindLimit, req.Limit)
+		assert.Empty(t, req.StartKey)
+		assert.False(t, req.IncludeDocs)
+	}
+
+	req, param = allDocsParams(url.Values{
+		"limit":        {"5000"},
+		"startkey":     {`"foo"`},
+		"include_docs": {"true"},
+	})
+	if assert.Empty(t, param) {
+		assert.Equal(t, maxFindLimit, req.Limit)
+		assert.Equal(t, "foo", req.StartKey)
+		assert.True(t, req.IncludeDocs)
+	}
+
+	_, param = allDocsParams(url.Values{"limit": {"-1"}})
+	assert.Equal(t, "limit", param)
+	_, param = allDocsParams(url.Values{"startkey": {`"foo`}})
+	assert.Equal(t, "startkey", param)
+	_, param = allDocsParams(url.Values{"include_docs": {"maybe"}})
+	assert.Equal(t, "include_docs", param)
+}
+
+func TestJSONAPIDoc(t *testing.T) {
+	doc := jsonapiDoc{couchdb.JSONDoc{Type: Type, M: map[string]interface{}{
+		"_id":  "foo",
+		"_rev": "1-abc",
+		"test": "value",
+	}}}
+	assert.Equal(t, "/data/"+Type+"/foo", doc.SelfLink())
+	j, err := json.Marshal(doc)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `{"test":"value"}`, string(j))
+	}
+}
+
+func TestAllDocs(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/data/"+Type+"/_all_docs?limit=1&include_docs=true", nil)
+	req.Header.Add("Host", Host)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	rows, ok := out["rows"].([]interface{})
+	if assert.True(t, ok) && assert.Len(t, rows, 1) {
+		row := rows[0].(map[string]interface{})
+		assert.Contains(t, row, "doc")
+	}
+	next := res.Header.Get("Link")
+	assert.Contains(t, next, `rel="next"`)
+
+	req, _ = http.NewRequest("GET", ts.URL+"/data/"+Type+"/_all_docs?limit=1", nil)
+	req.Header.Add("Host", Host)
+	req.Header.Add("Accept", "application/vnd.api+json")
+	out, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	data, ok := out["data"].([]interface{})
+	if assert.True(t, ok) && assert.Len(t, data, 1) {
+		obj := data[0].(map[string]interface{})
+		assert.Equal(t, Type, obj["type"])
+		assert.NotEmpty(t, obj["id"])
+	}
+	links, ok := out["links"].(map[string]interface{})
+	if assert.True(t, ok) {
+		assert.Contains(t, links["next"], "startkey=")
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	doc := getDocForTest()
+	url := ts.URL + "/data/" + doc.DocType() + "/" + doc.ID() + "/avatar.png"
+	req, _ := http.NewRequest("PUT", url, bytes.NewBufferString("PNG"))
+	req.Header.Add("Host", Host)
+	req.Header.Add("Content-Type", "image/png")
+	req.Header.Add("If-Match", doc.Rev())
+	var out stackUpdateResponse
+	_, res, err := doRequest(req, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "201 Created", res.Status, "should get a 201")
+	assert.NotEqual(t, doc.Rev(), out.Rev)
+	rev := out.Rev
+
+	req, _ = http.NewRequest("GET", url, nil)
+	req.Header.Add("Host", Host)
+	res, err = client.Do(req)
+	if assert.NoError(t, err) {
+		defer res.Body.Close()
+		assert.Equal(t, "200 OK", res.Status, "should get a 200")
+		assert.Equal(t, "image/png", res.Header.Get("Content-Type"))
+		assert.NotEmpty(t, res.Header.Get("Etag"))
+		assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+		assert.Equal(t, "sandbox", res.Header.Get("Content-Security-Policy"))
+		assert.Empty(t, res.Header.Get("Content-Disposition"))
+		content, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, "PNG", string(content))
+	}
+
+	req, _ = http.NewRequest("DELETE", url, nil)
+	req.Header.Add("Host", Host)
+	jsonout, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assertJSONAPIError(t, jsonout, "400", ErrMissingRev.Error())
+
+	req, _ = http.NewRequest("DELETE", url+"?rev="+rev, nil)
+	req.Header.Add("Host", Host)
+	_, res, err = doRequest(req, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+}
+
+func TestUnsafeAttachment(t *testing.T) {
+	doc := getDocForTest()
+	url := ts.URL + "/data/" + doc.DocType() + "/" + doc.ID() + "/page.html"
+	req, _ := http.NewRequest("PUT", url+"?rev="+doc.Rev(), bytes.NewBufferString("<script>alert(1)</script>"))
+	req.Header.Add("Host", Host)
+	req.Header.Add("Content-Type", "text/html")
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "201 Created", res.Status, "should get a 201")
+
+	req, _ = http.NewRequest("GET", url, nil)
+	req.Header.Add("Host", Host)
+	res, err = client.Do(req)
+	if assert.NoError(t, err) {
+		defer res.Body.Close()
+		assert.Equal(t, "200 OK", res.Status, "should get a 200")
+		assert.Equal(t, "text/html", res.Header.Get("Content-Type"))
+		assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+		assert.Equal(t, "sandbox", res.Header.Get("Content-Security-Policy"))
+		assert.Equal(t, `attachment; filename=page.html`, res.Header.Get("Content-Disposition"))
+	}
+}
+
+func TestAttachmentTooLarge(t *testing.T) {
+	doc := getDocForTest()
+	url := ts.URL + "/data/" + doc.DocType() + "/" + doc.ID() + "/big.bin"
+	body := bytes.NewReader(make([]byte, maxAttachmentSize+1))
+	req, _ := http.NewRequest("PUT", url+"?rev="+doc.Rev(), body)
+	req.Header.Add("Host", Host)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "413 Request Entity Too Large", res.Status, "should get a 413")
+	assertJSONAPIError(t, out, "413", ErrAttachmentTooLarge.Error())
+}
+
+func TestValidationErrors(t *testing.T) {
+	errs := validationErrors("/1", doctypes.ValidationErrors{
+		{Field: "/name", Message: "is required"},
+	})
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, 422, errs[0].Status)
+		assert.Equal(t, "is required", errs[0].Detail)
+		assert.Equal(t, "/1/name", errs[0].Source.Pointer)
+	}
+}
+
+func TestCreateInvalidDoc(t *testing.T) {
+	doctype := "io.cozy.tests.validated"
+	doctypes.MustRegister(&doctypes.Doctype{
+		Name:   doctype,
+		Schema: doctypes.MustParseSchema(`{"type": "object", "required": ["name"]}`),
+	})
+	defer doctypes.Unregister(doctype)
+
+	req, _ := http.NewRequest("POST", ts.URL+"/data/"+doctype+"/", bytes.NewBufferString(`{"foo": "bar"}`))
+	req.Header.Add("Host", Host)
+	req.Header.Add("Content-Type", "application/json")
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "422 Unprocessable Entity", res.Status, "should get a 422")
+	assertJSONAPIError(t, out, "422", "is required")
+
+	req, _ = http.NewRequest("GET", ts.URL+"/data/_doctypes", nil)
+	req.Header.Add("Host", Host)
+	res, err = client.Do(req)
+	if assert.NoError(t, err) {
+		defer res.Body.Close()
+		assert.Equal(t, "200 OK", res.Status, "should get a 200")
+		var list []doctypes.Doctype
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&list))
+		var names []string
+		for _, dt := range list {
+			names = append(names, dt.Name)
+		}
+		assert.Contains(t, names, doctype)
+	}
+}
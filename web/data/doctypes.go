@@ -0,0 +1,28 @@
+package data
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/dcasier/cozy-stack/doctypes"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrUnknownRoute is used for a GET request on /data/:doctype, that only
+// exists for /data/_doctypes
+var ErrUnknownRoute = errors.New("The route does not exist")
+
+// listDoctypes handles GET /data/_doctypes requests. It returns the known
+// doctypes, with their JSON schemas, for the tooling of the developers.
+//
+// swagger:route GET /data/_doctypes data listDoctypes
+func listDoctypes(c *gin.Context) {
+	// @TODO: declare a static route for _doctypes when switching to
+	// echo/httprouterv2
+	if c.Param("doctype") != "_doctypes" {
+		jsonapi.AbortWithError(c, jsonapi.NotFound(ErrUnknownRoute))
+		return
+	}
+	c.JSON(http.StatusOK, doctypes.List())
+}
@@ -1,28 +1,76 @@
 package data
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 
 	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/doctypes"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
 )
 
-// HTTPStatus gives the http status for given error
-func HTTPStatus(err error) (code int) {
+var (
+	// ErrMissingRev is used when a document is deleted without its revision
+	ErrMissingRev = errors.New("The revision of the document is missing")
+	// ErrRevMismatch is used when the revisions given in the If-Match
+	// header, the rev parameter or the _rev field are not the same
+	ErrRevMismatch = errors.New("The If-Match header, the rev parameter and the _rev field mismatch")
+	// ErrIDMismatch is used when the _id of the document is not the one of
+	// the URL
+	ErrIDMismatch = errors.New("The _id of the document does not match the URL")
+	// ErrIDWithoutRev is used when a document is updated with an _id but no
+	// revision
+	ErrIDWithoutRev = errors.New("The _rev field must be given with the _id field for an update, or neither to create a document with a fixed id")
+	// ErrCreateWithID is used when a document is created with an _id
+	ErrCreateWithID = errors.New("Cannot create a document with _id")
+	// ErrInvalidLimit is used when the limit or the skip of a _find request
+	// is negative
+	ErrInvalidLimit = errors.New("The limit and the skip must be positive integers")
+	// ErrInternalDoctype is used when the documents of an internal doctype
+	// of the stack, like the sessions or the tokens, are accessed via the
+	// data routes
+	ErrInternalDoctype = errors.New("The documents of this doctype can only be accessed via the routes of the stack")
+)
+
+// wrapDataError returns a JSON-API error for the errors of the data
+// routes. A revision that is not the current one of the document gives a
+// 409 Conflict from CouchDB.
+func wrapDataError(err error) *jsonapi.Error {
+	if jsonErr, isJSONApiError := err.(*jsonapi.Error); isJSONApiError {
+		return jsonErr
+	}
+	if couchErr, isCouchErr := err.(*couchdb.Error); isCouchErr {
+		return jsonapi.WrapCouchError(couchErr)
+	}
 	if os.IsNotExist(err) {
-		code = http.StatusNotFound
-	} else if os.IsExist(err) {
-		code = http.StatusConflict
-	} else if couchErr, isCouchErr := err.(*couchdb.Error); isCouchErr {
-		code = couchErr.StatusCode
+		return jsonapi.NotFound(err)
 	}
-
-	if code == 0 {
-		code = http.StatusInternalServerError
+	if os.IsExist(err) {
+		return jsonapi.Conflict(err)
+	}
+	switch err {
+	case ErrMissingRev, ErrRevMismatch, ErrIDMismatch, ErrIDWithoutRev, ErrCreateWithID:
+		return jsonapi.BadRequest(err)
 	}
+	return jsonapi.InternalServerError(err)
+}
 
-	return
+// validationErrors returns the JSON-API errors for a document that doesn't
+// match the schema of its doctype, with a pointer to each invalid field. The
+// prefix is added to the pointers, for the documents of a _bulk_docs request.
+func validationErrors(prefix string, errs doctypes.ValidationErrors) jsonapi.ErrorList {
+	list := make(jsonapi.ErrorList, len(errs))
+	for i, e := range errs {
+		list[i] = &jsonapi.Error{
+			Status: http.StatusUnprocessableEntity,
+			Title:  "Invalid Document",
+			Detail: e.Message,
+			Source: jsonapi.SourceError{Pointer: prefix + e.Field},
+		}
+	}
+	return list
 }
 
 func invalidDoctypeErr(doctype string) error {
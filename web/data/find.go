@@ -0,0 +1,119 @@
+package data
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/couchdb/mango"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultFindLimit is the number of documents returned by _find when the
+// client does not give a limit, and maxFindLimit the maximal number
+const (
+	defaultFindLimit = 100
+	maxFindLimit     = 1000
+)
+
+// findRequest is the body of a POST /data/:doctype/_find request, with the
+// same fields as the _find of CouchDB
+type findRequest struct {
+	Selector json.RawMessage `json:"selector"`
+	Sort     json.RawMessage `json:"sort"`
+	Limit    int             `json:"limit"`
+	Skip     int             `json:"skip"`
+	Bookmark string          `json:"bookmark"`
+	Fields   []string        `json:"fields"`
+	UseIndex string          `json:"use_index"`
+}
+
+// invalidMember returns a 400 error for a member of the body of a _find
+// request
+func invalidMember(member string, err error) *jsonapi.Error {
+	e := jsonapi.BadRequest(err)
+	e.Source.Pointer = "/" + member
+	return e
+}
+
+// toFindRequest checks the request of the client and converts it to a
+// couchdb.FindRequest
+func (r *findRequest) toFindRequest() (*couchdb.FindRequest, *jsonapi.Error) {
+	if len(r.Selector) == 0 {
+		return nil, invalidMember("selector", mango.ErrInvalidSelector)
+	}
+	sel, err := mango.ParseSelector(r.Selector)
+	if err != nil {
+		return nil, invalidMember("selector", err)
+	}
+	req := &couchdb.FindRequest{
+		Selector: sel,
+		Limit:    r.Limit,
+		Skip:     r.Skip,
+		Bookmark: r.Bookmark,
+		Fields:   r.Fields,
+		UseIndex: r.UseIndex,
+	}
+	if len(r.Sort) > 0 {
+		if req.Sort, err = mango.ParseSort(r.Sort); err != nil {
+			return nil, invalidMember("sort", err)
+		}
+	}
+	if req.Limit < 0 || req.Skip < 0 {
+		return nil, invalidMember("limit", ErrInvalidLimit)
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultFindLimit
+	}
+	if req.Limit > maxFindLimit {
+		req.Limit = maxFindLimit
+	}
+	return req, nil
+}
+
+// findDocs handles POST /data/:doctype/_find requests. It queries the
+// documents of a doctype with a mango selector, via the indexes of the
+// doctype. The applications need a read permission on the doctype.
+//
+// swagger:route POST /data/:doctype/_find data findDocs
+func findDocs(c *gin.Context) {
+	doctype := c.MustGet("doctype").(string)
+	if !middlewares.AllowedDoctype(c, doctype, apps.ReadAccess) {
+		jsonapi.AbortWithError(c, jsonapi.Forbidden(middlewares.ErrForbiddenScope))
+		return
+	}
+
+	var body findRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&body); err != nil {
+		jsonapi.AbortWithError(c, jsonapi.BadJSON())
+		return
+	}
+	req, e := body.toFindRequest()
+	if e != nil {
+		jsonapi.AbortWithError(c, e)
+		return
+	}
+
+	instance := middlewares.GetInstance(c)
+	var docs []couchdb.JSONDoc
+	res, err := couchdb.FindDocsRaw(c.Request.Context(), instance.GetDatabasePrefix(), doctype, req, &docs)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapDataError(err))
+		return
+	}
+
+	out := make([]map[string]interface{}, len(docs))
+	for i := range docs {
+		docs[i].Type = doctype
+		out[i] = docs[i].ToMapWithType()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"docs":     out,
+		"limit":    req.Limit,
+		"next":     len(docs) == req.Limit,
+		"bookmark": res.Bookmark,
+	})
+}
@@ -8,12 +8,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/sharings"
 	"github.com/dcasier/cozy-stack/vfs"
 	"github.com/dcasier/cozy-stack/web/jsonapi"
 	"github.com/dcasier/cozy-stack/web/middlewares"
@@ -32,12 +35,24 @@ const (
 // recognized
 var ErrDocTypeInvalid = errors.New("Invalid document type")
 
+// ErrMissingFilePart is used when a multipart/form-data request does not
+// contain a file
+var ErrMissingFilePart = errors.New("The multipart request has no file")
+
+// ErrMissingPath is used when the Path parameter is required but has not
+// been given
+var ErrMissingPath = errors.New("The Path parameter is missing")
+
 // CreationHandler handle all POST requests on /files/:folder-id
 // aiming at creating a new document in the FS. Given the Type
 // parameter of the request, it will either upload a new file or
 // create a new directory.
 //
+// swagger:route POST /files/ files uploadFileOrCreateDirAtRoot
 // swagger:route POST /files/:folder-id files uploadFileOrCreateDir
+//
+// Responses:
+//   201: the created file or directory
 func CreationHandler(c *gin.Context) {
 	vfsC, err := getVfsContext(c)
 	if err != nil {
@@ -63,6 +78,10 @@ func CreationHandler(c *gin.Context) {
 }
 
 func createFileHandler(c *gin.Context, vfsC *vfs.Context) (doc *vfs.FileDoc, err error) {
+	if c.ContentType() == "multipart/form-data" {
+		return createFileFromMultipartHandler(c, vfsC)
+	}
+
 	doc, err = fileDocFromReq(
 		c,
 		c.Query("Name"),
@@ -73,24 +92,91 @@ func createFileHandler(c *gin.Context, vfsC *vfs.Context) (doc *vfs.FileDoc, err
 		return
 	}
 
-	file, err := vfs.CreateFile(vfsC, doc, nil)
+	err = writeFile(vfsC, doc, c.Request.Body)
+	return
+}
+
+// createFileFromMultipartHandler creates a file from the first file part
+// of a multipart/form-data request. The name and the content-type of the
+// file are taken from the headers of the part, and its content is
+// streamed to the VFS.
+func createFileFromMultipartHandler(c *gin.Context, vfsC *vfs.Context) (doc *vfs.FileDoc, err error) {
+	part, err := multipartFilePart(c.Request)
 	if err != nil {
 		return
 	}
+	defer part.Close()
 
-	_, err = io.Copy(file, c.Request.Body)
-	if err != nil {
-		return
+	name := c.Query("Name")
+	if name == "" {
+		name = part.FileName()
 	}
 
-	err = file.Close()
+	var md5Sum []byte
+	if md5Str := part.Header.Get("Content-MD5"); md5Str != "" {
+		md5Sum, err = parseMD5Hash(md5Str)
+		if err != nil {
+			return nil, jsonapi.InvalidParameter("Content-MD5", err)
+		}
+	}
+
+	mime, class := vfs.ExtractMimeAndClass(part.Header.Get("Content-Type"))
+	doc, err = vfs.NewFileDoc(
+		name,
+		c.Param("folder-id"),
+		-1,
+		md5Sum,
+		mime,
+		class,
+		c.Query("Executable") == "true",
+		strings.Split(c.Query("Tags"), TagSeparator),
+	)
 	if err != nil {
 		return
 	}
 
+	err = writeFile(vfsC, doc, part)
 	return
 }
 
+// multipartFilePart returns the first part of a multipart/form-data
+// request with a filename. The parts before it, like the form fields,
+// are skipped.
+func multipartFilePart(req *http.Request) (*multipart.Part, error) {
+	reader, err := req.MultipartReader()
+	if err != nil {
+		return nil, jsonapi.BadRequest(err)
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, jsonapi.BadRequest(ErrMissingFilePart)
+		}
+		if err != nil {
+			return nil, jsonapi.BadRequest(err)
+		}
+		if part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// writeFile creates a file in the VFS with the content read from r
+func writeFile(vfsC *vfs.Context, doc *vfs.FileDoc, r io.Reader) error {
+	file, err := vfs.CreateFile(vfsC, doc, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, r)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
 func createDirectoryHandler(c *gin.Context, vfsC *vfs.Context) (doc *vfs.DirDoc, err error) {
 	doc, err = vfs.NewDirDoc(
 		c.Query("Name"),
@@ -161,7 +247,7 @@ func OverwriteFileContentHandler(c *gin.Context) {
 
 	err = file.Close()
 	if err != nil {
-		jsonapi.AbortWithError(c, WrapVfsError(err))
+		jsonapi.AbortWithError(c, wrapUpdateError(c.Request, err))
 		return
 	}
 
@@ -173,6 +259,9 @@ func OverwriteFileContentHandler(c *gin.Context) {
 //
 // It can be used to modify the file or directory metadata, as well as
 // moving and renaming it in the filesystem.
+//
+// swagger:route PATCH /files/:file-id files patchFileOrDir
+// swagger:route PATCH /files/metadata files patchFileOrDirByPath
 func ModificationHandler(c *gin.Context) {
 	var err error
 
@@ -184,9 +273,9 @@ func ModificationHandler(c *gin.Context) {
 
 	patch := &vfs.DocPatch{}
 
-	var obj *jsonapi.ObjectMarshalling
-	if obj, err = jsonapi.Bind(c.Request, &patch); err != nil {
-		jsonapi.AbortWithError(c, jsonapi.BadJSON())
+	obj, e := jsonapi.Bind(c, vfs.FsDocType, patch)
+	if e != nil {
+		jsonapi.AbortWithError(c, e)
 		return
 	}
 
@@ -237,13 +326,30 @@ func ModificationHandler(c *gin.Context) {
 	}
 
 	if err != nil {
-		jsonapi.AbortWithError(c, WrapVfsError(err))
+		jsonapi.AbortWithError(c, wrapUpdateError(c.Request, err))
 		return
 	}
 
 	jsonapi.Data(c, http.StatusOK, data, nil)
 }
 
+// dirData sends the metadata of a directory, with a page of its contents,
+// following the page[limit] and page[cursor] parameters
+func dirData(c *gin.Context, vfsC *vfs.Context, dir *vfs.DirDoc) {
+	page, perr := jsonapi.PageParams(c)
+	if perr != nil {
+		jsonapi.AbortWithError(c, perr)
+		return
+	}
+	next, _, err := dir.FetchFilesPage(vfsC, page.Limit, page.Cursor)
+	if err != nil {
+		jsonapi.AbortWithError(c, WrapVfsError(err))
+		return
+	}
+	links := jsonapi.PageLinks(c.Request.URL, &jsonapi.PageInfo{NextCursor: next})
+	jsonapi.Data(c, http.StatusOK, dir, links)
+}
+
 // ReadMetadataFromIDHandler handles all GET requests on /files/:file-
 // id aiming at getting file metadata from its path.
 //
@@ -256,27 +362,23 @@ func ReadMetadataFromIDHandler(c *gin.Context, fileID string) {
 		return
 	}
 
-	typ, dir, file, err := vfs.GetDirOrFileDoc(vfsC, fileID, true)
+	typ, dir, file, err := vfs.GetDirOrFileDoc(vfsC, fileID, false)
 	if err != nil {
 		jsonapi.AbortWithError(c, WrapVfsError(err))
 		return
 	}
 
-	var data jsonapi.Object
-	switch typ {
-	case vfs.DirType:
-		data = dir
-	case vfs.FileType:
-		data = file
+	if typ == vfs.DirType {
+		dirData(c, vfsC, dir)
+		return
 	}
-
-	jsonapi.Data(c, http.StatusOK, data, nil)
+	jsonapi.Data(c, http.StatusOK, file, nil)
 }
 
 // ReadMetadataFromPathHandler handles all GET requests on
 // /files/metadata aiming at getting file metadata from its path.
 //
-// swagger:route GET /files/metadata files getFileMetadata
+// swagger:route GET /files/metadata files getFileMetadataByPath
 func ReadMetadataFromPathHandler(c *gin.Context) {
 	var err error
 
@@ -285,21 +387,23 @@ func ReadMetadataFromPathHandler(c *gin.Context) {
 		return
 	}
 
-	typ, dir, file, err := vfs.GetDirOrFileDocFromPath(vfsC, c.Query("Path"), true)
+	path := c.Query("Path")
+	if path == "" {
+		jsonapi.AbortWithError(c, jsonapi.InvalidParameter("Path", ErrMissingPath))
+		return
+	}
+
+	typ, dir, file, err := vfs.GetDirOrFileDocFromPath(vfsC, path, false)
 	if err != nil {
 		jsonapi.AbortWithError(c, WrapVfsError(err))
 		return
 	}
 
-	var data jsonapi.Object
-	switch typ {
-	case vfs.DirType:
-		data = dir
-	case vfs.FileType:
-		data = file
+	if typ == vfs.DirType {
+		dirData(c, vfsC, dir)
+		return
 	}
-
-	jsonapi.Data(c, http.StatusOK, data, nil)
+	jsonapi.Data(c, http.StatusOK, file, nil)
 }
 
 // ReadFileContentHandler handles all GET requests on /files/:file-id
@@ -310,7 +414,7 @@ func ReadMetadataFromPathHandler(c *gin.Context) {
 //    /files/download endpoint
 //
 // swagger:route GET /files/download files downloadFileByPath
-// swagger:route GET /files/:file-id files downloadFileByID
+// swagger:route GET /files/download/:file-id files downloadFileByID
 func ReadFileContentHandler(c *gin.Context, fileID string) {
 	var err error
 
@@ -325,7 +429,11 @@ func ReadFileContentHandler(c *gin.Context, fileID string) {
 	// form their path
 	var doc *vfs.FileDoc
 	var disposition string
-	if fileID == "" && path != "" {
+	if fileID == "" {
+		if path == "" {
+			jsonapi.AbortWithError(c, jsonapi.InvalidParameter("Path", ErrMissingPath))
+			return
+		}
 		disposition = "attachment"
 		doc, err = vfs.GetFileDocFromPath(vfsC, path)
 	} else {
@@ -346,6 +454,135 @@ func ReadFileContentHandler(c *gin.Context, fileID string) {
 	}
 }
 
+// TrashHandler handles DELETE requests on /files/:file-id to move a file
+// or a directory, and its subtree, to the trash.
+//
+// swagger:route DELETE /files/:file-id files trashFileOrDir
+func TrashHandler(c *gin.Context) {
+	vfsC, err := getVfsContext(c)
+	if err != nil {
+		return
+	}
+
+	typ, dir, file, err := vfs.GetDirOrFileDoc(vfsC, c.Param("file-id"), false)
+	if err != nil {
+		jsonapi.AbortWithError(c, WrapVfsError(err))
+		return
+	}
+
+	var data jsonapi.Object
+	switch typ {
+	case vfs.DirType:
+		if err = checkIfMatch(c.Request, dir.Rev()); err == nil {
+			data, err = vfs.TrashDir(vfsC, dir)
+		}
+	case vfs.FileType:
+		if err = checkIfMatch(c.Request, file.Rev()); err == nil {
+			data, err = vfs.TrashFile(vfsC, file)
+		}
+	}
+
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapUpdateError(c.Request, err))
+		return
+	}
+
+	jsonapi.Data(c, http.StatusOK, data, nil)
+}
+
+// EmptyTrashHandler handles DELETE requests on /files/trash to destroy
+// all the files and directories in the trash.
+//
+// swagger:route DELETE /files/trash files emptyTrash
+//
+// Responses:
+//   204: the trash has been emptied
+func EmptyTrashHandler(c *gin.Context) {
+	vfsC, err := getVfsContext(c)
+	if err != nil {
+		return
+	}
+
+	if err = vfs.EmptyTrash(vfsC); err != nil {
+		jsonapi.AbortWithError(c, WrapVfsError(err))
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ShareHandler handles POST requests on /files/:file-id/share to create
+// a public link to a file or a directory. The link can be limited in
+// time with the ExpiresAt parameter, and protected with the Password
+// field of the form in the body, to keep it out of the URL.
+//
+// swagger:route POST /files/:file-id/share files shareFile
+//
+// Responses:
+//   201: the created link
+func ShareHandler(c *gin.Context) {
+	instance := middlewares.GetInstance(c)
+	vfsC, err := getVfsContext(c)
+	if err != nil {
+		return
+	}
+
+	// the parameter is named folder-id to share the route with the
+	// CreationHandler, as gin does not allow two names for it
+	fileID := c.Param("folder-id")
+	if _, _, _, err = vfs.GetDirOrFileDoc(vfsC, fileID, false); err != nil {
+		jsonapi.AbortWithError(c, WrapVfsError(err))
+		return
+	}
+
+	var expiresAt *time.Time
+	if date := c.Query("ExpiresAt"); date != "" {
+		t, err := time.Parse(time.RFC3339, date)
+		if err != nil {
+			jsonapi.AbortWithError(c, jsonapi.InvalidParameter("ExpiresAt", err))
+			return
+		}
+		expiresAt = &t
+	}
+
+	db := instance.GetDatabasePrefix()
+	link, err := sharings.CreateLink(c.Request.Context(), db, fileID, expiresAt, c.PostForm("Password"))
+	if err != nil {
+		jsonapi.AbortWithError(c, WrapVfsError(err))
+		return
+	}
+
+	// the hash of the password should not leave the server
+	link.PasswordHash = nil
+	jsonapi.Data(c, http.StatusCreated, link, nil)
+}
+
+// downloadFromIDHandler handles the GET and HEAD requests on
+// /files/download/:file-id and /files/:file-id/relationships/:name
+func downloadFromIDHandler(c *gin.Context) {
+	dlOrFileID := c.Param("dl-meta-or-file-id")
+	fileID := c.Param("file-id")[1:]
+	if dlOrFileID != "download" && strings.HasPrefix(fileID, "relationships/") {
+		ReadRelationshipHandler(c, dlOrFileID, strings.TrimPrefix(fileID, "relationships/"))
+		return
+	}
+	ReadFileContentHandler(c, fileID)
+}
+
+// readHandler handles the GET and HEAD requests on /files/download,
+// /files/metadata and /files/:file-id, as they can't be declared as
+// separate routes.
+func readHandler(c *gin.Context) {
+	dlMeta := c.Param("dl-meta-or-file-id")
+	if dlMeta == "download" {
+		ReadFileContentHandler(c, "")
+	} else if dlMeta == "metadata" {
+		ReadMetadataFromPathHandler(c)
+	} else {
+		ReadMetadataFromIDHandler(c, dlMeta)
+	}
+}
+
 // Routes sets the routing for the files service
 func Routes(router *gin.RouterGroup) {
 	// @TODO: get rid of this handler when switching to
@@ -357,30 +594,34 @@ func Routes(router *gin.RouterGroup) {
 	//     router.GET("/download/:file-id", ReadFileContentFromIDHandler)
 	//     router.GET("/metadata", ReadMetadataFromPathHandler)
 	//     router.GET("/:file-id", ReadMetadataFromIDHanler)
+	//     router.GET("/:file-id/relationships/:name", ReadRelationshipHandler)
 	//
-	router.HEAD("/download/:file-id", func(c *gin.Context) {
-		ReadFileContentHandler(c, c.Param("file-id"))
-	})
-	router.GET("/:dl-meta-or-file-id/*file-id", func(c *gin.Context) {
-		fileID := c.Param("file-id")[1:]
-		ReadFileContentHandler(c, fileID)
-	})
-	router.GET("/:dl-meta-or-file-id", func(c *gin.Context) {
-		dlMeta := c.Param("dl-meta-or-file-id")
-		if dlMeta == "download" {
-			ReadFileContentHandler(c, "")
-		} else if dlMeta == "metadata" {
-			ReadMetadataFromPathHandler(c)
+	router.Use(middlewares.AllowFiles())
+
+	router.HEAD("/:dl-meta-or-file-id/*file-id", downloadFromIDHandler)
+	router.GET("/:dl-meta-or-file-id/*file-id", downloadFromIDHandler)
+	router.HEAD("/:dl-meta-or-file-id", readHandler)
+	router.GET("/:dl-meta-or-file-id", readHandler)
+
+	// the content of the files is streamed, the other bodies are JSON
+	upload := middlewares.BodyLimit(middlewares.BodyLimitFiles)
+	jsonBody := middlewares.BodyLimit(middlewares.BodyLimitJSON)
+
+	router.POST("/", upload, CreationHandler)
+	router.POST("/:folder-id", upload, CreationHandler)
+	router.POST("/:folder-id/share", jsonBody, ShareHandler)
+	router.POST("/:folder-id/relationships/:name", jsonBody, AddReferencedByHandler)
+
+	router.PATCH("/:file-id", jsonBody, ModificationHandler)
+	router.PUT("/:file-id", upload, OverwriteFileContentHandler)
+	router.DELETE("/:file-id", func(c *gin.Context) {
+		if c.Param("file-id") == "trash" {
+			EmptyTrashHandler(c)
 		} else {
-			ReadMetadataFromIDHandler(c, dlMeta)
+			TrashHandler(c)
 		}
 	})
-
-	router.POST("/", CreationHandler)
-	router.POST("/:folder-id", CreationHandler)
-
-	router.PATCH("/:file-id", ModificationHandler)
-	router.PUT("/:file-id", OverwriteFileContentHandler)
+	router.DELETE("/:file-id/relationships/:name", jsonBody, RemoveReferencedByHandler)
 }
 
 // WrapVfsError returns a formatted error from a golang error emitted by the vfs
@@ -416,13 +657,25 @@ func WrapVfsError(err error) *jsonapi.Error {
 		return jsonapi.PreconditionFailed("Content-MD5", err)
 	case vfs.ErrContentLengthMismatch:
 		return jsonapi.PreconditionFailed("Content-Length", err)
+	case middlewares.ErrRequestTooLarge:
+		return jsonapi.PayloadTooLarge(err)
+	case sharings.ErrIllegalExpiration:
+		return jsonapi.InvalidParameter("ExpiresAt", err)
+	case vfs.ErrFileInTrash:
+		return jsonapi.BadRequest(err)
+	case vfs.ErrInfectedFile:
+		return &jsonapi.Error{
+			Status: http.StatusUnprocessableEntity,
+			Title:  "Infected file",
+			Detail: err.Error(),
+		}
 	}
 	return jsonapi.InternalServerError(err)
 }
 
 func getVfsContext(c *gin.Context) (*vfs.Context, error) {
 	instance := middlewares.GetInstance(c)
-	vfsC, err := instance.GetVFSContext()
+	vfsC, err := instance.GetVFSContext(c.Request.Context())
 	if err != nil {
 		jsonapi.AbortWithError(c, jsonapi.InternalServerError(err))
 		return nil, err
@@ -464,14 +717,29 @@ func fileDocFromReq(c *gin.Context, name, folderID string, tags []string) (doc *
 	return
 }
 
+// errRevisionMismatch is used when the revision given in the If-Match
+// header is not the current revision of the document
+var errRevisionMismatch = errors.New("Revision does not match.")
+
 func checkIfMatch(req *http.Request, rev string) error {
-	ifMatch := req.Header.Get("If-Match")
+	ifMatch := strings.Trim(req.Header.Get("If-Match"), `"`)
 	if ifMatch != "" && rev != ifMatch {
-		return jsonapi.PreconditionFailed("If-Match", fmt.Errorf("Revision does not match."))
+		return jsonapi.PreconditionFailed("If-Match", errRevisionMismatch)
 	}
 	return nil
 }
 
+// wrapUpdateError is like WrapVfsError, but a conflict in couchdb is
+// reported as a failed precondition when the client has sent an
+// If-Match header: the document has been modified by someone else
+// between the check of the revision and its update.
+func wrapUpdateError(req *http.Request, err error) *jsonapi.Error {
+	if couchdb.IsConflictError(err) && req.Header.Get("If-Match") != "" {
+		return jsonapi.PreconditionFailed("If-Match", errRevisionMismatch)
+	}
+	return WrapVfsError(err)
+}
+
 func parseMD5Hash(md5B64 string) ([]byte, error) {
 	// Encoded md5 hash in base64 should at least have 22 caracters in
 	// base64: 16*3/4 = 21+1/3
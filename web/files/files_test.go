@@ -2,28 +2,31 @@ package files
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
 
 	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/couchdb/couchdbtest"
 	"github.com/dcasier/cozy-stack/instance"
 	"github.com/dcasier/cozy-stack/vfs"
 	"github.com/gin-gonic/gin"
-	"github.com/sourcegraph/checkup"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
 
-const CouchURL = "http://localhost:5984/"
 const TestPrefix = "test/"
 
 var ts *httptest.Server
@@ -481,7 +484,7 @@ func TestModifyMetadataDirMove(t *testing.T) {
 		"folder_id": folder2ID,
 	}
 
-	res3, _ := patchFile(t, "/files/"+folder1ID, "io.cozy.folders", folder1ID, attrs1, nil)
+	res3, _ := patchFile(t, "/files/"+folder1ID, "io.cozy.files", folder1ID, attrs1, nil)
 	assert.Equal(t, 200, res3.StatusCode)
 
 	storage, _ := testInstance.GetStorageProvider()
@@ -495,10 +498,10 @@ func TestModifyMetadataDirMove(t *testing.T) {
 		"folder_id": folder1ID,
 	}
 
-	res4, _ := patchFile(t, "/files/"+folder2ID, "io.cozy.folders", folder2ID, attrs2, nil)
+	res4, _ := patchFile(t, "/files/"+folder2ID, "io.cozy.files", folder2ID, attrs2, nil)
 	assert.Equal(t, 412, res4.StatusCode)
 
-	res5, _ := patchFile(t, "/files/"+folder1ID, "io.cozy.folders", folder1ID, attrs2, nil)
+	res5, _ := patchFile(t, "/files/"+folder1ID, "io.cozy.files", folder1ID, attrs2, nil)
 	assert.Equal(t, 412, res5.StatusCode)
 }
 
@@ -528,7 +531,7 @@ func TestModifyMetadataDirMoveWithRel(t *testing.T) {
 		Type: "io.cozy.files",
 	}
 
-	res3, _ := patchFile(t, "/files/"+folder1ID, "io.cozy.folders", folder1ID, nil, parent)
+	res3, _ := patchFile(t, "/files/"+folder1ID, "io.cozy.files", folder1ID, nil, parent)
 	assert.Equal(t, 200, res3.StatusCode)
 
 	storage, _ := testInstance.GetStorageProvider()
@@ -551,7 +554,7 @@ func TestModifyMetadataDirMoveConflict(t *testing.T) {
 		"name": "conflictmodme1",
 	}
 
-	res3, _ := patchFile(t, "/files/"+folder2ID, "io.cozy.folders", folder2ID, attrs1, nil)
+	res3, _ := patchFile(t, "/files/"+folder2ID, "io.cozy.files", folder2ID, attrs1, nil)
 	assert.Equal(t, 409, res3.StatusCode)
 }
 
@@ -589,8 +592,31 @@ func TestModifyContentBadRev(t *testing.T) {
 	assert.NoError(t, err)
 
 	req3.Header.Add("If-Match", fileRev)
-	res3, _ := doUploadOrMod(t, req3, "text/plain", newcontent, "")
+	res3, data3 := doUploadOrMod(t, req3, "text/plain", newcontent, "")
 	assert.Equal(t, 200, res3.StatusCode)
+
+	data3, ok = data3["data"].(map[string]interface{})
+	assert.True(t, ok)
+	meta3, ok := data3["meta"].(map[string]interface{})
+	assert.True(t, ok)
+	fileRev3, ok := meta3["rev"].(string)
+	assert.True(t, ok)
+
+	req4, err := http.NewRequest("DELETE", ts.URL+"/files/"+fileID, nil)
+	assert.NoError(t, err)
+	req4.Header.Add("If-Match", fileRev)
+	res4, err := http.DefaultClient.Do(req4)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 412, res4.StatusCode)
+	}
+
+	req5, err := http.NewRequest("DELETE", ts.URL+"/files/"+fileID, nil)
+	assert.NoError(t, err)
+	req5.Header.Add("If-Match", `"`+fileRev3+`"`)
+	res5, err := http.DefaultClient.Do(req5)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res5.StatusCode)
+	}
 }
 
 func TestModifyContentSuccess(t *testing.T) {
@@ -664,13 +690,28 @@ func TestModifyContentSuccess(t *testing.T) {
 	assert.Equal(t, fileInfo.Mode().String(), "-rw-r--r--")
 }
 
-func TestModifyContentConcurrently(t *testing.T) {
-	type result struct {
-		rev string
-		idx int64
-	}
+// updateResult is the revision given to an update of the content
+type updateResult struct {
+	rev string
+	idx int64
+}
+
+// byRev sorts the results of the updates by the number of their revision
+type byRev []*updateResult
+
+func (r byRev) Len() int      { return len(r) }
+func (r byRev) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byRev) Less(i, j int) bool {
+	return revNumber(r[i].rev) < revNumber(r[j].rev)
+}
 
-	done := make(chan *result)
+func revNumber(rev string) int {
+	n, _ := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	return n
+}
+
+func TestModifyContentConcurrently(t *testing.T) {
+	done := make(chan *updateResult)
 	errs := make(chan *http.Response)
 
 	res, data := upload(t, "/files/?Type=io.cozy.files&Name=willbemodifiedconcurrently&Executable=true", "text/plain", "foo", "")
@@ -693,7 +734,7 @@ func TestModifyContentConcurrently(t *testing.T) {
 		if res.StatusCode == 200 {
 			data = data["data"].(map[string]interface{})
 			meta := data["meta"].(map[string]interface{})
-			done <- &result{meta["rev"].(string), idx}
+			done <- &updateResult{meta["rev"].(string), idx}
 		} else {
 			errs <- res
 		}
@@ -705,7 +746,7 @@ func TestModifyContentConcurrently(t *testing.T) {
 		go doModContent()
 	}
 
-	var successes []*result
+	var successes []*updateResult
 	for i := 0; i < n; i++ {
 		select {
 		case res := <-errs:
@@ -717,6 +758,8 @@ func TestModifyContentConcurrently(t *testing.T) {
 
 	assert.True(t, len(successes) >= 1)
 
+	// the responses of the successful updates can arrive in any order
+	sort.Sort(byRev(successes))
 	for i, s := range successes {
 		assert.True(t, strings.HasPrefix(s.rev, strconv.Itoa(i+2)+"-"))
 	}
@@ -761,6 +804,35 @@ func TestDownloadFileByIDSuccess(t *testing.T) {
 	assert.Equal(t, body, string(resbody))
 }
 
+func TestDownloadFileIfNoneMatch(t *testing.T) {
+	body := "foo"
+	res1, filedata := upload(t, "/files/?Type=io.cozy.files&Name=downloadmeifnonematch", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+
+	fileID, _ := extractDirData(t, filedata)
+
+	res2, _ := download(t, "/files/download/"+fileID, "")
+	assert.Equal(t, 200, res2.StatusCode)
+	etag := res2.Header.Get("Etag")
+	assert.Equal(t, `"rL0Y20zC+Fzt72VPzMSk2A=="`, etag)
+
+	req3, err := http.NewRequest("GET", ts.URL+"/files/download/"+fileID, nil)
+	assert.NoError(t, err)
+	req3.Header.Add("If-None-Match", etag)
+	res3, err := http.DefaultClient.Do(req3)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 304, res3.StatusCode)
+	}
+
+	req4, err := http.NewRequest("GET", ts.URL+"/files/download/"+fileID, nil)
+	assert.NoError(t, err)
+	req4.Header.Add("If-None-Match", `"otheretag"`)
+	res4, err := http.DefaultClient.Do(req4)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res4.StatusCode)
+	}
+}
+
 func TestDownloadFileByPathSuccess(t *testing.T) {
 	body := "foo"
 	res1, _ := upload(t, "/files/?Type=io.cozy.files&Name=downloadme2", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
@@ -793,6 +865,57 @@ func TestDownloadRangeSuccess(t *testing.T) {
 	assert.Equal(t, "bar", string(res4body))
 }
 
+func uploadMultipart(t *testing.T, path, filename, contentType, body string) (res *http.Response, v map[string]interface{}) {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	assert.NoError(t, w.WriteField("description", "skipped"))
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, filename))
+	h.Set("Content-Type", contentType)
+	part, err := w.CreatePart(h)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = part.Write([]byte(body))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	req, err := http.NewRequest("POST", ts.URL+path, buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	return doUploadOrMod(t, req, w.FormDataContentType(), body, "")
+}
+
+func TestUploadMultipart(t *testing.T) {
+	res1, data1 := uploadMultipart(t, "/files/?Type=io.cozy.files", "multipart.txt", "text/plain", "foo,bar")
+	assert.Equal(t, 201, res1.StatusCode)
+
+	_, data := extractDirData(t, data1)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "multipart.txt", attrs["name"])
+	assert.Equal(t, "text/plain", attrs["mime"])
+	assert.Equal(t, "7", attrs["size"])
+
+	res2, body := download(t, "/files/download?Path=/multipart.txt", "")
+	assert.Equal(t, 200, res2.StatusCode)
+	assert.Equal(t, "foo,bar", string(body))
+
+	res3, data3 := uploadMultipart(t, "/files/?Type=io.cozy.files&Name=multipartrenamed", "whatever.txt", "text/plain", "baz")
+	assert.Equal(t, 201, res3.StatusCode)
+	_, data = extractDirData(t, data3)
+	attrs = data["attributes"].(map[string]interface{})
+	assert.Equal(t, "multipartrenamed", attrs["name"])
+
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	assert.NoError(t, w.WriteField("description", "no file"))
+	assert.NoError(t, w.Close())
+	req4, _ := http.NewRequest("POST", ts.URL+"/files/?Type=io.cozy.files", buf)
+	res4, _ := doUploadOrMod(t, req4, w.FormDataContentType(), "", "")
+	assert.Equal(t, 400, res4.StatusCode)
+}
+
 func TestGetFileMetadataFromPath(t *testing.T) {
 	res1, _ := http.Get(ts.URL + "/files/metadata?Path=/noooooop")
 	assert.Equal(t, 404, res1.StatusCode)
@@ -805,6 +928,39 @@ func TestGetFileMetadataFromPath(t *testing.T) {
 	assert.Equal(t, 200, res3.StatusCode)
 }
 
+func TestHeadByPath(t *testing.T) {
+	body := "foo,bar"
+	res1, _ := upload(t, "/files/?Type=io.cozy.files&Name=headbypath", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	assert.Equal(t, 201, res1.StatusCode)
+
+	res2, err := http.Head(ts.URL + "/files/download?Path=/headbypath")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res2.StatusCode)
+		assert.Equal(t, "7", res2.Header.Get("Content-Length"))
+		assert.True(t, strings.HasPrefix(res2.Header.Get("Content-Disposition"), "attachment"))
+	}
+
+	res3, err := http.Head(ts.URL + "/files/metadata?Path=/headbypath")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res3.StatusCode)
+	}
+
+	res4, err := http.Head(ts.URL + "/files/metadata?Path=/nooooop")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res4.StatusCode)
+	}
+
+	res5, err := http.Head(ts.URL + "/files/download")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 422, res5.StatusCode)
+	}
+
+	res6, err := http.Get(ts.URL + "/files/metadata")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 422, res6.StatusCode)
+	}
+}
+
 func TestGetDirectoryMetadataFromPath(t *testing.T) {
 	res1, _ := createDir(t, "/files/?Name=getdirmeta&Type=io.cozy.folders")
 	assert.Equal(t, 201, res1.StatusCode)
@@ -843,61 +999,133 @@ func TestGetDirectoryMetadataFromID(t *testing.T) {
 	assert.Equal(t, 200, res3.StatusCode)
 }
 
-func TestMain(m *testing.M) {
-	// First we make sure couchdb is started
-	db, err := checkup.HTTPChecker{URL: CouchURL}.Check()
-	if err != nil || db.Status() != checkup.Healthy {
-		fmt.Println("This test need couchdb to run.")
-		os.Exit(1)
+func TestShareFile(t *testing.T) {
+	res1, _ := http.Post(ts.URL+"/files/qsdqsd/share", "text/plain", nil)
+	assert.Equal(t, 404, res1.StatusCode)
+
+	body := "foo"
+	res2, data2 := upload(t, "/files/?Type=io.cozy.files&Name=sharedfile", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res2.StatusCode)
+
+	fileID, _ := extractDirData(t, data2)
+
+	res3, _ := http.Post(ts.URL+"/files/"+fileID+"/share?ExpiresAt=2006-01-02T15:04:05Z", "text/plain", nil)
+	assert.Equal(t, 422, res3.StatusCode)
+
+	res4, _ := http.Post(ts.URL+"/files/"+fileID+"/share?ExpiresAt=tomorrow", "text/plain", nil)
+	assert.Equal(t, 422, res4.StatusCode)
+
+	// the password is not read from the URL
+	res6, err := http.Post(ts.URL+"/files/"+fileID+"/share?Password=secret", "text/plain", nil)
+	if assert.NoError(t, err) {
+		var data6 map[string]interface{}
+		assert.NoError(t, extractJSONRes(res6, &data6))
+		_, attrs6 := extractDirData(t, data6)
+		assert.Equal(t, false, attrs6["attributes"].(map[string]interface{})["protected"])
+	}
+
+	res5, err := http.PostForm(ts.URL+"/files/"+fileID+"/share", url.Values{"Password": {"secret"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res5.Body.Close()
+	assert.Equal(t, 201, res5.StatusCode)
+
+	var data5 map[string]interface{}
+	assert.NoError(t, extractJSONRes(res5, &data5))
+	token, attrs := extractDirData(t, data5)
+	assert.NotEmpty(t, token)
+	assert.Equal(t, fileID, attrs["attributes"].(map[string]interface{})["file_id"])
+	assert.Equal(t, true, attrs["attributes"].(map[string]interface{})["protected"])
+	assert.Nil(t, attrs["attributes"].(map[string]interface{})["password_hash"])
+}
+
+func TestTrash(t *testing.T) {
+	body := "foo"
+	res1, data1 := upload(t, "/files/?Type=io.cozy.files&Name=totrash", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+	fileID, _ := extractDirData(t, data1)
+
+	res2, data2 := createDir(t, "/files/?Name=dirtotrash&Type=io.cozy.folders")
+	assert.Equal(t, 201, res2.StatusCode)
+	dirID, _ := extractDirData(t, data2)
+
+	req3, _ := http.NewRequest("DELETE", ts.URL+"/files/"+fileID, nil)
+	res3, err := http.DefaultClient.Do(req3)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res3.StatusCode)
+	}
+
+	req4, _ := http.NewRequest("DELETE", ts.URL+"/files/"+dirID, nil)
+	res4, err := http.DefaultClient.Do(req4)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res4.StatusCode)
+	}
+
+	res5, _ := http.Get(ts.URL + "/files/metadata?Path=" + url.QueryEscape(vfs.TrashDirName+"/totrash"))
+	assert.Equal(t, 200, res5.StatusCode)
+
+	req6, _ := http.NewRequest("DELETE", ts.URL+"/files/"+fileID, nil)
+	res6, err := http.DefaultClient.Do(req6)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 400, res6.StatusCode)
+	}
+
+	req7, _ := http.NewRequest("DELETE", ts.URL+"/files/trash", nil)
+	res7, err := http.DefaultClient.Do(req7)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 204, res7.StatusCode)
 	}
 
-	err = couchdb.ResetDB(TestPrefix, string(vfs.FsDocType))
+	res8, _ := http.Get(ts.URL + "/files/" + fileID)
+	assert.Equal(t, 404, res8.StatusCode)
+	res9, _ := http.Get(ts.URL + "/files/" + dirID)
+	assert.Equal(t, 404, res9.StatusCode)
+}
+
+func TestMain(m *testing.M) {
+	couchURL, stop := couchdbtest.Start()
+	err := couchdb.UseServer(couchdb.ServerOptions{URL: couchURL})
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	tempdir, err := ioutil.TempDir("", "cozy-stack")
+	err = couchdb.ResetDB(context.Background(), TestPrefix, string(vfs.FsDocType))
 	if err != nil {
-		fmt.Println("Could not create temporary directory.")
+		fmt.Println(err)
 		os.Exit(1)
 	}
-	defer func() {
-		os.RemoveAll(tempdir)
-	}()
 
 	gin.SetMode(gin.TestMode)
 	testInstance = &instance.Instance{
 		Domain:     "test",
-		StorageURL: "file://localhost" + tempdir,
+		StorageURL: "mem://test",
 	}
-	testInstance.Create()
+	testInstance.Create(context.Background())
 
 	router := gin.New()
 	router.Use(injectInstance(testInstance))
 	router.POST("/files/", CreationHandler)
 	router.POST("/files/:folder-id", CreationHandler)
-	router.PATCH("/files/:file-id", ModificationHandler)
-	router.PUT("/files/:file-id", OverwriteFileContentHandler)
-	router.HEAD("/files/download/:file-id", func(c *gin.Context) {
-		ReadFileContentHandler(c, c.Param("file-id"))
-	})
-	router.GET("/files/:dl-meta-or-file-id/*file-id", func(c *gin.Context) {
-		fileID := c.Param("file-id")[1:]
-		ReadFileContentHandler(c, fileID)
-	})
-	router.GET("/files/:dl-meta-or-file-id", func(c *gin.Context) {
-		dlMeta := c.Param("dl-meta-or-file-id")
-		if dlMeta == "download" {
-			ReadFileContentHandler(c, "")
-		} else if dlMeta == "metadata" {
-			ReadMetadataFromPathHandler(c)
+	router.POST("/files/:folder-id/share", ShareHandler)
+	router.DELETE("/files/:file-id", func(c *gin.Context) {
+		if c.Param("file-id") == "trash" {
+			EmptyTrashHandler(c)
 		} else {
-			ReadMetadataFromIDHandler(c, dlMeta)
+			TrashHandler(c)
 		}
 	})
+	router.PATCH("/files/:file-id", ModificationHandler)
+	router.PUT("/files/:file-id", OverwriteFileContentHandler)
+	router.HEAD("/files/:dl-meta-or-file-id/*file-id", downloadFromIDHandler)
+	router.GET("/files/:dl-meta-or-file-id/*file-id", downloadFromIDHandler)
+	router.HEAD("/files/:dl-meta-or-file-id", readHandler)
+	router.GET("/files/:dl-meta-or-file-id", readHandler)
 
 	ts = httptest.NewServer(router)
-	defer ts.Close()
-	os.Exit(m.Run())
+	res := m.Run()
+	ts.Close()
+	stop()
+	os.Exit(res)
 }
@@ -0,0 +1,162 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/dcasier/cozy-stack/vfs"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrUnknownRelationship is used when the file or directory has no
+// relationship with the requested name
+var ErrUnknownRelationship = errors.New("No relationship with this name")
+
+// ErrReadOnlyRelationship is used for the requests that try to modify the
+// parent or contents relationships, as the files are moved with a PATCH on
+// their document
+var ErrReadOnlyRelationship = errors.New("This relationship can't be modified with this request")
+
+const (
+	relContents     = "contents"
+	relParent       = "parent"
+	relReferencedBy = "referenced_by"
+)
+
+// relationshipLink returns the link of a relationship of a file or
+// directory, like /files/:file-id/relationships/contents
+func relationshipLink(fileID, name string) string {
+	return "/files/" + fileID + "/relationships/" + name
+}
+
+// ReadRelationshipHandler handles the GET requests on
+// /files/:file-id/relationships/:name. It returns the resource identifiers
+// of the parent of a file or directory, of the contents of a directory,
+// paginated with page[limit] and page[cursor], and of the documents that
+// reference a file.
+//
+// swagger:route GET /files/:file-id/relationships/:name files getRelationship
+func ReadRelationshipHandler(c *gin.Context, fileID, name string) {
+	vfsC, err := getVfsContext(c)
+	if err != nil {
+		return
+	}
+
+	typ, dir, file, err := vfs.GetDirOrFileDoc(vfsC, fileID, false)
+	if err != nil {
+		jsonapi.AbortWithError(c, WrapVfsError(err))
+		return
+	}
+
+	var rels jsonapi.RelationshipMap
+	if typ == vfs.DirType {
+		if name == relContents {
+			page, perr := jsonapi.PageParams(c)
+			if perr != nil {
+				jsonapi.AbortWithError(c, perr)
+				return
+			}
+			next, _, err := dir.FetchFilesPage(vfsC, page.Limit, page.Cursor)
+			if err != nil {
+				jsonapi.AbortWithError(c, WrapVfsError(err))
+				return
+			}
+			rels = dir.Relationships()
+			rel := rels[relContents]
+			rel.Links = jsonapi.PageLinks(c.Request.URL, &jsonapi.PageInfo{NextCursor: next})
+			if rel.Links == nil {
+				rel.Links = &jsonapi.LinksList{}
+			}
+			rel.Links.Self = relationshipLink(fileID, name)
+			jsonapi.Relationships(c, http.StatusOK, rel)
+			return
+		}
+		rels = dir.Relationships()
+	} else {
+		rels = file.Relationships()
+	}
+
+	rel, ok := rels[name]
+	if !ok {
+		jsonapi.AbortWithError(c, jsonapi.NotFound(ErrUnknownRelationship))
+		return
+	}
+	links := &jsonapi.LinksList{Self: relationshipLink(fileID, name)}
+	if rel.Links != nil {
+		links.Related = rel.Links.Related
+	}
+	rel.Links = links
+	if refs, ok := rel.Data.([]jsonapi.ResourceIdentifier); ok {
+		rel.Meta = &jsonapi.ListMeta{Count: len(refs)}
+	}
+	jsonapi.Relationships(c, http.StatusOK, rel)
+}
+
+// AddReferencedByHandler handles the POST requests on
+// /files/:file-id/relationships/referenced_by. It adds the documents of
+// the body to the documents that reference the file.
+//
+// swagger:route POST /files/:file-id/relationships/referenced_by files addReferencedBy
+//
+// Responses:
+//   204: the references have been added
+func AddReferencedByHandler(c *gin.Context) {
+	// the parameter is named folder-id to share the route with the
+	// CreationHandler, as gin does not allow two names for it
+	updateReferencedBy(c, c.Param("folder-id"), vfs.AddReferencedBy)
+}
+
+// RemoveReferencedByHandler handles the DELETE requests on
+// /files/:file-id/relationships/referenced_by. It removes the documents of
+// the body from the documents that reference the file.
+//
+// swagger:route DELETE /files/:file-id/relationships/referenced_by files removeReferencedBy
+//
+// Responses:
+//   204: the references have been removed
+func RemoveReferencedByHandler(c *gin.Context) {
+	updateReferencedBy(c, c.Param("file-id"), vfs.RemoveReferencedBy)
+}
+
+type referencesUpdate func(*vfs.Context, *vfs.FileDoc, []jsonapi.ResourceIdentifier) error
+
+func updateReferencedBy(c *gin.Context, fileID string, update referencesUpdate) {
+	switch c.Param("name") {
+	case relReferencedBy:
+	case relContents, relParent:
+		jsonapi.AbortWithError(c, jsonapi.Forbidden(ErrReadOnlyRelationship))
+		return
+	default:
+		jsonapi.AbortWithError(c, jsonapi.NotFound(ErrUnknownRelationship))
+		return
+	}
+
+	vfsC, err := getVfsContext(c)
+	if err != nil {
+		return
+	}
+
+	refs, e := jsonapi.BindRelationships(c)
+	if e != nil {
+		jsonapi.AbortWithError(c, e)
+		return
+	}
+
+	doc, err := vfs.GetFileDoc(vfsC, fileID)
+	if err != nil {
+		jsonapi.AbortWithError(c, WrapVfsError(err))
+		return
+	}
+
+	if err = checkIfMatch(c.Request, doc.Rev()); err != nil {
+		jsonapi.AbortWithError(c, WrapVfsError(err))
+		return
+	}
+
+	if err = update(vfsC, doc, refs); err != nil {
+		jsonapi.AbortWithError(c, wrapUpdateError(c.Request, err))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
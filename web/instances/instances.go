@@ -0,0 +1,190 @@
+// Package instances is the admin API to create, list, inspect and destroy
+// the instances hosted by the stack, and to act on them as their owner. It
+// is served only on the admin server.
+package instances
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrMissingDomain is used when an instance is created without a domain
+var ErrMissingDomain = errors.New("The domain of the instance is missing")
+
+// CreateParams is the body of POST /instances
+type CreateParams struct {
+	Domain         string   `json:"domain"`
+	Locale         string   `json:"locale,omitempty"`
+	StorageURL     string   `json:"storage,omitempty"`
+	Context        string   `json:"context,omitempty"`
+	Quota          int64    `json:"quota,omitempty"`
+	TrashRetention int      `json:"trash_retention,omitempty"`
+	Apps           []string `json:"apps,omitempty"`
+}
+
+// Created is the response of POST /instances: the summary of the new
+// instance, with its registration token and the jobs of the installation of
+// its applications
+type Created struct {
+	*instance.Info
+	RegisterToken string   `json:"register_token"`
+	Jobs          []string `json:"jobs,omitempty"`
+}
+
+// AdminToken is the response of POST /instances/:domain/token
+type AdminToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// listInstances responds with the summaries of all the instances: their
+// domain, storage URL, disk usage, creation date and state
+func listInstances(c *gin.Context) {
+	infos, err := instance.ListInfos(c.Request.Context())
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapInstancesError(err))
+		return
+	}
+	c.JSON(http.StatusOK, infos)
+}
+
+// showInstance responds with the summary of the instance for a domain
+func showInstance(c *gin.Context) {
+	ctx := c.Request.Context()
+	i, err := instance.Get(ctx, c.Param("domain"))
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapInstancesError(err))
+		return
+	}
+	info, err := i.Info(ctx)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapInstancesError(err))
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// createInstance creates an instance, and pushes the jobs that install its
+// applications: those of the apps parameter, or the default applications of
+// its context
+func createInstance(c *gin.Context) {
+	var params CreateParams
+	if err := json.NewDecoder(c.Request.Body).Decode(&params); err != nil {
+		jsonapi.AbortWithError(c, jsonapi.BadJSON())
+		return
+	}
+	if params.Domain == "" {
+		jsonapi.AbortWithError(c, jsonapi.InvalidParameter("domain", ErrMissingDomain))
+		return
+	}
+
+	ctx := c.Request.Context()
+	i, err := instance.Create(ctx, params.Domain, params.Locale, params.StorageURL, params.Context)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapInstancesError(err))
+		return
+	}
+	if params.TrashRetention > 0 {
+		if err = i.SetTrashRetention(ctx, params.TrashRetention); err != nil {
+			jsonapi.AbortWithError(c, wrapInstancesError(err))
+			return
+		}
+	}
+	if params.Quota > 0 {
+		if err = i.SetQuota(ctx, params.Quota); err != nil {
+			jsonapi.AbortWithError(c, wrapInstancesError(err))
+			return
+		}
+	}
+
+	var defaults []*instance.DefaultApp
+	for _, slug := range params.Apps {
+		defaults = append(defaults, &instance.DefaultApp{Slug: slug})
+	}
+	pushed, err := apps.InstallDefaults(ctx, i, defaults)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapInstancesError(err))
+		return
+	}
+
+	info, err := i.Info(ctx)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapInstancesError(err))
+		return
+	}
+	res := &Created{Info: info, RegisterToken: hex.EncodeToString(i.RegisterToken)}
+	for _, job := range pushed {
+		res.Jobs = append(res.Jobs, job.ID())
+	}
+	c.JSON(http.StatusCreated, res)
+}
+
+// destroyInstance destroys the instance for a domain, with all its data
+func destroyInstance(c *gin.Context) {
+	if err := instance.Destroy(c.Request.Context(), c.Param("domain")); err != nil {
+		jsonapi.AbortWithError(c, wrapInstancesError(err))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// createToken responds with a new admin token for the instance of a domain,
+// that gives the rights of its owner on the API of the stack for a short
+// time
+func createToken(c *gin.Context) {
+	ctx := c.Request.Context()
+	i, err := instance.Get(ctx, c.Param("domain"))
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapInstancesError(err))
+		return
+	}
+	token, err := apps.CreateAdminToken(ctx, i.GetDatabasePrefix())
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapInstancesError(err))
+		return
+	}
+	c.JSON(http.StatusCreated, &AdminToken{
+		Token:     token,
+		ExpiresAt: time.Now().Add(apps.AdminTokenTTL).UTC(),
+	})
+}
+
+func wrapInstancesError(err error) *jsonapi.Error {
+	if couchErr, isCouchErr := err.(*couchdb.Error); isCouchErr {
+		return jsonapi.WrapCouchError(couchErr)
+	}
+	if instance.IsNotFound(err) {
+		return jsonapi.NotFound(err)
+	}
+	switch err {
+	case instance.ErrExists:
+		return jsonapi.Conflict(err)
+	case instance.ErrInvalidLocale:
+		return jsonapi.InvalidParameter("locale", err)
+	case instance.ErrInvalidStorageURL:
+		return jsonapi.InvalidParameter("storage", err)
+	case instance.ErrUnknownContext:
+		return jsonapi.InvalidParameter("context", err)
+	case apps.ErrInvalidSlugName:
+		return jsonapi.InvalidParameter("apps", err)
+	}
+	return jsonapi.InternalServerError(err)
+}
+
+// AdminRoutes sets the routing for the instances on the admin server
+func AdminRoutes(router *gin.RouterGroup) {
+	router.GET("/", listInstances)
+	router.POST("/", createInstance)
+	router.GET("/:domain", showInstance)
+	router.DELETE("/:domain", destroyInstance)
+	router.POST("/:domain/token", createToken)
+}
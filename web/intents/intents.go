@@ -0,0 +1,56 @@
+// Package intents is the HTTP frontend of the intents package. It resolves
+// the applications that can handle an action asked by another application.
+package intents
+
+import (
+	"net/http"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/intents"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+func wrapIntentsError(err error) *jsonapi.Error {
+	if couchErr, isCouchErr := err.(*couchdb.Error); isCouchErr {
+		return jsonapi.WrapCouchError(couchErr)
+	}
+	switch err {
+	case intents.ErrMissingAction:
+		return jsonapi.InvalidParameter("action", err)
+	case intents.ErrMissingType:
+		return jsonapi.InvalidParameter("type", err)
+	}
+	return jsonapi.InternalServerError(err)
+}
+
+// CreateHandler handles POST /intents requests. It creates an intent for
+// the action and type given in the JSON-API body, with the list of the
+// installed applications that can handle it.
+func CreateHandler(c *gin.Context) {
+	intent := &intents.Intent{}
+	if _, e := jsonapi.Bind(c, intents.IntentDocType, intent); e != nil {
+		jsonapi.AbortWithError(c, e)
+		return
+	}
+	intent.SetID("")
+	intent.SetRev("")
+	intent.Client = ""
+	if app := middlewares.GetApp(c); app != nil {
+		intent.Client = app.Slug
+	}
+
+	instance := middlewares.GetInstance(c)
+	if err := intents.Create(c.Request.Context(), instance.GetDatabasePrefix(), intent); err != nil {
+		jsonapi.AbortWithError(c, wrapIntentsError(err))
+		return
+	}
+
+	jsonapi.Data(c, http.StatusCreated, intent, nil)
+}
+
+// Routes sets the routing for the intents service
+func Routes(router *gin.RouterGroup) {
+	router.POST("/", CreateHandler)
+}
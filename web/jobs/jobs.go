@@ -0,0 +1,220 @@
+// Package jobs is the HTTP frontend of the jobs package. It pushes the jobs
+// in the queues of the workers, and gives their state.
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/jobs"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrNotFound is used for the unknown routes under /jobs
+var ErrNotFound = errors.New("Not found")
+
+func wrapJobsError(err error) *jsonapi.Error {
+	if couchErr, isCouchErr := err.(*couchdb.Error); isCouchErr {
+		return jsonapi.WrapCouchError(couchErr)
+	}
+	switch err {
+	case jobs.ErrUnknownWorker:
+		return jsonapi.NotFound(err)
+	case jobs.ErrInvalidArguments:
+		return jsonapi.InvalidAttribute("arguments", err)
+	case jobs.ErrUnknownTrigger:
+		return jsonapi.InvalidAttribute("type", err)
+	case jobs.ErrInvalidTrigger:
+		return jsonapi.InvalidAttribute("arguments", err)
+	}
+	return jsonapi.InternalServerError(err)
+}
+
+// jobAttributes are the attributes of the JSON-API body of a request to
+// push a job
+type jobAttributes struct {
+	Arguments json.RawMessage `json:"arguments"`
+	Options   *jobs.Options   `json:"options"`
+}
+
+// pushJob handles POST /jobs/queue/:worker-type requests. It creates a job
+// with the arguments and options of the JSON-API body, and pushes it in the
+// queue of the worker type. The applications need a jobs permission for
+// the worker type.
+func pushJob(c *gin.Context) {
+	workerType := c.Param("worker-type")
+	if !middlewares.AllowedJobs(c, workerType) {
+		jsonapi.AbortWithError(c, jsonapi.Forbidden(middlewares.ErrForbiddenScope))
+		return
+	}
+
+	attrs := &jobAttributes{}
+	if _, e := jsonapi.Bind(c, jobs.JobDocType, attrs); e != nil {
+		jsonapi.AbortWithError(c, e)
+		return
+	}
+
+	instance := middlewares.GetInstance(c)
+	job, err := jobs.Push(c.Request.Context(), instance.GetDatabasePrefix(), &jobs.Request{
+		WorkerType: workerType,
+		Arguments:  attrs.Arguments,
+		Options:    attrs.Options,
+	})
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapJobsError(err))
+		return
+	}
+	jsonapi.Data(c, http.StatusAccepted, job, nil)
+}
+
+// getJob handles GET /jobs/:job-id requests. It returns the state of a job.
+// The applications need a jobs permission for the worker type of the job.
+func getJob(c *gin.Context, id string) {
+	instance := middlewares.GetInstance(c)
+	job, err := jobs.Get(c.Request.Context(), instance.GetDatabasePrefix(), id)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapJobsError(err))
+		return
+	}
+	if !middlewares.AllowedJobs(c, job.WorkerType) {
+		jsonapi.AbortWithError(c, jsonapi.Forbidden(middlewares.ErrForbiddenScope))
+		return
+	}
+	jsonapi.Data(c, http.StatusOK, job, nil)
+}
+
+// addTrigger handles POST /jobs/triggers requests. It creates a trigger
+// with the attributes of the JSON-API body. The applications need a jobs
+// permission for the worker type of the trigger and, for an event trigger,
+// a read permission on its doctype, as its jobs have the documents of the
+// events.
+func addTrigger(c *gin.Context) {
+	t := &jobs.Trigger{}
+	if _, e := jsonapi.Bind(c, jobs.TriggerDocType, t); e != nil {
+		jsonapi.AbortWithError(c, e)
+		return
+	}
+	if !middlewares.AllowedJobs(c, t.WorkerType) {
+		jsonapi.AbortWithError(c, jsonapi.Forbidden(middlewares.ErrForbiddenScope))
+		return
+	}
+	if doctype, ok := t.EventDoctype(); ok && !middlewares.AllowedEvents(c, doctype) {
+		jsonapi.AbortWithError(c, jsonapi.Forbidden(middlewares.ErrForbiddenScope))
+		return
+	}
+
+	instance := middlewares.GetInstance(c)
+	if err := jobs.AddTrigger(c.Request.Context(), instance.GetDatabasePrefix(), t); err != nil {
+		jsonapi.AbortWithError(c, wrapJobsError(err))
+		return
+	}
+	jsonapi.Data(c, http.StatusCreated, t, nil)
+}
+
+// listTriggers handles GET /jobs/triggers requests. The applications only
+// see the triggers of the worker types of their jobs permissions. The list
+// is paginated with page[limit] and page[cursor].
+func listTriggers(c *gin.Context) {
+	page, perr := jsonapi.PageParams(c)
+	if perr != nil {
+		jsonapi.AbortWithError(c, perr)
+		return
+	}
+	instance := middlewares.GetInstance(c)
+	triggers, err := jobs.ListTriggers(c.Request.Context(), instance.GetDatabasePrefix())
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapJobsError(err))
+		return
+	}
+	objs := make([]jsonapi.Object, 0, len(triggers))
+	for _, t := range triggers {
+		if middlewares.AllowedJobs(c, t.WorkerType) {
+			objs = append(objs, t)
+		}
+	}
+	objs, info, perr := jsonapi.PaginateObjects(objs, page)
+	if perr != nil {
+		jsonapi.AbortWithError(c, perr)
+		return
+	}
+	jsonapi.PaginatedDataList(c, http.StatusOK, objs, info)
+}
+
+// getTrigger returns the trigger of the request, or aborts it if the
+// trigger does not exist or if the application has no permission for it
+func getTrigger(c *gin.Context, id string) (*jobs.Trigger, bool) {
+	instance := middlewares.GetInstance(c)
+	t, err := jobs.GetTrigger(c.Request.Context(), instance.GetDatabasePrefix(), id)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapJobsError(err))
+		return nil, false
+	}
+	if !middlewares.AllowedJobs(c, t.WorkerType) {
+		jsonapi.AbortWithError(c, jsonapi.Forbidden(middlewares.ErrForbiddenScope))
+		return nil, false
+	}
+	return t, true
+}
+
+// showTrigger handles GET /jobs/triggers/:trigger-id requests
+func showTrigger(c *gin.Context, id string) {
+	if t, ok := getTrigger(c, id); ok {
+		jsonapi.Data(c, http.StatusOK, t, nil)
+	}
+}
+
+// deleteTrigger handles DELETE /jobs/triggers/:trigger-id requests. The
+// jobs already pushed by the trigger are kept.
+func deleteTrigger(c *gin.Context) {
+	t, ok := getTrigger(c, c.Param("trigger-id"))
+	if !ok {
+		return
+	}
+	if err := couchdb.DeleteDoc(c.Request.Context(), t.DBPrefix, t); err != nil {
+		jsonapi.AbortWithError(c, wrapJobsError(err))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// readHandler handles the GET requests on /jobs/triggers and
+// /jobs/:job-id, as they can't be declared as separate routes.
+func readHandler(c *gin.Context) {
+	id := c.Param("triggers-or-job-id")
+	if id == "triggers" {
+		listTriggers(c)
+	} else {
+		getJob(c, id)
+	}
+}
+
+// readTriggerHandler handles the GET requests on
+// /jobs/triggers/:trigger-id, for the same reason.
+func readTriggerHandler(c *gin.Context) {
+	if c.Param("triggers-or-job-id") != "triggers" {
+		jsonapi.AbortWithError(c, jsonapi.NotFound(ErrNotFound))
+		return
+	}
+	showTrigger(c, c.Param("trigger-id"))
+}
+
+// Routes sets the routing for the jobs service
+func Routes(router *gin.RouterGroup) {
+	// @TODO: get rid of these handlers when switching to
+	// echo/httprouterv2. This should ideally be:
+	//
+	//     router.GET("/triggers", listTriggers)
+	//     router.GET("/triggers/:trigger-id", showTrigger)
+	//     router.GET("/:job-id", getJob)
+	//
+	router.GET("/:triggers-or-job-id", readHandler)
+	router.GET("/:triggers-or-job-id/:trigger-id", readTriggerHandler)
+
+	router.POST("/queue/:worker-type", pushJob)
+	router.POST("/triggers", addTrigger)
+	router.DELETE("/triggers/:trigger-id", deleteTrigger)
+}
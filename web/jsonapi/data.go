@@ -44,6 +44,7 @@ type ResourceIdentifier struct {
 // or an array of them for to-many relationships.
 type Relationship struct {
 	Links *LinksList  `json:"links,omitempty"`
+	Meta  *ListMeta   `json:"meta,omitempty"`
 	Data  interface{} `json:"data"`
 }
 
@@ -85,10 +86,16 @@ func (o *ObjectMarshalling) GetRelationship(name string) (*Relationship, bool) {
 // MarshalObject serializes an Object to JSON.
 // It returns a json.RawMessage that can be used a in Document.
 func MarshalObject(o Object) (json.RawMessage, error) {
+	return marshalObject(o, nil)
+}
+
+// marshalObject is like MarshalObject, with only the fields of the sparse
+// fieldset of the client
+func marshalObject(o Object, opts *renderOptions) (json.RawMessage, error) {
 	id := o.ID()
 	rev := o.Rev()
 	self := o.SelfLink()
-	rels := o.Relationships()
+	rels := opts.sparseRelationships(o.DocType(), o.Relationships())
 
 	o.SetID("")
 	o.SetRev("")
@@ -101,6 +108,9 @@ func MarshalObject(o Object) (json.RawMessage, error) {
 	if err != nil {
 		return nil, err
 	}
+	if b, err = opts.sparseAttributes(o.DocType(), b); err != nil {
+		return nil, err
+	}
 
 	data := ObjectMarshalling{
 		Type:          o.DocType(),
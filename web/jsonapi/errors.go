@@ -30,12 +30,40 @@ func (e *Error) Error() string {
 	return e.Title + "(" + strconv.Itoa(e.Status) + ")" + ": " + e.Detail
 }
 
-// WrapCouchError returns a formatted error from a couchdb error
+// status returns the HTTP status for a response with these errors
+func (errs ErrorList) status() int {
+	if len(errs) == 0 {
+		return http.StatusInternalServerError
+	}
+	status := errs[0].Status
+	for _, e := range errs[1:] {
+		if e.Status == status {
+			continue
+		}
+		if e.Status >= 500 || status >= 500 {
+			return http.StatusInternalServerError
+		}
+		status = http.StatusBadRequest
+	}
+	return status
+}
+
+// WrapCouchError returns a formatted error from a couchdb error. The
+// title is the one of the HTTP status, and the details are the name and
+// the reason given by CouchDB.
 func WrapCouchError(err *couchdb.Error) *Error {
+	status := err.StatusCode
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	detail := err.Name
+	if err.Reason != "" {
+		detail += ": " + err.Reason
+	}
 	return &Error{
-		Status: err.StatusCode,
-		Title:  err.Name,
-		Detail: err.Reason,
+		Status: status,
+		Title:  http.StatusText(status),
+		Detail: detail,
 	}
 }
 
@@ -57,6 +85,14 @@ func BadRequest(err error) *Error {
 	}
 }
 
+// badPointer returns a 400 formatted error for an invalid member of the
+// request document
+func badPointer(pointer string, err error) *Error {
+	e := BadRequest(err)
+	e.Source.Pointer = pointer
+	return e
+}
+
 // BadJSON returns a 400 formatted error meaning the json input is
 // malformed.
 func BadJSON() *Error {
@@ -67,6 +103,42 @@ func BadJSON() *Error {
 	}
 }
 
+// Unauthorized returns a 401 formatted error
+func Unauthorized(err error) *Error {
+	return &Error{
+		Status: http.StatusUnauthorized,
+		Title:  "Unauthorized",
+		Detail: err.Error(),
+	}
+}
+
+// Forbidden returns a 403 formatted error
+func Forbidden(err error) *Error {
+	return &Error{
+		Status: http.StatusForbidden,
+		Title:  "Forbidden",
+		Detail: err.Error(),
+	}
+}
+
+// Conflict returns a 409 formatted error
+func Conflict(err error) *Error {
+	return &Error{
+		Status: http.StatusConflict,
+		Title:  "Conflict",
+		Detail: err.Error(),
+	}
+}
+
+// PayloadTooLarge returns a 413 formatted error
+func PayloadTooLarge(err error) *Error {
+	return &Error{
+		Status: http.StatusRequestEntityTooLarge,
+		Title:  "Request Entity Too Large",
+		Detail: err.Error(),
+	}
+}
+
 // InternalServerError returns a 500 formatted error
 func InternalServerError(err error) *Error {
 	return &Error{
@@ -0,0 +1,159 @@
+package jsonapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// ErrUnknownInclude is used when the client asks to include a relationship
+// that the object does not have
+var ErrUnknownInclude = errors.New("The object has no relationship with this name")
+
+// renderOptions are the sparse fieldsets and the included relationships
+// asked by the client, with the fields[type] and include query parameters.
+// See http://jsonapi.org/format/#fetching-sparse-fieldsets
+type renderOptions struct {
+	// fields are the attributes and relationships to keep, by type
+	fields map[string]map[string]bool
+	// include are the names of the relationships whose objects are included,
+	// or nil if the client has not given the include parameter, for the
+	// default of the response
+	include map[string]bool
+}
+
+// parseRenderOptions reads the fields[type] and include query parameters
+func parseRenderOptions(query url.Values) *renderOptions {
+	opts := &renderOptions{}
+	for key, values := range query {
+		if !strings.HasPrefix(key, "fields[") || !strings.HasSuffix(key, "]") {
+			continue
+		}
+		typ := key[len("fields[") : len(key)-1]
+		if opts.fields == nil {
+			opts.fields = make(map[string]map[string]bool)
+		}
+		opts.fields[typ] = splitNames(values)
+	}
+	if values, ok := query["include"]; ok {
+		opts.include = splitNames(values)
+	}
+	return opts
+}
+
+// splitNames returns the set of the names separated by commas in the values
+func splitNames(values []string) map[string]bool {
+	names := make(map[string]bool)
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names[name] = true
+			}
+		}
+	}
+	return names
+}
+
+// keep returns true if the field of an object of the given type must be
+// serialized
+func (opts *renderOptions) keep(typ, field string) bool {
+	if opts == nil || opts.fields == nil {
+		return true
+	}
+	fields, ok := opts.fields[typ]
+	return !ok || fields[field]
+}
+
+// sparseAttributes removes the attributes that the client has not asked
+// for from the serialized attributes of an object of the given type
+func (opts *renderOptions) sparseAttributes(typ string, attrs []byte) ([]byte, error) {
+	if opts == nil || opts.fields == nil {
+		return attrs, nil
+	}
+	if _, ok := opts.fields[typ]; !ok {
+		return attrs, nil
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(attrs, &all); err != nil {
+		return nil, err
+	}
+	for name := range all {
+		if !opts.keep(typ, name) {
+			delete(all, name)
+		}
+	}
+	return json.Marshal(all)
+}
+
+// sparseRelationships removes the relationships that the client has not
+// asked for
+func (opts *renderOptions) sparseRelationships(typ string, rels RelationshipMap) RelationshipMap {
+	if opts == nil || opts.fields == nil {
+		return rels
+	}
+	if _, ok := opts.fields[typ]; !ok {
+		return rels
+	}
+	sparse := make(RelationshipMap, len(rels))
+	for name, rel := range rels {
+		if opts.keep(typ, name) {
+			sparse[name] = rel
+		}
+	}
+	return sparse
+}
+
+// included returns the objects included with an object: all the objects of
+// Included() if the client has not given the include parameter and
+// includeByDefault is true, else only the objects of the relationships
+// that the client has asked for.
+func (opts *renderOptions) included(o Object, includeByDefault bool) ([]Object, *Error) {
+	if opts == nil || opts.include == nil {
+		if includeByDefault {
+			return o.Included(), nil
+		}
+		return nil, nil
+	}
+	if len(opts.include) == 0 {
+		return nil, nil
+	}
+
+	rels := o.Relationships()
+	wanted := make(map[ResourceIdentifier]bool)
+	for name := range opts.include {
+		rel, ok := rels[name]
+		if !ok {
+			return nil, InvalidParameter("include", ErrUnknownInclude)
+		}
+		for _, id := range resourceIdentifiers(rel.Data) {
+			wanted[id] = true
+		}
+	}
+
+	var included []Object
+	for _, inc := range o.Included() {
+		if wanted[ResourceIdentifier{ID: inc.ID(), Type: inc.DocType()}] {
+			included = append(included, inc)
+		}
+	}
+	return included, nil
+}
+
+// resourceIdentifiers returns the resource identifiers of the data of a
+// relationship, for a to-one or a to-many relationship
+func resourceIdentifiers(data interface{}) []ResourceIdentifier {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil
+	}
+	var many []ResourceIdentifier
+	if err = json.Unmarshal(b, &many); err == nil {
+		return many
+	}
+	var one ResourceIdentifier
+	if err = json.Unmarshal(b, &one); err == nil && one.ID != "" {
+		return []ResourceIdentifier{one}
+	}
+	return nil
+}
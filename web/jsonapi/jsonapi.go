@@ -4,6 +4,7 @@ package jsonapi
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -12,6 +13,20 @@ import (
 // ContentType is the official mime-type for JSON-API
 const ContentType = "application/vnd.api+json"
 
+var (
+	// ErrMissingData is used when the request document has no primary data
+	ErrMissingData = errors.New("The document must have an object as primary data")
+	// ErrMissingType is used when the primary data of the request document
+	// has no type
+	ErrMissingType = errors.New("The type of the primary data is missing")
+	// ErrTypeMismatch is used when the type of the primary data of the
+	// request document is not the type of the endpoint
+	ErrTypeMismatch = errors.New("The type of the primary data does not match the endpoint")
+	// ErrInvalidAttributes is used when the attributes of the request
+	// document can't be decoded
+	ErrInvalidAttributes = errors.New("The attributes are not valid for this type")
+)
+
 // Document is JSON-API document, identified by the mediatype
 // application/vnd.api+json
 // See http://jsonapi.org/format/#document-structure
@@ -20,21 +35,32 @@ type Document struct {
 	Errors   ErrorList        `json:"errors,omitempty"`
 	Links    *LinksList       `json:"links,omitempty"`
 	Included []interface{}    `json:"included,omitempty"`
+	Meta     *ListMeta        `json:"meta,omitempty"`
+}
+
+// ListMeta is the meta of a document with a list of objects
+type ListMeta struct {
+	// Count is the total number of objects, not only the ones in data
+	Count int `json:"count"`
 }
 
 // Data can be called to send an answer with a JSON-API document containing a
-// single object as data
+// single object as data. The objects of Included() are included, unless the
+// client restricts them with the include parameter, and the fields are
+// filtered by the sparse fieldsets of the client.
 func Data(c *gin.Context, statusCode int, o Object, links *LinksList) {
-	var included []interface{}
-	for _, o := range o.Included() {
-		data, err := MarshalObject(o)
-		if err != nil {
-			AbortWithError(c, InternalServerError(err))
-			return
-		}
-		included = append(included, &data)
+	opts := parseRenderOptions(c.Request.URL.Query())
+	objs, e := opts.included(o, true)
+	if e != nil {
+		AbortWithError(c, e)
+		return
 	}
-	data, err := MarshalObject(o)
+	included, err := marshalIncluded(objs, opts)
+	if err != nil {
+		AbortWithError(c, InternalServerError(err))
+		return
+	}
+	data, err := marshalObject(o, opts)
 	if err != nil {
 		AbortWithError(c, InternalServerError(err))
 		return
@@ -55,14 +81,46 @@ func Data(c *gin.Context, statusCode int, o Object, links *LinksList) {
 // DataList can be called to send an multiple-value answer with a
 // JSON-API document contains multiple objects.
 func DataList(c *gin.Context, statusCode int, objs []Object, links *LinksList) {
+	dataList(c, statusCode, objs, links, nil)
+}
+
+// DataListWithTotal is like DataList, with the total number of objects in
+// meta.count, for example when the objects are paginated
+func DataListWithTotal(c *gin.Context, statusCode int, total int, objs []Object, links *LinksList) {
+	dataList(c, statusCode, objs, links, &ListMeta{Count: total})
+}
+
+// dataList sends a list of objects. Their included objects are only sent
+// when the client asks for them with the include parameter.
+func dataList(c *gin.Context, statusCode int, objs []Object, links *LinksList, meta *ListMeta) {
+	opts := parseRenderOptions(c.Request.URL.Query())
 	objsMarshaled := make([]json.RawMessage, len(objs))
+	var includedObjs []Object
+	seen := make(map[ResourceIdentifier]bool)
 	for i, o := range objs {
-		j, err := MarshalObject(o)
+		j, err := marshalObject(o, opts)
 		if err != nil {
 			AbortWithError(c, InternalServerError(err))
 			return
 		}
 		objsMarshaled[i] = j
+		incs, e := opts.included(o, false)
+		if e != nil {
+			AbortWithError(c, e)
+			return
+		}
+		for _, inc := range incs {
+			id := ResourceIdentifier{ID: inc.ID(), Type: inc.DocType()}
+			if !seen[id] {
+				seen[id] = true
+				includedObjs = append(includedObjs, inc)
+			}
+		}
+	}
+	included, err := marshalIncluded(includedObjs, opts)
+	if err != nil {
+		AbortWithError(c, InternalServerError(err))
+		return
 	}
 
 	data, err := json.Marshal(objsMarshaled)
@@ -72,8 +130,10 @@ func DataList(c *gin.Context, statusCode int, objs []Object, links *LinksList) {
 	}
 
 	doc := Document{
-		Data:  (*json.RawMessage)(&data),
-		Links: links,
+		Data:     (*json.RawMessage)(&data),
+		Links:    links,
+		Included: included,
+		Meta:     meta,
 	}
 
 	body, err := json.Marshal(doc)
@@ -84,41 +144,71 @@ func DataList(c *gin.Context, statusCode int, objs []Object, links *LinksList) {
 	c.Data(statusCode, ContentType, body)
 }
 
+// marshalIncluded serializes the included objects, with the sparse
+// fieldsets of the client
+func marshalIncluded(objs []Object, opts *renderOptions) ([]interface{}, error) {
+	var included []interface{}
+	for _, o := range objs {
+		data, err := marshalObject(o, opts)
+		if err != nil {
+			return nil, err
+		}
+		included = append(included, &data)
+	}
+	return included, nil
+}
+
 // AbortWithError can be called to abort the current http request/response
 // processing, and send an error in the JSON-API format
-//
-// TODO could be nice to have AbortWithErrors(c *gin.Context, errors ErrorList)
 func AbortWithError(c *gin.Context, e *Error) {
+	AbortWithErrors(c, ErrorList{e})
+}
+
+// AbortWithErrors is like AbortWithError, but for several errors. The HTTP
+// status is the one of the errors if they all have the same, else the most
+// generally applicable one (400 or 500).
+func AbortWithErrors(c *gin.Context, errs ErrorList) {
 	doc := Document{
-		Errors: ErrorList{e},
+		Errors: errs,
 	}
 	body, err := json.Marshal(doc)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
-	c.Data(e.Status, ContentType, body)
+	c.Data(errs.status(), ContentType, body)
 	c.Abort()
 }
 
-// Bind is used to unmarshal an input JSONApi document. It binds an
-// incoming request to a attribute type.
-func Bind(req *http.Request, attrs interface{}) (*ObjectMarshalling, error) {
-	decoder := json.NewDecoder(req.Body)
+// Bind parses the JSON-API document of the request body, checks that its
+// primary data has the expected doctype, and decodes its attributes in
+// attrs. It returns the primary data, for its relationships and its meta.
+// The errors point to the invalid member of the document: a malformed
+// document gives a 400 Bad Request, and a type that does not match the
+// endpoint a 409 Conflict.
+func Bind(c *gin.Context, doctype string, attrs interface{}) (*ObjectMarshalling, *Error) {
 	var doc *Document
-	if err := decoder.Decode(&doc); err != nil {
-		return nil, err
+	if err := json.NewDecoder(c.Request.Body).Decode(&doc); err != nil || doc == nil {
+		return nil, BadJSON()
 	}
 	if doc.Data == nil {
-		return nil, BadJSON()
+		return nil, badPointer("/data", ErrMissingData)
 	}
 	var obj *ObjectMarshalling
-	if err := json.Unmarshal(*doc.Data, &obj); err != nil {
-		return nil, err
+	if err := json.Unmarshal(*doc.Data, &obj); err != nil || obj == nil {
+		return nil, badPointer("/data", ErrMissingData)
+	}
+	if obj.Type == "" {
+		return nil, badPointer("/data/type", ErrMissingType)
+	}
+	if obj.Type != doctype {
+		e := Conflict(ErrTypeMismatch)
+		e.Source.Pointer = "/data/type"
+		return nil, e
 	}
 	if obj.Attributes != nil {
-		if err := json.Unmarshal(*obj.Attributes, &attrs); err != nil {
-			return nil, err
+		if err := json.Unmarshal(*obj.Attributes, attrs); err != nil {
+			return nil, badPointer("/data/attributes", ErrInvalidAttributes)
 		}
 	}
 	return obj, nil
@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/dcasier/cozy-stack/couchdb"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
@@ -141,6 +144,204 @@ func TestData(t *testing.T) {
 	assert.Equal(t, qux["id"], "qux")
 }
 
+func TestDataListWithTotal(t *testing.T) {
+	res, err := http.Get(ts.URL + "/foos")
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	defer res.Body.Close()
+	var body map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&body)
+
+	assert.Contains(t, body, "data")
+	data := body["data"].([]interface{})
+	assert.Len(t, data, 2)
+	assert.Contains(t, body, "meta")
+	meta := body["meta"].(map[string]interface{})
+	assert.Equal(t, float64(42), meta["count"])
+}
+
+func getPage(t *testing.T, path string) (int, map[string]interface{}) {
+	res, err := http.Get(ts.URL + path)
+	if !assert.NoError(t, err) {
+		return 0, nil
+	}
+	defer res.Body.Close()
+	var body map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	return res.StatusCode, body
+}
+
+func TestPaginatedDataList(t *testing.T) {
+	code, body := getPage(t, "/paginated?page[limit]=2&filter=x")
+	assert.Equal(t, 200, code)
+	assert.Len(t, body["data"], 2)
+	assert.Equal(t, float64(5), body["meta"].(map[string]interface{})["count"])
+	links := body["links"].(map[string]interface{})
+	assert.NotContains(t, links, "prev")
+	assert.Equal(t, "/paginated?filter=x&page%5Bcursor%5D=2&page%5Blimit%5D=2", links["next"])
+
+	code, body = getPage(t, "/paginated?page[limit]=2&page[cursor]=4")
+	assert.Equal(t, 200, code)
+	assert.Len(t, body["data"], 1)
+	links = body["links"].(map[string]interface{})
+	assert.Equal(t, "/paginated?page%5Bcursor%5D=2&page%5Blimit%5D=2", links["prev"])
+	assert.NotContains(t, links, "next")
+
+	code, body = getPage(t, "/paginated")
+	assert.Equal(t, 200, code)
+	assert.Len(t, body["data"], 5)
+	assert.NotContains(t, body, "links")
+
+	code, _ = getPage(t, "/paginated?page[limit]=-1")
+	assert.Equal(t, 422, code)
+	code, _ = getPage(t, "/paginated?page[cursor]=42")
+	assert.Equal(t, 422, code)
+}
+
+func TestPaginateObjectsFirstPage(t *testing.T) {
+	objs := []Object{&Foo{FID: "a"}, &Foo{FID: "b"}, &Foo{FID: "c"}}
+	page, info, err := PaginateObjects(objs, &Page{Limit: 2, Cursor: "1"})
+	assert.Nil(t, err)
+	assert.Len(t, page, 2)
+	assert.Equal(t, firstPageCursor, info.PrevCursor)
+	assert.Empty(t, info.NextCursor)
+}
+
+func TestPageLinks(t *testing.T) {
+	u, _ := url.Parse("/foos?page[limit]=2&page[cursor]=4&filter=x")
+	assert.Nil(t, PageLinks(u, &PageInfo{Count: 5}))
+	links := PageLinks(u, &PageInfo{PrevCursor: "2", NextCursor: "6"})
+	assert.Equal(t, "/foos?filter=x&page%5Bcursor%5D=2&page%5Blimit%5D=2", links.Prev)
+	assert.Equal(t, "/foos?filter=x&page%5Bcursor%5D=6&page%5Blimit%5D=2", links.Next)
+}
+
+func TestSparseFieldsets(t *testing.T) {
+	q, _ := url.ParseQuery("fields[io.cozy.foos]=bar,single&fields[io.cozy.bars]=")
+	opts := parseRenderOptions(q)
+	foo := &Foo{FID: "courge", FRev: "1-abc", Bar: "baz"}
+	data, err := marshalObject(foo, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var obj ObjectMarshalling
+	assert.NoError(t, json.Unmarshal(data, &obj))
+	assert.Equal(t, "courge", obj.ID)
+	assert.Contains(t, obj.Relationships, "single")
+	assert.NotContains(t, obj.Relationships, "multiple")
+	assert.Equal(t, `{"bar":"baz"}`, string(*obj.Attributes))
+
+	q, _ = url.ParseQuery("fields[io.cozy.foos]=single")
+	data, err = marshalObject(foo, parseRenderOptions(q))
+	if assert.NoError(t, err) {
+		assert.NoError(t, json.Unmarshal(data, &obj))
+		assert.Equal(t, `{}`, string(*obj.Attributes))
+	}
+
+	data, err = marshalObject(foo, parseRenderOptions(url.Values{}))
+	if assert.NoError(t, err) {
+		obj = ObjectMarshalling{}
+		assert.NoError(t, json.Unmarshal(data, &obj))
+		assert.Len(t, obj.Relationships, 2)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	foo := &Foo{FID: "courge", FRev: "1-abc", Bar: "baz"}
+
+	opts := parseRenderOptions(url.Values{})
+	included, err := opts.included(foo, true)
+	assert.Nil(t, err)
+	assert.Len(t, included, 1)
+	included, err = opts.included(foo, false)
+	assert.Nil(t, err)
+	assert.Len(t, included, 0)
+
+	q, _ := url.ParseQuery("include=")
+	included, err = parseRenderOptions(q).included(foo, true)
+	assert.Nil(t, err)
+	assert.Len(t, included, 0)
+
+	q, _ = url.ParseQuery("include=multiple")
+	included, err = parseRenderOptions(q).included(foo, false)
+	assert.Nil(t, err)
+	if assert.Len(t, included, 1) {
+		assert.Equal(t, "qux", included[0].ID())
+	}
+
+	q, _ = url.ParseQuery("include=single,unknown")
+	_, err = parseRenderOptions(q).included(foo, true)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusUnprocessableEntity, err.Status)
+	}
+}
+
+func bindBody(body string, attrs interface{}) (*ObjectMarshalling, *Error) {
+	req := httptest.NewRequest("POST", "/foos", strings.NewReader(body))
+	return Bind(&gin.Context{Request: req}, "io.cozy.foos", attrs)
+}
+
+func TestBind(t *testing.T) {
+	foo := &Foo{}
+	obj, err := bindBody(`{"data": {"type": "io.cozy.foos", "id": "courge", "attributes": {"bar": "baz"},
+		"relationships": {"single": {"data": {"type": "io.cozy.foos", "id": "qux"}}}, "meta": {"rev": "1-abc"}}}`, foo)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "baz", foo.Bar)
+		assert.Equal(t, "courge", obj.ID)
+		assert.Equal(t, "1-abc", obj.Meta.Rev)
+		rel, ok := obj.GetRelationship("single")
+		if assert.True(t, ok) {
+			id, ok := rel.ResourceIdentifier()
+			assert.True(t, ok)
+			assert.Equal(t, "qux", id.ID)
+		}
+	}
+
+	_, err = bindBody(`{"data": `, foo)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusBadRequest, err.Status)
+	}
+	_, err = bindBody(`{"meta": {}}`, foo)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusBadRequest, err.Status)
+		assert.Equal(t, "/data", err.Source.Pointer)
+	}
+	_, err = bindBody(`{"data": {"attributes": {}}}`, foo)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusBadRequest, err.Status)
+		assert.Equal(t, "/data/type", err.Source.Pointer)
+	}
+	_, err = bindBody(`{"data": {"type": "io.cozy.bars", "attributes": {}}}`, foo)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusConflict, err.Status)
+		assert.Equal(t, "/data/type", err.Source.Pointer)
+	}
+	_, err = bindBody(`{"data": {"type": "io.cozy.foos", "attributes": {"bar": 42}}}`, foo)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusBadRequest, err.Status)
+		assert.Equal(t, "/data/attributes", err.Source.Pointer)
+	}
+}
+
+func TestWrapCouchError(t *testing.T) {
+	err := WrapCouchError(&couchdb.Error{StatusCode: 409, Name: "conflict", Reason: "Document update conflict."})
+	assert.Equal(t, http.StatusConflict, err.Status)
+	assert.Equal(t, "Conflict", err.Title)
+	assert.Equal(t, "conflict: Document update conflict.", err.Detail)
+
+	err = WrapCouchError(&couchdb.Error{Name: "wrong_json"})
+	assert.Equal(t, http.StatusInternalServerError, err.Status)
+	assert.Equal(t, "wrong_json", err.Detail)
+}
+
+func TestErrorListStatus(t *testing.T) {
+	e422 := &Error{Status: http.StatusUnprocessableEntity}
+	e404 := &Error{Status: http.StatusNotFound}
+	e500 := &Error{Status: http.StatusInternalServerError}
+	assert.Equal(t, http.StatusUnprocessableEntity, ErrorList{e422, e422}.status())
+	assert.Equal(t, http.StatusBadRequest, ErrorList{e422, e404}.status())
+	assert.Equal(t, http.StatusInternalServerError, ErrorList{e422, e500}.status())
+}
+
 func TestMain(m *testing.M) {
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
@@ -148,7 +349,58 @@ func TestMain(m *testing.M) {
 		courge := &Foo{FID: "courge", FRev: "1-abc", Bar: "baz"}
 		Data(c, 200, courge, nil)
 	})
+	router.GET("/foos", func(c *gin.Context) {
+		foos := []Object{
+			&Foo{FID: "courge", FRev: "1-abc", Bar: "baz"},
+			&Foo{FID: "qux", FRev: "2-def", Bar: "quux"},
+		}
+		DataListWithTotal(c, 200, 42, foos, nil)
+	})
+	router.GET("/paginated", func(c *gin.Context) {
+		page, perr := PageParams(c)
+		if perr != nil {
+			AbortWithError(c, perr)
+			return
+		}
+		var foos []Object
+		for _, id := range []string{"a", "b", "c", "d", "e"} {
+			foos = append(foos, &Foo{FID: id, FRev: "1-abc"})
+		}
+		foos, info, perr := PaginateObjects(foos, page)
+		if perr != nil {
+			AbortWithError(c, perr)
+			return
+		}
+		PaginatedDataList(c, 200, foos, info)
+	})
 	ts = httptest.NewServer(router)
 	defer ts.Close()
 	os.Exit(m.Run())
 }
+
+func TestBindRelationships(t *testing.T) {
+	bind := func(body string) ([]ResourceIdentifier, *Error) {
+		req := httptest.NewRequest("POST", "/foos/courge/relationships/bars", strings.NewReader(body))
+		return BindRelationships(&gin.Context{Request: req})
+	}
+
+	refs, err := bind(`{"data": [{"type": "io.cozy.bars", "id": "qux"}, {"type": "io.cozy.bars", "id": "quux"}]}`)
+	if assert.Nil(t, err) && assert.Len(t, refs, 2) {
+		assert.Equal(t, ResourceIdentifier{ID: "qux", Type: "io.cozy.bars"}, refs[0])
+		assert.Equal(t, ResourceIdentifier{ID: "quux", Type: "io.cozy.bars"}, refs[1])
+	}
+
+	_, err = bind(`{"data": {"type": "io.cozy.bars", "id": "qux"}}`)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusBadRequest, err.Status)
+		assert.Equal(t, "/data", err.Source.Pointer)
+	}
+	_, err = bind(`{"data": [{"id": "qux"}]}`)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusBadRequest, err.Status)
+	}
+	_, err = bind(`{"meta": {}}`)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "/data", err.Source.Pointer)
+	}
+}
@@ -0,0 +1,118 @@
+package jsonapi
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultPageLimit is the number of objects in a page, when the client does
+// not give a page[limit]
+const DefaultPageLimit = 100
+
+// MaxPageLimit is the maximal number of objects in a page
+const MaxPageLimit = 1000
+
+var (
+	// ErrInvalidPageLimit is used when page[limit] is not a positive integer
+	ErrInvalidPageLimit = errors.New("The page limit must be a positive integer")
+	// ErrInvalidPageCursor is used when page[cursor] is not a cursor of the
+	// list
+	ErrInvalidPageCursor = errors.New("The page cursor is not valid")
+)
+
+// Page is the pagination asked by the client with the page[limit] and
+// page[cursor] query parameters
+type Page struct {
+	Limit  int
+	Cursor string
+}
+
+// PageInfo is the position of a page in a paginated list: the total number
+// of objects, for meta.count, and the cursors of the previous and next
+// pages, empty if there are none, for links.prev and links.next
+type PageInfo struct {
+	Count      int
+	PrevCursor string
+	NextCursor string
+}
+
+// PageParams returns the pagination of the request, with DefaultPageLimit if
+// the client has not given a limit. The limit is capped to MaxPageLimit.
+func PageParams(c *gin.Context) (*Page, *Error) {
+	page := &Page{Limit: DefaultPageLimit, Cursor: c.Query("page[cursor]")}
+	if limit := c.Query("page[limit]"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, InvalidParameter("page[limit]", ErrInvalidPageLimit)
+		}
+		page.Limit = n
+	}
+	if page.Limit > MaxPageLimit {
+		page.Limit = MaxPageLimit
+	}
+	return page, nil
+}
+
+// PageLinks returns the links to the previous and next pages, with the
+// same URL and query parameters as the current request except for the
+// cursor, or nil if there are no other pages
+func PageLinks(u *url.URL, info *PageInfo) *LinksList {
+	if info.PrevCursor == "" && info.NextCursor == "" {
+		return nil
+	}
+	link := func(cursor string) string {
+		if cursor == "" {
+			return ""
+		}
+		q := u.Query()
+		q.Set("page[cursor]", cursor)
+		return (&url.URL{Path: u.Path, RawQuery: q.Encode()}).String()
+	}
+	return &LinksList{Prev: link(info.PrevCursor), Next: link(info.NextCursor)}
+}
+
+// PaginatedDataList sends a page of a paginated list, with the links to
+// the previous and next pages and the total number of objects in
+// meta.count
+func PaginatedDataList(c *gin.Context, statusCode int, objs []Object, info *PageInfo) {
+	dataList(c, statusCode, objs, PageLinks(c.Request.URL, info), &ListMeta{Count: info.Count})
+}
+
+// firstPageCursor is the cursor of the first page of the lists paginated
+// with offsets, as an empty cursor means that there is no previous page
+const firstPageCursor = "0"
+
+// PaginateObjects returns the page of a list of objects that are all in
+// memory, like a list filtered by the permissions of the client. Its
+// cursors are the offsets of the pages.
+func PaginateObjects(objs []Object, page *Page) ([]Object, *PageInfo, *Error) {
+	offset := 0
+	if page.Cursor != "" {
+		n, err := strconv.Atoi(page.Cursor)
+		if err != nil || n < 0 || n > len(objs) {
+			return nil, nil, InvalidParameter("page[cursor]", ErrInvalidPageCursor)
+		}
+		offset = n
+	}
+	end := offset + page.Limit
+	if end > len(objs) {
+		end = len(objs)
+	}
+
+	info := &PageInfo{Count: len(objs)}
+	if offset > 0 {
+		prev := offset - page.Limit
+		if prev <= 0 {
+			info.PrevCursor = firstPageCursor
+		} else {
+			info.PrevCursor = strconv.Itoa(prev)
+		}
+	}
+	if end < len(objs) {
+		info.NextCursor = strconv.Itoa(end)
+	}
+	return objs[offset:end], info, nil
+}
@@ -0,0 +1,60 @@
+package jsonapi
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrInvalidLinkage is used when the primary data of a request on a to-many
+// relationship is not an array of resource identifiers
+var ErrInvalidLinkage = errors.New("The data must be an array of resource identifiers")
+
+// Relationships sends the resource linkage of a relationship, as the
+// primary data of the document, with its links and meta. It is the answer
+// to the requests on the relationship links, like
+// /files/:file-id/relationships/contents.
+// See http://jsonapi.org/format/#fetching-relationships
+func Relationships(c *gin.Context, statusCode int, rel Relationship) {
+	data, err := json.Marshal(rel.Data)
+	if err != nil {
+		AbortWithError(c, InternalServerError(err))
+		return
+	}
+	doc := Document{
+		Data:  (*json.RawMessage)(&data),
+		Links: rel.Links,
+		Meta:  rel.Meta,
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		AbortWithError(c, InternalServerError(err))
+		return
+	}
+	c.Data(statusCode, ContentType, body)
+}
+
+// BindRelationships decodes the body of a request to add or remove members
+// of a to-many relationship: a document with an array of resource
+// identifiers as primary data.
+// See http://jsonapi.org/format/#crud-updating-to-many-relationships
+func BindRelationships(c *gin.Context) ([]ResourceIdentifier, *Error) {
+	var doc *Document
+	if err := json.NewDecoder(c.Request.Body).Decode(&doc); err != nil || doc == nil {
+		return nil, BadJSON()
+	}
+	if doc.Data == nil {
+		return nil, badPointer("/data", ErrMissingData)
+	}
+	var refs []ResourceIdentifier
+	if err := json.Unmarshal(*doc.Data, &refs); err != nil || refs == nil {
+		return nil, badPointer("/data", ErrInvalidLinkage)
+	}
+	for _, ref := range refs {
+		if ref.ID == "" || ref.Type == "" {
+			return nil, badPointer("/data", ErrInvalidLinkage)
+		}
+	}
+	return refs, nil
+}
@@ -0,0 +1,53 @@
+// Package metrics exposes the metrics of the stack, like the number and
+// duration of the requests to CouchDB, for monitoring purposes.
+package metrics
+
+import (
+	"errors"
+
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrAdminOnly is used when the metrics are read on the domain of an
+// instance, but are only served by the admin server
+var ErrAdminOnly = errors.New("The metrics are only served on the admin port")
+
+// public is true if the metrics are served on the domains of the instances,
+// and not only on the admin server
+var public bool
+
+// UsePublic serves the metrics on the domains of the instances too, if
+// enabled is true
+func UsePublic(enabled bool) {
+	public = enabled
+}
+
+// Metrics responds with the metrics of the stack
+//
+// swagger:route GET /metrics metrics showMetrics
+//
+// It responds with the metrics in the text format of Prometheus
+func Metrics(c *gin.Context) {
+	prometheus.Handler().ServeHTTP(c.Writer, c.Request)
+}
+
+// publicMetrics is like Metrics, for the domains of the instances
+func publicMetrics(c *gin.Context) {
+	if !public {
+		jsonapi.AbortWithError(c, jsonapi.NotFound(ErrAdminOnly))
+		return
+	}
+	Metrics(c)
+}
+
+// Routes sets the routing for the metrics service
+func Routes(router *gin.RouterGroup) {
+	router.GET("/", publicMetrics)
+}
+
+// AdminRoutes sets the routing for the metrics service on the admin server
+func AdminRoutes(router *gin.RouterGroup) {
+	router.GET("/", Metrics)
+}
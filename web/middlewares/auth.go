@@ -0,0 +1,109 @@
+package middlewares
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/dcasier/cozy-stack/sessions"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrNotLoggedIn is used when a request needs the session of the owner of
+// the instance, and has none
+var ErrNotLoggedIn = errors.New("You must be logged in")
+
+// SetSession creates a gin middleware that puts in the gin context the
+// session of the owner of the instance, when the request has a valid
+// session cookie. An invalid or expired cookie is ignored: the routes that
+// need a session are protected by NeedAuth and NeedSession.
+func SetSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cookie, err := c.Request.Cookie(sessions.CookieName)
+		if err != nil || cookie.Value == "" {
+			return
+		}
+		instance := GetInstance(c)
+		session, err := sessions.Get(c.Request.Context(), instance, cookie.Value)
+		if err == nil {
+			c.Set("session", session)
+		}
+	}
+}
+
+// SetSessionCookies sends the session cookie to the browser, with the CSRF token of
+// the session. They are only sent back on the domain of the instance, and
+// the session cookie is not readable by JavaScript. They are marked as
+// Secure when the request has been made over HTTPS, and with SameSite: Lax
+// for the session cookie, to stay logged in when following a link to the
+// instance, and Strict for the CSRF cookie.
+func SetSessionCookies(c *gin.Context, session *sessions.Session, maxAge int) {
+	var value, csrf string
+	if session != nil {
+		value, csrf = session.Cookie(), session.CSRFToken()
+	}
+	secure := RequestScheme(c) == "https"
+	setCookie(c, &http.Cookie{
+		Name:     sessions.CookieName,
+		Value:    value,
+		MaxAge:   maxAge,
+		Path:     "/",
+		Secure:   secure,
+		HttpOnly: true,
+	}, "Lax")
+	setCookie(c, &http.Cookie{
+		Name:   CSRFCookieName,
+		Value:  csrf,
+		MaxAge: maxAge,
+		Path:   "/",
+		Secure: secure,
+	}, "Strict")
+}
+
+// setCookie adds the cookie to the response, with the SameSite attribute
+// that http.Cookie doesn't support
+func setCookie(c *gin.Context, cookie *http.Cookie, sameSite string) {
+	c.Writer.Header().Add("Set-Cookie", cookie.String()+"; SameSite="+sameSite)
+}
+
+// GetSession returns the session of the owner of the instance, or nil if
+// the request is not made from a logged-in browser
+func GetSession(c *gin.Context) *sessions.Session {
+	if session, ok := c.Get("session"); ok {
+		return session.(*sessions.Session)
+	}
+	return nil
+}
+
+// NeedAuth creates a gin middleware that rejects the requests that have
+// neither the session of the owner, nor the token of an application, of an
+// OAuth2 client or of a hoster. The scopes of the applications and clients
+// are checked later, by AllowDoctype and AllowFiles.
+func NeedAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if GetSession(c) == nil && GetApp(c) == nil && GetOAuthToken(c) == nil && !IsAdmin(c) {
+			jsonapi.AbortWithError(c, jsonapi.Unauthorized(ErrNotLoggedIn))
+		}
+	}
+}
+
+// NeedSession creates a gin middleware that rejects the requests that are
+// not made by the logged-in owner of the instance, even with the token of
+// an application
+func NeedSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if GetSession(c) == nil {
+			jsonapi.AbortWithError(c, jsonapi.Unauthorized(ErrNotLoggedIn))
+		}
+	}
+}
+
+// NeedSessionOrAdmin creates a gin middleware like NeedSession, that also
+// accepts the requests of the hosters, made with an admin token
+func NeedSessionOrAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if GetSession(c) == nil && !IsAdmin(c) {
+			jsonapi.AbortWithError(c, jsonapi.Unauthorized(ErrNotLoggedIn))
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package middlewares
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dcasier/cozy-stack/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetSessionCookies(t *testing.T) {
+	defer UseTrustedProxies(nil)
+	assert.NoError(t, UseTrustedProxies([]string{"127.0.0.1"}))
+
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		SetSessionCookies(c, nil, -1)
+	})
+	cookies := func(remote, proto string) []string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-Forwarded-Proto", proto)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res.HeaderMap["Set-Cookie"]
+	}
+
+	set := cookies("127.0.0.1:4321", "https")
+	if assert.Len(t, set, 2) {
+		assert.True(t, strings.HasPrefix(set[0], sessions.CookieName+"="))
+		assert.Contains(t, set[0], "; HttpOnly; Secure; SameSite=Lax")
+		assert.True(t, strings.HasPrefix(set[1], CSRFCookieName+"="))
+		assert.Contains(t, set[1], "; Secure; SameSite=Strict")
+	}
+
+	set = cookies("203.0.113.7:4321", "https")
+	if assert.Len(t, set, 2) {
+		assert.NotContains(t, set[0], "Secure")
+		assert.Contains(t, set[0], "SameSite=Lax")
+		assert.NotContains(t, set[1], "Secure")
+		assert.Contains(t, set[1], "SameSite=Strict")
+	}
+}
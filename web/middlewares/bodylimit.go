@@ -0,0 +1,128 @@
+package middlewares
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/gin-gonic/gin"
+)
+
+// The groups of routes of the limits of the size of the request bodies
+const (
+	// BodyLimitJSON is the group of the routes that read a JSON or form
+	// body, that is decoded in memory
+	BodyLimitJSON = "json"
+	// BodyLimitFiles is the group of the routes that stream their body,
+	// like the upload of a file
+	BodyLimitFiles = "files"
+)
+
+// DefaultBodyLimits are the maximal sizes in bytes of the request bodies of
+// the groups of routes, 0 for no limit. The size of the files is already
+// limited by the quota of the instance.
+var DefaultBodyLimits = map[string]int64{
+	BodyLimitJSON:  5 << 20,
+	BodyLimitFiles: 0,
+}
+
+// ErrRequestTooLarge is used when the body of a request is larger than the
+// limit of its route
+var ErrRequestTooLarge = errors.New("The body of the request is too large")
+
+var (
+	bodyMu     sync.RWMutex
+	bodyLimits = DefaultBodyLimits
+)
+
+// UseBodyLimits changes the maximal sizes of the request bodies of the
+// groups of routes. The groups that are not in limits keep their default.
+func UseBodyLimits(limits map[string]int64) {
+	merged := make(map[string]int64, len(DefaultBodyLimits))
+	for group, limit := range DefaultBodyLimits {
+		merged[group] = limit
+	}
+	for group, limit := range limits {
+		merged[group] = limit
+	}
+	bodyMu.Lock()
+	defer bodyMu.Unlock()
+	bodyLimits = merged
+}
+
+func getBodyLimit(group string) int64 {
+	bodyMu.RLock()
+	defer bodyMu.RUnlock()
+	return bodyLimits[group]
+}
+
+// BodyLimit creates a gin middleware that limits the size of the body of
+// the requests of a group of routes. A request with a Content-Length over
+// the limit is rejected at once with a 413 Request Entity Too Large, before
+// the handler reads anything. For the JSON routes, a body without length,
+// sent in chunks, is read up to the limit before the handler, so that it
+// can also be rejected with a 413. For the streaming routes, it is cut when
+// the limit is reached, and the handler gets ErrRequestTooLarge.
+func BodyLimit(group string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := getBodyLimit(group)
+		req := c.Request
+		if limit <= 0 || req.Body == nil {
+			return
+		}
+		if req.ContentLength > limit {
+			abortTooLarge(c)
+			return
+		}
+
+		if group == BodyLimitJSON && req.ContentLength < 0 {
+			body, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+			req.Body.Close()
+			if err != nil {
+				jsonapi.AbortWithError(c, jsonapi.BadRequest(err))
+				return
+			}
+			if int64(len(body)) > limit {
+				abortTooLarge(c)
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			return
+		}
+		req.Body = &limitedBody{ReadCloser: req.Body, remaining: limit}
+	}
+}
+
+func abortTooLarge(c *gin.Context) {
+	// the rest of the body is not read, the connection can't be reused
+	c.Header("Connection", "close")
+	jsonapi.AbortWithError(c, jsonapi.PayloadTooLarge(ErrRequestTooLarge))
+}
+
+// limitedBody is the body of a request that can't be read after a given
+// number of bytes
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// a read of the next byte tells if the body was exactly at the
+		// limit, or too large
+		var b [1]byte
+		if n, _ := l.ReadCloser.Read(b[:]); n > 0 {
+			return 0, ErrRequestTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
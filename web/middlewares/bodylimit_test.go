@@ -0,0 +1,75 @@
+package middlewares
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// chunked hides the length of a body, so that it is sent in chunks
+type chunked struct{ io.Reader }
+
+func TestBodyLimit(t *testing.T) {
+	UseBodyLimits(map[string]int64{BodyLimitJSON: 10, BodyLimitFiles: 20})
+	defer UseBodyLimits(nil)
+
+	echo := func(c *gin.Context) {
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err == ErrRequestTooLarge {
+			c.String(http.StatusRequestEntityTooLarge, "cut")
+			return
+		}
+		assert.NoError(t, err)
+		c.String(http.StatusOK, string(body))
+	}
+	router := gin.New()
+	router.POST("/json", BodyLimit(BodyLimitJSON), echo)
+	router.POST("/files", BodyLimit(BodyLimitFiles), echo)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	post := func(path string, body io.Reader) (int, string) {
+		res, err := http.Post(ts.URL+path, "application/json", body)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	status, body := post("/json", strings.NewReader(`{"a": 1}`))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"a": 1}`, body)
+	status, body = post("/json", strings.NewReader(`{"a": 12345}`))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Contains(t, body, ErrRequestTooLarge.Error())
+	status, body = post("/json", chunked{strings.NewReader(`{"a": 123}`)})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"a": 123}`, body)
+	status, body = post("/json", chunked{strings.NewReader(`{"a": 1234}`)})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Contains(t, body, ErrRequestTooLarge.Error())
+
+	status, _ = post("/files", strings.NewReader(strings.Repeat("x", 20)))
+	assert.Equal(t, http.StatusOK, status)
+	status, body = post("/files", strings.NewReader(strings.Repeat("x", 21)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Contains(t, body, ErrRequestTooLarge.Error())
+	status, _ = post("/files", chunked{strings.NewReader(strings.Repeat("x", 20))})
+	assert.Equal(t, http.StatusOK, status)
+	status, body = post("/files", chunked{strings.NewReader(strings.Repeat("x", 21))})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, "cut", body)
+
+	// no limit for the files by default
+	UseBodyLimits(nil)
+	status, _ = post("/files", strings.NewReader(strings.Repeat("x", 1000)))
+	assert.Equal(t, http.StatusOK, status)
+}
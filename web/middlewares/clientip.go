@@ -0,0 +1,117 @@
+package middlewares
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	proxiesMu      sync.RWMutex
+	trustedProxies []*net.IPNet
+)
+
+// UseTrustedProxies sets the IP addresses or networks, like 10.0.0.0/8, of
+// the reverse proxies in front of the stack. The X-Forwarded-For and
+// X-Real-IP headers are only read on the requests sent by them.
+func UseTrustedProxies(proxies []string) error {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		network, err := parseNetwork(proxy)
+		if err != nil {
+			return err
+		}
+		networks = append(networks, network)
+	}
+	proxiesMu.Lock()
+	defer proxiesMu.Unlock()
+	trustedProxies = networks
+	return nil
+}
+
+// parseNetwork parses an IP address, as a network of a single address, or
+// a network in the CIDR notation
+func parseNetwork(proxy string) (*net.IPNet, error) {
+	if ip := net.ParseIP(proxy); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid trusted proxy %s", proxy)
+	}
+	return network, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	proxiesMu.RLock()
+	defer proxiesMu.RUnlock()
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP address of the client of a request. It is the
+// remote address of the connection, unless it is a trusted proxy: the
+// address is then the last one of X-Forwarded-For that is not a trusted
+// proxy, or the one of X-Real-IP. A client can't choose its address by
+// sending these headers itself.
+func ClientIP(c *gin.Context) string {
+	ip := remoteIP(c.Request)
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	if forwarded := c.Request.Header.Get("X-Forwarded-For"); forwarded != "" {
+		addrs := strings.Split(forwarded, ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(addrs[i])
+			if net.ParseIP(addr) == nil {
+				break
+			}
+			ip = addr
+			if !isTrustedProxy(addr) {
+				break
+			}
+		}
+		return ip
+	}
+	if real := strings.TrimSpace(c.Request.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+	return ip
+}
+
+// RequestScheme returns https if the request has been made over TLS, to the
+// stack or to a trusted proxy that has set the X-Forwarded-Proto header, and
+// http otherwise
+func RequestScheme(c *gin.Context) string {
+	if c.Request.TLS != nil {
+		return "https"
+	}
+	if isTrustedProxy(remoteIP(c.Request)) && c.Request.Header.Get("X-Forwarded-Proto") == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,73 @@
+package middlewares
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	defer UseTrustedProxies(nil)
+
+	clientIP := func(remote string, headers map[string]string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return ClientIP(&gin.Context{Request: req})
+	}
+	spoofed := map[string]string{
+		"X-Forwarded-For": "1.2.3.4",
+		"X-Real-IP":       "5.6.7.8",
+	}
+
+	// the forwarded headers are ignored without trusted proxies
+	assert.NoError(t, UseTrustedProxies(nil))
+	assert.Equal(t, "203.0.113.7", clientIP("203.0.113.7:4321", nil))
+	assert.Equal(t, "203.0.113.7", clientIP("203.0.113.7:4321", spoofed))
+	assert.Equal(t, "::1", clientIP("[::1]:4321", spoofed))
+
+	assert.NoError(t, UseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"}))
+	assert.Equal(t, "203.0.113.7", clientIP("203.0.113.7:4321", spoofed))
+	assert.Equal(t, "1.2.3.4", clientIP("127.0.0.1:4321", spoofed))
+	assert.Equal(t, "5.6.7.8", clientIP("10.1.2.3:4321", map[string]string{
+		"X-Real-IP": "5.6.7.8",
+	}))
+	// the addresses added by the client before the proxies are ignored
+	assert.Equal(t, "203.0.113.7", clientIP("127.0.0.1:4321", map[string]string{
+		"X-Forwarded-For": "1.2.3.4, 203.0.113.7, 10.0.0.2",
+	}))
+	assert.Equal(t, "10.0.0.2", clientIP("127.0.0.1:4321", map[string]string{
+		"X-Forwarded-For": "not-an-ip, 10.0.0.2",
+	}))
+	assert.Equal(t, "127.0.0.1", clientIP("127.0.0.1:4321", map[string]string{
+		"X-Forwarded-For": "not-an-ip",
+	}))
+
+	assert.Error(t, UseTrustedProxies([]string{"not-a-proxy"}))
+}
+
+func TestRequestScheme(t *testing.T) {
+	defer UseTrustedProxies(nil)
+
+	scheme := func(remote, proto string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		return RequestScheme(&gin.Context{Request: req})
+	}
+
+	assert.NoError(t, UseTrustedProxies([]string{"127.0.0.1"}))
+	assert.Equal(t, "http", scheme("127.0.0.1:4321", ""))
+	assert.Equal(t, "https", scheme("127.0.0.1:4321", "https"))
+	// the header is ignored on the requests of the other clients
+	assert.Equal(t, "http", scheme("203.0.113.7:4321", "https"))
+
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	assert.Equal(t, "https", RequestScheme(&gin.Context{Request: req}))
+}
@@ -0,0 +1,58 @@
+package middlewares
+
+import (
+	"errors"
+	"mime"
+
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// CSRFCookieName is the name of the cookie with the CSRF token of the
+	// session. Unlike the session cookie, it can be read by the JavaScript
+	// of the pages of the instance, but not by the other sites.
+	CSRFCookieName = "cozycsrf"
+	// CSRFHeader is the header where the CSRF token is sent
+	CSRFHeader = "X-CSRF-Token"
+	// CSRFFormField is the field of the HTML forms with the CSRF token
+	CSRFFormField = "csrf_token"
+)
+
+// ErrInvalidCSRFToken is used when a request authenticated by the session
+// cookie changes something without the CSRF token of the session
+var ErrInvalidCSRFToken = errors.New("Missing or invalid CSRF token")
+
+// CheckCSRF creates a gin middleware that rejects the requests that change
+// something (all the methods except GET, HEAD and OPTIONS), that are
+// authenticated by the session cookie, and that don't have the CSRF token
+// of the session in the X-CSRF-Token header or in the csrf_token field of a
+// form. A malicious site can make the browser send the cookie, but it can't
+// read the token. The requests with a token in the Authorization header are
+// not concerned, as the browsers don't add this header by themselves.
+func CheckCSRF() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case "GET", "HEAD", "OPTIONS":
+			return
+		}
+		session := GetSession(c)
+		if session == nil || c.Request.Header.Get("Authorization") != "" {
+			return
+		}
+		token := c.Request.Header.Get(CSRFHeader)
+		if token == "" && isForm(c) {
+			token = c.PostForm(CSRFFormField)
+		}
+		if !session.CheckCSRFToken(token) {
+			jsonapi.AbortWithError(c, jsonapi.Forbidden(ErrInvalidCSRFToken))
+		}
+	}
+}
+
+// isForm returns true if the body of the request is an HTML form. The other
+// bodies, like the content of a file, must not be read by the middlewares.
+func isForm(c *gin.Context) bool {
+	ct, _, _ := mime.ParseMediaType(c.Request.Header.Get("Content-Type"))
+	return ct == "application/x-www-form-urlencoded"
+}
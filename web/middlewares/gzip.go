@@ -0,0 +1,194 @@
+package middlewares
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dcasier/cozy-stack/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// gzipMinSize is the size under which a response with a known length is
+// not compressed, as the gain would be lost in the headers
+const gzipMinSize = 1024
+
+// compressibleTypes are the content types that are compressed. The others,
+// like the images, videos and archives, are often already compressed.
+var compressibleTypes = map[string]bool{
+	"application/javascript":   true,
+	"application/json":         true,
+	"application/vnd.api+json": true,
+	"application/xml":          true,
+	"application/x-javascript": true,
+	"image/svg+xml":            true,
+}
+
+var (
+	gzipEnabled = true
+	gzipPool    = newGzipPool(gzip.DefaultCompression)
+)
+
+// UseGzip enables or disables the compression of the responses, with the
+// given level of compression (gzip.DefaultCompression for 0)
+func UseGzip(enabled bool, level int) error {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	if _, err := gzip.NewWriterLevel(ioutil.Discard, level); err != nil {
+		return err
+	}
+	gzipEnabled = enabled
+	gzipPool = newGzipPool(level)
+	return nil
+}
+
+func newGzipPool(level int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			gz, _ := gzip.NewWriterLevel(ioutil.Discard, level)
+			return gz
+		},
+	}
+}
+
+// Gzip creates a gin middleware that compresses the responses with gzip,
+// for the clients that accept it. Only the text and JSON responses are
+// compressed: the JSON-API documents, like the listings of directories with
+// hundreds of children, and the assets of the applications.
+func Gzip() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !gzipEnabled || c.Request.Method == http.MethodHead ||
+			!acceptsGzip(c.Request.Header.Get("Accept-Encoding")) {
+			return
+		}
+		w := &gzipWriter{ResponseWriter: c.Writer, pool: gzipPool}
+		c.Writer = w
+		defer w.close()
+		c.Next()
+	}
+}
+
+// acceptsGzip returns true if the Accept-Encoding header accepts gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != "gzip" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			if q := strings.TrimSpace(param); q == "q=0" || q == "q=0.0" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// isCompressible returns true if a response with the given content type
+// is worth compressing
+func isCompressible(contentType string) bool {
+	ct, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if ct == "text/event-stream" {
+		// the events must be sent as soon as they are written
+		return false
+	}
+	return strings.HasPrefix(ct, "text/") || compressibleTypes[ct]
+}
+
+// gzipWriter compresses the body of a response, if it is worth it. The
+// decision is taken on the first write, when the status and the headers of
+// the response are known.
+type gzipWriter struct {
+	gin.ResponseWriter
+	pool     *sync.Pool
+	gz       *gzip.Writer
+	decided  bool
+	compress bool
+}
+
+func (w *gzipWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	if w.ResponseWriter.Written() {
+		return
+	}
+
+	header := w.Header()
+	switch status := w.Status(); {
+	case status < 200, status == http.StatusNoContent,
+		status == http.StatusPartialContent, status >= 300 && status < 400:
+		return
+	}
+	if header.Get("Content-Encoding") != "" || !isCompressible(header.Get("Content-Type")) {
+		return
+	}
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < gzipMinSize {
+		return
+	}
+
+	w.compress = true
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	header.Add("Vary", "Accept-Encoding")
+	// the compressed content is not the same byte for byte
+	if etag := header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("Etag", "W/"+etag)
+	}
+	w.gz = w.pool.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+}
+
+// Write compresses the data, if the response is compressed - see
+// http.ResponseWriter interface
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	w.decide()
+	if w.compress {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteString is like Write - see gin.ResponseWriter interface
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// WriteHeaderNow sends the headers of a response without body, that is not
+// compressed - see gin.ResponseWriter interface
+func (w *gzipWriter) WriteHeaderNow() {
+	w.decided = true
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// Flush sends the data compressed so far - see http.Flusher interface
+func (w *gzipWriter) Flush() {
+	if w.compress {
+		if err := w.gz.Flush(); err != nil {
+			logger.Warnf("gzip", "cannot flush the response: %v", err)
+		}
+	}
+	w.ResponseWriter.Flush()
+}
+
+// close finishes the compressed stream
+func (w *gzipWriter) close() {
+	if !w.compress {
+		return
+	}
+	if err := w.gz.Close(); err != nil {
+		logger.Warnf("gzip", "cannot close the response: %v", err)
+	}
+	w.gz.Reset(ioutil.Discard)
+	w.pool.Put(w.gz)
+}
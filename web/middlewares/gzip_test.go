@@ -0,0 +1,86 @@
+package middlewares
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	assert.True(t, acceptsGzip("gzip"))
+	assert.True(t, acceptsGzip("gzip, deflate, br"))
+	assert.True(t, acceptsGzip("deflate, gzip;q=0.8"))
+	assert.False(t, acceptsGzip(""))
+	assert.False(t, acceptsGzip("deflate"))
+	assert.False(t, acceptsGzip("gzip;q=0, deflate"))
+}
+
+func TestIsCompressible(t *testing.T) {
+	assert.True(t, isCompressible("application/vnd.api+json"))
+	assert.True(t, isCompressible("application/json; charset=utf-8"))
+	assert.True(t, isCompressible("text/html; charset=utf-8"))
+	assert.True(t, isCompressible("image/svg+xml"))
+	assert.False(t, isCompressible(""))
+	assert.False(t, isCompressible("image/png"))
+	assert.False(t, isCompressible("application/zip"))
+	assert.False(t, isCompressible("text/event-stream"))
+}
+
+func TestGzip(t *testing.T) {
+	big := strings.Repeat("cozy ", 1000)
+	router := gin.New()
+	router.Use(Gzip())
+	router.GET("/text", func(c *gin.Context) {
+		c.String(http.StatusOK, big)
+	})
+	router.GET("/small", func(c *gin.Context) {
+		c.Header("Content-Length", "4")
+		c.Data(http.StatusOK, "text/plain", []byte("cozy"))
+	})
+	router.GET("/image", func(c *gin.Context) {
+		c.Data(http.StatusOK, "image/png", []byte(big))
+	})
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// the transport must not decompress the responses by itself
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(path, encoding string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		return res
+	}
+
+	res := get("/text", "gzip")
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	gz, err := gzip.NewReader(res.Body)
+	if assert.NoError(t, err) {
+		body, err := ioutil.ReadAll(gz)
+		assert.NoError(t, err)
+		assert.Equal(t, big, string(body))
+	}
+	res.Body.Close()
+
+	res = get("/text", "")
+	assert.Equal(t, "", res.Header.Get("Content-Encoding"))
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, big, string(body))
+	res.Body.Close()
+
+	for _, path := range []string{"/small", "/image"} {
+		res = get(path, "gzip")
+		assert.Equal(t, "", res.Header.Get("Content-Encoding"), path)
+		res.Body.Close()
+	}
+}
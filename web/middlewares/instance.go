@@ -3,16 +3,35 @@
 package middlewares
 
 import (
+	"net"
+	"strings"
+
+	"github.com/dcasier/cozy-stack/apps"
 	"github.com/dcasier/cozy-stack/instance"
 	"github.com/dcasier/cozy-stack/web/jsonapi"
 	"github.com/gin-gonic/gin"
 )
 
 // SetInstance creates a gin middleware to put the instance in the gin context
-// for next handlers
+// for next handlers. A request on a subdomain of the instance, like
+// calendar.example.cozycloud.cc, is for the application with this slug: its
+// instance is resolved from the parent domain.
 func SetInstance() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		i, err := instance.Get(c.Request.Host)
+		host := normalizeHost(c.Request.Host)
+		i, err := instance.Get(c.Request.Context(), host)
+		if instance.IsNotFound(err) {
+			if slug, parent, ok := splitAppHost(host); ok {
+				i, err = instance.Get(c.Request.Context(), parent)
+				if err == nil {
+					c.Set("app_slug", slug)
+				}
+			}
+		}
+		if instance.IsNotFound(err) {
+			jsonapi.AbortWithError(c, jsonapi.NotFound(err))
+			return
+		}
 		if err != nil {
 			jsonapi.AbortWithError(c, jsonapi.InternalServerError(err))
 			return
@@ -21,8 +40,39 @@ func SetInstance() gin.HandlerFunc {
 	}
 }
 
+// normalizeHost returns the host of a request in lower case, without the
+// trailing dot of a fully qualified domain name
+func normalizeHost(host string) string {
+	host = strings.ToLower(host)
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		return net.JoinHostPort(strings.TrimSuffix(h, "."), port)
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// splitAppHost splits the host of a request on the subdomain of an
+// application, like calendar.example.cozycloud.cc, in the slug of the
+// application and the domain of its instance. It returns false if the first
+// label of the host is not a valid slug.
+func splitAppHost(host string) (slug, parent string, ok bool) {
+	parts := strings.SplitN(host, ".", 2)
+	if len(parts) != 2 || parts[1] == "" || !apps.ValidSlug(parts[0]) {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
 // GetInstance will return the instance linked to the given gin
 // context or panic if none exists
 func GetInstance(c *gin.Context) *instance.Instance {
 	return c.MustGet("instance").(*instance.Instance)
 }
+
+// GetAppSlug returns the slug of the application requested on its
+// subdomain, or an empty string for the requests on the instance domain
+func GetAppSlug(c *gin.Context) string {
+	if slug, ok := c.Get("app_slug"); ok {
+		return slug.(string)
+	}
+	return ""
+}
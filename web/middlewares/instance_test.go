@@ -51,6 +51,34 @@ func TestSetInstance(t *testing.T) {
 	res.Body.Close()
 }
 
+func TestNormalizeHost(t *testing.T) {
+	assert.Equal(t, "example.cozycloud.cc", normalizeHost("Example.CozyCloud.cc"))
+	assert.Equal(t, "example.cozycloud.cc", normalizeHost("example.cozycloud.cc."))
+	assert.Equal(t, "example.cozycloud.cc:8080", normalizeHost("example.cozycloud.cc.:8080"))
+	assert.Equal(t, "[::1]:8080", normalizeHost("[::1]:8080"))
+}
+
+func TestSplitAppHost(t *testing.T) {
+	slug, parent, ok := splitAppHost("drive.alice.example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "drive", slug)
+	assert.Equal(t, "alice.example.com", parent)
+
+	slug, parent, ok = splitAppHost("drive.alice.example.com:8080")
+	assert.True(t, ok)
+	assert.Equal(t, "drive", slug)
+	assert.Equal(t, "alice.example.com:8080", parent)
+
+	_, _, ok = splitAppHost("localhost")
+	assert.False(t, ok)
+	_, _, ok = splitAppHost("-drive.alice.example.com")
+	assert.False(t, ok)
+	_, _, ok = splitAppHost("drive_app.alice.example.com")
+	assert.False(t, ok)
+	_, _, ok = splitAppHost("drive.")
+	assert.False(t, ok)
+}
+
 func TestMain(m *testing.M) {
 	gin.SetMode(gin.TestMode)
 	os.Exit(m.Run())
@@ -0,0 +1,114 @@
+package middlewares
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// activeWindow is the duration after its last request during which an
+// instance is considered as active
+const activeWindow = 5 * time.Minute
+
+var (
+	httpRequestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cozy",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests, by method, route group and status code",
+	}, []string{"method", "group", "code"})
+
+	httpDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cozy",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the HTTP requests, by method and route group",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "group"})
+
+	activeInstancesGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "cozy",
+		Subsystem: "http",
+		Name:      "active_instances",
+		Help:      "Number of instances that have received a request in the last 5 minutes",
+	}, func() float64 { return float64(activeInstances.count(time.Now())) })
+
+	activeInstances = &activeSet{seen: make(map[string]time.Time)}
+)
+
+func init() {
+	prometheus.MustRegister(httpRequestsCounter, httpDurationHistogram, activeInstancesGauge)
+}
+
+// activeSet keeps the time of the last request of the instances
+type activeSet struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func (s *activeSet) touch(domain string, now time.Time) {
+	s.mu.Lock()
+	s.seen[domain] = now
+	s.mu.Unlock()
+}
+
+// count returns the number of instances seen in the active window, and
+// forgets the others
+func (s *activeSet) count(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for domain, t := range s.seen {
+		if now.Sub(t) > activeWindow {
+			delete(s.seen, domain)
+		}
+	}
+	return len(s.seen)
+}
+
+// Metrics creates a gin middleware that records the number and the duration
+// of the HTTP requests. The requests are grouped by the first segment of
+// their path, if it is one of the given groups, so that the unknown paths
+// can't create new series. The requests on the subdomains of the
+// applications are in the "serve" group.
+func Metrics(groups ...string) gin.HandlerFunc {
+	known := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		known[group] = true
+	}
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		group := requestGroup(c, known)
+		method := c.Request.Method
+		code := strconv.Itoa(c.Writer.Status())
+		httpRequestsCounter.WithLabelValues(method, group, code).Inc()
+		httpDurationHistogram.WithLabelValues(method, group).Observe(time.Since(start).Seconds())
+		if i, ok := c.Get("instance"); ok {
+			activeInstances.touch(i.(*instance.Instance).Domain, start)
+		}
+	}
+}
+
+// requestGroup returns the label of the route group of a request
+func requestGroup(c *gin.Context, known map[string]bool) string {
+	if GetAppSlug(c) != "" {
+		return "serve"
+	}
+	path := strings.TrimPrefix(c.Request.URL.Path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		path = path[:i]
+	}
+	if path == "" {
+		return "root"
+	}
+	if known[path] {
+		return path
+	}
+	return "other"
+}
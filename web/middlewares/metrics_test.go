@@ -0,0 +1,35 @@
+package middlewares
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActiveInstances(t *testing.T) {
+	s := &activeSet{seen: make(map[string]time.Time)}
+	now := time.Now()
+	s.touch("alice.cozy.example", now.Add(-10*time.Minute))
+	s.touch("bob.cozy.example", now.Add(-time.Minute))
+	s.touch("carol.cozy.example", now)
+	assert.Equal(t, 2, s.count(now))
+	s.touch("alice.cozy.example", now)
+	assert.Equal(t, 3, s.count(now))
+	assert.Equal(t, 0, s.count(now.Add(time.Hour)))
+}
+
+func TestRequestGroup(t *testing.T) {
+	known := map[string]bool{"files": true, "data": true}
+	group := func(path string) string {
+		req, _ := http.NewRequest("GET", "http://alice.cozy.example"+path, nil)
+		return requestGroup(&gin.Context{Request: req}, known)
+	}
+	assert.Equal(t, "files", group("/files/123"))
+	assert.Equal(t, "data", group("/data/io.cozy.contacts/"))
+	assert.Equal(t, "files", group("/files"))
+	assert.Equal(t, "root", group("/"))
+	assert.Equal(t, "other", group("/random-path"))
+}
@@ -0,0 +1,202 @@
+package middlewares
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/notifications"
+	"github.com/dcasier/cozy-stack/oauth"
+	"github.com/dcasier/cozy-stack/vfs"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// ErrInvalidToken is used when the token of the Authorization header
+	// is malformed or is not the token of an installed application
+	ErrInvalidToken = errors.New("Invalid application token")
+	// ErrForbiddenScope is used when an application has no scope for the
+	// requested operation
+	ErrForbiddenScope = errors.New("The application has no permission for this operation")
+)
+
+// SetApp creates a gin middleware that puts in the gin context the manifest
+// of the application, when the request has an application token in its
+// Authorization header (the token issued at its installation, or one
+// created by POST /apps/:slug/token), or the access token of an OAuth2
+// client. The scopes of this application or client are then enforced by the
+// AllowDoctype and AllowFiles middlewares. The token can also be an admin
+// token, given to the hosters by the admin server, with the rights of the
+// owner.
+func SetApp() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.Request.Header.Get("Authorization")
+		if header == "" {
+			return
+		}
+		if !strings.HasPrefix(header, "Bearer ") {
+			jsonapi.AbortWithError(c, jsonapi.Unauthorized(ErrInvalidToken))
+			return
+		}
+
+		token := strings.TrimPrefix(header, "Bearer ")
+		switch err := AuthenticateToken(c, token); err {
+		case nil:
+		case ErrInvalidToken:
+			jsonapi.AbortWithError(c, jsonapi.Unauthorized(err))
+		default:
+			jsonapi.AbortWithError(c, jsonapi.InternalServerError(err))
+		}
+	}
+}
+
+// AuthenticateToken puts in the gin context the manifest of the application,
+// the access token of the OAuth2 client, or the admin flag, for the given
+// token. It returns
+// ErrInvalidToken if the token is not valid for the instance.
+func AuthenticateToken(c *gin.Context, token string) error {
+	ctx := c.Request.Context()
+	dbprefix := GetInstance(c).GetDatabasePrefix()
+	man, err := apps.GetByToken(ctx, dbprefix, token)
+	if err == apps.ErrInvalidToken {
+		if apps.CheckAdminToken(ctx, dbprefix, token) != nil {
+			return ErrInvalidToken
+		}
+		c.Set("admin", true)
+		return nil
+	}
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		t, err := oauth.GetAccessToken(ctx, dbprefix, token)
+		if err == oauth.ErrInvalidToken {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+		c.Set("oauth_token", t)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.Set("app", man)
+	return nil
+}
+
+// IsAdmin returns true if the request has been made with an admin token
+func IsAdmin(c *gin.Context) bool {
+	_, ok := c.Get("admin")
+	return ok
+}
+
+// GetOAuthToken returns the access token of the OAuth2 client that has made
+// the request, or nil if the request has no such token
+func GetOAuthToken(c *gin.Context) *oauth.Token {
+	if t, ok := c.Get("oauth_token"); ok {
+		return t.(*oauth.Token)
+	}
+	return nil
+}
+
+// AllowedDoctype returns true if the request has been made by the owner, or
+// by an application or an OAuth2 client with a data scope for the doctype
+func AllowedDoctype(c *gin.Context, doctype string, access apps.Access) bool {
+	scopes, ok := requestScopes(c)
+	return !ok || scopes.CanAccessDoctype(doctype, access)
+}
+
+// AllowedFiles returns true if the request has been made by the owner, or
+// by an application or an OAuth2 client with a files scope
+func AllowedFiles(c *gin.Context, access apps.Access) bool {
+	scopes, ok := requestScopes(c)
+	return !ok || scopes.CanAccessFiles(access)
+}
+
+// AllowedSettings returns true if the request has been made by the owner, or
+// by an application or an OAuth2 client with a settings scope for the type
+// of settings
+func AllowedSettings(c *gin.Context, typ string, access apps.Access) bool {
+	scopes, ok := requestScopes(c)
+	return !ok || scopes.CanAccessSettings(typ, access)
+}
+
+// AllowedNotifications returns true if the request has been made by the
+// owner, or by an application or an OAuth2 client with a notifications scope
+func AllowedNotifications(c *gin.Context, access apps.Access) bool {
+	scopes, ok := requestScopes(c)
+	return !ok || scopes.CanAccessNotifications(access)
+}
+
+// AllowedEvents returns true if the request has been made by the owner, or
+// by an application or an OAuth2 client that can read the documents of the
+// doctype, and so their events. The files and the notifications have their
+// own scopes.
+func AllowedEvents(c *gin.Context, doctype string) bool {
+	switch doctype {
+	case vfs.FsDocType:
+		return AllowedFiles(c, apps.ReadAccess)
+	case notifications.DocType:
+		return AllowedNotifications(c, apps.ReadAccess)
+	}
+	return AllowedDoctype(c, doctype, apps.ReadAccess)
+}
+
+// AllowedJobs returns true if the request has been made by the owner, or by
+// an application or an OAuth2 client with a jobs scope for the worker type
+func AllowedJobs(c *gin.Context, workerType string) bool {
+	scopes, ok := requestScopes(c)
+	return !ok || scopes.CanPushJob(workerType)
+}
+
+// requestScopes returns the scopes of the application or the OAuth2 client
+// that has made the request, and false if it has been made by the owner
+func requestScopes(c *gin.Context) (apps.Scopes, bool) {
+	if man := GetApp(c); man != nil {
+		return man.Scopes, true
+	}
+	if t := GetOAuthToken(c); t != nil {
+		return t.Scope, true
+	}
+	return nil, false
+}
+
+// GetApp returns the manifest of the application that has made the request,
+// or nil if the request has no application token
+func GetApp(c *gin.Context) *apps.Manifest {
+	if man, ok := c.Get("app"); ok {
+		return man.(*apps.Manifest)
+	}
+	return nil
+}
+
+// requestAccess returns the access needed for the method of the request
+func requestAccess(c *gin.Context) apps.Access {
+	switch c.Request.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return apps.ReadAccess
+	}
+	return apps.WriteAccess
+}
+
+// AllowDoctype creates a gin middleware that checks that the application or
+// the OAuth2 client, if any, has a data scope for the doctype parameter of
+// the route
+func AllowDoctype() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !AllowedDoctype(c, c.Param("doctype"), requestAccess(c)) {
+			jsonapi.AbortWithError(c, jsonapi.Forbidden(ErrForbiddenScope))
+		}
+	}
+}
+
+// AllowFiles creates a gin middleware that checks that the application or
+// the OAuth2 client, if any, has a files scope for the request
+func AllowFiles() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !AllowedFiles(c, requestAccess(c)) {
+			jsonapi.AbortWithError(c, jsonapi.Forbidden(ErrForbiddenScope))
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package middlewares
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/dcasier/cozy-stack/logger"
+	"github.com/dcasier/cozy-stack/ratelimit"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/gin-gonic/gin"
+)
+
+// The groups of routes of the rate limiter, that have their own budgets
+const (
+	// RateLimitDefault is the group of all the requests to an instance
+	RateLimitDefault = "default"
+	// RateLimitAuth is the group of the authentication requests
+	RateLimitAuth = "auth"
+)
+
+// ErrTooManyRequests is used when a client has exceeded its budget of
+// requests
+var ErrTooManyRequests = errors.New("Too many requests, retry later")
+
+var (
+	rateMu     sync.RWMutex
+	rateStore  ratelimit.Store
+	rateLimits map[string]ratelimit.Limit
+)
+
+// UseRateLimiter enables the rate limiter, with the store for the buckets
+// and the limits of the groups of routes. A nil store disables it.
+func UseRateLimiter(store ratelimit.Store, limits map[string]ratelimit.Limit) {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	rateStore = store
+	rateLimits = limits
+}
+
+// UseRateLimits changes the limits of the groups of routes, and keeps the
+// buckets of the clients. It is used when the configuration is reloaded.
+func UseRateLimits(limits map[string]ratelimit.Limit) {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	rateLimits = limits
+}
+
+func getRateLimit(group string) (ratelimit.Store, ratelimit.Limit, bool) {
+	rateMu.RLock()
+	defer rateMu.RUnlock()
+	limit, ok := rateLimits[group]
+	return rateStore, limit, ok
+}
+
+// RateLimit creates a gin middleware that limits the requests of a client
+// on an instance for a group of routes, with a budget for each client IP
+// and each instance. The requests over the budget are rejected with a
+// 429 Too Many Requests, and a Retry-After header.
+func RateLimit(group string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		store, limit, ok := getRateLimit(group)
+		if store == nil || !ok || !limit.Enabled() {
+			return
+		}
+
+		key := group + ":" + GetInstance(c).Domain + ":" + ClientIP(c)
+		wait, err := store.Take(key, limit)
+		if err != nil {
+			// a failure of the store must not make the instance unavailable
+			logger.Errorf("ratelimit", "cannot take a token for %s: %v", key, err)
+			return
+		}
+		if wait > 0 {
+			seconds := int(math.Ceil(wait.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(seconds))
+			jsonapi.AbortWithError(c, &jsonapi.Error{
+				Status: http.StatusTooManyRequests,
+				Title:  http.StatusText(http.StatusTooManyRequests),
+				Detail: ErrTooManyRequests.Error(),
+			})
+		}
+	}
+}
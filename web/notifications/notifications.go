@@ -0,0 +1,133 @@
+// Package notifications is the HTTP frontend of the notifications package.
+// The applications and the konnectors create notifications for the user,
+// and the home application lists the unread ones and marks them as read.
+package notifications
+
+import (
+	"net/http"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/notifications"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+func wrapNotificationsError(err error) *jsonapi.Error {
+	if couchErr, isCouchErr := err.(*couchdb.Error); isCouchErr {
+		return jsonapi.WrapCouchError(couchErr)
+	}
+	switch err {
+	case notifications.ErrMissingTitle:
+		return jsonapi.InvalidAttribute("title", err)
+	}
+	return jsonapi.InternalServerError(err)
+}
+
+// allowed returns true if the application or the OAuth2 client, if any, has
+// a notifications scope, or else it aborts the request
+func allowed(c *gin.Context, access apps.Access) bool {
+	if !middlewares.AllowedNotifications(c, access) {
+		jsonapi.AbortWithError(c, jsonapi.Forbidden(middlewares.ErrForbiddenScope))
+		return false
+	}
+	return true
+}
+
+// createHandler handles POST /notifications requests. It creates an unread
+// notification with the attributes of the JSON-API body. Its source is the
+// application or the OAuth2 client that has made the request.
+func createHandler(c *gin.Context) {
+	if !allowed(c, apps.WriteAccess) {
+		return
+	}
+	n := &notifications.Notification{}
+	if _, e := jsonapi.Bind(c, notifications.DocType, n); e != nil {
+		jsonapi.AbortWithError(c, e)
+		return
+	}
+	n.SetID("")
+	n.SetRev("")
+	n.Source = ""
+	if app := middlewares.GetApp(c); app != nil {
+		n.Source = app.Slug
+	} else if t := middlewares.GetOAuthToken(c); t != nil {
+		n.Source = t.ClientID
+	}
+
+	instance := middlewares.GetInstance(c)
+	if err := notifications.Create(c.Request.Context(), instance.GetDatabasePrefix(), n); err != nil {
+		jsonapi.AbortWithError(c, wrapNotificationsError(err))
+		return
+	}
+	jsonapi.Data(c, http.StatusCreated, n, nil)
+}
+
+// listHandler handles GET /notifications requests. It returns the unread
+// notifications, the most recent first, paginated with page[limit] and
+// page[cursor].
+func listHandler(c *gin.Context) {
+	if !allowed(c, apps.ReadAccess) {
+		return
+	}
+	page, perr := jsonapi.PageParams(c)
+	if perr != nil {
+		jsonapi.AbortWithError(c, perr)
+		return
+	}
+	instance := middlewares.GetInstance(c)
+	list, err := notifications.ListUnread(c.Request.Context(), instance.GetDatabasePrefix())
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapNotificationsError(err))
+		return
+	}
+	objs := make([]jsonapi.Object, len(list))
+	for i, n := range list {
+		objs[i] = n
+	}
+	objs, info, perr := jsonapi.PaginateObjects(objs, page)
+	if perr != nil {
+		jsonapi.AbortWithError(c, perr)
+		return
+	}
+	jsonapi.PaginatedDataList(c, http.StatusOK, objs, info)
+}
+
+// readHandler handles PUT /notifications/:notification-id/read requests. It
+// marks a notification as read.
+func readHandler(c *gin.Context) {
+	if !allowed(c, apps.WriteAccess) {
+		return
+	}
+	instance := middlewares.GetInstance(c)
+	id := c.Param("notification-id")
+	n, err := notifications.MarkAsRead(c.Request.Context(), instance.GetDatabasePrefix(), id)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapNotificationsError(err))
+		return
+	}
+	jsonapi.Data(c, http.StatusOK, n, nil)
+}
+
+// readAllHandler handles POST /notifications/read requests. It marks all
+// the unread notifications as read.
+func readAllHandler(c *gin.Context) {
+	if !allowed(c, apps.WriteAccess) {
+		return
+	}
+	instance := middlewares.GetInstance(c)
+	if _, err := notifications.MarkAllAsRead(c.Request.Context(), instance.GetDatabasePrefix()); err != nil {
+		jsonapi.AbortWithError(c, wrapNotificationsError(err))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Routes sets the routing for the notifications service
+func Routes(router *gin.RouterGroup) {
+	router.GET("/", listHandler)
+	router.POST("/", createHandler)
+	router.POST("/read", readAllHandler)
+	router.PUT("/:notification-id/read", readHandler)
+}
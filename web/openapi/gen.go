@@ -0,0 +1,26 @@
+//go:build ignore
+// +build ignore
+
+// This program generates spec.go from the annotations of the web packages.
+// It is invoked by running go generate in this directory.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/dcasier/cozy-stack/web/openapi"
+)
+
+func main() {
+	src, err := openapi.Source("..")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = ioutil.WriteFile("spec.go", src, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
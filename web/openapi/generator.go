@@ -0,0 +1,453 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	metaAnnotation  = "swagger:meta"
+	routeAnnotation = "swagger:route"
+)
+
+// Spec is a Swagger 2.0 (aka OpenAPI 2) document
+type Spec struct {
+	Swagger  string                           `json:"swagger"`
+	Info     Info                             `json:"info"`
+	Host     string                           `json:"host,omitempty"`
+	BasePath string                           `json:"basePath,omitempty"`
+	Schemes  []string                         `json:"schemes,omitempty"`
+	Consumes []string                         `json:"consumes,omitempty"`
+	Produces []string                         `json:"produces,omitempty"`
+	Paths    map[string]map[string]*Operation `json:"paths"`
+}
+
+// Info is the metadata of the API, from the swagger:meta annotation
+type Info struct {
+	Title          string   `json:"title"`
+	Description    string   `json:"description,omitempty"`
+	TermsOfService string   `json:"termsOfService,omitempty"`
+	Contact        *Contact `json:"contact,omitempty"`
+	License        *License `json:"license,omitempty"`
+	Version        string   `json:"version"`
+}
+
+// Contact is the contact information of the API
+type Contact struct {
+	Name  string `json:"name,omitempty"`
+	URL   string `json:"url,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+// License is the license of the API
+type License struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+// Operation is a route of the API, from a swagger:route annotation
+type Operation struct {
+	Tags        []string             `json:"tags,omitempty"`
+	Summary     string               `json:"summary,omitempty"`
+	Description string               `json:"description,omitempty"`
+	OperationID string               `json:"operationId"`
+	Consumes    []string             `json:"consumes,omitempty"`
+	Produces    []string             `json:"produces,omitempty"`
+	Parameters  []Parameter          `json:"parameters,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+// Parameter is a parameter of an operation. Only the parameters of the
+// paths are generated.
+type Parameter struct {
+	Name     string `json:"name"`
+	In       string `json:"in"`
+	Required bool   `json:"required"`
+	Type     string `json:"type"`
+}
+
+// Response is a response of an operation
+type Response struct {
+	Description string `json:"description"`
+}
+
+// pathParam matches the parameters of the paths of gin, like :file-id and
+// *path, to turn them into the {file-id} parameters of swagger
+var pathParam = regexp.MustCompile(`[:*]([^/]+)`)
+
+// sectionLine matches the lines like "Host: localhost" or "Responses:" of
+// the annotations
+var sectionLine = regexp.MustCompile(`^([A-Za-z][A-Za-z ]*):\s*(.*)$`)
+
+// Generate parses the Go files of the given directory and of its
+// sub-directories, and returns the spec built from their annotations: the
+// package comment with swagger:meta for the metadata of the API, and the
+// doc comments of the functions with swagger:route lines for its routes.
+//
+// A route annotation is written like go-swagger does:
+//
+//	swagger:route METHOD /path/:param tag1 tag2 operationID
+//
+// Its summary and description are the text of the doc comment after the
+// annotation, or before it if there is none after. The Consumes:, Produces:
+// and Responses: sections can be used to describe the route.
+func Generate(root string) ([]byte, error) {
+	spec := &Spec{
+		Swagger: "2.0",
+		Paths:   make(map[string]map[string]*Operation),
+	}
+	ids := make(map[string]string)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		fset := token.NewFileSet()
+		pkgs, err := parser.ParseDir(fset, path, isSource, parser.ParseComments)
+		if err != nil {
+			return err
+		}
+		for _, pkg := range pkgs {
+			for _, name := range sortedFiles(pkg) {
+				file := pkg.Files[name]
+				if file.Doc != nil && hasLine(file.Doc.Text(), metaAnnotation) {
+					parseMeta(&spec.Info, spec, file.Doc.Text())
+				}
+				for _, decl := range file.Decls {
+					fn, ok := decl.(*ast.FuncDecl)
+					if !ok || fn.Doc == nil {
+						continue
+					}
+					if err := parseRoutes(spec, ids, fn.Name.Name, fn.Doc.Text()); err != nil {
+						return fmt.Errorf("%s: %s", fset.Position(fn.Pos()), err)
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if spec.Info.Title == "" {
+		return nil, fmt.Errorf("No %s annotation in %s", metaAnnotation, root)
+	}
+
+	b, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// hasLine returns true if the text has a line with only the given content
+func hasLine(text, content string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == content {
+			return true
+		}
+	}
+	return false
+}
+
+func isSource(info os.FileInfo) bool {
+	return !strings.HasSuffix(info.Name(), "_test.go")
+}
+
+func sortedFiles(pkg *ast.Package) []string {
+	names := make([]string, 0, len(pkg.Files))
+	for name := range pkg.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseMeta fills the info and the global fields of the spec with the
+// package comment that has the swagger:meta annotation
+func parseMeta(info *Info, spec *Spec, text string) {
+	var section string
+	var description, tos []string
+	for i, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if i == 0 && strings.HasPrefix(trimmed, "Package ") {
+			// Package web Cozy Stack API.
+			if parts := strings.SplitN(trimmed, " ", 3); len(parts) == 3 {
+				info.Title = parts[2]
+			}
+			continue
+		}
+		if trimmed == metaAnnotation {
+			continue
+		}
+		if m := sectionLine.FindStringSubmatch(trimmed); m != nil {
+			section = strings.ToLower(m[1])
+			value := m[2]
+			switch section {
+			case "schemes":
+				spec.Schemes = splitList(value)
+			case "host":
+				spec.Host = value
+			case "basepath":
+				spec.BasePath = value
+			case "version":
+				info.Version = value
+			case "license":
+				info.License = parseLicense(value)
+			case "contact":
+				info.Contact = parseContact(value)
+			case "consumes", "produces", "terms of service":
+			default:
+				section = ""
+				description = append(description, trimmed)
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(trimmed, "- ") && section == "consumes":
+			spec.Consumes = append(spec.Consumes, strings.TrimSpace(trimmed[2:]))
+		case strings.HasPrefix(trimmed, "- ") && section == "produces":
+			spec.Produces = append(spec.Produces, strings.TrimSpace(trimmed[2:]))
+		case section == "terms of service":
+			tos = append(tos, trimmed)
+		case section == "":
+			description = append(description, trimmed)
+		}
+	}
+	info.Description = strings.Join(paragraphs(description), "\n\n")
+	info.TermsOfService = strings.Join(paragraphs(tos), "\n\n")
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseLicense parses a license like "AGPL-3.0 https://..."
+func parseLicense(value string) *License {
+	license := &License{}
+	for _, field := range strings.Fields(value) {
+		if strings.Contains(field, "://") {
+			license.URL = field
+		} else {
+			license.Name = strings.TrimSpace(license.Name + " " + field)
+		}
+	}
+	return license
+}
+
+// parseContact parses a contact like "Name <email> https://..."
+func parseContact(value string) *Contact {
+	contact := &Contact{}
+	for _, field := range strings.Fields(value) {
+		switch {
+		case strings.HasPrefix(field, "<") && strings.HasSuffix(field, ">"):
+			contact.Email = field[1 : len(field)-1]
+		case strings.Contains(field, "://"):
+			contact.URL = field
+		default:
+			contact.Name = strings.TrimSpace(contact.Name + " " + field)
+		}
+	}
+	return contact
+}
+
+// parseRoutes adds the routes of the swagger:route annotations of the doc
+// comment of a function to the spec
+func parseRoutes(spec *Spec, ids map[string]string, funcName, comment string) error {
+	lines := strings.Split(comment, "\n")
+	first, last := -1, -1
+	for i, line := range lines {
+		if strings.HasPrefix(line, routeAnnotation+" ") {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+
+	before := lines[:first]
+	after := lines[last+1:]
+	text, sections := parseRouteText(after)
+	if len(text) == 0 {
+		text, _ = parseRouteText(before)
+		text = stripFuncName(text, funcName)
+	}
+	summary, description := summarize(text)
+
+	for _, line := range lines[first : last+1] {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != routeAnnotation || len(fields) < 4 {
+			return fmt.Errorf("Invalid annotation %q", line)
+		}
+		method := strings.ToLower(fields[1])
+		path := pathParam.ReplaceAllString(fields[2], "{$1}")
+		id := fields[len(fields)-1]
+		if other, ok := ids[id]; ok {
+			return fmt.Errorf("Duplicate operation id %s, already used by %s", id, other)
+		}
+		ids[id] = strings.ToUpper(method) + " " + path
+		if spec.Paths[path] == nil {
+			spec.Paths[path] = make(map[string]*Operation)
+		}
+		if _, ok := spec.Paths[path][method]; ok {
+			return fmt.Errorf("Duplicate route %s %s", strings.ToUpper(method), path)
+		}
+
+		op := &Operation{
+			Tags:        fields[3 : len(fields)-1],
+			Summary:     summary,
+			Description: description,
+			OperationID: id,
+			Consumes:    sections.consumes,
+			Produces:    sections.produces,
+			Responses:   sections.responses,
+		}
+		for _, m := range pathParam.FindAllStringSubmatch(fields[2], -1) {
+			op.Parameters = append(op.Parameters, Parameter{
+				Name:     m[1],
+				In:       "path",
+				Required: true,
+				Type:     "string",
+			})
+		}
+		if len(op.Responses) == 0 {
+			op.Responses = map[string]*Response{"200": {Description: "OK"}}
+		}
+		spec.Paths[path][method] = op
+	}
+	return nil
+}
+
+type routeSections struct {
+	consumes  []string
+	produces  []string
+	responses map[string]*Response
+}
+
+// parseRouteText splits the lines of the doc comment of a route between
+// its text and its sections
+func parseRouteText(lines []string) ([]string, routeSections) {
+	var text []string
+	var sections routeSections
+	var section string
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if m := sectionLine.FindStringSubmatch(trimmed); m != nil && m[2] == "" {
+			switch s := strings.ToLower(m[1]); s {
+			case "consumes", "produces", "responses":
+				section = s
+				continue
+			}
+		}
+		switch section {
+		case "consumes", "produces":
+			if strings.HasPrefix(trimmed, "- ") {
+				item := strings.TrimSpace(trimmed[2:])
+				if section == "consumes" {
+					sections.consumes = append(sections.consumes, item)
+				} else {
+					sections.produces = append(sections.produces, item)
+				}
+				continue
+			}
+		case "responses":
+			if parts := strings.SplitN(trimmed, ":", 2); len(parts) == 2 {
+				if sections.responses == nil {
+					sections.responses = make(map[string]*Response)
+				}
+				code := strings.TrimSpace(parts[0])
+				sections.responses[code] = &Response{Description: strings.TrimSpace(parts[1])}
+				continue
+			}
+		}
+		if trimmed != "" {
+			section = ""
+		}
+		text = append(text, trimmed)
+	}
+	return paragraphs(text), sections
+}
+
+// paragraphs joins the lines of the paragraphs separated by empty lines
+func paragraphs(lines []string) []string {
+	var paras []string
+	var current []string
+	for _, line := range append(lines, "") {
+		if line != "" {
+			current = append(current, line)
+			continue
+		}
+		if len(current) > 0 {
+			paras = append(paras, strings.Join(current, " "))
+			current = nil
+		}
+	}
+	return paras
+}
+
+// stripFuncName removes the name of the function from the start of its
+// doc comment, as in "ShareHandler handles POST requests...", to use the
+// rest as the description of the route. The case is ignored, as some
+// unexported handlers are documented with an uppercase name.
+func stripFuncName(paras []string, funcName string) []string {
+	if len(paras) == 0 || len(paras[0]) <= len(funcName) ||
+		!strings.EqualFold(paras[0][:len(funcName)+1], funcName+" ") {
+		return paras
+	}
+	rest := paras[0][len(funcName)+1:]
+	r, size := utf8.DecodeRuneInString(rest)
+	paras[0] = string(unicode.ToUpper(r)) + rest[size:]
+	return paras
+}
+
+// summarize returns the first sentence of the text as the summary, and
+// the rest as the description
+func summarize(paras []string) (string, string) {
+	if len(paras) == 0 {
+		return "", ""
+	}
+	first := paras[0]
+	rest := paras[1:]
+	if i := strings.Index(first, ". "); i >= 0 {
+		rest = append([]string{first[i+2:]}, rest...)
+		first = first[:i+1]
+	}
+	return first, strings.Join(rest, "\n\n")
+}
+
+// Source returns the Go source of the spec.go file, with the spec
+// generated from the annotations of the directory root
+func Source(root string) ([]byte, error) {
+	spec, err := Generate(root)
+	if err != nil {
+		return nil, err
+	}
+	quoted := strings.Replace(string(spec), "`", "` + \"`\" + `", -1)
+	src := "// Code generated by gen.go; DO NOT EDIT.\n\n" +
+		"package openapi\n\n" +
+		"// spec is the OpenAPI specification of the API, see Generate\n" +
+		"const spec = `" + quoted + "`\n"
+	return []byte(src), nil
+}
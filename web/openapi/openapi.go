@@ -0,0 +1,25 @@
+// Package openapi serves the OpenAPI (aka Swagger 2.0) specification of the
+// API of the stack, that can be used to generate the client SDKs. The spec
+// is generated from the swagger:meta and swagger:route annotations of the
+// code of the web packages, with go generate.
+package openapi
+
+//go:generate go run gen.go
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAPI responds with the OpenAPI specification of the API
+//
+// swagger:route GET /openapi.json openapi showOpenAPI
+func OpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(spec))
+}
+
+// Routes sets the routing for the OpenAPI specification
+func Routes(router *gin.RouterGroup) {
+	router.GET("/openapi.json", OpenAPI)
+}
@@ -0,0 +1,114 @@
+package openapi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpecIsUpToDate(t *testing.T) {
+	expected, err := Source("..")
+	if !assert.NoError(t, err) {
+		return
+	}
+	actual, err := ioutil.ReadFile("spec.go")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, string(expected) == string(actual),
+		"spec.go is not up-to-date, run go generate ./web/openapi/")
+}
+
+func TestRoutes(t *testing.T) {
+	router := gin.New()
+	Routes(router.Group("/"))
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/openapi.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, "200 OK", res.Status)
+	assert.Equal(t, "application/json; charset=utf-8", res.Header.Get("Content-Type"))
+
+	var doc Spec
+	if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&doc)) {
+		return
+	}
+	assert.Equal(t, "2.0", doc.Swagger)
+	assert.Equal(t, "Cozy Stack API.", doc.Info.Title)
+	assert.Equal(t, []string{"application/json"}, doc.Consumes)
+	if assert.NotNil(t, doc.Info.License) {
+		assert.Equal(t, "AGPL-3.0", doc.Info.License.Name)
+	}
+
+	for _, route := range []struct{ path, method string }{
+		{"/files/{file-id}", "get"},
+		{"/files/{folder-id}", "post"},
+		{"/data/{doctype}/{docid}", "put"},
+		{"/apps/{slug}", "post"},
+		{"/konnectors/{slug}", "post"},
+		{"/auth/login", "post"},
+		{"/settings/instance", "get"},
+		{"/openapi.json", "get"},
+	} {
+		if assert.Contains(t, doc.Paths, route.path) {
+			assert.Contains(t, doc.Paths[route.path], route.method, route.path)
+		}
+	}
+
+	op := doc.Paths["/files/{file-id}/share"]["post"]
+	if assert.NotNil(t, op) {
+		assert.Equal(t, "shareFile", op.OperationID)
+		assert.Equal(t, []string{"files"}, op.Tags)
+		assert.Equal(t, "Handles POST requests on /files/:file-id/share to create a public link to a file or a directory.", op.Summary)
+		assert.Equal(t, []Parameter{{Name: "file-id", In: "path", Required: true, Type: "string"}}, op.Parameters)
+		assert.Contains(t, op.Responses, "201")
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-openapi")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	meta := "// Package web Test API.\n//\n// swagger:meta\npackage web\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "web.go"), []byte(meta), 0644))
+	_, err = Generate(dir)
+	assert.NoError(t, err)
+
+	routes := `package web
+
+// swagger:route GET /foo foo getFoo
+func foo() {}
+
+// swagger:route GET /bar foo getFoo
+func bar() {}
+`
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "routes.go"), []byte(routes), 0644))
+	_, err = Generate(dir)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Duplicate operation id getFoo")
+	}
+
+	assert.NoError(t, os.Remove(filepath.Join(dir, "web.go")))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "routes.go")))
+	_, err = Generate(dir)
+	assert.Error(t, err)
+}
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
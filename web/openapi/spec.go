@@ -0,0 +1,1256 @@
+// Code generated by gen.go; DO NOT EDIT.
+
+package openapi
+
+// spec is the OpenAPI specification of the API, see Generate
+const spec = `{
+  "swagger": "2.0",
+  "info": {
+    "title": "Cozy Stack API.",
+    "description": "Cozy is a personal platform as a service with a focus on data.",
+    "termsOfService": "there are no TOS at this moment, use at your own risk we take no responsibility",
+    "contact": {
+      "name": "Bruno Michel",
+      "url": "https://cozy.io/",
+      "email": "bruno@cozycloud.cc"
+    },
+    "license": {
+      "name": "AGPL-3.0",
+      "url": "https://opensource.org/licenses/agpl-3.0"
+    },
+    "version": "0.0.1"
+  },
+  "host": "localhost",
+  "basePath": "/",
+  "schemes": [
+    "https"
+  ],
+  "consumes": [
+    "application/json"
+  ],
+  "produces": [
+    "application/json"
+  ],
+  "paths": {
+    "/apps/": {
+      "get": {
+        "tags": [
+          "apps"
+        ],
+        "summary": "Lists the installed applications or konnectors.",
+        "description": "They can be filtered by state with ?state=, and the list is paginated with page[limit] and page[cursor].",
+        "operationId": "listApps",
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/apps/{slug}": {
+      "delete": {
+        "tags": [
+          "apps"
+        ],
+        "summary": "Removes an installed application or konnector.",
+        "operationId": "uninstallApp",
+        "parameters": [
+          {
+            "name": "slug",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "204": {
+            "description": "the application has been removed"
+          }
+        }
+      },
+      "get": {
+        "tags": [
+          "apps"
+        ],
+        "summary": "Responds with the manifest of an installed application or konnector.",
+        "operationId": "showApp",
+        "parameters": [
+          {
+            "name": "slug",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      },
+      "post": {
+        "tags": [
+          "apps"
+        ],
+        "summary": "Installs an application or a konnector from the given Source.",
+        "description": "The installation continues in the background, and its progress can be followed on the events route.",
+        "operationId": "installApp",
+        "parameters": [
+          {
+            "name": "slug",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "202": {
+            "description": "the manifest of the application being installed"
+          }
+        }
+      },
+      "put": {
+        "tags": [
+          "apps"
+        ],
+        "summary": "Updates an installed application or konnector to the last version of its source.",
+        "description": "The update continues in the background.",
+        "operationId": "updateApp",
+        "parameters": [
+          {
+            "name": "slug",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "202": {
+            "description": "the manifest of the application being updated"
+          }
+        }
+      }
+    },
+    "/apps/{slug}/events": {
+      "get": {
+        "tags": [
+          "apps"
+        ],
+        "summary": "Streams the progress of the installation or update of an application or konnector, as server-sent events, until it is done or has failed.",
+        "operationId": "appEvents",
+        "produces": [
+          "text/event-stream"
+        ],
+        "parameters": [
+          {
+            "name": "slug",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/apps/{slug}/rollback": {
+      "post": {
+        "tags": [
+          "apps"
+        ],
+        "summary": "Restores the previous version of an installed application or konnector.",
+        "operationId": "rollbackApp",
+        "parameters": [
+          {
+            "name": "slug",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/apps/{slug}/token": {
+      "post": {
+        "tags": [
+          "apps"
+        ],
+        "summary": "Handles all POST /:slug/token requests and creates a token for the installed application with the given slug.",
+        "description": "The application can then use this token to access the data and files allowed by its scopes.",
+        "operationId": "createAppToken",
+        "parameters": [
+          {
+            "name": "slug",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "201": {
+            "description": "the token of the application"
+          }
+        }
+      }
+    },
+    "/auth/access_token": {
+      "post": {
+        "tags": [
+          "auth"
+        ],
+        "summary": "Handles POST /auth/access_token requests.",
+        "description": "It gives an access token to the client, in exchange of an authorization code or a refresh token.",
+        "operationId": "accessToken",
+        "consumes": [
+          "application/x-www-form-urlencoded"
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/auth/authorize": {
+      "get": {
+        "tags": [
+          "auth"
+        ],
+        "summary": "Handles GET /auth/authorize requests.",
+        "description": "It shows to the logged-in owner of the instance the permissions asked by the client. The page can't be embedded in a frame, where a malicious site could trick the owner into clicking on the button.",
+        "operationId": "authorizeForm",
+        "produces": [
+          "text/html"
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      },
+      "post": {
+        "tags": [
+          "auth"
+        ],
+        "summary": "Handles POST /auth/authorize requests, when the owner accepts the request of the client.",
+        "description": "The browser is redirected to the client with an authorization code. The form has the CSRF token of the session, checked by the CheckCSRF middleware.",
+        "operationId": "authorize",
+        "consumes": [
+          "application/x-www-form-urlencoded"
+        ],
+        "responses": {
+          "302": {
+            "description": "the redirection to the client with the authorization code"
+          }
+        }
+      }
+    },
+    "/auth/login": {
+      "delete": {
+        "tags": [
+          "auth"
+        ],
+        "summary": "Handles DELETE /auth/login requests.",
+        "description": "It destroys the session and removes the cookie.",
+        "operationId": "logout",
+        "responses": {
+          "204": {
+            "description": "the session has been closed"
+          }
+        }
+      },
+      "post": {
+        "tags": [
+          "auth"
+        ],
+        "summary": "Handles POST /auth/login requests.",
+        "description": "It checks the passphrase and opens a session for the owner of the instance.",
+        "operationId": "login",
+        "consumes": [
+          "application/x-www-form-urlencoded"
+        ],
+        "responses": {
+          "204": {
+            "description": "a session has been opened"
+          }
+        }
+      }
+    },
+    "/auth/passphrase": {
+      "get": {
+        "tags": [
+          "auth"
+        ],
+        "summary": "Handles GET /auth/passphrase requests.",
+        "description": "It shows the onboarding page, with the registration token of the registerToken parameter, until the owner has registered the passphrase.",
+        "operationId": "onboardingForm",
+        "produces": [
+          "text/html"
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      },
+      "post": {
+        "tags": [
+          "auth"
+        ],
+        "summary": "Handles POST /auth/passphrase requests.",
+        "description": "It sets the passphrase of an instance that has none yet, with the registration token in hexadecimal, and logs in its owner.",
+        "operationId": "registerPassphrase",
+        "consumes": [
+          "application/x-www-form-urlencoded"
+        ],
+        "responses": {
+          "204": {
+            "description": "the passphrase has been registered and a session opened"
+          }
+        }
+      }
+    },
+    "/auth/register": {
+      "post": {
+        "tags": [
+          "auth"
+        ],
+        "summary": "Handles POST /auth/register requests, for the dynamic registration of the OAuth2 clients",
+        "operationId": "registerClient",
+        "responses": {
+          "201": {
+            "description": "the registered client"
+          }
+        }
+      }
+    },
+    "/data/_doctypes": {
+      "get": {
+        "tags": [
+          "data"
+        ],
+        "summary": "Handles GET /data/_doctypes requests.",
+        "description": "It returns the known doctypes, with their JSON schemas, for the tooling of the developers.",
+        "operationId": "listDoctypes",
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/data/{doctype}/": {
+      "post": {
+        "tags": [
+          "data"
+        ],
+        "summary": "Create doc from the json passed as body",
+        "operationId": "createDoc",
+        "parameters": [
+          {
+            "name": "doctype",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "201": {
+            "description": "the created document"
+          }
+        }
+      }
+    },
+    "/data/{doctype}/_all_docs": {
+      "get": {
+        "tags": [
+          "data"
+        ],
+        "summary": "Handles GET /data/:doctype/_all_docs requests.",
+        "description": "It returns the documents of a doctype in the order of their ids, by pages of limit documents, from the startkey parameter. The response is the one of CouchDB, with the link to the next page in a Link header, or a JSON-API document if the client accepts it, with the link in links.next. The design documents are not sent.",
+        "operationId": "allDocs",
+        "parameters": [
+          {
+            "name": "doctype",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/data/{doctype}/_bulk_docs": {
+      "post": {
+        "tags": [
+          "data"
+        ],
+        "summary": "Handles POST /data/:doctype/_bulk_docs requests.",
+        "description": "It creates, updates and deletes several documents of a doctype in a single request, and returns the result of each document in the same order. The documents without _id are created, and the ones with _deleted are deleted. A document that can't be written, like an update with a stale revision, does not prevent the others to be written, but nothing is written if a document doesn't match the schema of the doctype.",
+        "operationId": "bulkDocs",
+        "parameters": [
+          {
+            "name": "doctype",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "201": {
+            "description": "the results of the documents"
+          }
+        }
+      }
+    },
+    "/data/{doctype}/_changes": {
+      "get": {
+        "tags": [
+          "data"
+        ],
+        "summary": "Handles GET /data/:doctype/_changes requests.",
+        "description": "It returns the changes of the documents of a doctype, since the since parameter, like the _changes of CouchDB, so that the client-side databases like PouchDB can replicate the doctype. The design documents are not sent.",
+        "operationId": "changesFeed",
+        "parameters": [
+          {
+            "name": "doctype",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/data/{doctype}/_find": {
+      "post": {
+        "tags": [
+          "data"
+        ],
+        "summary": "Handles POST /data/:doctype/_find requests.",
+        "description": "It queries the documents of a doctype with a mango selector, via the indexes of the doctype. The applications need a read permission on the doctype.",
+        "operationId": "findDocs",
+        "parameters": [
+          {
+            "name": "doctype",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/data/{doctype}/{docid}": {
+      "delete": {
+        "tags": [
+          "data"
+        ],
+        "summary": "Deletes a document.",
+        "description": "Its revision must be given in the rev parameter or the If-Match header, and a revision that is not the current one gives a 409 Conflict.",
+        "operationId": "deleteDoc",
+        "parameters": [
+          {
+            "name": "doctype",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          },
+          {
+            "name": "docid",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      },
+      "get": {
+        "tags": [
+          "data"
+        ],
+        "summary": "Get a doc by its type and id",
+        "operationId": "getDoc",
+        "parameters": [
+          {
+            "name": "doctype",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          },
+          {
+            "name": "docid",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      },
+      "put": {
+        "tags": [
+          "data"
+        ],
+        "summary": "Updates a document, or creates it with the id of the URL if the body has no _id.",
+        "description": "The revision of an update can be given in the _rev field, the rev parameter or the If-Match header, and a revision that is not the current one gives a 409 Conflict.",
+        "operationId": "updateDoc",
+        "parameters": [
+          {
+            "name": "doctype",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          },
+          {
+            "name": "docid",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/data/{doctype}/{docid}/{attachment-name}": {
+      "delete": {
+        "tags": [
+          "data"
+        ],
+        "summary": "Handles DELETE /data/:doctype/:docid/:attachment-name requests.",
+        "description": "Like for the deletion of a document, the revision must be given in the rev parameter or the If-Match header.",
+        "operationId": "deleteAttachment",
+        "parameters": [
+          {
+            "name": "doctype",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          },
+          {
+            "name": "docid",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          },
+          {
+            "name": "attachment-name",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      },
+      "get": {
+        "tags": [
+          "data"
+        ],
+        "summary": "Handles GET /data/:doctype/:docid/:attachment-name requests.",
+        "description": "The content of the attachment is streamed from CouchDB, with its digest as ETag. As its type is chosen by the client that has put it, the attachment is sandboxed, and downloaded unless its type is safe.",
+        "operationId": "getAttachment",
+        "produces": [
+          "*/*"
+        ],
+        "parameters": [
+          {
+            "name": "doctype",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          },
+          {
+            "name": "docid",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          },
+          {
+            "name": "attachment-name",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      },
+      "put": {
+        "tags": [
+          "data"
+        ],
+        "summary": "Handles PUT /data/:doctype/:docid/:attachment-name requests.",
+        "description": "The body of the request is streamed to CouchDB as the content of the attachment, that is added to the document or replaces the previous one. The revision of the document must be given in the If-Match header or the rev parameter, except to create a new document with only this attachment.",
+        "operationId": "putAttachment",
+        "consumes": [
+          "*/*"
+        ],
+        "parameters": [
+          {
+            "name": "doctype",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          },
+          {
+            "name": "docid",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          },
+          {
+            "name": "attachment-name",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "201": {
+            "description": "the new revision of the document"
+          }
+        }
+      }
+    },
+    "/files/": {
+      "post": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handle all POST requests on /files/:folder-id aiming at creating a new document in the FS.",
+        "description": "Given the Type parameter of the request, it will either upload a new file or create a new directory.",
+        "operationId": "uploadFileOrCreateDirAtRoot",
+        "responses": {
+          "201": {
+            "description": "the created file or directory"
+          }
+        }
+      }
+    },
+    "/files/download": {
+      "get": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handles all GET requests on /files/:file-id aiming at downloading a file.",
+        "description": "It serves two main purposes in this regard: - downloading a file given its ID in inline mode - downloading a file given its path in attachment mode on the /files/download endpoint",
+        "operationId": "downloadFileByPath",
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/files/download/{file-id}": {
+      "get": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handles all GET requests on /files/:file-id aiming at downloading a file.",
+        "description": "It serves two main purposes in this regard: - downloading a file given its ID in inline mode - downloading a file given its path in attachment mode on the /files/download endpoint",
+        "operationId": "downloadFileByID",
+        "parameters": [
+          {
+            "name": "file-id",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/files/metadata": {
+      "get": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handles all GET requests on /files/metadata aiming at getting file metadata from its path.",
+        "operationId": "getFileMetadataByPath",
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      },
+      "patch": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handles PATCH requests on /files/:file-id and /files/metadata.",
+        "description": "It can be used to modify the file or directory metadata, as well as moving and renaming it in the filesystem.",
+        "operationId": "patchFileOrDirByPath",
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/files/trash": {
+      "delete": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handles DELETE requests on /files/trash to destroy all the files and directories in the trash.",
+        "operationId": "emptyTrash",
+        "responses": {
+          "204": {
+            "description": "the trash has been emptied"
+          }
+        }
+      }
+    },
+    "/files/{file-id}": {
+      "delete": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handles DELETE requests on /files/:file-id to move a file or a directory, and its subtree, to the trash.",
+        "operationId": "trashFileOrDir",
+        "parameters": [
+          {
+            "name": "file-id",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      },
+      "get": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handles all GET requests on /files/:file- id aiming at getting file metadata from its path.",
+        "operationId": "getFileMetadata",
+        "parameters": [
+          {
+            "name": "file-id",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      },
+      "patch": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handles PATCH requests on /files/:file-id and /files/metadata.",
+        "description": "It can be used to modify the file or directory metadata, as well as moving and renaming it in the filesystem.",
+        "operationId": "patchFileOrDir",
+        "parameters": [
+          {
+            "name": "file-id",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      },
+      "put": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handles PUT requests on /files/:file-id to overwrite the content of a file given its identifier.",
+        "operationId": "overwriteFileContent",
+        "parameters": [
+          {
+            "name": "file-id",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/files/{file-id}/relationships/referenced_by": {
+      "delete": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handles the DELETE requests on /files/:file-id/relationships/referenced_by.",
+        "description": "It removes the documents of the body from the documents that reference the file.",
+        "operationId": "removeReferencedBy",
+        "parameters": [
+          {
+            "name": "file-id",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "204": {
+            "description": "the references have been removed"
+          }
+        }
+      },
+      "post": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handles the POST requests on /files/:file-id/relationships/referenced_by.",
+        "description": "It adds the documents of the body to the documents that reference the file.",
+        "operationId": "addReferencedBy",
+        "parameters": [
+          {
+            "name": "file-id",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "204": {
+            "description": "the references have been added"
+          }
+        }
+      }
+    },
+    "/files/{file-id}/relationships/{name}": {
+      "get": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handles the GET requests on /files/:file-id/relationships/:name.",
+        "description": "It returns the resource identifiers of the parent of a file or directory, of the contents of a directory, paginated with page[limit] and page[cursor], and of the documents that reference a file.",
+        "operationId": "getRelationship",
+        "parameters": [
+          {
+            "name": "file-id",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          },
+          {
+            "name": "name",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/files/{file-id}/share": {
+      "post": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handles POST requests on /files/:file-id/share to create a public link to a file or a directory.",
+        "description": "The link can be limited in time with the ExpiresAt parameter, and protected with the Password field of the form in the body, to keep it out of the URL.",
+        "operationId": "shareFile",
+        "parameters": [
+          {
+            "name": "file-id",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "201": {
+            "description": "the created link"
+          }
+        }
+      }
+    },
+    "/files/{folder-id}": {
+      "post": {
+        "tags": [
+          "files"
+        ],
+        "summary": "Handle all POST requests on /files/:folder-id aiming at creating a new document in the FS.",
+        "description": "Given the Type parameter of the request, it will either upload a new file or create a new directory.",
+        "operationId": "uploadFileOrCreateDir",
+        "parameters": [
+          {
+            "name": "folder-id",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "201": {
+            "description": "the created file or directory"
+          }
+        }
+      }
+    },
+    "/konnectors/": {
+      "get": {
+        "tags": [
+          "konnectors"
+        ],
+        "summary": "Lists the installed applications or konnectors.",
+        "description": "They can be filtered by state with ?state=, and the list is paginated with page[limit] and page[cursor].",
+        "operationId": "listKonnectors",
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/konnectors/{slug}": {
+      "delete": {
+        "tags": [
+          "konnectors"
+        ],
+        "summary": "Removes an installed application or konnector.",
+        "operationId": "uninstallKonnector",
+        "parameters": [
+          {
+            "name": "slug",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "204": {
+            "description": "the application has been removed"
+          }
+        }
+      },
+      "get": {
+        "tags": [
+          "konnectors"
+        ],
+        "summary": "Responds with the manifest of an installed application or konnector.",
+        "operationId": "showKonnector",
+        "parameters": [
+          {
+            "name": "slug",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      },
+      "post": {
+        "tags": [
+          "konnectors"
+        ],
+        "summary": "Installs an application or a konnector from the given Source.",
+        "description": "The installation continues in the background, and its progress can be followed on the events route.",
+        "operationId": "installKonnector",
+        "parameters": [
+          {
+            "name": "slug",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "202": {
+            "description": "the manifest of the application being installed"
+          }
+        }
+      },
+      "put": {
+        "tags": [
+          "konnectors"
+        ],
+        "summary": "Updates an installed application or konnector to the last version of its source.",
+        "description": "The update continues in the background.",
+        "operationId": "updateKonnector",
+        "parameters": [
+          {
+            "name": "slug",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "202": {
+            "description": "the manifest of the application being updated"
+          }
+        }
+      }
+    },
+    "/konnectors/{slug}/events": {
+      "get": {
+        "tags": [
+          "konnectors"
+        ],
+        "summary": "Streams the progress of the installation or update of an application or konnector, as server-sent events, until it is done or has failed.",
+        "operationId": "konnectorEvents",
+        "produces": [
+          "text/event-stream"
+        ],
+        "parameters": [
+          {
+            "name": "slug",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/konnectors/{slug}/rollback": {
+      "post": {
+        "tags": [
+          "konnectors"
+        ],
+        "summary": "Restores the previous version of an installed application or konnector.",
+        "operationId": "rollbackKonnector",
+        "parameters": [
+          {
+            "name": "slug",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "tags": [
+          "metrics"
+        ],
+        "summary": "It responds with the metrics in the text format of Prometheus",
+        "operationId": "showMetrics",
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "tags": [
+          "openapi"
+        ],
+        "summary": "Responds with the OpenAPI specification of the API",
+        "operationId": "showOpenAPI",
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/public/files/{token}": {
+      "get": {
+        "tags": [
+          "public"
+        ],
+        "summary": "Handles GET requests on /public/files/:token.",
+        "description": "It serves the shared file, or a zip of the shared directory, to anyone having the token (and the password if the link is protected). The password is given in the X-Share-Password header, or in the Password field of a form sent with POST, for the browsers.\n\nThe links to a protected file share the budget of the authentication requests, to slow down the attempts to guess the password. The files and directories in the trash are no longer shared.\n\nThe shared files are always downloaded, and never rendered by the browser, as their content type is chosen by the one who uploaded them and they are served on the domain of the instance.",
+        "operationId": "getSharedFile",
+        "parameters": [
+          {
+            "name": "token",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      },
+      "post": {
+        "tags": [
+          "public"
+        ],
+        "summary": "Handles GET requests on /public/files/:token.",
+        "description": "It serves the shared file, or a zip of the shared directory, to anyone having the token (and the password if the link is protected). The password is given in the X-Share-Password header, or in the Password field of a form sent with POST, for the browsers.\n\nThe links to a protected file share the budget of the authentication requests, to slow down the attempts to guess the password. The files and directories in the trash are no longer shared.\n\nThe shared files are always downloaded, and never rendered by the browser, as their content type is chosen by the one who uploaded them and they are served on the domain of the instance.",
+        "operationId": "postSharedFile",
+        "parameters": [
+          {
+            "name": "token",
+            "in": "path",
+            "required": true,
+            "type": "string"
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/settings/context": {
+      "get": {
+        "tags": [
+          "settings"
+        ],
+        "summary": "Handles GET /settings/context requests.",
+        "description": "It gives the context of the instance to the applications, for example to adapt their look to its branding or to hide the features that are not allowed.",
+        "operationId": "getContext",
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/settings/instance": {
+      "get": {
+        "tags": [
+          "settings"
+        ],
+        "summary": "Handles GET /settings/instance requests.",
+        "description": "The applications and OAuth2 clients only see the fields of their settings scopes.",
+        "operationId": "getInstanceSettings",
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      },
+      "put": {
+        "tags": [
+          "settings"
+        ],
+        "summary": "Handles PUT /settings/instance requests.",
+        "description": "It replaces the public settings by the attributes of the JSON-API document. The applications and OAuth2 clients can only change the fields of their settings scopes.",
+        "operationId": "updateInstanceSettings",
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/settings/passphrase": {
+      "put": {
+        "tags": [
+          "settings"
+        ],
+        "summary": "Handles PUT /settings/passphrase requests.",
+        "description": "It changes the passphrase of the owner, after checking the current one. The other sessions are closed, and the browser gets the cookies of a new session.",
+        "operationId": "updatePassphrase",
+        "responses": {
+          "204": {
+            "description": "the passphrase has been changed"
+          }
+        }
+      }
+    },
+    "/status": {
+      "get": {
+        "tags": [
+          "status"
+        ],
+        "summary": "It checks CouchDB, the storage of the files of the instance, if the request is made on an instance, and the other registered dependencies, like Redis.",
+        "description": "CouchDB is reported as down without being checked when its circuit breaker is open. The response is a 503 Service Unavailable if a dependency is down.\n\nWith the probe parameter, the dependencies are not checked: it only says that the HTTP server is up, for the load balancers.",
+        "operationId": "showStatus",
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    },
+    "/version": {
+      "get": {
+        "tags": [
+          "version"
+        ],
+        "summary": "It responds with the git commit used at the build",
+        "operationId": "showVersion",
+        "responses": {
+          "200": {
+            "description": "OK"
+          }
+        }
+      }
+    }
+  }
+}
+`
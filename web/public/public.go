@@ -0,0 +1,153 @@
+// Package public exposes the routes that can be used by the people that
+// don't have an access to the cozy, like the sharing links.
+package public
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/sharings"
+	"github.com/dcasier/cozy-stack/vfs"
+	"github.com/dcasier/cozy-stack/web/files"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+func wrapSharingError(err error) *jsonapi.Error {
+	if couchErr, isCouchErr := err.(*couchdb.Error); isCouchErr {
+		return jsonapi.WrapCouchError(couchErr)
+	}
+	switch err {
+	case sharings.ErrLinkExpired:
+		return &jsonapi.Error{
+			Status: http.StatusGone,
+			Title:  "Gone",
+			Detail: err.Error(),
+		}
+	case sharings.ErrInvalidPassword:
+		return &jsonapi.Error{
+			Status: http.StatusUnauthorized,
+			Title:  "Unauthorized",
+			Detail: err.Error(),
+			Source: jsonapi.SourceError{Parameter: "Password"},
+		}
+	}
+	return jsonapi.InternalServerError(err)
+}
+
+// PasswordHeader is the header where the password of a protected link is
+// given. It is not in the URL, where it would be kept in the logs, the
+// history of the browser and the Referer header.
+const PasswordHeader = "X-Share-Password"
+
+// FileHandler handles GET requests on /public/files/:token. It serves
+// the shared file, or a zip of the shared directory, to anyone having
+// the token (and the password if the link is protected). The password is
+// given in the X-Share-Password header, or in the Password field of a
+// form sent with POST, for the browsers.
+//
+// The links to a protected file share the budget of the authentication
+// requests, to slow down the attempts to guess the password. The files
+// and directories in the trash are no longer shared.
+//
+// The shared files are always downloaded, and never rendered by the
+// browser, as their content type is chosen by the one who uploaded them
+// and they are served on the domain of the instance.
+//
+// swagger:route GET /public/files/:token public getSharedFile
+// swagger:route POST /public/files/:token public postSharedFile
+func FileHandler(c *gin.Context) {
+	instance := middlewares.GetInstance(c)
+	link, err := sharings.GetLink(c.Request.Context(), instance.GetDatabasePrefix(), c.Param("token"))
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapSharingError(err))
+		return
+	}
+
+	if link.Protected {
+		middlewares.RateLimit(middlewares.RateLimitAuth)(c)
+		if c.IsAborted() {
+			return
+		}
+	}
+
+	password := c.Request.Header.Get(PasswordHeader)
+	if c.Request.Method == http.MethodPost {
+		password = c.PostForm("Password")
+	}
+	if err = link.Check(password); err != nil {
+		jsonapi.AbortWithError(c, wrapSharingError(err))
+		return
+	}
+
+	vfsC, err := instance.GetVFSContext(c.Request.Context())
+	if err != nil {
+		jsonapi.AbortWithError(c, jsonapi.InternalServerError(err))
+		return
+	}
+
+	typ, dir, file, err := vfs.GetDirOrFileDoc(vfsC, link.FileID, false)
+	if err != nil {
+		jsonapi.AbortWithError(c, files.WrapVfsError(err))
+		return
+	}
+	trashed, err := inTrash(vfsC, dir, file)
+	if err != nil {
+		jsonapi.AbortWithError(c, files.WrapVfsError(err))
+		return
+	}
+	if trashed {
+		jsonapi.AbortWithError(c, jsonapi.NotFound(os.ErrNotExist))
+		return
+	}
+
+	c.Header("X-Content-Type-Options", "nosniff")
+	if typ == vfs.FileType {
+		err = vfs.ServeFileContent(vfsC, file, "attachment", c.Request, c.Writer)
+		if err != nil {
+			jsonapi.AbortWithError(c, files.WrapVfsError(err))
+		}
+		return
+	}
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "application/zip")
+	header.Set("Content-Disposition", vfs.ContentDisposition("attachment", dir.Name+".zip"))
+	c.Status(http.StatusOK)
+	if err = vfs.WriteZip(vfsC, dir, c.Writer); err != nil {
+		// the headers have already been sent, we can only log the error
+		c.Error(err)
+		c.Abort()
+	}
+}
+
+// inTrash returns true if the file or directory has been put in the trash,
+// directly or with one of its parent directories.
+func inTrash(c *vfs.Context, dir *vfs.DirDoc, file *vfs.FileDoc) (bool, error) {
+	var fullpath string
+	var err error
+	if file != nil {
+		if file.TrashedAt != nil {
+			return true, nil
+		}
+		fullpath, err = file.Path(c)
+	} else {
+		if dir.TrashedAt != nil {
+			return true, nil
+		}
+		fullpath, err = dir.Path(c)
+	}
+	if err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(fullpath, vfs.TrashDirName+"/"), nil
+}
+
+// Routes sets the routing for the public service
+func Routes(router *gin.RouterGroup) {
+	router.GET("/files/:token", FileHandler)
+	router.POST("/files/:token", middlewares.BodyLimit(middlewares.BodyLimitJSON), FileHandler)
+}
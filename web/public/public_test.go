@@ -0,0 +1,331 @@
+package public
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/couchdb/couchdbtest"
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/ratelimit"
+	"github.com/dcasier/cozy-stack/sharings"
+	"github.com/dcasier/cozy-stack/vfs"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const TestPrefix = "test/"
+
+var ts *httptest.Server
+var vfsC *vfs.Context
+
+func injectInstance(i *instance.Instance) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("instance", i)
+	}
+}
+
+func createFile(t *testing.T, name, folderID, content string) *vfs.FileDoc {
+	doc, err := vfs.NewFileDoc(name, folderID, -1, nil, "text/plain", "text", false, []string{})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	file, err := vfs.CreateFile(vfsC, doc, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = io.Copy(file, strings.NewReader(content))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	return doc
+}
+
+func get(t *testing.T, path string) (*http.Response, []byte) {
+	res, err := http.Get(ts.URL + path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	return res, body
+}
+
+func getWithPassword(t *testing.T, path, password string) (*http.Response, []byte) {
+	req, _ := http.NewRequest("GET", ts.URL+path, nil)
+	req.Header.Set(PasswordHeader, password)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	return res, body
+}
+
+func TestUnknownToken(t *testing.T) {
+	res, _ := get(t, "/public/files/nooooop")
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestSharedFile(t *testing.T) {
+	doc := createFile(t, "sharedfile", "", "foo")
+	link, err := sharings.CreateLink(context.Background(), TestPrefix, doc.ID(), nil, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	res, body := get(t, "/public/files/"+link.ID())
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "foo", string(body))
+	assert.Equal(t, "attachment; filename=sharedfile", res.Header.Get("Content-Disposition"))
+	assert.Equal(t, "nosniff", res.Header.Get("X-Content-Type-Options"))
+}
+
+func TestSharedFileWithPassword(t *testing.T) {
+	doc := createFile(t, "protectedfile", "", "bar")
+	link, err := sharings.CreateLink(context.Background(), TestPrefix, doc.ID(), nil, "secret")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	res1, _ := get(t, "/public/files/"+link.ID())
+	assert.Equal(t, 401, res1.StatusCode)
+
+	// the password is not read from the URL
+	res2, _ := get(t, "/public/files/"+link.ID()+"?Password=secret")
+	assert.Equal(t, 401, res2.StatusCode)
+
+	req3, _ := http.NewRequest("GET", ts.URL+"/public/files/"+link.ID(), nil)
+	req3.Header.Set(PasswordHeader, "wrong")
+	res3, err := http.DefaultClient.Do(req3)
+	if assert.NoError(t, err) {
+		res3.Body.Close()
+		assert.Equal(t, 401, res3.StatusCode)
+	}
+
+	req4, _ := http.NewRequest("GET", ts.URL+"/public/files/"+link.ID(), nil)
+	req4.Header.Set(PasswordHeader, "secret")
+	res4, err := http.DefaultClient.Do(req4)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(res4.Body)
+		res4.Body.Close()
+		assert.Equal(t, 200, res4.StatusCode)
+		assert.Equal(t, "bar", string(body))
+	}
+
+	res5, err := http.PostForm(ts.URL+"/public/files/"+link.ID(), url.Values{"Password": {"secret"}})
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(res5.Body)
+		res5.Body.Close()
+		assert.Equal(t, 200, res5.StatusCode)
+		assert.Equal(t, "bar", string(body))
+	}
+}
+
+func TestExpiredLink(t *testing.T) {
+	doc := createFile(t, "expiredfile", "", "baz")
+	future := time.Now().Add(time.Hour)
+	link, err := sharings.CreateLink(context.Background(), TestPrefix, doc.ID(), &future, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	past := time.Now().Add(-time.Hour)
+	link.ExpiresAt = &past
+	assert.NoError(t, couchdb.UpdateDoc(context.Background(), TestPrefix, link))
+
+	res, _ := get(t, "/public/files/"+link.ID())
+	assert.Equal(t, 410, res.StatusCode)
+}
+
+func TestSharedDirectory(t *testing.T) {
+	dir, err := vfs.NewDirDoc("shared dir", "", nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, vfs.CreateDirectory(vfsC, dir)) {
+		return
+	}
+	sub, err := vfs.NewDirDoc("sub", dir.ID(), nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, vfs.CreateDirectory(vfsC, sub)) {
+		return
+	}
+	createFile(t, "one", dir.ID(), "1")
+	createFile(t, "two", sub.ID(), "22")
+
+	link, err := sharings.CreateLink(context.Background(), TestPrefix, dir.ID(), nil, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	res, body := get(t, "/public/files/"+link.ID())
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "application/zip", res.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="shared dir.zip"`, res.Header.Get("Content-Disposition"))
+
+	z, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	contents := make(map[string]string)
+	for _, f := range z.File {
+		r, err := f.Open()
+		if !assert.NoError(t, err) {
+			return
+		}
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+		contents[f.Name] = string(b)
+	}
+	assert.Equal(t, "1", contents["shared dir/one"])
+	assert.Equal(t, "22", contents["shared dir/sub/two"])
+}
+
+func TestTrashedFile(t *testing.T) {
+	doc := createFile(t, "trashedfile", "", "qux")
+	link, err := sharings.CreateLink(context.Background(), TestPrefix, doc.ID(), nil, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = vfs.TrashFile(vfsC, doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	res, _ := get(t, "/public/files/"+link.ID())
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestFileInTrashedDirectory(t *testing.T) {
+	dir, err := vfs.NewDirDoc("trashed dir", "", nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, vfs.CreateDirectory(vfsC, dir)) {
+		return
+	}
+	doc := createFile(t, "child", dir.ID(), "quux")
+	link, err := sharings.CreateLink(context.Background(), TestPrefix, doc.ID(), nil, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = vfs.TrashDir(vfsC, dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	res, _ := get(t, "/public/files/"+link.ID())
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestZipSkipsTrash(t *testing.T) {
+	doc := createFile(t, "intrash", "", "trash")
+	_, err := vfs.TrashFile(vfsC, doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	link, err := sharings.CreateLink(context.Background(), TestPrefix, vfs.RootFolderID, nil, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	res, body := get(t, "/public/files/"+link.ID())
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	z, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, f := range z.File {
+		assert.NotContains(t, f.Name, vfs.TrashDirName[1:])
+	}
+}
+
+func TestProtectedLinkRateLimit(t *testing.T) {
+	middlewares.UseRateLimiter(ratelimit.NewMemoryStore(), map[string]ratelimit.Limit{
+		middlewares.RateLimitAuth: {Rate: 0.001, Burst: 2},
+	})
+	defer middlewares.UseRateLimiter(nil, nil)
+
+	doc := createFile(t, "ratelimited", "", "limited")
+	link, err := sharings.CreateLink(context.Background(), TestPrefix, doc.ID(), nil, "secret")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		res, _ := getWithPassword(t, "/public/files/"+link.ID(), "wrong")
+		assert.Equal(t, 401, res.StatusCode)
+	}
+	res, _ := getWithPassword(t, "/public/files/"+link.ID(), "secret")
+	assert.Equal(t, 429, res.StatusCode)
+	assert.NotEmpty(t, res.Header.Get("Retry-After"))
+
+	// the links without a password are not limited
+	open := createFile(t, "notlimited", "", "open")
+	link, err = sharings.CreateLink(context.Background(), TestPrefix, open.ID(), nil, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, _ = get(t, "/public/files/"+link.ID())
+	assert.Equal(t, 200, res.StatusCode)
+}
+
+func TestMain(m *testing.M) {
+	couchURL, stop := couchdbtest.Start()
+	err := couchdb.UseServer(couchdb.ServerOptions{URL: couchURL})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = couchdb.ResetDB(context.Background(), TestPrefix, vfs.FsDocType)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = couchdb.ResetDB(context.Background(), TestPrefix, sharings.LinkDocType)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	gin.SetMode(gin.TestMode)
+	testInstance := &instance.Instance{
+		Domain:     "test",
+		StorageURL: "mem://test",
+	}
+	testInstance.Create(context.Background())
+	vfsC, err = testInstance.GetVFSContext(context.Background())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	router := gin.New()
+	router.Use(injectInstance(testInstance))
+	Routes(router.Group("/public"))
+	ts = httptest.NewServer(router)
+	res := m.Run()
+	ts.Close()
+	stop()
+	os.Exit(res)
+}
@@ -0,0 +1,221 @@
+// Package realtime is the HTTP frontend of the realtime package. The clients
+// open a WebSocket on /realtime/, subscribe to the doctypes or documents that
+// they display, and receive the events when these documents are created,
+// updated or deleted. The clients that can't use a WebSocket can receive the
+// same events with Server-Sent Events on /realtime/sse.
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/dcasier/cozy-stack/logger"
+	"github.com/dcasier/cozy-stack/realtime"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+// pingInterval is the time between two pings to the clients, to keep the
+// connections open through the proxies
+const pingInterval = 30 * time.Second
+
+// The methods of the messages of the clients
+const (
+	methodAuth        = "AUTH"
+	methodSubscribe   = "SUBSCRIBE"
+	methodUnsubscribe = "UNSUBSCRIBE"
+)
+
+var (
+	// ErrForbiddenOrigin is used when a page of another site tries to open
+	// a WebSocket with the session cookie of the owner
+	ErrForbiddenOrigin = errors.New("The origin of the request is not allowed")
+	// ErrUnknownMethod is used when a message has an unknown method
+	ErrUnknownMethod = errors.New("Unknown method")
+	// ErrMissingDoctype is used when a subscription has no doctype
+	ErrMissingDoctype = errors.New("The doctype is missing")
+)
+
+// message is a message of a client, like
+// {"method": "SUBSCRIBE", "payload": {"type": "io.cozy.contacts"}}
+type message struct {
+	Method  string          `json:"method"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// subscription is the payload of the SUBSCRIBE and UNSUBSCRIBE messages
+type subscription struct {
+	Doctype string `json:"type"`
+	DocID   string `json:"id"`
+}
+
+// outMessage is a message sent to a client, for an event or an error
+type outMessage struct {
+	Event   string      `json:"event"`
+	Payload interface{} `json:"payload"`
+}
+
+// isAuthenticated returns true if the request has the session of the owner,
+// or the token of an application or of an OAuth2 client
+func isAuthenticated(c *gin.Context) bool {
+	return middlewares.GetSession(c) != nil ||
+		middlewares.GetApp(c) != nil ||
+		middlewares.GetOAuthToken(c) != nil
+}
+
+// sameOrigin returns true if the request comes from a page of the instance,
+// or from a client that is not a browser
+func sameOrigin(c *gin.Context) bool {
+	origin := c.Request.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == c.Request.Host
+}
+
+// WebsocketHandler handles GET /realtime/ requests. It upgrades the
+// connection to a WebSocket, and sends the events of the documents that the
+// client subscribes to. A client without a session cookie or an
+// Authorization header must first send its token in an AUTH message.
+func WebsocketHandler(c *gin.Context) {
+	if middlewares.GetSession(c) != nil && !sameOrigin(c) {
+		jsonapi.AbortWithError(c, jsonapi.Forbidden(ErrForbiddenOrigin))
+		return
+	}
+	ws, err := upgrade(c.Writer, c.Request)
+	if err != nil {
+		jsonapi.AbortWithError(c, jsonapi.BadRequest(err))
+		return
+	}
+
+	instance := middlewares.GetInstance(c)
+	sub := realtime.GetHub().Subscribe(instance.GetDatabasePrefix())
+	defer sub.Close()
+
+	// the gin context must not be used after the handler has returned, so
+	// the handler waits for the end of the reading of the messages
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer sub.Close()
+		readMessages(c, ws, sub)
+	}()
+	writeEvents(ws, sub)
+	<-done
+}
+
+// readMessages handles the messages of the client, until the connection is
+// closed
+func readMessages(c *gin.Context, ws *wsConn, sub *realtime.Subscriber) {
+	for {
+		data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg message
+		if err = json.Unmarshal(data, &msg); err != nil {
+			sendError(ws, jsonapi.BadJSON())
+			continue
+		}
+
+		if msg.Method == methodAuth {
+			var token string
+			if err = json.Unmarshal(msg.Payload, &token); err != nil {
+				sendError(ws, jsonapi.BadJSON())
+				continue
+			}
+			if err = middlewares.AuthenticateToken(c, token); err != nil {
+				if err == middlewares.ErrInvalidToken {
+					sendError(ws, jsonapi.Unauthorized(err))
+				} else {
+					sendError(ws, jsonapi.InternalServerError(err))
+				}
+				ws.Close(closePolicyViolation, err.Error())
+				return
+			}
+			continue
+		}
+
+		if !isAuthenticated(c) {
+			sendError(ws, jsonapi.Unauthorized(middlewares.ErrNotLoggedIn))
+			continue
+		}
+		var s subscription
+		if err = json.Unmarshal(msg.Payload, &s); err != nil {
+			sendError(ws, jsonapi.BadJSON())
+			continue
+		}
+		switch msg.Method {
+		case methodSubscribe:
+			if e := watch(c, sub, &s); e != nil {
+				sendError(ws, e)
+			}
+		case methodUnsubscribe:
+			sub.Unwatch(s.Doctype, s.DocID)
+		default:
+			sendError(ws, jsonapi.InvalidParameter("method", ErrUnknownMethod))
+		}
+	}
+}
+
+// watch adds a subscription to the subscriber, if the client can read the
+// documents of its doctype
+func watch(c *gin.Context, sub *realtime.Subscriber, s *subscription) *jsonapi.Error {
+	if s.Doctype == "" {
+		return jsonapi.InvalidParameter("type", ErrMissingDoctype)
+	}
+	if !middlewares.AllowedEvents(c, s.Doctype) {
+		return jsonapi.Forbidden(middlewares.ErrForbiddenScope)
+	}
+	sub.Watch(s.Doctype, s.DocID)
+	return nil
+}
+
+// writeEvents sends the events of the subscriber to the client, until the
+// subscriber is closed
+func writeEvents(ws *wsConn, sub *realtime.Subscriber) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				ws.Close(closeNormal, "")
+				return
+			}
+			data, err := json.Marshal(&outMessage{Event: e.Verb, Payload: e})
+			if err != nil {
+				logger.Errorf("realtime", "cannot serialize an event: %v", err)
+				continue
+			}
+			if err = ws.WriteMessage(data); err != nil {
+				ws.Close(closeNormal, "")
+				return
+			}
+		case <-ticker.C:
+			if err := ws.Ping(); err != nil {
+				ws.Close(closeNormal, "")
+				return
+			}
+		}
+	}
+}
+
+// sendError sends an error to the client, with the format of the JSON-API
+// errors
+func sendError(ws *wsConn, e *jsonapi.Error) {
+	data, err := json.Marshal(&outMessage{Event: "error", Payload: e})
+	if err == nil {
+		ws.WriteMessage(data)
+	}
+}
+
+// Routes sets the routing for the realtime service
+func Routes(router *gin.RouterGroup) {
+	router.GET("/", WebsocketHandler)
+	router.GET("/sse", middlewares.NeedAuth(), SSEHandler)
+}
@@ -0,0 +1,99 @@
+package realtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dcasier/cozy-stack/realtime"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+// heartbeatInterval is the time between two heartbeat comments on the
+// Server-Sent Events streams, to keep them open through the proxies
+const heartbeatInterval = 15 * time.Second
+
+// parseSubscription parses a subscribe parameter, like io.cozy.contacts for
+// a doctype, or io.cozy.files/0f6f9a4e for a document. The doctypes can't
+// have a slash, but the identifiers of the documents can.
+func parseSubscription(param string) *subscription {
+	parts := strings.SplitN(param, "/", 2)
+	s := &subscription{Doctype: parts[0]}
+	if len(parts) == 2 {
+		s.DocID = parts[1]
+	}
+	return s
+}
+
+// writeSSEvent writes an event of a Server-Sent Events stream. The data is a
+// single line of JSON.
+func writeSSEvent(w io.Writer, e *realtime.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Verb, data)
+	return err
+}
+
+// SSEHandler handles GET /realtime/sse requests. It sends the events of the
+// doctypes and documents of the subscribe parameters, with the Server-Sent
+// Events format, for the clients that can't use a WebSocket. The stream is
+// closed if the client doesn't read its events fast enough, and the client
+// is expected to reconnect.
+func SSEHandler(c *gin.Context) {
+	params := c.Request.URL.Query()["subscribe"]
+	if len(params) == 0 {
+		jsonapi.AbortWithError(c, jsonapi.InvalidParameter("subscribe", ErrMissingDoctype))
+		return
+	}
+
+	instance := middlewares.GetInstance(c)
+	sub := realtime.GetHub().Subscribe(instance.GetDatabasePrefix())
+	defer sub.Close()
+	for _, param := range params {
+		if e := watch(c, sub, parseSubscription(param)); e != nil {
+			jsonapi.AbortWithError(c, e)
+			return
+		}
+	}
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// nginx must not buffer the events
+	header.Set("X-Accel-Buffering", "no")
+	c.Writer.WriteHeader(http.StatusOK)
+	// an initial comment sends the headers to the client
+	if _, err := io.WriteString(c.Writer, ": ok\n\n"); err != nil {
+		return
+	}
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	closed := c.Writer.CloseNotify()
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := writeSSEvent(c.Writer, e); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := io.WriteString(c.Writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+		c.Writer.Flush()
+	}
+}
@@ -0,0 +1,36 @@
+package realtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/dcasier/cozy-stack/realtime"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSubscription(t *testing.T) {
+	s := parseSubscription("io.cozy.contacts")
+	assert.Equal(t, "io.cozy.contacts", s.Doctype)
+	assert.Equal(t, "", s.DocID)
+	s = parseSubscription("io.cozy.files/0f6f9a4e")
+	assert.Equal(t, "io.cozy.files", s.Doctype)
+	assert.Equal(t, "0f6f9a4e", s.DocID)
+	s = parseSubscription("io.cozy.events/a/b")
+	assert.Equal(t, "a/b", s.DocID)
+}
+
+func TestWriteSSEvent(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := writeSSEvent(buf, &realtime.Event{
+		Verb:    realtime.EventUpdate,
+		Doctype: "io.cozy.contacts",
+		DocID:   "42",
+		Doc:     json.RawMessage(`{"_id":"42","fullname":"Alice"}`),
+	})
+	assert.NoError(t, err)
+	expected := "event: UPDATED\n" +
+		`data: {"type":"io.cozy.contacts","id":"42","doc":{"_id":"42","fullname":"Alice"}}` +
+		"\n\n"
+	assert.Equal(t, expected, buf.String())
+}
@@ -0,0 +1,297 @@
+package realtime
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file is a minimal implementation of the server side of the WebSocket
+// protocol (RFC 6455): the handshake, the text messages, and the control
+// frames. The extensions, like the compression, are not supported.
+
+// websocketGUID is the magic string of the handshake
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxMessageSize is the maximal size of a message from a client
+const maxMessageSize = 64 * 1024
+
+// writeTimeout is the maximal duration to send a frame to a client
+const writeTimeout = 10 * time.Second
+
+// The opcodes of the frames
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// The status codes of the close frames
+const (
+	closeNormal          = 1000
+	closeProtocolError   = 1002
+	closeUnsupported     = 1003
+	closePolicyViolation = 1008
+	closeTooBig          = 1009
+)
+
+var (
+	// errNotWebsocket is used when the handshake is not a valid WebSocket
+	// upgrade request
+	errNotWebsocket = errors.New("Expected a WebSocket upgrade request")
+	// errProtocol is used when a client sends an invalid frame
+	errProtocol = errors.New("Invalid WebSocket frame")
+	// errMessageTooBig is used when a client sends a message over
+	// maxMessageSize
+	errMessageTooBig = errors.New("WebSocket message too big")
+	// errBinaryMessage is used when a client sends a binary message
+	errBinaryMessage = errors.New("Binary WebSocket messages are not supported")
+	// errClosed is used when the client has closed the connection
+	errClosed = errors.New("WebSocket closed")
+)
+
+// wsConn is a WebSocket connection with a client
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	// mu serializes the writes of the frames
+	mu sync.Mutex
+}
+
+// acceptKey returns the value of the Sec-WebSocket-Accept header for the
+// key of the client
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains returns true if a comma-separated header has the token
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgrade checks the handshake of a client, and takes over its connection
+// to answer with a 101 Switching Protocols
+func upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errNotWebsocket
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errNotWebsocket
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// the deadlines of the HTTP server are not for the long-lived WebSockets
+	conn.SetDeadline(time.Time{})
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err = conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// readFrame reads a frame, and unmasks its payload
+func (ws *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(ws.r, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0F
+	if head[0]&0x70 != 0 || head[1]&0x80 == 0 {
+		// the extensions are not negotiated, and the clients must mask
+		err = errProtocol
+		return
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= opClose && (!fin || length > 125) {
+		err = errProtocol
+		return
+	}
+	if length > maxMessageSize {
+		err = errMessageTooBig
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// ReadMessage returns the next text message of the client. It answers to
+// the pings, and returns errClosed when the client closes the connection.
+func (ws *wsConn) ReadMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			ws.fail(err)
+			return nil, err
+		}
+		switch opcode {
+		case opPing:
+			if err = ws.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			ws.writeFrame(opClose, closePayload(closeNormal, ""))
+			return nil, errClosed
+		case opText, opBinary:
+			if started {
+				ws.fail(errProtocol)
+				return nil, errProtocol
+			}
+			if opcode == opBinary {
+				ws.fail(errBinaryMessage)
+				return nil, errBinaryMessage
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				ws.fail(errProtocol)
+				return nil, errProtocol
+			}
+		default:
+			ws.fail(errProtocol)
+			return nil, errProtocol
+		}
+		if len(message)+len(payload) > maxMessageSize {
+			ws.fail(errMessageTooBig)
+			return nil, errMessageTooBig
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// WriteMessage sends a text message to the client
+func (ws *wsConn) WriteMessage(data []byte) error {
+	return ws.writeFrame(opText, data)
+}
+
+// Ping sends a ping to the client, to keep the connection open through the
+// proxies
+func (ws *wsConn) Ping() error {
+	return ws.writeFrame(opPing, nil)
+}
+
+// Close sends a close frame with a status code, and closes the connection
+func (ws *wsConn) Close(code int, reason string) error {
+	ws.writeFrame(opClose, closePayload(code, reason))
+	return ws.conn.Close()
+}
+
+// fail closes the connection after an error of the client
+func (ws *wsConn) fail(err error) {
+	switch err {
+	case errProtocol:
+		ws.Close(closeProtocolError, err.Error())
+	case errBinaryMessage:
+		ws.Close(closeUnsupported, err.Error())
+	case errMessageTooBig:
+		ws.Close(closeTooBig, err.Error())
+	default:
+		ws.conn.Close()
+	}
+}
+
+// writeFrame sends an unmasked and unfragmented frame, as the server frames
+// must not be masked
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := ws.conn.Write(encodeFrame(opcode, payload))
+	return err
+}
+
+// encodeFrame returns the bytes of an unmasked final frame
+func encodeFrame(opcode byte, payload []byte) []byte {
+	length := len(payload)
+	frame := make([]byte, 0, length+10)
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case length <= 125:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, byte(length>>8), byte(length))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(length))
+		frame = append(frame, 127)
+		frame = append(frame, ext[:]...)
+	}
+	return append(frame, payload...)
+}
+
+// closePayload returns the payload of a close frame
+func closePayload(code int, reason string) []byte {
+	payload := []byte{byte(code >> 8), byte(code)}
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	return append(payload, reason...)
+}
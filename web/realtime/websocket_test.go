@@ -0,0 +1,124 @@
+package realtime
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// maskedFrame returns a frame as sent by a client
+func maskedFrame(fin bool, opcode byte, payload string) []byte {
+	mask := []byte{1, 2, 3, 4}
+	head := opcode
+	if fin {
+		head |= 0x80
+	}
+	frame := []byte{head, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	return frame
+}
+
+// readServerFrame reads an unmasked frame with a short payload
+func readServerFrame(t *testing.T, r *bufio.Reader) (byte, string) {
+	head := make([]byte, 2)
+	_, err := r.Read(head[:1])
+	assert.NoError(t, err)
+	_, err = r.Read(head[1:])
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0x80), head[0]&0x80)
+	assert.Equal(t, byte(0), head[1]&0x80)
+	payload := make([]byte, head[1])
+	for n := 0; n < len(payload); {
+		m, err := r.Read(payload[n:])
+		if !assert.NoError(t, err) {
+			break
+		}
+		n += m
+	}
+	return head[0] & 0x0F, string(payload)
+}
+
+func TestAcceptKey(t *testing.T) {
+	// the example of the RFC 6455
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestEncodeFrame(t *testing.T) {
+	assert.Equal(t, []byte{0x81, 2, 'h', 'i'}, encodeFrame(opText, []byte("hi")))
+	frame := encodeFrame(opText, make([]byte, 300))
+	assert.Equal(t, []byte{0x81, 126, 1, 44}, frame[:4])
+	assert.Len(t, frame, 304)
+	frame = encodeFrame(opText, make([]byte, 70000))
+	assert.Equal(t, []byte{0x81, 127, 0, 0, 0, 0, 0, 1, 0x11, 0x70}, frame[:10])
+}
+
+func TestWebsocket(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrade(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for {
+			msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage([]byte(strings.ToUpper(string(msg))))
+		}
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res.Body.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\n" +
+		"Host: cozy.local\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	res, err = http.ReadResponse(r, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", res.Header.Get("Sec-WebSocket-Accept"))
+
+	conn.Write(maskedFrame(true, opText, "hello"))
+	opcode, payload := readServerFrame(t, r)
+	assert.Equal(t, byte(opText), opcode)
+	assert.Equal(t, "HELLO", payload)
+
+	// a fragmented message, with a ping in the middle
+	conn.Write(maskedFrame(false, opText, "foo"))
+	conn.Write(maskedFrame(true, opPing, "ping"))
+	conn.Write(maskedFrame(true, opContinuation, "bar"))
+	opcode, payload = readServerFrame(t, r)
+	assert.Equal(t, byte(opPong), opcode)
+	assert.Equal(t, "ping", payload)
+	opcode, payload = readServerFrame(t, r)
+	assert.Equal(t, byte(opText), opcode)
+	assert.Equal(t, "FOOBAR", payload)
+
+	conn.Write(maskedFrame(true, opClose, ""))
+	opcode, payload = readServerFrame(t, r)
+	assert.Equal(t, byte(opClose), opcode)
+	assert.Equal(t, string([]byte{0x03, 0xE8}), payload)
+}
@@ -24,21 +24,75 @@ package web
 
 import (
 	"github.com/dcasier/cozy-stack/web/apps"
+	"github.com/dcasier/cozy-stack/web/auth"
 	"github.com/dcasier/cozy-stack/web/data"
 	"github.com/dcasier/cozy-stack/web/files"
+	"github.com/dcasier/cozy-stack/web/instances"
+	"github.com/dcasier/cozy-stack/web/intents"
+	"github.com/dcasier/cozy-stack/web/jobs"
+	"github.com/dcasier/cozy-stack/web/metrics"
 	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/dcasier/cozy-stack/web/notifications"
+	"github.com/dcasier/cozy-stack/web/openapi"
+	"github.com/dcasier/cozy-stack/web/public"
+	"github.com/dcasier/cozy-stack/web/realtime"
+	"github.com/dcasier/cozy-stack/web/settings"
 	"github.com/dcasier/cozy-stack/web/status"
 	"github.com/dcasier/cozy-stack/web/version"
 	"github.com/gin-gonic/gin"
 )
 
+// routeGroups are the first segments of the paths of the routes, used as
+// labels for the metrics of the HTTP requests
+var routeGroups = []string{
+	"auth", "apps", "konnectors", "data", "files", "intents", "jobs",
+	"notifications", "settings", "metrics", "public", "realtime", "status",
+	"version", "openapi.json", "dev",
+}
+
 // SetupRoutes sets the routing for HTTP endpoints to the Go methods
 func SetupRoutes(router *gin.Engine) {
+	router.Use(middlewares.Metrics(routeGroups...))
+	router.Use(middlewares.Gzip())
 	router.Use(middlewares.SetInstance())
+	router.Use(middlewares.RateLimit(middlewares.RateLimitDefault))
+	router.Use(middlewares.SetApp())
+	router.Use(middlewares.SetSession())
+	router.Use(middlewares.CheckCSRF())
 	router.Use(middlewares.ErrorHandler())
-	apps.Routes(router.Group("/apps"))
-	data.Routes(router.Group("/data"))
-	files.Routes(router.Group("/files"))
+	router.Use(apps.Serve())
+	// the data and files routes have their own limits of the size of the
+	// bodies, as some of them stream large contents
+	jsonBody := middlewares.BodyLimit(middlewares.BodyLimitJSON)
+	auth.Routes(router.Group("/auth", middlewares.RateLimit(middlewares.RateLimitAuth), jsonBody))
+	apps.Routes(router.Group("/apps", middlewares.NeedSessionOrAdmin(), jsonBody))
+	apps.KonnectorsRoutes(router.Group("/konnectors", middlewares.NeedSessionOrAdmin(), jsonBody))
+	data.Routes(router.Group("/data", middlewares.NeedAuth()))
+	files.Routes(router.Group("/files", middlewares.NeedAuth()))
+	intents.Routes(router.Group("/intents", middlewares.NeedAuth(), jsonBody))
+	jobs.Routes(router.Group("/jobs", middlewares.NeedAuth(), jsonBody))
+	notifications.Routes(router.Group("/notifications", middlewares.NeedAuth(), jsonBody))
+	settings.Routes(router.Group("/settings", middlewares.NeedAuth(), jsonBody))
+	metrics.Routes(router.Group("/metrics"))
+	public.Routes(router.Group("/public"))
+	realtime.Routes(router.Group("/realtime"))
 	status.Routes(router.Group("/status"))
 	version.Routes(router.Group("/version"))
+	openapi.Routes(router.Group("/"))
+}
+
+// SetupAdminRoutes sets the routing of the admin server, that listens on
+// another port than the instances and is reserved to the operators
+func SetupAdminRoutes(router *gin.Engine) {
+	instances.AdminRoutes(router.Group("/instances"))
+	metrics.AdminRoutes(router.Group("/metrics"))
+	status.Routes(router.Group("/status"))
+}
+
+// SetupDevRoutes serves the files of an application in development from
+// its local directory on /dev, without installing it. The applications can
+// then be installed from a local directory by all the clients.
+func SetupDevRoutes(router *gin.Engine, appdir string) {
+	router.Static("/dev", appdir)
+	apps.UseDevMode(true)
 }
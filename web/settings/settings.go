@@ -0,0 +1,255 @@
+// Package settings is the HTTP frontend of the settings of an instance: its
+// public settings, like the name of the owner or the locale, and the
+// passphrase of the owner.
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/dcasier/cozy-stack/apps"
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/instance"
+	"github.com/dcasier/cozy-stack/sessions"
+	"github.com/dcasier/cozy-stack/web/jsonapi"
+	"github.com/dcasier/cozy-stack/web/middlewares"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrMissingPassphrase is used when the request to change the passphrase
+// has no current or new passphrase
+var ErrMissingPassphrase = errors.New("The current and new passphrases are required")
+
+func wrapSettingsError(err error) *jsonapi.Error {
+	if couchErr, isCouchErr := err.(*couchdb.Error); isCouchErr {
+		return jsonapi.WrapCouchError(couchErr)
+	}
+	switch err {
+	case instance.ErrInvalidEmail:
+		return jsonapi.InvalidParameter("email", err)
+	case instance.ErrInvalidLocale:
+		return jsonapi.InvalidParameter("locale", err)
+	case instance.ErrInvalidTimezone:
+		return jsonapi.InvalidParameter("timezone", err)
+	case instance.ErrPassphraseTooShort:
+		return jsonapi.InvalidParameter("new_passphrase", err)
+	case instance.ErrSettingsConflict:
+		return jsonapi.Conflict(err)
+	case instance.ErrNoPassphrase, instance.ErrInvalidPassphrase:
+		return jsonapi.Forbidden(err)
+	}
+	return jsonapi.InternalServerError(err)
+}
+
+// apiSettings is the JSON-API object of the public settings of an instance
+type apiSettings struct {
+	*instance.PublicSettings
+	rev string
+}
+
+// ID returns the settings identifier - see couchdb.Doc interface
+func (s *apiSettings) ID() string { return instance.SettingsID }
+
+// Rev returns the settings revision - see couchdb.Doc interface
+func (s *apiSettings) Rev() string { return s.rev }
+
+// DocType returns the settings doctype - see couchdb.Doc interface
+func (s *apiSettings) DocType() string { return instance.SettingsDocType }
+
+// SetID does nothing, the identifier is fixed - see couchdb.Doc interface
+func (s *apiSettings) SetID(id string) {}
+
+// SetRev changes the settings revision - see couchdb.Doc interface
+func (s *apiSettings) SetRev(rev string) { s.rev = rev }
+
+// SelfLink is used to generate a JSON-API link - see jsonapi.Object interface
+func (s *apiSettings) SelfLink() string { return "/settings/instance" }
+
+// Relationships is used to generate the relationships - see jsonapi.Object
+// interface
+func (s *apiSettings) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Included is used to generate the included objects - see jsonapi.Object
+// interface
+func (s *apiSettings) Included() []jsonapi.Object { return nil }
+
+// contextID is the identifier of the JSON-API object of the context
+const contextID = "io.cozy.settings.context"
+
+// apiContext is the JSON-API object of the context of an instance
+type apiContext struct {
+	*instance.Context
+}
+
+// ID returns the context identifier - see couchdb.Doc interface
+func (c *apiContext) ID() string { return contextID }
+
+// Rev returns an empty revision, the context is not a document - see
+// couchdb.Doc interface
+func (c *apiContext) Rev() string { return "" }
+
+// DocType returns the settings doctype - see couchdb.Doc interface
+func (c *apiContext) DocType() string { return instance.SettingsDocType }
+
+// SetID does nothing, the identifier is fixed - see couchdb.Doc interface
+func (c *apiContext) SetID(id string) {}
+
+// SetRev does nothing - see couchdb.Doc interface
+func (c *apiContext) SetRev(rev string) {}
+
+// SelfLink is used to generate a JSON-API link - see jsonapi.Object interface
+func (c *apiContext) SelfLink() string { return "/settings/context" }
+
+// Relationships is used to generate the relationships - see jsonapi.Object
+// interface
+func (c *apiContext) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Included is used to generate the included objects - see jsonapi.Object
+// interface
+func (c *apiContext) Included() []jsonapi.Object { return nil }
+
+// settingsField is a field of the public settings, with the type of the
+// settings permissions of the applications that gives access to it
+type settingsField struct {
+	typ   string
+	value *string
+}
+
+func fieldsOf(p *instance.PublicSettings) []settingsField {
+	return []settingsField{
+		{"owner", &p.PublicName},
+		{"owner", &p.Email},
+		{"locale", &p.Locale},
+		{"locale", &p.Timezone},
+		{"background", &p.Background},
+	}
+}
+
+// getInstanceSettings handles GET /settings/instance requests. The
+// applications and OAuth2 clients only see the fields of their settings
+// scopes.
+//
+// swagger:route GET /settings/instance settings getInstanceSettings
+func getInstanceSettings(c *gin.Context) {
+	i := middlewares.GetInstance(c)
+	settings, err := i.GetSettings(c.Request.Context())
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapSettingsError(err))
+		return
+	}
+
+	public := settings.PublicSettings
+	allowed := false
+	for _, f := range fieldsOf(&public) {
+		if middlewares.AllowedSettings(c, f.typ, apps.ReadAccess) {
+			allowed = true
+		} else {
+			*f.value = ""
+		}
+	}
+	if !allowed {
+		jsonapi.AbortWithError(c, jsonapi.Forbidden(middlewares.ErrForbiddenScope))
+		return
+	}
+	jsonapi.Data(c, http.StatusOK, &apiSettings{&public, settings.Rev()}, nil)
+}
+
+// updateInstanceSettings handles PUT /settings/instance requests. It
+// replaces the public settings by the attributes of the JSON-API document.
+// The applications and OAuth2 clients can only change the fields of their
+// settings scopes.
+//
+// swagger:route PUT /settings/instance settings updateInstanceSettings
+func updateInstanceSettings(c *gin.Context) {
+	public := &instance.PublicSettings{}
+	obj, e := jsonapi.Bind(c, instance.SettingsDocType, public)
+	if e != nil {
+		jsonapi.AbortWithError(c, e)
+		return
+	}
+
+	i := middlewares.GetInstance(c)
+	ctx := c.Request.Context()
+	settings, err := i.GetSettings(ctx)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapSettingsError(err))
+		return
+	}
+	current := fieldsOf(&settings.PublicSettings)
+	for k, f := range fieldsOf(public) {
+		if *f.value != *current[k].value && !middlewares.AllowedSettings(c, f.typ, apps.WriteAccess) {
+			jsonapi.AbortWithError(c, jsonapi.Forbidden(middlewares.ErrForbiddenScope))
+			return
+		}
+	}
+
+	settings, err = i.UpdatePublicSettings(ctx, public, obj.Meta.Rev)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapSettingsError(err))
+		return
+	}
+	jsonapi.Data(c, http.StatusOK, &apiSettings{&settings.PublicSettings, settings.Rev()}, nil)
+}
+
+// getContext handles GET /settings/context requests. It gives the context
+// of the instance to the applications, for example to adapt their look to
+// its branding or to hide the features that are not allowed.
+//
+// swagger:route GET /settings/context settings getContext
+func getContext(c *gin.Context) {
+	i := middlewares.GetInstance(c)
+	jsonapi.Data(c, http.StatusOK, &apiContext{i.GetContext()}, nil)
+}
+
+// passphraseParams is the body of PUT /settings/passphrase
+type passphraseParams struct {
+	Current    string `json:"current_passphrase"`
+	Passphrase string `json:"new_passphrase"`
+}
+
+// updatePassphrase handles PUT /settings/passphrase requests. It changes the
+// passphrase of the owner, after checking the current one. The other
+// sessions are closed, and the browser gets the cookies of a new session.
+//
+// swagger:route PUT /settings/passphrase settings updatePassphrase
+//
+// Responses:
+//   204: the passphrase has been changed
+func updatePassphrase(c *gin.Context) {
+	var params passphraseParams
+	if err := json.NewDecoder(c.Request.Body).Decode(&params); err != nil {
+		jsonapi.AbortWithError(c, jsonapi.BadJSON())
+		return
+	}
+	if params.Current == "" || params.Passphrase == "" {
+		jsonapi.AbortWithError(c, jsonapi.BadRequest(ErrMissingPassphrase))
+		return
+	}
+
+	i := middlewares.GetInstance(c)
+	ctx := c.Request.Context()
+	if err := i.UpdatePassphrase(ctx, params.Current, params.Passphrase); err != nil {
+		jsonapi.AbortWithError(c, wrapSettingsError(err))
+		return
+	}
+	if old := middlewares.GetSession(c); old != nil {
+		old.Delete(ctx, i)
+	}
+	session, err := sessions.New(ctx, i)
+	if err != nil {
+		jsonapi.AbortWithError(c, wrapSettingsError(err))
+		return
+	}
+	middlewares.SetSessionCookies(c, session, int(sessions.MaxAge.Seconds()))
+	c.Status(http.StatusNoContent)
+}
+
+// Routes sets the routing for the settings service
+func Routes(router *gin.RouterGroup) {
+	router.GET("/instance", getInstanceSettings)
+	router.PUT("/instance", updateInstanceSettings)
+	router.GET("/context", getContext)
+	router.PUT("/passphrase", middlewares.NeedSession(),
+		middlewares.RateLimit(middlewares.RateLimitAuth), updatePassphrase)
+}
@@ -1,38 +1,165 @@
-// Package status is here just to say that the API is up and that it can
-// access the CouchDB databases, for debugging and monitoring purposes.
+// Package status is here to say that the API is up and that it can access
+// its dependencies, like CouchDB, the storage of the files and Redis, for
+// debugging and monitoring purposes.
 package status
 
 import (
+	"context"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/instance"
 	"github.com/gin-gonic/gin"
 	"github.com/sourcegraph/checkup"
+	"github.com/spf13/afero"
 )
 
-// CouchDBURL is the URL where to check if CouchDB is up
-var CouchDBURL = "http://localhost:5984/"
+// checkTimeout is the maximal duration of the check of a dependency
+const checkTimeout = 5 * time.Second
+
+// slowThreshold is the latency above which a dependency that answers is
+// reported as degraded
+const slowThreshold = time.Second
+
+// fsCheckFile is the file written and removed in the storage of the
+// instance to check that it is writable
+const fsCheckFile = ".cozy-status"
+
+// Check is a function that checks that a dependency of the stack is
+// available
+type Check func(ctx context.Context) error
+
+var (
+	checksMu sync.Mutex
+	checks   = map[string]Check{"couchdb": couchdb.Ping}
+)
+
+// AddCheck adds a dependency to the checks of /status, under the given
+// name. CouchDB is always checked.
+func AddCheck(name string, check Check) {
+	checksMu.Lock()
+	defer checksMu.Unlock()
+	checks[name] = check
+}
+
+// Result is the status of a dependency, with the duration of its check in
+// milliseconds. The errors are not shown, as they can contain credentials.
+type Result struct {
+	Status  checkup.StatusText `json:"status"`
+	Latency int64              `json:"latency_ms"`
+}
+
+// runCheck runs the check of a dependency, with a timeout
+func runCheck(ctx context.Context, check Check) *Result {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	start := time.Now()
+	err := check(ctx)
+	latency := time.Since(start)
+	res := &Result{Status: checkup.Healthy, Latency: int64(latency / time.Millisecond)}
+	if err != nil {
+		res.Status = checkup.Down
+	} else if latency > slowThreshold {
+		res.Status = checkup.Degraded
+	}
+	return res
+}
+
+// runChecks runs the checks concurrently, and returns their results by name
+func runChecks(ctx context.Context, checks map[string]Check) map[string]*Result {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]*Result, len(checks))
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			res := runCheck(ctx, check)
+			mu.Lock()
+			results[name] = res
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+	return results
+}
+
+// overallStatus returns the status of the stack: down if a dependency is
+// down, degraded if one is degraded, and healthy otherwise
+func overallStatus(results map[string]*Result) checkup.StatusText {
+	status := checkup.Healthy
+	for _, res := range results {
+		switch res.Status {
+		case checkup.Down:
+			return checkup.Down
+		case checkup.Degraded:
+			status = checkup.Degraded
+		}
+	}
+	return status
+}
+
+// fsCheck returns a check that the storage of the files of an instance is
+// writable
+func fsCheck(i *instance.Instance) Check {
+	return func(ctx context.Context) error {
+		fs, err := i.GetStorageProvider()
+		if err != nil {
+			return err
+		}
+		if err = afero.WriteFile(fs, fsCheckFile, []byte("OK"), 0644); err != nil {
+			return err
+		}
+		return fs.Remove(fsCheckFile)
+	}
+}
 
 // Status responds with the status of the service
 //
 // swagger:route GET /status status showStatus
 //
-// It responds OK if the service is running
+// It checks CouchDB, the storage of the files of the instance, if the
+// request is made on an instance, and the other registered dependencies,
+// like Redis. CouchDB is reported as down without being checked when its
+// circuit breaker is open. The response is a 503 Service Unavailable if a
+// dependency is down.
+//
+// With the probe parameter, the dependencies are not checked: it only says
+// that the HTTP server is up, for the load balancers.
 func Status(c *gin.Context) {
-	message := "OK"
+	if _, ok := c.GetQuery("probe"); ok {
+		c.JSON(http.StatusOK, gin.H{
+			"status":  checkup.Healthy,
+			"message": "OK",
+		})
+		return
+	}
 
-	checker := checkup.HTTPChecker{
-		Name:     "CouchDB",
-		URL:      CouchDBURL,
-		Attempts: 3,
+	checksMu.Lock()
+	toRun := make(map[string]Check, len(checks)+1)
+	for name, check := range checks {
+		toRun[name] = check
+	}
+	checksMu.Unlock()
+	if i, ok := c.Get("instance"); ok {
+		toRun["fs"] = fsCheck(i.(*instance.Instance))
 	}
-	couchdb, err := checker.Check()
-	if err != nil || couchdb.Status() != checkup.Healthy {
-		message = "KO"
+
+	results := runChecks(c.Request.Context(), toRun)
+	status := overallStatus(results)
+	message, code := "OK", http.StatusOK
+	if status == checkup.Down {
+		message, code = "KO", http.StatusServiceUnavailable
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	c.JSON(code, gin.H{
+		"status":  status,
 		"message": message,
-		"couchdb": couchdb.Status(),
+		// kept for the monitoring tools that only look at CouchDB
+		"couchdb": results["couchdb"].Status,
+		"checks":  results,
 	})
 }
 
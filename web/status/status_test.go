@@ -1,25 +1,32 @@
 package status
 
 import (
-	"io/ioutil"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/dcasier/cozy-stack/couchdb"
+	"github.com/dcasier/cozy-stack/couchdb/couchdbtest"
 	"github.com/gin-gonic/gin"
+	"github.com/sourcegraph/checkup"
 	"github.com/stretchr/testify/assert"
 )
 
-func testRequest(t *testing.T, url string) {
+func testRequest(t *testing.T, url string) map[string]interface{} {
 	res, err := http.Get(url)
 	assert.NoError(t, err)
 	defer res.Body.Close()
 
-	body, ioerr := ioutil.ReadAll(res.Body)
-	assert.NoError(t, ioerr)
+	var body map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
 	assert.Equal(t, "200 OK", res.Status, "should get a 200")
-	assert.Equal(t, "{\"couchdb\":\"healthy\",\"message\":\"OK\"}\n", string(body), "res body should match")
+	return body
 }
 
 func TestRoutes(t *testing.T) {
@@ -29,10 +36,52 @@ func TestRoutes(t *testing.T) {
 	ts := httptest.NewServer(router)
 	defer ts.Close()
 
-	testRequest(t, ts.URL+"/status")
+	body := testRequest(t, ts.URL+"/status")
+	assert.Equal(t, "OK", body["message"])
+	assert.Equal(t, "healthy", body["status"])
+	assert.Equal(t, "healthy", body["couchdb"])
+	checks, _ := body["checks"].(map[string]interface{})
+	if assert.Contains(t, checks, "couchdb") {
+		couch := checks["couchdb"].(map[string]interface{})
+		assert.Equal(t, "healthy", couch["status"])
+		assert.Contains(t, couch, "latency_ms")
+	}
+
+	body = testRequest(t, ts.URL+"/status?probe")
+	assert.Equal(t, "OK", body["message"])
+	assert.NotContains(t, body, "checks")
+}
+
+func TestRunChecks(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	ko := func(ctx context.Context) error { return errors.New("unreachable") }
+	slow := func(ctx context.Context) error {
+		time.Sleep(slowThreshold + 10*time.Millisecond)
+		return nil
+	}
+
+	results := runChecks(context.Background(), map[string]Check{"a": ok, "b": slow})
+	assert.Equal(t, checkup.Healthy, results["a"].Status)
+	assert.Equal(t, checkup.Degraded, results["b"].Status)
+	assert.True(t, results["b"].Latency >= int64(slowThreshold/time.Millisecond))
+	assert.Equal(t, checkup.Degraded, overallStatus(results))
+
+	results = runChecks(context.Background(), map[string]Check{"a": ok, "b": ko})
+	assert.Equal(t, checkup.Down, results["b"].Status)
+	assert.Equal(t, checkup.Down, overallStatus(results))
+
+	results = runChecks(context.Background(), map[string]Check{"a": ok})
+	assert.Equal(t, checkup.Healthy, overallStatus(results))
 }
 
 func TestMain(m *testing.M) {
+	couchURL, stop := couchdbtest.Start()
+	if err := couchdb.UseServer(couchdb.ServerOptions{URL: couchURL}); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	gin.SetMode(gin.TestMode)
-	os.Exit(m.Run())
+	res := m.Run()
+	stop()
+	os.Exit(res)
 }